@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// checkArchiveOutput checks that the build writes an archive which flag can
+// refer to. Archives uploaded to object storage can only be referred to by
+// the URL given with urlFlag.
+func checkArchiveOutput(flag, urlFlag, outSpec, url string) error {
+	if *flagOutURL != "" {
+		if url == "" && fetchableOutURL() == "" {
+			return fmt.Errorf("%v with --out-url requires %v", flag, urlFlag)
+		}
+		return nil
+	}
+	_, _, err := localArchive(flag, outSpec)
+	return err
+}
+
+// builtArchive returns the URL, type (tar.zst or zip) and SHA256 of the
+// archive written by the build. Uploaded archives have been hashed while
+// uploading and default to the upload URL if it is fetchable, local ones are
+// hashed here and default to their file URL.
+func builtArchive(outSpec string, uploaded []byte, url string) (string, string, []byte, error) {
+	if *flagOutURL != "" {
+		if url == "" {
+			url = fetchableOutURL()
+		}
+		if strings.HasSuffix(*flagOutURL, ".zip") {
+			return url, "zip", uploaded, nil
+		}
+		return url, "tar.zst", uploaded, nil
+	}
+	path, typ, err := localArchive("", outSpec)
+	if err != nil {
+		return "", "", nil, err
+	}
+	sum, err := hashFile(path)
+	if err != nil {
+		return "", "", nil, err
+	}
+	if url == "" {
+		if url, err = fileURL(path); err != nil {
+			return "", "", nil, err
+		}
+	}
+	return url, typ, sum, nil
+}
+
+// fetchableOutURL returns the URL the archive uploaded to an HTTP server
+// can be downloaded from, empty if it isn't uploaded to one or the URL
+// contains credentials.
+func fetchableOutURL() string {
+	u, err := url.Parse(*flagOutURL)
+	if err != nil || u.User != nil {
+		return ""
+	}
+	switch u.Scheme {
+	case "http", "https":
+	case "dav":
+		u.Scheme = "http"
+	case "davs":
+		u.Scheme = "https"
+	default:
+		return ""
+	}
+	return u.String()
+}
+
+// localArchive returns the local path of the archive written by the build
+// and its type. flag names the option requiring an archive in errors.
+func localArchive(flag, outSpec string) (path, typ string, err error) {
+	parts := strings.SplitN(outSpec, ":", 2)
+	switch parts[0] {
+	case "tar":
+		return parts[1], "tar.zst", nil
+	case "zip", "wincontainer", "nupkg":
+		return parts[1], "zip", nil
+	}
+	return "", "", fmt.Errorf("%v requires an archive output (tar or zip), not %v", flag, parts[0])
+}
+
+// hashFile returns the SHA256 of the file at path.
+func hashFile(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// fileURL returns the file URL of the local path.
+func fileURL(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	abs = filepath.ToSlash(abs)
+	if !strings.HasPrefix(abs, "/") {
+		// Windows paths start with a drive letter
+		abs = "/" + abs
+	}
+	return "file://" + abs, nil
+}
@@ -0,0 +1,165 @@
+package authenticode
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func testCert(t *testing.T) (*x509.Certificate, *rsa.PrivateKey) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(42),
+		Subject: pkix.Name{
+			CommonName:   "Microsoft Corporation",
+			Organization: []string{"Microsoft Corporation"},
+			Locality:     []string{"Redmond"},
+			Province:     []string{"Washington"},
+			Country:      []string{"US"},
+		},
+		NotBefore:   time.Now().Add(-time.Hour),
+		NotAfter:    time.Now().Add(time.Hour),
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func mustMarshal(t *testing.T, v interface{}, params string) []byte {
+	t.Helper()
+	b, err := asn1.MarshalWithParams(v, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// contextTag wraps der in a constructed context-specific tag.
+func contextTag(tag int, der []byte) asn1.RawValue {
+	return asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: tag, IsCompound: true, Bytes: der}
+}
+
+// signDigest builds a PKCS#7 Authenticode signature over the given SHA256
+// payload digest.
+func signDigest(t *testing.T, cert *x509.Certificate, key *rsa.PrivateKey, payloadDigest []byte) []byte {
+	sha256ID := pkix.AlgorithmIdentifier{Algorithm: asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}, Parameters: asn1.NullRawValue}
+	var indirect spcIndirectDataContent
+	indirect.Data.Type = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 2, 1, 15}
+	indirect.MessageDigest = digestInfo{Algorithm: sha256ID, Digest: payloadDigest}
+	indirectDER := mustMarshal(t, indirect, "")
+	var content asn1.RawValue
+	asn1.Unmarshal(indirectDER, &content)
+	contentDigest := sha256.Sum256(content.Bytes)
+
+	digestValue := asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: mustMarshal(t, contentDigest[:], "")}
+	attrsSet := mustMarshal(t, []attribute{{Type: oidAttrMessageDigest, Values: digestValue}}, "set")
+	attrsDigest := sha256.Sum256(attrsSet)
+	sigValue, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, attrsDigest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var attrs asn1.RawValue
+	asn1.Unmarshal(attrsSet, &attrs)
+
+	sd := signedData{
+		Version:          1,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{sha256ID},
+		ContentInfo:      contentInfo{ContentType: oidSpcIndirectData, Content: contextTag(0, indirectDER)},
+		Certificates:     contextTag(0, cert.Raw),
+		SignerInfos: []signerInfo{{
+			Version:                   1,
+			IssuerAndSerial:           issuerAndSerial{Issuer: asn1.RawValue{FullBytes: cert.RawIssuer}, SerialNumber: cert.SerialNumber},
+			DigestAlgorithm:           sha256ID,
+			AuthenticatedAttributes:   contextTag(0, attrs.Bytes),
+			DigestEncryptionAlgorithm: pkix.AlgorithmIdentifier{Algorithm: asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}, Parameters: asn1.NullRawValue},
+			EncryptedDigest:           sigValue,
+		}},
+	}
+	return mustMarshal(t, contentInfo{ContentType: oidSignedData, Content: contextTag(0, mustMarshal(t, sd, ""))}, "")
+}
+
+// signedCAB returns a minimal cabinet with a header reserve pointing to an
+// Authenticode signature appended to it.
+func signedCAB(t *testing.T, cert *x509.Certificate, key *rsa.PrivateKey, body []byte) []byte {
+	header := make([]byte, 60)
+	copy(header, "MSCF")
+	binary.LittleEndian.PutUint16(header[30:], cabFlagReservePresent)
+	binary.LittleEndian.PutUint16(header[36:], 20)
+	cab := append(header, body...)
+	binary.LittleEndian.PutUint32(cab[40:], 0x00100000)
+	// The layout of the digest as computed by osslsigncode's
+	// cab_digest_calc: signature, cbCabinet to setID, the end of the
+	// reserve and everything after it.
+	h := sha256.New()
+	h.Write(cab[0:4])
+	h.Write(cab[8:34])
+	h.Write(cab[56:])
+	sig := signDigest(t, cert, key, h.Sum(nil))
+	binary.LittleEndian.PutUint32(cab[44:], uint32(len(cab)))
+	binary.LittleEndian.PutUint32(cab[48:], uint32(len(sig)))
+	return append(cab, sig...)
+}
+
+func TestVerifyCAB(t *testing.T) {
+	cert, key := testCert(t)
+	cab := signedCAB(t, cert, key, []byte("folders, files and data"))
+	sig, err := VerifyCAB(cab)
+	if err != nil {
+		t.Fatalf("VerifyCAB: %v", err)
+	}
+	if !sig.MatchesSubject("CN=Microsoft Corporation, O=Microsoft Corporation, L=Redmond, S=Washington, C=US") {
+		t.Error("signer doesn't match expected subject")
+	}
+	if sig.MatchesSubject("CN=Someone Else, O=Microsoft Corporation") {
+		t.Error("signer matches wrong subject")
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	if err := sig.VerifyChain(roots); err != nil {
+		t.Errorf("VerifyChain: %v", err)
+	}
+	if err := sig.VerifyChain(x509.NewCertPool()); err == nil {
+		t.Error("VerifyChain succeeded without trusted roots")
+	}
+	if err := sig.VerifyChain(nil); err == nil {
+		t.Error("VerifyChain trusted a root other than Microsoft's by default")
+	}
+
+	// iCabinet is not covered by the signature.
+	cab[34] ^= 1
+	if _, err := VerifyCAB(cab); err != nil {
+		t.Errorf("VerifyCAB with changed iCabinet: %v", err)
+	}
+	for _, i := range []int{8, 33, 57, 65} {
+		cab[i] ^= 1
+		if _, err := VerifyCAB(cab); err == nil {
+			t.Errorf("cabinet modified at %d verified successfully", i)
+		}
+		cab[i] ^= 1
+	}
+	unsigned := make([]byte, 60)
+	copy(unsigned, "MSCF")
+	if _, err := VerifyCAB(unsigned); !errors.Is(err, ErrNotSigned) {
+		t.Errorf("unsigned cabinet: got %v, want ErrNotSigned", err)
+	}
+}
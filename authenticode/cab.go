@@ -0,0 +1,90 @@
+package authenticode
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const (
+	cabFlagPrevCabinet    = 0x0001
+	cabFlagNextCabinet    = 0x0002
+	cabFlagReservePresent = 0x0004
+
+	// cabSignedReserve is the size of the header reserve of signed
+	// cabinets.
+	cabSignedReserve = 20
+)
+
+// VerifyCAB verifies the Authenticode signature of a cabinet file. The
+// signature is referenced from the per-cabinet reserved area of the header
+// and appended to the cabinet.
+func VerifyCAB(data []byte) (*Signature, error) {
+	return VerifyCABReader(bytes.NewReader(data), int64(len(data)))
+}
+
+// VerifyCABReader is like VerifyCAB for a cabinet of the given size read
+// from r.
+func VerifyCABReader(r io.ReaderAt, size int64) (*Signature, error) {
+	header := make([]byte, 40)
+	if size < 36 {
+		return nil, fmt.Errorf("not a cabinet file")
+	}
+	if size < 40 {
+		header = header[:size]
+	}
+	if _, err := r.ReadAt(header, 0); err != nil {
+		return nil, err
+	}
+	if string(header[:4]) != "MSCF" {
+		return nil, fmt.Errorf("not a cabinet file")
+	}
+	flags := binary.LittleEndian.Uint16(header[30:32])
+	if flags&cabFlagReservePresent == 0 || size < 40 {
+		return nil, ErrNotSigned
+	}
+	// Signed cabinets have a 20 byte header reserve, which holds the
+	// location of the signature.
+	if binary.LittleEndian.Uint16(header[36:38]) != cabSignedReserve || size < 40+cabSignedReserve {
+		return nil, ErrNotSigned
+	}
+	reserve := make([]byte, cabSignedReserve)
+	if _, err := r.ReadAt(reserve, 40); err != nil {
+		return nil, err
+	}
+	sigOffset := int64(binary.LittleEndian.Uint32(reserve[4:8]))
+	sigSize := int64(binary.LittleEndian.Uint32(reserve[8:12]))
+	if sigSize == 0 {
+		return nil, ErrNotSigned
+	}
+	if sigOffset < 40+cabSignedReserve || sigOffset+sigSize > size {
+		return nil, fmt.Errorf("signature location out of bounds")
+	}
+	der := make([]byte, sigSize)
+	if _, err := r.ReadAt(der, sigOffset); err != nil {
+		return nil, err
+	}
+	sig, err := Parse(der)
+	if err != nil {
+		return nil, err
+	}
+
+	// The digest skips the fields which are changed when signing or differ
+	// between the cabinets of a set: the first reserved field, iCabinet, the
+	// sizes of the reserved areas and the start of the header reserve up to
+	// the signature location. Everything from the last 4 bytes of the
+	// reserve up to the signature is included, like osslsigncode and
+	// Windows compute it.
+	h := sig.DigestAlgorithm.New()
+	h.Write(header[0:4])
+	h.Write(header[8:34])
+	h.Write(reserve[16:20])
+	if _, err := io.Copy(h, io.NewSectionReader(r, 40+cabSignedReserve, sigOffset-40-cabSignedReserve)); err != nil {
+		return nil, err
+	}
+	if err := sig.checkDigest(h.Sum(nil)); err != nil {
+		return nil, err
+	}
+	return sig, nil
+}
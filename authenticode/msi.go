@@ -0,0 +1,143 @@
+package authenticode
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/richardlehane/mscfb"
+)
+
+const (
+	msiSignatureStream   = "\x05DigitalSignature"
+	msiSignatureExStream = "\x05MsiDigitalSignatureEx"
+)
+
+// msiEntry is a node in the compound file directory tree.
+type msiEntry struct {
+	file     *mscfb.File
+	rawName  []byte
+	children []*msiEntry
+}
+
+// rawName returns the UTF-16LE encoded name of f as stored in the directory.
+// mscfb strips non-printable initial characters from the name.
+func rawName(f *mscfb.File) []byte {
+	name := f.Name
+	if f.Initial != 0 && !strings.HasPrefix(name, string(rune(f.Initial))) {
+		name = string(rune(f.Initial)) + name
+	}
+	return encodeName(name)
+}
+
+// encodeName encodes name as UTF-16LE.
+func encodeName(name string) []byte {
+	units := utf16.Encode([]rune(name))
+	b := make([]byte, 2*len(units))
+	for i, u := range units {
+		b[2*i], b[2*i+1] = byte(u), byte(u>>8)
+	}
+	return b
+}
+
+// clsid returns the binary CLSID of a directory entry.
+func clsid(id string) []byte {
+	raw, err := hex.DecodeString(strings.NewReplacer("{", "", "}", "", "-", "").Replace(id))
+	if err != nil || len(raw) != 16 {
+		return make([]byte, 16)
+	}
+	// The first three groups are stored little-endian.
+	raw[0], raw[1], raw[2], raw[3] = raw[3], raw[2], raw[1], raw[0]
+	raw[4], raw[5] = raw[5], raw[4]
+	raw[6], raw[7] = raw[7], raw[6]
+	return raw
+}
+
+// hashMSIEntry hashes the contents of all streams below e in directory
+// order, followed by the CLSID of e.
+func hashMSIEntry(h hash.Hash, e *msiEntry, root bool) error {
+	sort.Slice(e.children, func(i, j int) bool {
+		a, b := e.children[i].rawName, e.children[j].rawName
+		n := len(a)
+		if len(b) < n {
+			n = len(b)
+		}
+		if c := bytes.Compare(a[:n], b[:n]); c != 0 {
+			return c < 0
+		}
+		return len(a) < len(b)
+	})
+	for _, c := range e.children {
+		if root && (bytes.Equal(c.rawName, encodeName(msiSignatureStream)) || bytes.Equal(c.rawName, encodeName(msiSignatureExStream))) {
+			continue
+		}
+		if c.file.FileInfo().IsDir() {
+			if err := hashMSIEntry(h, c, false); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, err := io.Copy(h, c.file); err != nil {
+			return fmt.Errorf("failed to read stream %q: %w", c.file.Name, err)
+		}
+	}
+	h.Write(clsid(e.file.ID()))
+	return nil
+}
+
+// VerifyMSI verifies the Authenticode signature of an MSI database, which is
+// stored in the \x05DigitalSignature stream and covers all other streams.
+func VerifyMSI(r io.ReaderAt) (*Signature, error) {
+	doc, err := mscfb.New(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open MSI: %w", err)
+	}
+	// mscfb lists entries in tree order, reconstruct the tree by path.
+	root := &msiEntry{file: doc.File[0]}
+	storages := map[string]*msiEntry{"": root}
+	var sigRaw []byte
+	hasEx := false
+	for _, f := range doc.File[1:] {
+		e := &msiEntry{file: f, rawName: rawName(f)}
+		parent, ok := storages[strings.Join(f.Path, "/")]
+		if !ok {
+			return nil, fmt.Errorf("stream %q has no parent storage", f.Name)
+		}
+		parent.children = append(parent.children, e)
+		if f.FileInfo().IsDir() {
+			storages[strings.Join(append(append([]string{}, f.Path...), f.Name), "/")] = e
+		}
+		if parent == root && bytes.Equal(e.rawName, encodeName(msiSignatureStream)) {
+			if sigRaw, err = ioutil.ReadAll(f); err != nil {
+				return nil, fmt.Errorf("failed to read signature: %w", err)
+			}
+		}
+		if parent == root && bytes.Equal(e.rawName, encodeName(msiSignatureExStream)) {
+			hasEx = true
+		}
+	}
+	if sigRaw == nil {
+		return nil, ErrNotSigned
+	}
+	if hasEx {
+		return nil, fmt.Errorf("MSI signatures with extended metadata (MsiDigitalSignatureEx) are not supported")
+	}
+	sig, err := Parse(sigRaw)
+	if err != nil {
+		return nil, err
+	}
+	h := sig.DigestAlgorithm.New()
+	if err := hashMSIEntry(h, root, true); err != nil {
+		return nil, err
+	}
+	if err := sig.checkDigest(h.Sum(nil)); err != nil {
+		return nil, err
+	}
+	return sig, nil
+}
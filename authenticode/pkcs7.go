@@ -0,0 +1,308 @@
+// Package authenticode verifies Authenticode signatures embedded in the
+// payloads of the Visual Studio installer: PKCS#7 signatures in cabinet files
+// and MSI databases and OPC package signatures in VSIX files.
+package authenticode
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha1"
+	_ "crypto/sha256" // registers crypto.SHA256
+	_ "crypto/sha512" // registers crypto.SHA384 and crypto.SHA512
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// ErrNotSigned is returned if a payload doesn't carry a signature.
+var ErrNotSigned = errors.New("payload is not signed")
+
+var (
+	oidSignedData        = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidSpcIndirectData   = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 2, 1, 4}
+	oidAttrMessageDigest = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidAttrSigningTime   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 5}
+)
+
+var digestAlgorithms = map[string]crypto.Hash{
+	"1.3.14.3.2.26":          crypto.SHA1,
+	"2.16.840.1.101.3.4.2.1": crypto.SHA256,
+	"2.16.840.1.101.3.4.2.2": crypto.SHA384,
+	"2.16.840.1.101.3.4.2.3": crypto.SHA512,
+}
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,optional,tag:0"`
+}
+
+type issuerAndSerial struct {
+	Issuer       asn1.RawValue
+	SerialNumber *big.Int
+}
+
+type signerInfo struct {
+	Version                   int
+	IssuerAndSerial           issuerAndSerial
+	DigestAlgorithm           pkix.AlgorithmIdentifier
+	AuthenticatedAttributes   asn1.RawValue `asn1:"optional,tag:0"`
+	DigestEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedDigest           []byte
+	UnauthenticatedAttributes asn1.RawValue `asn1:"optional,tag:1"`
+}
+
+type signedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	ContentInfo      contentInfo
+	Certificates     asn1.RawValue `asn1:"optional,tag:0"`
+	CRLs             asn1.RawValue `asn1:"optional,tag:1"`
+	SignerInfos      []signerInfo  `asn1:"set"`
+}
+
+type attribute struct {
+	Type   asn1.ObjectIdentifier
+	Values asn1.RawValue `asn1:"set"`
+}
+
+type digestInfo struct {
+	Algorithm pkix.AlgorithmIdentifier
+	Digest    []byte
+}
+
+type spcIndirectDataContent struct {
+	Data struct {
+		Type  asn1.ObjectIdentifier
+		Value asn1.RawValue `asn1:"optional"`
+	}
+	MessageDigest digestInfo
+}
+
+// Signature is a parsed Authenticode signature whose internal consistency
+// has been verified: the signer's certificate signed the attributes, which
+// cover the signed content.
+type Signature struct {
+	// Certificates are all certificates contained in the signature.
+	Certificates []*x509.Certificate
+	// Signer is the certificate which made the signature.
+	Signer *x509.Certificate
+	// DigestAlgorithm is the algorithm Digest was computed with.
+	DigestAlgorithm crypto.Hash
+	// Digest is the signed digest of the payload. It is nil for signatures
+	// which don't sign a single digest of the payload.
+	Digest []byte
+	// SigningTime is the signing time claimed by the signer or the zero
+	// time if it didn't claim one.
+	SigningTime time.Time
+}
+
+// Parse parses a DER-encoded PKCS#7 Authenticode signature and checks its
+// internal consistency. It doesn't check the certificate chain, see
+// Signature.VerifyChain.
+func Parse(der []byte) (*Signature, error) {
+	var ci contentInfo
+	if _, err := asn1.Unmarshal(der, &ci); err != nil {
+		return nil, fmt.Errorf("invalid PKCS#7 structure: %w", err)
+	}
+	if !ci.ContentType.Equal(oidSignedData) {
+		return nil, fmt.Errorf("PKCS#7 content is %v, not signed data", ci.ContentType)
+	}
+	var sd signedData
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &sd); err != nil {
+		return nil, fmt.Errorf("invalid PKCS#7 signed data: %w", err)
+	}
+	if !sd.ContentInfo.ContentType.Equal(oidSpcIndirectData) {
+		return nil, fmt.Errorf("signed content is %v, not Authenticode data", sd.ContentInfo.ContentType)
+	}
+	if len(sd.SignerInfos) != 1 {
+		return nil, fmt.Errorf("expected exactly one signer, got %d", len(sd.SignerInfos))
+	}
+	certs, err := x509.ParseCertificates(sd.Certificates.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid certificate in signature: %w", err)
+	}
+	si := sd.SignerInfos[0]
+	sig := &Signature{Certificates: certs}
+	for _, c := range certs {
+		if bytes.Equal(c.RawIssuer, si.IssuerAndSerial.Issuer.FullBytes) && c.SerialNumber.Cmp(si.IssuerAndSerial.SerialNumber) == 0 {
+			sig.Signer = c
+			break
+		}
+	}
+	if sig.Signer == nil {
+		return nil, fmt.Errorf("signing certificate not included in signature")
+	}
+
+	// The content digest covers the SpcIndirectDataContent without its
+	// outer tag and length.
+	var content asn1.RawValue
+	if _, err := asn1.Unmarshal(sd.ContentInfo.Content.Bytes, &content); err != nil {
+		return nil, fmt.Errorf("invalid signed content: %w", err)
+	}
+	var indirect spcIndirectDataContent
+	if _, err := asn1.Unmarshal(sd.ContentInfo.Content.Bytes, &indirect); err != nil {
+		return nil, fmt.Errorf("invalid Authenticode data: %w", err)
+	}
+	var ok bool
+	sig.DigestAlgorithm, ok = digestAlgorithms[indirect.MessageDigest.Algorithm.Algorithm.String()]
+	if !ok {
+		return nil, fmt.Errorf("unsupported payload digest algorithm %v", indirect.MessageDigest.Algorithm.Algorithm)
+	}
+	sig.Digest = indirect.MessageDigest.Digest
+
+	hash, ok := digestAlgorithms[si.DigestAlgorithm.Algorithm.String()]
+	if !ok {
+		return nil, fmt.Errorf("unsupported signer digest algorithm %v", si.DigestAlgorithm.Algorithm)
+	}
+	if len(si.AuthenticatedAttributes.FullBytes) == 0 {
+		return nil, fmt.Errorf("signature has no authenticated attributes")
+	}
+	// The attributes are signed as a SET, not with their implicit tag.
+	signedAttrs := append([]byte{0x31}, si.AuthenticatedAttributes.FullBytes[1:]...)
+	var attrs []attribute
+	if _, err := asn1.UnmarshalWithParams(signedAttrs, &attrs, "set"); err != nil {
+		return nil, fmt.Errorf("invalid authenticated attributes: %w", err)
+	}
+	var messageDigest []byte
+	for _, a := range attrs {
+		switch {
+		case a.Type.Equal(oidAttrMessageDigest):
+			if _, err := asn1.Unmarshal(a.Values.Bytes, &messageDigest); err != nil {
+				return nil, fmt.Errorf("invalid message digest attribute: %w", err)
+			}
+		case a.Type.Equal(oidAttrSigningTime):
+			asn1.Unmarshal(a.Values.Bytes, &sig.SigningTime)
+		}
+	}
+	h := hash.New()
+	h.Write(content.Bytes)
+	if messageDigest == nil || !bytes.Equal(h.Sum(nil), messageDigest) {
+		return nil, fmt.Errorf("signed attributes don't match the signed content")
+	}
+	algo, err := signatureAlgorithm(sig.Signer, hash)
+	if err != nil {
+		return nil, err
+	}
+	if err := sig.Signer.CheckSignature(algo, signedAttrs, si.EncryptedDigest); err != nil {
+		return nil, fmt.Errorf("invalid signature: %w", err)
+	}
+	return sig, nil
+}
+
+func signatureAlgorithm(cert *x509.Certificate, hash crypto.Hash) (x509.SignatureAlgorithm, error) {
+	algos := map[x509.PublicKeyAlgorithm]map[crypto.Hash]x509.SignatureAlgorithm{
+		x509.RSA: {
+			crypto.SHA1:   x509.SHA1WithRSA,
+			crypto.SHA256: x509.SHA256WithRSA,
+			crypto.SHA384: x509.SHA384WithRSA,
+			crypto.SHA512: x509.SHA512WithRSA,
+		},
+		x509.ECDSA: {
+			crypto.SHA1:   x509.ECDSAWithSHA1,
+			crypto.SHA256: x509.ECDSAWithSHA256,
+			crypto.SHA384: x509.ECDSAWithSHA384,
+			crypto.SHA512: x509.ECDSAWithSHA512,
+		},
+	}
+	if algo, ok := algos[cert.PublicKeyAlgorithm][hash]; ok {
+		return algo, nil
+	}
+	return 0, fmt.Errorf("unsupported signature algorithm %v with %v", cert.PublicKeyAlgorithm, hash)
+}
+
+// checkDigest compares the signed digest with digest, which must have been
+// computed with s.DigestAlgorithm.
+func (s *Signature) checkDigest(digest []byte) error {
+	if !bytes.Equal(s.Digest, digest) {
+		return fmt.Errorf("payload doesn't match its signature")
+	}
+	return nil
+}
+
+// microsoftRoots are the SHA-1 thumbprints of the roots of Microsoft's code
+// signing certificates, which VerifyChain trusts by default.
+var microsoftRoots = map[string]bool{
+	"8f43288ad272f3103b6fb1428485ea3014c0bcfe": true, // Microsoft Root Certificate Authority 2011
+	"3b1efd3a66ea28b16697394703a72ca340a05bd5": true, // Microsoft Root Certificate Authority 2010
+}
+
+// VerifyChain checks that the signing certificate chains up to one of roots
+// using the other certificates in the signature as intermediates. If roots
+// is nil, only the Microsoft code signing roots are trusted, which then
+// have to be included in the signature. Because payloads are usually
+// signed with certificates which have since expired, the chain is checked
+// at the signing time, or if there is none, at the start of the signer's
+// validity period.
+func (s *Signature) VerifyChain(roots *x509.CertPool) error {
+	intermediates := x509.NewCertPool()
+	for _, c := range s.Certificates {
+		if c != s.Signer {
+			intermediates.AddCert(c)
+		}
+	}
+	if roots == nil {
+		roots = x509.NewCertPool()
+		for _, c := range s.Certificates {
+			thumbprint := sha1.Sum(c.Raw)
+			if microsoftRoots[hex.EncodeToString(thumbprint[:])] {
+				roots.AddCert(c)
+			}
+		}
+	}
+	t := s.SigningTime
+	if t.IsZero() {
+		t = s.Signer.NotBefore
+	}
+	_, err := s.Signer.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   t,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	return err
+}
+
+// MatchesSubject reports whether the signer's subject matches a subject name
+// in the form used by the installer manifest, like
+// "CN=Microsoft Corporation, O=Microsoft Corporation, L=Redmond, S=Washington, C=US".
+// Only the attributes present in subject are compared.
+func (s *Signature) MatchesSubject(subject string) bool {
+	name := s.Signer.Subject
+	fields := map[string][]string{
+		"CN": {name.CommonName},
+		"O":  name.Organization,
+		"OU": name.OrganizationalUnit,
+		"L":  name.Locality,
+		"S":  name.Province,
+		"ST": name.Province,
+		"C":  name.Country,
+	}
+	matched := false
+	for _, part := range strings.Split(subject, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		values, ok := fields[strings.ToUpper(kv[0])]
+		if !ok {
+			continue
+		}
+		found := false
+		for _, v := range values {
+			if v == kv[1] {
+				found = true
+			}
+		}
+		if !found {
+			return false
+		}
+		matched = true
+	}
+	return matched
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"os"
+	"text/template"
+)
+
+var (
+	flagBazelSnippet = flag.String("bazel-snippet", "", "After building an archive, write a Bazel stanza fetching it to this path (- for stdout)")
+	flagBazelFormat  = flag.String("bazel-format", "workspace", "Format of --bazel-snippet: workspace (http_archive) or module (bazel_dep with archive_override for MODULE.bazel)")
+	flagBazelURL     = flag.String("bazel-url", "", "URL the archive is published at, used in --bazel-snippet (default: file URL of the local archive)")
+	flagBazelName    = flag.String("bazel-name", "winsysroot", "Name of the Bazel repository or module in --bazel-snippet")
+)
+
+// bazelBuildFile makes all files of the sysroot available to toolchains.
+const bazelBuildFile = `filegroup(
+    name = "sysroot",
+    srcs = glob(["**"]),
+    visibility = ["//visibility:public"],
+)`
+
+var bazelTemplates = map[string]*template.Template{
+	"workspace": template.Must(template.New("workspace").Parse(`load("@bazel_tools//tools/build_defs/repo:http.bzl", "http_archive")
+
+http_archive(
+    name = {{printf "%q" .Name}},
+    urls = [{{printf "%q" .URL}}],
+    sha256 = {{printf "%q" .SHA256}},
+    type = {{printf "%q" .Type}},
+    build_file_content = """{{.BuildFile}}
+""",
+)
+`)),
+	"module": template.Must(template.New("module").Parse(`bazel_dep(name = {{printf "%q" .Name}})
+
+archive_override(
+    module_name = {{printf "%q" .Name}},
+    urls = [{{printf "%q" .URL}}],
+    integrity = {{printf "%q" .Integrity}},
+    # The archive only contains the sysroot, so the module files are created here.
+    patch_cmds = [
+        {{printf "%q" .ModuleCmd}},
+        {{printf "%q" .BuildCmd}},
+    ],
+)
+`)),
+}
+
+// checkBazelFlags validates the --bazel-* flags before anything is built.
+func checkBazelFlags(outSpec string) error {
+	if *flagBazelSnippet == "" {
+		return nil
+	}
+	if _, ok := bazelTemplates[*flagBazelFormat]; !ok {
+		return fmt.Errorf("unknown --bazel-format %q, supported are workspace and module", *flagBazelFormat)
+	}
+	return checkArchiveOutput("--bazel-snippet", "--bazel-url", outSpec, *flagBazelURL)
+}
+
+// emitBazelSnippet writes the stanza for the archive written by the build.
+func emitBazelSnippet(outSpec string, uploaded []byte) error {
+	url, typ, sum, err := builtArchive(outSpec, uploaded, *flagBazelURL)
+	if err != nil {
+		return err
+	}
+	return writeBazelSnippet(url, typ, sum)
+}
+
+// writeBazelSnippet writes the stanza fetching the archive with the given
+// SHA256 from url to --bazel-snippet.
+func writeBazelSnippet(url, typ string, sum []byte) error {
+	tmpl := bazelTemplates[*flagBazelFormat]
+	data := struct {
+		Name, URL, Type, SHA256, Integrity string
+		BuildFile, ModuleCmd, BuildCmd     string
+	}{
+		Name:      *flagBazelName,
+		URL:       url,
+		Type:      typ,
+		SHA256:    fmt.Sprintf("%x", sum),
+		Integrity: "sha256-" + base64.StdEncoding.EncodeToString(sum),
+		BuildFile: bazelBuildFile,
+		ModuleCmd: fmt.Sprintf("echo 'module(name = %q)' > MODULE.bazel", *flagBazelName),
+		BuildCmd:  "cat > BUILD.bazel <<'EOF'\n" + bazelBuildFile + "\nEOF",
+	}
+	if *flagBazelSnippet == "-" {
+		return tmpl.Execute(os.Stdout, &data)
+	}
+	f, err := os.Create(*flagBazelSnippet)
+	if err != nil {
+		return err
+	}
+	if err := tmpl.Execute(f, &data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
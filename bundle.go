@@ -0,0 +1,483 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+
+	"git.dolansoft.org/lorenz/winsysroot/sysroot"
+	"git.dolansoft.org/lorenz/winsysroot/target"
+)
+
+func init() {
+	subcommands = append(subcommands, &subcommand{
+		name:  "bundle",
+		short: "Create an archive of everything a build downloads (create) and build from it without network access (build)",
+		setup: setupBundle,
+	})
+}
+
+// bundleIndexName is the name of the file describing a bundle, it is the
+// last one in the archive.
+const bundleIndexName = "bundle.json"
+
+// bundleIndex describes the configuration a bundle was created for and the
+// recorded HTTP responses.
+type bundleIndex struct {
+	VSRelease     string                     `json:"vsRelease"`
+	WinSDKVersion string                     `json:"winSdkVersion"`
+	Architectures []string                   `json:"architectures"`
+	HostArch      string                     `json:"hostArch,omitempty"`
+	Toolsets      []string                   `json:"msvcToolsets,omitempty"`
+	Slim          bool                       `json:"slim"`
+	SDKFeatures   []string                   `json:"sdkFeatures,omitempty"`
+	Created       time.Time                  `json:"created"`
+	Responses     map[string]*bundleResponse `json:"responses"`
+}
+
+// bundleResponse is a recorded response to a GET request. Redirects have a
+// location, all other responses a body stored at path in the bundle.
+type bundleResponse struct {
+	Status      int    `json:"status"`
+	Location    string `json:"location,omitempty"`
+	ContentType string `json:"contentType,omitempty"`
+	Path        string `json:"path,omitempty"`
+	Size        int64  `json:"size,omitempty"`
+	SHA256      string `json:"sha256,omitempty"`
+}
+
+func setupBundle(fs *flag.FlagSet) func(ctx context.Context) error {
+	vsRelease := fs.String("vs-release", *flagVSRelease, "create: "+flag.Lookup("vs-release").Usage)
+	winSDKVersion := fs.String("win-sdk-version", *flagWinSDKVersion, "create: "+flag.Lookup("win-sdk-version").Usage)
+	archs := fs.String("architectures", *flagArchitectures, "create: "+flag.Lookup("architectures").Usage)
+	fs.StringVar(flagHostArch, "host-arch", *flagHostArch, "create: "+flag.Lookup("host-arch").Usage)
+	fs.StringVar(flagMSVCToolsets, "msvc-toolsets", *flagMSVCToolsets, "create: "+flag.Lookup("msvc-toolsets").Usage)
+	slim := fs.Bool("slim", *flagSlim, "create: "+flag.Lookup("slim").Usage)
+	sdkFeatures := fs.String("sdk-features", "", "create: "+flag.Lookup("sdk-features").Usage)
+	nearest := fs.Bool("nearest", false, "create: "+flag.Lookup("nearest").Usage)
+	fs.StringVar(flagOut, "out", "", "build: "+flag.Lookup("out").Usage)
+	fs.StringVar(flagOutDir, "out-dir", "", "build: "+flag.Lookup("out-dir").Usage)
+	fs.StringVar(flagOutTar, "out-tar", "", "build: "+flag.Lookup("out-tar").Usage)
+	fs.StringVar(flagVFSRoot, "vfs-root", *flagVFSRoot, "build: "+flag.Lookup("vfs-root").Usage)
+	fs.IntVar(flagExtractWorkers, "extract-workers", 0, "build: "+flag.Lookup("extract-workers").Usage)
+	fs.BoolVar(flagAcceptLicenses, "accept-licenses", false, flag.Lookup("accept-licenses").Usage)
+	fs.BoolVar(flagProgress, "progress", false, flag.Lookup("progress").Usage)
+	fs.StringVar(flagTempDir, "temp-dir", "", flag.Lookup("temp-dir").Usage)
+	registerHTTPFlags(fs)
+	registerTrustFlags(fs)
+	registerLimitFlags(fs)
+	return func(ctx context.Context) error {
+		usage := stageErrorf(stageUsage, "", "", "usage: winsysroot bundle create|build [flags] <bundle.tar.zst>")
+		if fs.NArg() == 0 {
+			return usage
+		}
+		verb := fs.Arg(0)
+		// Flags following the verb are only parsed now.
+		if err := fs.Parse(fs.Args()[1:]); err != nil {
+			return stageErrorf(stageUsage, "", "", "%w", err)
+		}
+		if fs.NArg() != 1 {
+			return usage
+		}
+		switch verb {
+		case "create":
+			var features []string
+			if *sdkFeatures != "" {
+				features = strings.Split(*sdkFeatures, ",")
+			}
+			return runBundleCreate(ctx, fs.Arg(0), *vsRelease, *winSDKVersion, strings.Split(*archs, ","), *slim, features, *nearest)
+		case "build":
+			return runBundleBuild(ctx, fs.Arg(0))
+		}
+		return usage
+	}
+}
+
+// runBundleCreate builds the sysroot without writing it anywhere while
+// recording all responses into the bundle.
+func runBundleCreate(ctx context.Context, path, vsRelease, winSDKVersion string, architectures []string, slim bool, sdkFeatures []string, nearest bool) (err error) {
+	out, err := target.NewTar(path)
+	if err != nil {
+		return stageErrorf(stageOutput, "", "", "%w", err)
+	}
+	w := &bundleWriter{out: out, responses: make(map[string]*bundleResponse)}
+	defer func() {
+		if err != nil {
+			out.Close()
+			os.Remove(path)
+		}
+	}()
+	wrapTransport = func(rt http.RoundTripper) http.RoundTripper {
+		return &recordingTransport{rt: rt, w: w}
+	}
+	_, manifest, err := fetchManifests(ctx, vsRelease)
+	if err != nil {
+		return err
+	}
+	sdkVersion, err := sysroot.ResolveSDKVersion(manifest, winSDKVersion, nearest)
+	if err != nil {
+		return err
+	}
+	acRoots, err := authenticodeRoots()
+	if err != nil {
+		return stageErrorf(stageUsage, "", "", "%w", err)
+	}
+	hc, err := httpClient()
+	if err != nil {
+		return stageErrorf(stageUsage, "", "", "%w", err)
+	}
+	err = sysroot.Build(ctx, sysroot.Options{
+		Manifest:                 manifest,
+		WinSDKVersion:            sdkVersion,
+		Architectures:            architectures,
+		HostArch:                 *flagHostArch,
+		Toolsets:                 strings.Split(*flagMSVCToolsets, ","),
+		Slim:                     slim,
+		SDKFeatures:              sdkFeatures,
+		HTTPClient:               hc,
+		Header:                   httpHeader(),
+		RequestTimeout:           httpRequestTimeout,
+		Events:                   buildEvents(),
+		AcceptLicenses:           *flagAcceptLicenses,
+		Limits:                   &limits,
+		OnChecksumMismatch:       onChecksumMismatch,
+		RequireSigner:            requireSigner,
+		Authenticode:             verifyAuthenticode,
+		AuthenticodeRoots:        acRoots,
+		AuthenticodeIdentityOnly: authenticodeIdentity,
+		TempDir:                  *flagTempDir,
+	}, discardTarget{})
+	if err != nil {
+		return err
+	}
+	if err := w.close(&bundleIndex{
+		VSRelease:     vsRelease,
+		WinSDKVersion: sdkVersion,
+		Architectures: architectures,
+		HostArch:      *flagHostArch,
+		Toolsets:      strings.Split(*flagMSVCToolsets, ","),
+		Slim:          slim,
+		SDKFeatures:   sdkFeatures,
+		Created:       time.Now(),
+	}); err != nil {
+		return stageErrorf(stageOutput, "", "", "failed to write bundle: %w", err)
+	}
+	log.Printf("Wrote bundle with %d responses to %v, build it with: winsysroot bundle build --out-dir=<dir> --accept-licenses %v", len(w.responses), path, path)
+	return nil
+}
+
+// runBundleBuild runs a regular build with the configuration of the bundle,
+// all requests are answered from it.
+func runBundleBuild(ctx context.Context, path string) error {
+	if checkRevocation {
+		// CRLs are downloaded directly, not through the replay transport.
+		return stageErrorf(stageUsage, "", "", "--check-revocation can't be used with bundle build, bundles don't contain CRLs")
+	}
+	dir, err := ioutil.TempDir(*flagTempDir, "winsysroot-bundle-")
+	if err != nil {
+		return stageErrorf(stageUsage, "", "", "%w", err)
+	}
+	defer os.RemoveAll(dir)
+	idx, err := extractBundle(path, dir)
+	if err != nil {
+		return stageErrorf(stageUsage, "", "", "invalid bundle %v: %w", path, err)
+	}
+	*flagVSRelease = idx.VSRelease
+	*flagWinSDKVersion = idx.WinSDKVersion
+	*flagArchitectures = strings.Join(idx.Architectures, ",")
+	*flagSlim = idx.Slim
+	if idx.HostArch != "" {
+		*flagHostArch = idx.HostArch
+	}
+	if len(idx.Toolsets) > 0 {
+		*flagMSVCToolsets = strings.Join(idx.Toolsets, ",")
+	}
+	*flagSDKFeatures = strings.Join(idx.SDKFeatures, ",")
+	log.Printf("Building Windows SDK %v for %v from bundle created %v", idx.WinSDKVersion, *flagArchitectures, idx.Created.Format(time.RFC3339))
+	replay := &replayTransport{dir: dir, responses: idx.Responses}
+	wrapTransport = func(http.RoundTripper) http.RoundTripper {
+		return replay
+	}
+	return run(ctx)
+}
+
+// bundleWriter writes recorded responses into the bundle.
+type bundleWriter struct {
+	mu        sync.Mutex
+	out       *target.Tar
+	responses map[string]*bundleResponse
+	err       error
+}
+
+// add records a response whose body, if any, has been written to body.
+func (w *bundleWriter) add(url string, r *bundleResponse, body *os.File) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, ok := w.responses[url]; ok || w.err != nil {
+		return
+	}
+	if body != nil {
+		sum := sha256.Sum256([]byte(url))
+		r.Path = "responses/" + hex.EncodeToString(sum[:])
+		if _, err := body.Seek(0, io.SeekStart); err != nil {
+			w.err = err
+			return
+		}
+		if err := w.out.Create(r.Path, r.Size, time.Now()); err != nil {
+			w.err = err
+			return
+		}
+		if _, err := io.Copy(w.out, body); err != nil {
+			w.err = err
+			return
+		}
+	}
+	w.responses[url] = r
+}
+
+// close writes the index and finishes the bundle.
+func (w *bundleWriter) close(idx *bundleIndex) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return w.err
+	}
+	idx.Responses = w.responses
+	raw, err := json.MarshalIndent(idx, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := w.out.Create(bundleIndexName, int64(len(raw)), time.Now()); err != nil {
+		return err
+	}
+	if _, err := w.out.Write(raw); err != nil {
+		return err
+	}
+	return w.out.Close()
+}
+
+// recordingTransport passes requests to rt and records redirects and
+// completely read successful responses.
+type recordingTransport struct {
+	rt http.RoundTripper
+	w  *bundleWriter
+}
+
+func (t *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := t.rt.RoundTrip(req)
+	if err != nil || req.Method != http.MethodGet || req.Header.Get("Range") != "" {
+		return res, err
+	}
+	url := req.URL.String()
+	switch {
+	case res.StatusCode >= 300 && res.StatusCode < 400 && res.Header.Get("Location") != "":
+		t.w.add(url, &bundleResponse{Status: res.StatusCode, Location: res.Header.Get("Location")}, nil)
+	case res.StatusCode == http.StatusOK:
+		f, err := ioutil.TempFile(*flagTempDir, ".winsysroot-response-")
+		if err != nil {
+			res.Body.Close()
+			return nil, err
+		}
+		res.Body = &recordingBody{
+			ReadCloser: res.Body,
+			f:          f,
+			h:          sha256.New(),
+			done: func(f *os.File, size int64, sum []byte) {
+				t.w.add(url, &bundleResponse{
+					Status:      http.StatusOK,
+					ContentType: res.Header.Get("Content-Type"),
+					Size:        size,
+					SHA256:      hex.EncodeToString(sum),
+				}, f)
+			},
+		}
+	}
+	return res, nil
+}
+
+// recordingBody copies a response body into a temporary file. If it has
+// been read completely, done is called when closing it.
+type recordingBody struct {
+	io.ReadCloser
+	f      *os.File
+	h      hash.Hash
+	size   int64
+	failed bool
+	eof    bool
+	done   func(f *os.File, size int64, sum []byte)
+}
+
+func (b *recordingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if _, werr := b.f.Write(p[:n]); werr != nil {
+		b.failed = true
+	}
+	b.h.Write(p[:n])
+	b.size += int64(n)
+	if err == io.EOF {
+		b.eof = true
+	}
+	return n, err
+}
+
+func (b *recordingBody) Close() error {
+	err := b.ReadCloser.Close()
+	if b.f != nil {
+		if b.eof && !b.failed {
+			b.done(b.f, b.size, b.h.Sum(nil))
+		}
+		b.f.Close()
+		os.Remove(b.f.Name())
+		b.f = nil
+	}
+	return err
+}
+
+// replayTransport answers requests with the responses recorded in a bundle
+// extracted to dir.
+type replayTransport struct {
+	dir       string
+	responses map[string]*bundleResponse
+}
+
+func (t *replayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	r, ok := t.responses[req.URL.String()]
+	if !ok || req.Method != http.MethodGet {
+		return nil, fmt.Errorf("%v %v is not in the bundle, which only contains what building its configuration downloads", req.Method, req.URL)
+	}
+	res := &http.Response{
+		Status:     fmt.Sprintf("%d %v", r.Status, http.StatusText(r.Status)),
+		StatusCode: r.Status,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Body:       http.NoBody,
+		Request:    req,
+	}
+	if r.Location != "" {
+		res.Header.Set("Location", r.Location)
+	}
+	if r.Path != "" {
+		f, err := os.Open(filepath.Join(t.dir, filepath.FromSlash(r.Path)))
+		if err != nil {
+			return nil, err
+		}
+		res.Body = f
+		res.ContentLength = r.Size
+		if r.ContentType != "" {
+			res.Header.Set("Content-Type", r.ContentType)
+		}
+	}
+	return res, nil
+}
+
+// extractBundle extracts the bundle at path into dir and returns its index
+// after checking the hashes of all responses.
+func extractBundle(path, dir string) (*bundleIndex, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	zr, err := zstd.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	sums := make(map[string]string)
+	var idx *bundleIndex
+	tr := tar.NewReader(zr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		name, err := target.CleanPath(hdr.Name)
+		if err != nil {
+			return nil, err
+		}
+		if name == bundleIndexName {
+			idx = new(bundleIndex)
+			if err := json.NewDecoder(tr).Decode(idx); err != nil {
+				return nil, fmt.Errorf("failed to parse %v: %w", bundleIndexName, err)
+			}
+			continue
+		}
+		dest := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+			return nil, err
+		}
+		out, err := os.Create(dest)
+		if err != nil {
+			return nil, err
+		}
+		h := sha256.New()
+		_, err = io.Copy(io.MultiWriter(out, h), tr)
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return nil, err
+		}
+		sums[name] = hex.EncodeToString(h.Sum(nil))
+	}
+	if idx == nil {
+		return nil, fmt.Errorf("%v is missing", bundleIndexName)
+	}
+	var problems []string
+	for url, r := range idx.Responses {
+		if r == nil {
+			problems = append(problems, url)
+			continue
+		}
+		if r.Path == "" {
+			continue
+		}
+		// The replay transport opens the path, so it must be one of the
+		// extracted files.
+		name, err := target.CleanPath(r.Path)
+		sum, ok := sums[name]
+		if err != nil || !ok || r.SHA256 == "" || sum != r.SHA256 {
+			problems = append(problems, url)
+			continue
+		}
+		r.Path = name
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return nil, errors.New("missing or corrupted responses for " + strings.Join(problems, ", "))
+	}
+	return idx, nil
+}
+
+// discardTarget drops everything written to it.
+type discardTarget struct{}
+
+func (discardTarget) Create(path string, size int64, modTime time.Time) error { return nil }
+func (discardTarget) Write(b []byte) (int, error)                             { return len(b), nil }
+func (discardTarget) Close() error                                            { return nil }
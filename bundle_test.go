@@ -0,0 +1,52 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"git.dolansoft.org/lorenz/winsysroot/target"
+)
+
+func TestExtractBundleChecksResponses(t *testing.T) {
+	body := []byte("payload")
+	sum := sha256.Sum256(body)
+	goodSum := hex.EncodeToString(sum[:])
+	for _, tc := range []struct {
+		name string
+		r    *bundleResponse
+		ok   bool
+	}{
+		{"valid", &bundleResponse{Status: 200, Path: "responses/a", SHA256: goodSum}, true},
+		{"redirect", &bundleResponse{Status: 302, Location: "https://example.com/"}, true},
+		{"wrong hash", &bundleResponse{Status: 200, Path: "responses/a", SHA256: "00"}, false},
+		{"no hash", &bundleResponse{Status: 200, Path: "responses/a"}, false},
+		{"missing file", &bundleResponse{Status: 200, Path: "responses/b"}, false},
+		{"outside", &bundleResponse{Status: 200, Path: "../a", SHA256: goodSum}, false},
+		{"index", &bundleResponse{Status: 200, Path: bundleIndexName}, false},
+		{"null", nil, false},
+	} {
+		dir := t.TempDir()
+		path := filepath.Join(dir, "bundle.tar.zst")
+		out, err := target.NewTar(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := out.Create("responses/a", int64(len(body)), time.Now()); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := out.Write(body); err != nil {
+			t.Fatal(err)
+		}
+		w := &bundleWriter{out: out, responses: map[string]*bundleResponse{"https://example.com/a": tc.r}}
+		if err := w.close(&bundleIndex{}); err != nil {
+			t.Fatal(err)
+		}
+		_, err = extractBundle(path, filepath.Join(dir, "out"))
+		if (err == nil) != tc.ok {
+			t.Errorf("%v: extractBundle returned %v", tc.name, err)
+		}
+	}
+}
@@ -18,11 +18,12 @@
 // Cabinet files produced by gcab for the LVFS project.
 //
 // Normative references for this implementation are [MS-CAB] for the Cabinet
-// file format and [MS-MCI] for the Microsoft ZIP Compression and Decompression
-// Data Structure.
+// file format, [MS-MCI] for the Microsoft ZIP Compression and Decompression
+// Data Structure and [MS-PATCH] for the LZX Data Compression Format.
 //
 // [MS-CAB]: http://download.microsoft.com/download/4/d/a/4da14f27-b4ef-4170-a6e6-5b1ef85b1baa/[ms-cab].pdf
 // [MS-MCI]: http://interoperability.blob.core.windows.net/files/MS-MCI/[MS-MCI].pdf
+// [MS-PATCH]: https://interoperability.blob.core.windows.net/files/MS-PATCH/[MS-PATCH].pdf
 package cab
 
 import (
@@ -33,25 +34,102 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"math"
 	"sort"
+	"strings"
 	"time"
 )
 
 // Cabinet provides read-only access to Microsoft Cabinet files.
 type Cabinet struct {
-	r     io.ReadSeeker
-	hdr   *cfHeader
-	fldrs []*cfFolder
-	files []*file
+	fldrs    []*folder
+	files    []*file
+	siblings []string
 
 	fileIdx    int
 	fileReader io.Reader
 
 	folderIdx uint16
-	folderBuf []byte
+	folder    *folderFiles
+
+	// Used by Content, nil if disabled
+	cache *folderCache
+	// nil unless Options.Progress is set
+	progress *progress
+
+	opts Options
+}
+
+// Options configure how a Cabinet is read.
+type Options struct {
+	// MaxFolderSize limits the uncompressed size of a single folder, which
+	// is held in memory completely while extracting files from it. Zero
+	// means no limit.
+	MaxFolderSize int64
+	// MaxRatio limits the ratio between the uncompressed and compressed
+	// size of a folder. It is only enforced once a folder has produced at
+	// least 1MiB of data. Zero means no limit.
+	MaxRatio float64
+	// OpenCabinet opens another cabinet of a multi-part set given its file
+	// name as stored in the header. It is required for reading cabinets
+	// which span multiple files.
+	OpenCabinet func(name string) (io.ReadSeeker, error)
+	// VerifyChecksums enables checking the checksums of data blocks. Blocks
+	// without a checksum (which is allowed by the format) are not checked.
+	VerifyChecksums bool
+	// DecodeName converts file names which aren't marked as UTF-8 from the
+	// OEM code page of the system the cabinet was created on. It defaults to
+	// DecodeCP437.
+	DecodeName func(name []byte) string
+	// FolderCacheSize is the maximum total size of decompressed folders
+	// Content keeps in memory to serve further files from them. Zero
+	// disables the cache.
+	FolderCacheSize int64
+	// Lenient tolerates deviations from the format which are harmless for
+	// reading the cabinet, like unknown minor versions, nonzero reserved
+	// fields or a wrong cabinet size in the header. They are reported to
+	// Warn instead of failing.
+	Lenient bool
+	// Warn receives a description of each deviation tolerated by Lenient.
+	// It may be nil.
+	Warn func(msg string)
+	// Progress, if set, is called after every data block and file read
+	// from the Cabinet. Calls are serialized, even with ExtractParallel.
+	Progress func(Progress)
+	// WantFile, if set, is called with the name of every file before Next
+	// decompresses its folder. Folders without any wanted file are skipped
+	// completely and their files not returned by Next.
+	WantFile func(name string) bool
+}
+
+// quirk reports a deviation from the format. It returns an error unless
+// o.Lenient is set.
+func (o *Options) quirk(format string, args ...interface{}) error {
+	if !o.Lenient {
+		return fmt.Errorf(format, args...)
+	}
+	if o.Warn != nil {
+		o.Warn(fmt.Sprintf(format, args...))
+	}
+	return nil
 }
 
+// ErrLimitExceeded is returned if extracting a Cabinet would exceed one of
+// the limits set in Options.
+var ErrLimitExceeded = errors.New("resource limit exceeded")
+
+// ErrChecksum is returned if a data block doesn't match its checksum and
+// Options.VerifyChecksums is set.
+var ErrChecksum = errors.New("data block checksum mismatch")
+
+// ratioGrace is the amount of uncompressed data a folder may produce before
+// MaxRatio is enforced, as small, highly compressible folders are common.
+const ratioGrace = 1 << 20
+
+// maxBlockSize is the maximum number of uncompressed bytes in a CFDATA block.
+const maxBlockSize = 32768
+
 type cfHeader struct {
 	Signature    [4]byte
 	Reserved1    uint32
@@ -84,6 +162,20 @@ const (
 	hdrReservePresent
 )
 
+// part is a single cabinet file of a possibly multi-part set.
+type part struct {
+	r    io.ReadSeeker
+	hdr  *cfHeader
+	name string // as referenced by another cabinet of the set
+	// Names of the previous and next cabinet in the set
+	prev, next string
+	fldrs      []*cfFolder
+	files      []*file
+	// Size of the reserved area in each CFDATA
+	dataReserve int
+	size        int64
+}
+
 type cfFolder struct {
 	COFFCabStart uint32 // offset of the first CFDATA block in this folder
 	CCFData      uint16 // number of CFDATA blocks in this folder
@@ -98,6 +190,20 @@ const (
 	compLZX            = 0x3
 )
 
+// folder is a logical folder, whose data can span multiple cabinets of a set.
+type folder struct {
+	segments []*folderSegment
+}
+
+// folderSegment is the part of a folder stored in a single cabinet.
+type folderSegment struct {
+	r           io.ReadSeeker
+	dataReserve int
+	// Size of the cabinet file r reads from
+	size int64
+	*cfFolder
+}
+
 type cfFile struct {
 	CBFile          uint32 // uncompressed size of this file in bytes
 	UOffFolderStart uint32 // uncompressed offset of this file in the folder
@@ -107,20 +213,31 @@ type cfFile struct {
 	Attribs         uint16 // attribute flags for this file
 }
 
+// Special values of cfFile.IFolder for files spanning multiple cabinets
+const (
+	ifoldContinuedFromPrev    uint16 = 0xfffd
+	ifoldContinuedToNext      uint16 = 0xfffe
+	ifoldContinuedPrevAndNext uint16 = 0xffff
+)
+
+// Attribute bits of a file in Header.Attributes
 const (
-	attribReadOnly = 1 << iota // file is read-only
-	attribHidden               // file is hidden
-	attribSystem               // file is a system file
+	AttrReadOnly uint16 = 1 << iota // file is read-only
+	AttrHidden                      // file is hidden
+	AttrSystem                      // file is a system file
 	_
 	_
-	attribArchive   // file modified since last backup
-	attribExec      // run after extraction
-	attribNameIsUTF // filename is UTF-encoded
+	AttrArchive   // file modified since last backup
+	AttrExec      // run after extraction
+	AttrNameIsUTF // filename is UTF-encoded
 )
 
 type file struct {
 	*cfFile
+	// Raw file name until decoded in NewWithOptions
 	name string
+	// Position in Cabinet.files
+	idx int
 }
 
 type Header struct {
@@ -130,6 +247,28 @@ type Header struct {
 	CreateTime time.Time
 	// The file size in bytes
 	Size uint32
+	// Attribute bits of the file (AttrReadOnly, AttrExec, ...)
+	Attributes uint16
+	// Index of the folder containing the file, see Cabinet.Folders
+	Folder int
+	// Offset of the file in the uncompressed data of its folder
+	Offset uint32
+	// Position of the file in the order Next returns files
+	Index int
+}
+
+// Mode returns Unix permissions corresponding to the attributes of the
+// file: 0644 for regular files, 0755 for files to be executed after
+// extraction, without the write bits if the file is read-only.
+func (h *Header) Mode() fs.FileMode {
+	mode := fs.FileMode(0644)
+	if h.Attributes&AttrExec != 0 {
+		mode = 0755
+	}
+	if h.Attributes&AttrReadOnly != 0 {
+		mode &^= 0222
+	}
+	return mode
 }
 
 type cfData struct {
@@ -138,8 +277,187 @@ type cfData struct {
 	CBUncomp uint16 // number of uncompressed bytes in this block
 }
 
+// checksum computes the checksum of a data block with the given reserved
+// area and compressed data as specified in MS-CAB section 2.6.
+func (d *cfData) checksum(reserve, data []byte) uint32 {
+	hdr := make([]byte, 4, 4+len(reserve))
+	binary.LittleEndian.PutUint16(hdr[0:], d.CBData)
+	binary.LittleEndian.PutUint16(hdr[2:], d.CBUncomp)
+	return checksum(append(hdr, reserve...), checksum(data, 0))
+}
+
+func checksum(data []byte, seed uint32) uint32 {
+	sum := seed
+	for len(data) >= 4 {
+		sum ^= binary.LittleEndian.Uint32(data)
+		data = data[4:]
+	}
+	// Remaining bytes are combined in big-endian order
+	var ul uint32
+	for _, b := range data {
+		ul = ul<<8 | uint32(b)
+	}
+	return sum ^ ul
+}
+
 // New returns a new Cabinet with the header structures parsed and sanity checked.
 func New(r io.ReadSeeker) (*Cabinet, error) {
+	return NewWithOptions(r, Options{})
+}
+
+// NewWithOptions is like New but allows configuring how the Cabinet is read.
+//
+// If r is part of a multi-part set, all other cabinets of the set are opened
+// using opts.OpenCabinet and the Cabinet provides access to the files of the
+// whole set.
+func NewWithOptions(r io.ReadSeeker, opts Options) (*Cabinet, error) {
+	parts, err := openSet(r, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var fldrs []*folder
+	var files []*file
+	for k, p := range parts {
+		// The first folder continues the last one of the previous cabinet if
+		// a file spans both.
+		continued := false
+		for _, f := range p.files {
+			if f.IFolder == ifoldContinuedFromPrev || f.IFolder == ifoldContinuedPrevAndNext {
+				continued = true
+			}
+		}
+		base := len(fldrs)
+		for i, cf := range p.fldrs {
+			seg := &folderSegment{r: p.r, dataReserve: p.dataReserve, size: p.size, cfFolder: cf}
+			if i == 0 && continued && k > 0 && len(fldrs) > 0 {
+				last := fldrs[len(fldrs)-1]
+				if last.segments[0].TypeCompress != cf.TypeCompress {
+					return nil, fmt.Errorf("continued folder changes compression from %d to %d", last.segments[0].TypeCompress, cf.TypeCompress)
+				}
+				last.segments = append(last.segments, seg)
+				base--
+				continue
+			}
+			fldrs = append(fldrs, &folder{segments: []*folderSegment{seg}})
+		}
+		for _, f := range p.files {
+			f.name = opts.decodeName(f)
+			switch f.IFolder {
+			case ifoldContinuedFromPrev, ifoldContinuedPrevAndNext:
+				// Listed in the cabinet the file starts in
+				continue
+			case ifoldContinuedToNext:
+				f.IFolder = uint16(len(p.fldrs) - 1)
+			}
+			if int(f.IFolder) >= len(p.fldrs) {
+				return nil, fmt.Errorf("file %q references folder %d, but there are only %d", f.name, f.IFolder, len(p.fldrs))
+			}
+			f.IFolder = uint16(base + int(f.IFolder))
+			files = append(files, f)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		// Sort by folder first, then by offset
+		return (uint64(files[i].IFolder)<<32)+uint64(files[i].UOffFolderStart) < (uint64(files[j].IFolder)<<32)+uint64(files[j].UOffFolderStart)
+	})
+	for i, f := range files {
+		f.idx = i
+	}
+
+	var siblings []string
+	for _, p := range parts {
+		if p.name != "" {
+			siblings = append(siblings, p.name)
+		}
+	}
+	c := &Cabinet{fldrs: fldrs, files: files, siblings: siblings, folderIdx: math.MaxUint16, opts: opts}
+	if opts.FolderCacheSize > 0 {
+		c.cache = newFolderCache(opts.FolderCacheSize)
+	}
+	c.progress = newProgress(opts.Progress, fldrs, files)
+	return c, nil
+}
+
+// openSet reads r and, if it is part of a multi-part set, all other
+// cabinets in the set. The cabinets are returned in set order.
+func openSet(r io.ReadSeeker, opts Options) ([]*part, error) {
+	first, err := readPart(r, &opts)
+	if err != nil {
+		return nil, err
+	}
+	parts := []*part{first}
+	if first.hdr.Flags&(hdrPrevCabinet|hdrNextCabinet) == 0 {
+		return parts, nil
+	}
+	if opts.OpenCabinet == nil {
+		return nil, errors.New("multi-part Cabinet files require Options.OpenCabinet")
+	}
+	seen := make(map[string]bool)
+	open := func(name string) (*part, error) {
+		if seen[strings.ToLower(name)] {
+			return nil, fmt.Errorf("cabinet %q appears twice in set", name)
+		}
+		seen[strings.ToLower(name)] = true
+		r, err := opts.OpenCabinet(name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open cabinet %q of set: %w", name, err)
+		}
+		p, err := readPart(r, &opts)
+		if err != nil {
+			return nil, fmt.Errorf("cabinet %q: %w", name, err)
+		}
+		if p.hdr.SetID != first.hdr.SetID {
+			return nil, fmt.Errorf("cabinet %q belongs to set %d instead of %d", name, p.hdr.SetID, first.hdr.SetID)
+		}
+		p.name = name
+		return p, nil
+	}
+	for parts[0].hdr.Flags&hdrPrevCabinet != 0 {
+		p, err := open(parts[0].prev)
+		if err != nil {
+			return nil, err
+		}
+		parts = append([]*part{p}, parts...)
+	}
+	for parts[len(parts)-1].hdr.Flags&hdrNextCabinet != 0 {
+		p, err := open(parts[len(parts)-1].next)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, p)
+	}
+	return parts, nil
+}
+
+// maxNameLen is the maximum length of file and cabinet names.
+const maxNameLen = 256
+
+// readCString reads a NUL-terminated string of at most maxNameLen bytes.
+func readCString(r io.ReadSeeker) (string, error) {
+	off, err := r.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return "", fmt.Errorf("could not preserve current offset: %v", err)
+	}
+	s, err := bufio.NewReader(io.LimitReader(r, maxNameLen+1)).ReadBytes('\x00')
+	if err == io.EOF && len(s) > maxNameLen {
+		return "", fmt.Errorf("string longer than %d bytes", maxNameLen)
+	}
+	if err != nil {
+		return "", err
+	}
+	if _, err := r.Seek(off+int64(len(s)), io.SeekStart); err != nil {
+		return "", fmt.Errorf("could not seek to the end of string: %v", err)
+	}
+	return string(s[:len(s)-1]), nil
+}
+
+// readPart parses the header structures of a single cabinet file.
+func readPart(r io.ReadSeeker, opts *Options) (*part, error) {
+	size, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, fmt.Errorf("could not determine size: %v", err)
+	}
 	if _, err := r.Seek(0, io.SeekStart); err != nil {
 		return nil, fmt.Errorf("could not seek to the beginning: %v", err)
 	}
@@ -153,73 +471,112 @@ func New(r io.ReadSeeker) (*Cabinet, error) {
 		return nil, fmt.Errorf("invalid Cabinet file signature: %v", hdr.Signature)
 	}
 	if hdr.Reserved1 != 0 || hdr.Reserved2 != 0 || hdr.Reserved3 != 0 {
-		return nil, fmt.Errorf("reserved files must be zero: %v, %v, %v", hdr.Reserved1, hdr.Reserved2, hdr.Reserved3)
+		if err := opts.quirk("reserved fields must be zero: %v, %v, %v", hdr.Reserved1, hdr.Reserved2, hdr.Reserved3); err != nil {
+			return nil, err
+		}
 	}
-	if hdr.VersionMajor != 1 || hdr.VersionMinor != 3 {
+	if hdr.VersionMajor != 1 {
 		return nil, fmt.Errorf("Cabinet file version has unsupported version %d.%d", hdr.VersionMajor, hdr.VersionMinor)
 	}
-	if (hdr.Flags&hdrPrevCabinet) != 0 || (hdr.Flags&hdrNextCabinet) != 0 {
-		return nil, errors.New("multi-part Cabinet files are unsupported")
+	if hdr.VersionMinor != 3 {
+		if err := opts.quirk("Cabinet file version has unsupported version %d.%d", hdr.VersionMajor, hdr.VersionMinor); err != nil {
+			return nil, err
+		}
+	}
+	if int64(hdr.CBCabinet) != size {
+		if err := opts.quirk("cabinet size in header is %d bytes, but the file has %d bytes", hdr.CBCabinet, size); err != nil {
+			return nil, err
+		}
+	}
+	// Reject counts and offsets which cannot fit in the file before
+	// reading or allocating anything based on them.
+	if int64(hdr.COFFFiles) > size {
+		return nil, fmt.Errorf("CFFILE offset %d is beyond the end of the file (%d bytes)", hdr.COFFFiles, size)
 	}
+	if int64(hdr.CFolders)*int64(binary.Size(cfFolder{})) > size || int64(hdr.CFiles)*int64(binary.Size(cfFile{})) > size {
+		return nil, fmt.Errorf("%d folders and %d files do not fit in %d bytes", hdr.CFolders, hdr.CFiles, size)
+	}
+	// Sizes of the application-specific areas in each CFFOLDER and CFDATA
+	var folderReserve, dataReserve int
 	if (hdr.Flags & hdrReservePresent) != 0 {
 		var reserveHdr cfHeaderReserve
 		if err := binary.Read(r, binary.LittleEndian, &reserveHdr); err != nil {
 			return nil, fmt.Errorf("coult not deserialize reserved header: %w", err)
 		}
-		if reserveHdr.CBCFData != 0 || reserveHdr.CBCFFolder != 0 {
-			return nil, errors.New("cabinet file with reserved folder and data sections unsupported")
-		}
+		folderReserve, dataReserve = int(reserveHdr.CBCFFolder), int(reserveHdr.CBCFData)
 		appSpecificHdr := make([]byte, reserveHdr.CBCFHeader)
 		if _, err := io.ReadFull(r, appSpecificHdr); err != nil {
 			return nil, fmt.Errorf("failed to read app-specific header: %w", err)
 		}
 	}
+	p := &part{r: r, hdr: &hdr, dataReserve: dataReserve, size: size}
+	// The disk names following the cabinet names are only informational.
+	if (hdr.Flags & hdrPrevCabinet) != 0 {
+		var err error
+		if p.prev, err = readCString(r); err != nil {
+			return nil, fmt.Errorf("could not read name of previous cabinet: %v", err)
+		}
+		if _, err := readCString(r); err != nil {
+			return nil, fmt.Errorf("could not read name of previous disk: %v", err)
+		}
+	}
+	if (hdr.Flags & hdrNextCabinet) != 0 {
+		var err error
+		if p.next, err = readCString(r); err != nil {
+			return nil, fmt.Errorf("could not read name of next cabinet: %v", err)
+		}
+		if _, err := readCString(r); err != nil {
+			return nil, fmt.Errorf("could not read name of next disk: %v", err)
+		}
+	}
 
 	// CFFOLDER
-	var fldrs []*cfFolder
 	for i := uint16(0); i < hdr.CFolders; i++ {
 		var fldr cfFolder
 		if err := binary.Read(r, binary.LittleEndian, &fldr); err != nil {
 			return nil, fmt.Errorf("could not deserialize folder %d: %v", i, err)
 		}
+		if int64(fldr.COFFCabStart) > size {
+			return nil, fmt.Errorf("data of folder %d starts beyond the end of the file", i)
+		}
+		if _, err := r.Seek(int64(folderReserve), io.SeekCurrent); err != nil {
+			return nil, fmt.Errorf("could not skip reserved area of folder %d: %v", i, err)
+		}
 		switch fldr.TypeCompress & compMask {
 		case compNone:
 		case compMSZIP:
+		case compLZX:
+			if _, ok := lzxPositionSlots[lzxWindowBits(fldr.TypeCompress)]; !ok {
+				return nil, fmt.Errorf("folder %d uses unsupported LZX window size 2^%d", i, lzxWindowBits(fldr.TypeCompress))
+			}
 		default:
 			return nil, fmt.Errorf("folder compressed with unsupported algorithm %d", fldr.TypeCompress)
 		}
-		fldrs = append(fldrs, &fldr)
+		p.fldrs = append(p.fldrs, &fldr)
 	}
 
 	// CFFILE
 	if _, err := r.Seek(int64(hdr.COFFFiles), io.SeekStart); err != nil {
 		return nil, fmt.Errorf("could not seek to start of CFFILE section: %v", err)
 	}
-	var files []*file
 	for i := uint16(0); i < hdr.CFiles; i++ {
 		var f cfFile
 		if err := binary.Read(r, binary.LittleEndian, &f); err != nil {
 			return nil, fmt.Errorf("could not deserialize file %d: %v", i, err)
 		}
-		off, err := r.Seek(0, io.SeekCurrent)
-		if err != nil {
-			return nil, fmt.Errorf("could not preserve current offset: %v", err)
-		}
-		fn, err := bufio.NewReader(r).ReadBytes('\x00')
+		fn, err := readCString(r)
 		if err != nil {
 			return nil, fmt.Errorf("could not read filename for file %d: %v", i, err)
 		}
-		if _, err := r.Seek(off+int64(len(fn)), io.SeekStart); err != nil {
-			return nil, fmt.Errorf("could not seek to the end of file entry %d: %v", i, err)
-		}
-		files = append(files, &file{&f, string(fn[:len(fn)-1])})
+		p.files = append(p.files, &file{cfFile: &f, name: fn})
 	}
-	sort.Slice(files, func(i, j int) bool {
-		// Sort by folder first, then by offset
-		return (uint64(files[i].IFolder)<<32)+uint64(files[i].UOffFolderStart) < (uint64(files[j].IFolder)<<32)+uint64(files[j].UOffFolderStart)
-	})
+	return p, nil
+}
 
-	return &Cabinet{r: r, hdr: &hdr, fldrs: fldrs, files: files, folderIdx: math.MaxUint16}, nil
+// Siblings returns the names of the other cabinets of a multi-part set
+// which were opened using Options.OpenCabinet, in set order.
+func (c *Cabinet) Siblings() []string {
+	return c.siblings
 }
 
 // FileList returns the list of filenames in the Cabinet file.
@@ -233,39 +590,154 @@ func (c *Cabinet) FileList() []string {
 
 type folderDataReader struct {
 	r    io.Reader
-	fldr *cfFolder
+	fldr *folder
+	// Index of the current segment of fldr
+	seg int
 
 	// MS-ZIP requires that the history buffer is preserved across block boundaries
 	lastBlock bytes.Buffer
+	// LZX keeps its window and Huffman trees across block boundaries
+	lzx *lzxDecoder
 
-	// Index of the next block to be read
+	// Index of the next block to be read in the current segment
 	blockIdx int
 
 	// Reader of the current block
 	blockReader io.Reader
 
 	rawBlockReader io.ReadCloser
+
+	opts     Options
+	progress *progress
+	// Compressed and uncompressed bytes of all blocks so far
+	compressed, uncompressed int64
 }
 
-func (f *folderDataReader) nextBlock() error {
-	if uint16(f.blockIdx) >= f.fldr.CCFData {
-		return io.EOF
+// startSegment seeks to the first data block of the given segment.
+func (f *folderDataReader) startSegment(idx int) error {
+	seg := f.fldr.segments[idx]
+	if _, err := seg.r.Seek(int64(seg.COFFCabStart), io.SeekStart); err != nil {
+		return fmt.Errorf("could not seek to start of data section: %v", err)
 	}
+	f.r = seg.r
+	f.seg = idx
+	f.blockIdx = 0
+	return nil
+}
+
+// readBlock reads the header of the next data block and returns a reader
+// for its compressed data. Blocks split across cabinets are joined.
+func (f *folderDataReader) readBlock() (*cfData, io.ReadCloser, error) {
+	for uint16(f.blockIdx) >= f.fldr.segments[f.seg].CCFData {
+		if f.seg+1 >= len(f.fldr.segments) {
+			return nil, nil, io.EOF
+		}
+		if err := f.startSegment(f.seg + 1); err != nil {
+			return nil, nil, err
+		}
+	}
+	d, reserve, err := f.readBlockHeader()
+	if err != nil {
+		return nil, nil, err
+	}
+	lastInSegment := uint16(f.blockIdx) >= f.fldr.segments[f.seg].CCFData
+	if d.CBUncomp != 0 || !lastInSegment || f.seg+1 >= len(f.fldr.segments) {
+		if !f.opts.VerifyChecksums {
+			return d, ExactReader(f.r, int64(d.CBData)), nil
+		}
+		data, err := f.readBlockData(d, reserve)
+		if err != nil {
+			return nil, nil, err
+		}
+		return d, io.NopCloser(bytes.NewReader(data)), nil
+	}
+	// The last block of a segment without uncompressed data continues in
+	// the first block of the next segment.
+	data, err := f.readBlockData(d, reserve)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := f.startSegment(f.seg + 1); err != nil {
+		return nil, nil, err
+	}
+	if f.fldr.segments[f.seg].CCFData == 0 {
+		return nil, nil, errors.New("split data block has no continuation")
+	}
+	cont, reserve, err := f.readBlockHeader()
+	if err != nil {
+		return nil, nil, err
+	}
+	rest, err := f.readBlockData(cont, reserve)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(data)+len(rest) > math.MaxUint16 {
+		return nil, nil, errors.New("split data block too large")
+	}
+	cont.CBData += d.CBData
+	return cont, io.NopCloser(bytes.NewReader(append(data, rest...))), nil
+}
+
+// readBlockHeader reads the next CFDATA header and its reserved area.
+func (f *folderDataReader) readBlockHeader() (*cfData, []byte, error) {
+	var d cfData
+	if err := binary.Read(f.r, binary.LittleEndian, &d); err != nil {
+		return nil, nil, fmt.Errorf("could not deserialize data structure %d: %v", f.blockIdx, err)
+	}
+	reserve := make([]byte, f.fldr.segments[f.seg].dataReserve)
+	if _, err := io.ReadFull(f.r, reserve); err != nil {
+		return nil, nil, fmt.Errorf("could not read reserved area of data structure %d: %v", f.blockIdx, err)
+	}
+	f.blockIdx++
+	return &d, reserve, nil
+}
+
+// readBlockData reads the compressed data of the data block d, verifying
+// its checksum if enabled.
+func (f *folderDataReader) readBlockData(d *cfData, reserve []byte) ([]byte, error) {
+	data := make([]byte, d.CBData)
+	if _, err := io.ReadFull(f.r, data); err != nil {
+		return nil, fmt.Errorf("failed to read data block %d: %w", f.blockIdx-1, err)
+	}
+	// Implementations disagree on whether the reserved area is covered by
+	// the checksum, so both variants are accepted.
+	if f.opts.VerifyChecksums && d.Checksum != 0 && d.checksum(nil, data) != d.Checksum {
+		if sum := d.checksum(reserve, data); sum != d.Checksum {
+			return nil, fmt.Errorf("%w: data block %d has checksum %08x, expected %08x", ErrChecksum, f.blockIdx-1, sum, d.Checksum)
+		}
+	}
+	return data, nil
+}
+
+func (f *folderDataReader) nextBlock() error {
 	if f.rawBlockReader != nil {
 		// Close old raw block reader to make sure everthing was read
 		f.rawBlockReader.Close()
 	}
-	var d cfData
-	if err := binary.Read(f.r, binary.LittleEndian, &d); err != nil {
-		return fmt.Errorf("could not deserialize data structure %d: %v", f.blockIdx, err)
+	d, raw, err := f.readBlock()
+	if err != nil {
+		return err
+	}
+	blockIdx := f.blockIdx - 1
+	if d.CBUncomp > maxBlockSize {
+		return fmt.Errorf("data block %d has %d uncompressed bytes, more than the maximum of %d", blockIdx, d.CBUncomp, maxBlockSize)
+	}
+	f.compressed += int64(d.CBData)
+	f.uncompressed += int64(d.CBUncomp)
+	if f.opts.MaxFolderSize > 0 && f.uncompressed > f.opts.MaxFolderSize {
+		return fmt.Errorf("%w: folder is larger than %d bytes", ErrLimitExceeded, f.opts.MaxFolderSize)
 	}
-	f.rawBlockReader = ExactReader(f.r, int64(d.CBData))
+	if f.opts.MaxRatio > 0 && f.uncompressed > ratioGrace && float64(f.uncompressed) > f.opts.MaxRatio*float64(f.compressed) {
+		return fmt.Errorf("%w: folder decompresses to more than %v times its size", ErrLimitExceeded, f.opts.MaxRatio)
+	}
+	f.rawBlockReader = raw
+	f.progress.add(0, int64(d.CBUncomp))
 
-	// TODO: Checksum the block
-	switch f.fldr.TypeCompress {
+	typeCompress := f.fldr.segments[0].TypeCompress
+	switch typeCompress & compMask {
 	case compNone:
 		if d.CBData != d.CBUncomp {
-			return fmt.Errorf("compressed bytes %d of data section %d do not equal uncompressed bytes %d when no compression was specified", d.CBData, f.blockIdx, d.CBUncomp)
+			return fmt.Errorf("compressed bytes %d of data section %d do not equal uncompressed bytes %d when no compression was specified", d.CBData, blockIdx, d.CBUncomp)
 		}
 		f.blockReader = f.rawBlockReader
 	case compMSZIP:
@@ -274,7 +746,7 @@ func (f *folderDataReader) nextBlock() error {
 			return fmt.Errorf("failed to read MS-ZIP signature: %w", err)
 		}
 		if !bytes.Equal(sig, []byte("CK")) {
-			return fmt.Errorf("invalid MS-ZIP signature %q in data block %d", sig, f.blockIdx)
+			return fmt.Errorf("invalid MS-ZIP signature %q in data block %d", sig, blockIdx)
 		}
 		var r io.Reader
 		if f.lastBlock.Len() == 0 {
@@ -283,14 +755,32 @@ func (f *folderDataReader) nextBlock() error {
 			r = flate.NewReaderDict(f.rawBlockReader, f.lastBlock.Next(f.lastBlock.Len()))
 		}
 		f.blockReader = io.TeeReader(ExactReader(r, int64(d.CBUncomp)), &f.lastBlock)
+	case compLZX:
+		if f.lzx == nil {
+			var err error
+			if f.lzx, err = newLZXDecoder(lzxWindowBits(typeCompress)); err != nil {
+				return err
+			}
+		}
+		in, err := io.ReadAll(f.rawBlockReader)
+		if err != nil {
+			return fmt.Errorf("failed to read data block %d: %w", blockIdx, err)
+		}
+		out, err := f.lzx.decodeFrame(in, int(d.CBUncomp))
+		if err != nil {
+			return fmt.Errorf("failed to decompress data block %d: %w", blockIdx, err)
+		}
+		f.blockReader = bytes.NewReader(out)
 	default:
 		return errors.New("unsupported compression")
 	}
-	f.blockIdx++
 	return nil
 }
 
 func (f *folderDataReader) Read(p []byte) (n int, err error) {
+	if f.blockReader == nil {
+		return 0, io.EOF
+	}
 	n, err = f.blockReader.Read(p)
 	if err == io.EOF {
 		return n, f.nextBlock()
@@ -299,73 +789,342 @@ func (f *folderDataReader) Read(p []byte) (n int, err error) {
 }
 
 func (c *Cabinet) folderData(idx uint16) (*folderDataReader, error) {
+	return c.folderDataAt(idx, 0)
+}
+
+// folderDataAt returns a reader for the data of the given folder starting at
+// the uncompressed offset off.
+func (c *Cabinet) folderDataAt(idx uint16, off int64) (*folderDataReader, error) {
 	if int(idx) >= len(c.fldrs) {
 		return nil, errors.New("folder number out of range")
 	}
-	fldr := c.fldrs[idx]
-	if _, err := c.r.Seek(int64(fldr.COFFCabStart), io.SeekStart); err != nil {
-		return nil, fmt.Errorf("could not seek to start of data section: %v", err)
-	}
+	return c.newFolderDataReader(c.fldrs[idx], off)
+}
+
+// newFolderDataReader returns a reader for the data of fldr starting at the
+// uncompressed offset off. Blocks of uncompressed folders which lie
+// completely before off are seeked over instead of being read.
+func (c *Cabinet) newFolderDataReader(fldr *folder, off int64) (*folderDataReader, error) {
 	r := &folderDataReader{
-		r:    c.r,
-		fldr: fldr,
+		fldr:     fldr,
+		opts:     c.opts,
+		progress: c.progress,
+	}
+	if err := r.startSegment(0); err != nil {
+		return nil, err
+	}
+	if off > 0 && fldr.segments[0].TypeCompress&compMask == compNone {
+		skipped, err := r.skipBlocks(off)
+		if err != nil {
+			return nil, err
+		}
+		off -= skipped
+	}
+	if err := r.nextBlock(); err != nil && err != io.EOF {
+		return nil, err
+	}
+	if _, err := io.CopyN(io.Discard, r, off); err != nil {
+		return nil, fmt.Errorf("could not seek to start of data: %v", err)
 	}
-	r.nextBlock()
 	return r, nil
 }
 
+// skipBlocks seeks over the uncompressed data blocks ending at or before
+// off without reading their data and returns the number of bytes skipped.
+// It stops in front of the first block it cannot skip, including blocks
+// split across cabinets.
+func (f *folderDataReader) skipBlocks(off int64) (int64, error) {
+	var skipped int64
+	for {
+		for uint16(f.blockIdx) >= f.fldr.segments[f.seg].CCFData {
+			if f.seg+1 >= len(f.fldr.segments) {
+				return skipped, nil
+			}
+			if err := f.startSegment(f.seg + 1); err != nil {
+				return skipped, err
+			}
+		}
+		seg := f.fldr.segments[f.seg]
+		d, reserve, err := f.readBlockHeader()
+		if err != nil {
+			return skipped, err
+		}
+		if d.CBUncomp == 0 || d.CBData != d.CBUncomp || skipped+int64(d.CBUncomp) > off {
+			// Leave this block to nextBlock.
+			f.blockIdx--
+			_, err := seg.r.Seek(-int64(binary.Size(d)+len(reserve)), io.SeekCurrent)
+			return skipped, err
+		}
+		if _, err := seg.r.Seek(int64(d.CBData), io.SeekCurrent); err != nil {
+			return skipped, fmt.Errorf("could not skip data block %d: %v", f.blockIdx-1, err)
+		}
+		f.compressed += int64(d.CBData)
+		f.uncompressed += int64(d.CBUncomp)
+		f.progress.add(0, int64(d.CBUncomp))
+		skipped += int64(d.CBUncomp)
+	}
+}
+
 func (c *Cabinet) Read(p []byte) (n int, err error) {
+	if c.fileReader == nil {
+		return 0, errors.New("Read called before Next")
+	}
 	return c.fileReader.Read(p)
 }
 
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// overlapping reports if any files in the folder of the file at index
+// start overlap. It relies on the files being sorted by folder and offset.
+func (c *Cabinet) overlapping(start int) bool {
+	var end uint64
+	for _, f := range c.files[start:] {
+		if f.IFolder != c.files[start].IFolder {
+			break
+		}
+		if uint64(f.UOffFolderStart) < end {
+			return true
+		}
+		end = uint64(f.UOffFolderStart) + uint64(f.CBFile)
+	}
+	return false
+}
+
+// folderFiles provides the contents of the files of one folder, which have
+// to be requested in order. Folders with overlapping files are buffered
+// completely, all others are streamed.
+type folderFiles struct {
+	buf    []byte
+	stream *countingReader
+}
+
+func newFolderFiles(r io.Reader, overlapping bool) (*folderFiles, error) {
+	if !overlapping {
+		return &folderFiles{stream: &countingReader{r: r}}, nil
+	}
+	// CAB allows overlapping files, which cannot be streamed
+	buf, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read folder data stream: %w", err)
+	}
+	return &folderFiles{buf: buf}, nil
+}
+
+// open returns the content of f, which must not start before the previous
+// file if the folder is streamed.
+func (ff *folderFiles) open(f *file) (io.Reader, error) {
+	if ff.stream != nil {
+		// Skip the unread part of the previous file and any gap
+		if skip := int64(f.UOffFolderStart) - ff.stream.n; skip > 0 {
+			if _, err := io.CopyN(io.Discard, ff.stream, skip); err != nil {
+				return nil, fmt.Errorf("failed to skip to file data: %w", err)
+			}
+		}
+		return ExactReader(ff.stream, int64(f.CBFile)), nil
+	}
+	if len(ff.buf) < int(f.UOffFolderStart)+int(f.CBFile) {
+		return nil, fmt.Errorf("file segment out of range")
+	}
+	return bytes.NewReader(ff.buf[f.UOffFolderStart : f.UOffFolderStart+f.CBFile]), nil
+}
+
+func (f *file) header() *Header {
+	return &Header{
+		Name:       f.name,
+		CreateTime: msDosTimeToTime(f.Date, f.Time),
+		Size:       f.CBFile,
+		Attributes: f.Attribs,
+		Folder:     int(f.IFolder),
+		Offset:     f.UOffFolderStart,
+		Index:      f.idx,
+	}
+}
+
 func (c *Cabinet) Next() (*Header, error) {
+	c.skipUnwantedFolders()
 	if c.fileIdx >= len(c.files) {
 		return nil, io.EOF
 	}
 	f := c.files[c.fileIdx]
 	if f.IFolder != c.folderIdx {
-		var err error
 		c.folderIdx = f.IFolder
-		var r io.Reader
-		r, err = c.folderData(c.folderIdx)
+		r, err := c.folderData(c.folderIdx)
 		if err != nil {
 			return nil, fmt.Errorf("failed to read new folder data stream: %w", err)
 		}
-		// Necessary as CAB allows overlapping files
-		c.folderBuf, err = io.ReadAll(r)
-		if err != nil {
-			return nil, fmt.Errorf("failed to read folder data stream: %w", err)
+		if c.folder, err = newFolderFiles(r, c.overlapping(c.fileIdx)); err != nil {
+			return nil, err
 		}
 	}
-	if len(c.folderBuf) < int(f.UOffFolderStart)+int(f.CBFile) {
-		return nil, fmt.Errorf("file segment out of range")
+	var err error
+	if c.fileReader, err = c.folder.open(f); err != nil {
+		return nil, err
 	}
-	c.fileReader = bytes.NewReader(c.folderBuf[f.UOffFolderStart : f.UOffFolderStart+f.CBFile])
 	c.fileIdx++
-	return &Header{
-		Name:       f.name,
-		CreateTime: msDosTimeToTime(f.Date, f.Time),
-		Size:       f.CBFile,
-	}, nil
+	c.progress.add(1, 0)
+	return f.header(), nil
+}
+
+// skipUnwantedFolders advances past all folders starting at the current
+// file which don't contain any file accepted by Options.WantFile.
+func (c *Cabinet) skipUnwantedFolders() {
+	if c.opts.WantFile == nil {
+		return
+	}
+	for c.fileIdx < len(c.files) && c.files[c.fileIdx].IFolder != c.folderIdx {
+		start := c.fileIdx
+		end, wanted := c.folderWanted(start)
+		if wanted {
+			return
+		}
+		c.fileIdx = end
+	}
+}
+
+// folderWanted reports whether any of the files of the folder starting with
+// the file with index start is accepted by Options.WantFile, and returns the
+// index of the first file of the next folder. Unwanted folders are
+// accounted as skipped in the progress.
+func (c *Cabinet) folderWanted(start int) (end int, wanted bool) {
+	var size int64
+	for end = start; end < len(c.files) && c.files[end].IFolder == c.files[start].IFolder; end++ {
+		f := c.files[end]
+		wanted = wanted || c.opts.WantFile == nil || c.opts.WantFile(f.name)
+		if fileEnd := int64(f.UOffFolderStart) + int64(f.CBFile); fileEnd > size {
+			size = fileEnd
+		}
+	}
+	if !wanted {
+		// Skipped data counts as read, see Progress.Bytes.
+		c.progress.add(end-start, size)
+	}
+	return end, wanted
 }
 
 // Content returns the content of the file specified by its filename as an
-// io.Reader. Note that the entire folder which contains the file in question
-// is decompressed for every file request.
+// io.Reader. Note that unless Options.FolderCacheSize is set, the folder
+// which contains the file in question is decompressed up to the file for
+// every file request. Uncompressed folders are seeked through, so only the
+// data blocks covering the file are read. Content may be called between
+// Next and reading the file it returned, the stream read by Next is not
+// affected.
 func (c *Cabinet) Content(name string) (io.Reader, error) {
 	for _, f := range c.files {
-		if f.name != name {
-			continue
+		if f.name == name {
+			return c.content(f)
 		}
-		data, err := c.folderData(f.IFolder)
+	}
+	return nil, fmt.Errorf("file %q not found in Cabinet", name)
+}
+
+func (c *Cabinet) content(f *file) (io.Reader, error) {
+	if c.cache != nil {
+		return c.cachedContent(f)
+	}
+	data, err := c.detachedFolderData(f.IFolder, int64(f.UOffFolderStart), int64(f.CBFile))
+	if err != nil {
+		return nil, fmt.Errorf("could not acquire uncompressed data for folder %d: %v", f.IFolder, err)
+	}
+	return data, nil
+}
+
+// detachedFolderData returns a reader for n bytes of the data of folder idx
+// starting at the uncompressed offset off, or for all of it if n is
+// negative. Every returned reader gets its own section readers so that
+// multiple of them and the stream returned by Next can be read in
+// alternation. If the readers of the cabinet files don't implement
+// io.ReaderAt, their positions are shared, so the data is read right away
+// and the positions are restored afterwards.
+func (c *Cabinet) detachedFolderData(idx uint16, off, n int64) (io.Reader, error) {
+	if int(idx) >= len(c.fldrs) {
+		return nil, errors.New("folder number out of range")
+	}
+	if fldr, ok := c.fldrs[idx].independent(); ok {
+		r, err := c.newFolderDataReader(fldr, off)
 		if err != nil {
-			return nil, fmt.Errorf("could not acquire uncompressed data for folder %d: %v", f.IFolder, err)
+			return nil, err
+		}
+		if n < 0 {
+			return r, nil
+		}
+		return ExactReader(r, n), nil
+	}
+	restore, err := c.savePositions()
+	if err != nil {
+		return nil, err
+	}
+	var buf []byte
+	r, err := c.newFolderDataReader(c.fldrs[idx], off)
+	if err == nil {
+		var src io.Reader = r
+		if n >= 0 {
+			src = ExactReader(r, n)
 		}
+		buf, err = io.ReadAll(src)
+	}
+	if restoreErr := restore(); err == nil {
+		err = restoreErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(buf), nil
+}
 
-		if _, err := io.CopyN(io.Discard, data, int64(f.UOffFolderStart)); err != nil {
-			return nil, fmt.Errorf("could not seek to start of data: %v", err)
+// savePositions records the current positions of the readers of all
+// cabinet files and returns a function which seeks them back.
+func (c *Cabinet) savePositions() (restore func() error, err error) {
+	// Segments of the same cabinet file share its reader, which is then
+	// simply restored multiple times.
+	var segments []*folderSegment
+	var positions []int64
+	for _, fldr := range c.fldrs {
+		for _, seg := range fldr.segments {
+			pos, err := seg.r.Seek(0, io.SeekCurrent)
+			if err != nil {
+				return nil, err
+			}
+			segments = append(segments, seg)
+			positions = append(positions, pos)
 		}
-		return ExactReader(data, int64(f.CBFile)), nil
 	}
-	return nil, fmt.Errorf("file %q not found in Cabinet", name)
+	return func() error {
+		for i, seg := range segments {
+			if _, err := seg.r.Seek(positions[i], io.SeekStart); err != nil {
+				return fmt.Errorf("could not restore position of cabinet reader: %w", err)
+			}
+		}
+		return nil
+	}, nil
+}
+
+// cachedContent returns the content of f from the folder cache,
+// decompressing and adding its folder if necessary.
+func (c *Cabinet) cachedContent(f *file) (io.Reader, error) {
+	data, ok := c.cache.get(f.IFolder)
+	if !ok {
+		r, err := c.detachedFolderData(f.IFolder, 0, -1)
+		if err != nil {
+			return nil, fmt.Errorf("could not acquire uncompressed data for folder %d: %v", f.IFolder, err)
+		}
+		data, err = io.ReadAll(r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read folder data stream: %w", err)
+		}
+		c.cache.put(f.IFolder, data)
+	}
+	if uint64(len(data)) < uint64(f.UOffFolderStart)+uint64(f.CBFile) {
+		return nil, fmt.Errorf("file segment out of range")
+	}
+	return bytes.NewReader(data[f.UOffFolderStart : f.UOffFolderStart+f.CBFile]), nil
 }
@@ -0,0 +1,643 @@
+package cab
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type testBlock struct {
+	data     []byte
+	uncompSz int
+	checksum uint32
+}
+
+type testFolder struct {
+	typeCompress uint16
+	blocks       []testBlock
+}
+
+type testFile struct {
+	name   string
+	folder uint16
+	offset uint32
+	size   uint32
+}
+
+// testCabinet describes a cabinet file to be built for tests.
+type testCabinet struct {
+	setID      uint16
+	prev, next string
+	folders    []testFolder
+	files      []testFile
+	// Sizes of the reserved areas, filled with 0xff
+	headerReserve, folderReserve, dataReserve int
+}
+
+func (tc testCabinet) build() []byte {
+	var flags uint16
+	var names bytes.Buffer
+	if tc.headerReserve != 0 || tc.folderReserve != 0 || tc.dataReserve != 0 {
+		flags |= hdrReservePresent
+		binary.Write(&names, binary.LittleEndian, cfHeaderReserve{
+			CBCFHeader: uint16(tc.headerReserve),
+			CBCFFolder: uint8(tc.folderReserve),
+			CBCFData:   uint8(tc.dataReserve),
+		})
+		names.Write(bytes.Repeat([]byte{0xff}, tc.headerReserve))
+	}
+	if tc.prev != "" {
+		flags |= hdrPrevCabinet
+		names.WriteString(tc.prev + "\x00disk\x00")
+	}
+	if tc.next != "" {
+		flags |= hdrNextCabinet
+		names.WriteString(tc.next + "\x00disk\x00")
+	}
+	var filesBuf bytes.Buffer
+	for _, f := range tc.files {
+		binary.Write(&filesBuf, binary.LittleEndian, cfFile{
+			CBFile:          f.size,
+			UOffFolderStart: f.offset,
+			IFolder:         f.folder,
+		})
+		filesBuf.WriteString(f.name + "\x00")
+	}
+	filesStart := binary.Size(cfHeader{}) + names.Len() + len(tc.folders)*(binary.Size(cfFolder{})+tc.folderReserve)
+	dataStart := filesStart + filesBuf.Len()
+
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, cfHeader{
+		Signature:    [4]byte{'M', 'S', 'C', 'F'},
+		COFFFiles:    uint32(filesStart),
+		VersionMinor: 3,
+		VersionMajor: 1,
+		CFolders:     uint16(len(tc.folders)),
+		CFiles:       uint16(len(tc.files)),
+		Flags:        flags,
+		SetID:        tc.setID,
+	})
+	buf.Write(names.Bytes())
+	var data bytes.Buffer
+	for _, fldr := range tc.folders {
+		binary.Write(&buf, binary.LittleEndian, cfFolder{
+			COFFCabStart: uint32(dataStart + data.Len()),
+			CCFData:      uint16(len(fldr.blocks)),
+			TypeCompress: fldr.typeCompress,
+		})
+		buf.Write(bytes.Repeat([]byte{0xff}, tc.folderReserve))
+		for _, b := range fldr.blocks {
+			binary.Write(&data, binary.LittleEndian, cfData{Checksum: b.checksum, CBData: uint16(len(b.data)), CBUncomp: uint16(b.uncompSz)})
+			data.Write(bytes.Repeat([]byte{0xff}, tc.dataReserve))
+			data.Write(b.data)
+		}
+	}
+	buf.Write(filesBuf.Bytes())
+	buf.Write(data.Bytes())
+	out := buf.Bytes()
+	binary.LittleEndian.PutUint32(out[8:], uint32(len(out)))
+	return out
+}
+
+// checkFiles reads all files from c and compares them with want.
+func checkFiles(t *testing.T, c *Cabinet, want map[string]string) {
+	t.Helper()
+	got := make(map[string]string)
+	for {
+		hdr, err := c.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Next: %v", err)
+		}
+		data, err := io.ReadAll(c)
+		if err != nil {
+			t.Fatalf("reading %v: %v", hdr.Name, err)
+		}
+		got[hdr.Name] = string(data)
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got files %q, want %q", got, want)
+	}
+}
+
+func TestMultiPart(t *testing.T) {
+	// b.txt spans both cabinets and its folder's second data block is split
+	// between them.
+	cabs := map[string][]byte{
+		"cab1.cab": testCabinet{
+			setID: 42,
+			next:  "cab2.cab",
+			folders: []testFolder{
+				{blocks: []testBlock{{[]byte("aaaa"), 4, 0}}},
+				{blocks: []testBlock{{[]byte("bbbb"), 4, 0}, {[]byte("bb"), 0, 0}}},
+			},
+			files: []testFile{{"a.txt", 0, 0, 4}, {"b.txt", ifoldContinuedToNext, 0, 8}},
+		}.build(),
+		"cab2.cab": testCabinet{
+			setID: 42,
+			prev:  "cab1.cab",
+			folders: []testFolder{
+				{blocks: []testBlock{{[]byte("bbcc"), 6, 0}}},
+				{blocks: []testBlock{{[]byte("dd"), 2, 0}}},
+			},
+			files: []testFile{{"b.txt", ifoldContinuedFromPrev, 0, 8}, {"c.txt", 0, 8, 2}, {"d.txt", 1, 0, 2}},
+		}.build(),
+	}
+	var opened []string
+	opts := Options{OpenCabinet: func(name string) (io.ReadSeeker, error) {
+		opened = append(opened, name)
+		data, ok := cabs[name]
+		if !ok {
+			return nil, fmt.Errorf("no cabinet %q", name)
+		}
+		return bytes.NewReader(data), nil
+	}}
+	want := map[string]string{"a.txt": "aaaa", "b.txt": "bbbbbbbb", "c.txt": "cc", "d.txt": "dd"}
+
+	if _, err := New(bytes.NewReader(cabs["cab1.cab"])); err == nil {
+		t.Error("New succeeded on multi-part cabinet without OpenCabinet")
+	}
+	// Opening any cabinet of the set yields all files.
+	for _, name := range []string{"cab1.cab", "cab2.cab"} {
+		opened = nil
+		c, err := NewWithOptions(bytes.NewReader(cabs[name]), opts)
+		if err != nil {
+			t.Fatalf("%v: NewWithOptions: %v", name, err)
+		}
+		if len(c.Siblings()) != 1 || c.Siblings()[0] == name {
+			t.Errorf("%v: got siblings %v", name, c.Siblings())
+		}
+		checkFiles(t, c, want)
+	}
+
+	c, err := NewWithOptions(bytes.NewReader(cabs["cab1.cab"]), opts)
+	if err != nil {
+		t.Fatalf("NewWithOptions: %v", err)
+	}
+	wantFolders := []FolderInfo{
+		{Compression: CompressionNone, Blocks: 1, Cabinets: 1, Files: 1},
+		{Compression: CompressionNone, Blocks: 3, Cabinets: 2, Files: 2},
+		{Compression: CompressionNone, Blocks: 1, Cabinets: 1, Files: 1},
+	}
+	if got := c.Folders(); fmt.Sprint(got) != fmt.Sprint(wantFolders) {
+		t.Errorf("Folders() = %+v, want %+v", got, wantFolders)
+	}
+	var layout []string
+	for _, hdr := range c.Headers() {
+		layout = append(layout, fmt.Sprintf("%d:%s@%d/%d", hdr.Index, hdr.Name, hdr.Folder, hdr.Offset))
+	}
+	if got, want := strings.Join(layout, " "), "0:a.txt@0/0 1:b.txt@1/0 2:c.txt@1/8 3:d.txt@2/0"; got != want {
+		t.Errorf("got layout %q, want %q", got, want)
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	for _, tc := range []struct {
+		checksum uint32
+		verify   bool
+		wantErr  error
+	}{
+		{0x03622968, true, nil},
+		{0, true, nil},
+		{0x03622969, true, ErrChecksum},
+		{0x03622969, false, nil},
+	} {
+		cabData := testCabinet{
+			folders: []testFolder{{blocks: []testBlock{{data: []byte("hello world"), uncompSz: 11, checksum: tc.checksum}}}},
+			files:   []testFile{{"a.txt", 0, 0, 11}},
+		}.build()
+		c, err := NewWithOptions(bytes.NewReader(cabData), Options{VerifyChecksums: tc.verify})
+		if err != nil {
+			t.Fatalf("NewWithOptions: %v", err)
+		}
+		if _, err := c.Next(); !errors.Is(err, tc.wantErr) {
+			t.Errorf("checksum %08x, verify %v: got error %v, want %v", tc.checksum, tc.verify, err, tc.wantErr)
+		}
+	}
+}
+
+func TestStreaming(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		files []testFile
+		want  map[string]string
+	}{
+		{"gap", []testFile{{"a.txt", 0, 0, 4}, {"b.txt", 0, 6, 4}}, map[string]string{"a.txt": "0123", "b.txt": "6789"}},
+		{"overlap", []testFile{{"a.txt", 0, 0, 6}, {"b.txt", 0, 4, 6}}, map[string]string{"a.txt": "012345", "b.txt": "456789"}},
+	} {
+		cabData := testCabinet{
+			folders: []testFolder{{blocks: []testBlock{{[]byte("01234"), 5, 0}, {[]byte("56789"), 5, 0}}}},
+			files:   tc.files,
+		}.build()
+		c, err := New(bytes.NewReader(cabData))
+		if err != nil {
+			t.Fatalf("%v: New: %v", tc.name, err)
+		}
+		if streamed := !c.overlapping(0); streamed != (tc.name == "gap") {
+			t.Errorf("%v: streamed is %v", tc.name, streamed)
+		}
+		checkFiles(t, c, tc.want)
+
+		// Files which aren't read completely are skipped.
+		c, err = New(bytes.NewReader(cabData))
+		if err != nil {
+			t.Fatalf("%v: New: %v", tc.name, err)
+		}
+		c.Next()
+		c.Read(make([]byte, 1))
+		c.Next()
+		if got, err := io.ReadAll(c); err != nil || string(got) != tc.want["b.txt"] {
+			t.Errorf("%v: after partial read got %q, %v", tc.name, got, err)
+		}
+	}
+}
+
+func TestContentWhileStreaming(t *testing.T) {
+	cabData := testCabinet{
+		folders: []testFolder{
+			{blocks: []testBlock{{[]byte("01234"), 5, 0}, {[]byte("56789"), 5, 0}}},
+			{blocks: []testBlock{{[]byte("abcde"), 5, 0}}},
+		},
+		files: []testFile{{"a.txt", 0, 0, 10}, {"b.txt", 1, 0, 5}},
+	}.build()
+	for _, tc := range []struct {
+		name string
+		r    io.ReadSeeker
+		opts Options
+	}{
+		{"ReaderAt", bytes.NewReader(cabData), Options{}},
+		{"ReadSeeker", &countingReadSeeker{ReadSeeker: bytes.NewReader(cabData)}, Options{}},
+		{"cache", &countingReadSeeker{ReadSeeker: bytes.NewReader(cabData)}, Options{FolderCacheSize: 1 << 20}},
+	} {
+		c, err := NewWithOptions(tc.r, tc.opts)
+		if err != nil {
+			t.Fatalf("%v: NewWithOptions: %v", tc.name, err)
+		}
+		if _, err := c.Next(); err != nil {
+			t.Fatalf("%v: Next: %v", tc.name, err)
+		}
+		start := make([]byte, 3)
+		if _, err := io.ReadFull(c, start); err != nil {
+			t.Fatalf("%v: Read: %v", tc.name, err)
+		}
+		content, err := c.Content("b.txt")
+		if err != nil {
+			t.Fatalf("%v: Content: %v", tc.name, err)
+		}
+		if got, err := io.ReadAll(content); err != nil || string(got) != "abcde" {
+			t.Errorf("%v: got b.txt %q, %v", tc.name, got, err)
+		}
+		rest, err := io.ReadAll(c)
+		if got := string(start) + string(rest); err != nil || got != "0123456789" {
+			t.Errorf("%v: got streamed a.txt %q, %v", tc.name, got, err)
+		}
+	}
+}
+
+func TestNextOrder(t *testing.T) {
+	// Files listed out of order are still returned by folder and offset, so
+	// that every folder is decompressed once.
+	cabData := testCabinet{
+		folders: []testFolder{
+			{blocks: []testBlock{{[]byte("abcd"), 4, 0}}},
+			{blocks: []testBlock{{[]byte("efgh"), 4, 0}}},
+		},
+		files: []testFile{{"d.txt", 1, 2, 2}, {"a.txt", 0, 0, 2}, {"c.txt", 1, 0, 2}, {"b.txt", 0, 2, 2}},
+	}.build()
+	var last Progress
+	c, err := NewWithOptions(bytes.NewReader(cabData), Options{Progress: func(p Progress) { last = p }})
+	if err != nil {
+		t.Fatalf("NewWithOptions: %v", err)
+	}
+	var names []string
+	for {
+		hdr, err := c.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Next: %v", err)
+		}
+		if _, err := io.Copy(io.Discard, c); err != nil {
+			t.Fatalf("reading %v: %v", hdr.Name, err)
+		}
+		names = append(names, hdr.Name)
+	}
+	if got := strings.Join(names, " "); got != "a.txt b.txt c.txt d.txt" {
+		t.Errorf("got files in order %q", got)
+	}
+	if last.Bytes != last.TotalBytes {
+		t.Errorf("decompressed %d bytes, want %d", last.Bytes, last.TotalBytes)
+	}
+}
+
+func TestWantFile(t *testing.T) {
+	cabData := testCabinet{
+		folders: []testFolder{
+			// Broken checksum, which is only noticed if the folder is read
+			{blocks: []testBlock{{[]byte("abcd"), 4, 1}}},
+			{blocks: []testBlock{{[]byte("efgh"), 4, 0}}},
+			{blocks: []testBlock{{[]byte("ijkl"), 4, 1}}},
+		},
+		files: []testFile{{"a.txt", 0, 0, 2}, {"b.txt", 0, 2, 2}, {"c.txt", 1, 0, 2}, {"d.txt", 1, 2, 2}, {"e.txt", 2, 0, 4}},
+	}.build()
+	var last Progress
+	c, err := NewWithOptions(bytes.NewReader(cabData), Options{
+		VerifyChecksums: true,
+		WantFile:        func(name string) bool { return name == "d.txt" },
+		Progress:        func(p Progress) { last = p },
+	})
+	if err != nil {
+		t.Fatalf("NewWithOptions: %v", err)
+	}
+	checkFiles(t, c, map[string]string{"c.txt": "ef", "d.txt": "gh"})
+	if last.Files != last.TotalFiles || last.Bytes != last.TotalBytes {
+		t.Errorf("progress %+v is incomplete after skipping folders", last)
+	}
+
+	c, err = NewWithOptions(bytes.NewReader(cabData), Options{
+		VerifyChecksums: true,
+		WantFile:        func(name string) bool { return name == "d.txt" },
+		Progress:        func(p Progress) { last = p },
+	})
+	if err != nil {
+		t.Fatalf("NewWithOptions: %v", err)
+	}
+	var mu sync.Mutex
+	got := make(map[string]string)
+	err = c.ExtractParallel(4, func(hdr *Header, r io.Reader) error {
+		data, err := io.ReadAll(r)
+		mu.Lock()
+		got[hdr.Name] = string(data)
+		mu.Unlock()
+		return err
+	})
+	if err != nil {
+		t.Fatalf("ExtractParallel: %v", err)
+	}
+	if fmt.Sprint(got) != fmt.Sprint(map[string]string{"c.txt": "ef", "d.txt": "gh"}) {
+		t.Errorf("ExtractParallel got files %q", got)
+	}
+	if last.Files != last.TotalFiles || last.Bytes != last.TotalBytes {
+		t.Errorf("progress %+v is incomplete after skipping folders in parallel", last)
+	}
+}
+
+func TestReserve(t *testing.T) {
+	cabData := testCabinet{
+		folders:       []testFolder{{blocks: []testBlock{{[]byte("abc"), 3, 0}, {[]byte("def"), 3, 0}}}},
+		files:         []testFile{{"a.txt", 0, 0, 6}},
+		headerReserve: 20,
+		folderReserve: 3,
+		dataReserve:   5,
+	}.build()
+	c, err := New(bytes.NewReader(cabData))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	checkFiles(t, c, map[string]string{"a.txt": "abcdef"})
+}
+
+func TestDecodeName(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		attribs uint16
+		opts    Options
+		want    string
+	}{
+		{"plain.txt", 0, Options{}, "plain.txt"},
+		{"\x84rger.txt", 0, Options{}, "ärger.txt"},
+		{"\xc3\xa4rger.txt", AttrNameIsUTF, Options{}, "ärger.txt"},
+		// Invalid UTF-8 is decoded like names without the attribute
+		{"\x84rger.txt", AttrNameIsUTF, Options{}, "ärger.txt"},
+		{"\xe4rger.txt", 0, Options{DecodeName: func(b []byte) string { return "custom" }}, "custom"},
+	} {
+		f := &file{cfFile: &cfFile{Attribs: tc.attribs}, name: tc.name}
+		if got := tc.opts.decodeName(f); got != tc.want {
+			t.Errorf("decodeName(%q, %#x) = %q, want %q", tc.name, tc.attribs, got, tc.want)
+		}
+	}
+}
+
+func TestFolderCache(t *testing.T) {
+	c := newFolderCache(10)
+	c.put(0, []byte("aaaa"))
+	c.put(1, []byte("bbbb"))
+	c.get(0)
+	// Evicts folder 1 as 0 was used more recently
+	c.put(2, []byte("cccc"))
+	// Larger than the cache
+	c.put(3, make([]byte, 11))
+	for folder, want := range map[uint16]bool{0: true, 1: false, 2: true, 3: false} {
+		if _, ok := c.get(folder); ok != want {
+			t.Errorf("folder %d cached: %v, want %v", folder, ok, want)
+		}
+	}
+
+	cabData := testCabinet{
+		folders: []testFolder{{blocks: []testBlock{{[]byte("0123456789"), 10, 0}}}},
+		files:   []testFile{{"a.txt", 0, 0, 4}, {"b.txt", 0, 4, 6}},
+	}.build()
+	cab, err := NewWithOptions(bytes.NewReader(cabData), Options{FolderCacheSize: 1 << 20})
+	if err != nil {
+		t.Fatalf("NewWithOptions: %v", err)
+	}
+	for name, want := range map[string]string{"a.txt": "0123", "b.txt": "456789"} {
+		r, err := cab.Content(name)
+		if err != nil {
+			t.Fatalf("Content(%q): %v", name, err)
+		}
+		if got, _ := io.ReadAll(r); string(got) != want {
+			t.Errorf("Content(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestHeaderMode(t *testing.T) {
+	for attrs, want := range map[uint16]fs.FileMode{
+		0:                        0644,
+		AttrArchive | AttrHidden: 0644,
+		AttrReadOnly:             0444,
+		AttrExec:                 0755,
+		AttrExec | AttrReadOnly:  0555,
+	} {
+		h := Header{Attributes: attrs}
+		if got := h.Mode(); got != want {
+			t.Errorf("Mode() with attributes %#x = %v, want %v", attrs, got, want)
+		}
+	}
+}
+
+func TestExtractParallel(t *testing.T) {
+	tc := testCabinet{files: []testFile{{"overlap.txt", 1, 2, 3}}}
+	want := map[string]string{"overlap.txt": "111"}
+	for i := 0; i < 8; i++ {
+		content := bytes.Repeat([]byte{'0' + byte(i)}, 5)
+		tc.folders = append(tc.folders, testFolder{blocks: []testBlock{{content, 5, 0}}})
+		name := fmt.Sprintf("%d.txt", i)
+		tc.files = append(tc.files, testFile{name, uint16(i), 0, 5})
+		want[name] = string(content)
+	}
+	c, err := New(bytes.NewReader(tc.build()))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	var mu sync.Mutex
+	got := make(map[string]string)
+	err = c.ExtractParallel(4, func(hdr *Header, r io.Reader) error {
+		data, err := io.ReadAll(r)
+		mu.Lock()
+		got[hdr.Name] = string(data)
+		mu.Unlock()
+		return err
+	})
+	if err != nil {
+		t.Fatalf("ExtractParallel: %v", err)
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got files %q, want %q", got, want)
+	}
+
+	wantErr := errors.New("test")
+	if err := c.ExtractParallel(4, func(*Header, io.Reader) error { return wantErr }); err != wantErr {
+		t.Errorf("got error %v, want %v", err, wantErr)
+	}
+}
+
+func TestLenient(t *testing.T) {
+	data := testCabinet{
+		folders: []testFolder{{blocks: []testBlock{{[]byte("hello"), 5, 0}}}},
+		files:   []testFile{{"a.txt", 0, 0, 5}},
+	}.build()
+	data[12] = 1 // Reserved2
+	data[24] = 2 // VersionMinor
+	data[8] += 1 // CBCabinet
+	if _, err := New(bytes.NewReader(data)); err == nil {
+		t.Fatal("New accepted a quirky cabinet without Lenient")
+	}
+	var warnings []string
+	c, err := NewWithOptions(bytes.NewReader(data), Options{
+		Lenient: true,
+		Warn:    func(msg string) { warnings = append(warnings, msg) },
+	})
+	if err != nil {
+		t.Fatalf("NewWithOptions: %v", err)
+	}
+	if len(warnings) != 3 {
+		t.Errorf("got warnings %q, want 3", warnings)
+	}
+	checkFiles(t, c, map[string]string{"a.txt": "hello"})
+}
+
+// countingReadSeeker counts the bytes read from an io.ReadSeeker.
+type countingReadSeeker struct {
+	io.ReadSeeker
+	n int
+}
+
+func (c *countingReadSeeker) Read(p []byte) (int, error) {
+	n, err := c.ReadSeeker.Read(p)
+	c.n += n
+	return n, err
+}
+
+func TestUncompressedSeek(t *testing.T) {
+	big := bytes.Repeat([]byte{'x'}, maxBlockSize)
+	data := testCabinet{
+		folders: []testFolder{{blocks: []testBlock{
+			{big, maxBlockSize, 0}, {big, maxBlockSize, 0}, {[]byte("xxhello"), 7, 0},
+		}}},
+		files: []testFile{{"big.txt", 0, 0, 2*maxBlockSize + 2}, {"small.txt", 0, 2*maxBlockSize + 2, 5}},
+	}.build()
+	r := &countingReadSeeker{ReadSeeker: bytes.NewReader(data)}
+	c, err := New(r)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	r.n = 0
+	content, err := c.Content("small.txt")
+	if err != nil {
+		t.Fatalf("Content: %v", err)
+	}
+	got, err := io.ReadAll(content)
+	if err != nil || string(got) != "hello" {
+		t.Errorf("got %q, %v, want \"hello\"", got, err)
+	}
+	if r.n > 100 {
+		t.Errorf("read %d bytes for a 5 byte file", r.n)
+	}
+}
+
+func TestProgress(t *testing.T) {
+	data := testCabinet{
+		folders: []testFolder{{blocks: []testBlock{{[]byte("hello"), 5, 0}, {[]byte("world"), 5, 0}}}},
+		files:   []testFile{{"a.txt", 0, 0, 5}, {"b.txt", 0, 5, 5}},
+	}.build()
+	var last Progress
+	calls := 0
+	c, err := NewWithOptions(bytes.NewReader(data), Options{Progress: func(p Progress) {
+		last = p
+		calls++
+	}})
+	if err != nil {
+		t.Fatalf("NewWithOptions: %v", err)
+	}
+	checkFiles(t, c, map[string]string{"a.txt": "hello", "b.txt": "world"})
+	if want := (Progress{Files: 2, TotalFiles: 2, Bytes: 10, TotalBytes: 10}); last != want || calls != 4 {
+		t.Errorf("got %d calls with last progress %+v, want 4 calls ending with %+v", calls, last, want)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	// A folder of 40 MSZIP blocks of zeros, 1.25MiB decompressed from a
+	// few hundred bytes.
+	var block bytes.Buffer
+	block.WriteString("CK")
+	fw, _ := flate.NewWriter(&block, flate.BestCompression)
+	fw.Write(make([]byte, maxBlockSize))
+	fw.Close()
+	var blocks []testBlock
+	for i := 0; i < 40; i++ {
+		blocks = append(blocks, testBlock{block.Bytes(), maxBlockSize, 0})
+	}
+	cabData := testCabinet{
+		folders: []testFolder{{typeCompress: compMSZIP, blocks: blocks}},
+		files:   []testFile{{"zeros.bin", 0, 0, 40 * maxBlockSize}},
+	}.build()
+	for _, tc := range []struct {
+		name string
+		opts Options
+		fail bool
+	}{
+		{"none", Options{}, false},
+		{"folder size", Options{MaxFolderSize: 1 << 20}, true},
+		{"ratio", Options{MaxRatio: 100}, true},
+		{"within limits", Options{MaxFolderSize: 2 << 20, MaxRatio: 10000}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c, err := NewWithOptions(bytes.NewReader(cabData), tc.opts)
+			if err != nil {
+				t.Fatalf("NewWithOptions: %v", err)
+			}
+			if _, err := c.Next(); err != nil {
+				t.Fatalf("Next: %v", err)
+			}
+			_, err = io.ReadAll(c)
+			if tc.fail && !errors.Is(err, ErrLimitExceeded) {
+				t.Errorf("got error %v, want ErrLimitExceeded", err)
+			}
+			if !tc.fail && err != nil {
+				t.Errorf("ReadAll: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright 2022 Lorenz Brun
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cab
+
+import "container/list"
+
+// folderCache keeps the decompressed data of recently used folders up to a
+// total size, evicting the least recently used ones first.
+type folderCache struct {
+	maxSize int64
+	size    int64
+	// Entries ordered from most to least recently used
+	lru      *list.List
+	byFolder map[uint16]*list.Element
+}
+
+type folderCacheEntry struct {
+	folder uint16
+	data   []byte
+}
+
+func newFolderCache(maxSize int64) *folderCache {
+	return &folderCache{
+		maxSize:  maxSize,
+		lru:      list.New(),
+		byFolder: make(map[uint16]*list.Element),
+	}
+}
+
+func (c *folderCache) get(folder uint16) ([]byte, bool) {
+	e, ok := c.byFolder[folder]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+	return e.Value.(*folderCacheEntry).data, true
+}
+
+// put adds the data of a folder to the cache. Folders larger than the whole
+// cache are not added.
+func (c *folderCache) put(folder uint16, data []byte) {
+	if int64(len(data)) > c.maxSize {
+		return
+	}
+	if _, ok := c.byFolder[folder]; ok {
+		return
+	}
+	c.byFolder[folder] = c.lru.PushFront(&folderCacheEntry{folder: folder, data: data})
+	c.size += int64(len(data))
+	for c.size > c.maxSize {
+		oldest := c.lru.Remove(c.lru.Back()).(*folderCacheEntry)
+		delete(c.byFolder, oldest.folder)
+		c.size -= int64(len(oldest.data))
+	}
+}
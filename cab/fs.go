@@ -0,0 +1,211 @@
+// Copyright 2022 Lorenz Brun
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cab
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// FS returns a read-only fs.FS view of the files in c. Backslashes in file
+// names are treated as path separators and names which aren't valid
+// relative paths are left out. File contents are read like with Content,
+// so open files can be read in any order. Without Options.FolderCacheSize
+// every opened file decompresses its folder up to the file, and if the
+// readers of the cabinet files don't implement io.ReaderAt files are
+// buffered completely on their first Read. The returned FS must not be used
+// concurrently with other methods of c.
+func FS(c *Cabinet) fs.FS {
+	root := &fsNode{name: ".", dir: true, children: make(map[string]*fsNode)}
+	for _, f := range c.files {
+		p := path.Clean(strings.ReplaceAll(f.name, "\\", "/"))
+		if !fs.ValidPath(p) || p == "." {
+			continue
+		}
+		parts := strings.Split(p, "/")
+		dir := root
+		for _, part := range parts[:len(parts)-1] {
+			child := dir.children[part]
+			if child == nil {
+				child = &fsNode{name: part, dir: true, children: make(map[string]*fsNode)}
+				dir.children[part] = child
+			}
+			if !child.dir {
+				// A file and a directory of the same name, the file loses
+				child.dir = true
+				child.file = nil
+				child.children = make(map[string]*fsNode)
+			}
+			dir = child
+		}
+		name := parts[len(parts)-1]
+		if existing := dir.children[name]; existing != nil && existing.dir {
+			continue
+		}
+		dir.children[name] = &fsNode{name: name, file: f, hdr: f.header()}
+	}
+	return &cabFS{root: root, c: c}
+}
+
+type fsNode struct {
+	name     string
+	dir      bool
+	file     *file
+	hdr      *Header
+	children map[string]*fsNode
+}
+
+func (n *fsNode) Name() string { return n.name }
+func (n *fsNode) Size() int64 {
+	if n.dir {
+		return 0
+	}
+	return int64(n.hdr.Size)
+}
+func (n *fsNode) Mode() fs.FileMode {
+	if n.dir {
+		return fs.ModeDir | 0555
+	}
+	return n.hdr.Mode()
+}
+func (n *fsNode) ModTime() time.Time {
+	if n.dir {
+		return time.Time{}
+	}
+	return n.hdr.CreateTime
+}
+func (n *fsNode) IsDir() bool      { return n.dir }
+func (n *fsNode) Sys() interface{} { return n.hdr }
+
+func (n *fsNode) Type() fs.FileMode          { return n.Mode().Type() }
+func (n *fsNode) Info() (fs.FileInfo, error) { return n, nil }
+
+func (n *fsNode) entries() []fs.DirEntry {
+	var entries []fs.DirEntry
+	for _, c := range n.children {
+		entries = append(entries, c)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries
+}
+
+type cabFS struct {
+	root *fsNode
+	c    *Cabinet
+}
+
+func (f *cabFS) lookup(op, name string) (*fsNode, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	n := f.root
+	if name == "." {
+		return n, nil
+	}
+	for _, part := range strings.Split(name, "/") {
+		if !n.dir {
+			return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+		n = n.children[part]
+		if n == nil {
+			return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+	}
+	return n, nil
+}
+
+func (f *cabFS) Open(name string) (fs.File, error) {
+	n, err := f.lookup("open", name)
+	if err != nil {
+		return nil, err
+	}
+	if n.dir {
+		return &fsDir{node: n, entries: n.entries()}, nil
+	}
+	return &fsFile{node: n, fs: f}, nil
+}
+
+func (f *cabFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	n, err := f.lookup("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	if !n.dir {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+	return n.entries(), nil
+}
+
+func (f *cabFS) Stat(name string) (fs.FileInfo, error) {
+	n, err := f.lookup("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+type fsDir struct {
+	node    *fsNode
+	entries []fs.DirEntry
+	offset  int
+}
+
+func (d *fsDir) Stat() (fs.FileInfo, error) { return d.node, nil }
+func (d *fsDir) Close() error               { return nil }
+func (d *fsDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.node.name, Err: errors.New("is a directory")}
+}
+
+func (d *fsDir) ReadDir(count int) ([]fs.DirEntry, error) {
+	rest := d.entries[d.offset:]
+	if count <= 0 {
+		d.offset = len(d.entries)
+		return rest, nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	if count > len(rest) {
+		count = len(rest)
+	}
+	d.offset += count
+	return rest[:count], nil
+}
+
+type fsFile struct {
+	node *fsNode
+	fs   *cabFS
+	r    io.Reader
+}
+
+func (f *fsFile) Stat() (fs.FileInfo, error) { return f.node, nil }
+
+func (f *fsFile) Read(b []byte) (int, error) {
+	if f.r == nil {
+		r, err := f.fs.c.content(f.node.file)
+		if err != nil {
+			return 0, &fs.PathError{Op: "read", Path: f.node.name, Err: err}
+		}
+		f.r = r
+	}
+	return f.r.Read(b)
+}
+
+func (f *fsFile) Close() error { return nil }
@@ -0,0 +1,73 @@
+package cab
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+)
+
+func TestFS(t *testing.T) {
+	cabData := testCabinet{
+		folders: []testFolder{{blocks: []testBlock{{[]byte("windowswinbasekernel32"), 22, 0}}}},
+		files: []testFile{
+			{"um\\windows.h", 0, 0, 7},
+			{"um\\winbase.h", 0, 7, 7},
+			{"lib\\x64\\kernel32.Lib", 0, 14, 8},
+			{"..\\evil.txt", 0, 0, 7},
+		},
+	}.build()
+	c, err := NewWithOptions(bytes.NewReader(cabData), Options{FolderCacheSize: 1 << 20})
+	if err != nil {
+		t.Fatalf("NewWithOptions: %v", err)
+	}
+	if err := fstest.TestFS(FS(c), "um/windows.h", "um/winbase.h", "lib/x64/kernel32.Lib"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFSAlternatingReads(t *testing.T) {
+	cabData := testCabinet{
+		folders: []testFolder{{blocks: []testBlock{{[]byte("aaaaaaaabbbbbbbb"), 16, 0}}}},
+		files:   []testFile{{"a.txt", 0, 0, 8}, {"b.txt", 0, 8, 8}},
+	}.build()
+	sources := map[string]io.ReadSeeker{
+		"ReaderAt":   bytes.NewReader(cabData),
+		"ReadSeeker": &countingReadSeeker{ReadSeeker: bytes.NewReader(cabData)},
+	}
+	for name, r := range sources {
+		t.Run(name, func(t *testing.T) {
+			c, err := New(r)
+			if err != nil {
+				t.Fatalf("New: %v", err)
+			}
+			fsys := FS(c)
+			a, err := fsys.Open("a.txt")
+			if err != nil {
+				t.Fatalf("Open: %v", err)
+			}
+			b, err := fsys.Open("b.txt")
+			if err != nil {
+				t.Fatalf("Open: %v", err)
+			}
+			var gotA, gotB []byte
+			buf := make([]byte, 3)
+			for len(gotA) < 8 || len(gotB) < 8 {
+				for _, f := range []struct {
+					f   fs.File
+					got *[]byte
+				}{{a, &gotA}, {b, &gotB}} {
+					n, err := f.f.Read(buf)
+					if err != nil && err != io.EOF {
+						t.Fatalf("Read: %v", err)
+					}
+					*f.got = append(*f.got, buf[:n]...)
+				}
+			}
+			if string(gotA) != "aaaaaaaa" || string(gotB) != "bbbbbbbb" {
+				t.Errorf("got %q and %q, want \"aaaaaaaa\" and \"bbbbbbbb\"", gotA, gotB)
+			}
+		})
+	}
+}
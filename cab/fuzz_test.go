@@ -0,0 +1,47 @@
+//go:build go1.18
+// +build go1.18
+
+package cab
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func FuzzCabinet(f *testing.F) {
+	f.Add(testCabinet{
+		folders: []testFolder{{blocks: []testBlock{{[]byte("0123456789"), 10, 0}}}},
+		files:   []testFile{{"a.txt", 0, 0, 4}, {"b.txt", 0, 2, 6}},
+	}.build())
+	f.Add(testCabinet{
+		folders:       []testFolder{{blocks: []testBlock{{[]byte("abc"), 3, 0}, {[]byte("def"), 3, 0}}}},
+		files:         []testFile{{"a.txt", 0, 0, 6}},
+		headerReserve: 4,
+		dataReserve:   2,
+	}.build())
+	f.Add(testCabinet{
+		folders: []testFolder{{typeCompress: compLZX | 15<<8, blocks: []testBlock{{[]byte{0, 0x60, 0, 0, 0, 0}, 5, 0}}}},
+		files:   []testFile{{"a.txt", 0, 0, 5}},
+	}.build())
+	f.Fuzz(func(t *testing.T, data []byte) {
+		opts := Options{MaxFolderSize: 1 << 20, VerifyChecksums: true, FolderCacheSize: 1 << 20}
+		c, err := NewWithOptions(bytes.NewReader(data), opts)
+		if err != nil {
+			return
+		}
+		for _, name := range c.FileList() {
+			if r, err := c.Content(name); err == nil {
+				io.Copy(io.Discard, r)
+			}
+		}
+		for {
+			if _, err := c.Next(); err != nil {
+				return
+			}
+			if _, err := io.Copy(io.Discard, c); err != nil {
+				return
+			}
+		}
+	})
+}
@@ -0,0 +1,90 @@
+// Copyright 2022 Lorenz Brun
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cab
+
+import "fmt"
+
+// Compression is the compression method of a folder.
+type Compression uint16
+
+const (
+	CompressionNone    Compression = compNone
+	CompressionMSZIP   Compression = compMSZIP
+	CompressionQuantum Compression = compQuantum
+	CompressionLZX     Compression = compLZX
+)
+
+func (c Compression) String() string {
+	switch c {
+	case CompressionNone:
+		return "none"
+	case CompressionMSZIP:
+		return "MS-ZIP"
+	case CompressionQuantum:
+		return "Quantum"
+	case CompressionLZX:
+		return "LZX"
+	}
+	return fmt.Sprintf("Compression(%d)", uint16(c))
+}
+
+// FolderInfo describes the layout of a folder. Folders are compressed
+// independently of each other, but the files in a folder can only be
+// decompressed in order.
+type FolderInfo struct {
+	Compression Compression
+	// WindowBits is the base-2 logarithm of the LZX window size, zero for
+	// other compression methods.
+	WindowBits int
+	// Blocks is the number of data blocks, summed over all cabinets the
+	// folder spans. Blocks split between two cabinets are counted twice.
+	Blocks int
+	// Cabinets is the number of cabinets of a multi-part set the folder's
+	// data is stored in.
+	Cabinets int
+	// Files is the number of files in the folder.
+	Files int
+}
+
+// Folders returns the layout of all folders in the Cabinet, indexed like
+// Header.Folder.
+func (c *Cabinet) Folders() []FolderInfo {
+	infos := make([]FolderInfo, len(c.fldrs))
+	for i, fldr := range c.fldrs {
+		typeCompress := fldr.segments[0].TypeCompress
+		info := FolderInfo{Compression: Compression(typeCompress & compMask), Cabinets: len(fldr.segments)}
+		if info.Compression == CompressionLZX {
+			info.WindowBits = int(lzxWindowBits(typeCompress))
+		}
+		for _, seg := range fldr.segments {
+			info.Blocks += int(seg.CCFData)
+		}
+		infos[i] = info
+	}
+	for _, f := range c.files {
+		infos[f.IFolder].Files++
+	}
+	return infos
+}
+
+// Headers returns the headers of all files in the Cabinet in the order Next
+// returns them, which is sorted by folder and offset.
+func (c *Cabinet) Headers() []*Header {
+	hdrs := make([]*Header, len(c.files))
+	for i, f := range c.files {
+		hdrs[i] = f.header()
+	}
+	return hdrs
+}
@@ -0,0 +1,541 @@
+// Copyright 2022 Lorenz Brun
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cab
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// LZX decompression as specified in [MS-PATCH] section 2, restricted to the
+// subset used in Cabinet files (no reference data, one CFDATA block per
+// frame).
+
+const (
+	lzxMinMatch        = 2
+	lzxNumChars        = 256
+	lzxPrimaryLengths  = 7
+	lzxSecondaryLength = 249
+	lzxPretreeSize     = 20
+	lzxAlignedSize     = 8
+
+	lzxBlockVerbatim     = 1
+	lzxBlockAligned      = 2
+	lzxBlockUncompressed = 3
+
+	// E8 translation is only performed on the first 32768 frames.
+	lzxMaxE8Frames = 32768
+)
+
+// lzxPositionSlots is the number of position slots for each window size.
+var lzxPositionSlots = map[uint]int{15: 30, 16: 32, 17: 34, 18: 36, 19: 38, 20: 42, 21: 50}
+
+var lzxExtraBits, lzxPositionBase [51]uint32
+
+func init() {
+	var j uint32
+	for i := 0; i < len(lzxExtraBits); i += 2 {
+		lzxExtraBits[i] = j
+		if i+1 < len(lzxExtraBits) {
+			lzxExtraBits[i+1] = j
+		}
+		if i != 0 && j < 17 {
+			j++
+		}
+	}
+	j = 0
+	for i := range lzxPositionBase {
+		lzxPositionBase[i] = j
+		j += 1 << lzxExtraBits[i]
+	}
+}
+
+// lzxWindowBits returns the base-2 logarithm of the window size encoded in a
+// CFFOLDER compression type.
+func lzxWindowBits(typeCompress uint16) uint {
+	return uint(typeCompress>>8) & 0x1f
+}
+
+var errLZXCorrupt = errors.New("corrupt LZX data")
+
+// lzxBitReader reads the LZX bit stream, which consists of 16-bit little
+// endian words whose bits are consumed starting with the most significant
+// one.
+type lzxBitReader struct {
+	in  []byte
+	pos int
+	// buf contains n valid bits, aligned to its most significant bit.
+	buf uint32
+	n   uint
+}
+
+func (b *lzxBitReader) fill() {
+	for b.n <= 16 {
+		var w uint32
+		if b.pos < len(b.in) {
+			w = uint32(b.in[b.pos])
+		}
+		if b.pos+1 < len(b.in) {
+			w |= uint32(b.in[b.pos+1]) << 8
+		}
+		b.pos += 2
+		b.buf |= w << (16 - b.n)
+		b.n += 16
+	}
+}
+
+// readBits reads up to 17 bits.
+func (b *lzxBitReader) readBits(n uint) uint32 {
+	if n == 0 {
+		return 0
+	}
+	b.fill()
+	v := b.buf >> (32 - n)
+	b.buf <<= n
+	b.n -= n
+	return v
+}
+
+// overrun reports if more bits were consumed than available.
+func (b *lzxBitReader) overrun() bool {
+	return b.pos*8-int(b.n) > len(b.in)*8
+}
+
+// align skips 1 to 16 bits to get to a 16-bit boundary and switches to
+// reading bytes.
+func (b *lzxBitReader) align() {
+	consumed := b.pos*8 - int(b.n)
+	skip := 16 - uint(consumed%16)
+	if skip > b.n {
+		b.fill()
+	}
+	b.buf <<= skip
+	b.n -= skip
+	b.pos -= int(b.n / 8)
+	b.buf, b.n = 0, 0
+}
+
+// lzxTableBits is the number of bits resolved by the primary lookup table of
+// a Huffman decoder. Longer codes are decoded canonically.
+const lzxTableBits = 10
+
+type lzxHuffman struct {
+	// table maps the next lzxTableBits bits to symbol<<4 | code length.
+	// Entries with a zero length belong to longer codes.
+	table   [1 << lzxTableBits]uint16
+	count   [17]int
+	symbols []uint16
+}
+
+// build sets up the decoder for the given code lengths, which may
+// describe an incomplete code but not an over-subscribed one.
+func (h *lzxHuffman) build(lengths []uint8) error {
+	h.count = [17]int{}
+	for _, l := range lengths {
+		h.count[l]++
+	}
+	h.count[0] = 0
+	left := 1
+	for l := 1; l <= 16; l++ {
+		left = left<<1 - h.count[l]
+		if left < 0 {
+			return fmt.Errorf("%w: over-subscribed Huffman code", errLZXCorrupt)
+		}
+	}
+	var offs [17]int
+	for l := 1; l < 16; l++ {
+		offs[l+1] = offs[l] + h.count[l]
+	}
+	h.symbols = h.symbols[:0]
+	for range lengths {
+		h.symbols = append(h.symbols, 0)
+	}
+	for sym, l := range lengths {
+		if l != 0 {
+			h.symbols[offs[l]] = uint16(sym)
+			offs[l]++
+		}
+	}
+	h.table = [1 << lzxTableBits]uint16{}
+	code, idx := 0, 0
+	for l := 1; l <= lzxTableBits; l++ {
+		for i := 0; i < h.count[l]; i++ {
+			entry := h.symbols[idx]<<4 | uint16(l)
+			start := code << (lzxTableBits - l)
+			end := (code + 1) << (lzxTableBits - l)
+			for j := start; j < end; j++ {
+				h.table[j] = entry
+			}
+			code++
+			idx++
+		}
+		code <<= 1
+	}
+	return nil
+}
+
+func (b *lzxBitReader) decode(h *lzxHuffman) (int, error) {
+	b.fill()
+	if e := h.table[b.buf>>(32-lzxTableBits)]; e&0xf != 0 {
+		l := uint(e & 0xf)
+		b.buf <<= l
+		b.n -= l
+		return int(e >> 4), nil
+	}
+	v := b.buf >> 16
+	code, first, idx := 0, 0, 0
+	for l := uint(1); l <= 16; l++ {
+		code |= int(v>>(16-l)) & 1
+		c := h.count[l]
+		if code-first < c {
+			b.buf <<= l
+			b.n -= l
+			return int(h.symbols[idx+code-first]), nil
+		}
+		idx += c
+		first = (first + c) << 1
+		code <<= 1
+	}
+	return 0, fmt.Errorf("%w: invalid Huffman code", errLZXCorrupt)
+}
+
+// lzxDecoder holds the state of an LZX stream, which spans all CFDATA blocks
+// of a folder.
+type lzxDecoder struct {
+	window     []byte
+	wpos       int
+	total      int64
+	frame      int
+	headerRead bool
+	e8Size     int32
+
+	r [3]uint32
+
+	blockType      int
+	blockSize      int
+	blockRemaining int
+	blockPad       bool
+	// Part of a match which extends into the next frame.
+	pendingLen    int
+	pendingOffset int
+
+	mainLengths   []uint8
+	lengthLengths [lzxSecondaryLength]uint8
+	main          lzxHuffman
+	length        lzxHuffman
+	aligned       lzxHuffman
+	pretree       lzxHuffman
+	lengthEmpty   bool
+
+	out []byte
+}
+
+func newLZXDecoder(windowBits uint) (*lzxDecoder, error) {
+	slots, ok := lzxPositionSlots[windowBits]
+	if !ok {
+		return nil, fmt.Errorf("unsupported LZX window size 2^%d", windowBits)
+	}
+	numMain := lzxNumChars + slots*8
+	return &lzxDecoder{
+		window:      make([]byte, 1<<windowBits),
+		r:           [3]uint32{1, 1, 1},
+		mainLengths: make([]uint8, numMain),
+	}, nil
+}
+
+// readLengths reads the pretree and the code lengths encoded with it,
+// which are deltas to the previous lengths.
+func (d *lzxDecoder) readLengths(b *lzxBitReader, lengths []uint8) error {
+	var pretreeLengths [lzxPretreeSize]uint8
+	for i := range pretreeLengths {
+		pretreeLengths[i] = uint8(b.readBits(4))
+	}
+	if err := d.pretree.build(pretreeLengths[:]); err != nil {
+		return err
+	}
+	for i := 0; i < len(lengths); {
+		z, err := b.decode(&d.pretree)
+		if err != nil {
+			return err
+		}
+		run, val := 1, uint8(0)
+		switch z {
+		case 17:
+			run = int(b.readBits(4)) + 4
+		case 18:
+			run = int(b.readBits(5)) + 20
+		case 19:
+			run = int(b.readBits(1)) + 4
+			if z, err = b.decode(&d.pretree); err != nil {
+				return err
+			}
+			if z > 16 {
+				return fmt.Errorf("%w: invalid code length delta", errLZXCorrupt)
+			}
+			val = uint8((int(lengths[i]) - z + 17) % 17)
+		default:
+			val = uint8((int(lengths[i]) - z + 17) % 17)
+		}
+		if i+run > len(lengths) {
+			return fmt.Errorf("%w: code length run overflows tree", errLZXCorrupt)
+		}
+		for ; run > 0; run-- {
+			lengths[i] = val
+			i++
+		}
+	}
+	return nil
+}
+
+func (d *lzxDecoder) readBlockHeader(b *lzxBitReader) error {
+	if d.blockPad {
+		b.pos++
+		d.blockPad = false
+	}
+	d.blockType = int(b.readBits(3))
+	d.blockSize = int(b.readBits(16))<<8 | int(b.readBits(8))
+	d.blockRemaining = d.blockSize
+	if d.blockRemaining == 0 {
+		return fmt.Errorf("%w: empty block", errLZXCorrupt)
+	}
+	switch d.blockType {
+	case lzxBlockAligned:
+		var alignedLengths [lzxAlignedSize]uint8
+		for i := range alignedLengths {
+			alignedLengths[i] = uint8(b.readBits(3))
+		}
+		if err := d.aligned.build(alignedLengths[:]); err != nil {
+			return err
+		}
+		fallthrough
+	case lzxBlockVerbatim:
+		if err := d.readLengths(b, d.mainLengths[:lzxNumChars]); err != nil {
+			return err
+		}
+		if err := d.readLengths(b, d.mainLengths[lzxNumChars:]); err != nil {
+			return err
+		}
+		if err := d.main.build(d.mainLengths); err != nil {
+			return err
+		}
+		if err := d.readLengths(b, d.lengthLengths[:]); err != nil {
+			return err
+		}
+		d.lengthEmpty = true
+		for _, l := range d.lengthLengths {
+			if l != 0 {
+				d.lengthEmpty = false
+			}
+		}
+		return d.length.build(d.lengthLengths[:])
+	case lzxBlockUncompressed:
+		b.align()
+		if b.pos+12 > len(b.in) {
+			return fmt.Errorf("%w: truncated uncompressed block header", errLZXCorrupt)
+		}
+		for i := range d.r {
+			d.r[i] = binary.LittleEndian.Uint32(b.in[b.pos:])
+			b.pos += 4
+		}
+		return nil
+	default:
+		return fmt.Errorf("%w: invalid block type %d", errLZXCorrupt, d.blockType)
+	}
+}
+
+// copyMatch copies n bytes from offset bytes back in the window.
+func (d *lzxDecoder) copyMatch(offset, n int) {
+	mask := len(d.window) - 1
+	src := (d.wpos - offset) & mask
+	for i := 0; i < n; i++ {
+		d.window[d.wpos] = d.window[src]
+		d.wpos = (d.wpos + 1) & mask
+		src = (src + 1) & mask
+	}
+}
+
+// readOffset decodes the match offset for the given position slot and
+// updates the repeated offsets.
+func (d *lzxDecoder) readOffset(b *lzxBitReader, slot int) (uint32, error) {
+	switch slot {
+	case 0:
+		return d.r[0], nil
+	case 1:
+		d.r[0], d.r[1] = d.r[1], d.r[0]
+		return d.r[0], nil
+	case 2:
+		d.r[0], d.r[2] = d.r[2], d.r[0]
+		return d.r[0], nil
+	}
+	extra := lzxExtraBits[slot]
+	offset := lzxPositionBase[slot] - 2
+	if d.blockType == lzxBlockAligned && extra >= 3 {
+		offset += b.readBits(uint(extra-3)) << 3
+		a, err := b.decode(&d.aligned)
+		if err != nil {
+			return 0, err
+		}
+		offset += uint32(a)
+	} else {
+		offset += b.readBits(uint(extra))
+	}
+	d.r[2], d.r[1], d.r[0] = d.r[1], d.r[0], offset
+	return offset, nil
+}
+
+// decodeFrame decompresses the data of one CFDATA block into frameSize
+// bytes. The returned slice is only valid until the next call.
+func (d *lzxDecoder) decodeFrame(in []byte, frameSize int) ([]byte, error) {
+	if frameSize > len(d.window) {
+		return nil, fmt.Errorf("%w: frame larger than window", errLZXCorrupt)
+	}
+	b := &lzxBitReader{in: in}
+	if !d.headerRead {
+		if b.readBits(1) == 1 {
+			d.e8Size = int32(b.readBits(16)<<16 | b.readBits(16))
+		}
+		d.headerRead = true
+	}
+	mask := len(d.window) - 1
+	start := d.wpos
+	for done := 0; done < frameSize; {
+		if d.pendingLen > 0 {
+			n := d.pendingLen
+			if n > frameSize-done {
+				n = frameSize - done
+			}
+			d.copyMatch(d.pendingOffset, n)
+			d.pendingLen -= n
+			done += n
+			continue
+		}
+		if d.blockRemaining == 0 {
+			if err := d.readBlockHeader(b); err != nil {
+				return nil, err
+			}
+		}
+		if d.blockType == lzxBlockUncompressed {
+			n := d.blockRemaining
+			if n > frameSize-done {
+				n = frameSize - done
+			}
+			if b.pos+n > len(b.in) {
+				return nil, fmt.Errorf("%w: truncated uncompressed block", errLZXCorrupt)
+			}
+			for _, c := range b.in[b.pos : b.pos+n] {
+				d.window[d.wpos] = c
+				d.wpos = (d.wpos + 1) & mask
+			}
+			b.pos += n
+			done += n
+			d.blockRemaining -= n
+			// Odd-sized uncompressed blocks are followed by a padding
+			// byte, which might only be in the next CFDATA block.
+			if d.blockRemaining == 0 && d.blockSize&1 == 1 {
+				if b.pos < len(b.in) {
+					b.pos++
+				} else {
+					d.blockPad = true
+				}
+			}
+			continue
+		}
+		sym, err := b.decode(&d.main)
+		if err != nil {
+			return nil, err
+		}
+		if sym < lzxNumChars {
+			d.window[d.wpos] = byte(sym)
+			d.wpos = (d.wpos + 1) & mask
+			done++
+			d.blockRemaining--
+			continue
+		}
+		sym -= lzxNumChars
+		matchLen := sym & 7
+		if matchLen == lzxPrimaryLengths {
+			if d.lengthEmpty {
+				return nil, fmt.Errorf("%w: match length with empty length tree", errLZXCorrupt)
+			}
+			l, err := b.decode(&d.length)
+			if err != nil {
+				return nil, err
+			}
+			matchLen += l
+		}
+		matchLen += lzxMinMatch
+		offset, err := d.readOffset(b, sym>>3)
+		if err != nil {
+			return nil, err
+		}
+		if int64(offset) > d.total+int64(done) || int(offset) > len(d.window) || offset == 0 {
+			return nil, fmt.Errorf("%w: match offset %d out of range", errLZXCorrupt, offset)
+		}
+		if matchLen > d.blockRemaining {
+			return nil, fmt.Errorf("%w: match crosses block boundary", errLZXCorrupt)
+		}
+		d.blockRemaining -= matchLen
+		n := matchLen
+		if n > frameSize-done {
+			n = frameSize - done
+		}
+		d.copyMatch(int(offset), n)
+		done += n
+		d.pendingLen, d.pendingOffset = matchLen-n, int(offset)
+	}
+	if b.overrun() {
+		return nil, fmt.Errorf("%w: bit stream overrun", errLZXCorrupt)
+	}
+
+	if cap(d.out) < frameSize {
+		d.out = make([]byte, frameSize)
+	}
+	d.out = d.out[:frameSize]
+	n := copy(d.out, d.window[start:])
+	copy(d.out[n:], d.window)
+	if d.e8Size != 0 && d.frame < lzxMaxE8Frames {
+		d.undoE8(d.out)
+	}
+	d.total += int64(frameSize)
+	d.frame++
+	return d.out, nil
+}
+
+// undoE8 reverses the translation of relative x86 CALL targets into
+// absolute ones which the compressor applies to improve compression.
+func (d *lzxDecoder) undoE8(data []byte) {
+	if len(data) <= 10 {
+		return
+	}
+	for i := 0; i < len(data)-10; {
+		if data[i] != 0xe8 {
+			i++
+			continue
+		}
+		curpos := int32(d.total) + int32(i)
+		abs := int32(binary.LittleEndian.Uint32(data[i+1:]))
+		if abs >= -curpos && abs < d.e8Size {
+			var rel int32
+			if abs >= 0 {
+				rel = abs - curpos
+			} else {
+				rel = abs + d.e8Size
+			}
+			binary.LittleEndian.PutUint32(data[i+1:], uint32(rel))
+		}
+		i += 5
+	}
+}
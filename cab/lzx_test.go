@@ -0,0 +1,196 @@
+package cab
+
+import (
+	"bytes"
+	"testing"
+)
+
+// lzxBitWriter produces an LZX bit stream for building test data.
+type lzxBitWriter struct {
+	out []byte
+	acc uint32
+	n   uint
+}
+
+func (w *lzxBitWriter) write(v uint32, n uint) {
+	for i := n; i > 0; i-- {
+		w.acc = w.acc<<1 | (v>>(i-1))&1
+		w.n++
+		if w.n == 16 {
+			w.out = append(w.out, byte(w.acc), byte(w.acc>>8))
+			w.acc, w.n = 0, 0
+		}
+	}
+}
+
+func (w *lzxBitWriter) align() {
+	w.write(0, 16-w.n)
+}
+
+// canonicalCodes returns the canonical Huffman codes for the given lengths.
+func canonicalCodes(lengths []uint8) []uint32 {
+	var count [17]uint32
+	for _, l := range lengths {
+		count[l]++
+	}
+	count[0] = 0
+	var next [17]uint32
+	var code uint32
+	for l := 1; l <= 16; l++ {
+		code = (code + count[l-1]) << 1
+		next[l] = code
+	}
+	codes := make([]uint32, len(lengths))
+	for sym, l := range lengths {
+		if l != 0 {
+			codes[sym] = next[l]
+			next[l]++
+		}
+	}
+	return codes
+}
+
+func (w *lzxBitWriter) writeSym(lengths []uint8, sym int) {
+	w.write(canonicalCodes(lengths)[sym], uint(lengths[sym]))
+}
+
+// writeLengths encodes lengths as deltas from zero using a pretree which
+// only contains the symbols needed for that.
+func (w *lzxBitWriter) writeLengths(lengths []uint8) {
+	var pretree [lzxPretreeSize]uint8
+	pretree[0], pretree[8], pretree[9] = 1, 2, 2
+	for _, l := range pretree {
+		w.write(uint32(l), 4)
+	}
+	for _, l := range lengths {
+		w.writeSym(pretree[:], (17-int(l))%17)
+	}
+}
+
+func TestLZX(t *testing.T) {
+	const windowBits = 15
+	mainLengths := make([]uint8, lzxNumChars+lzxPositionSlots[windowBits]*8)
+	for i := range mainLengths {
+		// 16 codes of length 8 and 480 of length 9 form a complete code.
+		if i < 16 {
+			mainLengths[i] = 8
+		} else {
+			mainLengths[i] = 9
+		}
+	}
+	match := func(slot, length int) int { return lzxNumChars + slot*8 + length - lzxMinMatch }
+
+	// Frame 1: a verbatim block with literals, an explicit and a repeated
+	// match.
+	var w lzxBitWriter
+	w.write(0, 1) // no E8 translation
+	w.write(lzxBlockVerbatim, 3)
+	w.write(0, 16)
+	w.write(16, 8)
+	w.writeLengths(mainLengths[:lzxNumChars])
+	w.writeLengths(mainLengths[lzxNumChars:])
+	w.writeLengths(make([]uint8, lzxSecondaryLength))
+	for _, c := range []byte("abc") {
+		w.writeSym(mainLengths, int(c))
+	}
+	// Offset 3 is in position slot 4 (base 4, one extra bit).
+	w.writeSym(mainLengths, match(4, 8))
+	w.write(1, 1)
+	w.writeSym(mainLengths, match(0, 5))
+	w.align()
+	frame1 := w.out
+
+	// Frame 2: an odd-sized uncompressed block.
+	w = lzxBitWriter{}
+	w.write(lzxBlockUncompressed, 3)
+	w.write(0, 16)
+	w.write(5, 8)
+	w.align()
+	frame2 := append(w.out, 1, 0, 0, 0, 1, 0, 0, 0, 1, 0, 0, 0)
+	frame2 = append(frame2, "hello\x00"...)
+
+	cabData := testCabinet{
+		folders: []testFolder{{
+			typeCompress: compLZX | windowBits<<8,
+			blocks:       []testBlock{{frame1, 16, 0}, {frame2, 5, 0}},
+		}},
+		files: []testFile{{"a.txt", 0, 0, 16}, {"b.txt", 0, 16, 5}},
+	}.build()
+	c, err := New(bytes.NewReader(cabData))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	checkFiles(t, c, map[string]string{"a.txt": "abcabcabcabcabca", "b.txt": "hello"})
+}
+
+// TestLZXAlignedE8 covers an aligned offset block, E8 translation and a
+// match continuing in the next frame. The expected output is derived from
+// [MS-PATCH] by hand rather than from the encoder above.
+func TestLZXAlignedE8(t *testing.T) {
+	const windowBits = 15
+	mainLengths := make([]uint8, lzxNumChars+lzxPositionSlots[windowBits]*8)
+	for i := range mainLengths {
+		if i < 16 {
+			mainLengths[i] = 8
+		} else {
+			mainLengths[i] = 9
+		}
+	}
+	lengthLengths := make([]uint8, lzxSecondaryLength)
+	lengthLengths[0], lengthLengths[11] = 8, 8
+	// Aligned offset codes of differing lengths, so reading the low 3 bits
+	// of offsets verbatim fails.
+	alignedLengths := []uint8{1, 2, 3, 4, 5, 6, 7, 7}
+	match := func(slot, header int) int { return lzxNumChars + slot*8 + header }
+
+	// Frame 1: 'x', a CALL to the absolute offset 0x105 and the alphabet,
+	// followed by the first 8 bytes of a match of 20 bytes.
+	var w lzxBitWriter
+	w.write(1, 1) // E8 translation with a file size of 0x10000
+	w.write(1, 16)
+	w.write(0, 16)
+	w.write(lzxBlockAligned, 3)
+	w.write(0, 16)
+	w.write(56, 8)
+	for _, l := range alignedLengths {
+		w.write(uint32(l), 3)
+	}
+	w.writeLengths(mainLengths[:lzxNumChars])
+	w.writeLengths(mainLengths[lzxNumChars:])
+	w.writeLengths(lengthLengths)
+	for _, c := range []byte("x\xe8\x05\x01\x00\x00abcdefghijklmnopqrstuvwxyz") {
+		w.writeSym(mainLengths, int(c))
+	}
+	// Length 20 is 2 + 7 from the main element + 11 from the length tree.
+	// Offset 26 is in position slot 9 (base 24, 3 extra bits), all of which
+	// are coded with the aligned offset tree.
+	w.writeSym(mainLengths, match(9, 7))
+	w.writeSym(lengthLengths, 11)
+	w.writeSym(alignedLengths, 4)
+	w.align()
+	frame1 := w.out
+
+	// Frame 2: the remaining 12 bytes of the match, then a match of 4 bytes
+	// at offset 41 in position slot 10 (base 32, 4 extra bits), one of which
+	// is verbatim.
+	w = lzxBitWriter{}
+	w.writeSym(mainLengths, match(10, 2))
+	w.write(1, 1)
+	w.writeSym(alignedLengths, 3)
+	w.align()
+	frame2 := w.out
+
+	cabData := testCabinet{
+		folders: []testFolder{{
+			typeCompress: compLZX | windowBits<<8,
+			blocks:       []testBlock{{frame1, 40, 0}, {frame2, 16, 0}},
+		}},
+		files: []testFile{{"a.bin", 0, 0, 56}},
+	}.build()
+	c, err := New(bytes.NewReader(cabData))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	// The CALL at offset 1 targets 0x105 - 1 relative to its position.
+	checkFiles(t, c, map[string]string{"a.bin": "x\xe8\x04\x01\x00\x00abcdefghijklmnopqrstuvwxyz" + "abcdefgh" + "ijklmnopqrst" + "fghi"})
+}
@@ -0,0 +1,60 @@
+// Copyright 2022 Lorenz Brun
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cab
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// cp437 contains the characters 0x80 to 0xff of the IBM PC code page 437,
+// the default OEM code page.
+const cp437 = "ÇüéâäàåçêëèïîìÄÅ" +
+	"ÉæÆôöòûùÿÖÜ¢£¥₧ƒ" +
+	"áíóúñÑªº¿⌐¬½¼¡«»" +
+	"░▒▓│┤╡╢╖╕╣║╗╝╜╛┐" +
+	"└┴┬├─┼╞╟╚╔╩╦╠═╬╧" +
+	"╨╤╥╙╘╒╓╫╪┘┌█▄▌▐▀" +
+	"αßΓπΣσµτΦΘΩδ∞φε∩" +
+	"≡±≥≤⌠⌡÷≈°∙·√ⁿ²■\u00a0"
+
+var cp437Runes = []rune(cp437)
+
+// DecodeCP437 decodes a file name in code page 437.
+func DecodeCP437(name []byte) string {
+	var b strings.Builder
+	for _, c := range name {
+		if c < 0x80 {
+			b.WriteByte(c)
+		} else {
+			b.WriteRune(cp437Runes[c-0x80])
+		}
+	}
+	return b.String()
+}
+
+// decodeName returns the name of f as UTF-8. Names with the UTF attribute
+// are already UTF-8 unless they are invalid, in which case they are treated
+// like all others as being in the OEM code page.
+func (o *Options) decodeName(f *file) string {
+	if f.Attribs&AttrNameIsUTF != 0 && utf8.ValidString(f.name) {
+		return f.name
+	}
+	decode := o.DecodeName
+	if decode == nil {
+		decode = DecodeCP437
+	}
+	return decode([]byte(f.name))
+}
@@ -0,0 +1,137 @@
+// Copyright 2022 Lorenz Brun
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cab
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// independent returns a copy of fldr reading through its own section
+// readers so that it can be decompressed concurrently with other folders.
+// It fails if the underlying readers don't implement io.ReaderAt.
+func (fldr *folder) independent() (*folder, bool) {
+	out := &folder{}
+	for _, seg := range fldr.segments {
+		ra, ok := seg.r.(io.ReaderAt)
+		if !ok {
+			return nil, false
+		}
+		segCopy := *seg
+		segCopy.r = io.NewSectionReader(ra, 0, seg.size)
+		out.segments = append(out.segments, &segCopy)
+	}
+	return out, true
+}
+
+// ExtractParallel decompresses the folders of the Cabinet using up to
+// workers goroutines and calls fn with the header and content of every
+// file. As folders are independent of each other, fn is called concurrently
+// for files in different folders, but in order for files in the same folder.
+// Extraction stops at the first error returned by fn or encountered while
+// decompressing.
+//
+// Folders are only decompressed concurrently if the readers of the cabinet
+// files implement io.ReaderAt, otherwise they are processed one after the
+// other. Like with Next, folders without any file accepted by
+// Options.WantFile are skipped. ExtractParallel must not be called
+// concurrently with Next or Content.
+func (c *Cabinet) ExtractParallel(workers int, fn func(hdr *Header, r io.Reader) error) error {
+	// Index of the first file of each wanted folder
+	var starts []int
+	for start := 0; start < len(c.files); {
+		end, wanted := c.folderWanted(start)
+		if wanted {
+			starts = append(starts, start)
+		}
+		start = end
+	}
+	fldrs := make([]*folder, len(starts))
+	for i, start := range starts {
+		var ok bool
+		if fldrs[i], ok = c.fldrs[c.files[start].IFolder].independent(); !ok {
+			workers = 1
+			fldrs[i] = c.fldrs[c.files[start].IFolder]
+		}
+	}
+	if workers < 1 {
+		workers = 1
+	}
+
+	var mu sync.Mutex
+	var firstErr error
+	failed := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return firstErr != nil
+	}
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				if failed() {
+					continue
+				}
+				if err := c.extractFolder(fldrs[i], starts[i], fn); err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for i := range starts {
+		if failed() {
+			break
+		}
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	return firstErr
+}
+
+// extractFolder calls fn for all files in fldr, starting at the file with
+// index start.
+func (c *Cabinet) extractFolder(fldr *folder, start int, fn func(hdr *Header, r io.Reader) error) error {
+	r, err := c.newFolderDataReader(fldr, 0)
+	if err != nil {
+		return fmt.Errorf("failed to read folder data stream: %w", err)
+	}
+	ff, err := newFolderFiles(r, c.overlapping(start))
+	if err != nil {
+		return err
+	}
+	for _, f := range c.files[start:] {
+		if f.IFolder != c.files[start].IFolder {
+			break
+		}
+		fr, err := ff.open(f)
+		if err != nil {
+			return fmt.Errorf("%v: %w", f.name, err)
+		}
+		c.progress.add(1, 0)
+		if err := fn(f.header(), fr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
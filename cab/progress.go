@@ -0,0 +1,69 @@
+// Copyright 2022 Lorenz Brun
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cab
+
+import "sync"
+
+// Progress describes how much of a Cabinet has been read.
+type Progress struct {
+	// Files is the number of files returned or skipped by Next or passed to
+	// the callback of ExtractParallel so far, TotalFiles the number of files
+	// in the Cabinet.
+	Files, TotalFiles int
+	// Bytes is the amount of folder data decompressed or skipped so far.
+	// TotalBytes is the amount of folder data covered by files, which is
+	// what reading all files in order decompresses. Bytes can exceed it if
+	// folders are decompressed more than once, like by Content.
+	Bytes, TotalBytes int64
+}
+
+// progress tracks the Progress of a Cabinet for Options.Progress. A nil
+// *progress ignores all updates.
+type progress struct {
+	mu sync.Mutex
+	p  Progress
+	fn func(Progress)
+}
+
+func newProgress(fn func(Progress), fldrs []*folder, files []*file) *progress {
+	if fn == nil {
+		return nil
+	}
+	p := &progress{fn: fn}
+	p.p.TotalFiles = len(files)
+	ends := make([]int64, len(fldrs))
+	for _, f := range files {
+		if end := int64(f.UOffFolderStart) + int64(f.CBFile); end > ends[f.IFolder] {
+			ends[f.IFolder] = end
+		}
+	}
+	for _, end := range ends {
+		p.p.TotalBytes += end
+	}
+	return p
+}
+
+// add accounts for the given number of files and bytes and reports the
+// new state. Calls to the callback are serialized.
+func (p *progress) add(files int, bytes int64) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.p.Files += files
+	p.p.Bytes += bytes
+	p.fn(p.p)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"os"
+	"runtime/debug"
+	"sort"
+	"strings"
+
+	"git.dolansoft.org/lorenz/winsysroot/manifest"
+	"git.dolansoft.org/lorenz/winsysroot/sysroot"
+)
+
+func init() {
+	subcommands = append(subcommands, &subcommand{
+		name:  "cache-key",
+		short: "Print a key identifying the sysroot the given flags build, without downloading payloads",
+		setup: setupCacheKey,
+	})
+}
+
+// cacheKeyFormat is part of every key and needs to be changed whenever the
+// key inputs change.
+const cacheKeyFormat = "winsysroot-cache-key-v2"
+
+func setupCacheKey(fs *flag.FlagSet) func(ctx context.Context) error {
+	vsRelease := fs.String("vs-release", *flagVSRelease, flag.Lookup("vs-release").Usage)
+	winSDKVersion := fs.String("win-sdk-version", *flagWinSDKVersion, flag.Lookup("win-sdk-version").Usage)
+	archs := fs.String("architectures", *flagArchitectures, flag.Lookup("architectures").Usage)
+	hostArch := fs.String("host-arch", *flagHostArch, flag.Lookup("host-arch").Usage)
+	toolsets := fs.String("msvc-toolsets", *flagMSVCToolsets, flag.Lookup("msvc-toolsets").Usage)
+	slim := fs.Bool("slim", *flagSlim, flag.Lookup("slim").Usage)
+	sdkFeatures := fs.String("sdk-features", "", flag.Lookup("sdk-features").Usage)
+	nearest := fs.Bool("nearest", false, flag.Lookup("nearest").Usage)
+	vfsRoot := fs.String("vfs-root", *flagVFSRoot, flag.Lookup("vfs-root").Usage)
+	fs.StringVar(flagCacheDir, "cache-dir", "", flag.Lookup("cache-dir").Usage)
+	salt := fs.String("salt", "", "Arbitrary string mixed into the key, like the version of a filter plugin or the CI configuration")
+	explain := fs.Bool("explain", false, "Print the inputs of the key instead of the key itself")
+	registerHTTPFlags(fs)
+	registerTrustFlags(fs)
+	return func(ctx context.Context) error {
+		_, installer, err := fetchManifests(ctx, *vsRelease)
+		if err != nil {
+			return err
+		}
+		sdkVersion, err := sysroot.ResolveSDKVersion(installer, *winSDKVersion, *nearest)
+		if err != nil {
+			return err
+		}
+		architectures := strings.Split(*archs, ",")
+		var features []string
+		if *sdkFeatures != "" {
+			features = strings.Split(*sdkFeatures, ",")
+		}
+		pkgs, err := sysroot.Packages(sysroot.Options{
+			Manifest:      installer,
+			WinSDKVersion: sdkVersion,
+			Architectures: architectures,
+			HostArch:      *hostArch,
+			Toolsets:      strings.Split(*toolsets, ","),
+		})
+		if err != nil {
+			return err
+		}
+		inputs := []string{
+			cacheKeyFormat,
+			"winsysroot " + winsysrootVersion(),
+			"vs-release " + *vsRelease,
+			"win-sdk-version " + sdkVersion,
+			"architectures " + strings.Join(sortedCopy(architectures), ","),
+			"host-arch " + *hostArch,
+			"msvc-toolsets " + strings.Join(sortedCopy(strings.Split(*toolsets, ",")), ","),
+			fmt.Sprintf("slim %v", *slim),
+			"sdk-features " + strings.Join(sortedCopy(features), ","),
+			"vfs-root " + *vfsRoot,
+			"salt " + *salt,
+		}
+		inputs = append(inputs, packageKeyLines(pkgs)...)
+		if *explain {
+			for _, l := range inputs {
+				fmt.Println(l)
+			}
+			return nil
+		}
+		h := sha256.New()
+		for _, l := range inputs {
+			fmt.Fprintln(h, l)
+		}
+		fmt.Fprintf(os.Stdout, "%x\n", h.Sum(nil))
+		return nil
+	}
+}
+
+// packageKeyLines describes pkgs by their IDs, versions and payload hashes in
+// a stable order. Payloads without a hash are identified by their URL.
+func packageKeyLines(pkgs []manifest.Package) []string {
+	var lines []string
+	for _, pkg := range pkgs {
+		for _, p := range pkg.Payloads {
+			id := strings.ToLower(p.Sha256)
+			if id == "" {
+				id = p.URL
+			}
+			lines = append(lines, fmt.Sprintf("package %v %v %v %v", pkg.ID, pkg.Version, p.FileName, id))
+		}
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+// winsysrootVersion returns the module version of this binary, which is
+// (devel) when not built from a tagged module.
+func winsysrootVersion() string {
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+		return info.Main.Version
+	}
+	return "(devel)"
+}
+
+func sortedCopy(s []string) []string {
+	s = append([]string(nil), s...)
+	sort.Strings(s)
+	return s
+}
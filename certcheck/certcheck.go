@@ -0,0 +1,97 @@
+// Package certcheck implements additional checks on certificate chains on
+// top of the standard verification: public key pinning and revocation checks
+// using CRLs. They are used both for TLS connections and for the certificates
+// signing manifests.
+package certcheck
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrPinMismatch is returned if no certificate in a chain matches any pin.
+var ErrPinMismatch = errors.New("no certificate in the chain matches a pinned public key")
+
+// SPKIHash returns the base64-encoded SHA-256 hash of the certificate's
+// SubjectPublicKeyInfo, as used in HPKP and curl's --pinnedpubkey.
+func SPKIHash(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// Pins is a set of SPKI hashes. A chain matches if any of its certificates
+// has a pinned public key. An empty set matches every chain.
+type Pins map[string]bool
+
+// ParsePins parses pins in the form sha256//BASE64 (or sha256/BASE64).
+func ParsePins(pins []string) (Pins, error) {
+	p := make(Pins)
+	for _, pin := range pins {
+		if !strings.HasPrefix(pin, "sha256/") {
+			return nil, fmt.Errorf("pin %q is not in the form sha256//BASE64", pin)
+		}
+		hash := strings.TrimPrefix(strings.TrimPrefix(pin, "sha256/"), "/")
+		raw, err := base64.StdEncoding.DecodeString(hash)
+		if err != nil || len(raw) != sha256.Size {
+			return nil, fmt.Errorf("pin %q is not a base64-encoded SHA-256 hash", pin)
+		}
+		p[hash] = true
+	}
+	return p, nil
+}
+
+// Check returns ErrPinMismatch if no certificate in chain is pinned.
+func (p Pins) Check(chain []*x509.Certificate) error {
+	if len(p) == 0 {
+		return nil
+	}
+	for _, c := range chain {
+		if p[SPKIHash(c)] {
+			return nil
+		}
+	}
+	return ErrPinMismatch
+}
+
+// ChainCheck is a check on a verified certificate chain, leaf first.
+type ChainCheck func(chain []*x509.Certificate) error
+
+// All combines checks into one which fails if any of them fails.
+func All(checks ...ChainCheck) ChainCheck {
+	return func(chain []*x509.Certificate) error {
+		for _, check := range checks {
+			if check == nil {
+				continue
+			}
+			if err := check(chain); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// TLSConfig returns a TLS configuration which runs check on the verified
+// chains of every connection in addition to the standard verification. The
+// connection is accepted if any verified chain passes.
+func TLSConfig(check ChainCheck) *tls.Config {
+	return &tls.Config{
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			var err error
+			for _, chain := range cs.VerifiedChains {
+				if err = check(chain); err == nil {
+					return nil
+				}
+			}
+			if err == nil {
+				err = errors.New("no verified certificate chain")
+			}
+			return fmt.Errorf("certificate check for %v failed: %w", cs.ServerName, err)
+		},
+	}
+}
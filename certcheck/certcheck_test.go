@@ -0,0 +1,61 @@
+package certcheck
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func testCert(t *testing.T, cn string) *x509.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestPins(t *testing.T) {
+	leaf, root, other := testCert(t, "leaf"), testCert(t, "root"), testCert(t, "other")
+	pins, err := ParsePins([]string{"sha256//" + SPKIHash(root)})
+	if err != nil {
+		t.Fatalf("ParsePins: %v", err)
+	}
+	if err := pins.Check([]*x509.Certificate{leaf, root}); err != nil {
+		t.Errorf("chain with pinned root rejected: %v", err)
+	}
+	if err := pins.Check([]*x509.Certificate{leaf, other}); !errors.Is(err, ErrPinMismatch) {
+		t.Errorf("chain without pinned key: got %v, want ErrPinMismatch", err)
+	}
+	if err := Pins(nil).Check([]*x509.Certificate{leaf}); err != nil {
+		t.Errorf("empty pin set rejected chain: %v", err)
+	}
+	if _, err := ParsePins([]string{"sha256/" + SPKIHash(root)}); err != nil {
+		t.Errorf("ParsePins with a single slash: %v", err)
+	}
+	for _, bad := range []string{SPKIHash(root), "/" + SPKIHash(root), "//" + SPKIHash(root), "sha256//notbase64!", "sha256//AAAA"} {
+		if _, err := ParsePins([]string{bad}); err == nil {
+			t.Errorf("ParsePins(%q) succeeded", bad)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package certcheck
+
+import (
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrRevoked is returned for chains containing a revoked certificate.
+var ErrRevoked = errors.New("certificate has been revoked")
+
+// maxCRLSize limits the size of downloaded CRLs.
+const maxCRLSize = 64 << 20
+
+// CRLChecker checks certificates against the CRLs published at their CRL
+// distribution points. Downloaded CRLs are cached until their next update.
+type CRLChecker struct {
+	// Client is used to download CRLs. It must not itself use the checker,
+	// as CRLs are usually served over plain HTTP anyway. If nil,
+	// http.DefaultClient is used.
+	Client *http.Client
+	// Timeout limits the time a single CRL download may take. Zero means
+	// one minute.
+	Timeout time.Duration
+	// SoftFail accepts certificates whose CRLs cannot be fetched instead of
+	// failing.
+	SoftFail bool
+
+	mu    sync.Mutex
+	cache map[string]*pkix.CertificateList
+	// inflight are the downloads in progress by URL, which concurrent
+	// checks wait for instead of downloading the CRL again.
+	inflight map[string]*crlDownload
+}
+
+// crlDownload is a download of a CRL shared by all checks needing it.
+type crlDownload struct {
+	done chan struct{}
+	crl  *pkix.CertificateList
+	err  error
+}
+
+// Check implements ChainCheck. Every certificate except the root is checked
+// against the CRLs of its distribution points, which must be signed by its
+// issuer.
+func (c *CRLChecker) Check(chain []*x509.Certificate) error {
+	for i := 0; i+1 < len(chain); i++ {
+		cert, issuer := chain[i], chain[i+1]
+		if len(cert.CRLDistributionPoints) == 0 {
+			continue
+		}
+		var lastErr error
+		checked := false
+		for _, url := range cert.CRLDistributionPoints {
+			crl, err := c.fetch(url, issuer)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			checked = true
+			for _, revoked := range crl.TBSCertList.RevokedCertificates {
+				if revoked.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+					return fmt.Errorf("%w: %q (serial %v)", ErrRevoked, cert.Subject.CommonName, cert.SerialNumber)
+				}
+			}
+			break
+		}
+		if !checked && !c.SoftFail {
+			return fmt.Errorf("failed to check revocation of %q: %w", cert.Subject.CommonName, lastErr)
+		}
+	}
+	return nil
+}
+
+// fetch returns the CRL at url signed by issuer. The lock is only held to
+// look up the cache, so slow downloads don't block checks needing other
+// CRLs. As the CRL can be cached or downloaded for a check with a different
+// issuer, its signature is checked for every caller.
+func (c *CRLChecker) fetch(url string, issuer *x509.Certificate) (*pkix.CertificateList, error) {
+	c.mu.Lock()
+	if crl, ok := c.cache[url]; ok && time.Now().Before(crl.TBSCertList.NextUpdate) {
+		c.mu.Unlock()
+		if err := checkCRLSignature(url, issuer, crl); err != nil {
+			return nil, err
+		}
+		return crl, nil
+	}
+	d, waiting := c.inflight[url]
+	if !waiting {
+		d = &crlDownload{done: make(chan struct{})}
+		if c.inflight == nil {
+			c.inflight = make(map[string]*crlDownload)
+		}
+		c.inflight[url] = d
+	}
+	c.mu.Unlock()
+
+	if waiting {
+		<-d.done
+	} else {
+		d.crl, d.err = c.download(url)
+	}
+	err := d.err
+	if err == nil {
+		err = checkCRLSignature(url, issuer, d.crl)
+	}
+	if !waiting {
+		c.mu.Lock()
+		delete(c.inflight, url)
+		if err == nil {
+			if c.cache == nil {
+				c.cache = make(map[string]*pkix.CertificateList)
+			}
+			c.cache[url] = d.crl
+		}
+		c.mu.Unlock()
+		close(d.done)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return d.crl, nil
+}
+
+func checkCRLSignature(url string, issuer *x509.Certificate, crl *pkix.CertificateList) error {
+	if err := issuer.CheckCRLSignature(crl); err != nil {
+		return fmt.Errorf("CRL %v not signed by issuer: %w", url, err)
+	}
+	return nil
+}
+
+// download fetches and parses the CRL at url.
+func (c *CRLChecker) download(url string) (*pkix.CertificateList, error) {
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = time.Minute
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	client := c.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching CRL %v: HTTP %d", url, res.StatusCode)
+	}
+	raw, err := ioutil.ReadAll(io.LimitReader(res.Body, maxCRLSize))
+	if err != nil {
+		return nil, err
+	}
+	crl, err := x509.ParseCRL(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CRL %v: %w", url, err)
+	}
+	return crl, nil
+}
@@ -0,0 +1,127 @@
+package certcheck
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCRLCheckerConcurrent(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		SubjectKeyId:          []byte{1, 2, 3, 4},
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crl, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:     big.NewInt(1),
+		ThisUpdate: time.Now().Add(-time.Hour),
+		NextUpdate: time.Now().Add(time.Hour),
+	}, ca, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	release := make(chan struct{})
+	requested := make(chan struct{}, 10)
+	var slowRequests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/slow.crl" {
+			atomic.AddInt32(&slowRequests, 1)
+			requested <- struct{}{}
+			<-release
+		}
+		w.Write(crl)
+	}))
+	defer srv.Close()
+	leaf := func(crlPath string) *x509.Certificate {
+		tmpl := &x509.Certificate{
+			SerialNumber:          big.NewInt(2),
+			Subject:               pkix.Name{CommonName: "leaf"},
+			NotBefore:             time.Now().Add(-time.Hour),
+			NotAfter:              time.Now().Add(time.Hour),
+			CRLDistributionPoints: []string{srv.URL + crlPath},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert
+	}
+	slow, fast := leaf("/slow.crl"), leaf("/fast.crl")
+
+	c := &CRLChecker{Client: srv.Client()}
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := c.Check([]*x509.Certificate{slow, ca}); err != nil {
+				t.Errorf("Check: %v", err)
+			}
+		}()
+	}
+	<-requested
+	// Another CRL can be fetched while the slow one is downloading.
+	checked := make(chan error)
+	go func() { checked <- c.Check([]*x509.Certificate{fast, ca}) }()
+	select {
+	case err := <-checked:
+		if err != nil {
+			t.Errorf("Check: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("check of another CRL waited for the slow download")
+	}
+	close(release)
+	wg.Wait()
+	if n := atomic.LoadInt32(&slowRequests); n != 1 {
+		t.Errorf("slow CRL was downloaded %d times, want once", n)
+	}
+
+	// The cached CRL is not accepted for another issuer.
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &otherKey.PublicKey, otherKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := x509.ParseCertificate(otherDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Check([]*x509.Certificate{fast, other}); err == nil {
+		t.Error("cached CRL accepted for another issuer")
+	}
+}
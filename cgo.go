@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func init() {
+	subcommands = append(subcommands, &subcommand{
+		name:  "cgo",
+		short: "Generate CC/CXX wrappers and environment settings for cross-compiling Go programs using cgo",
+		setup: setupCgo,
+	})
+}
+
+// cgoArchs maps GOARCH values to the architectures of the sysroot.
+var cgoArchs = map[string]string{
+	"386":   "x86",
+	"amd64": "x64",
+	"arm64": "arm64",
+}
+
+// cgoFilter rewrites the MinGW specific flags cmd/go and cmd/link pass to
+// the C compiler for windows targets. lld-link doesn't understand GNU ld
+// options, the MinGW runtime libraries don't exist in the sysroot and the
+// subsystem is selected differently.
+const cgoFilter = `for arg do
+	shift
+	case "$arg" in
+	-mconsole|-Wl,--subsystem,console) set -- "$@" -Wl,/subsystem:console ;;
+	-mwindows|-Wl,--subsystem,windows) set -- "$@" -Wl,/subsystem:windows ;;
+	-mthreads|-static|-Wl,-T,*|-Wl,-B*|-Wl,--*|-lmingw*|-lgcc*|-lmoldname|-lstdc++) ;;
+	*) set -- "$@" "$arg" ;;
+	esac
+done
+`
+
+func setupCgo(fs *flag.FlagSet) func(ctx context.Context) error {
+	outDir := fs.String("out", "cgo-winsysroot", "Directory to write the wrappers and environment files to")
+	goarchs := fs.String("goarch", "", "Comma-separated list of GOARCH values to generate wrappers for (default: all supported by the sysroot)")
+	return func(ctx context.Context) error {
+		if fs.NArg() != 1 {
+			return stageErrorf(stageUsage, "", "", "usage: winsysroot cgo [flags] <sysroot-dir>")
+		}
+		return runCgo(fs.Arg(0), *outDir, *goarchs)
+	}
+}
+
+func runCgo(sysrootDir, outDir, goarchs string) error {
+	info, err := inspectSysroot(sysrootDir)
+	if err != nil {
+		return stageErrorf(stageUsage, "", "", "%w", err)
+	}
+	var selected []string
+	if goarchs != "" {
+		for _, goarch := range strings.Split(goarchs, ",") {
+			arch, ok := cgoArchs[goarch]
+			if !ok {
+				return stageErrorf(stageUsage, "", "", "unsupported GOARCH %v, supported are 386, amd64 and arm64", goarch)
+			}
+			if !info.hasArch(arch) {
+				return stageErrorf(stageUsage, "", "", "sysroot does not contain %v needed for GOARCH %v, available are %v", arch, goarch, strings.Join(info.Architectures, ", "))
+			}
+			selected = append(selected, goarch)
+		}
+	} else {
+		for _, goarch := range []string{"386", "amd64", "arm64"} {
+			if info.hasArch(cgoArchs[goarch]) {
+				selected = append(selected, goarch)
+			}
+		}
+		if len(selected) == 0 {
+			return stageErrorf(stageUsage, "", "", "sysroot contains no architecture supported by Go, available are %v", strings.Join(info.Architectures, ", "))
+		}
+	}
+	// A bundled LLVM (see --bundle-llvm) only has clang-cl, which acts as
+	// clang when given the driver mode.
+	clang, clangxx := "clang", "clang++"
+	if info.useBundledLLVM(); info.LLVMDir != "" {
+		bundled := shellQuote(info.tool("clang-cl"))
+		clang, clangxx = bundled+" --driver-mode=gcc", bundled+" --driver-mode=g++"
+	}
+	outDir, err = filepath.Abs(outDir)
+	if err != nil {
+		return stageErrorf(stageOutput, "", "", "%w", err)
+	}
+	if err := os.MkdirAll(filepath.Join(outDir, "bin"), 0755); err != nil {
+		return stageErrorf(stageOutput, "", "", "%w", err)
+	}
+	for _, goarch := range selected {
+		arch := cgoArchs[goarch]
+		cc := filepath.Join(outDir, "bin", "windows_"+goarch+"-cc")
+		cxx := filepath.Join(outDir, "bin", "windows_"+goarch+"-cxx")
+		if err := ioutil.WriteFile(cc, []byte(info.cgoWrapper(goarch, arch, clang)), 0755); err != nil {
+			return stageErrorf(stageOutput, "", "", "%w", err)
+		}
+		if err := ioutil.WriteFile(cxx, []byte(info.cgoWrapper(goarch, arch, clangxx)), 0755); err != nil {
+			return stageErrorf(stageOutput, "", "", "%w", err)
+		}
+		env := filepath.Join(outDir, "windows_"+goarch+".env")
+		if err := ioutil.WriteFile(env, []byte(cgoEnv(goarch, cc, cxx)), 0644); err != nil {
+			return stageErrorf(stageOutput, "", "", "%w", err)
+		}
+		log.Printf("Wrote cgo wrappers for windows/%v, use them with: . %v && go build", goarch, shellQuote(env))
+	}
+	return nil
+}
+
+// cgoWrapper returns a shell script compiling and linking for arch with
+// compiler against the sysroot.
+func (s *sysrootInfo) cgoWrapper(goarch, arch, compiler string) string {
+	flags := []string{"--target=" + toolchainArchs[arch].Triple, "-fuse-ld=lld"}
+	if s.LLVMDir != "" {
+		// lld-link is searched next to the compiler first.
+		flags = append(flags, "-B"+s.LLVMDir)
+	}
+	if s.Overlay != "" {
+		flags = append(flags, "-ivfsoverlay", s.Overlay, "-Wl,/vfsoverlay:"+s.Overlay)
+	}
+	for _, d := range s.includeDirs() {
+		flags = append(flags, "-isystem", d)
+	}
+	for _, d := range s.libDirs(arch) {
+		flags = append(flags, "-L"+d)
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "#!/bin/sh\n")
+	fmt.Fprintf(&b, "# cgo compiler for windows/%v with MSVC %v and Windows SDK %v generated by winsysroot\n", goarch, s.MSVCVersion, s.SDKVersion)
+	b.WriteString(cgoFilter)
+	fmt.Fprintf(&b, "exec %v", compiler)
+	for _, f := range flags {
+		fmt.Fprintf(&b, " %v", shellQuote(f))
+	}
+	b.WriteString(" \"$@\"\n")
+	return b.String()
+}
+
+// cgoEnv returns a shell script setting up the go command to build for
+// windows/goarch with the given wrappers.
+func cgoEnv(goarch, cc, cxx string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Source this file to cross-compile for windows/%v with cgo\n", goarch)
+	fmt.Fprintf(&b, "export CGO_ENABLED=1\n")
+	fmt.Fprintf(&b, "export GOOS=windows\n")
+	fmt.Fprintf(&b, "export GOARCH=%v\n", goarch)
+	fmt.Fprintf(&b, "export CC=%v\n", shellQuote(cc))
+	fmt.Fprintf(&b, "export CXX=%v\n", shellQuote(cxx))
+	return b.String()
+}
+
+// shellQuote quotes s for POSIX shells if needed.
+func shellQuote(s string) string {
+	if s != "" && strings.IndexFunc(s, func(r rune) bool {
+		return !strings.ContainsRune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_./:=+,@%", r)
+	}) < 0 {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// isFile reports whether path is a regular file.
+func isFile(path string) bool {
+	fi, err := os.Stat(path)
+	return err == nil && fi.Mode().IsRegular()
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func init() {
+	subcommands = append(subcommands, &subcommand{
+		name:  "cmake-package",
+		short: "Generate a CMake package with imported targets for the headers and libraries of a sysroot directory",
+		setup: setupCMakePackage,
+	})
+}
+
+// cmakePackageName is the name projects pass to find_package.
+const cmakePackageName = "WinSysroot"
+
+func setupCMakePackage(fs *flag.FlagSet) func(ctx context.Context) error {
+	outDir := fs.String("out", "cmake-winsysroot", "Directory to write "+cmakePackageName+"Config.cmake to")
+	archs := fs.String("architectures", "", "Comma-separated list of architectures to generate imported targets for (default: all in the sysroot)")
+	return func(ctx context.Context) error {
+		if fs.NArg() != 1 {
+			return stageErrorf(stageUsage, "", "", "usage: winsysroot cmake-package [flags] <sysroot-dir>")
+		}
+		return runCMakePackage(fs.Arg(0), *outDir, *archs)
+	}
+}
+
+func runCMakePackage(sysrootDir, outDir, archs string) error {
+	info, err := inspectSysroot(sysrootDir)
+	if err != nil {
+		return stageErrorf(stageUsage, "", "", "%w", err)
+	}
+	architectures := info.Architectures
+	if archs != "" {
+		architectures = strings.Split(archs, ",")
+		for _, arch := range architectures {
+			if !info.hasArch(arch) {
+				return stageErrorf(stageUsage, "", "", "sysroot does not contain %v, available are %v", arch, strings.Join(info.Architectures, ", "))
+			}
+		}
+	}
+	outDir, err = filepath.Abs(outDir)
+	if err != nil {
+		return stageErrorf(stageOutput, "", "", "%w", err)
+	}
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		return stageErrorf(stageOutput, "", "", "%w", err)
+	}
+	for name, content := range map[string]string{
+		cmakePackageName + "Config.cmake":        info.cmakePackageConfig(architectures),
+		cmakePackageName + "ConfigVersion.cmake": info.cmakePackageVersion(),
+	} {
+		if err := ioutil.WriteFile(filepath.Join(outDir, name), []byte(content), 0644); err != nil {
+			return stageErrorf(stageOutput, "", "", "%w", err)
+		}
+	}
+	log.Printf("Wrote CMake package for %v to %v, use it with: -D%v_DIR=%v", strings.Join(architectures, ", "), outDir, cmakePackageName, outDir)
+	return nil
+}
+
+// cmakeList returns dirs as a quoted CMake list with forward slashes.
+func cmakeList(dirs []string) string {
+	slashed := make([]string, len(dirs))
+	for i, d := range dirs {
+		slashed[i] = filepath.ToSlash(d)
+	}
+	return cmakeQuote(strings.Join(slashed, ";"))
+}
+
+// cmakePackageConfig returns the package configuration file defining an
+// interface target WinSysroot::<arch> for every architecture, and
+// WinSysroot::WinSysroot for the one being built for.
+func (s *sysrootInfo) cmakePackageConfig(archs []string) string {
+	pkg := cmakePackageName
+	var b strings.Builder
+	fmt.Fprintf(&b, "# CMake package for MSVC %v and Windows SDK %v generated by winsysroot\n", s.MSVCVersion, s.SDKVersion)
+	fmt.Fprintf(&b, "if(CMAKE_VERSION VERSION_LESS 3.13)\n")
+	fmt.Fprintf(&b, "  set(%v_FOUND FALSE)\n", pkg)
+	fmt.Fprintf(&b, "  set(%v_NOT_FOUND_MESSAGE \"%v requires CMake 3.13 or newer\")\n", pkg, pkg)
+	fmt.Fprintf(&b, "  return()\n")
+	fmt.Fprintf(&b, "endif()\n\n")
+	fmt.Fprintf(&b, "set(%v_ROOT %v)\n", pkg, cmakeQuote(filepath.ToSlash(s.Root)))
+	fmt.Fprintf(&b, "set(%v_MSVC_VERSION %v)\n", pkg, s.MSVCVersion)
+	fmt.Fprintf(&b, "set(%v_SDK_VERSION %v)\n", pkg, s.SDKVersion)
+	fmt.Fprintf(&b, "set(%v_ARCHITECTURES %v)\n", pkg, strings.Join(archs, " "))
+	fmt.Fprintf(&b, "set(%v_INCLUDE_DIRS %v)\n", pkg, cmakeList(s.includeDirs()))
+	for _, arch := range archs {
+		target := pkg + "::" + arch
+		fmt.Fprintf(&b, "\nset(%v_%v_LIBRARY_DIRS %v)\n", pkg, arch, cmakeList(s.libDirs(arch)))
+		fmt.Fprintf(&b, "if(NOT TARGET %v)\n", target)
+		fmt.Fprintf(&b, "  add_library(%v INTERFACE IMPORTED)\n", target)
+		fmt.Fprintf(&b, "  set_target_properties(%v PROPERTIES\n", target)
+		fmt.Fprintf(&b, "    INTERFACE_INCLUDE_DIRECTORIES \"${%v_INCLUDE_DIRS}\"\n", pkg)
+		fmt.Fprintf(&b, "    INTERFACE_LINK_DIRECTORIES \"${%v_%v_LIBRARY_DIRS}\")\n", pkg, arch)
+		if s.Overlay != "" {
+			// Only case-sensitive hosts need the overlay, there the
+			// compiler is clang-cl and the linker lld-link.
+			overlay := filepath.ToSlash(s.Overlay)
+			fmt.Fprintf(&b, "  if(NOT CMAKE_HOST_WIN32)\n")
+			fmt.Fprintf(&b, "    set_target_properties(%v PROPERTIES\n", target)
+			fmt.Fprintf(&b, "      INTERFACE_COMPILE_OPTIONS %v\n", cmakeQuote("SHELL:-Xclang -ivfsoverlay -Xclang "+cmakeQuoteAll([]string{overlay})[0]))
+			fmt.Fprintf(&b, "      INTERFACE_LINK_OPTIONS %v)\n", cmakeQuote("/vfsoverlay:"+overlay))
+			fmt.Fprintf(&b, "  endif()\n")
+		}
+		fmt.Fprintf(&b, "endif()\n")
+		fmt.Fprintf(&b, "set(%v_%v_FOUND TRUE)\n", pkg, arch)
+	}
+
+	fmt.Fprintf(&b, "\n# The architecture of the compiler, or of the target system if no\n")
+	fmt.Fprintf(&b, "# MSVC-compatible compiler is enabled.\n")
+	fmt.Fprintf(&b, "if(NOT %v_ARCH)\n", pkg)
+	fmt.Fprintf(&b, "  set(_winsysroot_id \"${CMAKE_CXX_COMPILER_ARCHITECTURE_ID}\")\n")
+	fmt.Fprintf(&b, "  if(NOT _winsysroot_id)\n")
+	fmt.Fprintf(&b, "    set(_winsysroot_id \"${CMAKE_C_COMPILER_ARCHITECTURE_ID}\")\n")
+	fmt.Fprintf(&b, "  endif()\n")
+	for i, arch := range archs {
+		keyword := "elseif"
+		if i == 0 {
+			keyword = "if"
+		}
+		a := toolchainArchs[arch]
+		fmt.Fprintf(&b, "  %v(_winsysroot_id STREQUAL \"%v\" OR (NOT _winsysroot_id AND CMAKE_SYSTEM_PROCESSOR STREQUAL \"%v\"))\n", keyword, a.ArchitectureID, a.Processor)
+		fmt.Fprintf(&b, "    set(%v_ARCH %v)\n", pkg, arch)
+	}
+	fmt.Fprintf(&b, "  endif()\n")
+	fmt.Fprintf(&b, "  unset(_winsysroot_id)\n")
+	fmt.Fprintf(&b, "endif()\n")
+	fmt.Fprintf(&b, "if(%v_ARCH AND TARGET %v::${%v_ARCH} AND NOT TARGET %v::%v)\n", pkg, pkg, pkg, pkg, pkg)
+	fmt.Fprintf(&b, "  add_library(%v::%v INTERFACE IMPORTED)\n", pkg, pkg)
+	fmt.Fprintf(&b, "  set_target_properties(%v::%v PROPERTIES INTERFACE_LINK_LIBRARIES %v::${%v_ARCH})\n", pkg, pkg, pkg, pkg)
+	fmt.Fprintf(&b, "endif()\n")
+
+	fmt.Fprintf(&b, "\n# Components are architectures.\n")
+	fmt.Fprintf(&b, "foreach(_winsysroot_comp IN LISTS %v_FIND_COMPONENTS)\n", pkg)
+	fmt.Fprintf(&b, "  if(NOT %v_${_winsysroot_comp}_FOUND AND %v_FIND_REQUIRED_${_winsysroot_comp})\n", pkg, pkg)
+	fmt.Fprintf(&b, "    set(%v_FOUND FALSE)\n", pkg)
+	fmt.Fprintf(&b, "    set(%v_NOT_FOUND_MESSAGE \"The sysroot does not contain ${_winsysroot_comp}, available are %v\")\n", pkg, strings.Join(archs, ", "))
+	fmt.Fprintf(&b, "  endif()\n")
+	fmt.Fprintf(&b, "endforeach()\n")
+	fmt.Fprintf(&b, "unset(_winsysroot_comp)\n")
+	return b.String()
+}
+
+// cmakePackageVersion returns the package version file. The package has the
+// version of the Windows SDK and satisfies requests for older versions.
+func (s *sysrootInfo) cmakePackageVersion() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Generated by winsysroot\n")
+	fmt.Fprintf(&b, "set(PACKAGE_VERSION %v)\n", s.SDKVersion)
+	fmt.Fprintf(&b, "if(PACKAGE_FIND_VERSION VERSION_GREATER PACKAGE_VERSION)\n")
+	fmt.Fprintf(&b, "  set(PACKAGE_VERSION_COMPATIBLE FALSE)\n")
+	fmt.Fprintf(&b, "else()\n")
+	fmt.Fprintf(&b, "  set(PACKAGE_VERSION_COMPATIBLE TRUE)\n")
+	fmt.Fprintf(&b, "  if(PACKAGE_FIND_VERSION VERSION_EQUAL PACKAGE_VERSION)\n")
+	fmt.Fprintf(&b, "    set(PACKAGE_VERSION_EXACT TRUE)\n")
+	fmt.Fprintf(&b, "  endif()\n")
+	fmt.Fprintf(&b, "endif()\n")
+	return b.String()
+}
@@ -0,0 +1,175 @@
+// cabtool lists, extracts and verifies Microsoft Cabinet files using the cab
+// package.
+//
+// Usage:
+//
+//	cabtool list file.cab
+//	cabtool extract [-C dir] file.cab [name...]
+//	cabtool verify file.cab
+//
+// Multi-part sets are read starting from any of their cabinets as long as
+// the other ones are in the same directory.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"git.dolansoft.org/lorenz/winsysroot/cab"
+	"git.dolansoft.org/lorenz/winsysroot/target"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s list [-lenient] <file.cab>\n       %s extract [-lenient] [-C dir] <file.cab> [name...]\n       %s verify [-lenient] <file.cab>\n", os.Args[0], os.Args[0], os.Args[0])
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	fs := flag.NewFlagSet(os.Args[1], flag.ExitOnError)
+	fs.Usage = usage
+	lenient := fs.Bool("lenient", false, "Tolerate harmless format deviations, printing warnings")
+	var run func(c *cab.Cabinet, names []string) error
+	switch os.Args[1] {
+	case "list":
+		run = list
+	case "extract":
+		dir := fs.String("C", ".", "Directory to extract to")
+		run = func(c *cab.Cabinet, names []string) error { return extract(c, *dir, names) }
+	case "verify":
+		run = verify
+	default:
+		usage()
+		os.Exit(2)
+	}
+	fs.Parse(os.Args[2:])
+	if fs.NArg() < 1 || (os.Args[1] != "extract" && fs.NArg() != 1) {
+		usage()
+		os.Exit(2)
+	}
+	c, closeAll, err := open(fs.Arg(0), *lenient)
+	if err == nil {
+		err = run(c, fs.Args()[1:])
+		closeAll()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
+
+// open opens the cabinet at path, resolving other cabinets of a multi-part
+// set relative to its directory. closeAll closes all opened files.
+func open(path string, lenient bool) (c *cab.Cabinet, closeAll func(), err error) {
+	var files []*os.File
+	closeAll = func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}
+	openFile := func(name string) (io.ReadSeeker, error) {
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+		return f, nil
+	}
+	r, err := openFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	c, err = cab.NewWithOptions(r, cab.Options{
+		VerifyChecksums: true,
+		Lenient:         lenient,
+		Warn:            func(msg string) { fmt.Fprintf(os.Stderr, "warning: %s\n", msg) },
+		OpenCabinet: func(name string) (io.ReadSeeker, error) {
+			return openFile(filepath.Join(filepath.Dir(path), filepath.Base(strings.ReplaceAll(name, "\\", "/"))))
+		},
+	})
+	if err != nil {
+		closeAll()
+		return nil, nil, err
+	}
+	return c, closeAll, nil
+}
+
+func list(c *cab.Cabinet, _ []string) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', tabwriter.AlignRight)
+	for {
+		hdr, err := c.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%d\t%v\t%v\t %s\n", hdr.Size, hdr.CreateTime.Format("2006-01-02 15:04:05"), hdr.Mode(), hdr.Name)
+	}
+	return w.Flush()
+}
+
+func extract(c *cab.Cabinet, dir string, names []string) error {
+	want := make(map[string]bool)
+	for _, name := range names {
+		want[name] = true
+	}
+	out := target.NewDirectory(dir)
+	for {
+		hdr, err := c.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if len(want) > 0 && !want[hdr.Name] {
+			continue
+		}
+		delete(want, hdr.Name)
+		if err := out.Create(hdr.Name, int64(hdr.Size), hdr.CreateTime); err != nil {
+			return err
+		}
+		if _, err := io.Copy(out, c); err != nil {
+			return fmt.Errorf("%v: %w", hdr.Name, err)
+		}
+		fmt.Println(hdr.Name)
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	for name := range want {
+		return fmt.Errorf("file %q not found in cabinet", name)
+	}
+	return nil
+}
+
+// verify decompresses all files, checking the block checksums.
+func verify(c *cab.Cabinet, _ []string) error {
+	var files int
+	var size int64
+	for {
+		_, err := c.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		n, err := io.Copy(io.Discard, c)
+		if err != nil {
+			return err
+		}
+		files++
+		size += n
+	}
+	fmt.Printf("OK: %d files, %d bytes\n", files, size)
+	return nil
+}
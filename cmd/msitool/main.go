@@ -0,0 +1,261 @@
+// msitool inspects Windows Installer databases using the msi package and
+// extracts the files they install.
+//
+// Usage:
+//
+//	msitool info file.msi
+//	msitool tables file.msi
+//	msitool dump file.msi table
+//	msitool files file.msi
+//	msitool extract [-C dir] file.msi [file...]
+//
+// External cabinets are read from the directory containing the MSI.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"git.dolansoft.org/lorenz/winsysroot/cab"
+	"git.dolansoft.org/lorenz/winsysroot/msi"
+	"git.dolansoft.org/lorenz/winsysroot/target"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `Usage: %[1]s info <file.msi>
+       %[1]s tables <file.msi>
+       %[1]s dump <file.msi> <table>
+       %[1]s files <file.msi>
+       %[1]s extract [-C dir] <file.msi> [file...]
+`, os.Args[0])
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	fs := flag.NewFlagSet(os.Args[1], flag.ExitOnError)
+	fs.Usage = usage
+	var run func(path string, f *os.File, args []string) error
+	nargs := 1
+	switch os.Args[1] {
+	case "info":
+		run = info
+	case "tables":
+		run = tables
+	case "dump":
+		run = dump
+		nargs = 2
+	case "files":
+		run = files
+	case "extract":
+		dir := fs.String("C", ".", "Directory to extract to")
+		run = func(path string, f *os.File, names []string) error { return extract(path, f, *dir, names) }
+		nargs = -1
+	default:
+		usage()
+		os.Exit(2)
+	}
+	fs.Parse(os.Args[2:])
+	if fs.NArg() < 1 || (nargs > 0 && fs.NArg() != nargs) {
+		usage()
+		os.Exit(2)
+	}
+	f, err := os.Open(fs.Arg(0))
+	if err == nil {
+		err = run(fs.Arg(0), f, fs.Args()[1:])
+		f.Close()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
+
+func info(_ string, f *os.File, _ []string) error {
+	m, err := msi.Parse(f)
+	if err != nil {
+		return err
+	}
+	s := m.Summary
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "Product:\t%s\n", m.ProductName)
+	fmt.Fprintf(w, "Version:\t%s\n", m.ProductVersion)
+	fmt.Fprintf(w, "Title:\t%s\n", s.Title)
+	fmt.Fprintf(w, "Subject:\t%s\n", s.Subject)
+	fmt.Fprintf(w, "Author:\t%s\n", s.Author)
+	fmt.Fprintf(w, "Platform:\t%s\n", s.Platform())
+	fmt.Fprintf(w, "Languages:\t%s\n", strings.Join(s.Languages(), ", "))
+	fmt.Fprintf(w, "Package code:\t%s\n", s.RevisionNumber)
+	fmt.Fprintf(w, "Created:\t%v\n", s.CreateTime.Format("2006-01-02 15:04:05"))
+	fmt.Fprintf(w, "Installer version:\t%d\n", s.PageCount)
+	fmt.Fprintf(w, "Code page:\t%d\n", s.Codepage)
+	fmt.Fprintf(w, "Files:\t%d\n", len(m.FileMap))
+	fmt.Fprintf(w, "Cabinets:\t%s\n", strings.Join(m.CABFiles, ", "))
+	fmt.Fprintf(w, "Embedded cabinets:\t%s\n", strings.Join(m.EmbeddedCABFiles, ", "))
+	return w.Flush()
+}
+
+func tables(_ string, f *os.File, _ []string) error {
+	db, err := msi.Open(f)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, name := range db.Tables() {
+		t, err := db.Table(name)
+		if err != nil {
+			return err
+		}
+		var cols []string
+		for _, c := range t.Columns {
+			cols = append(cols, c.Name)
+		}
+		fmt.Fprintf(w, "%s\t%d rows\t%s\n", name, t.Len(), strings.Join(cols, ", "))
+	}
+	return w.Flush()
+}
+
+func dump(_ string, f *os.File, args []string) error {
+	db, err := msi.Open(f)
+	if err != nil {
+		return err
+	}
+	t, err := db.Table(args[0])
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	var names []string
+	for _, c := range t.Columns {
+		names = append(names, c.Name)
+	}
+	fmt.Fprintln(w, strings.Join(names, "\t"))
+	for _, row := range t.Rows() {
+		vals := make([]string, len(names))
+		for i, name := range names {
+			if v := row[name]; v != nil {
+				vals[i] = fmt.Sprint(v)
+			}
+		}
+		fmt.Fprintln(w, strings.Join(vals, "\t"))
+	}
+	return w.Flush()
+}
+
+func files(_ string, f *os.File, _ []string) error {
+	m, err := msi.Parse(f)
+	if err != nil {
+		return err
+	}
+	var keys []string
+	for key := range m.FileMap {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return m.FileMap[keys[i]] < m.FileMap[keys[j]] })
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", key, m.FileCAB[key], m.FileMap[key])
+	}
+	return w.Flush()
+}
+
+// extract writes the files of the MSI found in its cabinets to dir. If
+// names are given, only files with these keys or target paths are
+// extracted.
+func extract(path string, f *os.File, dir string, names []string) error {
+	m, err := msi.Parse(f)
+	if err != nil {
+		return err
+	}
+	want := make(map[string]bool)
+	for _, name := range names {
+		want[name] = true
+	}
+	out := target.NewDirectory(dir)
+	// Files spanning several cabinets of a set may show up in more than
+	// one of them.
+	done := make(map[string]bool)
+	extractCab := func(name string, r io.ReadSeeker) error {
+		var siblings []*os.File
+		defer func() {
+			for _, s := range siblings {
+				s.Close()
+			}
+		}()
+		c, err := cab.NewWithOptions(r, cab.Options{
+			VerifyChecksums: true,
+			OpenCabinet: func(name string) (io.ReadSeeker, error) {
+				s, err := os.Open(filepath.Join(filepath.Dir(path), filepath.Base(strings.ReplaceAll(name, "\\", "/"))))
+				if err != nil {
+					return nil, err
+				}
+				siblings = append(siblings, s)
+				return s, nil
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("%v: %w", name, err)
+		}
+		for {
+			hdr, err := c.Next()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("%v: %w", name, err)
+			}
+			outPath, ok := m.FileMap[hdr.Name]
+			if !ok || done[hdr.Name] {
+				continue
+			}
+			if len(want) > 0 && !want[hdr.Name] && !want[outPath] {
+				continue
+			}
+			done[hdr.Name] = true
+			delete(want, hdr.Name)
+			delete(want, outPath)
+			if err := out.Create(outPath, int64(hdr.Size), hdr.CreateTime); err != nil {
+				return err
+			}
+			if _, err := io.Copy(out, c); err != nil {
+				return fmt.Errorf("%v: %w", hdr.Name, err)
+			}
+			fmt.Println(outPath)
+		}
+	}
+	for _, name := range m.EmbeddedCABFiles {
+		r, err := m.OpenEmbeddedCAB(name)
+		if err != nil {
+			return err
+		}
+		if err := extractCab(name, r); err != nil {
+			return err
+		}
+	}
+	for _, name := range m.CABFiles {
+		cf, err := os.Open(filepath.Join(filepath.Dir(path), name))
+		if err != nil {
+			return err
+		}
+		err = extractCab(name, cf)
+		cf.Close()
+		if err != nil {
+			return err
+		}
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	for name := range want {
+		return fmt.Errorf("file %q not found", name)
+	}
+	return nil
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf16"
+)
+
+func init() {
+	subcommands = append(subcommands, &subcommand{
+		name:  "compare",
+		short: "List headers and libraries of a real Visual Studio installation missing from a sysroot directory",
+		setup: setupCompare,
+	})
+}
+
+func setupCompare(fs *flag.FlagSet) func(ctx context.Context) error {
+	summary := fs.Bool("summary", false, "Only print the number of missing files per directory")
+	return func(ctx context.Context) error {
+		if fs.NArg() != 2 {
+			return stageErrorf(stageUsage, "", "", "usage: winsysroot compare [flags] <sysroot-dir> <reference-dir|listing.txt>")
+		}
+		return runCompare(fs.Arg(0), fs.Arg(1), *summary)
+	}
+}
+
+// referencePathRegexp finds the part of a path of a Visual Studio or Windows
+// SDK installation which is reproduced in the sysroot.
+var referencePathRegexp = regexp.MustCompile(`(?i)(^|/)((VC/Tools/MSVC|Windows Kits/10)/.*)$`)
+
+// versionedDirRegexp matches the version directories of MSVC and the
+// Windows SDK, which are ignored when comparing as the reference might have
+// other versions installed.
+var versionedDirRegexp = regexp.MustCompile(`(?i)^(vc/tools/msvc|windows kits/10/(include|lib|source|bin))/[0-9][0-9.]*/`)
+
+func runCompare(sysrootDir, reference string, summary bool) error {
+	info, err := inspectSysroot(sysrootDir)
+	if err != nil {
+		return stageErrorf(stageUsage, "", "", "%w", err)
+	}
+	have := make(map[string]bool)
+	err = filepath.Walk(info.Root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(info.Root, p)
+		if err != nil {
+			return err
+		}
+		have[compareKey(filepath.ToSlash(rel))] = true
+		return nil
+	})
+	if err != nil {
+		return stageErrorf(stageUsage, "", "", "failed to read sysroot: %w", err)
+	}
+	refPaths, err := readReference(reference)
+	if err != nil {
+		return stageErrorf(stageUsage, "", "", "failed to read reference: %w", err)
+	}
+	var missing []string
+	var compared int
+	seen := make(map[string]bool)
+	for _, p := range refPaths {
+		m := referencePathRegexp.FindStringSubmatch(p)
+		if m == nil || !compareRelevant(m[2], info) {
+			continue
+		}
+		key := compareKey(m[2])
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		compared++
+		if !have[key] {
+			missing = append(missing, m[2])
+		}
+	}
+	if compared == 0 {
+		return stageErrorf(stageUsage, "", "", "%v contains no MSVC or Windows SDK headers or libraries", reference)
+	}
+	sort.Strings(missing)
+	if summary {
+		counts := make(map[string]int)
+		var dirs []string
+		for _, p := range missing {
+			dir := path.Dir(p)
+			if counts[dir] == 0 {
+				dirs = append(dirs, dir)
+			}
+			counts[dir]++
+		}
+		for _, dir := range dirs {
+			fmt.Printf("%6d %v\n", counts[dir], dir)
+		}
+	} else {
+		for _, p := range missing {
+			fmt.Println(p)
+		}
+	}
+	log.Printf("%d of %d headers and libraries of the reference are missing from the sysroot", len(missing), compared)
+	return nil
+}
+
+// compareKey returns the path used for comparing, which is lower case and
+// has no version directories.
+func compareKey(p string) string {
+	p = strings.ToLower(p)
+	if m := versionedDirRegexp.FindStringSubmatchIndex(p); m != nil {
+		p = p[:m[3]] + "/*/" + p[m[1]:]
+	}
+	return p
+}
+
+// compareRelevant reports whether p is a header or a library for an
+// architecture in the sysroot.
+func compareRelevant(p string, info *sysrootInfo) bool {
+	lower := strings.ToLower(p)
+	for _, dir := range strings.Split(path.Dir(lower), "/") {
+		if _, ok := toolchainArchs[dir]; ok && !info.hasArch(dir) {
+			return false
+		}
+	}
+	switch {
+	case strings.Contains(lower, "/include/"):
+		// The C++ standard library headers have no extension.
+		return true
+	case strings.Contains(lower, "/lib/"):
+		ext := path.Ext(lower)
+		return ext == ".lib" || ext == ".obj"
+	}
+	return false
+}
+
+// readReference returns the slash-separated paths of all files in a
+// reference directory or listed in a file, one per line like the output of
+// "dir /s /b". Listings may be UTF-16 encoded as written by PowerShell.
+func readReference(reference string) ([]string, error) {
+	fi, err := os.Stat(reference)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	if fi.IsDir() {
+		err := filepath.Walk(reference, func(p string, fi os.FileInfo, err error) error {
+			if err == nil && !fi.IsDir() {
+				paths = append(paths, filepath.ToSlash(p))
+			}
+			return err
+		})
+		return paths, err
+	}
+	raw, err := ioutil.ReadFile(reference)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.HasPrefix(raw, []byte{0xff, 0xfe}) {
+		units := make([]uint16, (len(raw)-2)/2)
+		for i := range units {
+			units[i] = uint16(raw[2+2*i]) | uint16(raw[3+2*i])<<8
+		}
+		raw = []byte(string(utf16.Decode(units)))
+	}
+	raw = bytes.TrimPrefix(raw, []byte("\xef\xbb\xbf"))
+	s := bufio.NewScanner(bytes.NewReader(raw))
+	s.Buffer(nil, 1<<20)
+	for s.Scan() {
+		if line := strings.TrimSpace(s.Text()); line != "" {
+			paths = append(paths, strings.ReplaceAll(line, `\`, "/"))
+		}
+	}
+	return paths, s.Err()
+}
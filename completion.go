@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+func init() {
+	subcommands = append(subcommands,
+		&subcommand{name: "completion", short: "Print a shell completion script (bash, zsh or fish)", setup: setupCompletion},
+		&subcommand{name: "man", short: "Print the man page in roff format", setup: setupMan},
+	)
+}
+
+type flagDoc struct {
+	name   string
+	usage  string
+	def    string
+	isBool bool
+}
+
+func flagDocs(fs *flag.FlagSet) []flagDoc {
+	var docs []flagDoc
+	fs.VisitAll(func(f *flag.Flag) {
+		boolFlag, ok := f.Value.(interface{ IsBoolFlag() bool })
+		docs = append(docs, flagDoc{
+			name:   f.Name,
+			usage:  f.Usage,
+			def:    f.DefValue,
+			isBool: ok && boolFlag.IsBoolFlag(),
+		})
+	})
+	return docs
+}
+
+// subcommandFlags returns the flags of a subcommand without running it.
+func subcommandFlags(cmd *subcommand) []flagDoc {
+	fs := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+	cmd.setup(fs)
+	return flagDocs(fs)
+}
+
+func setupCompletion(fs *flag.FlagSet) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		if fs.NArg() != 1 {
+			return stageErrorf(stageUsage, "", "", "usage: winsysroot completion bash|zsh|fish")
+		}
+		switch fs.Arg(0) {
+		case "bash":
+			writeBashCompletion(os.Stdout)
+		case "zsh":
+			writeZshCompletion(os.Stdout)
+		case "fish":
+			writeFishCompletion(os.Stdout)
+		default:
+			return stageErrorf(stageUsage, "", "", "unsupported shell %q, supported are bash, zsh and fish", fs.Arg(0))
+		}
+		return nil
+	}
+}
+
+func flagWords(docs []flagDoc) string {
+	var words []string
+	for _, d := range docs {
+		words = append(words, "--"+d.name)
+	}
+	return strings.Join(words, " ")
+}
+
+func writeBashCompletion(w io.Writer) {
+	var cmdNames []string
+	for _, cmd := range subcommands {
+		cmdNames = append(cmdNames, cmd.name)
+	}
+	rootFlags := flagWords(flagDocs(flag.CommandLine))
+	fmt.Fprintf(w, "# bash completion for winsysroot\n")
+	fmt.Fprintf(w, "_winsysroot() {\n")
+	fmt.Fprintf(w, "\tlocal cur=\"${COMP_WORDS[COMP_CWORD]}\"\n")
+	fmt.Fprintf(w, "\tif [[ $COMP_CWORD -gt 1 ]]; then\n")
+	fmt.Fprintf(w, "\t\tcase \"${COMP_WORDS[1]}\" in\n")
+	for _, cmd := range subcommands {
+		fmt.Fprintf(w, "\t\t%s)\n\t\t\tCOMPREPLY=($(compgen -W %q -- \"$cur\"))\n\t\t\treturn\n\t\t\t;;\n", cmd.name, flagWords(subcommandFlags(cmd)))
+	}
+	fmt.Fprintf(w, "\t\tesac\n")
+	fmt.Fprintf(w, "\t\tCOMPREPLY=($(compgen -W %q -- \"$cur\"))\n", rootFlags)
+	fmt.Fprintf(w, "\t\treturn\n")
+	fmt.Fprintf(w, "\tfi\n")
+	fmt.Fprintf(w, "\tCOMPREPLY=($(compgen -W %q -- \"$cur\"))\n", strings.Join(cmdNames, " ")+" "+rootFlags)
+	fmt.Fprintf(w, "}\n")
+	fmt.Fprintf(w, "complete -o default -F _winsysroot winsysroot\n")
+}
+
+var zshEscaper = strings.NewReplacer("'", "'\\''", "[", "\\[", "]", "\\]", ":", "\\:")
+
+func zshArguments(docs []flagDoc) string {
+	var args []string
+	for _, d := range docs {
+		if d.isBool {
+			args = append(args, fmt.Sprintf("'--%s[%s]'", d.name, zshEscaper.Replace(d.usage)))
+		} else {
+			args = append(args, fmt.Sprintf("'--%s=[%s]:%s:_files'", d.name, zshEscaper.Replace(d.usage), d.name))
+		}
+	}
+	return strings.Join(args, " \\\n\t\t\t\t")
+}
+
+func writeZshCompletion(w io.Writer) {
+	fmt.Fprintf(w, "#compdef winsysroot\n\n")
+	fmt.Fprintf(w, "_winsysroot() {\n")
+	fmt.Fprintf(w, "\tlocal -a commands\n\tcommands=(\n")
+	for _, cmd := range subcommands {
+		fmt.Fprintf(w, "\t\t'%s:%s'\n", cmd.name, zshEscaper.Replace(cmd.short))
+	}
+	fmt.Fprintf(w, "\t)\n")
+	fmt.Fprintf(w, "\tif (( CURRENT > 2 )) && (( ${commands[(I)${words[2]}:*]} )); then\n")
+	fmt.Fprintf(w, "\t\tlocal cmd=${words[2]}\n\t\tshift words\n\t\t(( CURRENT-- ))\n")
+	fmt.Fprintf(w, "\t\tcase $cmd in\n")
+	for _, cmd := range subcommands {
+		docs := subcommandFlags(cmd)
+		if len(docs) == 0 {
+			fmt.Fprintf(w, "\t\t%s)\n\t\t\t_files\n\t\t\t;;\n", cmd.name)
+			continue
+		}
+		fmt.Fprintf(w, "\t\t%s)\n\t\t\t_arguments \\\n\t\t\t\t%s \\\n\t\t\t\t'*:file:_files'\n\t\t\t;;\n", cmd.name, zshArguments(docs))
+	}
+	fmt.Fprintf(w, "\t\tesac\n\t\treturn\n\tfi\n")
+	fmt.Fprintf(w, "\t_arguments \\\n\t\t\t\t%s \\\n\t\t\t\t'1:command:->command'\n", zshArguments(flagDocs(flag.CommandLine)))
+	fmt.Fprintf(w, "\tif [[ $state == command ]]; then\n\t\t_describe 'command' commands\n\tfi\n")
+	fmt.Fprintf(w, "}\n\n_winsysroot \"$@\"\n")
+}
+
+var fishEscaper = strings.NewReplacer("'", "\\'")
+
+func writeFishFlags(w io.Writer, condition string, docs []flagDoc) {
+	for _, d := range docs {
+		requiresArg := " -r"
+		if d.isBool {
+			requiresArg = ""
+		}
+		fmt.Fprintf(w, "complete -c winsysroot -n '%s' -l %s%s -d '%s'\n", condition, d.name, requiresArg, fishEscaper.Replace(d.usage))
+	}
+}
+
+func writeFishCompletion(w io.Writer) {
+	fmt.Fprintf(w, "# fish completion for winsysroot\n")
+	fmt.Fprintf(w, "complete -c winsysroot -f\n")
+	for _, cmd := range subcommands {
+		fmt.Fprintf(w, "complete -c winsysroot -n __fish_use_subcommand -a %s -d '%s'\n", cmd.name, fishEscaper.Replace(cmd.short))
+	}
+	writeFishFlags(w, "__fish_use_subcommand", flagDocs(flag.CommandLine))
+	for _, cmd := range subcommands {
+		writeFishFlags(w, "__fish_seen_subcommand_from "+cmd.name, subcommandFlags(cmd))
+	}
+}
+
+var roffEscaper = strings.NewReplacer("\\", "\\e", "-", "\\-", "'", "\\(aq")
+
+func writeManFlags(w io.Writer, docs []flagDoc) {
+	for _, d := range docs {
+		fmt.Fprintf(w, ".TP\n.B \\-\\-%s", roffEscaper.Replace(d.name))
+		if !d.isBool {
+			fmt.Fprintf(w, " \\fI%s\\fR", "value")
+		}
+		fmt.Fprintf(w, "\n%s", roffEscaper.Replace(d.usage))
+		if d.def != "" && d.def != "false" {
+			fmt.Fprintf(w, " (default: %s)", roffEscaper.Replace(d.def))
+		}
+		fmt.Fprintf(w, "\n")
+	}
+}
+
+func setupMan(fs *flag.FlagSet) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		writeManPage(os.Stdout)
+		return nil
+	}
+}
+
+func writeManPage(w io.Writer) {
+	fmt.Fprintf(w, ".TH WINSYSROOT 1 %q\n", time.Now().Format("2006-01-02"))
+	fmt.Fprintf(w, ".SH NAME\nwinsysroot \\- assemble Windows sysroots directly from Microsoft sources\n")
+	fmt.Fprintf(w, ".SH SYNOPSIS\n.B winsysroot\n[\\fIflags\\fR]\n.br\n.B winsysroot\n\\fIcommand\\fR [\\fIflags\\fR]\n")
+	fmt.Fprintf(w, ".SH DESCRIPTION\nDownloads the Windows SDK and MSVC libraries and headers from Microsoft's servers and assembles them into a sysroot usable with clang\\-cl and lld\\-link.\n")
+	fmt.Fprintf(w, ".SH OPTIONS\n")
+	writeManFlags(w, flagDocs(flag.CommandLine))
+	fmt.Fprintf(w, ".SH COMMANDS\n")
+	for _, cmd := range subcommands {
+		fmt.Fprintf(w, ".SS %s\n%s\n", roffEscaper.Replace(cmd.name), roffEscaper.Replace(cmd.short))
+		writeManFlags(w, subcommandFlags(cmd))
+	}
+	fmt.Fprintf(w, ".SH EXIT STATUS\n")
+	for _, e := range []struct {
+		code int
+		desc string
+	}{
+		{exitOK, "Success"},
+		{exitInternal, "Internal error"},
+		{exitUsage, "Invalid usage"},
+		{exitManifest, "Failed to fetch or parse a manifest"},
+		{exitResolve, "Failed to resolve the requested packages"},
+		{exitDownload, "Failed to download a payload"},
+		{exitExtract, "Failed to parse or extract a payload"},
+		{exitOutput, "Failed to write the output"},
+	} {
+		fmt.Fprintf(w, ".TP\n.B %d\n%s\n", e.code, e.desc)
+	}
+}
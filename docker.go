@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func init() {
+	subcommands = append(subcommands, &subcommand{
+		name:  "dockerfile",
+		short: "Generate a Dockerfile for a cross-compilation image containing a sysroot directory and LLVM",
+		setup: setupDockerfile,
+	})
+}
+
+// dockerToolchainDir is where the CMake toolchain files are put in the image.
+const dockerToolchainDir = "/usr/local/share/winsysroot"
+
+func setupDockerfile(fs *flag.FlagSet) func(ctx context.Context) error {
+	outDir := fs.String("out", "docker-winsysroot", "Directory to write the Dockerfile and toolchain files to, use .devcontainer with --devcontainer")
+	base := fs.String("base", "debian:bookworm-slim", "Debian or Ubuntu based image to install LLVM into")
+	llvmVersion := fs.String("llvm-version", "14", "Version of the LLVM packages (clang-N, lld-N, llvm-N) installed from the base image's repositories")
+	arch := fs.String("architecture", "", "Architecture CMAKE_TOOLCHAIN_FILE targets by default in the image (default: x64 if in the sysroot, otherwise the first one)")
+	devcontainer := fs.Bool("devcontainer", false, "Also write a devcontainer.json building the image")
+	return func(ctx context.Context) error {
+		if fs.NArg() != 1 {
+			return stageErrorf(stageUsage, "", "", "usage: winsysroot dockerfile [flags] <sysroot-dir>")
+		}
+		return runDockerfile(fs.Arg(0), *outDir, *base, *llvmVersion, *arch, *devcontainer)
+	}
+}
+
+func runDockerfile(sysrootDir, outDir, base, llvmVersion, arch string, devcontainer bool) error {
+	info, err := inspectSysroot(sysrootDir)
+	if err != nil {
+		return stageErrorf(stageUsage, "", "", "%w", err)
+	}
+	switch {
+	case arch == "" && info.hasArch("x64"):
+		arch = "x64"
+	case arch == "":
+		arch = info.Architectures[0]
+	case !info.hasArch(arch):
+		return stageErrorf(stageUsage, "", "", "sysroot does not contain %v, available are %v", arch, strings.Join(info.Architectures, ", "))
+	}
+	if err := os.MkdirAll(filepath.Join(outDir, "toolchains"), 0755); err != nil {
+		return stageErrorf(stageOutput, "", "", "%w", err)
+	}
+	// The sysroot is put at the same path in the image as on the host as its
+	// VFS overlay refers to files by absolute path.
+	for _, a := range info.Architectures {
+		toolchain := filepath.Join(outDir, "toolchains", "winsysroot-"+a+".cmake")
+		if err := ioutil.WriteFile(toolchain, []byte(info.cmakeToolchain(a)), 0644); err != nil {
+			return stageErrorf(stageOutput, "", "", "%w", err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(outDir, "Dockerfile"), []byte(info.dockerfile(base, llvmVersion, arch)), 0644); err != nil {
+		return stageErrorf(stageOutput, "", "", "%w", err)
+	}
+	if devcontainer {
+		raw, err := json.MarshalIndent(map[string]interface{}{
+			"name": "winsysroot",
+			"build": map[string]interface{}{
+				"dockerfile": "Dockerfile",
+				"context":    ".",
+				"options":    []string{"--build-context", "sysroot=" + info.Root},
+			},
+			"customizations": map[string]interface{}{
+				"vscode": map[string]interface{}{
+					"extensions": []string{"ms-vscode.cmake-tools"},
+				},
+			},
+		}, "", "\t")
+		if err != nil {
+			return stageErrorf(stageOutput, "", "", "%w", err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(outDir, "devcontainer.json"), append(raw, '\n'), 0644); err != nil {
+			return stageErrorf(stageOutput, "", "", "%w", err)
+		}
+	}
+	log.Printf("Wrote Dockerfile, build the image with: docker build --build-context sysroot=%v %v", info.Root, outDir)
+	return nil
+}
+
+// dockerfile returns a Dockerfile installing LLVM into base and copying the
+// sysroot from the build context named sysroot.
+func (s *sysrootInfo) dockerfile(base, llvmVersion, arch string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# syntax=docker/dockerfile:1.4\n")
+	fmt.Fprintf(&b, "# Windows cross-compilation image generated by winsysroot, build it with\n")
+	fmt.Fprintf(&b, "#   docker build --build-context sysroot=%v .\n", s.Root)
+	fmt.Fprintf(&b, "FROM %v\n\n", base)
+	fmt.Fprintf(&b, "ARG LLVM_VERSION=%v\n", llvmVersion)
+	fmt.Fprintf(&b, "RUN apt-get update && \\\n")
+	fmt.Fprintf(&b, "    apt-get install -y --no-install-recommends clang-${LLVM_VERSION} lld-${LLVM_VERSION} llvm-${LLVM_VERSION} cmake ninja-build && \\\n")
+	fmt.Fprintf(&b, "    rm -rf /var/lib/apt/lists/*\n")
+	fmt.Fprintf(&b, "# Provides clang-cl, lld-link, llvm-lib, llvm-rc and llvm-mt without version suffix\n")
+	fmt.Fprintf(&b, "ENV PATH=/usr/lib/llvm-${LLVM_VERSION}/bin:$PATH\n\n")
+	fmt.Fprintf(&b, "COPY --from=sysroot %v\n", dockerArgs(".", s.Root+"/"))
+	fmt.Fprintf(&b, "COPY %v\n", dockerArgs("toolchains", dockerToolchainDir+"/"))
+	fmt.Fprintf(&b, "ENV WINSYSROOT=%q\n", s.Root)
+	fmt.Fprintf(&b, "ENV CMAKE_TOOLCHAIN_FILE=%v/winsysroot-%v.cmake\n", dockerToolchainDir, arch)
+	fmt.Fprintf(&b, "ENV CMAKE_GENERATOR=Ninja\n")
+	return b.String()
+}
+
+// dockerArgs returns args in the JSON form of instructions like COPY, which
+// allows paths containing whitespace.
+func dockerArgs(args ...string) string {
+	raw, _ := json.Marshal(args)
+	return string(raw)
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"git.dolansoft.org/lorenz/winsysroot/vfs"
+)
+
+func init() {
+	subcommands = append(subcommands, &subcommand{
+		name:  "doctor",
+		short: "Check the LLVM tools and a sysroot directory for problems and suggest fixes",
+		setup: setupDoctor,
+	})
+}
+
+// doctorMinClang is the first clang version supporting /winsysroot.
+const doctorMinClang = 13
+
+// doctorTools are the LLVM tools builds with a sysroot need. llvm-lib and
+// llvm-rc don't print their version.
+var doctorTools = []struct {
+	name    string
+	version bool
+}{
+	{"clang-cl", true},
+	{"lld-link", true},
+	{"llvm-lib", false},
+	{"llvm-rc", false},
+}
+
+var llvmVersionRegexp = regexp.MustCompile(`(?:LLVM|clang) version ([0-9]+)\.[0-9.]+`)
+
+func setupDoctor(fs *flag.FlagSet) func(ctx context.Context) error {
+	compile := fs.Bool("compile", true, "Compile and link a test program against the sysroot if clang-cl and lld-link are available")
+	return func(ctx context.Context) error {
+		if fs.NArg() > 1 {
+			return stageErrorf(stageUsage, "", "", "usage: winsysroot doctor [flags] [sysroot-dir]")
+		}
+		d := &doctor{}
+		d.run(ctx, fs.Arg(0), *compile)
+		if d.failed > 0 {
+			return stageErrorf(stageOutput, "", "", "%d of %d checks failed", d.failed, d.checks)
+		}
+		fmt.Printf("All %d checks passed\n", d.checks)
+		return nil
+	}
+}
+
+// doctor runs checks and prints their results.
+type doctor struct {
+	checks, failed int
+}
+
+func (d *doctor) ok(format string, a ...interface{}) {
+	d.checks++
+	fmt.Printf("ok    %v\n", fmt.Sprintf(format, a...))
+}
+
+func (d *doctor) warn(fix, format string, a ...interface{}) {
+	d.checks++
+	fmt.Printf("warn  %v\n      fix: %v\n", fmt.Sprintf(format, a...), fix)
+}
+
+func (d *doctor) fail(fix, format string, a ...interface{}) {
+	d.checks++
+	d.failed++
+	fmt.Printf("FAIL  %v\n      fix: %v\n", fmt.Sprintf(format, a...), fix)
+}
+
+func (d *doctor) run(ctx context.Context, sysrootDir string, compile bool) {
+	var info *sysrootInfo
+	if sysrootDir != "" {
+		var err error
+		if info, err = inspectSysroot(sysrootDir); err != nil {
+			d.fail("build a sysroot with winsysroot --out-dir <dir> --accept-licenses", "%v", err)
+			return
+		}
+		info.useBundledLLVM()
+		d.ok("sysroot %v has MSVC %v and Windows SDK %v for %v", info.Root, info.MSVCVersion, info.SDKVersion, strings.Join(info.Architectures, ", "))
+	} else {
+		info = &sysrootInfo{}
+	}
+
+	found := make(map[string]string)
+	for _, t := range doctorTools {
+		tool := t.name
+		path, err := exec.LookPath(info.tool(tool))
+		if err != nil {
+			d.fail("install LLVM (like apt install clang lld llvm) or rebuild the sysroot with --bundle-llvm", "%v not found", tool)
+			continue
+		}
+		found[tool] = path
+		if !t.version {
+			d.ok("%v at %v", tool, path)
+			continue
+		}
+		out, err := exec.CommandContext(ctx, path, "--version").CombinedOutput()
+		m := llvmVersionRegexp.FindSubmatch(out)
+		if err != nil || m == nil {
+			d.warn("check that "+path+" is an LLVM tool", "%v found at %v, but failed to determine its version", tool, path)
+			continue
+		}
+		if major, _ := strconv.Atoi(string(m[1])); tool == "clang-cl" && major < doctorMinClang {
+			d.fail(fmt.Sprintf("install clang %d or newer or rebuild the sysroot with --bundle-llvm", doctorMinClang), "%v at %v is %s, which does not support /winsysroot", tool, path, m[0])
+			continue
+		}
+		d.ok("%v at %v (%s)", tool, path, m[0])
+	}
+	if sysrootDir == "" {
+		return
+	}
+
+	rebuild := "rebuild the sysroot, the build might have been interrupted or filtered too much"
+	for _, dir := range []string{
+		filepath.Join("VC", "Tools", "MSVC", info.MSVCVersion, "include"),
+		filepath.Join("Windows Kits", "10", "Include", info.SDKVersion, "ucrt"),
+		filepath.Join("Windows Kits", "10", "Include", info.SDKVersion, "um"),
+		filepath.Join("Windows Kits", "10", "Include", info.SDKVersion, "shared"),
+	} {
+		d.checkDir(info.Root, dir, rebuild)
+	}
+	for _, arch := range info.Architectures {
+		for _, dir := range info.libDirs(arch) {
+			rel, _ := filepath.Rel(info.Root, dir)
+			d.checkDir(info.Root, rel, rebuild+", including "+arch+" in --architectures")
+		}
+	}
+	if !d.checkOverlay(info) {
+		return
+	}
+	if compile && found["clang-cl"] != "" && found["lld-link"] != "" {
+		d.checkCompile(ctx, info)
+	}
+}
+
+// checkDir checks that the directory rel of the sysroot exists and isn't
+// empty.
+func (d *doctor) checkDir(root, rel, fix string) {
+	entries, err := ioutil.ReadDir(filepath.Join(root, rel))
+	switch {
+	case err != nil:
+		d.fail(fix, "%v is missing", filepath.ToSlash(rel))
+	case len(entries) == 0:
+		d.fail(fix, "%v is empty", filepath.ToSlash(rel))
+	default:
+		d.ok("%v has %d entries", filepath.ToSlash(rel), len(entries))
+	}
+}
+
+// checkOverlay checks that the VFS overlay parses, is meant for the location
+// of the sysroot and only refers to existing files.
+func (d *doctor) checkOverlay(info *sysrootInfo) bool {
+	fix := "rebuild the sysroot with --out-dir set to its final location or with --vfs-root matching it"
+	if info.Overlay == "" {
+		d.fail(fix, "%v is missing, headers are only found on case-insensitive filesystems", vfs.OverlayName)
+		return false
+	}
+	raw, err := ioutil.ReadFile(info.Overlay)
+	if err != nil {
+		d.fail(fix, "failed to read %v: %v", vfs.OverlayName, err)
+		return false
+	}
+	var overlay vfs.VFS
+	if err := json.Unmarshal(raw, &overlay); err != nil || len(overlay.Roots) != 1 {
+		d.fail(fix, "%v is not a valid VFS overlay", vfs.OverlayName)
+		return false
+	}
+	root := overlay.Roots[0]
+	if filepath.Clean(filepath.FromSlash(root.Name)) != info.Root {
+		d.fail(fix, "%v is for a sysroot at %v, but it is at %v", vfs.OverlayName, root.Name, info.Root)
+		return false
+	}
+	var files int
+	var missing []string
+	var walk func(i *vfs.Inode)
+	walk = func(i *vfs.Inode) {
+		for _, c := range i.Contents {
+			if c.Type != "file" {
+				walk(c)
+				continue
+			}
+			files++
+			target := c.ExternalContents
+			if overlay.OverlayRelative != nil && *overlay.OverlayRelative {
+				target = filepath.Join(filepath.Dir(info.Overlay), filepath.FromSlash(target))
+			}
+			if _, err := os.Stat(target); err != nil {
+				missing = append(missing, c.ExternalContents)
+			}
+		}
+	}
+	walk(root)
+	if len(missing) > 0 {
+		d.fail("rebuild the sysroot, files were removed after it was built", "%d of %d files in %v are missing, like %v", len(missing), files, vfs.OverlayName, missing[0])
+		return false
+	}
+	d.ok("%v maps %d files", vfs.OverlayName, files)
+	return true
+}
+
+// checkCompile builds a program using the C runtime and the Windows API for
+// every architecture of the sysroot.
+func (d *doctor) checkCompile(ctx context.Context, info *sysrootInfo) {
+	dir, err := ioutil.TempDir("", "winsysroot-doctor-")
+	if err != nil {
+		d.fail("check that the temporary directory is writable", "%v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "test.cpp")
+	// Mixed case includes as commonly found in Windows code
+	program := "#include <Windows.h>\n#include <stdio.h>\n#include <vector>\n\nint main() {\n\tstd::vector<int> v{1};\n\tprintf(\"%d %lu\\n\", v[0], GetCurrentProcessId());\n\treturn 0;\n}\n"
+	if err := ioutil.WriteFile(src, []byte(program), 0644); err != nil {
+		d.fail("check that the temporary directory is writable", "%v", err)
+		return
+	}
+	for _, arch := range info.Architectures {
+		args := append(info.compileFlags(arch), "/nologo", "/EHsc", "-fuse-ld=lld", "/Fe"+filepath.Join(dir, "test-"+arch+".exe"), "/Fo"+filepath.Join(dir, "test-"+arch+".obj"), src, "/link")
+		args = append(args, info.linkFlags(arch)...)
+		out, err := exec.CommandContext(ctx, info.tool("clang-cl"), args...).CombinedOutput()
+		if err != nil {
+			d.fail("check the errors above, a too old clang or a sysroot built with --slim filters might be the cause", "compiling and linking a test program for %v failed: %v\n%s", arch, err, strings.TrimSpace(string(out)))
+			continue
+		}
+		d.ok("compiled and linked a test program for %v", arch)
+	}
+}
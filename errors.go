@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"git.dolansoft.org/lorenz/winsysroot/sysroot"
+)
+
+// Exit codes used by winsysroot. These are part of the CLI interface and
+// documented in the README, do not renumber them.
+const (
+	exitOK       = 0
+	exitInternal = 1
+	exitUsage    = 2
+	exitManifest = 3
+	exitResolve  = 4
+	exitDownload = 5
+	exitExtract  = 6
+	exitOutput   = 7
+)
+
+// Shorthands for the stages, the CLI reports its own errors using them too.
+const (
+	stageUsage    = sysroot.StageUsage
+	stageManifest = sysroot.StageManifest
+	stageResolve  = sysroot.StageResolve
+	stageDownload = sysroot.StageDownload
+	stageExtract  = sysroot.StageExtract
+	stageOutput   = sysroot.StageOutput
+)
+
+var stageExitCodes = map[sysroot.Stage]int{
+	stageUsage:    exitUsage,
+	stageManifest: exitManifest,
+	stageResolve:  exitResolve,
+	stageDownload: exitDownload,
+	stageExtract:  exitExtract,
+	stageOutput:   exitOutput,
+}
+
+var stageErrorf = sysroot.Errorf
+
+// errorReport is the JSON document written to --error-report on failure.
+type errorReport struct {
+	Stage    string `json:"stage"`
+	Package  string `json:"package,omitempty"`
+	URL      string `json:"url,omitempty"`
+	Error    string `json:"error"`
+	ExitCode int    `json:"exitCode"`
+}
+
+// newErrorReport describes err for reporting it to other programs.
+func newErrorReport(err error) *errorReport {
+	report := &errorReport{
+		Stage:    "internal",
+		Error:    err.Error(),
+		ExitCode: exitCodeFor(err),
+	}
+	var be *sysroot.Error
+	if errors.As(err, &be) {
+		report.Stage = string(be.Stage)
+		report.Package = be.Package
+		report.URL = be.URL
+		report.Error = be.Err.Error()
+	}
+	return report
+}
+
+// exitCodeFor returns the documented exit code for err.
+func exitCodeFor(err error) int {
+	var be *sysroot.Error
+	if errors.As(err, &be) {
+		if code, ok := stageExitCodes[be.Stage]; ok {
+			return code
+		}
+	}
+	return exitInternal
+}
+
+// fail logs err, writes the error report if requested and exits the process
+// with the exit code corresponding to the error's stage.
+func fail(err error) {
+	code := exitCodeFor(err)
+	log.Print(err)
+	if *flagErrorReport != "" {
+		report := newErrorReport(err)
+		reportRaw, err := json.MarshalIndent(report, "", "\t")
+		if err != nil {
+			log.Printf("failed to encode error report: %v", err)
+		} else if err := ioutil.WriteFile(*flagErrorReport, reportRaw, 0644); err != nil {
+			log.Printf("failed to write error report: %v", err)
+		}
+	}
+	os.Exit(code)
+}
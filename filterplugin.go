@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	"git.dolansoft.org/lorenz/winsysroot/sysroot"
+)
+
+// filterPlugin runs an external command deciding which files are included in
+// the sysroot. For every file, a JSON object with the fields path, size and
+// package is written as a single line to the command's standard input. The
+// command answers each with a line containing either include, exclude or
+// default (apply the built-in rules).
+type filterPlugin struct {
+	cmd *exec.Cmd
+	in  io.WriteCloser
+	out *bufio.Reader
+	err error
+}
+
+type filterPluginRequest struct {
+	Path    string `json:"path"`
+	Size    int64  `json:"size"`
+	Package string `json:"package"`
+}
+
+func startFilterPlugin(command string) (*filterPlugin, error) {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return nil, fmt.Errorf("empty filter plugin command")
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stderr = os.Stderr
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start filter plugin: %w", err)
+	}
+	return &filterPlugin{cmd: cmd, in: in, out: bufio.NewReader(out)}, nil
+}
+
+// Filter implements sysroot.Filter. After the first error all files are
+// excluded, the error is returned by Close.
+func (p *filterPlugin) Filter(targetPath string, info sysroot.FileInfo) sysroot.Decision {
+	if p.err != nil {
+		return sysroot.Exclude
+	}
+	req, err := json.Marshal(&filterPluginRequest{Path: targetPath, Size: info.Size, Package: info.Package})
+	if err != nil {
+		p.err = err
+		return sysroot.Exclude
+	}
+	if _, err := p.in.Write(append(req, '\n')); err != nil {
+		p.err = fmt.Errorf("failed to write to filter plugin: %w", err)
+		return sysroot.Exclude
+	}
+	line, err := p.out.ReadString('\n')
+	if err != nil {
+		p.err = fmt.Errorf("failed to read from filter plugin: %w", err)
+		return sysroot.Exclude
+	}
+	switch strings.TrimSpace(line) {
+	case "include":
+		return sysroot.Include
+	case "exclude":
+		return sysroot.Exclude
+	case "default":
+		return sysroot.Default
+	default:
+		p.err = fmt.Errorf("filter plugin returned invalid decision %q for %q", strings.TrimSpace(line), targetPath)
+		return sysroot.Exclude
+	}
+}
+
+// Close stops the plugin and returns the first error encountered.
+func (p *filterPlugin) Close() error {
+	p.in.Close()
+	waitErr := p.cmd.Wait()
+	if p.err != nil {
+		return p.err
+	}
+	if waitErr != nil {
+		return fmt.Errorf("filter plugin failed: %w", waitErr)
+	}
+	return nil
+}
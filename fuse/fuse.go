@@ -0,0 +1,66 @@
+// Package fuse serves read-only file system trees to the Linux kernel using
+// the FUSE protocol. It talks to /dev/fuse directly and only needs the
+// fusermount helper when not running as root.
+package fuse
+
+import (
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+// Node is a file or directory of a served tree. Nodes are identified by
+// their value, so they should be pointers, and must not change while the
+// tree is mounted.
+type Node interface {
+	Attr() Attr
+}
+
+// Attr describes a Node.
+type Attr struct {
+	// Mode contains the type and permission bits, like os.ModeDir|0555.
+	// Only directories and regular files are supported.
+	Mode    os.FileMode
+	Size    int64
+	ModTime time.Time
+}
+
+// Dir is a directory Node.
+type Dir interface {
+	Node
+	// Lookup returns the entry called name.
+	Lookup(name string) (Node, bool)
+	// Entries returns the names of all entries, always in the same order.
+	Entries() []string
+}
+
+// File is a regular file Node.
+type File interface {
+	Node
+	// Open returns the contents of the file. Errors wrapping a
+	// syscall.Errno are passed on to the caller, all others are reported as
+	// EIO.
+	Open() (Handle, error)
+}
+
+// Handle provides the contents of an open File.
+type Handle interface {
+	io.ReaderAt
+	io.Closer
+}
+
+// Options configure how a tree is mounted.
+type Options struct {
+	// Name is shown as the source of the mount, for example by mount(8).
+	Name string
+	// AllowOther lets other users access the mount, which requires
+	// user_allow_other in /etc/fuse.conf for unprivileged users.
+	AllowOther bool
+	// ErrorLog, if set, receives errors which can only be reported to the
+	// kernel as an error code.
+	ErrorLog func(err error)
+}
+
+// ErrNotSupported is returned by Mount on platforms without FUSE support.
+var ErrNotSupported = errors.New("FUSE is not supported on this platform")
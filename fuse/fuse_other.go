@@ -0,0 +1,22 @@
+//go:build !linux
+// +build !linux
+
+package fuse
+
+// Server serves a tree mounted with Mount.
+type Server struct{}
+
+// Mount is not supported on this platform and returns ErrNotSupported.
+func Mount(dir string, root Dir, opts Options) (*Server, error) {
+	return nil, ErrNotSupported
+}
+
+// Serve handles requests until the tree is unmounted.
+func (s *Server) Serve() error {
+	return ErrNotSupported
+}
+
+// Unmount unmounts the tree.
+func (s *Server) Unmount() error {
+	return ErrNotSupported
+}
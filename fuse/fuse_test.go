@@ -0,0 +1,109 @@
+//go:build linux
+// +build linux
+
+package fuse
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"testing"
+	"time"
+)
+
+type testDir struct{ entries map[string]Node }
+
+func (d *testDir) Attr() Attr { return Attr{Mode: os.ModeDir | 0555} }
+
+func (d *testDir) Lookup(name string) (Node, bool) {
+	n, ok := d.entries[name]
+	return n, ok
+}
+
+func (d *testDir) Entries() []string {
+	var names []string
+	for name := range d.entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+type testFile []byte
+
+func (f *testFile) Attr() Attr {
+	return Attr{Mode: 0444, Size: int64(len(*f)), ModTime: time.Unix(1600000000, 0)}
+}
+
+func (f *testFile) Open() (Handle, error) {
+	return nopCloser{bytes.NewReader(*f)}, nil
+}
+
+type nopCloser struct{ *bytes.Reader }
+
+func (nopCloser) Close() error { return nil }
+
+func TestMount(t *testing.T) {
+	big := make(testFile, 300<<10)
+	for i := range big {
+		big[i] = byte(i % 251)
+	}
+	small := testFile("hello")
+	root := &testDir{map[string]Node{
+		"a.txt": &small,
+		"sub":   &testDir{map[string]Node{"big.bin": &big}},
+	}}
+	// Opening files registers them with the runtime's poller, which makes
+	// the kernel send a poll request to the server while a P is held.
+	// Serving in the same process thus needs a second one.
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(2))
+	dir := t.TempDir()
+	s, err := Mount(dir, root, Options{Name: "fusetest"})
+	if err != nil {
+		t.Skipf("mounting is not possible here: %v", err)
+	}
+	served := make(chan error)
+	go func() { served <- s.Serve() }()
+	defer func() {
+		if err := s.Unmount(); err != nil {
+			t.Fatalf("failed to unmount: %v", err)
+		}
+		if err := <-served; err != nil {
+			t.Errorf("Serve returned %v", err)
+		}
+	}()
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "a.txt"))
+	if err != nil || string(data) != "hello" {
+		t.Errorf("reading a.txt returned %q, %v", data, err)
+	}
+	data, err = ioutil.ReadFile(filepath.Join(dir, "sub", "big.bin"))
+	if err != nil || !bytes.Equal(data, big) {
+		t.Errorf("reading big.bin returned %v bytes, %v", len(data), err)
+	}
+	fi, err := os.Stat(filepath.Join(dir, "sub", "big.bin"))
+	if err != nil || fi.Size() != int64(len(big)) || fi.ModTime().Unix() != 1600000000 {
+		t.Errorf("unexpected stat result %v, %v", fi, err)
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	if !reflect.DeepEqual(names, []string{"a.txt", "sub"}) || !entries[1].IsDir() {
+		t.Errorf("unexpected entries %v", names)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "missing")); !os.IsNotExist(err) {
+		t.Errorf("expected missing file not to exist, got %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "a.txt"), nil, 0644); err == nil {
+		t.Error("expected writing to fail")
+	}
+}
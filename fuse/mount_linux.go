@@ -0,0 +1,111 @@
+package fuse
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// mount mounts a FUSE file system at dir and returns the file descriptor
+// for talking to the kernel. Root can mount directly, other users need
+// fusermount, which passes the descriptor back over a socket.
+func mount(dir string, opts Options) (fd int, direct bool, err error) {
+	name := opts.Name
+	if name == "" {
+		name = "fuse"
+	}
+	fd, err = syscall.Open("/dev/fuse", syscall.O_RDWR|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, false, fmt.Errorf("failed to open /dev/fuse: %w", err)
+	}
+	data := fmt.Sprintf("fd=%d,rootmode=40000,user_id=%d,group_id=%d", fd, os.Getuid(), os.Getgid())
+	if opts.AllowOther {
+		data += ",allow_other"
+	}
+	err = syscall.Mount(name, dir, "fuse."+name, syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_RDONLY, data)
+	if err == nil {
+		return fd, true, nil
+	}
+	syscall.Close(fd)
+	if !errors.Is(err, syscall.EPERM) {
+		return -1, false, fmt.Errorf("failed to mount: %w", err)
+	}
+	fd, err = fusermount(dir, name, opts)
+	return fd, false, err
+}
+
+// fusermountBinary returns the path of the fusermount helper.
+func fusermountBinary() (string, error) {
+	for _, name := range []string{"fusermount3", "fusermount"} {
+		if path, err := exec.LookPath(name); err == nil {
+			return path, nil
+		}
+	}
+	return "", errors.New("mounting requires root or fusermount, which was not found")
+}
+
+func fusermount(dir, name string, opts Options) (int, error) {
+	bin, err := fusermountBinary()
+	if err != nil {
+		return -1, err
+	}
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return -1, err
+	}
+	local := os.NewFile(uintptr(fds[0]), "fusermount-local")
+	remote := os.NewFile(uintptr(fds[1]), "fusermount-remote")
+	defer local.Close()
+	defer remote.Close()
+
+	options := []string{"ro", "nosuid", "nodev", "fsname=" + name, "subtype=" + name}
+	if opts.AllowOther {
+		options = append(options, "allow_other")
+	}
+	cmd := exec.Command(bin, "-o", strings.Join(options, ","), "--", dir)
+	cmd.ExtraFiles = []*os.File{remote}
+	cmd.Env = append(os.Environ(), "_FUSE_COMMFD="+strconv.Itoa(3))
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return -1, fmt.Errorf("failed to run %v: %w", bin, err)
+	}
+	remote.Close()
+	buf := make([]byte, 1)
+	oob := make([]byte, syscall.CmsgSpace(4))
+	_, oobn, _, _, recvErr := syscall.Recvmsg(int(local.Fd()), buf, oob, 0)
+	if err := cmd.Wait(); err != nil {
+		return -1, fmt.Errorf("%v failed: %w", bin, err)
+	}
+	if recvErr != nil {
+		return -1, fmt.Errorf("failed to receive FUSE descriptor: %w", recvErr)
+	}
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil || len(msgs) != 1 {
+		return -1, fmt.Errorf("%v did not pass a FUSE descriptor", bin)
+	}
+	passed, err := syscall.ParseUnixRights(&msgs[0])
+	if err != nil || len(passed) != 1 {
+		return -1, fmt.Errorf("%v did not pass a FUSE descriptor", bin)
+	}
+	syscall.CloseOnExec(passed[0])
+	return passed[0], nil
+}
+
+// unmount unmounts dir, which was mounted directly or using fusermount.
+func unmount(dir string, direct bool) error {
+	if direct {
+		return syscall.Unmount(dir, 0)
+	}
+	bin, err := fusermountBinary()
+	if err != nil {
+		return err
+	}
+	if out, err := exec.Command(bin, "-u", "--", dir).CombinedOutput(); err != nil {
+		return fmt.Errorf("%v -u failed: %w: %s", bin, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
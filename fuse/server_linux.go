@@ -0,0 +1,496 @@
+package fuse
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Opcodes of the requests handled by Server, see linux/fuse.h
+const (
+	opLookup      = 1
+	opForget      = 2
+	opGetattr     = 3
+	opOpen        = 14
+	opRead        = 15
+	opStatfs      = 17
+	opRelease     = 18
+	opFlush       = 25
+	opInit        = 26
+	opOpendir     = 27
+	opReaddir     = 28
+	opReleasedir  = 29
+	opAccess      = 34
+	opInterrupt   = 36
+	opDestroy     = 38
+	opBatchForget = 42
+)
+
+const (
+	// protocolMinor is the minor version of the FUSE protocol spoken. Only
+	// features available in all versions since 7.12 are used.
+	protocolMinor = 31
+	// maxRead is the maximum size of a read request.
+	maxRead = 128 << 10
+	// inHeaderSize is the size of struct fuse_in_header.
+	inHeaderSize = 40
+	// readBufferSize is the size of the buffer requests are read into,
+	// which only needs to hold headers and names as nothing is written.
+	readBufferSize = 64 << 10
+	// rootID is the node ID of the root directory.
+	rootID = 1
+	// fopenKeepCache tells the kernel that file contents don't change.
+	fopenKeepCache = 1 << 1
+)
+
+// cacheTimeout is how long the kernel may cache entries and attributes.
+// Served trees don't change.
+const cacheTimeout = time.Hour
+
+// ne is the native byte order, which the kernel uses for all messages.
+var ne = nativeEndian()
+
+func nativeEndian() binary.ByteOrder {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 1 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}
+
+// Server serves a tree mounted with Mount.
+type Server struct {
+	dir    string
+	fd     int
+	direct bool
+	root   Dir
+	opts   Options
+
+	mu         sync.Mutex
+	ids        map[Node]uint64
+	nodes      map[uint64]Node
+	handles    map[uint64]Handle
+	nextID     uint64
+	nextHandle uint64
+}
+
+// Mount mounts the tree below root at the directory dir. Serve needs to be
+// called to handle requests.
+func Mount(dir string, root Dir, opts Options) (*Server, error) {
+	fd, direct, err := mount(dir, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &Server{
+		dir:     dir,
+		fd:      fd,
+		direct:  direct,
+		root:    root,
+		opts:    opts,
+		ids:     map[Node]uint64{root: rootID},
+		nodes:   map[uint64]Node{rootID: root},
+		handles: make(map[uint64]Handle),
+		nextID:  rootID + 1,
+	}, nil
+}
+
+// Unmount unmounts the tree, which makes Serve return.
+func (s *Server) Unmount() error {
+	return unmount(s.dir, s.direct)
+}
+
+// Serve handles requests until the tree is unmounted. Requests are handled
+// concurrently, so that opening a slow file doesn't block others.
+func (s *Server) Serve() error {
+	defer syscall.Close(s.fd)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		buf := make([]byte, readBufferSize)
+		n, err := syscall.Read(s.fd, buf)
+		switch {
+		case err == syscall.EINTR || err == syscall.EAGAIN || err == syscall.ENOENT:
+			// Interrupted or the request was aborted before it was read
+			continue
+		case err == syscall.ENODEV:
+			// Unmounted
+			return nil
+		case err != nil:
+			return err
+		}
+		if n < inHeaderSize {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.handle(buf[:n])
+		}()
+	}
+}
+
+// request is a parsed fuse_in_header along with the request body.
+type request struct {
+	opcode uint32
+	unique uint64
+	nodeID uint64
+	data   []byte
+}
+
+func (s *Server) handle(msg []byte) {
+	req := request{
+		opcode: ne.Uint32(msg[4:]),
+		unique: ne.Uint64(msg[8:]),
+		nodeID: ne.Uint64(msg[16:]),
+		data:   msg[inHeaderSize:],
+	}
+	var out []byte
+	var errno syscall.Errno
+	switch req.opcode {
+	case opForget, opBatchForget, opInterrupt:
+		// Node IDs are never reused and requests not interrupted, so
+		// there is nothing to do and no reply expected.
+		return
+	case opInit:
+		out, errno = s.init(req)
+	case opLookup:
+		out, errno = s.lookup(req)
+	case opGetattr:
+		node, ok := s.node(req.nodeID)
+		if !ok {
+			errno = syscall.ENOENT
+			break
+		}
+		var e encoder
+		e.duration(cacheTimeout)
+		e.u32(0)
+		e.u32(0)
+		s.attr(&e, req.nodeID, node)
+		out = e.b
+	case opOpen:
+		out, errno = s.open(req)
+	case opRead:
+		out, errno = s.read(req)
+	case opRelease:
+		if len(req.data) >= 8 {
+			fh := ne.Uint64(req.data)
+			s.mu.Lock()
+			h := s.handles[fh]
+			delete(s.handles, fh)
+			s.mu.Unlock()
+			if h != nil {
+				h.Close()
+			}
+		}
+	case opOpendir:
+		node, _ := s.node(req.nodeID)
+		if _, ok := node.(Dir); !ok {
+			errno = syscall.ENOTDIR
+			break
+		}
+		var e encoder
+		e.u64(0)
+		e.u32(fopenKeepCache)
+		e.u32(0)
+		out = e.b
+	case opReaddir:
+		out, errno = s.readdir(req)
+	case opReleasedir, opFlush, opAccess, opDestroy:
+	case opStatfs:
+		var e encoder
+		e.u64(0) // blocks
+		e.u64(0) // bfree
+		e.u64(0) // bavail
+		s.mu.Lock()
+		e.u64(uint64(len(s.nodes))) // files
+		s.mu.Unlock()
+		e.u64(0)    // ffree
+		e.u32(4096) // bsize
+		e.u32(255)  // namelen
+		e.u32(4096) // frsize
+		e.pad(7 * 4)
+		out = e.b
+	default:
+		errno = syscall.ENOSYS
+	}
+	s.reply(req, out, errno)
+}
+
+// reply sends the response to req, which is either out or an error.
+func (s *Server) reply(req request, out []byte, errno syscall.Errno) {
+	if errno != 0 {
+		out = nil
+	}
+	msg := make([]byte, 16, 16+len(out))
+	ne.PutUint32(msg, uint32(16+len(out)))
+	ne.PutUint32(msg[4:], uint32(-int32(errno)))
+	ne.PutUint64(msg[8:], req.unique)
+	msg = append(msg, out...)
+	if _, err := syscall.Write(s.fd, msg); err != nil && err != syscall.ENOENT {
+		// ENOENT means the request has been interrupted.
+		s.logError(err)
+	}
+}
+
+func (s *Server) logError(err error) {
+	if s.opts.ErrorLog != nil {
+		s.opts.ErrorLog(err)
+	}
+}
+
+func (s *Server) init(req request) ([]byte, syscall.Errno) {
+	if len(req.data) < 16 {
+		return nil, syscall.EINVAL
+	}
+	major, minor := ne.Uint32(req.data), ne.Uint32(req.data[4:])
+	maxReadahead := ne.Uint32(req.data[8:])
+	if major != 7 || minor < 12 {
+		return nil, syscall.EPROTO
+	}
+	if minor > protocolMinor {
+		minor = protocolMinor
+	}
+	var e encoder
+	e.u32(7)
+	e.u32(minor)
+	e.u32(maxReadahead)
+	e.u32(0)     // flags
+	e.u16(0)     // max_background
+	e.u16(0)     // congestion_threshold
+	e.u32(4096)  // max_write, nothing is ever written
+	e.u32(1)     // time_gran
+	e.u16(0)     // max_pages
+	e.u16(0)     // map_alignment
+	e.pad(8 * 4) // unused
+	if minor < 23 {
+		// Older kernels expect the shorter reply
+		e.b = e.b[:24]
+	}
+	return e.b, 0
+}
+
+// node returns the node with the given ID.
+func (s *Server) node(id uint64) (Node, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n, ok := s.nodes[id]
+	return n, ok
+}
+
+// id returns the ID of node, assigning one if needed.
+func (s *Server) id(node Node) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if id, ok := s.ids[node]; ok {
+		return id
+	}
+	id := s.nextID
+	s.nextID++
+	s.ids[node] = id
+	s.nodes[id] = node
+	return id
+}
+
+func (s *Server) lookup(req request) ([]byte, syscall.Errno) {
+	parent, _ := s.node(req.nodeID)
+	dir, ok := parent.(Dir)
+	if !ok {
+		return nil, syscall.ENOTDIR
+	}
+	name := req.data
+	for i, c := range name {
+		if c == 0 {
+			name = name[:i]
+			break
+		}
+	}
+	var e encoder
+	node, ok := dir.Lookup(string(name))
+	if !ok {
+		// A node ID of zero caches the negative result, which speeds up
+		// include path searches considerably.
+		e.u64(0)
+		e.u64(0)
+		e.duration(cacheTimeout)
+		e.duration(0)
+		e.u32(0)
+		e.u32(0)
+		e.pad(attrSize)
+		return e.b, 0
+	}
+	id := s.id(node)
+	e.u64(id)
+	e.u64(0) // generation
+	e.duration(cacheTimeout)
+	e.duration(cacheTimeout)
+	e.u32(0)
+	e.u32(0)
+	s.attr(&e, id, node)
+	return e.b, 0
+}
+
+// attrSize is the size of struct fuse_attr.
+const attrSize = 88
+
+// attr appends the fuse_attr of node to e.
+func (s *Server) attr(e *encoder, id uint64, node Node) {
+	a := node.Attr()
+	mode := uint32(a.Mode.Perm())
+	nlink := uint32(1)
+	if a.Mode.IsDir() {
+		mode |= syscall.S_IFDIR
+		nlink = 2
+	} else {
+		mode |= syscall.S_IFREG
+	}
+	mtime := a.ModTime
+	if mtime.IsZero() {
+		mtime = time.Unix(0, 0)
+	}
+	e.u64(id)
+	e.u64(uint64(a.Size))
+	e.u64(uint64((a.Size + 511) / 512))
+	for i := 0; i < 3; i++ {
+		e.u64(uint64(mtime.Unix()))
+	}
+	for i := 0; i < 3; i++ {
+		e.u32(uint32(mtime.Nanosecond()))
+	}
+	e.u32(mode)
+	e.u32(nlink)
+	e.u32(uint32(os.Getuid()))
+	e.u32(uint32(os.Getgid()))
+	e.u32(0)    // rdev
+	e.u32(4096) // blksize
+	e.u32(0)    // flags
+}
+
+func (s *Server) open(req request) ([]byte, syscall.Errno) {
+	node, _ := s.node(req.nodeID)
+	file, ok := node.(File)
+	if !ok {
+		return nil, syscall.EISDIR
+	}
+	if len(req.data) < 4 {
+		return nil, syscall.EINVAL
+	}
+	if ne.Uint32(req.data)&syscall.O_ACCMODE != syscall.O_RDONLY {
+		return nil, syscall.EROFS
+	}
+	h, err := file.Open()
+	if err != nil {
+		var errno syscall.Errno
+		if errors.As(err, &errno) {
+			return nil, errno
+		}
+		s.logError(err)
+		return nil, syscall.EIO
+	}
+	s.mu.Lock()
+	s.nextHandle++
+	fh := s.nextHandle
+	s.handles[fh] = h
+	s.mu.Unlock()
+	var e encoder
+	e.u64(fh)
+	e.u32(fopenKeepCache)
+	e.u32(0)
+	return e.b, 0
+}
+
+func (s *Server) read(req request) ([]byte, syscall.Errno) {
+	if len(req.data) < 24 {
+		return nil, syscall.EINVAL
+	}
+	fh, off, size := ne.Uint64(req.data), int64(ne.Uint64(req.data[8:])), ne.Uint32(req.data[16:])
+	if size > maxRead {
+		size = maxRead
+	}
+	s.mu.Lock()
+	h := s.handles[fh]
+	s.mu.Unlock()
+	if h == nil {
+		return nil, syscall.EBADF
+	}
+	buf := make([]byte, size)
+	n, err := h.ReadAt(buf, off)
+	if err != nil && err != io.EOF {
+		s.logError(err)
+		return nil, syscall.EIO
+	}
+	return buf[:n], 0
+}
+
+func (s *Server) readdir(req request) ([]byte, syscall.Errno) {
+	node, _ := s.node(req.nodeID)
+	dir, ok := node.(Dir)
+	if !ok {
+		return nil, syscall.ENOTDIR
+	}
+	if len(req.data) < 24 {
+		return nil, syscall.EINVAL
+	}
+	off, size := ne.Uint64(req.data[8:]), int(ne.Uint32(req.data[16:]))
+	var e encoder
+	entries := dir.Entries()
+	for i := off; i < uint64(len(entries)); i++ {
+		name := entries[i]
+		child, ok := dir.Lookup(name)
+		if !ok {
+			continue
+		}
+		// struct fuse_dirent, padded to 8 bytes
+		entrySize := (24 + len(name) + 7) &^ 7
+		if len(e.b)+entrySize > size {
+			break
+		}
+		typ := uint32(syscall.DT_REG)
+		if child.Attr().Mode.IsDir() {
+			typ = syscall.DT_DIR
+		}
+		e.u64(s.id(child))
+		e.u64(i + 1)
+		e.u32(uint32(len(name)))
+		e.u32(typ)
+		e.b = append(e.b, name...)
+		e.pad(entrySize - 24 - len(name))
+	}
+	return e.b, 0
+}
+
+// encoder builds messages in native byte order.
+type encoder struct {
+	b []byte
+}
+
+func (e *encoder) u16(v uint16) {
+	var b [2]byte
+	ne.PutUint16(b[:], v)
+	e.b = append(e.b, b[:]...)
+}
+
+func (e *encoder) u32(v uint32) {
+	var b [4]byte
+	ne.PutUint32(b[:], v)
+	e.b = append(e.b, b[:]...)
+}
+
+func (e *encoder) u64(v uint64) {
+	var b [8]byte
+	ne.PutUint64(b[:], v)
+	e.b = append(e.b, b[:]...)
+}
+
+// duration appends the seconds of d. Nanoseconds are appended separately.
+func (e *encoder) duration(d time.Duration) {
+	e.u64(uint64(d / time.Second))
+}
+
+func (e *encoder) pad(n int) {
+	e.b = append(e.b, make([]byte, n)...)
+}
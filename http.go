@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	httpUserAgent       string
+	httpHeaders         headerFlag
+	httpRequestTimeout  time.Duration
+	httpMaxConnsPerHost int
+	httpDownloadMirror  string
+)
+
+// headerFlag collects repeated --header "Name: value" flags.
+type headerFlag []string
+
+func (h *headerFlag) String() string {
+	return strings.Join(*h, ", ")
+}
+
+func (h *headerFlag) Set(v string) error {
+	if !strings.Contains(v, ":") {
+		return fmt.Errorf("header %q is not in the form \"Name: value\"", v)
+	}
+	*h = append(*h, v)
+	return nil
+}
+
+// registerHTTPFlags registers the flags controlling outgoing HTTP requests on
+// fs. It is used for both the main command and subcommands which download.
+func registerHTTPFlags(fs *flag.FlagSet) {
+	fs.StringVar(&httpUserAgent, "user-agent", "", "User-Agent header to send with all HTTP requests (default is Go's)")
+	fs.Var(&httpHeaders, "header", "Extra HTTP header in the form \"Name: value\" to send with all requests, can be repeated")
+	fs.DurationVar(&httpRequestTimeout, "request-timeout", 30*time.Minute, "Abort any single HTTP request (including downloading the response) taking longer than this, 0 disables the timeout")
+	fs.IntVar(&httpMaxConnsPerHost, "max-conns-per-host", 0, "Maximum number of connections to a single host, 0 means no limit")
+	fs.StringVar(&httpDownloadMirror, "download-mirror", "", "Base URL of a mirror (see \"winsysroot mirror\") to download manifests and payloads from instead of Microsoft's servers")
+}
+
+func init() {
+	registerHTTPFlags(flag.CommandLine)
+}
+
+// httpHeader returns the headers to send with every request as configured by
+// the flags.
+func httpHeader() http.Header {
+	header := make(http.Header)
+	if httpUserAgent != "" {
+		header.Set("User-Agent", httpUserAgent)
+	}
+	for _, h := range httpHeaders {
+		parts := strings.SplitN(h, ":", 2)
+		header.Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	}
+	return header
+}
+
+// Timeouts of the shared HTTP transport. The time for transferring a whole
+// response is limited separately by --request-timeout.
+const (
+	httpDialTimeout           = 30 * time.Second
+	httpTLSHandshakeTimeout   = 30 * time.Second
+	httpResponseHeaderTimeout = 2 * time.Minute
+	httpIdleConnTimeout       = 90 * time.Second
+)
+
+// httpMaxIdleConnsPerHost keeps enough idle connections around to reuse them
+// for concurrent downloads instead of reconnecting after every payload.
+const httpMaxIdleConnsPerHost = 16
+
+// wrapTransport, if set, wraps the transports of all HTTP clients. It needs
+// to be set before the first request, subcommands use it to record or replay
+// all requests.
+var wrapTransport func(http.RoundTripper) http.RoundTripper
+
+var (
+	sharedClientOnce sync.Once
+	sharedClient     *http.Client
+	sharedClientErr  error
+)
+
+// httpClient returns the HTTP client for all downloads, configured for the
+// certificate checks selected by the flags. All callers share one client so
+// that connections are reused between manifest and payload downloads.
+func httpClient() (*http.Client, error) {
+	sharedClientOnce.Do(func() {
+		tlsConf, err := tlsConfig()
+		if err != nil {
+			sharedClientErr = err
+			return
+		}
+		var crlTransport, transport http.RoundTripper = newTransport(nil), newTransport(tlsConf)
+		if httpDownloadMirror != "" {
+			base, err := url.Parse(strings.TrimSuffix(httpDownloadMirror, "/"))
+			if err != nil || (base.Scheme != "http" && base.Scheme != "https") || base.Host == "" {
+				sharedClientErr = fmt.Errorf("--download-mirror needs an http or https URL, got %q", httpDownloadMirror)
+				return
+			}
+			transport = &mirrorTransport{rt: transport, base: base}
+		}
+		if wrapTransport != nil {
+			crlTransport, transport = wrapTransport(crlTransport), wrapTransport(transport)
+		}
+		crlChecker.Client = &http.Client{Transport: crlTransport}
+		sharedClient = &http.Client{Transport: transport}
+	})
+	return sharedClient, sharedClientErr
+}
+
+// newTransport returns a transport tuned for downloading many large files
+// from few hosts. It uses the proxy from the environment and HTTP/2 where
+// available, also with a custom tlsConf.
+func newTransport(tlsConf *tls.Config) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{
+		Timeout:   httpDialTimeout,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	transport.ForceAttemptHTTP2 = true
+	transport.TLSHandshakeTimeout = httpTLSHandshakeTimeout
+	transport.ResponseHeaderTimeout = httpResponseHeaderTimeout
+	transport.IdleConnTimeout = httpIdleConnTimeout
+	transport.MaxIdleConnsPerHost = httpMaxIdleConnsPerHost
+	transport.MaxConnsPerHost = httpMaxConnsPerHost
+	if tlsConf != nil {
+		transport.TLSClientConfig = tlsConf
+	}
+	return transport
+}
+
+// mirroredHost reports whether downloads from host are redirected to the
+// --download-mirror. These are all hosts manifests and payloads are served
+// from, but not the ones used for uploads.
+func mirroredHost(host string) bool {
+	host = strings.ToLower(host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return host == "aka.ms" || strings.HasSuffix(host, ".microsoft.com")
+}
+
+// mirrorPath returns the path of u below the root of a mirror, which is its
+// host followed by its path.
+func mirrorPath(u *url.URL) string {
+	return strings.ToLower(u.Hostname()) + path.Clean("/"+u.Path)
+}
+
+// mirrorTransport sends GET and HEAD requests for manifests and payloads to
+// a mirror instead, at the URL of the mirror followed by their mirrorPath.
+type mirrorTransport struct {
+	rt   http.RoundTripper
+	base *url.URL
+}
+
+func (t *mirrorTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if (req.Method != http.MethodGet && req.Method != http.MethodHead) || !mirroredHost(req.URL.Host) {
+		return t.rt.RoundTrip(req)
+	}
+	u := *t.base
+	u.Path = t.base.Path + "/" + mirrorPath(req.URL)
+	u.RawPath = ""
+	u.RawQuery = req.URL.RawQuery
+	req = req.Clone(req.Context())
+	req.URL = &u
+	req.Host = ""
+	return t.rt.RoundTrip(req)
+}
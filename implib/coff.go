@@ -0,0 +1,181 @@
+package implib
+
+import (
+	"bytes"
+	"debug/pe"
+	"encoding/binary"
+)
+
+// Section characteristics and symbol storage classes used by the import
+// objects.
+const (
+	scnCntInitializedData = 0x00000040
+	scnAlign2Bytes        = 0x00200000
+	scnAlign4Bytes        = 0x00300000
+	scnAlign8Bytes        = 0x00400000
+	scnMemRead            = 0x40000000
+	scnMemWrite           = 0x80000000
+
+	symClassExternal = 2
+	symClassStatic   = 3
+	symClassSection  = 104
+
+	file32BitMachine = 0x0100
+)
+
+// object is a COFF object file under construction.
+type object struct {
+	machine  uint16
+	sections []section
+	symbols  []symbol
+}
+
+type section struct {
+	name            string
+	data            []byte
+	relocs          []pe.Reloc
+	characteristics uint32
+}
+
+type symbol struct {
+	name string
+	// section is the 1-based index of the section defining the symbol, 0 if
+	// it is undefined.
+	section int16
+	class   uint8
+}
+
+// bytes returns the encoded object: the file header, section headers, the
+// data and relocations of every section, the symbol table and string table.
+func (o *object) bytes() []byte {
+	offset := 20 + 40*len(o.sections)
+	headers := make([]pe.SectionHeader32, len(o.sections))
+	for i, s := range o.sections {
+		copy(headers[i].Name[:], s.name)
+		headers[i].SizeOfRawData = uint32(len(s.data))
+		headers[i].PointerToRawData = uint32(offset)
+		offset += len(s.data)
+		if len(s.relocs) > 0 {
+			headers[i].PointerToRelocations = uint32(offset)
+			headers[i].NumberOfRelocations = uint16(len(s.relocs))
+			offset += 10 * len(s.relocs)
+		}
+		headers[i].Characteristics = s.characteristics
+	}
+	fh := pe.FileHeader{
+		Machine:              o.machine,
+		NumberOfSections:     uint16(len(o.sections)),
+		PointerToSymbolTable: uint32(offset),
+		NumberOfSymbols:      uint32(len(o.symbols)),
+	}
+	if !is64Bit(o.machine) {
+		fh.Characteristics = file32BitMachine
+	}
+
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, &fh)
+	binary.Write(&b, binary.LittleEndian, headers)
+	for _, s := range o.sections {
+		b.Write(s.data)
+		binary.Write(&b, binary.LittleEndian, s.relocs)
+	}
+	// Names longer than 8 bytes are stored in the string table following
+	// the symbols, referenced by their offset in it.
+	strtab := []byte{0, 0, 0, 0}
+	for _, s := range o.symbols {
+		sym := pe.COFFSymbol{SectionNumber: s.section, StorageClass: s.class}
+		if len(s.name) <= len(sym.Name) {
+			copy(sym.Name[:], s.name)
+		} else {
+			binary.LittleEndian.PutUint32(sym.Name[4:], uint32(len(strtab)))
+			strtab = append(strtab, s.name...)
+			strtab = append(strtab, 0)
+		}
+		binary.Write(&b, binary.LittleEndian, &sym)
+	}
+	binary.LittleEndian.PutUint32(strtab, uint32(len(strtab)))
+	b.Write(strtab)
+	return b.Bytes()
+}
+
+// rvaRelocation returns the relocation type of machine storing the RVA of a
+// symbol.
+func rvaRelocation(machine uint16) uint16 {
+	switch machine {
+	case pe.IMAGE_FILE_MACHINE_AMD64:
+		return 3 // IMAGE_REL_AMD64_ADDR32NB
+	case pe.IMAGE_FILE_MACHINE_I386:
+		return 7 // IMAGE_REL_I386_DIR32NB
+	default:
+		return 2 // IMAGE_REL_ARM_ADDR32NB, IMAGE_REL_ARM64_ADDR32NB
+	}
+}
+
+// importDescriptor returns the object defining the import directory entry of
+// dll. Its relocations pull in the DLL name, the null thunk terminating the
+// lookup and address tables and the null descriptor terminating the import
+// directory.
+func importDescriptor(machine uint16, dll, lib string) []byte {
+	rva := rvaRelocation(machine)
+	o := object{
+		machine: machine,
+		sections: []section{{
+			name: ".idata$2",
+			data: make([]byte, 20),
+			relocs: []pe.Reloc{
+				{VirtualAddress: 12, SymbolTableIndex: 2, Type: rva}, // Name
+				{VirtualAddress: 0, SymbolTableIndex: 3, Type: rva},  // ImportLookupTable
+				{VirtualAddress: 16, SymbolTableIndex: 4, Type: rva}, // ImportAddressTable
+			},
+			characteristics: scnAlign4Bytes | scnCntInitializedData | scnMemRead | scnMemWrite,
+		}, {
+			name:            ".idata$6",
+			data:            append([]byte(dll), 0),
+			characteristics: scnAlign2Bytes | scnCntInitializedData | scnMemRead | scnMemWrite,
+		}},
+		symbols: []symbol{
+			{"__IMPORT_DESCRIPTOR_" + lib, 1, symClassExternal},
+			{".idata$2", 1, symClassSection},
+			{".idata$6", 2, symClassStatic},
+			{".idata$4", 0, symClassSection},
+			{".idata$5", 0, symClassSection},
+			{"__NULL_IMPORT_DESCRIPTOR", 0, symClassExternal},
+			{"\x7f" + lib + "_NULL_THUNK_DATA", 0, symClassExternal},
+		},
+	}
+	return o.bytes()
+}
+
+// nullImportDescriptor returns the object defining the all-zero entry
+// terminating the import directory.
+func nullImportDescriptor(machine uint16) []byte {
+	o := object{
+		machine: machine,
+		sections: []section{{
+			name:            ".idata$3",
+			data:            make([]byte, 20),
+			characteristics: scnAlign4Bytes | scnCntInitializedData | scnMemRead | scnMemWrite,
+		}},
+		symbols: []symbol{{"__NULL_IMPORT_DESCRIPTOR", 1, symClassExternal}},
+	}
+	return o.bytes()
+}
+
+// nullThunk returns the object defining the null entries terminating the
+// import lookup and address tables of lib.
+func nullThunk(machine uint16, lib string) []byte {
+	size, align := 4, uint32(scnAlign4Bytes)
+	if is64Bit(machine) {
+		size, align = 8, scnAlign8Bytes
+	}
+	characteristics := align | scnCntInitializedData | scnMemRead | scnMemWrite
+	o := object{
+		machine: machine,
+		sections: []section{
+			{name: ".idata$5", data: make([]byte, size), characteristics: characteristics},
+			{name: ".idata$4", data: make([]byte, size), characteristics: characteristics},
+		},
+		symbols: []symbol{{"\x7f" + lib + "_NULL_THUNK_DATA", 1, symClassExternal}},
+	}
+	return o.bytes()
+}
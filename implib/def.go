@@ -0,0 +1,101 @@
+package implib
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// ParseDef parses a module-definition (.def) file as used by lib.exe and
+// llvm-dlltool. It returns the DLL name from the LIBRARY statement and the
+// exports. Statements other than LIBRARY, NAME and EXPORTS are ignored.
+func ParseDef(r io.Reader) (string, []Export, error) {
+	var dll string
+	var exports []Export
+	inExports := false
+	s := bufio.NewScanner(r)
+	for line := 1; s.Scan(); line++ {
+		text := s.Text()
+		if i := strings.IndexByte(text, ';'); i >= 0 {
+			text = text[:i]
+		}
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		switch strings.ToUpper(fields[0]) {
+		case "LIBRARY", "NAME":
+			inExports = false
+			if len(fields) > 1 {
+				dll = strings.Trim(fields[1], `"`)
+				if strings.EqualFold(fields[0], "LIBRARY") && !strings.Contains(dll, ".") {
+					dll += ".dll"
+				}
+			}
+			continue
+		case "EXPORTS":
+			inExports = true
+			fields = fields[1:]
+			if len(fields) == 0 {
+				continue
+			}
+		case "DESCRIPTION", "HEAPSIZE", "STACKSIZE", "SECTIONS", "VERSION", "STUB":
+			inExports = false
+			continue
+		}
+		if !inExports {
+			continue
+		}
+		e, err := parseExport(fields)
+		if err != nil {
+			return "", nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		exports = append(exports, e)
+	}
+	if err := s.Err(); err != nil {
+		return "", nil, err
+	}
+	return dll, exports, nil
+}
+
+// parseExport parses the fields of an export definition like
+// "name[=internal] [@ordinal [NONAME]] [DATA] [PRIVATE]".
+func parseExport(fields []string) (Export, error) {
+	var e Export
+	name := strings.Trim(fields[0], `"`)
+	// The internal name only matters when building the DLL.
+	if i := strings.IndexByte(name, '='); i > 0 {
+		name = name[:i]
+	}
+	e.Name = name
+	for i := 1; i < len(fields); i++ {
+		f := fields[i]
+		switch {
+		case strings.HasPrefix(f, "@"):
+			num := f[1:]
+			if num == "" && i+1 < len(fields) {
+				i++
+				num = fields[i]
+			}
+			ordinal, err := strconv.ParseUint(num, 10, 16)
+			if err != nil {
+				return e, fmt.Errorf("invalid ordinal of %v: %q", name, num)
+			}
+			e.Ordinal = uint16(ordinal)
+		case strings.EqualFold(f, "NONAME"):
+			e.NoName = true
+		case strings.EqualFold(f, "DATA"), strings.EqualFold(f, "CONSTANT"):
+			e.Data = true
+		case strings.EqualFold(f, "PRIVATE"):
+			e.Private = true
+		default:
+			return e, fmt.Errorf("unknown attribute %q of %v", f, name)
+		}
+	}
+	if e.NoName && e.Ordinal == 0 {
+		return e, fmt.Errorf("%v is NONAME without an ordinal", name)
+	}
+	return e, nil
+}
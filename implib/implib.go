@@ -0,0 +1,221 @@
+// Package implib writes and reads COFF import libraries, which tell the
+// linker which DLL exports a function. Libraries are written in the short
+// import format also produced by lib.exe and llvm-dlltool, so both link.exe
+// and lld-link accept them.
+package implib
+
+import (
+	"bytes"
+	"debug/pe"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Export is a symbol exported by a DLL.
+type Export struct {
+	// Name is the exported name as written in a module-definition file. On
+	// x86 the leading underscore of C symbols is added when writing.
+	Name string
+	// Ordinal is the ordinal of the export, used as the hint for named
+	// exports.
+	Ordinal uint16
+	// NoName exports are imported by Ordinal only.
+	NoName bool
+	// Data exports are variables, only their __imp_ pointer is defined.
+	Data bool
+	// Private exports are left out of the import library.
+	Private bool
+}
+
+// Import type and name type of short import objects.
+const (
+	importCode = 0
+	importData = 1
+
+	importOrdinal        = 0
+	importName           = 1
+	importNameNoPrefix   = 2
+	importNameUndecorate = 3
+)
+
+// importHeaderSize is the size of the header of a short import object.
+const importHeaderSize = 20
+
+// is64Bit reports whether machine uses 64 bit pointers.
+func is64Bit(machine uint16) bool {
+	return machine == pe.IMAGE_FILE_MACHINE_AMD64 || machine == pe.IMAGE_FILE_MACHINE_ARM64
+}
+
+// symbolName returns the symbol name and name type of e for machine.
+func (e *Export) symbolName(machine uint16) (string, uint16) {
+	if machine != pe.IMAGE_FILE_MACHINE_I386 || strings.HasPrefix(e.Name, "?") {
+		return e.Name, importName
+	}
+	// stdcall (_name@n) and fastcall (@name@n) names are imported without
+	// their decoration, cdecl names without the underscore.
+	if strings.HasPrefix(e.Name, "@") {
+		return e.Name, importNameUndecorate
+	}
+	if strings.Contains(e.Name, "@") {
+		return "_" + e.Name, importNameUndecorate
+	}
+	return "_" + e.Name, importNameNoPrefix
+}
+
+// shortImport returns the short import object importing e from dll.
+func shortImport(machine uint16, dll string, e *Export) []byte {
+	sym, nameType := e.symbolName(machine)
+	if e.NoName {
+		nameType = importOrdinal
+	}
+	typ := uint16(importCode)
+	if e.Data {
+		typ = importData
+	}
+	b := make([]byte, importHeaderSize, importHeaderSize+len(sym)+len(dll)+2)
+	binary.LittleEndian.PutUint16(b[0:], pe.IMAGE_FILE_MACHINE_UNKNOWN)
+	binary.LittleEndian.PutUint16(b[2:], 0xffff)
+	binary.LittleEndian.PutUint16(b[6:], machine)
+	binary.LittleEndian.PutUint32(b[12:], uint32(len(sym)+len(dll)+2))
+	binary.LittleEndian.PutUint16(b[16:], e.Ordinal)
+	binary.LittleEndian.PutUint16(b[18:], typ|nameType<<2)
+	b = append(b, sym...)
+	b = append(b, 0)
+	b = append(b, dll...)
+	return append(b, 0)
+}
+
+// Write writes an import library for the exports of dll built for machine
+// (one of the IMAGE_FILE_MACHINE_* constants of debug/pe) to w.
+func Write(w io.Writer, machine uint16, dll string, exports []Export) error {
+	switch machine {
+	case pe.IMAGE_FILE_MACHINE_I386, pe.IMAGE_FILE_MACHINE_AMD64, pe.IMAGE_FILE_MACHINE_ARMNT, pe.IMAGE_FILE_MACHINE_ARM64:
+	default:
+		return fmt.Errorf("unsupported machine %#x", machine)
+	}
+	if dll == "" || strings.ContainsAny(dll, "\x00/\\") {
+		return fmt.Errorf("invalid DLL name %q", dll)
+	}
+	lib := strings.TrimSuffix(dll, path.Ext(dll))
+	members := []member{
+		{importDescriptor(machine, dll, lib), []string{"__IMPORT_DESCRIPTOR_" + lib}},
+		{nullImportDescriptor(machine), []string{"__NULL_IMPORT_DESCRIPTOR"}},
+		{nullThunk(machine, lib), []string{"\x7f" + lib + "_NULL_THUNK_DATA"}},
+	}
+	for i := range exports {
+		e := &exports[i]
+		if e.Private {
+			continue
+		}
+		if e.Name == "" && !e.NoName {
+			return fmt.Errorf("export %d has no name", i)
+		}
+		sym, _ := e.symbolName(machine)
+		symbols := []string{"__imp_" + sym}
+		if !e.Data {
+			symbols = append(symbols, sym)
+		}
+		members = append(members, member{shortImport(machine, dll, e), symbols})
+	}
+	_, err := w.Write(writeArchive(dll, members))
+	return err
+}
+
+// member is an archive member and the symbols it defines.
+type member struct {
+	data    []byte
+	symbols []string
+}
+
+const (
+	archiveMagic      = "!<arch>\n"
+	archiveHeaderSize = 60
+)
+
+func archiveHeader(name string, size int, mode string) string {
+	return fmt.Sprintf("%-16s%-12s%-6s%-6s%-8s%-10d`\n", name, "0", "0", "0", mode, size)
+}
+
+// writeArchive returns a COFF archive of members which are all named name.
+// It contains both the first (big-endian, in member order) and the second
+// (little-endian, sorted) linker member.
+func writeArchive(name string, members []member) []byte {
+	type symbol struct {
+		name   string
+		member int
+	}
+	var symbols []symbol
+	var namesSize int
+	for i, m := range members {
+		for _, s := range m.symbols {
+			symbols = append(symbols, symbol{s, i})
+			namesSize += len(s) + 1
+		}
+	}
+	firstSize := 4 + 4*len(symbols) + namesSize
+	secondSize := 4 + 4*len(members) + 4 + 2*len(symbols) + namesSize
+	memberName := name + "/"
+	var longNames []byte
+	if len(memberName) > 16 {
+		memberName = "/0"
+		longNames = append([]byte(name), 0)
+	}
+	padded := func(size int) int { return size + size&1 }
+	offset := len(archiveMagic) + archiveHeaderSize + padded(firstSize) + archiveHeaderSize + padded(secondSize)
+	if longNames != nil {
+		offset += archiveHeaderSize + padded(len(longNames))
+	}
+	offsets := make([]uint32, len(members))
+	for i, m := range members {
+		offsets[i] = uint32(offset)
+		offset += archiveHeaderSize + padded(len(m.data))
+	}
+
+	var b bytes.Buffer
+	b.WriteString(archiveMagic)
+	pad := func() {
+		if b.Len()&1 != 0 {
+			b.WriteByte('\n')
+		}
+	}
+	b.WriteString(archiveHeader("/", firstSize, "0"))
+	binary.Write(&b, binary.BigEndian, uint32(len(symbols)))
+	for _, s := range symbols {
+		binary.Write(&b, binary.BigEndian, offsets[s.member])
+	}
+	for _, s := range symbols {
+		b.WriteString(s.name)
+		b.WriteByte(0)
+	}
+	pad()
+
+	sort.SliceStable(symbols, func(i, j int) bool { return symbols[i].name < symbols[j].name })
+	b.WriteString(archiveHeader("/", secondSize, "0"))
+	binary.Write(&b, binary.LittleEndian, uint32(len(members)))
+	binary.Write(&b, binary.LittleEndian, offsets)
+	binary.Write(&b, binary.LittleEndian, uint32(len(symbols)))
+	for _, s := range symbols {
+		binary.Write(&b, binary.LittleEndian, uint16(s.member+1))
+	}
+	for _, s := range symbols {
+		b.WriteString(s.name)
+		b.WriteByte(0)
+	}
+	pad()
+
+	if longNames != nil {
+		b.WriteString(archiveHeader("//", len(longNames), "0"))
+		b.Write(longNames)
+		pad()
+	}
+	for _, m := range members {
+		b.WriteString(archiveHeader(memberName, len(m.data), "644"))
+		b.Write(m.data)
+		pad()
+	}
+	return b.Bytes()
+}
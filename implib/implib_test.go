@@ -0,0 +1,103 @@
+package implib
+
+import (
+	"bytes"
+	"debug/pe"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testDef = `; test exports
+LIBRARY api-ms-win-core-synch-l1-2-0
+EXPORTS
+	Sleep @1
+	WaitOnAddress=internal_wait
+	_hidden @ 3 NONAME
+	g_value DATA
+	DllGetClassObject PRIVATE
+	Stdcall@8
+`
+
+func TestParseDef(t *testing.T) {
+	dll, exports, err := ParseDef(strings.NewReader(testDef))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dll != "api-ms-win-core-synch-l1-2-0.dll" {
+		t.Errorf("got DLL %q", dll)
+	}
+	want := []Export{
+		{Name: "Sleep", Ordinal: 1},
+		{Name: "WaitOnAddress"},
+		{Name: "_hidden", Ordinal: 3, NoName: true},
+		{Name: "g_value", Data: true},
+		{Name: "DllGetClassObject", Private: true},
+		{Name: "Stdcall@8"},
+	}
+	if !reflect.DeepEqual(exports, want) {
+		t.Errorf("got exports %+v, want %+v", exports, want)
+	}
+	if _, _, err := ParseDef(strings.NewReader("EXPORTS\n\tfoo NONAME\n")); err == nil {
+		t.Error("NONAME export without ordinal was accepted")
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	_, exports, err := ParseDef(strings.NewReader(testDef))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dll := "api-ms-win-core-synch-l1-2-0.dll"
+	for _, machine := range []uint16{pe.IMAGE_FILE_MACHINE_I386, pe.IMAGE_FILE_MACHINE_AMD64, pe.IMAGE_FILE_MACHINE_ARM64} {
+		var b bytes.Buffer
+		if err := Write(&b, machine, dll, exports); err != nil {
+			t.Fatal(err)
+		}
+		imports, err := ReadImports(b.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []Export
+		for _, imp := range imports {
+			if imp.DLL != dll || imp.Machine != machine {
+				t.Errorf("import %v has DLL %q and machine %#x", imp.Name, imp.DLL, imp.Machine)
+			}
+			got = append(got, imp.Export)
+		}
+		want := []Export{exports[0], exports[1], exports[2], exports[3], exports[5]}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("machine %#x: got %+v, want %+v", machine, got, want)
+		}
+	}
+}
+
+func TestSymbolName(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		machine  uint16
+		sym      string
+		nameType uint16
+	}{
+		{"Sleep", pe.IMAGE_FILE_MACHINE_AMD64, "Sleep", importName},
+		{"Sleep", pe.IMAGE_FILE_MACHINE_I386, "_Sleep", importNameNoPrefix},
+		{"Sleep@4", pe.IMAGE_FILE_MACHINE_I386, "_Sleep@4", importNameUndecorate},
+		{"@Fast@8", pe.IMAGE_FILE_MACHINE_I386, "@Fast@8", importNameUndecorate},
+		{"?f@@YAXXZ", pe.IMAGE_FILE_MACHINE_I386, "?f@@YAXXZ", importName},
+	} {
+		e := Export{Name: tt.name}
+		if sym, nameType := e.symbolName(tt.machine); sym != tt.sym || nameType != tt.nameType {
+			t.Errorf("%v on %#x: got %v (%d), want %v (%d)", tt.name, tt.machine, sym, nameType, tt.sym, tt.nameType)
+		}
+	}
+}
+
+func TestLongMemberName(t *testing.T) {
+	var b bytes.Buffer
+	if err := Write(&b, pe.IMAGE_FILE_MACHINE_AMD64, "api-ms-win-core-synch-l1-2-0.dll", []Export{{Name: "Sleep"}}); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(b.Bytes(), []byte("//              ")) || !bytes.Contains(b.Bytes(), []byte("/0              ")) {
+		t.Error("long DLL name not stored in the long names member")
+	}
+}
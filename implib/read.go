@@ -0,0 +1,71 @@
+package implib
+
+import (
+	"bytes"
+	"debug/pe"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Import is an export of a DLL imported by an import library.
+type Import struct {
+	DLL     string
+	Machine uint16
+	Export
+}
+
+// ReadImports returns the imports of all short import objects in the import
+// library lib. Other members, like the import descriptors or regular
+// objects of static libraries, are skipped. This allows extracting the
+// exports of the API sets from umbrella libraries like onecore.lib.
+func ReadImports(lib []byte) ([]Import, error) {
+	if !bytes.HasPrefix(lib, []byte(archiveMagic)) {
+		return nil, fmt.Errorf("not an archive")
+	}
+	var imports []Import
+	for off := len(archiveMagic); off < len(lib); {
+		if len(lib)-off < archiveHeaderSize {
+			return nil, fmt.Errorf("truncated member header at %d", off)
+		}
+		hdr := lib[off : off+archiveHeaderSize]
+		size, err := strconv.Atoi(strings.TrimSpace(string(hdr[48:58])))
+		if err != nil || size < 0 || size > len(lib)-off-archiveHeaderSize {
+			return nil, fmt.Errorf("invalid member size at %d", off)
+		}
+		data := lib[off+archiveHeaderSize : off+archiveHeaderSize+size]
+		off += archiveHeaderSize + size + size&1
+		name := strings.TrimSpace(string(hdr[:16]))
+		if name == "/" || name == "//" || strings.HasPrefix(name, "/<") {
+			continue
+		}
+		if imp, ok := parseShortImport(data); ok {
+			imports = append(imports, imp)
+		}
+	}
+	return imports, nil
+}
+
+// parseShortImport parses data as short import object.
+func parseShortImport(data []byte) (Import, bool) {
+	var imp Import
+	if len(data) < importHeaderSize || binary.LittleEndian.Uint16(data[0:]) != pe.IMAGE_FILE_MACHINE_UNKNOWN || binary.LittleEndian.Uint16(data[2:]) != 0xffff {
+		return imp, false
+	}
+	names := bytes.SplitN(data[importHeaderSize:], []byte{0}, 3)
+	if len(names) < 3 {
+		return imp, false
+	}
+	imp.Machine = binary.LittleEndian.Uint16(data[6:])
+	imp.Ordinal = binary.LittleEndian.Uint16(data[16:])
+	info := binary.LittleEndian.Uint16(data[18:])
+	imp.Data = info&3 != importCode
+	imp.NoName = (info>>2)&7 == importOrdinal
+	imp.DLL = string(names[1])
+	imp.Name = string(names[0])
+	if imp.Machine == pe.IMAGE_FILE_MACHINE_I386 && (info>>2)&7 != importName {
+		imp.Name = strings.TrimPrefix(imp.Name, "_")
+	}
+	return imp, true
+}
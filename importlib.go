@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"debug/pe"
+	"flag"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"git.dolansoft.org/lorenz/winsysroot/implib"
+)
+
+func init() {
+	subcommands = append(subcommands, &subcommand{
+		name:  "implib",
+		short: "Generate import libraries for API sets or DLLs from .def files which the Windows SDK doesn't ship",
+		setup: setupImplib,
+	})
+}
+
+// implibMachines maps architectures to COFF machine types.
+var implibMachines = map[string]uint16{
+	"x86":   pe.IMAGE_FILE_MACHINE_I386,
+	"x64":   pe.IMAGE_FILE_MACHINE_AMD64,
+	"arm":   pe.IMAGE_FILE_MACHINE_ARMNT,
+	"arm64": pe.IMAGE_FILE_MACHINE_ARM64,
+}
+
+// umbrellaLibs are the Windows SDK libraries importing from API sets
+// instead of the DLLs implementing them.
+var umbrellaLibs = []string{"onecore.lib", "onecoreuap.lib", "onecore_apiset.lib", "onecoreuap_apiset.lib", "mincore.lib", "windowsapp.lib"}
+
+func setupImplib(fs *flag.FlagSet) func(ctx context.Context) error {
+	outDir := fs.String("out", "implib-winsysroot", "Directory to write the import libraries to, one subdirectory per architecture")
+	archs := fs.String("architectures", "", "Comma-separated list of architectures to generate import libraries for (default: all in the sysroot)")
+	var defs, apiSets stringsFlag
+	fs.Var(&defs, "def", "Module-definition (.def) file listing the exports of a DLL, can be repeated")
+	fs.Var(&apiSets, "apiset", "API set to generate an import library for from the umbrella libraries of the sysroot, like api-ms-win-core-synch-l1-2-0 or a pattern like api-ms-win-core-*, can be repeated")
+	return func(ctx context.Context) error {
+		if fs.NArg() > 1 || len(defs)+len(apiSets) == 0 {
+			return stageErrorf(stageUsage, "", "", "usage: winsysroot implib [--def <file.def>]... [--apiset <name>]... [flags] [sysroot-dir]")
+		}
+		var info *sysrootInfo
+		if fs.NArg() == 1 {
+			var err error
+			if info, err = inspectSysroot(fs.Arg(0)); err != nil {
+				return stageErrorf(stageUsage, "", "", "%w", err)
+			}
+		} else if len(apiSets) > 0 {
+			return stageErrorf(stageUsage, "", "", "--apiset needs a sysroot directory to read the umbrella libraries from")
+		} else if *archs == "" {
+			return stageErrorf(stageUsage, "", "", "--architectures is required without a sysroot directory")
+		}
+		var architectures []string
+		if *archs != "" {
+			for _, arch := range strings.Split(*archs, ",") {
+				if _, ok := implibMachines[arch]; !ok {
+					return stageErrorf(stageUsage, "", "", "unknown architecture %v", arch)
+				}
+				if info != nil && !info.hasArch(arch) {
+					return stageErrorf(stageUsage, "", "", "sysroot does not contain %v, available are %v", arch, strings.Join(info.Architectures, ", "))
+				}
+				architectures = append(architectures, arch)
+			}
+		} else {
+			architectures = info.Architectures
+		}
+		return runImplib(info, *outDir, architectures, defs, apiSets)
+	}
+}
+
+func runImplib(info *sysrootInfo, outDir string, archs, defs, apiSets []string) error {
+	// Exports of the .def files by DLL name
+	defExports := make(map[string][]implib.Export)
+	for _, def := range defs {
+		f, err := os.Open(def)
+		if err != nil {
+			return stageErrorf(stageUsage, "", "", "%w", err)
+		}
+		dll, exports, err := implib.ParseDef(f)
+		f.Close()
+		if err != nil {
+			return stageErrorf(stageUsage, "", "", "failed to parse %v: %w", def, err)
+		}
+		if dll == "" {
+			dll = strings.TrimSuffix(filepath.Base(def), filepath.Ext(def)) + ".dll"
+		}
+		defExports[dll] = append(defExports[dll], exports...)
+	}
+	for _, arch := range archs {
+		libs := make(map[string][]implib.Export)
+		for dll, exports := range defExports {
+			libs[dll] = exports
+		}
+		if len(apiSets) > 0 {
+			found, err := apiSetExports(info, arch, apiSets)
+			if err != nil {
+				return err
+			}
+			for dll, exports := range found {
+				libs[dll] = append(libs[dll], exports...)
+			}
+		}
+		dir := filepath.Join(outDir, arch)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return stageErrorf(stageOutput, "", "", "%w", err)
+		}
+		var names []string
+		for dll, exports := range libs {
+			name := strings.ToLower(strings.TrimSuffix(dll, path.Ext(dll))) + ".lib"
+			f, err := os.Create(filepath.Join(dir, name))
+			if err != nil {
+				return stageErrorf(stageOutput, "", "", "%w", err)
+			}
+			err = implib.Write(f, implibMachines[arch], dll, exports)
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				return stageErrorf(stageOutput, "", "", "failed to write %v: %w", name, err)
+			}
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		log.Printf("Wrote %v for %v, link with them using: /libpath:%v", strings.Join(names, ", "), arch, dir)
+	}
+	return nil
+}
+
+// apiSetExports collects the exports of the API sets matching patterns from
+// the umbrella libraries of the sysroot for arch.
+func apiSetExports(info *sysrootInfo, arch string, patterns []string) (map[string][]implib.Export, error) {
+	dir := filepath.Join(info.Root, "Windows Kits", "10", "Lib", info.SDKVersion, "um", arch)
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, stageErrorf(stageUsage, "", "", "%w", err)
+	}
+	wanted := make(map[string]bool)
+	for _, u := range umbrellaLibs {
+		wanted[u] = true
+	}
+	exports := make(map[string][]implib.Export)
+	// Umbrella libraries overlap, every export is only taken once.
+	seen := make(map[string]bool)
+	matched := make(map[string]bool)
+	for _, fi := range entries {
+		if !wanted[strings.ToLower(fi.Name())] {
+			continue
+		}
+		raw, err := ioutil.ReadFile(filepath.Join(dir, fi.Name()))
+		if err != nil {
+			return nil, stageErrorf(stageUsage, "", "", "%w", err)
+		}
+		imports, err := implib.ReadImports(raw)
+		if err != nil {
+			return nil, stageErrorf(stageUsage, "", "", "failed to read %v: %w", fi.Name(), err)
+		}
+		for _, imp := range imports {
+			dll := strings.ToLower(imp.DLL)
+			apiSet := strings.TrimSuffix(dll, path.Ext(dll))
+			for _, p := range patterns {
+				if ok, _ := path.Match(strings.ToLower(strings.TrimSuffix(p, ".dll")), apiSet); !ok {
+					continue
+				}
+				matched[p] = true
+				key := apiSet + "\x00" + imp.Name
+				if !seen[key] {
+					seen[key] = true
+					exports[dll] = append(exports[dll], imp.Export)
+				}
+				break
+			}
+		}
+	}
+	for _, p := range patterns {
+		if !matched[p] {
+			return nil, stageErrorf(stageUsage, "", "", "no exports of %v found in the umbrella libraries (%v) for %v", p, strings.Join(umbrellaLibs, ", "), arch)
+		}
+	}
+	return exports, nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"git.dolansoft.org/lorenz/winsysroot/sysroot"
+)
+
+var limits = sysroot.DefaultLimits
+
+// sizeFlag is a byte size which can be given with a K, M, G or T suffix
+// (powers of 1024).
+type sizeFlag struct {
+	v *int64
+}
+
+var sizeSuffixes = map[string]int64{"K": 1 << 10, "M": 1 << 20, "G": 1 << 30, "T": 1 << 40}
+
+func (s sizeFlag) String() string {
+	if s.v == nil {
+		return "0"
+	}
+	n := *s.v
+	for _, suffix := range []string{"T", "G", "M", "K"} {
+		if m := sizeSuffixes[suffix]; n != 0 && n%m == 0 {
+			return strconv.FormatInt(n/m, 10) + suffix
+		}
+	}
+	return strconv.FormatInt(n, 10)
+}
+
+func (s sizeFlag) Set(v string) error {
+	mult := int64(1)
+	upper := strings.TrimSuffix(strings.ToUpper(v), "B")
+	if len(upper) > 0 {
+		if m, ok := sizeSuffixes[upper[len(upper)-1:]]; ok {
+			mult = m
+			upper = upper[:len(upper)-1]
+		}
+	}
+	n, err := strconv.ParseInt(upper, 10, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid size %q", v)
+	}
+	*s.v = n * mult
+	return nil
+}
+
+// registerLimitFlags registers the flags controlling extraction resource
+// limits on fs.
+func registerLimitFlags(fs *flag.FlagSet) {
+	fs.Var(sizeFlag{&limits.MaxFileSize}, "max-file-size", "Fail if a single extracted file is larger than this (like 512M or 2G), 0 disables the limit")
+	fs.Var(sizeFlag{&limits.MaxTotalSize}, "max-total-size", "Fail if the extracted sysroot gets larger than this, 0 disables the limit")
+	fs.Var(sizeFlag{&limits.MaxFolderSize}, "max-folder-size", "Fail if a CAB folder, which is held in memory while extracting, is larger than this, 0 disables the limit")
+	fs.Float64Var(&limits.MaxRatio, "max-decompression-ratio", limits.MaxRatio, "Fail if CAB folders or zip entries larger than 1MiB decompress to more than this many times their compressed size, 0 disables the limit")
+}
+
+func init() {
+	registerLimitFlags(flag.CommandLine)
+}
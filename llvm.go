@@ -0,0 +1,466 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+
+	"git.dolansoft.org/lorenz/winsysroot/target"
+	"git.dolansoft.org/lorenz/winsysroot/versions"
+	"git.dolansoft.org/lorenz/winsysroot/vfs"
+)
+
+// bundledLLVMVersion is the LLVM release bundled by --bundle-llvm.
+const bundledLLVMVersion = "18.1.8"
+
+// llvmAsset is a release archive of bundledLLVMVersion.
+type llvmAsset struct {
+	name string
+	// sha256 is the hash of the archive as published with the release.
+	// Archives are only used if their hash is known, so entries without
+	// one require --llvm-sha256.
+	sha256 string
+}
+
+// llvmAssets are the release archives by host. The hashes have to be taken
+// from the checksums published with the release when it is updated.
+var llvmAssets = map[string]llvmAsset{
+	"linux-amd64":   {name: "clang+llvm-" + bundledLLVMVersion + "-x86_64-linux-gnu-ubuntu-18.04.tar.xz"},
+	"linux-arm64":   {name: "clang+llvm-" + bundledLLVMVersion + "-aarch64-linux-gnu.tar.xz"},
+	"darwin-arm64":  {name: "clang+llvm-" + bundledLLVMVersion + "-arm64-apple-macos11.tar.xz"},
+	"windows-amd64": {name: "clang+llvm-" + bundledLLVMVersion + "-x86_64-pc-windows-msvc.tar.xz"},
+}
+
+// llvmTools are the tools bundled, relative to the bin directory.
+var llvmTools = []string{"clang-cl", "lld-link", "llvm-lib", "llvm-rc", "llvm-mt"}
+
+var (
+	flagBundleLLVM = flag.Bool("bundle-llvm", false, "Bundle clang-cl, lld-link, llvm-lib, llvm-rc and llvm-mt from LLVM "+bundledLLVMVersion+" and CMake toolchains with the sysroot, making it a self-contained cross toolchain")
+	flagLLVMHost   = flag.String("llvm-host", runtime.GOOS+"-"+runtime.GOARCH, "Host the tools bundled by --bundle-llvm run on, like linux-amd64")
+	flagLLVMURL    = flag.String("llvm-url", "", "Download the LLVM release archive (.tar.xz, .tar.gz, .tar.zst or .zip) for --bundle-llvm from this URL instead of GitHub")
+	flagLLVMSHA256 = flag.String("llvm-sha256", "", "Expected SHA256 of the LLVM release archive, required with --llvm-url (default: the pinned hash of the release for --llvm-host)")
+)
+
+// llvmBundle adds LLVM and toolchain files to a target when it is closed.
+type llvmBundle struct {
+	archive string
+	windows bool
+
+	t       target.Target
+	files   target.FileCreator
+	vfsRoot string
+	archs   []string
+
+	mu          sync.Mutex
+	msvcVersion string
+	sdkVersion  string
+}
+
+// prepareLLVMBundle downloads the LLVM release archive for --bundle-llvm,
+// so the build fails early if it's not available.
+func prepareLLVMBundle(ctx context.Context, client *http.Client) (*llvmBundle, error) {
+	url, want := *flagLLVMURL, *flagLLVMSHA256
+	if url == "" {
+		asset, ok := llvmAssets[*flagLLVMHost]
+		if !ok {
+			var hosts []string
+			for h := range llvmAssets {
+				hosts = append(hosts, h)
+			}
+			sort.Strings(hosts)
+			return nil, fmt.Errorf("no LLVM release for %v, available are %v; pass --llvm-url for other hosts", *flagLLVMHost, strings.Join(hosts, ", "))
+		}
+		url = "https://github.com/llvm/llvm-project/releases/download/llvmorg-" + bundledLLVMVersion + "/" + asset.name
+		if want == "" {
+			want = asset.sha256
+		}
+	}
+	// The tools end up on users' PATH, so archives are never trusted on
+	// first use.
+	if want == "" {
+		return nil, fmt.Errorf("no SHA256 pinned for the LLVM archive %v, pass it with --llvm-sha256", url)
+	}
+	name := path.Base(url)
+	if i := strings.IndexAny(name, "?#"); i >= 0 {
+		name = name[:i]
+	}
+	archive := filepath.Join(os.TempDir(), "winsysroot-"+name)
+	if *flagTempDir != "" {
+		archive = filepath.Join(*flagTempDir, name)
+	}
+	if *flagCacheDir != "" {
+		archive = filepath.Join(*flagCacheDir, "llvm", name)
+	}
+	sum, err := hashFile(archive)
+	if err != nil || !strings.EqualFold(hex.EncodeToString(sum), want) {
+		log.Printf("Downloading %v", url)
+		if sum, err = downloadFile(ctx, client, url, archive); err != nil {
+			return nil, fmt.Errorf("failed to download LLVM: %w", err)
+		}
+	}
+	if !strings.EqualFold(hex.EncodeToString(sum), want) {
+		os.Remove(archive)
+		return nil, fmt.Errorf("LLVM archive %v has SHA256 %x, expected %v", url, sum, want)
+	}
+	return &llvmBundle{archive: archive, windows: strings.HasPrefix(*flagLLVMHost, "windows")}, nil
+}
+
+// downloadFile downloads url to dest and returns its SHA256.
+func downloadFile(ctx context.Context, client *http.Client, url, dest string) ([]byte, error) {
+	if httpRequestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, httpRequestTimeout)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range httpHeader() {
+		req.Header[k] = v
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%v: %v", url, res.Status)
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return nil, err
+	}
+	tmp := dest + ".partial"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.Copy(f, res.Body)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, dest)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+	return hashFile(dest)
+}
+
+var (
+	msvcPathRegexp = regexp.MustCompile(`(?i)^VC/Tools/MSVC/([^/]+)/`)
+	sdkPathRegexp  = regexp.MustCompile(`(?i)^Windows Kits/10/Lib/([^/]+)/`)
+)
+
+// wrap returns a target writing to t which adds the bundle when closed. The
+// versions for the toolchain files are taken from the paths written.
+func (b *llvmBundle) wrap(t target.Target, vfsRoot string, archs []string) target.Target {
+	b.t = t
+	b.files = target.Files(t)
+	b.vfsRoot = vfsRoot
+	b.archs = archs
+	return b
+}
+
+func (b *llvmBundle) observe(p string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	// Several MSVC toolsets can be installed side by side, the toolchain
+	// files use the newest like clang-cl does.
+	if m := msvcPathRegexp.FindStringSubmatch(p); m != nil && (b.msvcVersion == "" || versions.Compare(m[1], b.msvcVersion) > 0) {
+		b.msvcVersion = m[1]
+	}
+	if m := sdkPathRegexp.FindStringSubmatch(p); m != nil && b.sdkVersion == "" {
+		b.sdkVersion = m[1]
+	}
+}
+
+func (b *llvmBundle) Create(p string, size int64, modTime time.Time) error {
+	b.observe(p)
+	return b.t.Create(p, size, modTime)
+}
+
+// CreateFile implements target.FileCreator. Files are written in parallel
+// if the underlying target supports it.
+func (b *llvmBundle) CreateFile(p string, size int64, modTime time.Time) (io.WriteCloser, error) {
+	b.observe(p)
+	return b.files.CreateFile(p, size, modTime)
+}
+
+func (b *llvmBundle) Write(p []byte) (int, error) {
+	return b.t.Write(p)
+}
+
+func (b *llvmBundle) Close() error {
+	if err := b.writeLLVM(); err != nil {
+		return fmt.Errorf("failed to bundle LLVM: %w", err)
+	}
+	if err := b.writeToolchains(); err != nil {
+		return fmt.Errorf("failed to write toolchain files: %w", err)
+	}
+	return b.t.Close()
+}
+
+// llvmEntry is a file in the LLVM release archive.
+type llvmEntry struct {
+	// link is the target of a symlink relative to its directory, or of a
+	// hard link relative to the archive root if it starts with a slash.
+	link string
+	size int64
+}
+
+// writeLLVM copies the tools and clang's resource headers from the release
+// archive into llvm/ in the target. Tools are often symlinks in the archive,
+// so it is read twice: once to resolve which files are needed and once to
+// copy them.
+func (b *llvmBundle) writeLLVM() error {
+	exe := ""
+	if b.windows {
+		exe = ".exe"
+	}
+	entries := make(map[string]llvmEntry)
+	err := b.walk(func(name string, e llvmEntry, r io.Reader) error {
+		entries[name] = e
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// wanted maps files in the archive to the paths they are written to.
+	wanted := make(map[string][]string)
+	for _, tool := range llvmTools {
+		name := "bin/" + tool + exe
+		for i := 0; ; i++ {
+			e, ok := entries[name]
+			if !ok || i > 10 {
+				return fmt.Errorf("%v not found in %v", tool+exe, filepath.Base(b.archive))
+			}
+			if e.link == "" {
+				break
+			}
+			if strings.HasPrefix(e.link, "/") {
+				name = e.link[1:]
+			} else {
+				name = path.Join(path.Dir(name), e.link)
+			}
+		}
+		wanted[name] = append(wanted[name], "llvm/bin/"+tool+exe)
+	}
+	for name, e := range entries {
+		if e.link == "" && strings.HasPrefix(name, "lib/clang/") && strings.Contains(name, "/include/") {
+			wanted[name] = append(wanted[name], "llvm/"+name)
+		}
+	}
+	modTime := time.Now()
+	return b.walk(func(name string, e llvmEntry, r io.Reader) error {
+		dests := wanted[name]
+		if len(dests) == 0 {
+			return nil
+		}
+		// Tools can be wanted under several names, so their content is
+		// kept until all copies are written.
+		var content []byte
+		if len(dests) > 1 {
+			var err error
+			if content, err = ioutil.ReadAll(r); err != nil {
+				return err
+			}
+		}
+		for _, dest := range dests {
+			create := b.t.Create
+			if strings.HasPrefix(dest, "llvm/bin/") {
+				create = func(p string, size int64, modTime time.Time) error {
+					return target.CreateExecutable(b.t, p, size, modTime)
+				}
+			}
+			if err := create(dest, e.size, modTime); err != nil {
+				return err
+			}
+			src := r
+			if content != nil {
+				src = bytes.NewReader(content)
+			}
+			if _, err := io.Copy(b.t, src); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// walk calls fn for every file and symlink in the release archive with its
+// path below the top-level directory.
+func (b *llvmBundle) walk(fn func(name string, e llvmEntry, r io.Reader) error) error {
+	if strings.HasSuffix(b.archive, ".zip") {
+		zr, err := zip.OpenReader(b.archive)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		for _, f := range zr.File {
+			name := stripTopDir(f.Name)
+			if name == "" || f.FileInfo().IsDir() {
+				continue
+			}
+			rc, err := f.Open()
+			if err != nil {
+				return err
+			}
+			err = fn(name, llvmEntry{size: int64(f.UncompressedSize64)}, rc)
+			rc.Close()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	r, wait, err := decompress(b.archive)
+	if err != nil {
+		return err
+	}
+	err = walkTar(r, fn)
+	if waitErr := wait(); err == nil {
+		err = waitErr
+	}
+	return err
+}
+
+func walkTar(r io.Reader, fn func(name string, e llvmEntry, r io.Reader) error) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := stripTopDir(hdr.Name)
+		if name == "" {
+			continue
+		}
+		switch hdr.Typeflag {
+		case tar.TypeReg:
+			err = fn(name, llvmEntry{size: hdr.Size}, tr)
+		case tar.TypeSymlink:
+			err = fn(name, llvmEntry{link: hdr.Linkname}, nil)
+		case tar.TypeLink:
+			err = fn(name, llvmEntry{link: "/" + stripTopDir(hdr.Linkname)}, nil)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// decompress returns the decompressed contents of a tarball. wait cleans up
+// and returns any error of the decompressor.
+func decompress(name string) (r io.Reader, wait func() error, err error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch {
+	case strings.HasSuffix(name, ".tar.gz") || strings.HasSuffix(name, ".tgz"):
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+		return zr, f.Close, nil
+	case strings.HasSuffix(name, ".tar.zst"):
+		zr, err := zstd.NewReader(f)
+		if err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+		return zr, func() error { zr.Close(); return f.Close() }, nil
+	case strings.HasSuffix(name, ".tar.xz"):
+		// There is no xz decompressor in the standard library.
+		cmd := exec.Command("xz", "-dc")
+		cmd.Stdin = f
+		cmd.Stderr = os.Stderr
+		out, err := cmd.StdoutPipe()
+		if err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+		if err := cmd.Start(); err != nil {
+			f.Close()
+			if errors.Is(err, exec.ErrNotFound) {
+				return nil, nil, errors.New("extracting .tar.xz archives requires xz in PATH")
+			}
+			return nil, nil, err
+		}
+		return out, func() error {
+			// Drain the rest, xz fails if its output is closed early.
+			io.Copy(ioutil.Discard, out)
+			err := cmd.Wait()
+			f.Close()
+			return err
+		}, nil
+	}
+	f.Close()
+	return nil, nil, fmt.Errorf("unsupported archive format of %v", filepath.Base(name))
+}
+
+// stripTopDir removes the first component of an archive path.
+func stripTopDir(name string) string {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	if i := strings.Index(name, "/"); i >= 0 {
+		return name[i+1:]
+	}
+	return ""
+}
+
+// writeToolchains writes CMake toolchain files using the bundled tools into
+// cmake/ in the target.
+func (b *llvmBundle) writeToolchains() error {
+	if b.msvcVersion == "" || b.sdkVersion == "" {
+		return errors.New("failed to determine the MSVC and Windows SDK versions of the sysroot")
+	}
+	info := &sysrootInfo{
+		Root:        b.vfsRoot,
+		MSVCVersion: b.msvcVersion,
+		SDKVersion:  b.sdkVersion,
+		Overlay:     path.Join(b.vfsRoot, vfs.OverlayName),
+		LLVMDir:     path.Join(b.vfsRoot, "llvm", "bin"),
+	}
+	for _, arch := range b.archs {
+		if _, ok := toolchainArchs[arch]; !ok {
+			continue
+		}
+		toolchain := []byte(info.cmakeToolchain(arch))
+		if err := b.t.Create("cmake/winsysroot-"+arch+".cmake", int64(len(toolchain)), time.Now()); err != nil {
+			return err
+		}
+		if _, err := b.t.Write(toolchain); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -1,257 +1,289 @@
 package main
 
 import (
-	"archive/tar"
-	"encoding/json"
-	"errors"
+	"context"
 	"flag"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"log"
-	"net/http"
 	"os"
-	"path"
+	"os/signal"
 	"path/filepath"
-	"regexp"
 	"strings"
+	"syscall"
 	"time"
 
-	"github.com/klauspost/compress/zstd"
+	"git.dolansoft.org/lorenz/winsysroot/manifest"
+	"git.dolansoft.org/lorenz/winsysroot/objstore"
+	"git.dolansoft.org/lorenz/winsysroot/sysroot"
+	"git.dolansoft.org/lorenz/winsysroot/target"
+	"git.dolansoft.org/lorenz/winsysroot/vfs"
 )
 
 var (
 	flagVSRelease       = flag.String("vs-release", "17", "Major release of Visual Studio to generate sysroot from (like 14, 17, ..)")
-	flagWinSDKVersion   = flag.String("win-sdk-version", "10.0.20348", "Version of the Windows SDK to use, without the patch version (e.g. 10.0.20348)")
+	flagWinSDKVersion   = flag.String("win-sdk-version", "10.0.20348", "Version of the Windows SDK to use, without the patch version (e.g. 10.0.20348), \"latest\" or a range like 10.0 or [10.0.19041,10.0.22621]")
 	flagArchitectures   = flag.String("architectures", "x64", "Comma-separated list of architectures to include in the sysroot. Supported are x86, x64, arm, arm64 and arm64ec.")
+	flagHostArch        = flag.String("host-arch", "x64", "Architecture of the machine Visual Studio would be installed on, x64 or arm64. Selects the dependencies only installed on such machines.")
+	flagMSVCToolsets    = flag.String("msvc-toolsets", "latest", "Comma-separated list of MSVC toolsets to install side by side, each latest, a platform toolset like v141, v142 or v143 or a version like 14.29")
 	flagSlim            = flag.Bool("slim", true, "Strip most excess files, ship only headers, libraries and object files. Also strips separate onecore, store and uwp libraries.")
-	flagOutDir          = flag.String("out-dir", "", "Output sysroot under this directory. Exclusive with --out-tar.")
-	flagOutTar          = flag.String("out-tar", "", "Output sysroot to a zstd-compressed tarball at the path given to this argument. Exclusive with --out-dir.")
+	flagSDKFeatures     = flag.String("sdk-features", "", "Comma-separated list of Windows SDK installer features (like OptionId.DesktopCPPx64) to restrict the SDK to")
+	flagOutDir          = flag.String("out-dir", "", "Output sysroot under this directory. Shorthand for --out=dir:<path>.")
+	flagOutTar          = flag.String("out-tar", "", "Output sysroot to a zstd-compressed tarball at the path given to this argument. Shorthand for --out=tar:<path>.")
+	flagOut             = flag.String("out", "", "Output sysroot to the given target in the form scheme:location. Built-in schemes are dir, tar (zstd-compressed), zip, wincontainer (zip with provisioning scripts for Windows containers) and nupkg (NuGet package with MSBuild props).")
+	flagOutURL          = flag.String("out-url", "", "Upload the sysroot archive to object storage at s3://bucket/key, gs://bucket/object or azblob://account/container/blob, or with an HTTP PUT to http(s)://host/path or dav(s)://host/path (WebDAV). Objects ending in .zip are zip archives, all others zstd-compressed tarballs.")
+	flagVFSRoot         = flag.String("vfs-root", "/winsysroot", "Path the sysroot is referenced by in the VFS overlay for targets which are not directories")
 	flagListSDKVersions = flag.Bool("list-win-sdk-versions", false, "List available Windows SDK versions and exit")
+	flagNearest         = flag.Bool("nearest", false, "If the requested Windows SDK version is not available, use the closest available version instead of failing")
+	flagStrict          = flag.Bool("strict", false, "Fail instead of warning if a selected package is marked as deprecated in the manifest")
+	flagProgress        = flag.Bool("progress", false, "Log progress information about selected packages and downloads")
+	flagFilterPlugin    = flag.String("filter-plugin", "", "Command deciding which files to include, see README for the protocol")
+	flagErrorReport     = flag.String("error-report", "", "On failure, write a JSON report describing the error to this path")
+	flagAcceptLicenses  = flag.Bool("accept-licenses", false, "Accept the licenses of all included packages, which are listed if this is not set. Required to build a sysroot.")
+	flagCacheDir        = flag.String("cache-dir", "", "Keep verified downloads in this directory and reuse them in later runs")
+	flagRangedVSIX      = flag.Bool("ranged-vsix", false, "Only fetch the needed parts of VSIX packages using HTTP range requests. Their SHA256 hashes can then not be verified, only the CRC-32 of each extracted file.")
+	flagTempDir         = flag.String("temp-dir", "", "Directory to store downloads in while they are processed (default: system temporary directory)")
+	flagDownloads       = flag.Int("downloads", sysroot.DefaultDownloads, "Number of payloads to download concurrently")
+	flagExtractWorkers  = flag.Int("extract-workers", 0, "Number of payloads to extract concurrently, 0 means one per CPU. Use 1 for archives with a reproducible file order.")
 )
 
-func handleHTTPError(res *http.Response, err error) (*http.Response, error) {
-	if err != nil {
-		return nil, err
-	}
-	if res.StatusCode != http.StatusOK {
-		errorMsg, err := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
-		if err != nil {
-			return nil, fmt.Errorf("HTTP %d: %w", res.StatusCode, err)
-		}
-		return nil, fmt.Errorf("HTTP %d: %s", res.StatusCode, string(errorMsg))
-	}
-	return res, nil
+// subcommand is a mode of operation other than building a sysroot, selected
+// by the first command line argument. setup registers the subcommand's flags
+// on fs and returns a function running it once the flags have been parsed.
+type subcommand struct {
+	name  string
+	short string
+	setup func(fs *flag.FlagSet) func(ctx context.Context) error
 }
 
-type TargetI interface {
-	Create(path string, size int64, modTime time.Time) error
-	io.WriteCloser
+var subcommands []*subcommand
+
+func findSubcommand(name string) *subcommand {
+	for _, cmd := range subcommands {
+		if cmd.name == name {
+			return cmd
+		}
+	}
+	return nil
 }
 
 func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if len(os.Args) > 1 {
+		if cmd := findSubcommand(os.Args[1]); cmd != nil {
+			fs := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+			run := cmd.setup(fs)
+			if err := fs.Parse(os.Args[2:]); err != nil {
+				if err == flag.ErrHelp {
+					return
+				}
+				os.Exit(exitUsage)
+			}
+			if err := run(ctx); err != nil {
+				fail(err)
+			}
+			return
+		}
+	}
+	flag.Usage = usage
 	flag.Parse()
+	if err := run(ctx); err != nil {
+		fail(err)
+	}
+}
 
-	architectures := strings.Split(*flagArchitectures, ",")
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: %s [flags]\n       %s <command> [flags]\n\nCommands:\n", os.Args[0], os.Args[0])
+	for _, cmd := range subcommands {
+		fmt.Fprintf(out, "  %-20s %s\n", cmd.name, cmd.short)
+	}
+	fmt.Fprintf(out, "\nFlags:\n")
+	flag.PrintDefaults()
+}
 
-	res, err := handleHTTPError(http.Get("https://aka.ms/vs/" + *flagVSRelease + "/release/channel"))
+// fetchManifests downloads and parses the channel manifest for the given
+// Visual Studio major release as well as the installer manifest it refers to.
+func fetchManifests(ctx context.Context, vsRelease string) (*manifest.Channel, *manifest.Installer, error) {
+	verify, err := manifestVerifyOptions()
 	if err != nil {
-		log.Fatalf("failed to get channel manifest: %v", err)
+		return nil, nil, stageErrorf(stageUsage, "", "", "%w", err)
 	}
-	var channel ChannelManifest
-	if err := json.NewDecoder(res.Body).Decode(&channel); err != nil {
-		log.Fatalf("failed to parse channel manifest: %v", err)
-	}
-	res.Body.Close()
-	log.Printf("Using channel manifest %v", channel.Info.ID)
-	var installerManifestURL string
-	for _, item := range channel.ChannelItems {
-		if item.ID == "Microsoft.VisualStudio.Manifests.VisualStudio" {
-			installerManifestURL = item.Payloads[0].URL
-		}
+	hc, err := httpClient()
+	if err != nil {
+		return nil, nil, stageErrorf(stageUsage, "", "", "%w", err)
 	}
-	if installerManifestURL == "" {
-		log.Fatalf("could not find installer manifest in channel manifest")
+	client := manifest.Client{HTTPClient: hc, Header: httpHeader(), Timeout: httpRequestTimeout, Verify: verify}
+	if *flagCacheDir != "" {
+		client.CacheDir = filepath.Join(*flagCacheDir, "manifests")
 	}
-	res, err = handleHTTPError(http.Get(installerManifestURL))
+	channel, installer, err := client.Fetch(ctx, vsRelease)
 	if err != nil {
-		log.Fatalf("failed to get installer manifest: %v", err)
-	}
-	var installerManifest InstallerManifest
-	if err := json.NewDecoder(res.Body).Decode(&installerManifest); err != nil {
-		log.Fatalf("failed to parse installer manifest: %v", err)
+		return nil, nil, stageErrorf(stageManifest, "", "", "%w", err)
 	}
-	res.Body.Close()
+	return channel, installer, nil
+}
 
-	if *flagListSDKVersions {
-		packageRegexp := regexp.MustCompile(`^Win.*SDK_([0-9.]+)$`)
-		for _, pkg := range installerManifest.Packages {
-			res := packageRegexp.FindStringSubmatch(pkg.ID)
-			if len(res) > 0 {
-				fmt.Printf("%v\n", res[1])
-			}
-		}
-		return
+func run(ctx context.Context) (err error) {
+	architectures := strings.Split(*flagArchitectures, ",")
+	var sdkFeatures []string
+	if *flagSDKFeatures != "" {
+		sdkFeatures = strings.Split(*flagSDKFeatures, ",")
 	}
 
-	var out TargetI
-
-	if flagOutDir != nil && *flagOutDir != "" {
-		out = newVFSTargetLayer(&directoryTarget{rootDir: *flagOutDir}, *flagOutDir)
-	} else if flagOutTar != nil && *flagOutTar != "" {
-		outInner, err := newArchiveTarget(*flagOutTar)
-		if err != nil {
-			log.Fatalf("Failed to create output tar archive: %v", err)
-		}
-		out = newVFSTargetLayer(outInner, "/winsysroot")
-	} else {
-		log.Fatalln("Please pass either --out-dir or --out-tar to this command.")
+	channel, installerManifest, err := fetchManifests(ctx, *flagVSRelease)
+	if err != nil {
+		return err
 	}
+	log.Printf("Using channel manifest %v", channel.Info.ID)
 
-	buildWinSDK(*flagWinSDKVersion, architectures, *flagSlim, installerManifest, out)
-	buildVCTools(installerManifest, architectures, *flagSlim, out)
-
-	if err := out.Close(); err != nil {
-		log.Fatalf("failed to finish wrinting output: %v", err)
+	if *flagListSDKVersions {
+		for _, v := range installerManifest.SDKVersions() {
+			fmt.Printf("%v\n", v)
+		}
+		return nil
 	}
-}
-
-type vfsTargetLayer struct {
-	t TargetI
-	i *Inode
-	v VFS
-}
 
-func newVFSTargetLayer(t TargetI, sysrootPath string) *vfsTargetLayer {
-	var vfs VFS
-	vfs.Version = 0
-	vfs.RedirectingWith = RedirectingWithFallthrough
-	True := true
-	False := false
-	vfs.CaseSensitive = &False
-	vfs.OverlayRelative = &True
-
-	winsysRoot := Inode{
-		Type: "directory",
-		Name: sysrootPath,
+	sdkVersion, err := sysroot.ResolveSDKVersion(installerManifest, *flagWinSDKVersion, *flagNearest)
+	if err != nil {
+		return err
 	}
-	vfs.Roots = append(vfs.Roots, &winsysRoot)
-	return &vfsTargetLayer{
-		t: t,
-		i: &winsysRoot,
-		v: vfs,
+	if sdkVersion != *flagWinSDKVersion {
+		log.Printf("Using Windows SDK %v for requested version %v", sdkVersion, *flagWinSDKVersion)
 	}
-}
 
-func (v *vfsTargetLayer) Create(p string, size int64, modTime time.Time) error {
-	if err := v.i.Place(path.Dir(p), true, &Inode{
-		Type:             "file",
-		Name:             path.Base(p),
-		ExternalContents: p,
-	}); err != nil {
-		return err
+	var outSpec string
+	switch {
+	case *flagOutURL != "":
+	case *flagOut != "":
+		outSpec = *flagOut
+	case *flagOutDir != "":
+		outSpec = "dir:" + *flagOutDir
+	case *flagOutTar != "":
+		outSpec = "tar:" + *flagOutTar
+	default:
+		return stageErrorf(stageUsage, "", "", "please pass one of --out, --out-dir, --out-tar or --out-url to this command")
 	}
-	return v.t.Create(p, size, modTime)
-}
-
-func (v *vfsTargetLayer) Write(b []byte) (int, error) {
-	return v.t.Write(b)
-}
-
-func (v *vfsTargetLayer) Close() error {
-	vfsRaw, err := json.MarshalIndent(v.v, "", "\t")
-	if err != nil {
-		return fmt.Errorf("failed to encode VFS overlay metadata: %w", err)
+	if err := checkBazelFlags(outSpec); err != nil {
+		return stageErrorf(stageUsage, "", "", "%w", err)
 	}
-	v.t.Create("vfsoverlay.yaml", int64(len(vfsRaw)), time.Now())
-	if _, err := v.t.Write(vfsRaw); err != nil {
-		return fmt.Errorf("failed to write VFS overlay: %w", err)
+	if err := checkYoctoFlags(outSpec); err != nil {
+		return stageErrorf(stageUsage, "", "", "%w", err)
 	}
-	return v.t.Close()
-}
-
-type archiveTarget struct {
-	outFile *os.File
-	outComp *zstd.Encoder
-	out     *tar.Writer
-}
-
-func newArchiveTarget(name string) (*archiveTarget, error) {
-	outFile, err := os.Create(name)
+	if err := checkNuGetFlags(); err != nil {
+		return stageErrorf(stageUsage, "", "", "%w", err)
+	}
+	acRoots, err := authenticodeRoots()
 	if err != nil {
-		return nil, fmt.Errorf("failed to create output archive: %w", err)
+		return stageErrorf(stageUsage, "", "", "%w", err)
 	}
-	outComp, err := zstd.NewWriter(outFile)
+	hc, err := httpClient()
 	if err != nil {
-		return nil, fmt.Errorf("failed to initialize zstd compressor: %w", err)
+		return stageErrorf(stageUsage, "", "", "%w", err)
 	}
-	out := tar.NewWriter(outComp)
-	return &archiveTarget{
-		outFile: outFile,
-		outComp: outComp,
-		out:     out,
-	}, nil
-}
-
-func (a *archiveTarget) Close() error {
-	if err := a.out.Close(); err != nil {
-		return err
+	var bundle *llvmBundle
+	if *flagBundleLLVM {
+		if bundle, err = prepareLLVMBundle(ctx, hc); err != nil {
+			return stageErrorf(stageDownload, "", "", "%w", err)
+		}
 	}
-	if err := a.outComp.Close(); err != nil {
-		return err
+	var outInner target.Target
+	var upload *objstore.Writer
+	if *flagOutURL != "" {
+		upload, err = objstore.NewWriter(ctx, *flagOutURL, objstore.Options{Client: hc})
+		if err != nil {
+			return stageErrorf(stageOutput, "", "", "%w", err)
+		}
+		defer func() {
+			if err != nil {
+				abortCtx, cancel := context.WithTimeout(context.Background(), time.Minute)
+				defer cancel()
+				if abortErr := upload.Abort(abortCtx); abortErr != nil {
+					log.Printf("Failed to abort upload: %v", abortErr)
+				}
+			}
+		}()
+		if strings.HasSuffix(*flagOutURL, ".zip") {
+			outInner = target.NewZipWriter(upload)
+		} else if outInner, err = target.NewTarWriter(upload); err != nil {
+			return stageErrorf(stageOutput, "", "", "failed to create output: %w", err)
+		}
+	} else if outInner, err = target.Open(outSpec); err != nil {
+		return stageErrorf(stageOutput, "", "", "failed to create output: %w", err)
 	}
-	if err := a.outFile.Close(); err != nil {
-		return err
+	vfsRoot := *flagVFSRoot
+	if rooted, ok := outInner.(target.Rooted); ok {
+		vfsRoot = rooted.Root()
+	} else {
+		// Archives carry the hashes of their contents for verify-archive.
+		outInner = target.NewIntegrityLayer(outInner)
 	}
-	return nil
-}
-
-func (a *archiveTarget) Create(path string, size int64, modTime time.Time) error {
-	return a.out.WriteHeader(&tar.Header{
-		Name:    path,
-		ModTime: modTime,
-		Size:    size,
-		Mode:    0644,
-	})
-}
-
-func (a *archiveTarget) Write(b []byte) (int, error) {
-	return a.out.Write(b)
-}
-
-type directoryTarget struct {
-	rootDir  string
-	currFile *os.File
-}
-
-func (d *directoryTarget) Create(path string, size int64, modTime time.Time) error {
-	if d.currFile != nil {
-		d.currFile.Close()
+	if strings.HasPrefix(outSpec, "wincontainer:") {
+		outInner = newWinContainer(outInner)
 	}
-	targetPath := filepath.Join(d.rootDir, filepath.FromSlash(path))
-	f, err := os.Create(targetPath)
-	if errors.Is(err, os.ErrNotExist) {
-		if err := os.MkdirAll(filepath.Dir(targetPath), 0755); err != nil {
-			return err
-		}
-		f, err = os.Create(targetPath)
+	if strings.HasPrefix(outSpec, "nupkg:") {
+		outInner = newNuGetPackage(outInner)
+	}
+	if bundle != nil {
+		outInner = bundle.wrap(outInner, vfsRoot, architectures)
+	}
+	out := vfs.NewTargetLayer(outInner, vfsRoot)
+
+	var filter sysroot.Filter
+	var plugin *filterPlugin
+	if *flagFilterPlugin != "" {
+		plugin, err = startFilterPlugin(*flagFilterPlugin)
 		if err != nil {
-			return err
+			return stageErrorf(stageUsage, "", "", "%w", err)
 		}
-	} else if err != nil {
-		return err
+		filter = plugin.Filter
 	}
-	d.currFile = f
-	return nil
-}
-
-func (d *directoryTarget) Write(b []byte) (int, error) {
-	return d.currFile.Write(b)
-}
 
-func (d *directoryTarget) Close() error {
-	if d.currFile != nil {
-		return d.currFile.Close()
+	err = sysroot.Build(ctx, sysroot.Options{
+		Manifest:                 installerManifest,
+		WinSDKVersion:            sdkVersion,
+		Architectures:            architectures,
+		HostArch:                 *flagHostArch,
+		Toolsets:                 strings.Split(*flagMSVCToolsets, ","),
+		Slim:                     *flagSlim,
+		SDKFeatures:              sdkFeatures,
+		Strict:                   *flagStrict,
+		HTTPClient:               hc,
+		Header:                   httpHeader(),
+		RequestTimeout:           httpRequestTimeout,
+		Events:                   buildEvents(),
+		Filter:                   filter,
+		CacheDir:                 *flagCacheDir,
+		AcceptLicenses:           *flagAcceptLicenses,
+		Limits:                   &limits,
+		OnChecksumMismatch:       onChecksumMismatch,
+		RequireSigner:            requireSigner,
+		Authenticode:             verifyAuthenticode,
+		AuthenticodeRoots:        acRoots,
+		AuthenticodeIdentityOnly: authenticodeIdentity,
+		RangedVSIX:               *flagRangedVSIX,
+		TempDir:                  *flagTempDir,
+		Downloads:                *flagDownloads,
+		ExtractWorkers:           *flagExtractWorkers,
+	}, out)
+	if plugin != nil {
+		if pluginErr := plugin.Close(); pluginErr != nil && err == nil {
+			err = stageErrorf(stageExtract, "", "", "%w", pluginErr)
+		}
 	}
-	return nil
+	var uploaded []byte
+	if upload != nil {
+		uploaded = upload.SHA256()
+	}
+	if err == nil && *flagBazelSnippet != "" {
+		if bazelErr := emitBazelSnippet(outSpec, uploaded); bazelErr != nil {
+			err = stageErrorf(stageOutput, "", "", "failed to write Bazel snippet: %w", bazelErr)
+		}
+	}
+	if err == nil && *flagYoctoRecipe != "" {
+		if yoctoErr := emitYoctoRecipe(outSpec, uploaded, *flagVSRelease, sdkVersion); yoctoErr != nil {
+			err = stageErrorf(stageOutput, "", "", "failed to write Yocto recipe: %w", yoctoErr)
+		}
+	}
+	return err
 }
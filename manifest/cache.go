@@ -0,0 +1,98 @@
+package manifest
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// cacheEntry describes a cached manifest, whose body is stored next to it.
+type cacheEntry struct {
+	URL          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"lastModified,omitempty"`
+}
+
+// cachePaths returns the paths of the metadata and the body of the cache
+// entry for url.
+func (c *Client) cachePaths(url string) (meta, body string) {
+	sum := sha256.Sum256([]byte(url))
+	base := filepath.Join(c.CacheDir, hex.EncodeToString(sum[:]))
+	return base + ".json", base
+}
+
+// readCache returns the cached response for url, if any.
+func (c *Client) readCache(url string) (*cacheEntry, []byte, bool) {
+	if c.CacheDir == "" {
+		return nil, nil, false
+	}
+	metaPath, bodyPath := c.cachePaths(url)
+	rawMeta, err := ioutil.ReadFile(metaPath)
+	if err != nil {
+		return nil, nil, false
+	}
+	var entry cacheEntry
+	if err := json.Unmarshal(rawMeta, &entry); err != nil || entry.URL != url {
+		return nil, nil, false
+	}
+	body, err := ioutil.ReadFile(bodyPath)
+	if err != nil {
+		return nil, nil, false
+	}
+	return &entry, body, true
+}
+
+// setConditional adds the headers revalidating entry to req.
+func (e *cacheEntry) setConditional(req *http.Request) {
+	if e.ETag != "" {
+		req.Header.Set("If-None-Match", e.ETag)
+	}
+	if e.LastModified != "" {
+		req.Header.Set("If-Modified-Since", e.LastModified)
+	}
+}
+
+// writeCache stores the response to url if it can be revalidated. Failures
+// are ignored as the cache is only an optimization.
+func (c *Client) writeCache(url string, res *http.Response, body []byte) {
+	entry := cacheEntry{URL: url, ETag: res.Header.Get("ETag"), LastModified: res.Header.Get("Last-Modified")}
+	if c.CacheDir == "" || (entry.ETag == "" && entry.LastModified == "") {
+		return
+	}
+	rawMeta, err := json.Marshal(&entry)
+	if err != nil {
+		return
+	}
+	if err := os.MkdirAll(c.CacheDir, 0755); err != nil {
+		return
+	}
+	metaPath, bodyPath := c.cachePaths(url)
+	// The metadata is written last so that it never refers to a partially
+	// written body.
+	os.Remove(metaPath)
+	if writeFileAtomic(bodyPath, body) == nil {
+		writeFileAtomic(metaPath, rawMeta)
+	}
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
@@ -0,0 +1,36 @@
+package manifest
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCache(t *testing.T) {
+	var full int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		if req.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		full++
+		w.Write([]byte(`{"manifestVersion":"1.1"}`))
+	}))
+	defer srv.Close()
+
+	c := Client{HTTPClient: srv.Client(), CacheDir: t.TempDir()}
+	for i := 0; i < 2; i++ {
+		var installer Installer
+		if err := c.get(context.Background(), srv.URL, &installer); err != nil {
+			t.Fatalf("get: %v", err)
+		}
+		if installer.ManifestVersion != "1.1" {
+			t.Errorf("got manifest version %q", installer.ManifestVersion)
+		}
+	}
+	if full != 1 {
+		t.Errorf("manifest was downloaded %d times", full)
+	}
+}
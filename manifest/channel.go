@@ -1,6 +1,10 @@
-package main
+// Package manifest contains the types of the Visual Studio channel and
+// installer manifests and functions for fetching them.
+package manifest
 
-type ChannelManifest struct {
+// Channel is the channel manifest of a Visual Studio release. It mainly
+// points to the installer manifest.
+type Channel struct {
 	ManifestVersion string `json:"manifestVersion"`
 	Info            struct {
 		ID                               string `json:"id"`
@@ -59,28 +63,5 @@ type ChannelManifest struct {
 			} `json:"conditions"`
 		} `json:"requirements,omitempty"`
 	} `json:"channelItems"`
-	Signature struct {
-		SignInfo struct {
-			SignatureMethod  string `json:"signatureMethod"`
-			DigestMethod     string `json:"digestMethod"`
-			DigestValue      string `json:"digestValue"`
-			Canonicalization string `json:"canonicalization"`
-		} `json:"signInfo"`
-		SignatureValue string `json:"signatureValue"`
-		KeyInfo        struct {
-			KeyValue struct {
-				RsaKeyValue struct {
-					Modulus  string `json:"modulus"`
-					Exponent string `json:"exponent"`
-				} `json:"rsaKeyValue"`
-			} `json:"keyValue"`
-			X509Data []string `json:"x509Data"`
-		} `json:"keyInfo"`
-		CounterSign struct {
-			X509Data               []string `json:"x509Data"`
-			Timestamp              string   `json:"timestamp"`
-			CounterSignatureMethod string   `json:"counterSignatureMethod"`
-			CounterSignature       string   `json:"counterSignature"`
-		} `json:"counterSign"`
-	} `json:"signature"`
+	Signature Signature `json:"signature"`
 }
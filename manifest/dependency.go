@@ -0,0 +1,128 @@
+package manifest
+
+import (
+	"sort"
+	"strings"
+)
+
+// Dependency is an entry of Package.Dependencies.
+type Dependency struct {
+	// ID is the ID of the package depended on.
+	ID string
+	// Version is the range of versions accepted, like [17.8,18.0).
+	Version string
+	// Chip selects the package built for that processor architecture if
+	// several share the ID.
+	Chip string
+	// MachineArch restricts the dependency to machines of an architecture,
+	// like arm64.
+	MachineArch string
+	// Type is empty for required dependencies, otherwise like Optional or
+	// Recommended.
+	Type string
+	// When lists the IDs of the products the dependency applies to, like
+	// Microsoft.VisualStudio.Product.BuildTools. It applies to all if empty.
+	When []string
+}
+
+// ParseDependencies returns the dependencies of p sorted by ID. Entries are
+// either just a version range or an object with conditions.
+func (p *Package) ParseDependencies() []Dependency {
+	deps := make([]Dependency, 0, len(p.Dependencies))
+	for key, v := range p.Dependencies {
+		dep := Dependency{ID: key}
+		switch v := v.(type) {
+		case string:
+			dep.Version = v
+		case map[string]interface{}:
+			str := func(name string) string {
+				s, _ := v[name].(string)
+				return s
+			}
+			// Keys are unique, so dependencies on several chips of a
+			// package use other keys and name the package in id.
+			if id := str("id"); id != "" {
+				dep.ID = id
+			}
+			dep.Version = str("version")
+			dep.Chip = str("chip")
+			dep.MachineArch = str("machineArch")
+			dep.Type = str("type")
+			switch when := v["when"].(type) {
+			case string:
+				dep.When = []string{when}
+			case []interface{}:
+				for _, w := range when {
+					if w, ok := w.(string); ok {
+						dep.When = append(dep.When, w)
+					}
+				}
+			}
+		}
+		deps = append(deps, dep)
+	}
+	sort.Slice(deps, func(i, j int) bool {
+		if deps[i].ID != deps[j].ID {
+			return deps[i].ID < deps[j].ID
+		}
+		return deps[i].Chip < deps[j].Chip
+	})
+	return deps
+}
+
+// Conditions select the dependencies and packages which apply to an
+// installation. Empty fields don't restrict anything.
+type Conditions struct {
+	// MachineArch is the architecture of the machine installed on, like
+	// x64 or arm64.
+	MachineArch string
+	// Product is the ID of the product installed, like
+	// Microsoft.VisualStudio.Product.BuildTools.
+	Product string
+}
+
+// applies reports whether dep is followed under c.
+func (c Conditions) applies(dep Dependency) bool {
+	if dep.MachineArch != "" && c.MachineArch != "" && !strings.EqualFold(dep.MachineArch, c.MachineArch) {
+		return false
+	}
+	if len(dep.When) > 0 && c.Product != "" {
+		for _, w := range dep.When {
+			if strings.EqualFold(w, c.Product) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// choose returns the package to use out of candidates sharing an ID. A
+// dependency's chip selects the package built for it. Otherwise the first
+// one for the machine's architecture is preferred, then the first one
+// without a machine restriction and finally the first one.
+func (c Conditions) choose(candidates []Package, chip string) (Package, bool) {
+	if len(candidates) == 0 {
+		return Package{}, false
+	}
+	if chip != "" {
+		for _, pkg := range candidates {
+			if strings.EqualFold(pkg.Chip, chip) {
+				return pkg, true
+			}
+		}
+	}
+	if c.MachineArch != "" {
+		for _, pkg := range candidates {
+			if strings.EqualFold(pkg.MachineArch, c.MachineArch) || (pkg.MachineArch == "" && strings.EqualFold(pkg.Chip, c.MachineArch)) {
+				return pkg, true
+			}
+		}
+		for _, pkg := range candidates {
+			if pkg.MachineArch == "" {
+				return pkg, true
+			}
+		}
+	}
+	return candidates[0], true
+}
@@ -0,0 +1,148 @@
+package manifest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// InstallerManifestID is the ID of the channel item referencing the installer
+// manifest.
+const InstallerManifestID = "Microsoft.VisualStudio.Manifests.VisualStudio"
+
+// ChannelURL returns the URL of the channel manifest for the given Visual
+// Studio major release (like 16 or 17).
+func ChannelURL(release string) string {
+	return "https://aka.ms/vs/" + release + "/release/channel"
+}
+
+// Client fetches Visual Studio manifests.
+type Client struct {
+	// HTTPClient is used for all requests. If nil, http.DefaultClient is
+	// used.
+	HTTPClient *http.Client
+	// Header contains additional headers sent with every request.
+	Header http.Header
+	// Timeout limits the time a single request may take including reading
+	// the response. Zero means no timeout.
+	Timeout time.Duration
+	// Verify, if set, requires all fetched manifests to carry a valid
+	// signature according to these options.
+	Verify *VerifyOptions
+	// CacheDir, if set, is a directory where manifests are kept. Cached
+	// manifests are revalidated with the server using their ETag or
+	// modification time and only downloaded again if they have changed.
+	CacheDir string
+}
+
+func (c *Client) get(ctx context.Context, url string, v interface{}) error {
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	for k, vals := range c.Header {
+		req.Header[k] = vals
+	}
+	cached, cachedBody, isCached := c.readCache(url)
+	if isCached {
+		cached.setConditional(req)
+	}
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	var raw []byte
+	switch {
+	case res.StatusCode == http.StatusNotModified && isCached:
+		raw = cachedBody
+	case res.StatusCode == http.StatusOK:
+		raw, err = ioutil.ReadAll(res.Body)
+		if err != nil {
+			return err
+		}
+	default:
+		errorMsg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("HTTP %d: %s", res.StatusCode, string(errorMsg))
+	}
+	if c.Verify != nil {
+		if _, err := VerifySignature(raw, *c.Verify); err != nil {
+			return fmt.Errorf("signature verification failed: %w", err)
+		}
+	}
+	if err := json.Unmarshal(raw, v); err != nil {
+		return err
+	}
+	if res.StatusCode == http.StatusOK {
+		c.writeCache(url, res, raw)
+	}
+	return nil
+}
+
+// FetchChannel downloads the channel manifest of the given Visual Studio major
+// release.
+func (c *Client) FetchChannel(ctx context.Context, release string) (*Channel, error) {
+	var channel Channel
+	if err := c.get(ctx, ChannelURL(release), &channel); err != nil {
+		return nil, fmt.Errorf("failed to get channel manifest: %w", err)
+	}
+	return &channel, nil
+}
+
+// FetchInstaller downloads the installer manifest referenced by channel.
+func (c *Client) FetchInstaller(ctx context.Context, channel *Channel) (*Installer, error) {
+	url := channel.InstallerManifestURL()
+	if url == "" {
+		return nil, fmt.Errorf("could not find installer manifest in channel manifest")
+	}
+	var installer Installer
+	if err := c.get(ctx, url, &installer); err != nil {
+		return nil, fmt.Errorf("failed to get installer manifest: %w", err)
+	}
+	return &installer, nil
+}
+
+// Fetch downloads the channel manifest of the given Visual Studio major
+// release and the installer manifest it references.
+func (c *Client) Fetch(ctx context.Context, release string) (*Channel, *Installer, error) {
+	channel, err := c.FetchChannel(ctx, release)
+	if err != nil {
+		return nil, nil, err
+	}
+	installer, err := c.FetchInstaller(ctx, channel)
+	if err != nil {
+		return nil, nil, err
+	}
+	return channel, installer, nil
+}
+
+// Fetch downloads the channel manifest of the given Visual Studio major
+// release and the installer manifest it references using the default HTTP
+// client. header is sent with every request.
+func Fetch(ctx context.Context, release string, header http.Header) (*Channel, *Installer, error) {
+	return (&Client{Header: header}).Fetch(ctx, release)
+}
+
+// InstallerManifestURL returns the URL of the installer manifest referenced by
+// the channel manifest or an empty string if there is none.
+func (c *Channel) InstallerManifestURL() string {
+	for _, item := range c.ChannelItems {
+		if item.ID == InstallerManifestID && len(item.Payloads) > 0 {
+			return item.Payloads[0].URL
+		}
+	}
+	return ""
+}
@@ -0,0 +1,91 @@
+package manifest
+
+import "strings"
+
+// Package is a single package in the installer manifest.
+type Package struct {
+	ID      string `json:"id"`
+	Version string `json:"version"`
+	Type    string `json:"type"`
+	// Chip is the processor architecture the package is built for, like x64
+	// or neutral. Several packages can share an ID with different chips.
+	Chip string `json:"chip,omitempty"`
+	// MachineArch restricts the package to machines of an architecture.
+	MachineArch string    `json:"machineArch,omitempty"`
+	Payloads    []Payload `json:"payloads,omitempty"`
+	// Dependencies maps IDs of packages to either a version range or an
+	// object with conditions, see ParseDependencies.
+	Dependencies map[string]interface{}
+	InstallSizes struct {
+		TargetDrive int `json:"targetDrive"`
+	} `json:"installSizes,omitempty"`
+	LocalizedResources []LocalizedResource `json:"localizedResources,omitempty"`
+}
+
+// LocalizedResource contains the user-facing texts of a package in one
+// language.
+type LocalizedResource struct {
+	Language    string `json:"language"`
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	// License is the URL of the license the package is distributed under.
+	License string `json:"license"`
+}
+
+// Resource returns the localized resource of p in the given language
+// (like en-us), falling back to the first one if there is none in that
+// language.
+func (p *Package) Resource(language string) (LocalizedResource, bool) {
+	for _, r := range p.LocalizedResources {
+		if strings.EqualFold(r.Language, language) {
+			return r, true
+		}
+	}
+	if len(p.LocalizedResources) > 0 {
+		return p.LocalizedResources[0], true
+	}
+	return LocalizedResource{}, false
+}
+
+// Payload is a file belonging to a package.
+type Payload struct {
+	FileName string `json:"fileName"`
+	Sha256   string `json:"sha256"`
+	Size     int    `json:"size"`
+	URL      string `json:"url"`
+	Signer   struct {
+		Ref string `json:"$ref"`
+	} `json:"signer,omitempty"`
+}
+
+// Installer is the installer manifest of a Visual Studio release, listing all
+// packages available in it.
+type Installer struct {
+	ManifestVersion string `json:"manifestVersion"`
+	EngineVersion   string `json:"engineVersion"`
+	Info            struct {
+		ID                               string `json:"id"`
+		BuildBranch                      string `json:"buildBranch"`
+		BuildVersion                     string `json:"buildVersion"`
+		LocalBuild                       string `json:"localBuild"`
+		ManifestName                     string `json:"manifestName"`
+		ManifestType                     string `json:"manifestType"`
+		ProductDisplayVersion            string `json:"productDisplayVersion"`
+		ProductLine                      string `json:"productLine"`
+		ProductLineVersion               string `json:"productLineVersion"`
+		ProductMilestone                 string `json:"productMilestone"`
+		ProductMilestoneIsPreRelease     string `json:"productMilestoneIsPreRelease"`
+		ProductName                      string `json:"productName"`
+		ProductPatchVersion              string `json:"productPatchVersion"`
+		ProductPreReleaseMilestoneSuffix string `json:"productPreReleaseMilestoneSuffix"`
+		ProductSemanticVersion           string `json:"productSemanticVersion"`
+	} `json:"info"`
+	Signers []struct {
+		ID          string `json:"$id"`
+		SubjectName string `json:"subjectName"`
+	} `json:"signers"`
+	Packages []Package `json:"packages"`
+	// Deprecate maps IDs of deprecated packages to their replacement, if any.
+	Deprecate map[string]string `json:"deprecate"`
+	Signature Signature         `json:"signature"`
+}
@@ -0,0 +1,126 @@
+package manifest
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Package returns the first package with the given ID.
+func (m *Installer) Package(id string) (Package, bool) {
+	for _, pkg := range m.Packages {
+		if pkg.ID == id {
+			return pkg, true
+		}
+	}
+	return Package{}, false
+}
+
+// FindPackages returns all packages whose ID matches re.
+func (m *Installer) FindPackages(re *regexp.Regexp) []Package {
+	var pkgs []Package
+	for _, pkg := range m.Packages {
+		if re.MatchString(pkg.ID) {
+			pkgs = append(pkgs, pkg)
+		}
+	}
+	return pkgs
+}
+
+// DependencyClosure returns the packages with the given IDs as well as all
+// packages they transitively depend on, sorted by ID. All conditional
+// dependencies are followed, see DependencyClosureFor.
+func (m *Installer) DependencyClosure(ids ...string) []Package {
+	return m.DependencyClosureFor(Conditions{}, ids...)
+}
+
+// DependencyClosureFor returns the packages with the given IDs as well as
+// all packages they transitively depend on under c, sorted by ID. If
+// multiple packages share an ID, the one for the chip named by the
+// dependency or the machine's architecture is used, otherwise the first one.
+// Unknown IDs are ignored.
+func (m *Installer) DependencyClosureFor(c Conditions, ids ...string) []Package {
+	byID := make(map[string][]Package)
+	for _, pkg := range m.Packages {
+		byID[pkg.ID] = append(byID[pkg.ID], pkg)
+	}
+	seen := make(map[string]bool)
+	var closure []Package
+	var chase func(deps []Dependency)
+	chase = func(deps []Dependency) {
+		for _, dep := range deps {
+			if !c.applies(dep) {
+				continue
+			}
+			pkg, ok := c.choose(byID[dep.ID], dep.Chip)
+			if !ok {
+				continue
+			}
+			key := pkg.ID + "\x00" + strings.ToLower(pkg.Chip)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			closure = append(closure, pkg)
+			chase(pkg.ParseDependencies())
+		}
+	}
+	roots := make([]Dependency, len(ids))
+	for i, id := range ids {
+		roots[i] = Dependency{ID: id}
+	}
+	chase(roots)
+	sort.SliceStable(closure, func(i, j int) bool {
+		return closure[i].ID < closure[j].ID
+	})
+	return closure
+}
+
+// Payloads returns the payloads of all given packages.
+func Payloads(pkgs []Package) []Payload {
+	var payloads []Payload
+	for _, pkg := range pkgs {
+		payloads = append(payloads, pkg.Payloads...)
+	}
+	return payloads
+}
+
+var sdkPackageRegexp = regexp.MustCompile(`^Win.*SDK_([0-9.]+)$`)
+
+// SDKPackage returns the Windows SDK package with the given version
+// (without patch version, like 10.0.22621).
+func (m *Installer) SDKPackage(version string) (Package, bool) {
+	for _, pkg := range m.Packages {
+		res := sdkPackageRegexp.FindStringSubmatch(pkg.ID)
+		if len(res) > 0 && res[1] == version {
+			return pkg, true
+		}
+	}
+	return Package{}, false
+}
+
+// SDKVersions returns the versions of all Windows SDKs in the manifest in the
+// order they appear in.
+func (m *Installer) SDKVersions() []string {
+	var versions []string
+	seen := make(map[string]bool)
+	for _, pkg := range m.Packages {
+		res := sdkPackageRegexp.FindStringSubmatch(pkg.ID)
+		if len(res) > 0 && !seen[res[1]] {
+			seen[res[1]] = true
+			versions = append(versions, res[1])
+		}
+	}
+	return versions
+}
+
+// SignerSubject returns the subject name of the signer referenced by a
+// payload's signer reference.
+func (m *Installer) SignerSubject(ref string) (string, bool) {
+	for _, s := range m.Signers {
+		if s.ID == ref {
+			return s.SubjectName, true
+		}
+	}
+	return "", false
+}
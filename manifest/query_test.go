@@ -0,0 +1,103 @@
+package manifest
+
+import (
+	"encoding/json"
+	"reflect"
+	"regexp"
+	"testing"
+)
+
+func TestDependencyClosure(t *testing.T) {
+	m := &Installer{Packages: []Package{
+		{ID: "A", Dependencies: map[string]interface{}{"B": "1.0", "C": "1.0"}},
+		{ID: "B", Dependencies: map[string]interface{}{"C": "1.0", "Missing": "1.0"}},
+		{ID: "C", Dependencies: map[string]interface{}{"A": "1.0"}},
+		{ID: "C", Version: "duplicate"},
+		{ID: "D"},
+	}}
+	var ids []string
+	for _, pkg := range m.DependencyClosure("A") {
+		ids = append(ids, pkg.ID)
+		if pkg.Version == "duplicate" {
+			t.Errorf("got duplicate package %q, expected first one", pkg.ID)
+		}
+	}
+	if want := []string{"A", "B", "C"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("DependencyClosure() = %v, want %v", ids, want)
+	}
+}
+
+func TestDependencyClosureFor(t *testing.T) {
+	var m Installer
+	err := json.Unmarshal([]byte(`{"packages": [
+		{"id": "Root", "dependencies": {
+			"Plain": "[1.0,2.0)",
+			"Tools.X64": {"id": "Tools", "chip": "x64"},
+			"Tools.ARM64": {"id": "Tools", "chip": "arm64", "machineArch": "arm64"},
+			"ArmOnly": {"version": "[1.0,2.0)", "machineArch": "arm64"},
+			"BuildToolsOnly": {"when": ["Microsoft.VisualStudio.Product.BuildTools"]},
+			"CommunityOnly": {"when": ["Microsoft.VisualStudio.Product.Community"], "type": "Optional"}
+		}},
+		{"id": "Plain"},
+		{"id": "Tools", "chip": "x86"},
+		{"id": "Tools", "chip": "x64"},
+		{"id": "Tools", "chip": "arm64"},
+		{"id": "ArmOnly"},
+		{"id": "BuildToolsOnly"},
+		{"id": "CommunityOnly"},
+		{"id": "Host", "chip": "x64", "machineArch": "x64"},
+		{"id": "Host", "chip": "arm64", "machineArch": "arm64"}
+	]}`), &m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deps := m.Packages[0].ParseDependencies()
+	if len(deps) != 6 || deps[0].ID != "ArmOnly" || deps[0].MachineArch != "arm64" || deps[0].Version != "[1.0,2.0)" {
+		t.Errorf("unexpected dependencies %+v", deps)
+	}
+	closure := func(c Conditions, ids ...string) []string {
+		var got []string
+		for _, pkg := range m.DependencyClosureFor(c, ids...) {
+			id := pkg.ID
+			if pkg.Chip != "" {
+				id += "/" + pkg.Chip
+			}
+			got = append(got, id)
+		}
+		return got
+	}
+	buildTools := "Microsoft.VisualStudio.Product.BuildTools"
+	for _, tc := range []struct {
+		c    Conditions
+		ids  []string
+		want []string
+	}{
+		{Conditions{MachineArch: "x64", Product: buildTools}, []string{"Root"}, []string{"BuildToolsOnly", "Plain", "Root", "Tools/x64"}},
+		{Conditions{MachineArch: "arm64", Product: buildTools}, []string{"Root"}, []string{"ArmOnly", "BuildToolsOnly", "Plain", "Root", "Tools/arm64", "Tools/x64"}},
+		{Conditions{}, []string{"Root"}, []string{"ArmOnly", "BuildToolsOnly", "CommunityOnly", "Plain", "Root", "Tools/arm64", "Tools/x64"}},
+		{Conditions{MachineArch: "arm64"}, []string{"Host"}, []string{"Host/arm64"}},
+		{Conditions{}, []string{"Host"}, []string{"Host/x64"}},
+	} {
+		if got := closure(tc.c, tc.ids...); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("DependencyClosureFor(%+v, %v) = %v, want %v", tc.c, tc.ids, got, tc.want)
+		}
+	}
+}
+
+func TestSDKVersions(t *testing.T) {
+	m := &Installer{Packages: []Package{
+		{ID: "Win10SDK_10.0.19041"},
+		{ID: "Win11SDK_10.0.22621"},
+		{ID: "Win11SDK_10.0.22621"},
+		{ID: "Microsoft.VisualStudio.Component.Windows11SDK.22621"},
+	}}
+	if got, want := m.SDKVersions(), []string{"10.0.19041", "10.0.22621"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("SDKVersions() = %v, want %v", got, want)
+	}
+	if pkg, ok := m.SDKPackage("10.0.22621"); !ok || pkg.ID != "Win11SDK_10.0.22621" {
+		t.Errorf("SDKPackage() = %v, %v", pkg.ID, ok)
+	}
+	if got := m.FindPackages(regexp.MustCompile(`^Microsoft\.`)); len(got) != 1 {
+		t.Errorf("FindPackages() returned %d packages, want 1", len(got))
+	}
+}
@@ -0,0 +1,236 @@
+package manifest
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha1"
+	_ "crypto/sha256" // registers crypto.SHA256
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// Signature is the signature block of a channel or installer manifest. It
+// signs the manifest without the signature block itself.
+type Signature struct {
+	SignInfo struct {
+		SignatureMethod  string `json:"signatureMethod"`
+		DigestMethod     string `json:"digestMethod"`
+		DigestValue      string `json:"digestValue"`
+		Canonicalization string `json:"canonicalization"`
+	} `json:"signInfo"`
+	SignatureValue string `json:"signatureValue"`
+	KeyInfo        struct {
+		KeyValue struct {
+			RsaKeyValue struct {
+				Modulus  string `json:"modulus"`
+				Exponent string `json:"exponent"`
+			} `json:"rsaKeyValue"`
+		} `json:"keyValue"`
+		X509Data []string `json:"x509Data"`
+	} `json:"keyInfo"`
+	CounterSign struct {
+		X509Data               []string `json:"x509Data"`
+		Timestamp              string   `json:"timestamp"`
+		CounterSignatureMethod string   `json:"counterSignatureMethod"`
+		CounterSignature       string   `json:"counterSignature"`
+	} `json:"counterSign"`
+}
+
+// ErrUnsigned is returned by VerifySignature for manifests without a
+// signature block.
+var ErrUnsigned = errors.New("manifest is not signed")
+
+// microsoftRoots are the SHA-1 thumbprints of the Microsoft root
+// certificates manifests are signed under. They are trusted if the
+// signature carries them and no explicit roots are configured.
+var microsoftRoots = map[string]bool{
+	"8f43288ad272f3103b6fb1428485ea3014c0bcfe": true, // Microsoft Root Certificate Authority 2011
+	"3b1efd3a66ea28b16697394703a72ca340a05bd5": true, // Microsoft Root Certificate Authority 2010
+}
+
+// VerifyOptions configure manifest signature verification.
+type VerifyOptions struct {
+	// Roots are the trusted root certificates. If nil, only the well-known
+	// Microsoft roots are trusted, which must then be part of the
+	// certificates in the signature.
+	Roots *x509.CertPool
+	// CurrentTime is the time the certificate chain is checked at. If zero,
+	// the current time is used. The counter-signature timestamp isn't, as
+	// the counter-signature is not verified and anyone modifying the
+	// manifest could backdate it. Manifests signed with certificates which
+	// have expired since, like those of Visual Studio 15, therefore fail
+	// verification.
+	CurrentTime time.Time
+	// Check, if set, is run on the verified certificate chain (leaf first),
+	// for example to enforce key pins or check for revocation.
+	Check func(chain []*x509.Certificate) error
+}
+
+// canonicalize returns the signed content of a raw manifest, which is the
+// compact JSON encoding of the top-level object without its signature
+// member, preserving the order of all other members.
+func canonicalize(raw []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	if t, err := dec.Token(); err != nil || t != json.Delim('{') {
+		return nil, fmt.Errorf("manifest is not a JSON object")
+	}
+	var out bytes.Buffer
+	out.WriteByte('{')
+	first := true
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		key, ok := t.(string)
+		if !ok {
+			return nil, fmt.Errorf("unexpected token %v in manifest", t)
+		}
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return nil, err
+		}
+		if key == "signature" {
+			continue
+		}
+		if !first {
+			out.WriteByte(',')
+		}
+		first = false
+		keyRaw, _ := json.Marshal(key)
+		out.Write(keyRaw)
+		out.WriteByte(':')
+		if err := json.Compact(&out, value); err != nil {
+			return nil, err
+		}
+	}
+	out.WriteByte('}')
+	return out.Bytes(), nil
+}
+
+func hashForMethod(method string) (crypto.Hash, error) {
+	switch {
+	case strings.HasSuffix(method, "sha256"):
+		return crypto.SHA256, nil
+	case strings.HasSuffix(method, "sha1"):
+		return crypto.SHA1, nil
+	}
+	return 0, fmt.Errorf("unsupported signature method %q", method)
+}
+
+func parseCertificates(encoded []string) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for _, e := range encoded {
+		der, err := base64.StdEncoding.DecodeString(e)
+		if err != nil {
+			return nil, fmt.Errorf("invalid certificate encoding: %w", err)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, fmt.Errorf("invalid certificate: %w", err)
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
+
+// VerifySignature verifies the signature block of the raw channel or
+// installer manifest: the RSA signature over the canonicalized content must
+// be made by the first certificate in the block, which must chain up to a
+// trusted root. It returns the verified signing certificate.
+func VerifySignature(raw []byte, opts VerifyOptions) (*x509.Certificate, error) {
+	var envelope struct {
+		Signature *Signature `json:"signature"`
+	}
+	if err := json.Unmarshal(raw, &envelope); err != nil {
+		return nil, err
+	}
+	sig := envelope.Signature
+	if sig == nil || sig.SignatureValue == "" {
+		return nil, ErrUnsigned
+	}
+	content, err := canonicalize(raw)
+	if err != nil {
+		return nil, err
+	}
+	hash, err := hashForMethod(sig.SignInfo.SignatureMethod)
+	if err != nil {
+		return nil, err
+	}
+	h := hash.New()
+	h.Write(content)
+	digest := h.Sum(nil)
+	if sig.SignInfo.DigestValue != "" && sig.SignInfo.DigestValue != base64.StdEncoding.EncodeToString(digest) {
+		return nil, fmt.Errorf("manifest digest mismatch")
+	}
+	sigValue, err := base64.StdEncoding.DecodeString(sig.SignatureValue)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature encoding: %w", err)
+	}
+
+	certs, err := parseCertificates(sig.KeyInfo.X509Data)
+	if err != nil {
+		return nil, err
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("signature contains no certificates")
+	}
+	leaf := certs[0]
+	pub, ok := leaf.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("signing certificate has no RSA key")
+	}
+	if kv := sig.KeyInfo.KeyValue.RsaKeyValue; kv.Modulus != "" {
+		modulus, err := base64.StdEncoding.DecodeString(kv.Modulus)
+		if err != nil || new(big.Int).SetBytes(modulus).Cmp(pub.N) != 0 {
+			return nil, fmt.Errorf("key value doesn't match signing certificate")
+		}
+	}
+	if err := rsa.VerifyPKCS1v15(pub, hash, digest, sigValue); err != nil {
+		return nil, fmt.Errorf("invalid signature: %w", err)
+	}
+
+	roots := opts.Roots
+	if roots == nil {
+		roots = x509.NewCertPool()
+		for _, c := range certs[1:] {
+			thumbprint := sha1.Sum(c.Raw)
+			if microsoftRoots[hex.EncodeToString(thumbprint[:])] {
+				roots.AddCert(c)
+			}
+		}
+	}
+	intermediates := x509.NewCertPool()
+	for _, c := range certs[1:] {
+		intermediates.AddCert(c)
+	}
+	chains, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   opts.CurrentTime,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("untrusted signing certificate %q: %w", leaf.Subject.CommonName, err)
+	}
+	if opts.Check != nil {
+		var checkErr error
+		for _, chain := range chains {
+			if checkErr = opts.Check(chain); checkErr == nil {
+				break
+			}
+		}
+		if checkErr != nil {
+			return nil, fmt.Errorf("signing certificate %q rejected: %w", leaf.Subject.CommonName, checkErr)
+		}
+	}
+	return leaf, nil
+}
@@ -0,0 +1,125 @@
+package manifest
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testCert(t *testing.T, cn string, parent *x509.Certificate, parentKey *rsa.PrivateKey) (*x509.Certificate, *rsa.PrivateKey) {
+	t.Helper()
+	return testCertValid(t, cn, parent, parentKey, time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+}
+
+func testCertValid(t *testing.T, cn string, parent *x509.Certificate, parentKey *rsa.PrivateKey, notBefore, notAfter time.Time) (*x509.Certificate, *rsa.PrivateKey) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		BasicConstraintsValid: true,
+		IsCA:                  parent == nil,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	}
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func signManifest(t *testing.T, content string, leaf *x509.Certificate, key *rsa.PrivateKey) []byte {
+	t.Helper()
+	canonical, err := canonicalize([]byte(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256(canonical)
+	sigValue, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sig Signature
+	sig.SignInfo.SignatureMethod = "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"
+	sig.SignInfo.DigestValue = base64.StdEncoding.EncodeToString(digest[:])
+	sig.SignatureValue = base64.StdEncoding.EncodeToString(sigValue)
+	sig.KeyInfo.X509Data = []string{base64.StdEncoding.EncodeToString(leaf.Raw)}
+	sigRaw, err := json.Marshal(sig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return []byte(strings.TrimSuffix(content, "}") + `,"signature":` + string(sigRaw) + "}")
+}
+
+func TestVerifySignature(t *testing.T) {
+	root, rootKey := testCert(t, "Test Root", nil, nil)
+	leaf, leafKey := testCert(t, "Test Signer", root, rootKey)
+	roots := x509.NewCertPool()
+	roots.AddCert(root)
+
+	content := "{\n  \"manifestVersion\": \"1.1\",\n  \"packages\": [ {\"id\": \"A\"} ]\n}"
+	signed := signManifest(t, content, leaf, leafKey)
+	cert, err := VerifySignature(signed, VerifyOptions{Roots: roots})
+	if err != nil {
+		t.Fatalf("VerifySignature: %v", err)
+	}
+	if cert.Subject.CommonName != "Test Signer" {
+		t.Errorf("got signer %q", cert.Subject.CommonName)
+	}
+
+	tampered := []byte(strings.Replace(string(signed), `"A"`, `"B"`, 1))
+	if _, err := VerifySignature(tampered, VerifyOptions{Roots: roots}); err == nil {
+		t.Error("tampered manifest verified successfully")
+	}
+	if _, err := VerifySignature(signed, VerifyOptions{}); err == nil {
+		t.Error("manifest signed by untrusted root verified successfully")
+	}
+	if _, err := VerifySignature([]byte(content), VerifyOptions{Roots: roots}); !errors.Is(err, ErrUnsigned) {
+		t.Errorf("unsigned manifest: got %v, want ErrUnsigned", err)
+	}
+}
+
+func TestVerifySignatureIgnoresTimestamp(t *testing.T) {
+	expired := time.Now().Add(-24 * time.Hour)
+	root, rootKey := testCertValid(t, "Test Root", nil, nil, expired.Add(-time.Hour), time.Now().Add(time.Hour))
+	leaf, leafKey := testCertValid(t, "Expired Signer", root, rootKey, expired.Add(-time.Hour), expired)
+	roots := x509.NewCertPool()
+	roots.AddCert(root)
+
+	signed := signManifest(t, `{"manifestVersion":"1.1"}`, leaf, leafKey)
+	// The unverified counter-signature claims the manifest was signed while
+	// the certificate was still valid.
+	forged := strings.Replace(string(signed), `"timestamp":""`, `"timestamp":"`+expired.Add(-time.Minute).Format(time.RFC3339)+`"`, 1)
+	if forged == string(signed) {
+		t.Fatal("failed to add timestamp")
+	}
+	if _, err := VerifySignature([]byte(forged), VerifyOptions{Roots: roots}); err == nil {
+		t.Error("manifest signed with an expired certificate verified successfully")
+	}
+	if _, err := VerifySignature([]byte(forged), VerifyOptions{Roots: roots, CurrentTime: expired.Add(-time.Minute)}); err != nil {
+		t.Errorf("VerifySignature at an explicit time: %v", err)
+	}
+}
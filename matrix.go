@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"git.dolansoft.org/lorenz/winsysroot/versions"
+)
+
+func init() {
+	subcommands = append(subcommands, &subcommand{
+		name:  "sdk-matrix",
+		short: "Print which Windows SDK versions are available in which Visual Studio releases",
+		setup: setupSDKMatrix,
+	})
+}
+
+func setupSDKMatrix(fs *flag.FlagSet) func(ctx context.Context) error {
+	vsReleases := fs.String("vs-releases", "", "Comma-separated list of Visual Studio major releases to query (default: 15,16,17, or 16,17 with signed manifests)")
+	registerHTTPFlags(fs)
+	registerTrustFlags(fs)
+	return func(ctx context.Context) error {
+		releases := *vsReleases
+		if releases == "" {
+			releases = "15,16,17"
+			if requireSignedManifests || len(signingPins) > 0 {
+				// The manifests of Visual Studio 15 are signed with
+				// certificates which have expired since, so their
+				// signatures don't verify anymore.
+				releases = "16,17"
+			}
+		}
+		return runSDKMatrix(ctx, strings.Split(releases, ","))
+	}
+}
+
+func runSDKMatrix(ctx context.Context, releases []string) error {
+
+	available := make(map[string]map[string]bool)
+	for _, release := range releases {
+		_, manifest, err := fetchManifests(ctx, release)
+		if err != nil {
+			return fmt.Errorf("Visual Studio %v: %w", release, err)
+		}
+		for _, v := range manifest.SDKVersions() {
+			if available[v] == nil {
+				available[v] = make(map[string]bool)
+			}
+			available[v][release] = true
+		}
+	}
+	var sdkVersions []string
+	for v := range available {
+		sdkVersions = append(sdkVersions, v)
+	}
+	versions.Sort(sdkVersions)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprint(w, "SDK")
+	for _, release := range releases {
+		fmt.Fprintf(w, "\tVS %v", release)
+	}
+	fmt.Fprintln(w)
+	for _, v := range sdkVersions {
+		fmt.Fprint(w, v)
+		for _, release := range releases {
+			if available[v][release] {
+				fmt.Fprint(w, "\tyes")
+			} else {
+				fmt.Fprint(w, "\t-")
+			}
+		}
+		fmt.Fprintln(w)
+	}
+	return w.Flush()
+}
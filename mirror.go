@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"git.dolansoft.org/lorenz/winsysroot/manifest"
+	"git.dolansoft.org/lorenz/winsysroot/sysroot"
+	"git.dolansoft.org/lorenz/winsysroot/target"
+)
+
+func init() {
+	subcommands = append(subcommands, &subcommand{
+		name:  "mirror",
+		short: "Download manifests and payloads into a directory (sync) and serve it for --download-mirror (serve)",
+		setup: setupMirror,
+	})
+}
+
+// stringsFlag collects the values of a repeated flag.
+type stringsFlag []string
+
+func (s *stringsFlag) String() string {
+	return strings.Join(*s, ", ")
+}
+
+func (s *stringsFlag) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+func setupMirror(fs *flag.FlagSet) func(ctx context.Context) error {
+	vsReleases := fs.String("vs-releases", *flagVSRelease, "sync: Comma-separated list of Visual Studio major releases to mirror")
+	var sdkVersions stringsFlag
+	fs.Var(&sdkVersions, "win-sdk-version", "sync: "+flag.Lookup("win-sdk-version").Usage+", can be repeated (default "+*flagWinSDKVersion+")")
+	archs := fs.String("architectures", *flagArchitectures, "sync: "+flag.Lookup("architectures").Usage)
+	fs.StringVar(flagHostArch, "host-arch", *flagHostArch, "sync: "+flag.Lookup("host-arch").Usage)
+	fs.StringVar(flagMSVCToolsets, "msvc-toolsets", *flagMSVCToolsets, "sync: "+flag.Lookup("msvc-toolsets").Usage)
+	nearest := fs.Bool("nearest", false, "sync: "+flag.Lookup("nearest").Usage)
+	downloads := fs.Int("downloads", sysroot.DefaultDownloads, "sync: "+flag.Lookup("downloads").Usage)
+	listen := fs.String("listen", "localhost:8080", "serve: Address to listen on")
+	registerHTTPFlags(fs)
+	registerTrustFlags(fs)
+	return func(ctx context.Context) error {
+		usage := stageErrorf(stageUsage, "", "", "usage: winsysroot mirror sync|serve [flags] <mirror-dir>")
+		if fs.NArg() == 0 {
+			return usage
+		}
+		verb := fs.Arg(0)
+		// Flags following the verb are only parsed now.
+		if err := fs.Parse(fs.Args()[1:]); err != nil {
+			return stageErrorf(stageUsage, "", "", "%w", err)
+		}
+		if fs.NArg() != 1 {
+			return usage
+		}
+		switch verb {
+		case "sync":
+			if len(sdkVersions) == 0 {
+				sdkVersions = stringsFlag{*flagWinSDKVersion}
+			}
+			return runMirrorSync(ctx, fs.Arg(0), strings.Split(*vsReleases, ","), sdkVersions, strings.Split(*archs, ","), *nearest, *downloads)
+		case "serve":
+			return runMirrorServe(ctx, fs.Arg(0), *listen)
+		}
+		return usage
+	}
+}
+
+// runMirrorSync downloads the manifests of the given releases and the
+// payloads of the selected Windows SDK versions and MSVC packages into dir.
+// Payloads already present with the expected size are kept.
+func runMirrorSync(ctx context.Context, dir string, releases, sdkVersions, architectures []string, nearest bool, downloads int) error {
+	hc, err := httpClient()
+	if err != nil {
+		return stageErrorf(stageUsage, "", "", "%w", err)
+	}
+	payloads := make(map[string]manifest.Payload)
+	for _, release := range releases {
+		installer, err := mirrorManifests(ctx, hc, dir, release)
+		if err != nil {
+			return err
+		}
+		for _, v := range sdkVersions {
+			sdkVersion, err := sysroot.ResolveSDKVersion(installer, v, nearest)
+			if err != nil {
+				return fmt.Errorf("Visual Studio %v: %w", release, err)
+			}
+			pkgs, err := sysroot.Packages(sysroot.Options{
+				Manifest:      installer,
+				WinSDKVersion: sdkVersion,
+				Architectures: architectures,
+				HostArch:      *flagHostArch,
+				Toolsets:      strings.Split(*flagMSVCToolsets, ","),
+			})
+			if err != nil {
+				return fmt.Errorf("Visual Studio %v: %w", release, err)
+			}
+			log.Printf("Mirroring Windows SDK %v of Visual Studio %v", sdkVersion, release)
+			for _, pkg := range pkgs {
+				for _, p := range pkg.Payloads {
+					payloads[p.URL] = p
+				}
+			}
+		}
+	}
+
+	var missing []manifest.Payload
+	var missingSize int64
+	for _, p := range payloads {
+		dest, err := mirrorFile(dir, p.URL)
+		if err != nil {
+			return stageErrorf(stageDownload, "", p.URL, "%w", err)
+		}
+		if fi, err := os.Stat(dest); err == nil && fi.Size() == int64(p.Size) {
+			continue
+		}
+		missing = append(missing, p)
+		missingSize += int64(p.Size)
+	}
+	sort.Slice(missing, func(i, j int) bool { return missing[i].URL < missing[j].URL })
+	log.Printf("%d of %d payloads are up to date, downloading %d (%.1f MiB)", len(payloads)-len(missing), len(payloads), len(missing), float64(missingSize)/(1<<20))
+
+	if downloads < 1 {
+		downloads = 1
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	queue := make(chan manifest.Payload)
+	errs := make(chan error, downloads)
+	var wg sync.WaitGroup
+	for i := 0; i < downloads; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range queue {
+				if err := mirrorPayload(ctx, hc, dir, p); err != nil {
+					errs <- err
+					cancel()
+					return
+				}
+			}
+		}()
+	}
+feed:
+	for _, p := range missing {
+		select {
+		case queue <- p:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(queue)
+	wg.Wait()
+	close(errs)
+	if err := <-errs; err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	log.Printf("Mirror in %v is up to date, serve it with: winsysroot mirror serve %v", dir, dir)
+	return nil
+}
+
+// mirrorManifests stores the channel and installer manifests of release in
+// dir and returns the installer manifest. They are always downloaded again
+// as they change with every Visual Studio update.
+func mirrorManifests(ctx context.Context, hc *http.Client, dir, release string) (*manifest.Installer, error) {
+	verify, err := manifestVerifyOptions()
+	if err != nil {
+		return nil, stageErrorf(stageUsage, "", "", "%w", err)
+	}
+	fetch := func(rawURL string, v interface{}) error {
+		dest, err := mirrorFile(dir, rawURL)
+		if err != nil {
+			return stageErrorf(stageManifest, "", rawURL, "%w", err)
+		}
+		// The body is stored at the path of the requested URL even if it
+		// was redirected, so the mirror needs no redirects.
+		if _, err := downloadFile(ctx, hc, rawURL, dest); err != nil {
+			return stageErrorf(stageManifest, "", rawURL, "%w", err)
+		}
+		raw, err := ioutil.ReadFile(dest)
+		if err != nil {
+			return stageErrorf(stageManifest, "", rawURL, "%w", err)
+		}
+		if verify != nil {
+			if _, err := manifest.VerifySignature(raw, *verify); err != nil {
+				return stageErrorf(stageManifest, "", rawURL, "signature verification failed: %w", err)
+			}
+		}
+		if err := json.Unmarshal(raw, v); err != nil {
+			return stageErrorf(stageManifest, "", rawURL, "%w", err)
+		}
+		return nil
+	}
+	var channel manifest.Channel
+	if err := fetch(manifest.ChannelURL(release), &channel); err != nil {
+		return nil, err
+	}
+	installerURL := channel.InstallerManifestURL()
+	if installerURL == "" {
+		return nil, stageErrorf(stageManifest, "", manifest.ChannelURL(release), "could not find installer manifest in channel manifest")
+	}
+	var installer manifest.Installer
+	if err := fetch(installerURL, &installer); err != nil {
+		return nil, err
+	}
+	return &installer, nil
+}
+
+// mirrorPayload downloads p into dir and checks its hash.
+func mirrorPayload(ctx context.Context, hc *http.Client, dir string, p manifest.Payload) error {
+	dest, err := mirrorFile(dir, p.URL)
+	if err != nil {
+		return stageErrorf(stageDownload, "", p.URL, "%w", err)
+	}
+	sum, err := downloadFile(ctx, hc, p.URL, dest)
+	if err != nil {
+		return stageErrorf(stageDownload, "", p.URL, "%w", err)
+	}
+	if !strings.EqualFold(hex.EncodeToString(sum), p.Sha256) {
+		os.Remove(dest)
+		return stageErrorf(stageDownload, "", p.URL, "checksum mismatch: got %x, manifest has %v", sum, p.Sha256)
+	}
+	log.Printf("Downloaded %v", p.FileName)
+	return nil
+}
+
+// mirrorFile returns the local path of rawURL in the mirror directory dir.
+func mirrorFile(dir, rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	p, err := target.CleanPath(mirrorPath(u))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, filepath.FromSlash(p)), nil
+}
+
+// runMirrorServe serves the mirror in dir, the paths of files below it
+// match the URLs --download-mirror requests.
+func runMirrorServe(ctx context.Context, dir, listen string) error {
+	if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+		return stageErrorf(stageUsage, "", "", "%v is not a mirror directory", dir)
+	}
+	return runServe(ctx, listen, http.FileServer(http.Dir(dir)), "Serving mirror on http://%v, use it with --download-mirror=http://%[1]v")
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"git.dolansoft.org/lorenz/winsysroot/fuse"
+	"git.dolansoft.org/lorenz/winsysroot/sysroot"
+)
+
+func init() {
+	subcommands = append(subcommands, &subcommand{
+		name:  "mount",
+		short: "Mount a sysroot whose files are downloaded on first access (Linux only)",
+		setup: setupMount,
+	})
+}
+
+// lazyFlags are the flags selecting a sysroot which is generated on demand.
+type lazyFlags struct {
+	vsRelease, winSDKVersion, archs *string
+	hostArch, toolsets              *string
+	slim, nearest, strict           *bool
+	lazyDir                         *string
+}
+
+func registerLazyFlags(fs *flag.FlagSet) *lazyFlags {
+	lf := &lazyFlags{
+		vsRelease:     fs.String("vs-release", *flagVSRelease, flag.Lookup("vs-release").Usage),
+		winSDKVersion: fs.String("win-sdk-version", *flagWinSDKVersion, flag.Lookup("win-sdk-version").Usage),
+		archs:         fs.String("architectures", *flagArchitectures, flag.Lookup("architectures").Usage),
+		hostArch:      fs.String("host-arch", *flagHostArch, flag.Lookup("host-arch").Usage),
+		toolsets:      fs.String("msvc-toolsets", *flagMSVCToolsets, flag.Lookup("msvc-toolsets").Usage),
+		slim:          fs.Bool("slim", *flagSlim, flag.Lookup("slim").Usage),
+		nearest:       fs.Bool("nearest", false, flag.Lookup("nearest").Usage),
+		strict:        fs.Bool("strict", false, flag.Lookup("strict").Usage),
+		lazyDir:       fs.String("lazy-dir", "", "Directory extracted payloads are kept in (default: lazy below --cache-dir, otherwise a temporary directory)"),
+	}
+	fs.BoolVar(flagProgress, "progress", false, flag.Lookup("progress").Usage)
+	fs.StringVar(flagCacheDir, "cache-dir", "", flag.Lookup("cache-dir").Usage)
+	fs.BoolVar(flagAcceptLicenses, "accept-licenses", false, flag.Lookup("accept-licenses").Usage)
+	registerHTTPFlags(fs)
+	registerTrustFlags(fs)
+	registerLimitFlags(fs)
+	return lf
+}
+
+// open lists the files of the selected sysroot. The returned function
+// removes the extracted files if they were put into a temporary directory.
+func (lf *lazyFlags) open(ctx context.Context) (*sysroot.Lazy, func(), error) {
+	_, manifest, err := fetchManifests(ctx, *lf.vsRelease)
+	if err != nil {
+		return nil, nil, err
+	}
+	sdkVersion, err := sysroot.ResolveSDKVersion(manifest, *lf.winSDKVersion, *lf.nearest)
+	if err != nil {
+		return nil, nil, err
+	}
+	if sdkVersion != *lf.winSDKVersion {
+		log.Printf("Using Windows SDK %v for requested version %v", sdkVersion, *lf.winSDKVersion)
+	}
+	acRoots, err := authenticodeRoots()
+	if err != nil {
+		return nil, nil, stageErrorf(stageUsage, "", "", "%w", err)
+	}
+	hc, err := httpClient()
+	if err != nil {
+		return nil, nil, stageErrorf(stageUsage, "", "", "%w", err)
+	}
+	dir, cleanup := *lf.lazyDir, func() {}
+	switch {
+	case dir != "":
+	case *flagCacheDir != "":
+		dir = filepath.Join(*flagCacheDir, "lazy")
+	default:
+		dir, err = ioutil.TempDir("", "winsysroot-lazy")
+		if err != nil {
+			return nil, nil, stageErrorf(stageOutput, "", "", "%w", err)
+		}
+		cleanup = func() { os.RemoveAll(dir) }
+	}
+	lazy, err := sysroot.NewLazy(ctx, sysroot.Options{
+		Manifest:                 manifest,
+		WinSDKVersion:            sdkVersion,
+		Architectures:            strings.Split(*lf.archs, ","),
+		HostArch:                 *lf.hostArch,
+		Toolsets:                 strings.Split(*lf.toolsets, ","),
+		Slim:                     *lf.slim,
+		Strict:                   *lf.strict,
+		HTTPClient:               hc,
+		Header:                   httpHeader(),
+		RequestTimeout:           httpRequestTimeout,
+		Events:                   buildEvents(),
+		CacheDir:                 *flagCacheDir,
+		AcceptLicenses:           *flagAcceptLicenses,
+		Limits:                   &limits,
+		OnChecksumMismatch:       onChecksumMismatch,
+		RequireSigner:            requireSigner,
+		Authenticode:             verifyAuthenticode,
+		AuthenticodeRoots:        acRoots,
+		AuthenticodeIdentityOnly: authenticodeIdentity,
+	}, dir)
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	return lazy, cleanup, nil
+}
+
+func setupMount(fs *flag.FlagSet) func(ctx context.Context) error {
+	lf := registerLazyFlags(fs)
+	allowOther := fs.Bool("allow-other", false, "Let other users access the mounted sysroot")
+	return func(ctx context.Context) error {
+		if fs.NArg() != 1 {
+			return stageErrorf(stageUsage, "", "", "usage: winsysroot mount [flags] <mountpoint>")
+		}
+		return runMount(ctx, lf, fs.Arg(0), *allowOther)
+	}
+}
+
+func runMount(ctx context.Context, lf *lazyFlags, mountpoint string, allowOther bool) error {
+	lazy, cleanup, err := lf.open(ctx)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	root := newMountTree(ctx, lazy)
+	srv, err := fuse.Mount(mountpoint, root, fuse.Options{
+		Name:       "winsysroot",
+		AllowOther: allowOther,
+		ErrorLog:   func(err error) { log.Printf("Serving mounted sysroot: %v", err) },
+	})
+	if errors.Is(err, fuse.ErrNotSupported) {
+		return stageErrorf(stageUsage, "", "", "%w", err)
+	} else if err != nil {
+		return stageErrorf(stageOutput, "", "", "failed to mount sysroot at %v: %w", mountpoint, err)
+	}
+	log.Printf("Mounted sysroot with %d files at %v, interrupt to unmount", len(lazy.Files()), mountpoint)
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve() }()
+	select {
+	case err = <-served:
+	case <-ctx.Done():
+		if err := srv.Unmount(); err != nil {
+			return stageErrorf(stageOutput, "", "", "failed to unmount %v: %w", mountpoint, err)
+		}
+		err = <-served
+	}
+	if err != nil {
+		return stageErrorf(stageOutput, "", "", "serving mounted sysroot failed: %w", err)
+	}
+	return nil
+}
+
+// mountDir is a directory of a mounted sysroot. Lookups fall back to
+// ignoring case, like the VFS overlay does for clang.
+type mountDir struct {
+	modTime time.Time
+	names   []string
+	entries map[string]fuse.Node
+	folded  map[string]fuse.Node
+}
+
+func (d *mountDir) Attr() fuse.Attr {
+	return fuse.Attr{Mode: os.ModeDir | 0555, ModTime: d.modTime}
+}
+
+func (d *mountDir) Lookup(name string) (fuse.Node, bool) {
+	if n, ok := d.entries[name]; ok {
+		return n, true
+	}
+	n, ok := d.folded[strings.ToLower(name)]
+	return n, ok
+}
+
+func (d *mountDir) Entries() []string {
+	return d.names
+}
+
+// mountFile is a file of a mounted sysroot.
+type mountFile struct {
+	ctx  context.Context
+	lazy *sysroot.Lazy
+	f    *sysroot.LazyFile
+}
+
+func (f *mountFile) Attr() fuse.Attr {
+	return fuse.Attr{Mode: 0444, Size: f.f.Size, ModTime: f.f.ModTime}
+}
+
+func (f *mountFile) Open() (fuse.Handle, error) {
+	return f.lazy.Open(f.ctx, f.f)
+}
+
+// newMountTree builds the directory tree of lazy.
+func newMountTree(ctx context.Context, lazy *sysroot.Lazy) *mountDir {
+	dirs := map[string]*mountDir{".": newMountDir()}
+	var dirFor func(p string) *mountDir
+	dirFor = func(p string) *mountDir {
+		if d, ok := dirs[p]; ok {
+			return d
+		}
+		d := newMountDir()
+		dirs[p] = d
+		dirFor(path.Dir(p)).add(path.Base(p), d)
+		return d
+	}
+	for _, f := range lazy.Files() {
+		dirFor(path.Dir(f.Path)).add(path.Base(f.Path), &mountFile{ctx: ctx, lazy: lazy, f: f})
+	}
+	for _, f := range lazy.Files() {
+		// Directories get the time of their newest file
+		for p := path.Dir(f.Path); ; p = path.Dir(p) {
+			if d := dirs[p]; f.ModTime.After(d.modTime) {
+				d.modTime = f.ModTime
+			}
+			if p == "." {
+				break
+			}
+		}
+	}
+	for _, d := range dirs {
+		sort.Strings(d.names)
+	}
+	return dirs["."]
+}
+
+func newMountDir() *mountDir {
+	return &mountDir{entries: make(map[string]fuse.Node), folded: make(map[string]fuse.Node)}
+}
+
+func (d *mountDir) add(name string, n fuse.Node) {
+	d.names = append(d.names, name)
+	d.entries[name] = n
+	if _, ok := d.folded[strings.ToLower(name)]; !ok {
+		d.folded[strings.ToLower(name)] = n
+	}
+}
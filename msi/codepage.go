@@ -0,0 +1,60 @@
+package msi
+
+import (
+	"encoding/binary"
+	"strings"
+	"unicode/utf8"
+)
+
+// Code pages handled by DecodeString
+const (
+	CodepageNeutral     = 0
+	CodepageWindows1252 = 1252
+	CodepageUTF8        = 65001
+)
+
+// cp1252 contains the characters 0x80 to 0x9f of Windows code page 1252,
+// which differ from ISO 8859-1. Undefined positions map to the C1 control
+// characters like Windows does.
+const cp1252 = "€\u0081‚ƒ„…†‡ˆ‰Š‹Œ\u008dŽ\u008f" +
+	"\u0090‘’“”•–—˜™š›œ\u009džŸ"
+
+var cp1252Runes = []rune(cp1252)
+
+// DecodeString converts a string of an MSI database in the given code page
+// to UTF-8. It handles UTF-8 and Windows-1252, which is also used for the
+// neutral code page. Strings in other code pages are kept if they are valid
+// UTF-8, otherwise invalid bytes are replaced with U+FFFD. Use
+// Options.DecodeString to support more code pages.
+func DecodeString(codepage int, s []byte) string {
+	switch codepage {
+	case CodepageNeutral, CodepageWindows1252:
+		var b strings.Builder
+		for _, c := range s {
+			switch {
+			case c < 0x80:
+				b.WriteByte(c)
+			case c < 0xa0:
+				b.WriteRune(cp1252Runes[c-0x80])
+			default:
+				b.WriteRune(rune(c))
+			}
+		}
+		return b.String()
+	case CodepageUTF8:
+	default:
+		if utf8.Valid(s) {
+			return string(s)
+		}
+	}
+	return strings.ToValidUTF8(string(s), "�")
+}
+
+// stringPoolCodepage returns the code page of the strings from the string
+// pool header, whose high bit is the flag for long string references.
+func stringPoolCodepage(stringPool []byte) int {
+	if len(stringPool) < 4 {
+		return CodepageNeutral
+	}
+	return int(binary.LittleEndian.Uint32(stringPool) &^ longStringRefs)
+}
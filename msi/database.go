@@ -0,0 +1,151 @@
+package msi
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/richardlehane/mscfb"
+)
+
+// Database is an MSI database, giving access to all of its tables.
+type Database struct {
+	codepage int
+	strings  []string
+	// Width of string references in bytes
+	refSize int
+	schema  map[string][]Column
+	// Streams of tables keyed by the table name, only read when the table
+	// is decoded
+	streams map[string]*io.SectionReader
+	// Streams not belonging to tables, like embedded cabinets
+	others map[string]*mscfb.File
+	// Names of the storages nested in the database, like the transforms of
+	// a patch
+	storages []string
+	decode   func(codepage int, s []byte) string
+}
+
+// Options configure how an MSI database is read.
+type Options struct {
+	// DecodeString converts strings from the code page of the database,
+	// given in its string pool, to UTF-8. It defaults to DecodeString.
+	DecodeString func(codepage int, s []byte) string
+}
+
+// Open reads the MSI database in r. Streams not belonging to tables are
+// read from r when they are accessed, so it must stay usable as long as
+// the Database is.
+func Open(r io.ReaderAt) (*Database, error) {
+	return OpenWithOptions(r, Options{})
+}
+
+// OpenWithOptions reads the MSI database in r like Open with the given
+// options.
+func OpenWithOptions(r io.ReaderAt, opts Options) (*Database, error) {
+	doc, err := mscfb.New(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse MS-CFB header (not an MSI file?): %w", err)
+	}
+	db := &Database{streams: make(map[string]*io.SectionReader), others: make(map[string]*mscfb.File)}
+	// System tables needed to decode the others, which are only read on
+	// demand
+	system := make(map[string][]byte)
+	for entry, err := doc.Next(); err == nil; entry, err = doc.Next() {
+		if len(entry.Path) != 0 {
+			// Part of a nested storage
+			continue
+		}
+		name := decodeName(entry.Name)
+		if entry.FileInfo().IsDir() {
+			db.storages = append(db.storages, name)
+			continue
+		}
+		if !strings.HasPrefix(name, "!") {
+			db.others[name] = entry
+			continue
+		}
+		name = strings.TrimPrefix(name, "!")
+		switch name {
+		case "_StringPool", "_StringData", "_Tables", "_Columns":
+			data, err := io.ReadAll(entry)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read stream %v: %w", name, err)
+			}
+			system[name] = data
+		default:
+			db.streams[name] = io.NewSectionReader(entry, 0, entry.Size)
+		}
+	}
+	db.codepage = stringPoolCodepage(system["_StringPool"])
+	if db.strings, err = decodeStrings(system["_StringData"], system["_StringPool"]); err != nil {
+		return nil, fmt.Errorf("failed to read string pool: %w", err)
+	}
+	db.decode = opts.DecodeString
+	if db.decode == nil {
+		db.decode = DecodeString
+	}
+	for i, s := range db.strings {
+		// All supported code pages are ASCII-compatible.
+		if !isASCII(s) {
+			db.strings[i] = db.decode(db.codepage, []byte(s))
+		}
+	}
+	db.refSize = stringRefSize(system["_StringPool"])
+	if db.schema, err = readSchema(system, db.strings, db.refSize); err != nil {
+		return nil, fmt.Errorf("failed to read table schema: %w", err)
+	}
+	return db, nil
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+// Codepage returns the code page the strings of the database were stored
+// in.
+func (db *Database) Codepage() int {
+	return db.codepage
+}
+
+// Tables returns the names of all tables in the database, sorted by name.
+func (db *Database) Tables() []string {
+	var names []string
+	for name := range db.schema {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Table decodes the table with the given name.
+func (db *Database) Table(name string) (*Table, error) {
+	cols, ok := db.schema[name]
+	if !ok {
+		return nil, fmt.Errorf("no table named %v", name)
+	}
+	// Tables without rows have no stream and decode to an empty table.
+	var data []byte
+	if stream, ok := db.streams[name]; ok {
+		data = make([]byte, stream.Size())
+		if _, err := stream.ReadAt(data, 0); err != nil {
+			return nil, fmt.Errorf("failed to read stream of table %v: %w", name, err)
+		}
+	}
+	return decodeTable(name, cols, data, db.strings, db.refSize)
+}
+
+// scan decodes the table with the given name into target, see Table.Scan.
+func (db *Database) scan(name string, target interface{}) error {
+	t, err := db.Table(name)
+	if err != nil {
+		return err
+	}
+	return t.Scan(target)
+}
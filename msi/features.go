@@ -0,0 +1,71 @@
+package msi
+
+// Feature is a part of the product which can be selected for installation.
+type Feature struct {
+	Feature       string
+	FeatureParent string `msi:"Feature_Parent"`
+	Title         string
+	Description   string
+	Display       int32
+	Level         int32
+	Directory     string `msi:"Directory_"`
+	Attributes    uint16
+}
+
+// FeatureComponents maps features to the components they install.
+type FeatureComponents struct {
+	Feature   string `msi:"Feature_"`
+	Component string `msi:"Component_"`
+}
+
+// readFeatures reads the Feature and FeatureComponents tables, which are
+// optional, and records which files each feature installs.
+func (m *MSI) readFeatures(db *Database, files []File) error {
+	if _, ok := db.schema["Feature"]; ok {
+		if err := db.scan("Feature", &m.Features); err != nil {
+			return err
+		}
+	}
+	var featureComponents []FeatureComponents
+	if _, ok := db.schema["FeatureComponents"]; ok {
+		if err := db.scan("FeatureComponents", &featureComponents); err != nil {
+			return err
+		}
+	}
+	componentFiles := make(map[string][]string)
+	for _, f := range files {
+		componentFiles[f.Component] = append(componentFiles[f.Component], f.File)
+	}
+	m.featureFiles = make(map[string][]string)
+	for _, fc := range featureComponents {
+		m.featureFiles[fc.Feature] = append(m.featureFiles[fc.Feature], componentFiles[fc.Component]...)
+	}
+	return nil
+}
+
+// FeatureFiles returns the keys of all files installed by the given
+// features or their sub-features.
+func (m *MSI) FeatureFiles(features ...string) map[string]bool {
+	selected := make(map[string]bool)
+	for _, f := range features {
+		selected[f] = true
+	}
+	// Select sub-features until nothing changes, the hierarchy is usually
+	// only a few levels deep.
+	for changed := true; changed; {
+		changed = false
+		for _, f := range m.Features {
+			if !selected[f.Feature] && selected[f.FeatureParent] {
+				selected[f.Feature] = true
+				changed = true
+			}
+		}
+	}
+	files := make(map[string]bool)
+	for f := range selected {
+		for _, key := range m.featureFiles[f] {
+			files[key] = true
+		}
+	}
+	return files
+}
@@ -0,0 +1,190 @@
+package msi
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ContentOpener returns the content of the file identified by its key in the
+// File table, which is also its name inside the cabinet.
+type ContentOpener func(key string) (io.ReadCloser, error)
+
+// FS returns a read-only fs.FS view of the files installed by the MSI, with
+// paths as resolved through the Directory and Component tables. File contents
+// are not part of the MSI itself, they are read using open, which can be nil
+// if only metadata is needed. Reading a file then fails.
+func (m *MSI) FS(open ContentOpener) fs.FS {
+	root := &fsNode{name: ".", dir: true, children: make(map[string]*fsNode)}
+	for key, p := range m.FileMap {
+		p = path.Clean(filepath.ToSlash(p))
+		if p == "." || strings.HasPrefix(p, "../") || strings.HasPrefix(p, "/") {
+			continue
+		}
+		parts := strings.Split(p, "/")
+		dir := root
+		for _, part := range parts[:len(parts)-1] {
+			child := dir.children[part]
+			if child == nil {
+				child = &fsNode{name: part, dir: true, children: make(map[string]*fsNode)}
+				dir.children[part] = child
+			}
+			dir = child
+		}
+		dir.children[parts[len(parts)-1]] = &fsNode{
+			name: parts[len(parts)-1],
+			key:  key,
+			size: m.fileSizes[key],
+		}
+	}
+	return &msiFS{root: root, open: open}
+}
+
+type fsNode struct {
+	name     string
+	dir      bool
+	key      string
+	size     int64
+	children map[string]*fsNode
+}
+
+func (n *fsNode) Name() string { return n.name }
+func (n *fsNode) Size() int64  { return n.size }
+func (n *fsNode) Mode() fs.FileMode {
+	if n.dir {
+		return fs.ModeDir | 0555
+	}
+	return 0444
+}
+func (n *fsNode) ModTime() time.Time { return time.Time{} }
+func (n *fsNode) IsDir() bool        { return n.dir }
+func (n *fsNode) Sys() interface{}   { return nil }
+
+func (n *fsNode) Type() fs.FileMode          { return n.Mode().Type() }
+func (n *fsNode) Info() (fs.FileInfo, error) { return n, nil }
+
+func (n *fsNode) entries() []fs.DirEntry {
+	var entries []fs.DirEntry
+	for _, c := range n.children {
+		entries = append(entries, c)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries
+}
+
+type msiFS struct {
+	root *fsNode
+	open ContentOpener
+}
+
+func (f *msiFS) lookup(op, name string) (*fsNode, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	n := f.root
+	if name == "." {
+		return n, nil
+	}
+	for _, part := range strings.Split(name, "/") {
+		if !n.dir {
+			return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+		n = n.children[part]
+		if n == nil {
+			return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+	}
+	return n, nil
+}
+
+func (f *msiFS) Open(name string) (fs.File, error) {
+	n, err := f.lookup("open", name)
+	if err != nil {
+		return nil, err
+	}
+	if n.dir {
+		return &fsDir{node: n, entries: n.entries()}, nil
+	}
+	return &fsFile{node: n, fs: f}, nil
+}
+
+func (f *msiFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	n, err := f.lookup("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	if !n.dir {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+	return n.entries(), nil
+}
+
+func (f *msiFS) Stat(name string) (fs.FileInfo, error) {
+	n, err := f.lookup("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+type fsDir struct {
+	node    *fsNode
+	entries []fs.DirEntry
+	offset  int
+}
+
+func (d *fsDir) Stat() (fs.FileInfo, error) { return d.node, nil }
+func (d *fsDir) Close() error               { return nil }
+func (d *fsDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.node.name, Err: errors.New("is a directory")}
+}
+
+func (d *fsDir) ReadDir(count int) ([]fs.DirEntry, error) {
+	rest := d.entries[d.offset:]
+	if count <= 0 {
+		d.offset = len(d.entries)
+		return rest, nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	if count > len(rest) {
+		count = len(rest)
+	}
+	d.offset += count
+	return rest[:count], nil
+}
+
+type fsFile struct {
+	node *fsNode
+	fs   *msiFS
+	r    io.ReadCloser
+}
+
+func (f *fsFile) Stat() (fs.FileInfo, error) { return f.node, nil }
+
+func (f *fsFile) Read(b []byte) (int, error) {
+	if f.r == nil {
+		if f.fs.open == nil {
+			return 0, &fs.PathError{Op: "read", Path: f.node.name, Err: errors.New("file contents not available without a content opener")}
+		}
+		r, err := f.fs.open(f.node.key)
+		if err != nil {
+			return 0, &fs.PathError{Op: "read", Path: f.node.name, Err: err}
+		}
+		f.r = r
+	}
+	return f.r.Read(b)
+}
+
+func (f *fsFile) Close() error {
+	if f.r != nil {
+		return f.r.Close()
+	}
+	return nil
+}
@@ -0,0 +1,31 @@
+package msi
+
+import (
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestFS(t *testing.T) {
+	m := &MSI{
+		FileMap: map[string]string{
+			"fil1": "Windows Kits/10/Include/10.0.22621.0/um/windows.h",
+			"fil2": "Windows Kits/10/Include/10.0.22621.0/um/winbase.h",
+			"fil3": "Windows Kits/10/Lib/10.0.22621.0/um/x64/kernel32.Lib",
+		},
+		fileSizes: map[string]int64{"fil1": 7, "fil2": 7, "fil3": 8},
+	}
+	contents := map[string]string{"fil1": "windows", "fil2": "winbase", "fil3": "kernel32"}
+	fsys := m.FS(func(key string) (io.ReadCloser, error) {
+		return ioutil.NopCloser(strings.NewReader(contents[key])), nil
+	})
+	if err := fstest.TestFS(fsys,
+		"Windows Kits/10/Include/10.0.22621.0/um/windows.h",
+		"Windows Kits/10/Include/10.0.22621.0/um/winbase.h",
+		"Windows Kits/10/Lib/10.0.22621.0/um/x64/kernel32.Lib",
+	); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,14 +1,12 @@
 package msi
 
 import (
-	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"path"
 	"path/filepath"
-	"reflect"
 	"sort"
 	"strings"
 
@@ -17,43 +15,73 @@ import (
 
 // Lists source media disks for the installation.
 type Media struct {
-	DiskID        uint16
-	LastSequence1 uint16
-	LastSequence2 uint16
-	DiskPrompt    string
-	Cabinet       string
-	VolumeLabel   string
-	Source        string
+	DiskID uint16 `msi:"DiskId"`
+	// Sequence number of the last file on this medium
+	LastSequence int32
+	DiskPrompt   string
+	Cabinet      string
+	VolumeLabel  string
+	Source       string
 }
 
 type File struct {
 	File       string
-	Component  string
+	Component  string `msi:"Component_"`
 	FileName   string
-	FileSize1  uint16
-	FileSize2  uint16
+	Size       uint32 `msi:"FileSize"`
 	Version    string
 	Language   string
 	Attributes uint16
-	Sequence1  uint16
-	Sequence2  uint16
+	// Position of the file on the installation media
+	Sequence int32
 }
 
 type Component struct {
 	Component   string
-	ComponentID string
-	Directory   string
-	Attributes  uint16
-	Condition   string
-	KeyPath     string
+	ComponentID string `msi:"ComponentId"`
+	Directory   string `msi:"Directory_"`
+	// Attributes is a combination of the Component* flags.
+	Attributes uint16
+	// Condition is evaluated by the installer to decide whether the
+	// component is installed, like VersionNT64. Empty if it always is.
+	Condition string
+	KeyPath   string
+}
+
+// Flags in Component.Attributes
+const (
+	ComponentSourceOnly                = 0x1
+	ComponentOptional                  = 0x2
+	ComponentRegistryKeyPath           = 0x4
+	ComponentSharedDllRefCount         = 0x8
+	ComponentPermanent                 = 0x10
+	ComponentODBCDataSource            = 0x20
+	ComponentTransitive                = 0x40
+	ComponentNeverOverwrite            = 0x80
+	Component64Bit                     = 0x100
+	ComponentDisableRegistryReflection = 0x200
+	ComponentUninstallOnSupersedence   = 0x400
+	ComponentShared                    = 0x800
+)
+
+// Is64Bit reports whether the component is installed to the 64-bit
+// locations on 64-bit Windows.
+func (c *Component) Is64Bit() bool {
+	return c.Attributes&Component64Bit != 0
 }
 
 type Directory struct {
 	Directory       string
-	DirectoryParent string
+	DirectoryParent string `msi:"Directory_Parent"`
 	DefaultDir      string
 }
 
+// Property is a global property of the installation like ProductVersion.
+type Property struct {
+	Property string
+	Value    string
+}
+
 var msiNameAlphabet = []rune("0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz._!")
 
 func decodeName(name string) string {
@@ -71,155 +99,329 @@ func decodeName(name string) string {
 	return string(decodedName)
 }
 
-func decodeStrings(stringData, stringPool []byte) []string {
-	var strs []string
-	poolReader := bytes.NewReader(stringPool)
-	var offset uint32
-	for {
-		var occNumber, stringLen uint16
-		err := binary.Read(poolReader, binary.LittleEndian, &stringLen)
-		if err == io.EOF {
-			return strs
-		}
-		if err != nil {
-			panic(err)
-		}
-		if err := binary.Read(poolReader, binary.LittleEndian, &occNumber); err != nil {
-			panic(err)
-		}
-		if occNumber > 0 {
-			var bigStringLen uint32 = uint32(stringLen)
-			if stringLen == 0 {
-				if err := binary.Read(poolReader, binary.LittleEndian, &bigStringLen); err != nil {
-					panic(err)
-				}
+// decodeStrings decodes the string pool. Its first entry is the header,
+// which takes the place of the null string with index 0. Every other entry
+// consists of the length of a string in stringData and its reference count.
+// Strings longer than 64KiB use two entries, the first one having a length
+// of zero followed by the reference count, the second one holding the low
+// and high words of the real length.
+func decodeStrings(stringData, stringPool []byte) ([]string, error) {
+	if err := checkStringPoolHeader(stringPool); err != nil {
+		return nil, err
+	}
+	strs := []string{""}
+	var offset uint64
+	for i := 4; i < len(stringPool); i += 4 {
+		length := uint64(binary.LittleEndian.Uint16(stringPool[i:]))
+		refs := binary.LittleEndian.Uint16(stringPool[i+2:])
+		if length == 0 && refs != 0 {
+			if i+8 > len(stringPool) {
+				return nil, fmt.Errorf("string pool ends in the middle of the long string %d", len(strs))
 			}
-			strs = append(strs, string(stringData[offset:offset+bigStringLen]))
-			offset += bigStringLen
-		} else {
-			strs = append(strs, "")
+			i += 4
+			length = uint64(binary.LittleEndian.Uint16(stringPool[i:])) | uint64(binary.LittleEndian.Uint16(stringPool[i+2:]))<<16
+		}
+		if offset+length > uint64(len(stringData)) {
+			return nil, fmt.Errorf("string %d at offset %d with length %d exceeds the %d bytes of string data (truncated download?)", len(strs), offset, length, len(stringData))
 		}
+		strs = append(strs, string(stringData[offset:offset+length]))
+		offset += length
 	}
+	return strs, nil
 }
 
-func parseTable(data []uint16, stringTable []string, target interface{}) {
-	targetVal := reflect.ValueOf(target)
-	nColumns := targetVal.Type().Elem().Elem().NumField()
-	if len(data)%nColumns != 0 {
-		panic("invalid table data")
-	}
-	rowVal := reflect.New(targetVal.Type().Elem().Elem()).Elem()
-	nRows := len(data) / nColumns
-	for i := 0; i < nRows; i++ {
-		for j := 0; j < nColumns; j++ {
-			val := data[(nRows*j)+i]
-			f := rowVal.Field(j)
-			switch f.Type().Kind() {
-			case reflect.String:
-				if int(val) >= len(stringTable) {
-					fmt.Println("bug in case")
-					break
-				}
-				f.SetString(stringTable[val])
-			case reflect.Uint16:
-				f.SetUint(uint64(val))
-			default:
-				panic("unimplemented type")
-			}
+// checkStringPoolHeader validates the size of the string pool and the code
+// page in its header.
+func checkStringPoolHeader(stringPool []byte) error {
+	if len(stringPool) < 4 {
+		return errors.New("string pool has no header (truncated download?)")
+	}
+	if len(stringPool)%4 != 0 {
+		return fmt.Errorf("string pool size %d is not a multiple of 4 (truncated download?)", len(stringPool))
+	}
+	if cp := stringPoolCodepage(stringPool); cp > 0xffff {
+		return fmt.Errorf("invalid code page %d in string pool header", cp)
+	}
+	return nil
+}
+
+// longStringRefs is set in the string pool header if string references in
+// tables are 3 instead of 2 bytes wide, which is needed for more than 64K
+// strings.
+const longStringRefs = 0x80000000
+
+// stringRefSize returns the width of string references in tables.
+func stringRefSize(stringPool []byte) int {
+	if len(stringPool) >= 4 && binary.LittleEndian.Uint32(stringPool)&longStringRefs != 0 {
+		return 3
+	}
+	return 2
+}
+
+// fileCabinets maps each file to the name of the cabinet containing it. Each
+// medium contains the files with sequence numbers after the LastSequence of
+// the previous medium up to its own. Files on media without a cabinet are
+// left out.
+func fileCabinets(medias []Media, files []File) map[string]string {
+	sorted := append([]Media(nil), medias...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].LastSequence < sorted[j].LastSequence })
+	out := make(map[string]string)
+	for _, f := range files {
+		i := sort.Search(len(sorted), func(i int) bool { return sorted[i].LastSequence >= f.Sequence })
+		if i < len(sorted) && sorted[i].Cabinet != "" {
+			out[f.File] = strings.TrimPrefix(sorted[i].Cabinet, "#")
 		}
-		targetVal.Elem().Set(reflect.Append(targetVal.Elem(), rowVal))
 	}
+	return out
+}
+
+// splitName splits a name of the form short|long from the File or
+// Directory table into its short (8.3) and long form. Names which are valid
+// short names are stored without a separate long form.
+func splitName(name string) (short, long string) {
+	if i := strings.IndexByte(name, '|'); i >= 0 {
+		return name[:i], name[i+1:]
+	}
+	return name, name
 }
 
-func getModernName(name string) string {
-	parts := strings.SplitN(name, "|", 2)
-	return parts[len(parts)-1]
+// Names returns the short (8.3) and long name of the file.
+func (f *File) Names() (short, long string) {
+	return splitName(f.FileName)
+}
+
+// IsRoot reports whether d is a root of the directory tree, like TARGETDIR.
+// Its DefaultDir is the name of the property holding its location, usually
+// SourceDir, and not a directory name.
+func (d *Directory) IsRoot() bool {
+	return d.DirectoryParent == "" || d.DirectoryParent == d.Directory
+}
+
+// TargetNames returns the short (8.3) and long name of the directory when
+// installed. The DefaultDir column optionally also contains the names in
+// the source tree after a colon, which are ignored. Root directories and
+// directories named "." are the same as their parent and return ".".
+func (d *Directory) TargetNames() (short, long string) {
+	if d.IsRoot() {
+		return ".", "."
+	}
+	return splitName(strings.SplitN(d.DefaultDir, ":", 2)[0])
+}
+
+// directoryPaths returns the path of each directory relative to the root
+// directory, using short or long names.
+func directoryPaths(dirs []Directory, short bool) (map[string]string, error) {
+	byName := make(map[string]*Directory)
+	for i := range dirs {
+		byName[dirs[i].Directory] = &dirs[i]
+	}
+	paths := make(map[string]string)
+	var resolve func(d *Directory, depth int) (string, error)
+	resolve = func(d *Directory, depth int) (string, error) {
+		if p, ok := paths[d.Directory]; ok {
+			return p, nil
+		}
+		if depth > len(dirs) {
+			return "", fmt.Errorf("directory %v is its own ancestor", d.Directory)
+		}
+		shortName, longName := d.TargetNames()
+		name := longName
+		if short {
+			name = shortName
+		}
+		// Directories with an unknown parent are treated like roots.
+		var parentPath string
+		if parent, ok := byName[d.DirectoryParent]; ok && !d.IsRoot() {
+			var err error
+			if parentPath, err = resolve(parent, depth+1); err != nil {
+				return "", err
+			}
+		}
+		p := path.Join(parentPath, name)
+		paths[d.Directory] = p
+		return p, nil
+	}
+	for i := range dirs {
+		if _, err := resolve(&dirs[i], 0); err != nil {
+			return nil, err
+		}
+	}
+	return paths, nil
 }
 
 type MSI struct {
+	// Summary information of the package
+	Summary Summary
+	// ProductName and ProductVersion from the Property table
+	ProductName    string
+	ProductVersion string
 	// File name in CAB -> Final path
 	FileMap map[string]string
-	// List of CAB files used
+	// File name in CAB -> Final path using short (8.3) names
+	ShortFileMap map[string]string
+	// Components keyed by their name
+	Components map[string]*Component
+	// List of CAB files used, in the order of the sequence numbers of their
+	// files
 	CABFiles []string
+	// File name in CAB -> name of the CAB file containing it, as listed in
+	// CABFiles or EmbeddedCABFiles
+	FileCAB map[string]string
+	// List of CAB files stored as streams inside the MSI, see
+	// OpenEmbeddedCAB. They are listed in the Media table with a leading #,
+	// which isn't included here.
+	EmbeddedCABFiles []string
+
+	// File name in CAB -> size in bytes
+	fileSizes map[string]int64
+	// File name in CAB -> component installing it
+	fileComponents map[string]string
+	// Features of the product, see FeatureFiles
+	Features []Feature
+
+	// Feature -> keys of the files it installs directly
+	featureFiles map[string][]string
+	// Streams of embedded cabinets by name. As they keep the reader passed
+	// to Parse alive, this is nil unless there are any.
+	embedded map[string]*mscfb.File
+}
+
+// FileComponent returns the component installing the file with the given
+// key.
+func (m *MSI) FileComponent(file string) (*Component, bool) {
+	c, ok := m.Components[m.fileComponents[file]]
+	return c, ok
+}
+
+// FileSize returns the size of the file with the given key.
+func (m *MSI) FileSize(file string) (int64, bool) {
+	size, ok := m.fileSizes[file]
+	return size, ok
+}
+
+// OpenEmbeddedCAB returns the content of a cabinet stored inside the MSI.
+// It reads from the io.ReaderAt passed to Parse, which must still be
+// usable.
+func (m *MSI) OpenEmbeddedCAB(name string) (io.ReadSeeker, error) {
+	f, ok := m.embedded[name]
+	if !ok {
+		return nil, fmt.Errorf("no embedded cabinet named %q", name)
+	}
+	return openStream(f)
+}
+
+// openStream returns a reader for a stream of the compound file, starting
+// at its beginning.
+func openStream(f *mscfb.File) (io.ReadSeeker, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	// Hide io.ReaderAt, which is not safe for concurrent use.
+	return struct{ io.ReadSeeker }{f}, nil
 }
 
 func Parse(reader io.ReaderAt) (*MSI, error) {
-	doc, err := mscfb.New(reader)
+	db, err := Open(reader)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse MS-CFB header (not an MSI file?): %w", err)
-	}
-	var stringPool, stringData []byte
-	rawTableData := make(map[string][]uint16)
-	for entry, err := doc.Next(); err == nil; entry, err = doc.Next() {
-		name := decodeName(entry.Name)
-		if name == "!_StringPool" {
-			stringPool, err = io.ReadAll(entry)
-		}
-		if name == "!_StringData" {
-			stringData, err = io.ReadAll(entry)
-		}
-		if strings.HasPrefix(name, "!") && !strings.HasPrefix(name, "!_") {
-			raw := make([]uint16, entry.Size/2)
-			binary.Read(doc, binary.LittleEndian, &raw)
-			rawTableData[strings.TrimPrefix(name, "!")] = raw
-		}
-		if err != nil {
-			log.Fatal(err)
-		}
+		return nil, err
 	}
-	stringsList := decodeStrings(stringData, stringPool)
 
 	var dirs []Directory
-	parseTable(rawTableData["Directory"], stringsList, &dirs)
-	dirMap := make(map[string]Directory)
-	dirPathMap := make(map[string]string)
-	for _, dir := range dirs {
-		if dir.Directory == "TARGETDIR" {
-			dir.DefaultDir = "."
-		}
-		dirMap[dir.Directory] = dir
-	}
-	for _, dir := range dirs {
-		pathParts := []string{getModernName(dir.DefaultDir)}
-		nextParent := dir.DirectoryParent
-		for {
-			if nextParent == "" {
-				break
-			}
-			parent := dirMap[nextParent]
-			nextParent = parent.DirectoryParent
-			pathParts = append(pathParts, getModernName(parent.DefaultDir))
-		}
-		// Reverse order
-		sort.SliceStable(pathParts, func(i, j int) bool {
-			return i > j
-		})
-		dirPathMap[dir.Directory] = path.Join(pathParts...)
+	if err := db.scan("Directory", &dirs); err != nil {
+		return nil, err
+	}
+	longDirs, err := directoryPaths(dirs, false)
+	if err != nil {
+		return nil, err
+	}
+	shortDirs, err := directoryPaths(dirs, true)
+	if err != nil {
+		return nil, err
 	}
 
 	var components []Component
-	componentDirMap := make(map[string]string)
-	parseTable(rawTableData["Component"], stringsList, &components)
-	for _, cmp := range components {
-		componentDirMap[cmp.Component] = dirPathMap[cmp.Directory]
+	componentDirs := make(map[string]string)
+	if err := db.scan("Component", &components); err != nil {
+		return nil, err
+	}
+	componentMap := make(map[string]*Component)
+	for i, cmp := range components {
+		componentDirs[cmp.Component] = cmp.Directory
+		componentMap[cmp.Component] = &components[i]
 	}
 
 	var medias []Media
-	parseTable(rawTableData["Media"], stringsList, &medias)
+	if err := db.scan("Media", &medias); err != nil {
+		return nil, err
+	}
 
 	var files []File
-	parseTable(rawTableData["File"], stringsList, &files)
+	if err := db.scan("File", &files); err != nil {
+		return nil, err
+	}
 	fileToPath := make(map[string]string)
+	fileToShortPath := make(map[string]string)
+	fileSizes := make(map[string]int64)
 	for _, f := range files {
-		fileToPath[f.File] = filepath.Join(componentDirMap[f.Component], getModernName(f.FileName))
+		dir := componentDirs[f.Component]
+		short, long := f.Names()
+		fileToPath[f.File] = filepath.Join(longDirs[dir], long)
+		fileToShortPath[f.File] = filepath.Join(shortDirs[dir], short)
+		fileSizes[f.File] = int64(f.Size)
 	}
 	var data MSI
 	data.FileMap = fileToPath
+	data.ShortFileMap = fileToShortPath
+	data.Components = componentMap
+	data.fileComponents = make(map[string]string)
+	for _, f := range files {
+		data.fileComponents[f.File] = f.Component
+	}
+	data.fileSizes = fileSizes
+	summary, err := db.Summary()
+	if err != nil {
+		return nil, err
+	}
+	data.Summary = *summary
+	if _, ok := db.schema["Property"]; ok {
+		var props []Property
+		if err := db.scan("Property", &props); err != nil {
+			return nil, err
+		}
+		for _, p := range props {
+			switch p.Property {
+			case "ProductName":
+				data.ProductName = p.Value
+			case "ProductVersion":
+				data.ProductVersion = p.Value
+			}
+		}
+	}
+	if err := data.readFeatures(db, files); err != nil {
+		return nil, err
+	}
+	// Cabinets are listed in installation order, which is the order of
+	// the sequence numbers of their files.
+	sort.SliceStable(medias, func(i, j int) bool { return medias[i].LastSequence < medias[j].LastSequence })
 	for _, m := range medias {
 		if m.Cabinet == "" {
 			continue
 		}
+		if name := strings.TrimPrefix(m.Cabinet, "#"); name != m.Cabinet {
+			stream, ok := db.others[name]
+			if !ok {
+				return nil, fmt.Errorf("embedded cabinet %v not found", name)
+			}
+			if data.embedded == nil {
+				data.embedded = make(map[string]*mscfb.File)
+			}
+			data.embedded[name] = stream
+			data.EmbeddedCABFiles = append(data.EmbeddedCABFiles, name)
+			continue
+		}
 		data.CABFiles = append(data.CABFiles, m.Cabinet)
 	}
+
+	data.FileCAB = fileCabinets(medias, files)
 	return &data, nil
 }
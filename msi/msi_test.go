@@ -1,7 +1,11 @@
 package msi
 
 import (
+	"bytes"
+	"encoding/binary"
+	"io"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -16,12 +20,276 @@ func Test_decodeStringVector(t *testing.T) {
 		want []string
 	}{
 		{"testcase", args{stringData: []byte("NameTableTypeColumn"), stringPool: []byte{0x00, 0x00, 0x00, 0x00, 0x04, 0x00, 0x0A, 0x00, 0x05, 0x00, 0x02, 0x00, 0x00, 0x00, 0x00, 0x00, 0x04, 0x00, 0x06, 0x00, 0x06, 0x00, 0x02, 0x00}}, []string{"", "Name", "Table", "", "Type", "Column"}},
+		{"long string", args{stringData: []byte(strings.Repeat("a", 0x10001) + "bc"), stringPool: []byte{0xe4, 0x04, 0x00, 0x80, 0x00, 0x00, 0x01, 0x00, 0x01, 0x00, 0x01, 0x00, 0x02, 0x00, 0x01, 0x00}}, []string{"", strings.Repeat("a", 0x10001), "bc"}},
+		{"long string with references", args{stringData: []byte(strings.Repeat("a", 0x20003) + "bc"), stringPool: []byte{0xe4, 0x04, 0x00, 0x80, 0x00, 0x00, 0x07, 0x00, 0x03, 0x00, 0x02, 0x00, 0x02, 0x00, 0x01, 0x00}}, []string{"", strings.Repeat("a", 0x20003), "bc"}},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if got := decodeStrings(tt.args.stringData, tt.args.stringPool); !reflect.DeepEqual(got, tt.want) {
+			got, err := decodeStrings(tt.args.stringData, tt.args.stringPool)
+			if err != nil {
+				t.Fatalf("decodeStrings: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
 				t.Errorf("decodeStringVector() = %v, want %v", got, tt.want)
 			}
 		})
 	}
 }
+
+func TestDecodeStringsInvalid(t *testing.T) {
+	tests := []struct {
+		name       string
+		stringData []byte
+		stringPool []byte
+	}{
+		{"no header", nil, nil},
+		{"partial entry", []byte("ab"), []byte{0, 0, 0, 0, 2, 0, 1}},
+		{"truncated data", []byte("ab"), []byte{0, 0, 0, 0, 2, 0, 1, 0, 3, 0, 1, 0}},
+		{"truncated long string", nil, []byte{0, 0, 0, 0, 0, 0, 1, 0}},
+		{"invalid code page", nil, []byte{0, 0, 1, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := decodeStrings(tt.stringData, tt.stringPool); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+// columnMajor encodes table rows column by column with the given widths.
+func columnMajor(widths []int, rows ...[]uint32) []byte {
+	var out []byte
+	for j, w := range widths {
+		for _, row := range rows {
+			v := make([]byte, 4)
+			binary.LittleEndian.PutUint32(v, row[j])
+			out = append(out, v[:w]...)
+		}
+	}
+	return out
+}
+
+func TestParseTable(t *testing.T) {
+	strs := []string{"", "Media", "DiskId", "Cabinet", "LastSequence", "a.cab", "b.cab"}
+	// Columns are listed out of order and Cabinet comes before LastSequence,
+	// unlike in the Media struct.
+	streams := map[string][]byte{
+		"_Tables": columnMajor([]int{2}, []uint32{1}),
+		"_Columns": columnMajor([]int{2, 2, 2, 2},
+			[]uint32{1, 0x8000 | 3, 4, 0x8000 | uint32(colValid|4)},
+			[]uint32{1, 0x8000 | 1, 2, 0x8000 | uint32(colValid|colKey|2)},
+			[]uint32{1, 0x8000 | 2, 3, 0x8000 | uint32(colValid|colString|255)},
+		),
+		"Media": columnMajor([]int{2, 2, 4},
+			[]uint32{0x8001, 5, 0x80012345},
+			[]uint32{0x8002, 6, 0x80054321},
+		),
+	}
+	schema, err := readSchema(streams, strs, 2)
+	if err != nil {
+		t.Fatalf("readSchema: %v", err)
+	}
+	db := &Database{strings: strs, refSize: 2, schema: schema, streams: map[string]*io.SectionReader{
+		"Media": io.NewSectionReader(bytes.NewReader(streams["Media"]), 0, int64(len(streams["Media"]))),
+	}}
+	if got := db.Tables(); !reflect.DeepEqual(got, []string{"Media"}) {
+		t.Errorf("got tables %v", got)
+	}
+	tbl, err := db.Table("Media")
+	if err != nil {
+		t.Fatalf("Table: %v", err)
+	}
+	wantRows := []Row{
+		{"DiskId": int32(1), "Cabinet": "a.cab", "LastSequence": int32(0x12345)},
+		{"DiskId": int32(2), "Cabinet": "b.cab", "LastSequence": int32(0x54321)},
+	}
+	if got := tbl.Rows(); !reflect.DeepEqual(got, wantRows) {
+		t.Errorf("got rows %v, want %v", got, wantRows)
+	}
+	var medias []Media
+	if err := tbl.Scan(&medias); err != nil {
+		t.Fatalf("Scan: %v", err)
+	}
+	want := []Media{
+		{DiskID: 1, LastSequence: 0x12345, Cabinet: "a.cab"},
+		{DiskID: 2, LastSequence: 0x54321, Cabinet: "b.cab"},
+	}
+	if !reflect.DeepEqual(medias, want) {
+		t.Errorf("got %+v, want %+v", medias, want)
+	}
+
+	// With more than 64K strings, references are 3 bytes wide.
+	strs = append(strs, make([]string, 0x12345)...)
+	tbl, err = decodeTable("Media", schema["Media"], columnMajor([]int{2, 3, 4}, []uint32{0x8001, 0x12345, 0x80000001}), strs, 3)
+	if err != nil {
+		t.Fatalf("decodeTable: %v", err)
+	}
+	if got := tbl.rows[0]; !reflect.DeepEqual(got, []uint32{0x8001, 0x12345, 0x80000001}) {
+		t.Errorf("got row %x", got)
+	}
+
+	// Binary columns stay 2 bytes wide even then.
+	binaryCols := []Column{
+		{Name: "Name", Type: colValid | colKey | colString | 72},
+		{Name: "Data", Type: colValid | colString | colNullable},
+	}
+	tbl, err = decodeTable("Binary", binaryCols, columnMajor([]int{3, 2}, []uint32{0x12345, 1}, []uint32{1, 0}), strs, 3)
+	if err != nil {
+		t.Fatalf("decodeTable: %v", err)
+	}
+	if got := tbl.rows; !reflect.DeepEqual(got, [][]uint32{{0x12345, 1}, {1, 0}}) {
+		t.Errorf("got rows %x", got)
+	}
+}
+
+func TestIntValue(t *testing.T) {
+	i2 := Column{Type: colValid | 2}
+	i4 := Column{Type: colValid | 4}
+	for _, tc := range []struct {
+		col  Column
+		raw  uint32
+		want int32
+		null bool
+	}{
+		{i2, 0, 0, true},
+		{i2, 0x8000, 0, false},
+		{i2, 0x8005, 5, false},
+		{i2, 0x7fff, -1, false},
+		{i4, 0, 0, true},
+		{i4, 0x80000000, 0, false},
+		{i4, 0x80012345, 0x12345, false},
+		{i4, 0x7ffffffe, -2, false},
+	} {
+		if v, null := tc.col.intValue(tc.raw); v != tc.want || null != tc.null {
+			t.Errorf("intValue(%#x) with width %d = %d, %v, want %d, %v", tc.raw, tc.col.width(2), v, null, tc.want, tc.null)
+		}
+	}
+}
+
+func TestDecodeString(t *testing.T) {
+	for _, tc := range []struct {
+		codepage int
+		in       string
+		want     string
+	}{
+		{CodepageWindows1252, "caf\xe9 \x80", "café €"},
+		{CodepageNeutral, "plain", "plain"},
+		{CodepageUTF8, "caf\xc3\xa9\xff", "café�"},
+		{932, "\xe6\x97\xa5", "日"},
+	} {
+		if got := DecodeString(tc.codepage, []byte(tc.in)); got != tc.want {
+			t.Errorf("DecodeString(%d, %q) = %q, want %q", tc.codepage, tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestFeatureFiles(t *testing.T) {
+	m := &MSI{}
+	m.Features = []Feature{
+		{Feature: "OptionId.DesktopCPPx64"},
+		{Feature: "x64Libs", FeatureParent: "OptionId.DesktopCPPx64"},
+		{Feature: "OptionId.DesktopCPParm64"},
+	}
+	m.featureFiles = map[string][]string{
+		"OptionId.DesktopCPPx64":   {"windows.h"},
+		"x64Libs":                  {"kernel32.lib"},
+		"OptionId.DesktopCPParm64": {"windows.h", "kernel32.lib_arm64"},
+	}
+	got := m.FeatureFiles("OptionId.DesktopCPPx64")
+	if want := map[string]bool{"windows.h": true, "kernel32.lib": true}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestFileCabinets(t *testing.T) {
+	medias := []Media{
+		{DiskID: 2, LastSequence: 20, Cabinet: "b.cab"},
+		{DiskID: 1, LastSequence: 10, Cabinet: "a.cab"},
+		{DiskID: 3, LastSequence: 0x10000, Cabinet: "#c.cab"},
+	}
+	files := []File{
+		{File: "f1", Sequence: 1},
+		{File: "f10", Sequence: 10},
+		{File: "f11", Sequence: 11},
+		{File: "f21", Sequence: 21},
+		{File: "fbig", Sequence: 0x20000},
+	}
+	want := map[string]string{"f1": "a.cab", "f10": "a.cab", "f11": "b.cab", "f21": "c.cab"}
+	if got := fileCabinets(medias, files); !reflect.DeepEqual(got, want) {
+		t.Errorf("fileCabinets() = %v, want %v", got, want)
+	}
+}
+
+func TestDecodeSummary(t *testing.T) {
+	// Property set with a code page, a subject, a template and a word count
+	type prop struct {
+		id    uint32
+		value []byte
+	}
+	lpstr := func(s string) []byte {
+		b := make([]byte, 8+len(s)+1)
+		binary.LittleEndian.PutUint32(b, vtLPSTR)
+		binary.LittleEndian.PutUint32(b[4:], uint32(len(s)+1))
+		copy(b[8:], s)
+		return b
+	}
+	i2 := func(v uint16) []byte {
+		b := make([]byte, 8)
+		binary.LittleEndian.PutUint32(b, vtI2)
+		binary.LittleEndian.PutUint16(b[4:], v)
+		return b
+	}
+	props := []prop{{1, i2(1252)}, {3, lpstr("Caf\xe9")}, {7, lpstr("x64;1033,1031")}, {15, i2(2)}}
+	set := make([]byte, 8+8*len(props))
+	for i, p := range props {
+		binary.LittleEndian.PutUint32(set[8+i*8:], p.id)
+		binary.LittleEndian.PutUint32(set[12+i*8:], uint32(len(set)))
+		set = append(set, p.value...)
+	}
+	binary.LittleEndian.PutUint32(set, uint32(len(set)))
+	binary.LittleEndian.PutUint32(set[4:], uint32(len(props)))
+	data := make([]byte, 48)
+	binary.LittleEndian.PutUint16(data, 0xfffe)
+	binary.LittleEndian.PutUint32(data[24:], 1)
+	binary.LittleEndian.PutUint32(data[44:], 48)
+	data = append(data, set...)
+
+	s, err := decodeSummary(data, DecodeString)
+	if err != nil {
+		t.Fatalf("decodeSummary: %v", err)
+	}
+	if s.Codepage != 1252 || s.Subject != "Café" || s.WordCount != 2 {
+		t.Errorf("got %+v", s)
+	}
+	if p := s.Platform(); p != "x64" {
+		t.Errorf("Platform() = %q, want x64", p)
+	}
+	if l := s.Languages(); !reflect.DeepEqual(l, []string{"1033", "1031"}) {
+		t.Errorf("Languages() = %v", l)
+	}
+}
+
+func TestDirectoryPaths(t *testing.T) {
+	dirs := []Directory{
+		{Directory: "INCDIR", DirectoryParent: "KITSDIR", DefaultDir: "Include"},
+		{Directory: "TARGETDIR", DefaultDir: "SourceDir"},
+		{Directory: "KITSDIR", DirectoryParent: "TARGETDIR", DefaultDir: "WINDOW~1|Windows Kits:Kits"},
+		{Directory: "SAMEDIR", DirectoryParent: "KITSDIR", DefaultDir: "."},
+	}
+	got, err := directoryPaths(dirs, false)
+	if err != nil {
+		t.Fatalf("directoryPaths: %v", err)
+	}
+	want := map[string]string{"TARGETDIR": ".", "KITSDIR": "Windows Kits", "INCDIR": "Windows Kits/Include", "SAMEDIR": "Windows Kits"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, _ := directoryPaths(dirs, true); got["INCDIR"] != "WINDOW~1/Include" {
+		t.Errorf("got short path %q", got["INCDIR"])
+	}
+	dirs = append(dirs, Directory{Directory: "A", DirectoryParent: "B", DefaultDir: "a"}, Directory{Directory: "B", DirectoryParent: "A", DefaultDir: "b"})
+	if _, err := directoryPaths(dirs, false); err == nil {
+		t.Error("expected an error for a directory cycle")
+	}
+}
@@ -0,0 +1,67 @@
+package msi
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// Patch is an MSP patch package. Like an MSI, it is a database with its own
+// tables (like MsiPatchMetadata and MsiPatchSequence). Additionally, it
+// contains the transforms applied to the patched product's database and
+// cabinets with the new and updated files. Files in these cabinets are
+// named by their keys in the File table, which for updated files are the
+// same as in the patched MSI.
+type Patch struct {
+	*Database
+	cabinets []string
+}
+
+// OpenPatch reads the MSP patch in r, which must stay usable as long as the
+// Patch is.
+func OpenPatch(r io.ReaderAt) (*Patch, error) {
+	db, err := Open(r)
+	if err != nil {
+		return nil, err
+	}
+	p := &Patch{Database: db}
+	for name, f := range db.others {
+		sig := make([]byte, 4)
+		if _, err := f.ReadAt(sig, 0); err != nil && err != io.EOF {
+			return nil, fmt.Errorf("failed to read stream %v: %w", name, err)
+		}
+		if bytes.Equal(sig, []byte("MSCF")) {
+			p.cabinets = append(p.cabinets, name)
+		}
+	}
+	sort.Strings(p.cabinets)
+	return p, nil
+}
+
+// Cabinets returns the names of the cabinets stored in the patch, sorted by
+// name. They are referenced from the Media table of the transformed
+// database with a leading #.
+func (p *Patch) Cabinets() []string {
+	return p.cabinets
+}
+
+// OpenCabinet returns the content of the cabinet with the given name.
+func (p *Patch) OpenCabinet(name string) (io.ReadSeeker, error) {
+	for _, c := range p.cabinets {
+		if c == name {
+			return openStream(p.others[name])
+		}
+	}
+	return nil, fmt.Errorf("no cabinet named %q in patch", name)
+}
+
+// Transforms returns the names of the transforms stored in the patch. Each
+// patched product version usually has a transform (like RTM.1) and a
+// corresponding patch transform (like #RTM.1). Transforms are not decoded.
+func (p *Patch) Transforms() []string {
+	var names []string
+	names = append(names, p.storages...)
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,181 @@
+package msi
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// summaryStream is the name of the stream holding the summary information
+// property set.
+const summaryStream = "\x05SummaryInformation"
+
+// Summary is the summary information of an MSI database, see
+// https://docs.microsoft.com/en-us/windows/win32/msi/summary-information-stream-property-set
+type Summary struct {
+	Codepage int
+	Title    string
+	// Subject is the name of the product.
+	Subject string
+	// Author is the manufacturer of the product.
+	Author   string
+	Keywords string
+	Comments string
+	// Template contains the platform and the supported languages like
+	// x64;1033.
+	Template  string
+	LastSaved string
+	// RevisionNumber is the package code of an MSI or the GUIDs of the
+	// products a patch applies to.
+	RevisionNumber string
+	CreateTime     time.Time
+	LastSaveTime   time.Time
+	// PageCount is the minimum installer version required, like 500 for
+	// Windows Installer 5.0.
+	PageCount int32
+	// WordCount contains flags describing the source files, like whether
+	// they are compressed.
+	WordCount           int32
+	CreatingApplication string
+	Security            int32
+}
+
+// Platform returns the platform part of the template, like Intel, x64 or
+// Arm64.
+func (s *Summary) Platform() string {
+	return strings.SplitN(s.Template, ";", 2)[0]
+}
+
+// Languages returns the language IDs listed in the template.
+func (s *Summary) Languages() []string {
+	parts := strings.SplitN(s.Template, ";", 2)
+	if len(parts) < 2 || parts[1] == "" {
+		return nil
+	}
+	return strings.Split(parts[1], ",")
+}
+
+// Property types used in the summary information
+const (
+	vtI2       = 2
+	vtI4       = 3
+	vtLPSTR    = 30
+	vtFileTime = 64
+)
+
+// Summary reads the summary information stream of the database. Databases
+// without one return an empty Summary.
+func (db *Database) Summary() (*Summary, error) {
+	stream, ok := db.others[summaryStream]
+	if !ok {
+		return &Summary{}, nil
+	}
+	data, err := io.ReadAll(io.NewSectionReader(stream, 0, stream.Size))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read summary information: %w", err)
+	}
+	s, err := decodeSummary(data, db.decode)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode summary information: %w", err)
+	}
+	return s, nil
+}
+
+var errShortSummary = errors.New("truncated property set")
+
+// decodeSummary decodes the first property set of a property set stream as
+// described in [MS-OLEPS].
+func decodeSummary(data []byte, decode func(codepage int, s []byte) string) (*Summary, error) {
+	if len(data) < 48 {
+		return nil, errShortSummary
+	}
+	if bo := binary.LittleEndian.Uint16(data); bo != 0xfffe {
+		return nil, fmt.Errorf("invalid byte order mark %#x", bo)
+	}
+	if binary.LittleEndian.Uint32(data[24:]) < 1 {
+		return nil, errors.New("no property set")
+	}
+	setOff := binary.LittleEndian.Uint32(data[44:])
+	if uint64(setOff)+8 > uint64(len(data)) {
+		return nil, errShortSummary
+	}
+	set := data[setOff:]
+	n := binary.LittleEndian.Uint32(set[4:])
+	if uint64(n)*8+8 > uint64(len(set)) {
+		return nil, errShortSummary
+	}
+	type value struct {
+		typ  uint32
+		data []byte
+	}
+	props := make(map[uint32]value)
+	for i := uint32(0); i < n; i++ {
+		id := binary.LittleEndian.Uint32(set[8+i*8:])
+		off := binary.LittleEndian.Uint32(set[12+i*8:])
+		if uint64(off)+4 > uint64(len(set)) {
+			return nil, errShortSummary
+		}
+		props[id] = value{binary.LittleEndian.Uint32(set[off:]), set[off+4:]}
+	}
+
+	s := &Summary{Codepage: CodepageNeutral}
+	integer := func(id uint32) int32 {
+		v, ok := props[id]
+		switch {
+		case ok && v.typ == vtI2 && len(v.data) >= 2:
+			return int32(int16(binary.LittleEndian.Uint16(v.data)))
+		case ok && v.typ == vtI4 && len(v.data) >= 4:
+			return int32(binary.LittleEndian.Uint32(v.data))
+		}
+		return 0
+	}
+	if _, ok := props[1]; ok {
+		// Code pages above 32767 are stored as negative 16-bit values.
+		s.Codepage = int(uint16(integer(1)))
+	}
+	str := func(id uint32) string {
+		v, ok := props[id]
+		if !ok || v.typ != vtLPSTR || len(v.data) < 4 {
+			return ""
+		}
+		n := binary.LittleEndian.Uint32(v.data)
+		if uint64(n) > uint64(len(v.data)-4) {
+			return ""
+		}
+		b := v.data[4 : 4+n]
+		if i := strings.IndexByte(string(b), 0); i >= 0 {
+			b = b[:i]
+		}
+		if isASCII(string(b)) {
+			return string(b)
+		}
+		return decode(s.Codepage, b)
+	}
+	fileTime := func(id uint32) time.Time {
+		v, ok := props[id]
+		if !ok || v.typ != vtFileTime || len(v.data) < 8 {
+			return time.Time{}
+		}
+		// 100ns intervals since 1601-01-01
+		ft := int64(binary.LittleEndian.Uint64(v.data))
+		return time.Unix(ft/1e7-11644473600, ft%1e7*100).UTC()
+	}
+	s.Title = str(2)
+	s.Subject = str(3)
+	s.Author = str(4)
+	s.Keywords = str(5)
+	s.Comments = str(6)
+	s.Template = str(7)
+	s.LastSaved = str(8)
+	s.RevisionNumber = str(9)
+	s.CreateTime = fileTime(12)
+	s.LastSaveTime = fileTime(13)
+	s.PageCount = integer(14)
+	s.WordCount = integer(15)
+	s.CreatingApplication = str(18)
+	s.Security = integer(19)
+	return s, nil
+}
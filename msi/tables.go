@@ -0,0 +1,295 @@
+package msi
+
+import (
+	"encoding/binary"
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+// Bits of the column types stored in the _Columns table
+const (
+	colWidthMask   uint16 = 0x00ff
+	colValid       uint16 = 0x0100
+	colLocalizable uint16 = 0x0200
+	colString      uint16 = 0x0800
+	colNullable    uint16 = 0x1000
+	colKey         uint16 = 0x2000
+	colTemporary   uint16 = 0x4000
+)
+
+// Column is a column of a table as described by the _Columns table.
+type Column struct {
+	Name string
+	// Type is the column type as stored in the _Columns table.
+	Type uint16
+}
+
+// IsString reports whether the column holds strings (or binary data)
+// instead of integers.
+func (c Column) IsString() bool {
+	return c.Type&colString != 0
+}
+
+// IsBinary reports whether the column refers to binary data stored in a
+// separate stream.
+func (c Column) IsBinary() bool {
+	return c.Type&^colNullable == colString|colValid
+}
+
+// Nullable reports whether values of the column can be null.
+func (c Column) Nullable() bool {
+	return c.Type&colNullable != 0
+}
+
+// IsKey reports whether the column is part of the table's primary key.
+func (c Column) IsKey() bool {
+	return c.Type&colKey != 0
+}
+
+// width returns the number of bytes a value of the column takes up in the
+// table stream. String columns hold references into the string pool, which
+// are refSize bytes wide. Binary columns only mark whether the stream exists
+// and are always 2 bytes wide, as are integer columns unless declared with 4
+// bytes.
+func (c Column) width(refSize int) int {
+	if c.IsBinary() {
+		return 2
+	}
+	if c.IsString() {
+		return refSize
+	}
+	if c.Type&colWidthMask != 4 {
+		return 2
+	}
+	return 4
+}
+
+// intValue decodes a value of an integer column. Integers are stored with
+// their sign bit flipped, which leaves zero to mean null.
+func (c Column) intValue(raw uint32) (v int32, null bool) {
+	if raw == 0 {
+		return 0, true
+	}
+	if c.width(0) == 4 {
+		return int32(raw ^ 0x80000000), false
+	}
+	return int32(int16(uint16(raw) ^ 0x8000)), false
+}
+
+// Table is a table of an MSI database.
+type Table struct {
+	Name    string
+	Columns []Column
+
+	// Values as stored in the table stream: string columns hold indices
+	// into strings, integer columns their encoded value (see
+	// Column.intValue).
+	rows    [][]uint32
+	strings []string
+}
+
+// Row maps the column names of a table to the values of one row. Values
+// are strings for string columns and int32 for integer columns. Null values
+// and binary columns are nil.
+type Row map[string]interface{}
+
+// columnIndex returns the index of the column with the given name or -1.
+func (t *Table) columnIndex(name string) int {
+	for i, c := range t.Columns {
+		if c.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// Len returns the number of rows in the table.
+func (t *Table) Len() int {
+	return len(t.rows)
+}
+
+// Rows returns all rows of the table.
+func (t *Table) Rows() []Row {
+	rows := make([]Row, len(t.rows))
+	for i, raw := range t.rows {
+		row := make(Row, len(t.Columns))
+		for j, c := range t.Columns {
+			switch {
+			case c.IsBinary():
+				row[c.Name] = nil
+			case c.IsString():
+				if raw[j] == 0 {
+					row[c.Name] = nil
+				} else {
+					row[c.Name] = t.strings[raw[j]]
+				}
+			default:
+				if v, null := c.intValue(raw[j]); null {
+					row[c.Name] = nil
+				} else {
+					row[c.Name] = v
+				}
+			}
+		}
+		rows[i] = row
+	}
+	return rows
+}
+
+// Schemas of the system tables describing all other tables
+var (
+	tablesSchema = []Column{
+		{"Name", colValid | colString | colKey | 64},
+	}
+	columnsSchema = []Column{
+		{"Table", colValid | colString | colKey | 64},
+		{"Number", colValid | colKey | 2},
+		{"Name", colValid | colString | 64},
+		{"Type", colValid | 2},
+	}
+)
+
+// decodeTable decodes the stream of the table name with the given columns.
+// Values are stored column by column, so the stream consists of the values
+// of the first column of all rows, followed by those of the second one and
+// so on. String references are checked against strs.
+func decodeTable(name string, columns []Column, data []byte, strs []string, refSize int) (*Table, error) {
+	rowSize := 0
+	for _, c := range columns {
+		rowSize += c.width(refSize)
+	}
+	if rowSize == 0 {
+		return nil, fmt.Errorf("table %v has no columns", name)
+	}
+	if len(data)%rowSize != 0 {
+		return nil, fmt.Errorf("table %v has %d bytes, which is not a multiple of its row size %d", name, len(data), rowSize)
+	}
+	nRows := len(data) / rowSize
+	t := &Table{Name: name, Columns: columns, rows: make([][]uint32, nRows), strings: strs}
+	for i := range t.rows {
+		t.rows[i] = make([]uint32, len(columns))
+	}
+	offset := 0
+	for j, c := range columns {
+		w := c.width(refSize)
+		for i := 0; i < nRows; i++ {
+			v := data[offset+i*w:]
+			switch w {
+			case 4:
+				t.rows[i][j] = binary.LittleEndian.Uint32(v)
+			case 3:
+				t.rows[i][j] = uint32(v[0]) | uint32(v[1])<<8 | uint32(v[2])<<16
+			default:
+				t.rows[i][j] = uint32(binary.LittleEndian.Uint16(v))
+			}
+			if c.IsString() && !c.IsBinary() && int(t.rows[i][j]) >= len(strs) {
+				return nil, fmt.Errorf("table %v: string reference %d in column %v out of range", name, t.rows[i][j], c.Name)
+			}
+		}
+		offset += nRows * w
+	}
+	return t, nil
+}
+
+// readSchema returns the columns of all tables listed in the _Tables and
+// _Columns system tables.
+func readSchema(streams map[string][]byte, strs []string, refSize int) (map[string][]Column, error) {
+	tables, err := decodeTable("_Tables", tablesSchema, streams["_Tables"], strs, refSize)
+	if err != nil {
+		return nil, err
+	}
+	columns, err := decodeTable("_Columns", columnsSchema, streams["_Columns"], strs, refSize)
+	if err != nil {
+		return nil, err
+	}
+	type numberedColumn struct {
+		number int
+		Column
+	}
+	numbered := make(map[string][]numberedColumn)
+	for _, row := range tables.rows {
+		numbered[strs[row[0]]] = nil
+	}
+	for _, row := range columns.rows {
+		tableName, name := strs[row[0]], strs[row[2]]
+		if _, ok := numbered[tableName]; !ok {
+			return nil, fmt.Errorf("_Columns lists column %v of unknown table %v", name, tableName)
+		}
+		number, _ := columns.Columns[1].intValue(row[1])
+		typ, _ := columns.Columns[3].intValue(row[3])
+		numbered[tableName] = append(numbered[tableName], numberedColumn{
+			number: int(number),
+			Column: Column{Name: name, Type: uint16(typ)},
+		})
+	}
+	schema := make(map[string][]Column)
+	for name, cols := range numbered {
+		sort.Slice(cols, func(i, j int) bool { return cols[i].number < cols[j].number })
+		for i, c := range cols {
+			if c.number != i+1 {
+				return nil, fmt.Errorf("table %v has no column number %d", name, i+1)
+			}
+			schema[name] = append(schema[name], c.Column)
+		}
+	}
+	return schema, nil
+}
+
+// Scan appends the rows of the table to target, which must point to a
+// slice of structs. Struct fields are matched to columns by name or by the
+// column name given in their msi tag, like `msi:"Component_"`. String
+// columns are read into string fields, integer columns into integer fields,
+// with null values becoming zero. Unsigned 32-bit and 64-bit fields receive
+// the value as unsigned 32-bit integer, which is what sizes are stored as.
+// Columns without a matching field are ignored.
+func (t *Table) Scan(target interface{}) error {
+	targetVal := reflect.ValueOf(target)
+	if targetVal.Kind() != reflect.Ptr || targetVal.Elem().Kind() != reflect.Slice || targetVal.Type().Elem().Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("target must be a pointer to a slice of structs, not %T", target)
+	}
+	rowType := targetVal.Type().Elem().Elem()
+	// Column index of each field
+	cols := make([]int, rowType.NumField())
+	for i := range cols {
+		name := rowType.Field(i).Name
+		if tag := rowType.Field(i).Tag.Get("msi"); tag != "" {
+			name = tag
+		}
+		cols[i] = t.columnIndex(name)
+	}
+	for _, row := range t.rows {
+		rowVal := reflect.New(rowType).Elem()
+		for i, colIdx := range cols {
+			if colIdx < 0 {
+				continue
+			}
+			val := row[colIdx]
+			col := t.Columns[colIdx]
+			f := rowVal.Field(i)
+			if f.Kind() == reflect.String {
+				if !col.IsString() || col.IsBinary() {
+					return fmt.Errorf("table %v: column %v is not a string column", t.Name, col.Name)
+				}
+				f.SetString(t.strings[val])
+				continue
+			}
+			if col.IsString() {
+				return fmt.Errorf("table %v: column %v is not an integer column", t.Name, col.Name)
+			}
+			v, _ := col.intValue(val)
+			switch f.Kind() {
+			case reflect.Uint16:
+				f.SetUint(uint64(uint16(v)))
+			case reflect.Uint32, reflect.Uint64:
+				f.SetUint(uint64(uint32(v)))
+			case reflect.Int16, reflect.Int32, reflect.Int64, reflect.Int:
+				f.SetInt(int64(v))
+			default:
+				return fmt.Errorf("field %v has unsupported type %v", rowType.Field(i).Name, f.Type())
+			}
+		}
+		targetVal.Elem().Set(reflect.Append(targetVal.Elem(), rowVal))
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package ninep
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// encoder builds messages in little-endian byte order.
+type encoder struct {
+	b []byte
+}
+
+func (e *encoder) u8(v uint8) {
+	e.b = append(e.b, v)
+}
+
+func (e *encoder) u16(v uint16) {
+	var b [2]byte
+	binary.LittleEndian.PutUint16(b[:], v)
+	e.b = append(e.b, b[:]...)
+}
+
+func (e *encoder) u32(v uint32) {
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], v)
+	e.b = append(e.b, b[:]...)
+}
+
+func (e *encoder) u64(v uint64) {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], v)
+	e.b = append(e.b, b[:]...)
+}
+
+func (e *encoder) str(s string) {
+	e.u16(uint16(len(s)))
+	e.b = append(e.b, s...)
+}
+
+// time appends t as seconds and nanoseconds, zero for the zero time.
+func (e *encoder) time(t time.Time) {
+	if t.IsZero() {
+		e.u64(0)
+		e.u64(0)
+		return
+	}
+	e.u64(uint64(t.Unix()))
+	e.u64(uint64(t.Nanosecond()))
+}
+
+var errShort = errors.New("9P message too short")
+
+// decoder reads fields of a message. Reading past its end sets err and
+// returns zero values.
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.err != nil || len(d.b) < n {
+		d.err = errShort
+		return make([]byte, n)
+	}
+	b := d.b[:n]
+	d.b = d.b[n:]
+	return b
+}
+
+func (d *decoder) u16() uint16 {
+	return binary.LittleEndian.Uint16(d.next(2))
+}
+
+func (d *decoder) u32() uint32 {
+	return binary.LittleEndian.Uint32(d.next(4))
+}
+
+func (d *decoder) u64() uint64 {
+	return binary.LittleEndian.Uint64(d.next(8))
+}
+
+func (d *decoder) str() string {
+	return string(d.next(int(d.u16())))
+}
@@ -0,0 +1,713 @@
+// Package ninep serves read-only file system trees over the 9P2000.L
+// protocol, which the Linux kernel's v9fs client mounts over TCP:
+//
+//	mount -t 9p -o trans=tcp,port=5640,version=9p2000.L,ro host /mnt
+//
+// It serves the same trees as package fuse, but from any platform and to
+// other machines.
+package ninep
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"git.dolansoft.org/lorenz/winsysroot/fuse"
+)
+
+// Message types of 9P2000.L, see Documentation/filesystems/9p.rst and
+// include/net/9p/9p.h in Linux.
+const (
+	tlerror     = 6
+	rlerror     = 7
+	tstatfs     = 8
+	tlopen      = 12
+	treadlink   = 22
+	tgetattr    = 24
+	txattrwalk  = 30
+	treaddir    = 40
+	tversion    = 100
+	tauth       = 102
+	tattach     = 104
+	tflush      = 108
+	twalk       = 110
+	tread       = 116
+	tclunk      = 120
+	tremove     = 122
+	maxWalkElem = 16
+)
+
+// Linux error numbers, which 9P2000.L uses on every platform.
+const (
+	enoent     = 2
+	eio        = 5
+	ebadf      = 9
+	eacces     = 13
+	eexist     = 17
+	enotdir    = 20
+	eisdir     = 21
+	einval     = 22
+	erofs      = 30
+	enodata    = 61
+	eproto     = 71
+	eopnotsupp = 95
+)
+
+const (
+	// version is the only protocol version spoken.
+	version = "9P2000.L"
+	// maxMsize is the largest message size negotiated.
+	maxMsize = 1 << 20
+	// minMsize is the smallest message size accepted, which fits a walk of
+	// maxWalkElem names.
+	minMsize = 4096
+	// noFid is the fid meaning none, like the afid of unauthenticated
+	// attaches.
+	noFid = ^uint32(0)
+	// blockSize is reported by getattr and statfs.
+	blockSize = 4096
+	// magic is the file system type reported by statfs, V9FS_MAGIC.
+	magic = 0x01021997
+)
+
+// Qid types
+const (
+	qtDir  = 0x80
+	qtFile = 0
+)
+
+// Flags of Tlopen, directory entry types and the attributes returned by
+// Tgetattr, as on Linux.
+const (
+	oAccmode     = 3
+	oRdonly      = 0
+	oTrunc       = 01000
+	dtDir        = 4
+	dtReg        = 8
+	getattrBasic = 0x7ff
+)
+
+// Options configure how a tree is served.
+type Options struct {
+	// ErrorLog, if set, receives errors which can only be reported to the
+	// client as an error code.
+	ErrorLog func(err error)
+}
+
+// Server serves a tree to 9P clients.
+type Server struct {
+	root fuse.Dir
+	opts Options
+
+	mu     sync.Mutex
+	paths  map[fuse.Node]uint64
+	ln     net.Listener
+	conns  map[net.Conn]bool
+	closed bool
+
+	totals sync.Once
+	files  uint64
+	blocks uint64
+}
+
+// NewServer returns a server for the tree below root. Nodes must not change
+// while it is served.
+func NewServer(root fuse.Dir, opts Options) *Server {
+	return &Server{root: root, opts: opts, paths: make(map[fuse.Node]uint64), conns: make(map[net.Conn]bool)}
+}
+
+// Serve accepts connections on ln and serves them until Close is called,
+// then returns nil.
+func (s *Server) Serve(ln net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.ln = ln
+	s.mu.Unlock()
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return nil
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Temporary() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			c.Close()
+			return nil
+		}
+		s.conns[c] = true
+		s.mu.Unlock()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.ServeConn(c)
+			s.mu.Lock()
+			delete(s.conns, c)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+// Close stops accepting connections and closes all served ones.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	var err error
+	if s.ln != nil {
+		err = s.ln.Close()
+	}
+	for c := range s.conns {
+		c.Close()
+	}
+	return err
+}
+
+// ServeConn serves a single connection until it is closed or the client
+// violates the protocol. The connection is closed when it returns.
+func (s *Server) ServeConn(c io.ReadWriteCloser) {
+	conn := &conn{
+		s:        s,
+		c:        c,
+		msize:    maxMsize,
+		fids:     make(map[uint32]*fid),
+		inflight: make(map[uint16]chan struct{}),
+	}
+	conn.serve()
+}
+
+func (s *Server) logError(err error) {
+	if s.opts.ErrorLog != nil {
+		s.opts.ErrorLog(err)
+	}
+}
+
+// path returns the unique qid path of n.
+func (s *Server) path(n fuse.Node) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.paths[n]
+	if !ok {
+		p = uint64(len(s.paths)) + 1
+		s.paths[n] = p
+	}
+	return p
+}
+
+// count returns the number of files and blocks in the tree.
+func (s *Server) count() (files, blocks uint64) {
+	s.totals.Do(func() {
+		var walk func(d fuse.Dir)
+		walk = func(d fuse.Dir) {
+			for _, name := range d.Entries() {
+				n, ok := d.Lookup(name)
+				if !ok {
+					continue
+				}
+				s.files++
+				if sub, ok := n.(fuse.Dir); ok {
+					walk(sub)
+				} else {
+					s.blocks += (uint64(n.Attr().Size) + blockSize - 1) / blockSize
+				}
+			}
+		}
+		walk(s.root)
+	})
+	return s.files, s.blocks
+}
+
+// fid is a client's reference to a node. The path from the root is kept to
+// walk to "..".
+type fid struct {
+	nodes []fuse.Node
+
+	mu     sync.Mutex
+	opened bool
+	handle fuse.Handle
+}
+
+func (f *fid) node() fuse.Node {
+	return f.nodes[len(f.nodes)-1]
+}
+
+// conn is a connection to a client. Requests are handled concurrently, as
+// opening a file can take long.
+type conn struct {
+	s *Server
+	c io.ReadWriteCloser
+
+	wmu sync.Mutex
+	wg  sync.WaitGroup
+
+	mu       sync.Mutex
+	msize    uint32
+	fids     map[uint32]*fid
+	inflight map[uint16]chan struct{}
+}
+
+func (c *conn) serve() {
+	defer func() {
+		c.c.Close()
+		c.wg.Wait()
+		for _, f := range c.fids {
+			c.release(f)
+		}
+	}()
+	var size [4]byte
+	for {
+		if _, err := io.ReadFull(c.c, size[:]); err != nil {
+			if err != io.EOF {
+				c.s.logError(err)
+			}
+			return
+		}
+		n := binary.LittleEndian.Uint32(size[:])
+		c.mu.Lock()
+		msize := c.msize
+		c.mu.Unlock()
+		if n < 7 || n > msize {
+			c.s.logError(errors.New("9P message with invalid size"))
+			return
+		}
+		msg := make([]byte, n-4)
+		if _, err := io.ReadFull(c.c, msg); err != nil {
+			c.s.logError(err)
+			return
+		}
+		typ, tag := msg[0], binary.LittleEndian.Uint16(msg[1:])
+		d := &decoder{b: msg[3:]}
+		if typ == tversion {
+			// Versions must not overlap other requests.
+			c.wg.Wait()
+			c.reply(tag, typ, c.version(d))
+			continue
+		}
+		done := make(chan struct{})
+		c.mu.Lock()
+		c.inflight[tag] = done
+		c.mu.Unlock()
+		c.wg.Add(1)
+		go func() {
+			defer c.wg.Done()
+			out, errno := c.handle(typ, d)
+			c.mu.Lock()
+			delete(c.inflight, tag)
+			c.mu.Unlock()
+			if errno != 0 {
+				var e encoder
+				e.u32(errno)
+				c.reply(tag, rlerror-1, e.b)
+			} else {
+				c.reply(tag, typ, out)
+			}
+			close(done)
+		}()
+	}
+}
+
+// reply sends the response of type typ+1 to the request with tag.
+func (c *conn) reply(tag uint16, typ uint8, out []byte) {
+	msg := make([]byte, 7, 7+len(out))
+	binary.LittleEndian.PutUint32(msg, uint32(7+len(out)))
+	msg[4] = typ + 1
+	binary.LittleEndian.PutUint16(msg[5:], tag)
+	msg = append(msg, out...)
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if _, err := c.c.Write(msg); err != nil {
+		c.s.logError(err)
+	}
+}
+
+func (c *conn) version(d *decoder) []byte {
+	msize, v := d.u32(), d.str()
+	c.mu.Lock()
+	for _, f := range c.fids {
+		c.release(f)
+	}
+	c.fids = make(map[uint32]*fid)
+	if msize > maxMsize {
+		msize = maxMsize
+	}
+	if d.err != nil || msize < minMsize || v != version {
+		v = "unknown"
+	} else {
+		c.msize = msize
+	}
+	c.mu.Unlock()
+	var e encoder
+	e.u32(msize)
+	e.str(v)
+	return e.b
+}
+
+func (c *conn) handle(typ uint8, d *decoder) ([]byte, uint32) {
+	switch typ {
+	case tattach:
+		return c.attach(d)
+	case twalk:
+		return c.walk(d)
+	case tgetattr:
+		return c.getattr(d)
+	case tlopen:
+		return c.lopen(d)
+	case tread:
+		return c.read(d)
+	case treaddir:
+		return c.readdir(d)
+	case tclunk, tremove:
+		// Removing clunks the fid even though it fails.
+		f, errno := c.fid(d.u32(), d)
+		if errno != 0 {
+			return nil, errno
+		}
+		c.mu.Lock()
+		for id, g := range c.fids {
+			if g == f {
+				delete(c.fids, id)
+			}
+		}
+		c.mu.Unlock()
+		c.release(f)
+		if typ == tremove {
+			return nil, erofs
+		}
+		return nil, 0
+	case tflush:
+		oldtag := d.u16()
+		c.mu.Lock()
+		done := c.inflight[oldtag]
+		c.mu.Unlock()
+		// The flushed request is answered before the flush.
+		if done != nil {
+			<-done
+		}
+		return nil, 0
+	case tstatfs:
+		if _, errno := c.fid(d.u32(), d); errno != 0 {
+			return nil, errno
+		}
+		files, blocks := c.s.count()
+		var e encoder
+		e.u32(magic)
+		e.u32(blockSize)
+		e.u64(blocks)
+		e.u64(0) // bfree
+		e.u64(0) // bavail
+		e.u64(files)
+		e.u64(0) // ffree
+		e.u64(0) // fsid
+		e.u32(255)
+		return e.b, 0
+	case txattrwalk:
+		return nil, enodata
+	case treadlink:
+		return nil, einval
+	case tauth:
+		return nil, eopnotsupp
+	case tlerror, rlerror:
+		return nil, eproto
+	}
+	if typ%2 == 0 && typ < tversion {
+		// Creating, renaming and changing attributes of files
+		return nil, erofs
+	}
+	return nil, eopnotsupp
+}
+
+// fid returns the fid with the given number.
+func (c *conn) fid(id uint32, d *decoder) (*fid, uint32) {
+	if d.err != nil {
+		return nil, einval
+	}
+	c.mu.Lock()
+	f := c.fids[id]
+	c.mu.Unlock()
+	if f == nil {
+		return nil, ebadf
+	}
+	return f, 0
+}
+
+// release closes the handle of f if it was opened.
+func (c *conn) release(f *fid) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.handle != nil {
+		f.handle.Close()
+		f.handle = nil
+	}
+}
+
+// add registers f as id, which must not be in use.
+func (c *conn) add(id uint32, f *fid) uint32 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.fids[id]; ok {
+		return eexist
+	}
+	c.fids[id] = f
+	return 0
+}
+
+func (c *conn) qid(e *encoder, n fuse.Node) {
+	if _, ok := n.(fuse.Dir); ok {
+		e.u8(qtDir)
+	} else {
+		e.u8(qtFile)
+	}
+	e.u32(0)
+	e.u64(c.s.path(n))
+}
+
+func (c *conn) attach(d *decoder) ([]byte, uint32) {
+	id, afid := d.u32(), d.u32()
+	d.str() // uname
+	d.str() // aname
+	if d.err != nil {
+		return nil, einval
+	}
+	if afid != noFid {
+		return nil, eopnotsupp
+	}
+	if errno := c.add(id, &fid{nodes: []fuse.Node{c.s.root}}); errno != 0 {
+		return nil, errno
+	}
+	var e encoder
+	c.qid(&e, c.s.root)
+	return e.b, 0
+}
+
+func (c *conn) walk(d *decoder) ([]byte, uint32) {
+	id := d.u32()
+	f, errno := c.fid(id, d)
+	newID := d.u32()
+	names := make([]string, d.u16())
+	if len(names) > maxWalkElem {
+		return nil, einval
+	}
+	for i := range names {
+		names[i] = d.str()
+	}
+	if d.err != nil {
+		return nil, einval
+	}
+	if errno != 0 {
+		return nil, errno
+	}
+	nodes := append([]fuse.Node(nil), f.nodes...)
+	var e encoder
+	e.u16(0)
+	walked := 0
+	for _, name := range names {
+		dir, ok := nodes[len(nodes)-1].(fuse.Dir)
+		if !ok {
+			break
+		}
+		if name == ".." {
+			if len(nodes) > 1 {
+				nodes = nodes[:len(nodes)-1]
+			}
+		} else if name != "." {
+			child, ok := dir.Lookup(name)
+			if !ok {
+				break
+			}
+			nodes = append(nodes, child)
+		}
+		c.qid(&e, nodes[len(nodes)-1])
+		walked++
+	}
+	binary.LittleEndian.PutUint16(e.b, uint16(walked))
+	if walked < len(names) {
+		if walked == 0 {
+			return nil, enoent
+		}
+		// Partial walks return the qids found without creating newfid.
+		return e.b, 0
+	}
+	nf := &fid{nodes: nodes}
+	if newID == id {
+		c.mu.Lock()
+		c.fids[id] = nf
+		c.mu.Unlock()
+		c.release(f)
+	} else if errno := c.add(newID, nf); errno != 0 {
+		return nil, errno
+	}
+	return e.b, 0
+}
+
+func (c *conn) getattr(d *decoder) ([]byte, uint32) {
+	f, errno := c.fid(d.u32(), d)
+	if errno != 0 {
+		return nil, errno
+	}
+	n := f.node()
+	attr := n.Attr()
+	mode, nlink := uint32(0100000), uint64(1)
+	if attr.Mode.IsDir() {
+		mode, nlink = 0040000, 2
+	}
+	var e encoder
+	e.u64(getattrBasic)
+	c.qid(&e, n)
+	e.u32(mode | uint32(attr.Mode.Perm()))
+	e.u32(0) // uid
+	e.u32(0) // gid
+	e.u64(nlink)
+	e.u64(0) // rdev
+	e.u64(uint64(attr.Size))
+	e.u64(blockSize)
+	e.u64((uint64(attr.Size) + 511) / 512)
+	for i := 0; i < 3; i++ {
+		// atime, mtime and ctime
+		e.time(attr.ModTime)
+	}
+	e.time(time.Time{}) // btime
+	e.u64(0)            // gen
+	e.u64(0)            // data_version
+	return e.b, 0
+}
+
+func (c *conn) lopen(d *decoder) ([]byte, uint32) {
+	f, errno := c.fid(d.u32(), d)
+	flags := d.u32()
+	if d.err != nil {
+		return nil, einval
+	}
+	if errno != 0 {
+		return nil, errno
+	}
+	if flags&oAccmode != oRdonly || flags&oTrunc != 0 {
+		return nil, erofs
+	}
+	n := f.node()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.opened {
+		return nil, einval
+	}
+	if file, ok := n.(fuse.File); ok {
+		h, err := file.Open()
+		switch {
+		case os.IsNotExist(err):
+			return nil, enoent
+		case os.IsPermission(err):
+			return nil, eacces
+		case err != nil:
+			c.s.logError(err)
+			return nil, eio
+		}
+		f.handle = h
+	}
+	f.opened = true
+	var e encoder
+	c.qid(&e, n)
+	e.u32(0) // iounit, the client uses msize
+	return e.b, 0
+}
+
+func (c *conn) read(d *decoder) ([]byte, uint32) {
+	f, errno := c.fid(d.u32(), d)
+	off, count := d.u64(), d.u32()
+	if d.err != nil {
+		return nil, einval
+	}
+	if errno != 0 {
+		return nil, errno
+	}
+	f.mu.Lock()
+	h, opened := f.handle, f.opened
+	f.mu.Unlock()
+	if h == nil {
+		if opened {
+			return nil, eisdir
+		}
+		return nil, ebadf
+	}
+	c.mu.Lock()
+	// size[4] type[1] tag[2] count[4]
+	if max := c.msize - 11; count > max {
+		count = max
+	}
+	c.mu.Unlock()
+	buf := make([]byte, 4+count)
+	n, err := h.ReadAt(buf[4:], int64(off))
+	if err != nil && err != io.EOF {
+		c.s.logError(err)
+		return nil, eio
+	}
+	binary.LittleEndian.PutUint32(buf, uint32(n))
+	return buf[:4+n], 0
+}
+
+func (c *conn) readdir(d *decoder) ([]byte, uint32) {
+	f, errno := c.fid(d.u32(), d)
+	off, count := d.u64(), d.u32()
+	if d.err != nil {
+		return nil, einval
+	}
+	if errno != 0 {
+		return nil, errno
+	}
+	dir, ok := f.node().(fuse.Dir)
+	if !ok {
+		return nil, enotdir
+	}
+	f.mu.Lock()
+	opened := f.opened
+	f.mu.Unlock()
+	if !opened {
+		return nil, ebadf
+	}
+	c.mu.Lock()
+	if max := c.msize - 11; count > max {
+		count = max
+	}
+	c.mu.Unlock()
+	var e encoder
+	e.u32(0)
+	entries := dir.Entries()
+	for i := off; i < uint64(len(entries)); i++ {
+		name := entries[i]
+		child, ok := dir.Lookup(name)
+		if !ok {
+			continue
+		}
+		// qid[13] offset[8] type[1] name[s]
+		if len(e.b)-4+24+len(name) > int(count) {
+			break
+		}
+		typ := uint8(dtReg)
+		if _, ok := child.(fuse.Dir); ok {
+			typ = dtDir
+		}
+		c.qid(&e, child)
+		e.u64(i + 1)
+		e.u8(typ)
+		e.str(name)
+	}
+	binary.LittleEndian.PutUint32(e.b, uint32(len(e.b)-4))
+	return e.b, 0
+}
@@ -0,0 +1,269 @@
+package ninep
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"git.dolansoft.org/lorenz/winsysroot/fuse"
+)
+
+type testDir struct{ entries map[string]fuse.Node }
+
+func (d *testDir) Attr() fuse.Attr { return fuse.Attr{Mode: os.ModeDir | 0555} }
+
+func (d *testDir) Lookup(name string) (fuse.Node, bool) {
+	n, ok := d.entries[name]
+	return n, ok
+}
+
+func (d *testDir) Entries() []string {
+	var names []string
+	for name := range d.entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+type testFile []byte
+
+func (f *testFile) Attr() fuse.Attr {
+	return fuse.Attr{Mode: 0444, Size: int64(len(*f)), ModTime: time.Unix(1600000000, 0)}
+}
+
+func (f *testFile) Open() (fuse.Handle, error) {
+	return nopCloser{bytes.NewReader(*f)}, nil
+}
+
+type nopCloser struct{ *bytes.Reader }
+
+func (nopCloser) Close() error { return nil }
+
+// client sends requests one at a time.
+type client struct {
+	t *testing.T
+	c net.Conn
+}
+
+// call sends a request of type typ and returns the type and body of the
+// response.
+func (c *client) call(typ uint8, body []byte) (uint8, *decoder) {
+	c.t.Helper()
+	msg := make([]byte, 7, 7+len(body))
+	binary.LittleEndian.PutUint32(msg, uint32(7+len(body)))
+	msg[4] = typ
+	binary.LittleEndian.PutUint16(msg[5:], 1)
+	if _, err := c.c.Write(append(msg, body...)); err != nil {
+		c.t.Fatal(err)
+	}
+	var size [4]byte
+	if _, err := io.ReadFull(c.c, size[:]); err != nil {
+		c.t.Fatal(err)
+	}
+	resp := make([]byte, binary.LittleEndian.Uint32(size[:])-4)
+	if _, err := io.ReadFull(c.c, resp); err != nil {
+		c.t.Fatal(err)
+	}
+	if tag := binary.LittleEndian.Uint16(resp[1:]); tag != 1 {
+		c.t.Fatalf("response has tag %v", tag)
+	}
+	return resp[0], &decoder{b: resp[3:]}
+}
+
+// ok sends a request which must succeed.
+func (c *client) ok(typ uint8, e encoder) *decoder {
+	c.t.Helper()
+	rtyp, d := c.call(typ, e.b)
+	if rtyp == rlerror {
+		c.t.Fatalf("request %v failed with errno %v", typ, d.u32())
+	}
+	if rtyp != typ+1 {
+		c.t.Fatalf("request %v answered with %v", typ, rtyp)
+	}
+	return d
+}
+
+// fail sends a request which must fail with errno.
+func (c *client) fail(typ uint8, e encoder, errno uint32) {
+	c.t.Helper()
+	rtyp, d := c.call(typ, e.b)
+	if rtyp != rlerror {
+		c.t.Fatalf("request %v answered with %v, expected error %v", typ, rtyp, errno)
+	}
+	if got := d.u32(); got != errno {
+		c.t.Errorf("request %v failed with errno %v, expected %v", typ, got, errno)
+	}
+}
+
+func walk(fid, newfid uint32, names ...string) encoder {
+	var e encoder
+	e.u32(fid)
+	e.u32(newfid)
+	e.u16(uint16(len(names)))
+	for _, n := range names {
+		e.str(n)
+	}
+	return e
+}
+
+func fidRequest(fid uint32, rest ...uint64) encoder {
+	var e encoder
+	e.u32(fid)
+	for _, v := range rest {
+		e.u64(v)
+	}
+	return e
+}
+
+func TestServe(t *testing.T) {
+	big := make(testFile, 300<<10)
+	for i := range big {
+		big[i] = byte(i % 251)
+	}
+	small := testFile("hello")
+	root := &testDir{map[string]fuse.Node{
+		"a.txt": &small,
+		"sub":   &testDir{map[string]fuse.Node{"big.bin": &big}},
+	}}
+	s := NewServer(root, Options{ErrorLog: func(err error) { t.Error(err) }})
+	cc, sc := net.Pipe()
+	served := make(chan struct{})
+	go func() {
+		s.ServeConn(sc)
+		close(served)
+	}()
+	defer func() {
+		cc.Close()
+		<-served
+	}()
+	c := &client{t, cc}
+
+	var e encoder
+	e.u32(64 << 10)
+	e.str("9P2000.L")
+	d := c.ok(tversion, e)
+	if msize, v := d.u32(), d.str(); msize != 64<<10 || v != "9P2000.L" {
+		t.Fatalf("negotiated %v with msize %v", v, msize)
+	}
+	e = encoder{}
+	e.u32(0)
+	e.u32(noFid)
+	e.str("root")
+	e.str("")
+	e.u32(0)
+	if d := c.ok(tattach, e); d.next(1)[0] != qtDir {
+		t.Error("root is not a directory")
+	}
+
+	c.fail(twalk, walk(0, 1, "missing"), enoent)
+	d = c.ok(twalk, walk(0, 1, "sub", "big.bin", "x"))
+	if n := d.u16(); n != 2 {
+		t.Errorf("partial walk returned %v qids", n)
+	}
+	c.fail(tgetattr, fidRequest(1, getattrBasic), ebadf)
+
+	c.ok(twalk, walk(0, 1, "sub", "..", "sub", "big.bin"))
+	d = c.ok(tgetattr, fidRequest(1, getattrBasic))
+	d.u64()
+	d.next(13)
+	mode := d.u32()
+	d.next(4 + 4 + 8 + 8)
+	size := d.u64()
+	d.next(8 + 8 + 16)
+	mtime := d.u64()
+	if mode != 0100444 || size != uint64(len(big)) || mtime != 1600000000 {
+		t.Errorf("unexpected attributes mode %o, size %v, mtime %v", mode, size, mtime)
+	}
+	var flags encoder
+	flags.u32(1)
+	flags.u32(2) // O_RDWR
+	c.fail(tlopen, flags, erofs)
+	flags = encoder{}
+	flags.u32(1)
+	flags.u32(0)
+	c.ok(tlopen, flags)
+	var data []byte
+	for {
+		var req encoder
+		req.u32(1)
+		req.u64(uint64(len(data)))
+		req.u32(100 << 10)
+		d := c.ok(tread, req)
+		chunk := d.next(int(d.u32()))
+		if len(chunk) == 0 {
+			break
+		}
+		data = append(data, chunk...)
+	}
+	if !bytes.Equal(data, big) {
+		t.Errorf("read %v bytes of big.bin", len(data))
+	}
+	c.ok(tclunk, fidRequest(1))
+
+	c.ok(twalk, walk(0, 2))
+	flags = encoder{}
+	flags.u32(2)
+	flags.u32(0)
+	c.ok(tlopen, flags)
+	var names []string
+	for off := uint64(0); ; {
+		var req encoder
+		req.u32(2)
+		req.u64(off)
+		req.u32(40)
+		d := c.ok(treaddir, req)
+		entries := &decoder{b: d.next(int(d.u32()))}
+		if len(entries.b) == 0 {
+			break
+		}
+		for len(entries.b) > 0 {
+			entries.next(13)
+			off = entries.u64()
+			entries.next(1)
+			names = append(names, entries.str())
+		}
+	}
+	if !reflect.DeepEqual(names, []string{"a.txt", "sub"}) {
+		t.Errorf("unexpected entries %v", names)
+	}
+	c.fail(tremove, fidRequest(2), erofs)
+	c.fail(tclunk, fidRequest(2), ebadf)
+}
+
+func TestServeListener(t *testing.T) {
+	small := testFile("hello")
+	s := NewServer(&testDir{map[string]fuse.Node{"a.txt": &small}}, Options{})
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Skipf("listening is not possible here: %v", err)
+	}
+	served := make(chan error)
+	go func() { served <- s.Serve(ln) }()
+	cc, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &client{t, cc}
+	var e encoder
+	e.u32(8192)
+	e.str("9P2000")
+	if d := c.ok(tversion, e); d.u32() != 8192 || d.str() != "unknown" {
+		t.Error("expected unknown versions to be rejected")
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-served; err != nil {
+		t.Errorf("Serve returned %v", err)
+	}
+	if _, err := cc.Read(make([]byte, 1)); err == nil {
+		t.Error("expected connection to be closed")
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"git.dolansoft.org/lorenz/winsysroot/target"
+)
+
+var (
+	flagNuGetID      = flag.String("nuget-id", "WinSysroot", "ID of the package written by --out=nupkg:<path>")
+	flagNuGetVersion = flag.String("nuget-version", "", "Version of the package written by --out=nupkg:<path> (default: the Windows SDK version)")
+)
+
+var (
+	nugetIDRegexp      = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]*$`)
+	nugetVersionRegexp = regexp.MustCompile(`^[0-9]+(\.[0-9]+){1,3}(-[0-9A-Za-z.-]+)?(\+[0-9A-Za-z.-]+)?$`)
+)
+
+func init() {
+	// The package files are added by wrapping the target with
+	// newNuGetPackage once the integrity layer is in place.
+	target.Register("nupkg", func(location string) (target.Target, error) {
+		return target.NewZip(location)
+	})
+}
+
+// checkNuGetFlags validates the --nuget-* flags before anything is built.
+func checkNuGetFlags() error {
+	if !nugetIDRegexp.MatchString(*flagNuGetID) {
+		return fmt.Errorf("invalid NuGet package ID %q", *flagNuGetID)
+	}
+	if *flagNuGetVersion != "" && !nugetVersionRegexp.MatchString(*flagNuGetVersion) {
+		return fmt.Errorf("invalid NuGet package version %q", *flagNuGetVersion)
+	}
+	return nil
+}
+
+// nugetPackage wraps the zip archive of the nupkg scheme. It adds the
+// manifest and the OPC parts NuGet expects as well as MSBuild files adding
+// the include and library directories to C++ projects referencing the
+// package.
+type nugetPackage struct {
+	t     target.Target
+	files target.FileCreator
+	seen  sysrootPaths
+
+	mu sync.Mutex
+	// extensions of the files in the package, and the files without one,
+	// which need their content type listed individually.
+	extensions map[string]bool
+	bare       []string
+}
+
+func newNuGetPackage(t target.Target) *nugetPackage {
+	return &nugetPackage{t: t, files: target.Files(t), extensions: make(map[string]bool)}
+}
+
+func (n *nugetPackage) observe(p string) {
+	n.seen.observe(p)
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if ext := strings.ToLower(path.Ext(p)); ext != "" {
+		n.extensions[ext[1:]] = true
+	} else {
+		n.bare = append(n.bare, p)
+	}
+}
+
+func (n *nugetPackage) Create(p string, size int64, modTime time.Time) error {
+	n.observe(p)
+	return n.t.Create(p, size, modTime)
+}
+
+// CreateExecutable implements target.Executables.
+func (n *nugetPackage) CreateExecutable(p string, size int64, modTime time.Time) error {
+	n.observe(p)
+	return target.CreateExecutable(n.t, p, size, modTime)
+}
+
+// CreateFile implements target.FileCreator.
+func (n *nugetPackage) CreateFile(p string, size int64, modTime time.Time) (io.WriteCloser, error) {
+	n.observe(p)
+	return n.files.CreateFile(p, size, modTime)
+}
+
+func (n *nugetPackage) Write(p []byte) (int, error) {
+	return n.t.Write(p)
+}
+
+func (n *nugetPackage) Close() error {
+	if err := n.writeMetadata(); err != nil {
+		return fmt.Errorf("failed to write NuGet metadata: %w", err)
+	}
+	return n.t.Close()
+}
+
+func (n *nugetPackage) add(name string, data []byte) error {
+	if err := n.t.Create(name, int64(len(data)), time.Now()); err != nil {
+		return err
+	}
+	_, err := n.t.Write(data)
+	return err
+}
+
+// writeMetadata adds the nuspec, the MSBuild files and the OPC content types
+// and relationships.
+func (n *nugetPackage) writeMetadata() error {
+	if err := n.seen.check(); err != nil {
+		return err
+	}
+	id := *flagNuGetID
+	data := struct {
+		ID, Version, MSVCVersion, SDKVersion, Archs string
+	}{
+		ID:          id,
+		Version:     *flagNuGetVersion,
+		MSVCVersion: n.seen.msvcVersion,
+		SDKVersion:  n.seen.sdkVersion,
+		Archs:       strings.Join(n.seen.architectures(), ", "),
+	}
+	if data.Version == "" {
+		data.Version = n.seen.sdkVersion
+	}
+	for _, f := range []struct {
+		name string
+		tmpl *template.Template
+	}{
+		{id + ".nuspec", nugetSpec},
+		// NuGet imports the MSBuild files named after the package ID.
+		{"build/native/" + id + ".props", nugetProps},
+		{"build/native/" + id + ".targets", nugetTargets},
+	} {
+		name, tmpl := f.name, f.tmpl
+		n.observe(name)
+		var b bytes.Buffer
+		if err := tmpl.Execute(&b, &data); err != nil {
+			return err
+		}
+		if err := n.add(name, b.Bytes()); err != nil {
+			return err
+		}
+	}
+	rels := `<?xml version="1.0" encoding="utf-8"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+  <Relationship Type="http://schemas.microsoft.com/packaging/2010/07/manifest" Target="/` + id + `.nuspec" Id="R1" />
+</Relationships>
+`
+	if err := n.add("_rels/.rels", []byte(rels)); err != nil {
+		return err
+	}
+	return n.add("[Content_Types].xml", n.contentTypes())
+}
+
+// contentTypes returns the [Content_Types].xml of the package. NuGet itself
+// doesn't read the content types, but other OPC tools do.
+func (n *nugetPackage) contentTypes() []byte {
+	var b bytes.Buffer
+	b.WriteString(`<?xml version="1.0" encoding="utf-8"?>` + "\n")
+	b.WriteString(`<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` + "\n")
+	b.WriteString(`  <Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml" />` + "\n")
+	var exts []string
+	for ext := range n.extensions {
+		if ext != "rels" {
+			exts = append(exts, ext)
+		}
+	}
+	sort.Strings(exts)
+	for _, ext := range exts {
+		fmt.Fprintf(&b, "  <Default Extension=\"%v\" ContentType=\"application/octet\" />\n", xmlEscape(ext))
+	}
+	// The integrity layer adds its manifest after the package files.
+	bare := append(n.bare, target.IntegrityManifestName)
+	sort.Strings(bare)
+	for _, p := range bare {
+		segments := strings.Split(p, "/")
+		for i, s := range segments {
+			segments[i] = url.PathEscape(s)
+		}
+		fmt.Fprintf(&b, "  <Override PartName=\"/%v\" ContentType=\"application/octet\" />\n", xmlEscape(strings.Join(segments, "/")))
+	}
+	b.WriteString("</Types>\n")
+	return b.Bytes()
+}
+
+func xmlEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+var nugetSpec = template.Must(template.New("nuspec").Parse(`<?xml version="1.0" encoding="utf-8"?>
+<package xmlns="http://schemas.microsoft.com/packaging/2013/05/nuspec.xsd">
+  <metadata>
+    <id>{{.ID}}</id>
+    <version>{{.Version}}</version>
+    <authors>winsysroot</authors>
+    <description>Headers and libraries of MSVC {{.MSVCVersion}} and Windows SDK {{.SDKVersion}} for {{.Archs}}, generated by winsysroot. The licenses of Visual Studio and the Windows SDK were accepted when the package was built, they don't allow redistributing it.</description>
+    <tags>native msvc windows-sdk sysroot</tags>
+    <developmentDependency>true</developmentDependency>
+  </metadata>
+</package>
+`))
+
+var nugetProps = template.Must(template.New("props").Parse(`<?xml version="1.0" encoding="utf-8"?>
+<!-- MSVC {{.MSVCVersion}} and Windows SDK {{.SDKVersion}} for {{.Archs}} generated by winsysroot -->
+<Project xmlns="http://schemas.microsoft.com/developer/msbuild/2003">
+  <PropertyGroup>
+    <WinSysrootDir>$([System.IO.Path]::GetFullPath('$(MSBuildThisFileDirectory)..\..\'))</WinSysrootDir>
+    <WinSysrootMSVCVersion>{{.MSVCVersion}}</WinSysrootMSVCVersion>
+    <WinSysrootSDKVersion>{{.SDKVersion}}</WinSysrootSDKVersion>
+    <WinSysrootMSVCDir>$(WinSysrootDir)VC\Tools\MSVC\$(WinSysrootMSVCVersion)\</WinSysrootMSVCDir>
+    <WinSysrootSDKDir>$(WinSysrootDir)Windows Kits\10\</WinSysrootSDKDir>
+  </PropertyGroup>
+</Project>
+`))
+
+// nugetTargets sets the directories in a .targets file, as those are
+// imported after Microsoft.Cpp.props sets the defaults.
+var nugetTargets = template.Must(template.New("targets").Parse(`<?xml version="1.0" encoding="utf-8"?>
+<!-- MSVC {{.MSVCVersion}} and Windows SDK {{.SDKVersion}} for {{.Archs}} generated by winsysroot -->
+<Project xmlns="http://schemas.microsoft.com/developer/msbuild/2003">
+  <PropertyGroup>
+    <WinSysrootArch Condition="'$(WinSysrootArch)' == '' And '$(Platform)' == 'Win32'">x86</WinSysrootArch>
+    <WinSysrootArch Condition="'$(WinSysrootArch)' == ''">$(Platform.ToLowerInvariant())</WinSysrootArch>
+    <IncludePath>$(WinSysrootMSVCDir)include;$(WinSysrootSDKDir)Include\$(WinSysrootSDKVersion)\ucrt;$(WinSysrootSDKDir)Include\$(WinSysrootSDKVersion)\um;$(WinSysrootSDKDir)Include\$(WinSysrootSDKVersion)\shared;$(WinSysrootSDKDir)Include\$(WinSysrootSDKVersion)\winrt;$(WinSysrootSDKDir)Include\$(WinSysrootSDKVersion)\cppwinrt;$(IncludePath)</IncludePath>
+    <LibraryPath>$(WinSysrootMSVCDir)lib\$(WinSysrootArch);$(WinSysrootSDKDir)Lib\$(WinSysrootSDKVersion)\ucrt\$(WinSysrootArch);$(WinSysrootSDKDir)Lib\$(WinSysrootSDKVersion)\um\$(WinSysrootArch);$(LibraryPath)</LibraryPath>
+  </PropertyGroup>
+</Project>
+`))
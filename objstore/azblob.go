@@ -0,0 +1,195 @@
+package objstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// azureVersion is the version of the Blob Storage REST API used.
+const azureVersion = "2020-10-02"
+
+// azure uploads objects as block blobs, parts are staged as blocks which are
+// committed by complete.
+type azure struct {
+	client  *http.Client
+	account string
+	// blob is the URL of the uploaded blob.
+	blob string
+	sas  string
+	key  []byte
+	now  func() time.Time
+
+	blocks int
+}
+
+func newAzure(opts *Options, account, container, blob string) (*azure, error) {
+	a := &azure{
+		client:  opts.Client,
+		account: account,
+		sas:     strings.TrimPrefix(opts.Getenv("AZURE_STORAGE_SAS_TOKEN"), "?"),
+		now:     time.Now,
+	}
+	if key := opts.Getenv("AZURE_STORAGE_KEY"); key != "" {
+		var err error
+		if a.key, err = base64.StdEncoding.DecodeString(key); err != nil {
+			return nil, fmt.Errorf("invalid AZURE_STORAGE_KEY: %w", err)
+		}
+	}
+	if a.sas == "" && a.key == nil {
+		return nil, errors.New("uploading to Azure requires AZURE_STORAGE_SAS_TOKEN or AZURE_STORAGE_KEY")
+	}
+	endpoint := "https://" + account + ".blob.core.windows.net"
+	if e := opts.Getenv("AZURE_STORAGE_ENDPOINT"); e != "" {
+		endpoint = strings.TrimSuffix(e, "/")
+	}
+	segments := strings.Split(container+"/"+blob, "/")
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
+	}
+	a.blob = endpoint + "/" + strings.Join(segments, "/")
+	return a, nil
+}
+
+func (a *azure) request(ctx context.Context, method, suffix string, query url.Values, body []byte) (*http.Request, error) {
+	rawQuery := query.Encode()
+	if a.sas != "" {
+		if rawQuery != "" {
+			rawQuery += "&"
+		}
+		rawQuery += a.sas
+	}
+	u := a.blob + url.PathEscape(suffix)
+	if rawQuery != "" {
+		u += "?" + rawQuery
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("x-ms-version", azureVersion)
+	req.Header.Set("x-ms-date", a.now().UTC().Format(http.TimeFormat))
+	if len(body) > 0 {
+		sum := md5.Sum(body)
+		req.Header.Set("Content-MD5", base64.StdEncoding.EncodeToString(sum[:]))
+	}
+	if a.sas == "" {
+		a.sign(req, query, len(body))
+	}
+	return req, nil
+}
+
+// sign adds a Shared Key signature to req.
+func (a *azure) sign(req *http.Request, query url.Values, length int) {
+	contentLength := ""
+	if length > 0 {
+		contentLength = strconv.Itoa(length)
+	}
+	var msHeaders []string
+	for name := range req.Header {
+		if name := strings.ToLower(name); strings.HasPrefix(name, "x-ms-") {
+			msHeaders = append(msHeaders, name)
+		}
+	}
+	sort.Strings(msHeaders)
+	var b strings.Builder
+	for _, h := range []string{req.Method, "", "", contentLength, req.Header.Get("Content-MD5"), req.Header.Get("Content-Type"), "", "", "", "", "", ""} {
+		b.WriteString(h + "\n")
+	}
+	for _, name := range msHeaders {
+		b.WriteString(name + ":" + strings.TrimSpace(req.Header.Get(name)) + "\n")
+	}
+	b.WriteString("/" + a.account + req.URL.EscapedPath())
+	var keys []string
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		values := append([]string(nil), query[k]...)
+		sort.Strings(values)
+		b.WriteString("\n" + strings.ToLower(k) + ":" + strings.Join(values, ","))
+	}
+	h := hmac.New(sha256.New, a.key)
+	h.Write([]byte(b.String()))
+	req.Header.Set("Authorization", "SharedKey "+a.account+":"+base64.StdEncoding.EncodeToString(h.Sum(nil)))
+}
+
+// blockID returns the ID of the n-th block. All IDs need the same length.
+func blockID(n int) string {
+	return base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%08d", n)))
+}
+
+func (a *azure) start(ctx context.Context) error {
+	// Blocks are staged on first use, so just check access.
+	req, err := a.request(ctx, http.MethodGet, "", url.Values{"comp": {"blocklist"}, "blocklisttype": {"uncommitted"}}, nil)
+	if err != nil {
+		return err
+	}
+	_, _, err = do(a.client, req, http.StatusOK, http.StatusNotFound)
+	return err
+}
+
+func (a *azure) part(ctx context.Context, n int, offset int64, data []byte, last bool) error {
+	req, err := a.request(ctx, http.MethodPut, "", url.Values{"comp": {"block"}, "blockid": {blockID(n)}}, data)
+	if err != nil {
+		return err
+	}
+	_, _, err = do(a.client, req, http.StatusCreated)
+	if err == nil && n > a.blocks {
+		a.blocks = n
+	}
+	return err
+}
+
+func (a *azure) complete(ctx context.Context, sums *sums) error {
+	var body bytes.Buffer
+	body.WriteString(`<?xml version="1.0" encoding="utf-8"?><BlockList>`)
+	for n := 1; n <= a.blocks; n++ {
+		body.WriteString("<Latest>" + blockID(n) + "</Latest>")
+	}
+	body.WriteString("</BlockList>")
+	req, err := a.request(ctx, http.MethodPut, "", url.Values{"comp": {"blocklist"}}, body.Bytes())
+	if err != nil {
+		return err
+	}
+	req.Header.Set("x-ms-blob-content-md5", base64.StdEncoding.EncodeToString(sums.md5))
+	req.Header.Set("x-ms-meta-sha256", hex.EncodeToString(sums.sha256))
+	if a.sas == "" {
+		// Headers were added after signing.
+		a.sign(req, url.Values{"comp": {"blocklist"}}, body.Len())
+	}
+	_, _, err = do(a.client, req, http.StatusCreated)
+	return err
+}
+
+func (a *azure) abort(ctx context.Context) error {
+	// Uncommitted blocks are garbage collected by the service.
+	return nil
+}
+
+func (a *azure) put(ctx context.Context, suffix string, data []byte) error {
+	req, err := a.request(ctx, http.MethodPut, suffix, nil, data)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("x-ms-blob-type", "BlockBlob")
+	req.Header.Set("Content-Type", "text/plain")
+	if a.sas == "" {
+		a.sign(req, nil, len(data))
+	}
+	_, _, err = do(a.client, req, http.StatusCreated)
+	return err
+}
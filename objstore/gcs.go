@@ -0,0 +1,174 @@
+package objstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// gcsMetadataToken is where instances on Google Cloud get access tokens for
+// their service account.
+const gcsMetadataToken = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+
+// gcs uploads objects using resumable uploads of the Google Cloud Storage
+// JSON API. Parts are uploaded as chunks of one session.
+type gcs struct {
+	client   *http.Client
+	endpoint string
+	bucket   string
+	object   string
+	token    string
+
+	session string
+	result  []byte
+}
+
+func newGCS(opts *Options, bucket, object string) (*gcs, error) {
+	g := &gcs{
+		client:   opts.Client,
+		endpoint: "https://storage.googleapis.com",
+		bucket:   bucket,
+		object:   object,
+		token:    opts.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN"),
+	}
+	if host := opts.Getenv("STORAGE_EMULATOR_HOST"); host != "" {
+		if !strings.Contains(host, "://") {
+			host = "http://" + host
+		}
+		g.endpoint = strings.TrimSuffix(host, "/")
+	}
+	return g, nil
+}
+
+// metadataToken requests an access token from the metadata server.
+func (g *gcs) metadataToken(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, gcsMetadataToken, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	_, body, err := do(g.client, req, http.StatusOK)
+	if err != nil {
+		return fmt.Errorf("no GOOGLE_OAUTH_ACCESS_TOKEN set and no token from the metadata server: %w", err)
+	}
+	var res struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.Unmarshal(body, &res); err != nil || res.AccessToken == "" {
+		return errors.New("invalid token from the metadata server")
+	}
+	g.token = res.AccessToken
+	return nil
+}
+
+func (g *gcs) request(ctx context.Context, method, u string, body []byte) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if g.token != "" {
+		req.Header.Set("Authorization", "Bearer "+g.token)
+	}
+	return req, nil
+}
+
+// uploadURL returns the URL uploading the object with the given name.
+func (g *gcs) uploadURL(uploadType, name string) string {
+	return g.endpoint + "/upload/storage/v1/b/" + url.PathEscape(g.bucket) + "/o?" + url.Values{
+		"uploadType": {uploadType},
+		"name":       {name},
+	}.Encode()
+}
+
+func (g *gcs) start(ctx context.Context) error {
+	if g.token == "" && !strings.HasPrefix(g.endpoint, "http://") {
+		if err := g.metadataToken(ctx); err != nil {
+			return err
+		}
+	}
+	req, err := g.request(ctx, http.MethodPost, g.uploadURL("resumable", g.object), nil)
+	if err != nil {
+		return err
+	}
+	res, _, err := do(g.client, req, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	g.session = res.Header.Get("Location")
+	if g.session == "" {
+		return errors.New("no resumable upload session was returned")
+	}
+	return nil
+}
+
+func (g *gcs) part(ctx context.Context, n int, offset int64, data []byte, last bool) error {
+	req, err := g.request(ctx, http.MethodPut, g.session, data)
+	if err != nil {
+		return err
+	}
+	end := offset + int64(len(data))
+	switch {
+	case len(data) == 0:
+		req.Header.Set("Content-Range", fmt.Sprintf("bytes */%d", end))
+	case last:
+		req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, end-1, end))
+	default:
+		req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/*", offset, end-1))
+	}
+	if !last {
+		// 308 Permanent Redirect acknowledges an incomplete upload.
+		_, _, err = do(g.client, req, http.StatusPermanentRedirect)
+		return err
+	}
+	_, body, err := do(g.client, req, http.StatusOK, http.StatusCreated)
+	g.result = body
+	return err
+}
+
+func (g *gcs) complete(ctx context.Context, sums *sums) error {
+	// The upload is complete with the last part, verify its result.
+	var res struct {
+		Size    string `json:"size"`
+		MD5Hash string `json:"md5Hash"`
+	}
+	if err := json.Unmarshal(g.result, &res); err != nil {
+		return fmt.Errorf("invalid response to upload: %w", err)
+	}
+	if res.Size != fmt.Sprint(sums.size) {
+		return fmt.Errorf("uploaded object has %v bytes instead of %v", res.Size, sums.size)
+	}
+	// Composite objects have no MD5
+	if res.MD5Hash != "" && res.MD5Hash != base64.StdEncoding.EncodeToString(sums.md5) {
+		return errors.New("MD5 of the uploaded object does not match")
+	}
+	return nil
+}
+
+func (g *gcs) abort(ctx context.Context) error {
+	if g.session == "" {
+		return nil
+	}
+	req, err := g.request(ctx, http.MethodDelete, g.session, nil)
+	if err != nil {
+		return err
+	}
+	// 499 is returned for cancelled uploads.
+	_, _, err = do(g.client, req, 499, http.StatusNoContent, http.StatusOK)
+	return err
+}
+
+func (g *gcs) put(ctx context.Context, suffix string, data []byte) error {
+	req, err := g.request(ctx, http.MethodPost, g.uploadURL("media", g.object+suffix), data)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain")
+	_, _, err = do(g.client, req, http.StatusOK)
+	return err
+}
@@ -0,0 +1,161 @@
+package objstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// httpPut uploads objects to plain HTTP servers like Artifactory, Nexus or
+// WebDAV shares with a single streaming PUT request using chunked transfer
+// encoding. Parts are written to the request body as they come in.
+type httpPut struct {
+	client *http.Client
+	url    string
+	// mkcol creates the parent collections first, for WebDAV.
+	mkcol bool
+	auth  string
+
+	body *io.PipeWriter
+	done chan error
+	err  error
+}
+
+func newHTTPPut(opts *Options, u *url.URL) (*httpPut, error) {
+	h := &httpPut{client: opts.Client}
+	target := *u
+	switch u.Scheme {
+	case "dav":
+		target.Scheme, h.mkcol = "http", true
+	case "davs":
+		target.Scheme, h.mkcol = "https", true
+	}
+	// Credentials in the URL are moved to the header, so they don't end up
+	// in error messages.
+	if u.User != nil {
+		password, _ := u.User.Password()
+		h.auth = basicAuth(u.User.Username(), password)
+		target.User = nil
+	} else if token := opts.Getenv("WINSYSROOT_PUBLISH_TOKEN"); token != "" {
+		h.auth = "Bearer " + token
+	} else if user := opts.Getenv("WINSYSROOT_PUBLISH_USER"); user != "" {
+		h.auth = basicAuth(user, opts.Getenv("WINSYSROOT_PUBLISH_PASSWORD"))
+	}
+	h.url = target.String()
+	return h, nil
+}
+
+func basicAuth(user, password string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+password))
+}
+
+func (h *httpPut) request(ctx context.Context, method, url string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	if h.auth != "" {
+		req.Header.Set("Authorization", h.auth)
+	}
+	return req, nil
+}
+
+// makeCollections creates the collections the object is placed in. Existing
+// ones are answered with 405 Method Not Allowed.
+func (h *httpPut) makeCollections(ctx context.Context) error {
+	u, err := url.Parse(h.url)
+	if err != nil {
+		return err
+	}
+	dirs := strings.Split(strings.Trim(u.Path, "/"), "/")
+	for i := 1; i < len(dirs); i++ {
+		u.Path = "/" + strings.Join(dirs[:i], "/") + "/"
+		req, err := h.request(ctx, "MKCOL", u.String(), nil)
+		if err != nil {
+			return err
+		}
+		if _, _, err := do(h.client, req, http.StatusCreated, http.StatusMethodNotAllowed); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *httpPut) start(ctx context.Context) error {
+	if h.mkcol {
+		if err := h.makeCollections(ctx); err != nil {
+			return err
+		}
+	}
+	pr, pw := io.Pipe()
+	req, err := h.request(ctx, http.MethodPut, h.url, pr)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = -1
+	req.Header.Set("Content-Type", "application/octet-stream")
+	h.body = pw
+	h.done = make(chan error, 1)
+	go func() {
+		_, _, err := do(h.client, req, http.StatusOK, http.StatusCreated, http.StatusNoContent)
+		// Fails writes of parts if the server answered early.
+		if err != nil {
+			pr.CloseWithError(err)
+		} else {
+			pr.CloseWithError(errors.New("server answered before the upload was complete"))
+		}
+		h.done <- err
+	}()
+	return nil
+}
+
+// wait returns the result of the PUT request once it finished.
+func (h *httpPut) wait() error {
+	if h.done != nil {
+		h.err = <-h.done
+		h.done = nil
+	}
+	return h.err
+}
+
+func (h *httpPut) part(ctx context.Context, n int, offset int64, data []byte, last bool) error {
+	_, err := h.body.Write(data)
+	return err
+}
+
+func (h *httpPut) complete(ctx context.Context, sums *sums) error {
+	h.body.Close()
+	return h.wait()
+}
+
+func (h *httpPut) abort(ctx context.Context) error {
+	if h.body == nil {
+		return nil
+	}
+	// An incomplete chunked body is never stored. Deleting the object would
+	// remove a previous version instead.
+	h.body.CloseWithError(errors.New("upload aborted"))
+	h.wait()
+	return nil
+}
+
+func (h *httpPut) put(ctx context.Context, suffix string, data []byte) error {
+	u, err := url.Parse(h.url)
+	if err != nil {
+		return err
+	}
+	u.Path, u.RawPath = u.Path+suffix, ""
+	req, err := h.request(ctx, http.MethodPut, u.String(), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	// Artifactory verifies the upload against the checksum headers.
+	req.Header.Set("X-Checksum-Sha256", hexSHA256(data))
+	_, _, err = do(h.client, req, http.StatusOK, http.StatusCreated, http.StatusNoContent)
+	return err
+}
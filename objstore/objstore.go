@@ -0,0 +1,283 @@
+// Package objstore streams objects to Amazon S3, Google Cloud Storage and
+// Azure Blob Storage using their multipart upload APIs, or to plain HTTP
+// servers using a chunked PUT request, so that large outputs never need to
+// be stored locally.
+//
+// Objects are addressed by URLs of the form s3://bucket/key,
+// gs://bucket/object, azblob://account/container/blob or
+// https://host/path. dav:// and davs:// URLs are uploaded over HTTP(S) as
+// well, after creating the WebDAV collections on the path. Credentials are
+// taken from the environment variables the official tools use:
+//
+//   - S3: AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, AWS_SESSION_TOKEN and
+//     AWS_REGION (or AWS_DEFAULT_REGION). AWS_ENDPOINT_URL selects an
+//     S3-compatible service, which is then addressed path-style.
+//   - Google Cloud Storage: GOOGLE_OAUTH_ACCESS_TOKEN, otherwise a token is
+//     requested from the metadata server of the instance the upload runs
+//     on. STORAGE_EMULATOR_HOST selects another endpoint.
+//   - Azure: AZURE_STORAGE_SAS_TOKEN or AZURE_STORAGE_KEY.
+//     AZURE_STORAGE_ENDPOINT replaces https://<account>.blob.core.windows.net.
+//   - HTTP and WebDAV: the user info of the URL, otherwise
+//     WINSYSROOT_PUBLISH_TOKEN as bearer token or WINSYSROOT_PUBLISH_USER and
+//     WINSYSROOT_PUBLISH_PASSWORD for basic authentication.
+//
+// Each part is verified by the service using its MD5 where the API allows
+// it. Once the object is complete, its SHA256 is uploaded next to it with
+// the suffix .sha256 in the format of sha256sum.
+package objstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+)
+
+// DefaultPartSize is the size of the parts uploaded if Options.PartSize is
+// zero. With at most 10000 parts per S3 upload, it allows for objects of up
+// to 160GB.
+const DefaultPartSize = 16 << 20
+
+// Options configure an upload.
+type Options struct {
+	// Client is used for all requests, http.DefaultClient if nil.
+	Client *http.Client
+	// PartSize is the size of the parts the object is uploaded in. It must
+	// be at least 5MiB for S3 and a multiple of 256KiB for Google Cloud
+	// Storage.
+	PartSize int
+	// Getenv looks up credentials and endpoints, os.Getenv if nil.
+	Getenv func(key string) string
+}
+
+// backend implements the upload protocol of a service.
+type backend interface {
+	// start begins the upload.
+	start(ctx context.Context) error
+	// part uploads the n-th part (starting at 1), which starts at offset.
+	// All parts but the last have the same size.
+	part(ctx context.Context, n int, offset int64, data []byte, last bool) error
+	// complete finishes the upload, sums describe the whole object.
+	complete(ctx context.Context, sums *sums) error
+	// abort cancels an unfinished upload.
+	abort(ctx context.Context) error
+	// put uploads data as a separate object whose name is the one of the
+	// uploaded object with suffix appended.
+	put(ctx context.Context, suffix string, data []byte) error
+}
+
+// sums are the checksums of a complete object.
+type sums struct {
+	size   int64
+	md5    []byte
+	sha256 []byte
+}
+
+// Writer uploads an object written to it. Parts are uploaded in the
+// background while the next one is being written. The object only becomes
+// visible once Close succeeds.
+type Writer struct {
+	ctx  context.Context
+	b    backend
+	name string
+
+	buf      []byte
+	partSize int
+	n        int
+	offset   int64
+	md5      hash.Hash
+	sha256   hash.Hash
+
+	sum []byte
+
+	// pending receives the result of the part being uploaded, if any.
+	pending chan error
+	err     error
+}
+
+// NewWriter starts uploading the object at rawURL. Cancelling ctx aborts the
+// upload. If writing fails, Abort should be called to clean up the parts
+// uploaded so far.
+func NewWriter(ctx context.Context, rawURL string, opts Options) (*Writer, error) {
+	if opts.Client == nil {
+		opts.Client = http.DefaultClient
+	}
+	if opts.PartSize == 0 {
+		opts.PartSize = DefaultPartSize
+	}
+	if opts.Getenv == nil {
+		opts.Getenv = os.Getenv
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	p := strings.TrimPrefix(u.Path, "/")
+	if u.Host == "" || p == "" || strings.HasSuffix(p, "/") {
+		return nil, fmt.Errorf("object URL %q has no bucket or object name", rawURL)
+	}
+	var b backend
+	switch u.Scheme {
+	case "s3":
+		b, err = newS3(&opts, u.Host, p)
+	case "gs":
+		b, err = newGCS(&opts, u.Host, p)
+	case "azblob":
+		parts := strings.SplitN(p, "/", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return nil, fmt.Errorf("object URL %q is not in the form azblob://account/container/blob", rawURL)
+		}
+		b, err = newAzure(&opts, u.Host, parts[0], parts[1])
+	case "http", "https", "dav", "davs":
+		b, err = newHTTPPut(&opts, u)
+	default:
+		return nil, fmt.Errorf("unsupported object storage scheme %q, supported are s3, gs, azblob, http(s) and dav(s)", u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := b.start(ctx); err != nil {
+		return nil, fmt.Errorf("failed to start upload to %v: %w", rawURL, err)
+	}
+	return &Writer{
+		ctx:      ctx,
+		b:        b,
+		name:     path.Base(p),
+		buf:      make([]byte, 0, opts.PartSize),
+		partSize: opts.PartSize,
+		md5:      md5.New(),
+		sha256:   sha256.New(),
+	}, nil
+}
+
+func (w *Writer) Write(b []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	written := 0
+	for len(b) > 0 {
+		if len(w.buf) == w.partSize {
+			// Only upload once more data follows, so that the last part is
+			// known when it is uploaded.
+			w.flush(false)
+			if w.err != nil {
+				return written, w.err
+			}
+		}
+		n := copy(w.buf[len(w.buf):w.partSize], b)
+		w.buf = w.buf[:len(w.buf)+n]
+		w.md5.Write(b[:n])
+		w.sha256.Write(b[:n])
+		b = b[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// flush starts uploading the buffered part after the previous one has
+// finished. Errors are stored in w.err.
+func (w *Writer) flush(last bool) {
+	w.wait()
+	if w.err != nil {
+		return
+	}
+	w.n++
+	data, n, offset := w.buf, w.n, w.offset
+	w.offset += int64(len(data))
+	w.buf = make([]byte, 0, w.partSize)
+	w.pending = make(chan error, 1)
+	go func(pending chan<- error) {
+		err := w.b.part(w.ctx, n, offset, data, last)
+		if err != nil {
+			err = fmt.Errorf("failed to upload part %d: %w", n, err)
+		}
+		pending <- err
+	}(w.pending)
+}
+
+// wait waits for the part being uploaded.
+func (w *Writer) wait() {
+	if w.pending == nil {
+		return
+	}
+	if err := <-w.pending; err != nil && w.err == nil {
+		w.err = err
+	}
+	w.pending = nil
+}
+
+// Close uploads the last part, completes the upload and uploads the SHA256
+// of the object.
+func (w *Writer) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+	w.flush(true)
+	w.wait()
+	if w.err != nil {
+		return w.err
+	}
+	s := &sums{size: w.offset, md5: w.md5.Sum(nil), sha256: w.sha256.Sum(nil)}
+	if err := w.b.complete(w.ctx, s); err != nil {
+		w.err = fmt.Errorf("failed to complete upload: %w", err)
+		return w.err
+	}
+	sum := fmt.Sprintf("%x  %v\n", s.sha256, w.name)
+	if err := w.b.put(w.ctx, ".sha256", []byte(sum)); err != nil {
+		w.err = fmt.Errorf("failed to upload checksum: %w", err)
+		return w.err
+	}
+	w.sum = s.sha256
+	w.err = errors.New("write after close")
+	return nil
+}
+
+// SHA256 returns the SHA256 of the object once Close has succeeded.
+func (w *Writer) SHA256() []byte {
+	return w.sum
+}
+
+// Abort cancels the upload, discarding all parts uploaded so far.
+func (w *Writer) Abort(ctx context.Context) error {
+	w.wait()
+	w.err = errors.New("upload aborted")
+	return w.b.abort(ctx)
+}
+
+// do sends req and returns the response body if the status code is one of
+// ok. Other responses are returned as errors including the body, which
+// usually describes the problem.
+func do(client *http.Client, req *http.Request, ok ...int) (*http.Response, []byte, error) {
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, code := range ok {
+		if res.StatusCode == code {
+			return res, body, nil
+		}
+	}
+	// The query is left out as it can contain credentials.
+	return nil, nil, fmt.Errorf("%v %v%v: %v: %s", req.Method, req.URL.Host, req.URL.Path, res.Status, bytes.TrimSpace(body))
+}
+
+func hexSHA256(data []byte) string {
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:])
+}
@@ -0,0 +1,250 @@
+package objstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// s3 uploads objects using the S3 multipart upload API.
+type s3 struct {
+	client *http.Client
+	// base is the URL of the object, the bucket is part of either the host
+	// or the path.
+	base                          *url.URL
+	region                        string
+	accessKey, secretKey, session string
+	now                           func() time.Time
+
+	uploadID string
+	mu       sync.Mutex
+	etags    map[int]string
+}
+
+func newS3(opts *Options, bucket, key string) (*s3, error) {
+	s := &s3{
+		client:    opts.Client,
+		region:    opts.Getenv("AWS_REGION"),
+		accessKey: opts.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey: opts.Getenv("AWS_SECRET_ACCESS_KEY"),
+		session:   opts.Getenv("AWS_SESSION_TOKEN"),
+		now:       time.Now,
+		etags:     make(map[int]string),
+	}
+	if s.accessKey == "" || s.secretKey == "" {
+		return nil, errors.New("uploading to S3 requires AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+	if s.region == "" {
+		s.region = opts.Getenv("AWS_DEFAULT_REGION")
+	}
+	if s.region == "" {
+		s.region = "us-east-1"
+	}
+	var err error
+	if endpoint := opts.Getenv("AWS_ENDPOINT_URL"); endpoint != "" {
+		s.base, err = url.Parse(strings.TrimSuffix(endpoint, "/") + "/" + bucket + "/" + key)
+	} else {
+		s.base, err = url.Parse("https://" + bucket + ".s3." + s.region + ".amazonaws.com/" + key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// request creates a signed request for the object with the given key
+// suffix and query.
+func (s *s3) request(ctx context.Context, method, suffix string, query url.Values, body []byte) (*http.Request, error) {
+	u := *s.base
+	u.Path += suffix
+	u.RawQuery = strings.Replace(query.Encode(), "+", "%20", -1)
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		sum := md5.Sum(body)
+		req.Header.Set("Content-MD5", base64.StdEncoding.EncodeToString(sum[:]))
+	}
+	s.sign(req, hexSHA256(body))
+	return req, nil
+}
+
+// sign adds an AWS Signature Version 4 to req covering all of its headers.
+func (s *s3) sign(req *http.Request, payloadHash string) {
+	now := s.now().UTC()
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if s.session != "" {
+		req.Header.Set("X-Amz-Security-Token", s.session)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	var names []string
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	query := req.URL.Query()
+	var keys []string
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var canonicalQuery []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			canonicalQuery = append(canonicalQuery, awsEscape(k, true)+"="+awsEscape(v, true))
+		}
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		awsEscape(req.URL.Path, false),
+		strings.Join(canonicalQuery, "&"),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + now.Format("20060102T150405Z") + "\n" + scope + "\n" + hexSHA256([]byte(canonicalRequest))
+	key := []byte("AWS4" + s.secretKey)
+	for _, part := range []string{date, s.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%v/%v, SignedHeaders=%v, Signature=%v", s.accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// awsEscape percent-encodes everything but unreserved characters, and
+// slashes if they are not part of a query.
+func awsEscape(s string, query bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' || c == '/' && !query {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func (s *s3) start(ctx context.Context) error {
+	req, err := s.request(ctx, http.MethodPost, "", url.Values{"uploads": {""}}, nil)
+	if err != nil {
+		return err
+	}
+	_, body, err := do(s.client, req, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	var res struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.Unmarshal(body, &res); err != nil || res.UploadID == "" {
+		return fmt.Errorf("invalid response to creating multipart upload: %s", body)
+	}
+	s.uploadID = res.UploadID
+	return nil
+}
+
+func (s *s3) part(ctx context.Context, n int, offset int64, data []byte, last bool) error {
+	req, err := s.request(ctx, http.MethodPut, "", url.Values{
+		"partNumber": {strconv.Itoa(n)},
+		"uploadId":   {s.uploadID},
+	}, data)
+	if err != nil {
+		return err
+	}
+	res, _, err := do(s.client, req, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.etags[n] = res.Header.Get("ETag")
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *s3) complete(ctx context.Context, sums *sums) error {
+	type part struct {
+		PartNumber int
+		ETag       string
+	}
+	var doc struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []part   `xml:"Part"`
+	}
+	s.mu.Lock()
+	for n := 1; n <= len(s.etags); n++ {
+		doc.Parts = append(doc.Parts, part{n, s.etags[n]})
+	}
+	s.mu.Unlock()
+	raw, err := xml.Marshal(&doc)
+	if err != nil {
+		return err
+	}
+	req, err := s.request(ctx, http.MethodPost, "", url.Values{"uploadId": {s.uploadID}}, raw)
+	if err != nil {
+		return err
+	}
+	_, body, err := do(s.client, req, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	// Errors can also be reported after the response has started.
+	if bytes.Contains(body, []byte("<Error>")) {
+		return fmt.Errorf("failed to complete multipart upload: %s", body)
+	}
+	return nil
+}
+
+func (s *s3) abort(ctx context.Context) error {
+	req, err := s.request(ctx, http.MethodDelete, "", url.Values{"uploadId": {s.uploadID}}, nil)
+	if err != nil {
+		return err
+	}
+	_, _, err = do(s.client, req, http.StatusNoContent, http.StatusOK)
+	return err
+}
+
+func (s *s3) put(ctx context.Context, suffix string, data []byte) error {
+	req, err := s.request(ctx, http.MethodPut, suffix, nil, data)
+	if err != nil {
+		return err
+	}
+	_, _, err = do(s.client, req, http.StatusOK)
+	return err
+}
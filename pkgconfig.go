@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func init() {
+	subcommands = append(subcommands, &subcommand{
+		name:  "pkg-config",
+		short: "Generate pkg-config files for Windows SDK libraries in a sysroot directory",
+		setup: setupPkgConfig,
+	})
+}
+
+// pkgConfigLibs are the import libraries pkg-config files are generated for
+// if the sysroot contains them.
+var pkgConfigLibs = []string{
+	"advapi32", "bcrypt", "comctl32", "comdlg32", "crypt32", "d2d1", "d3d11",
+	"d3d12", "d3dcompiler", "dbghelp", "dwmapi", "dwrite", "dxgi", "dxguid",
+	"gdi32", "hid", "imm32", "iphlpapi", "kernel32", "mfplat", "mfreadwrite",
+	"mfuuid", "ncrypt", "netapi32", "ntdll", "ole32", "oleaut32", "opengl32",
+	"psapi", "rpcrt4", "secur32", "setupapi", "shell32", "shlwapi", "user32",
+	"userenv", "uuid", "uxtheme", "version", "winhttp", "wininet", "winmm",
+	"ws2_32", "wtsapi32", "xinput",
+}
+
+// pkgConfigBase is the name of the package all others require, carrying the
+// include and library directories.
+const pkgConfigBase = "winsysroot"
+
+func setupPkgConfig(fs *flag.FlagSet) func(ctx context.Context) error {
+	outDir := fs.String("out", "pkgconfig-winsysroot", "Directory to write a directory of .pc files per architecture to")
+	archs := fs.String("architectures", "", "Comma-separated list of architectures to generate pkg-config files for (default: all in the sysroot)")
+	return func(ctx context.Context) error {
+		if fs.NArg() != 1 {
+			return stageErrorf(stageUsage, "", "", "usage: winsysroot pkg-config [flags] <sysroot-dir>")
+		}
+		return runPkgConfig(fs.Arg(0), *outDir, *archs)
+	}
+}
+
+func runPkgConfig(sysrootDir, outDir, archs string) error {
+	info, err := inspectSysroot(sysrootDir)
+	if err != nil {
+		return stageErrorf(stageUsage, "", "", "%w", err)
+	}
+	architectures := info.Architectures
+	if archs != "" {
+		architectures = strings.Split(archs, ",")
+		for _, arch := range architectures {
+			if !info.hasArch(arch) {
+				return stageErrorf(stageUsage, "", "", "sysroot does not contain %v, available are %v", arch, strings.Join(info.Architectures, ", "))
+			}
+		}
+	}
+	outDir, err = filepath.Abs(outDir)
+	if err != nil {
+		return stageErrorf(stageOutput, "", "", "%w", err)
+	}
+	for _, arch := range architectures {
+		dir := filepath.Join(outDir, arch)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return stageErrorf(stageOutput, "", "", "%w", err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, pkgConfigBase+".pc"), []byte(info.pkgConfigFile(arch)), 0644); err != nil {
+			return stageErrorf(stageOutput, "", "", "%w", err)
+		}
+		// Library names in the SDK are not consistently cased.
+		present := make(map[string]bool)
+		for _, libDir := range info.libDirs(arch) {
+			entries, err := ioutil.ReadDir(libDir)
+			if err != nil {
+				continue
+			}
+			for _, fi := range entries {
+				present[strings.ToLower(fi.Name())] = true
+			}
+		}
+		var written int
+		for _, lib := range pkgConfigLibs {
+			if !present[lib+".lib"] {
+				continue
+			}
+			if err := ioutil.WriteFile(filepath.Join(dir, lib+".pc"), []byte(pkgConfigLib(lib)), 0644); err != nil {
+				return stageErrorf(stageOutput, "", "", "%w", err)
+			}
+			written++
+		}
+		log.Printf("Wrote %d pkg-config files for %v to %v", written+1, arch, dir)
+	}
+	log.Printf("Use them with: PKG_CONFIG_LIBDIR=%v", filepath.Join(outDir, architectures[0]))
+	return nil
+}
+
+// pkgConfigFile returns the pkg-config file adding the include and library
+// directories of the sysroot for arch.
+func (s *sysrootInfo) pkgConfigFile(arch string) string {
+	var cflags, libs []string
+	for _, d := range s.includeDirs() {
+		cflags = append(cflags, s.pkgConfigDir("-I", d))
+	}
+	for _, d := range s.libDirs(arch) {
+		libs = append(libs, s.pkgConfigDir("-L", d))
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Generated by winsysroot\n")
+	fmt.Fprintf(&b, "prefix=%v\n\n", filepath.ToSlash(s.Root))
+	fmt.Fprintf(&b, "Name: %v\n", pkgConfigBase)
+	fmt.Fprintf(&b, "Description: MSVC %v and Windows SDK %v for %v\n", s.MSVCVersion, s.SDKVersion, arch)
+	fmt.Fprintf(&b, "Version: %v\n", s.SDKVersion)
+	fmt.Fprintf(&b, "Cflags: %v\n", strings.Join(cflags, " "))
+	fmt.Fprintf(&b, "Libs: %v\n", strings.Join(libs, " "))
+	return b.String()
+}
+
+// pkgConfigLib returns the pkg-config file for the import library lib.
+func pkgConfigLib(lib string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Generated by winsysroot\n")
+	fmt.Fprintf(&b, "Name: %v\n", lib)
+	fmt.Fprintf(&b, "Description: Windows import library %v.lib\n", lib)
+	fmt.Fprintf(&b, "Version: 10.0\n")
+	fmt.Fprintf(&b, "Requires: %v\n", pkgConfigBase)
+	fmt.Fprintf(&b, "Libs: -l%v\n", lib)
+	return b.String()
+}
+
+// pkgConfigDir returns the flag opt for the directory dir relative to
+// ${prefix}. pkg-config splits flags after expanding variables, so they are
+// quoted as the paths below "Windows Kits" contain spaces.
+func (s *sysrootInfo) pkgConfigDir(opt, dir string) string {
+	rel, err := filepath.Rel(s.Root, dir)
+	if err != nil {
+		rel = dir
+	}
+	return `"` + opt + "${prefix}/" + filepath.ToSlash(rel) + `"`
+}
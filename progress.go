@@ -0,0 +1,60 @@
+package main
+
+import (
+	"log"
+	"path"
+
+	"git.dolansoft.org/lorenz/winsysroot/manifest"
+	"git.dolansoft.org/lorenz/winsysroot/sysroot"
+)
+
+// logEvents logs build progress for --progress.
+type logEvents struct {
+	downloadedBytes int64
+	extractedFiles  int
+	extractedBytes  int64
+	// Last logged tenth of the extraction of each large archive
+	extractSteps map[string]int64
+}
+
+// minProgressSize is the size above which the extraction progress of an
+// archive is logged.
+const minProgressSize = 100 << 20
+
+func (e *logEvents) PackageResolved(pkg manifest.Package) {
+	log.Printf("Selected package %s %s", pkg.ID, pkg.Version)
+}
+
+func (e *logEvents) DownloadStarted(pkg manifest.Package, url string, size int64) {}
+
+func (e *logEvents) DownloadFinished(pkg manifest.Package, url string, bytes int64) {
+	e.downloadedBytes += bytes
+	log.Printf("Downloaded %s (%.1f MiB, %.1f MiB total, %d files extracted so far)", path.Base(url), float64(bytes)/(1<<20), float64(e.downloadedBytes)/(1<<20), e.extractedFiles)
+}
+
+func (e *logEvents) FileExtracted(path string, size int64) {
+	e.extractedFiles++
+	e.extractedBytes += size
+}
+
+func (e *logEvents) ExtractProgress(pkg manifest.Package, url string, done, total int64) {
+	if total < minProgressSize {
+		return
+	}
+	step := done * 10 / total
+	if step <= e.extractSteps[url] {
+		return
+	}
+	if e.extractSteps == nil {
+		e.extractSteps = make(map[string]int64)
+	}
+	e.extractSteps[url] = step
+	log.Printf("Extracting %s: %.0f of %.0f MiB", path.Base(url), float64(done)/(1<<20), float64(total)/(1<<20))
+}
+
+func buildEvents() sysroot.Events {
+	if *flagProgress {
+		return &logEvents{}
+	}
+	return nil
+}
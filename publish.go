@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+func init() {
+	subcommands = append(subcommands, &subcommand{
+		name:  "publish",
+		short: "Upload archives and their checksums to a GitHub release or an HTTP server",
+		setup: setupPublish,
+	})
+}
+
+// publishChecksums is the name of the checksum file uploaded with the
+// published files, in the format of sha256sum.
+const publishChecksums = "SHA256SUMS"
+
+func setupPublish(fs *flag.FlagSet) func(ctx context.Context) error {
+	repo := fs.String("github-repo", "", "Publish to a release of this GitHub repository (owner/name), authenticated by $GITHUB_TOKEN")
+	tag := fs.String("tag", "", "Tag of the GitHub release, which is created if it doesn't exist")
+	api := fs.String("github-api", "https://api.github.com", "URL of the GitHub API, for GitHub Enterprise")
+	baseURL := fs.String("url", "", "Publish by PUTting each file below this URL instead, authenticated by $WINSYSROOT_PUBLISH_TOKEN or $WINSYSROOT_PUBLISH_USER and $WINSYSROOT_PUBLISH_PASSWORD if set")
+	replace := fs.Bool("replace", false, "Replace files which already exist in the GitHub release")
+	registerHTTPFlags(fs)
+	return func(ctx context.Context) error {
+		if fs.NArg() == 0 {
+			return stageErrorf(stageUsage, "", "", "usage: winsysroot publish (--github-repo owner/name --tag tag | --url url) <file>...")
+		}
+		files, err := publishFiles(fs.Args())
+		if err != nil {
+			return stageErrorf(stageUsage, "", "", "%w", err)
+		}
+		hc, err := httpClient()
+		if err != nil {
+			return stageErrorf(stageUsage, "", "", "%w", err)
+		}
+		switch {
+		case *repo != "" && *baseURL == "":
+			if *tag == "" {
+				return stageErrorf(stageUsage, "", "", "--github-repo requires --tag")
+			}
+			token := os.Getenv("GITHUB_TOKEN")
+			if token == "" {
+				return stageErrorf(stageUsage, "", "", "publishing to GitHub requires $GITHUB_TOKEN")
+			}
+			gh := &githubRelease{client: hc, api: strings.TrimSuffix(*api, "/"), repo: *repo, tag: *tag, token: token}
+			err = gh.publish(ctx, files, *replace)
+		case *baseURL != "" && *repo == "":
+			err = publishHTTP(ctx, hc, *baseURL, files)
+		default:
+			return stageErrorf(stageUsage, "", "", "pass either --github-repo or --url")
+		}
+		if err != nil {
+			return stageErrorf(stageOutput, "", "", "%w", err)
+		}
+		return nil
+	}
+}
+
+// publishedFile is a file to publish, content is set for generated files.
+type publishedFile struct {
+	name    string
+	path    string
+	content []byte
+	sha256  []byte
+}
+
+func (f *publishedFile) open() (io.ReadCloser, int64, error) {
+	if f.content != nil {
+		return ioutil.NopCloser(bytes.NewReader(f.content)), int64(len(f.content)), nil
+	}
+	file, err := os.Open(f.path)
+	if err != nil {
+		return nil, 0, err
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+	return file, fi.Size(), nil
+}
+
+// publishFiles returns the files at paths along with a checksum file
+// covering them.
+func publishFiles(paths []string) ([]*publishedFile, error) {
+	var files []*publishedFile
+	var sums []string
+	seen := make(map[string]bool)
+	for _, p := range paths {
+		name := filepath.Base(p)
+		if seen[name] || name == publishChecksums {
+			return nil, fmt.Errorf("file name %v is used more than once", name)
+		}
+		seen[name] = true
+		sum, err := hashFile(p)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, &publishedFile{name: name, path: p, sha256: sum})
+		sums = append(sums, fmt.Sprintf("%x  %v\n", sum, name))
+	}
+	sort.Strings(sums)
+	content := []byte(strings.Join(sums, ""))
+	sum := sha256.Sum256(content)
+	files = append(files, &publishedFile{name: publishChecksums, content: content, sha256: sum[:]})
+	return files, nil
+}
+
+// publishHTTP uploads files with PUT requests below baseURL. Artifactory
+// verifies them using the checksum header, other servers ignore it.
+func publishHTTP(ctx context.Context, client *http.Client, baseURL string, files []*publishedFile) error {
+	base := strings.TrimSuffix(baseURL, "/") + "/"
+	for _, f := range files {
+		body, size, err := f.open()
+		if err != nil {
+			return err
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPut, base+url.PathEscape(f.name), body)
+		if err != nil {
+			body.Close()
+			return err
+		}
+		req.ContentLength = size
+		req.Header.Set("X-Checksum-Sha256", fmt.Sprintf("%x", f.sha256))
+		if token := os.Getenv("WINSYSROOT_PUBLISH_TOKEN"); token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		} else if user := os.Getenv("WINSYSROOT_PUBLISH_USER"); user != "" {
+			req.SetBasicAuth(user, os.Getenv("WINSYSROOT_PUBLISH_PASSWORD"))
+		}
+		if _, err := publishDo(client, req, http.StatusOK, http.StatusCreated, http.StatusNoContent); err != nil {
+			return err
+		}
+		log.Printf("Published %v", base+f.name)
+	}
+	return nil
+}
+
+// publishDo sends req and returns the response body if the status is one of
+// ok.
+func publishDo(client *http.Client, req *http.Request, ok ...int) ([]byte, error) {
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	for _, code := range ok {
+		if res.StatusCode == code {
+			return body, nil
+		}
+	}
+	return nil, fmt.Errorf("%v %v: %v: %s", req.Method, req.URL, res.Status, bytes.TrimSpace(body))
+}
+
+// githubRelease publishes files as assets of a GitHub release.
+type githubRelease struct {
+	client *http.Client
+	api    string
+	repo   string
+	tag    string
+	token  string
+}
+
+type githubReleaseInfo struct {
+	ID        int64  `json:"id"`
+	UploadURL string `json:"upload_url"`
+	HTMLURL   string `json:"html_url"`
+	Assets    []struct {
+		ID   int64  `json:"id"`
+		Name string `json:"name"`
+	} `json:"assets"`
+}
+
+func (g *githubRelease) request(ctx context.Context, method, u string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Authorization", "Bearer "+g.token)
+	return req, nil
+}
+
+// release returns the release for the tag, creating it if necessary.
+func (g *githubRelease) release(ctx context.Context) (*githubReleaseInfo, error) {
+	req, err := g.request(ctx, http.MethodGet, g.api+"/repos/"+g.repo+"/releases/tags/"+url.PathEscape(g.tag), nil)
+	if err != nil {
+		return nil, err
+	}
+	body, err := publishDo(g.client, req, http.StatusOK, http.StatusNotFound)
+	if err != nil {
+		return nil, err
+	}
+	var info githubReleaseInfo
+	if json.Unmarshal(body, &info) == nil && info.ID != 0 {
+		return &info, nil
+	}
+	create, err := json.Marshal(map[string]string{"tag_name": g.tag, "name": g.tag})
+	if err != nil {
+		return nil, err
+	}
+	req, err = g.request(ctx, http.MethodPost, g.api+"/repos/"+g.repo+"/releases", bytes.NewReader(create))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if body, err = publishDo(g.client, req, http.StatusCreated); err != nil {
+		return nil, fmt.Errorf("failed to create release: %w", err)
+	}
+	if err := json.Unmarshal(body, &info); err != nil {
+		return nil, fmt.Errorf("invalid release: %w", err)
+	}
+	log.Printf("Created release %v", g.tag)
+	return &info, nil
+}
+
+// publish uploads files as assets of the release. Existing assets are only
+// replaced if replace is set, and only after the new file has been uploaded
+// under a temporary name, so a failed upload leaves the old one in place.
+func (g *githubRelease) publish(ctx context.Context, files []*publishedFile, replace bool) error {
+	info, err := g.release(ctx)
+	if err != nil {
+		return err
+	}
+	existing := make(map[string]int64)
+	for _, a := range info.Assets {
+		existing[a.Name] = a.ID
+	}
+	for _, f := range files {
+		if _, ok := existing[f.name]; ok && !replace {
+			return fmt.Errorf("release %v already contains %v, pass --replace to overwrite it", g.tag, f.name)
+		}
+	}
+	// The upload URL is a template like .../assets{?name,label}
+	uploadURL := info.UploadURL
+	if i := strings.Index(uploadURL, "{"); i >= 0 {
+		uploadURL = uploadURL[:i]
+	}
+	for _, f := range files {
+		oldID, ok := existing[f.name]
+		if !ok {
+			if _, err := g.upload(ctx, uploadURL, f, f.name); err != nil {
+				return err
+			}
+			log.Printf("Published %v to release %v", f.name, g.tag)
+			continue
+		}
+		// Asset names are unique, so the new file is uploaded under a
+		// temporary name and renamed once the old one is deleted.
+		tmpName := f.name + ".partial"
+		if id, ok := existing[tmpName]; ok {
+			// Left over from an interrupted replacement
+			if err := g.deleteAsset(ctx, id); err != nil {
+				return fmt.Errorf("failed to delete %v: %w", tmpName, err)
+			}
+		}
+		newID, err := g.upload(ctx, uploadURL, f, tmpName)
+		if err != nil {
+			return err
+		}
+		if err := g.deleteAsset(ctx, oldID); err != nil {
+			return fmt.Errorf("failed to delete existing %v, the new one was uploaded as %v: %w", f.name, tmpName, err)
+		}
+		if err := g.renameAsset(ctx, newID, f.name); err != nil {
+			return fmt.Errorf("failed to rename %v to %v: %w", tmpName, f.name, err)
+		}
+		log.Printf("Replaced %v in release %v", f.name, g.tag)
+	}
+	if info.HTMLURL != "" {
+		log.Printf("Release: %v", info.HTMLURL)
+	}
+	return nil
+}
+
+// upload uploads f as asset name and returns the ID of the new asset.
+func (g *githubRelease) upload(ctx context.Context, uploadURL string, f *publishedFile, name string) (int64, error) {
+	body, size, err := f.open()
+	if err != nil {
+		return 0, err
+	}
+	req, err := g.request(ctx, http.MethodPost, uploadURL+"?"+url.Values{"name": {name}}.Encode(), body)
+	if err != nil {
+		body.Close()
+		return 0, err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/octet-stream")
+	res, err := publishDo(g.client, req, http.StatusCreated)
+	if err != nil {
+		return 0, fmt.Errorf("failed to upload %v: %w", f.name, err)
+	}
+	var asset struct {
+		ID int64 `json:"id"`
+	}
+	if err := json.Unmarshal(res, &asset); err != nil {
+		return 0, fmt.Errorf("invalid asset for %v: %w", f.name, err)
+	}
+	return asset.ID, nil
+}
+
+func (g *githubRelease) deleteAsset(ctx context.Context, id int64) error {
+	req, err := g.request(ctx, http.MethodDelete, fmt.Sprintf("%v/repos/%v/releases/assets/%d", g.api, g.repo, id), nil)
+	if err != nil {
+		return err
+	}
+	_, err = publishDo(g.client, req, http.StatusNoContent)
+	return err
+}
+
+func (g *githubRelease) renameAsset(ctx context.Context, id int64, name string) error {
+	patch, err := json.Marshal(map[string]string{"name": name})
+	if err != nil {
+		return err
+	}
+	req, err := g.request(ctx, http.MethodPatch, fmt.Sprintf("%v/repos/%v/releases/assets/%d", g.api, g.repo, id), bytes.NewReader(patch))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	_, err = publishDo(g.client, req, http.StatusOK)
+	return err
+}
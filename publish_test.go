@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestGitHubReplace(t *testing.T) {
+	for _, failUpload := range []bool{false, true} {
+		var calls []string
+		var srv *httptest.Server
+		srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			call := req.Method + " " + req.URL.Path
+			if name := req.URL.Query().Get("name"); name != "" {
+				call += "?name=" + name
+			}
+			calls = append(calls, call)
+			switch {
+			case req.Method == http.MethodGet:
+				fmt.Fprintf(w, `{"id": 1, "upload_url": "%v/upload{?name,label}", "assets": [{"id": 10, "name": "sysroot.tar.zst"}]}`, srv.URL)
+			case req.Method == http.MethodPost && failUpload:
+				w.WriteHeader(http.StatusInternalServerError)
+			case req.Method == http.MethodPost:
+				w.WriteHeader(http.StatusCreated)
+				fmt.Fprint(w, `{"id": 11}`)
+			case req.Method == http.MethodDelete:
+				w.WriteHeader(http.StatusNoContent)
+			case req.Method == http.MethodPatch:
+				fmt.Fprint(w, `{"id": 11, "name": "sysroot.tar.zst"}`)
+			}
+		}))
+		g := &githubRelease{client: srv.Client(), api: srv.URL, repo: "o/r", tag: "v1"}
+		err := g.publish(context.Background(), []*publishedFile{{name: "sysroot.tar.zst", content: []byte("new")}}, true)
+		want := []string{
+			"GET /repos/o/r/releases/tags/v1",
+			"POST /upload?name=sysroot.tar.zst.partial",
+			"DELETE /repos/o/r/releases/assets/10",
+			"PATCH /repos/o/r/releases/assets/11",
+		}
+		if failUpload {
+			// The existing asset is kept.
+			want = want[:2]
+			if err == nil {
+				t.Error("publish succeeded despite failed upload")
+			}
+		} else if err != nil {
+			t.Errorf("publish: %v", err)
+		}
+		if !reflect.DeepEqual(calls, want) {
+			t.Errorf("failUpload=%v: got requests %q, want %q", failUpload, calls, want)
+		}
+	}
+}
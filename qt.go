@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+func init() {
+	subcommands = append(subcommands, &subcommand{
+		name:  "qt",
+		short: "Generate qbs profiles and qmake mkspecs for cross-compiling Qt projects with a sysroot directory",
+		setup: setupQt,
+	})
+}
+
+// qbsArchs maps architectures of the sysroot to qbs.architecture.
+var qbsArchs = map[string]string{
+	"x86":   "x86",
+	"x64":   "x86_64",
+	"arm":   "armv7",
+	"arm64": "arm64",
+}
+
+func setupQt(fs *flag.FlagSet) func(ctx context.Context) error {
+	outDir := fs.String("out", "qt-winsysroot", "Directory to write the qbs profiles and qmake mkspecs to")
+	archs := fs.String("architectures", "", "Comma-separated list of architectures to generate profiles for (default: all in the sysroot)")
+	qtMkspecs := fs.String("qt-mkspecs", "", "mkspecs directory of the host Qt, whose win32-clang-msvc mkspec is extended (default: from qmake -query if qmake is in PATH)")
+	return func(ctx context.Context) error {
+		if fs.NArg() != 1 {
+			return stageErrorf(stageUsage, "", "", "usage: winsysroot qt [flags] <sysroot-dir>")
+		}
+		return runQt(fs.Arg(0), *outDir, *archs, *qtMkspecs)
+	}
+}
+
+func runQt(sysrootDir, outDir, archs, qtMkspecs string) error {
+	info, err := inspectSysroot(sysrootDir)
+	if err != nil {
+		return stageErrorf(stageUsage, "", "", "%w", err)
+	}
+	info.useBundledLLVM()
+	var architectures []string
+	if archs != "" {
+		for _, arch := range strings.Split(archs, ",") {
+			if _, ok := qbsArchs[arch]; !ok {
+				return stageErrorf(stageUsage, "", "", "qbs and qmake do not support %v", arch)
+			}
+			if !info.hasArch(arch) {
+				return stageErrorf(stageUsage, "", "", "sysroot does not contain %v, available are %v", arch, strings.Join(info.Architectures, ", "))
+			}
+			architectures = append(architectures, arch)
+		}
+	} else {
+		for _, arch := range info.Architectures {
+			if _, ok := qbsArchs[arch]; ok {
+				architectures = append(architectures, arch)
+			}
+		}
+	}
+	if len(architectures) == 0 {
+		return stageErrorf(stageUsage, "", "", "sysroot contains no architecture supported by qbs and qmake, available are %v", strings.Join(info.Architectures, ", "))
+	}
+	outDir, err = filepath.Abs(outDir)
+	if err != nil {
+		return stageErrorf(stageOutput, "", "", "%w", err)
+	}
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		return stageErrorf(stageOutput, "", "", "%w", err)
+	}
+
+	qbsConf := filepath.Join(outDir, "qbs-profiles.conf")
+	if err := ioutil.WriteFile(qbsConf, []byte(info.qbsProfiles(architectures)), 0644); err != nil {
+		return stageErrorf(stageOutput, "", "", "%w", err)
+	}
+	log.Printf("Wrote qbs profiles winsysroot-{%v}, import them with: qbs config --import %v", strings.Join(architectures, ","), qbsConf)
+
+	if qtMkspecs == "" {
+		out, err := exec.Command("qmake", "-query", "QT_HOST_DATA/src").Output()
+		if err != nil {
+			log.Printf("Not writing qmake mkspecs, pass the mkspecs directory of Qt with --qt-mkspecs")
+			return nil
+		}
+		qtMkspecs = filepath.Join(strings.TrimSpace(string(out)), "mkspecs")
+	}
+	if qtMkspecs, err = filepath.Abs(qtMkspecs); err != nil {
+		return stageErrorf(stageUsage, "", "", "%w", err)
+	}
+	if _, err := os.Stat(filepath.Join(qtMkspecs, "win32-clang-msvc", "qmake.conf")); err != nil {
+		return stageErrorf(stageUsage, "", "", "%v does not contain the win32-clang-msvc mkspec: %w", qtMkspecs, err)
+	}
+	for _, arch := range architectures {
+		dir := filepath.Join(outDir, "mkspecs", "win32-clang-msvc-winsysroot-"+arch)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return stageErrorf(stageOutput, "", "", "%w", err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "qmake.conf"), []byte(info.qmakeConf(arch, qtMkspecs)), 0644); err != nil {
+			return stageErrorf(stageOutput, "", "", "%w", err)
+		}
+		defs := fmt.Sprintf("#include \"%v\"\n", filepath.ToSlash(filepath.Join(qtMkspecs, "win32-clang-msvc", "qplatformdefs.h")))
+		if err := ioutil.WriteFile(filepath.Join(dir, "qplatformdefs.h"), []byte(defs), 0644); err != nil {
+			return stageErrorf(stageOutput, "", "", "%w", err)
+		}
+		log.Printf("Wrote qmake mkspec for %v, use it with: qmake -spec %v", arch, dir)
+	}
+	return nil
+}
+
+// qbsSetting is a property of a qbs profile.
+type qbsSetting struct {
+	key   string
+	value interface{}
+}
+
+// qbsProfiles returns qbs settings defining a profile per architecture in
+// the format of qbs config --export.
+func (s *sysrootInfo) qbsProfiles(archs []string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# qbs profiles for MSVC %v and Windows SDK %v generated by winsysroot\n", s.MSVCVersion, s.SDKVersion)
+	for _, arch := range archs {
+		settings := []qbsSetting{
+			{"qbs.targetPlatform", "windows"},
+			{"qbs.architecture", qbsArchs[arch]},
+			{"qbs.toolchainType", "clang-cl"},
+			{"cpp.compilerName", "clang-cl"},
+			{"cpp.linkerName", "lld-link"},
+			{"cpp.driverFlags", s.compileFlags(arch)},
+			{"cpp.linkerFlags", s.linkFlags(arch)},
+			{"cpp.systemIncludePaths", s.includeDirs()},
+			{"cpp.libraryPaths", s.libDirs(arch)},
+		}
+		if s.LLVMDir != "" {
+			settings = append(settings, qbsSetting{"cpp.toolchainInstallPath", s.LLVMDir})
+		}
+		for _, setting := range settings {
+			raw, _ := json.Marshal(setting.value)
+			fmt.Fprintf(&b, "profiles.winsysroot-%v.%v: %s\n", arch, setting.key, raw)
+		}
+	}
+	return b.String()
+}
+
+// qmakeConf returns a qmake.conf extending Qt's win32-clang-msvc mkspec to
+// use the LLVM tools with the sysroot.
+func (s *sysrootInfo) qmakeConf(arch, qtMkspecs string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# qmake mkspec for %v with MSVC %v and Windows SDK %v generated by winsysroot\n", arch, s.MSVCVersion, s.SDKVersion)
+	fmt.Fprintf(&b, "include(%v)\n\n", filepath.ToSlash(filepath.Join(qtMkspecs, "win32-clang-msvc", "qmake.conf")))
+	for _, tool := range [][2]string{
+		{"QMAKE_CC", "clang-cl"},
+		{"QMAKE_CXX", "clang-cl"},
+		{"QMAKE_LINK", "lld-link"},
+		{"QMAKE_LINK_C", "lld-link"},
+		{"QMAKE_LIB", "llvm-lib"},
+		{"QMAKE_RC", "llvm-rc"},
+		{"QMAKE_MT", "llvm-mt"},
+	} {
+		fmt.Fprintf(&b, "%v = %v\n", tool[0], qmakeQuote(s.tool(tool[1])))
+	}
+	compile := qmakeQuoteAll(s.compileFlags(arch))
+	fmt.Fprintf(&b, "\nQMAKE_CFLAGS += %v\n", compile)
+	fmt.Fprintf(&b, "QMAKE_CXXFLAGS += %v\n", compile)
+	fmt.Fprintf(&b, "QMAKE_LFLAGS += %v\n", qmakeQuoteAll(s.linkFlags(arch)))
+	return b.String()
+}
+
+// qmakeQuoteAll joins flags into a qmake value, quoting flags containing
+// spaces so they stay single arguments.
+func qmakeQuoteAll(flags []string) string {
+	quoted := make([]string, len(flags))
+	for i, f := range flags {
+		quoted[i] = qmakeQuote(f)
+	}
+	return strings.Join(quoted, " ")
+}
+
+func qmakeQuote(s string) string {
+	if strings.ContainsAny(s, " \t") {
+		return `"` + s + `"`
+	}
+	return s
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"git.dolansoft.org/lorenz/winsysroot/sysroot"
+)
+
+func init() {
+	subcommands = append(subcommands, &subcommand{
+		name:  "serve",
+		short: "Serve a sysroot over HTTP, generating it on demand unless --dir is given",
+		setup: setupServe,
+	})
+}
+
+// serveIndexPath is the URL path of the index listing all served files.
+const serveIndexPath = "/index.json"
+
+func setupServe(fs *flag.FlagSet) func(ctx context.Context) error {
+	lf := registerLazyFlags(fs)
+	listen := fs.String("listen", "localhost:8080", "Address to listen on")
+	dir := fs.String("dir", "", "Serve this previously generated sysroot directory instead of generating one on demand")
+	return func(ctx context.Context) error {
+		if fs.NArg() != 0 {
+			return stageErrorf(stageUsage, "", "", "usage: winsysroot serve [flags]")
+		}
+		var srv *sysrootServer
+		if *dir != "" {
+			var err error
+			srv, err = newDirServer(*dir)
+			if err != nil {
+				return stageErrorf(stageOutput, "", "", "failed to list sysroot: %w", err)
+			}
+		} else {
+			lazy, cleanup, err := lf.open(ctx)
+			if err != nil {
+				return err
+			}
+			defer cleanup()
+			srv = newLazyServer(lazy)
+		}
+		return runServe(ctx, *listen, srv, "Serving sysroot on http://%v, index at "+serveIndexPath)
+	}
+}
+
+// runServe serves handler on listen until ctx is done. banner is logged with
+// the address listened on.
+func runServe(ctx context.Context, listen string, handler http.Handler, banner string) error {
+	ln, err := net.Listen("tcp", listen)
+	if err != nil {
+		return stageErrorf(stageUsage, "", "", "%w", err)
+	}
+	srv := &http.Server{Handler: handler, ReadHeaderTimeout: time.Minute}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+	log.Printf(banner, ln.Addr())
+	if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return stageErrorf(stageOutput, "", "", "%w", err)
+	}
+	return nil
+}
+
+// servedFile is a file of a served sysroot.
+type servedFile struct {
+	path    string
+	size    int64
+	modTime time.Time
+	open    func(ctx context.Context) (*os.File, error)
+}
+
+// serveIndexEntry describes a file in the index.
+type serveIndexEntry struct {
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+}
+
+// sysrootServer serves the files of a sysroot. Lookups fall back to
+// ignoring case, like the VFS overlay does for clang. ETags are the SHA256
+// of the contents, which are hashed when a file is first requested.
+type sysrootServer struct {
+	files  map[string]*servedFile
+	folded map[string]*servedFile
+	index  []byte
+
+	mu     sync.Mutex
+	hashes map[*servedFile]string
+}
+
+func newSysrootServer(files []*servedFile) *sysrootServer {
+	s := &sysrootServer{
+		files:  make(map[string]*servedFile),
+		folded: make(map[string]*servedFile),
+		hashes: make(map[*servedFile]string),
+	}
+	entries := make([]serveIndexEntry, 0, len(files))
+	for _, f := range files {
+		s.files[f.path] = f
+		if _, ok := s.folded[strings.ToLower(f.path)]; !ok {
+			s.folded[strings.ToLower(f.path)] = f
+		}
+		entries = append(entries, serveIndexEntry{Path: f.path, Size: f.size, ModTime: f.modTime})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+	s.index, _ = json.Marshal(struct {
+		Files []serveIndexEntry `json:"files"`
+	}{entries})
+	return s
+}
+
+func newLazyServer(lazy *sysroot.Lazy) *sysrootServer {
+	var files []*servedFile
+	for _, f := range lazy.Files() {
+		f := f
+		files = append(files, &servedFile{
+			path:    f.Path,
+			size:    f.Size,
+			modTime: f.ModTime,
+			open: func(ctx context.Context) (*os.File, error) {
+				return lazy.Open(ctx, f)
+			},
+		})
+	}
+	return newSysrootServer(files)
+}
+
+func newDirServer(dir string) (*sysrootServer, error) {
+	var files []*servedFile
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || !fi.Mode().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		files = append(files, &servedFile{
+			path:    filepath.ToSlash(rel),
+			size:    fi.Size(),
+			modTime: fi.ModTime(),
+			open:    func(context.Context) (*os.File, error) { return os.Open(path) },
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return newSysrootServer(files), nil
+}
+
+func (s *sysrootServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if req.URL.Path == serveIndexPath {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-cache")
+		http.ServeContent(w, req, "", time.Time{}, strings.NewReader(string(s.index)))
+		return
+	}
+	path := strings.TrimPrefix(req.URL.Path, "/")
+	f, ok := s.files[path]
+	if !ok {
+		f, ok = s.folded[strings.ToLower(path)]
+	}
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+	file, err := f.open(req.Context())
+	if err != nil {
+		log.Printf("Failed to serve %v: %v", f.path, err)
+		http.Error(w, "failed to extract file", http.StatusBadGateway)
+		return
+	}
+	defer file.Close()
+	etag, err := s.etag(f, file)
+	if err != nil {
+		log.Printf("Failed to serve %v: %v", f.path, err)
+		http.Error(w, "failed to read file", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, req, "", f.modTime, file)
+}
+
+// etag returns the strong ETag of f, hashing file if it is not yet known.
+// The file is left at its start.
+func (s *sysrootServer) etag(f *servedFile, file *os.File) (string, error) {
+	s.mu.Lock()
+	etag, ok := s.hashes[f]
+	s.mu.Unlock()
+	if ok {
+		return etag, nil
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	etag = `"` + hex.EncodeToString(h.Sum(nil)) + `"`
+	s.mu.Lock()
+	s.hashes[f] = etag
+	s.mu.Unlock()
+	return etag, nil
+}
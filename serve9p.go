@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"net"
+
+	"git.dolansoft.org/lorenz/winsysroot/ninep"
+)
+
+func init() {
+	subcommands = append(subcommands, &subcommand{
+		name:  "serve-9p",
+		short: "Serve a sysroot whose files are downloaded on first access over 9P for mounting on other machines",
+		setup: setupServe9P,
+	})
+}
+
+func setupServe9P(fs *flag.FlagSet) func(ctx context.Context) error {
+	lf := registerLazyFlags(fs)
+	listen := fs.String("listen", "localhost:5640", "Address to listen on")
+	return func(ctx context.Context) error {
+		if fs.NArg() != 0 {
+			return stageErrorf(stageUsage, "", "", "usage: winsysroot serve-9p [flags]")
+		}
+		return runServe9P(ctx, lf, *listen)
+	}
+}
+
+func runServe9P(ctx context.Context, lf *lazyFlags, listen string) error {
+	lazy, cleanup, err := lf.open(ctx)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	ln, err := net.Listen("tcp", listen)
+	if err != nil {
+		return stageErrorf(stageUsage, "", "", "%w", err)
+	}
+	srv := ninep.NewServer(newMountTree(ctx, lazy), ninep.Options{
+		ErrorLog: func(err error) { log.Printf("Serving sysroot over 9P: %v", err) },
+	})
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	host, port, _ := net.SplitHostPort(ln.Addr().String())
+	log.Printf("Serving sysroot with %d files over 9P on %v, mount it with: mount -t 9p -o trans=tcp,port=%v,version=9p2000.L,ro,cache=loose %v /mnt/winsysroot", len(lazy.Files()), ln.Addr(), port, host)
+	if err := srv.Serve(ln); err != nil {
+		return stageErrorf(stageOutput, "", "", "%w", err)
+	}
+	return nil
+}
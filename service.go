@@ -0,0 +1,482 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"git.dolansoft.org/lorenz/winsysroot/manifest"
+	"git.dolansoft.org/lorenz/winsysroot/sysroot"
+	"git.dolansoft.org/lorenz/winsysroot/target"
+	"git.dolansoft.org/lorenz/winsysroot/vfs"
+)
+
+func init() {
+	subcommands = append(subcommands, &subcommand{
+		name:  "service",
+		short: "Accept sysroot build requests over a JSON API and stream their progress",
+		setup: setupService,
+	})
+}
+
+// serviceBuildsPath is the URL path builds are created at and listed under.
+const serviceBuildsPath = "/v1/builds"
+
+// States of a service build.
+const (
+	buildQueued    = "queued"
+	buildRunning   = "running"
+	buildSucceeded = "succeeded"
+	buildFailed    = "failed"
+	buildCancelled = "cancelled"
+)
+
+func setupService(fs *flag.FlagSet) func(ctx context.Context) error {
+	listen := fs.String("listen", "localhost:8080", "Address to listen on")
+	outRoot := fs.String("out-root", "", "Directory the outputs of all builds are written to, requests give paths relative to it")
+	jobs := fs.Int("jobs", 1, "Number of builds running concurrently, further requests are queued")
+	fs.StringVar(flagCacheDir, "cache-dir", "", "Directory of the payload cache shared by all builds")
+	fs.IntVar(flagDownloads, "downloads", sysroot.DefaultDownloads, flag.Lookup("downloads").Usage)
+	fs.IntVar(flagExtractWorkers, "extract-workers", 0, flag.Lookup("extract-workers").Usage)
+	fs.StringVar(flagTempDir, "temp-dir", "", flag.Lookup("temp-dir").Usage)
+	registerHTTPFlags(fs)
+	registerTrustFlags(fs)
+	registerLimitFlags(fs)
+	return func(ctx context.Context) error {
+		if fs.NArg() != 0 || *outRoot == "" || *flagCacheDir == "" || *jobs < 1 {
+			return stageErrorf(stageUsage, "", "", "usage: winsysroot service --out-root <dir> --cache-dir <dir> [flags]")
+		}
+		root, err := filepath.Abs(*outRoot)
+		if err != nil {
+			return stageErrorf(stageUsage, "", "", "%w", err)
+		}
+		s := &buildService{
+			ctx:     ctx,
+			outRoot: root,
+			slots:   make(chan struct{}, *jobs),
+			builds:  make(map[string]*serviceBuild),
+		}
+		return runServe(ctx, *listen, s, "Accepting builds on http://%v"+serviceBuildsPath)
+	}
+}
+
+// serviceBuildRequest is the body of a request creating a build. Unset
+// fields default to the defaults of the corresponding flags.
+type serviceBuildRequest struct {
+	VSRelease     string   `json:"vsRelease"`
+	WinSDKVersion string   `json:"winSdkVersion"`
+	Nearest       bool     `json:"nearest,omitempty"`
+	Architectures []string `json:"architectures"`
+	Slim          bool     `json:"slim,omitempty"`
+	SDKFeatures   []string `json:"sdkFeatures,omitempty"`
+	// Out is a target like tar:x64/sysroot.tar.zst, its location is
+	// relative to --out-root.
+	Out            string `json:"out"`
+	VFSRoot        string `json:"vfsRoot,omitempty"`
+	AcceptLicenses bool   `json:"acceptLicenses"`
+}
+
+// serviceEvent is a line of the progress stream of a build.
+type serviceEvent struct {
+	Time    time.Time    `json:"time"`
+	Type    string       `json:"type"`
+	Package string       `json:"package,omitempty"`
+	Version string       `json:"version,omitempty"`
+	URL     string       `json:"url,omitempty"`
+	Bytes   int64        `json:"bytes,omitempty"`
+	Done    int64        `json:"done,omitempty"`
+	Total   int64        `json:"total,omitempty"`
+	State   string       `json:"state,omitempty"`
+	Error   *errorReport `json:"error,omitempty"`
+}
+
+// serviceBuild is a build requested from the service. Exported fields are
+// its status, they are guarded by mu.
+type serviceBuild struct {
+	ID              string              `json:"id"`
+	State           string              `json:"state"`
+	Request         serviceBuildRequest `json:"request"`
+	ResolvedSDK     string              `json:"resolvedSdkVersion,omitempty"`
+	Output          string              `json:"output"`
+	Created         time.Time           `json:"created"`
+	Started         *time.Time          `json:"started,omitempty"`
+	Finished        *time.Time          `json:"finished,omitempty"`
+	DownloadedBytes int64               `json:"downloadedBytes"`
+	ExtractedFiles  int64               `json:"extractedFiles"`
+	ExtractedBytes  int64               `json:"extractedBytes"`
+	Error           *errorReport        `json:"error,omitempty"`
+
+	mu      sync.Mutex
+	events  [][]byte
+	changed chan struct{}
+	cancel  context.CancelFunc
+	// Last reported tenth of the extraction of each archive
+	extractSteps map[string]int64
+}
+
+// buildService runs builds requested over HTTP.
+type buildService struct {
+	ctx     context.Context
+	outRoot string
+	slots   chan struct{}
+
+	mu     sync.Mutex
+	builds map[string]*serviceBuild
+	order  []string
+}
+
+func (s *buildService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == serviceBuildsPath {
+		switch r.Method {
+		case http.MethodGet:
+			s.list(w)
+		case http.MethodPost:
+			s.create(w, r)
+		default:
+			serviceError(w, http.StatusMethodNotAllowed, "method %v not allowed", r.Method)
+		}
+		return
+	}
+	rest := strings.TrimPrefix(r.URL.Path, serviceBuildsPath+"/")
+	if rest == r.URL.Path {
+		serviceError(w, http.StatusNotFound, "not found")
+		return
+	}
+	parts := strings.SplitN(rest, "/", 2)
+	s.mu.Lock()
+	b := s.builds[parts[0]]
+	s.mu.Unlock()
+	if b == nil {
+		serviceError(w, http.StatusNotFound, "no build with ID %q", parts[0])
+		return
+	}
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		b.mu.Lock()
+		raw, err := json.Marshal(b)
+		b.mu.Unlock()
+		if err != nil {
+			serviceError(w, http.StatusInternalServerError, "%v", err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(raw)
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		b.cancel()
+		w.WriteHeader(http.StatusAccepted)
+	case len(parts) == 2 && parts[1] == "events" && r.Method == http.MethodGet:
+		b.streamEvents(w, r)
+	default:
+		serviceError(w, http.StatusNotFound, "not found")
+	}
+}
+
+func serviceError(w http.ResponseWriter, status int, format string, a ...interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprintf(format, a...)})
+}
+
+func (s *buildService) list(w http.ResponseWriter) {
+	s.mu.Lock()
+	builds := make([]*serviceBuild, 0, len(s.order))
+	for _, id := range s.order {
+		builds = append(builds, s.builds[id])
+	}
+	s.mu.Unlock()
+	var raw []json.RawMessage
+	for _, b := range builds {
+		b.mu.Lock()
+		r, err := json.Marshal(b)
+		b.mu.Unlock()
+		if err != nil {
+			serviceError(w, http.StatusInternalServerError, "%v", err)
+			return
+		}
+		raw = append(raw, r)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]json.RawMessage{"builds": raw})
+}
+
+func (s *buildService) create(w http.ResponseWriter, r *http.Request) {
+	req := serviceBuildRequest{
+		VSRelease:     *flagVSRelease,
+		WinSDKVersion: *flagWinSDKVersion,
+		VFSRoot:       *flagVFSRoot,
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+		serviceError(w, http.StatusBadRequest, "invalid request: %v", err)
+		return
+	}
+	if len(req.Architectures) == 0 {
+		req.Architectures = strings.Split(*flagArchitectures, ",")
+	}
+	out, err := s.outputSpec(req.Out)
+	if err != nil {
+		serviceError(w, http.StatusBadRequest, "invalid out: %v", err)
+		return
+	}
+	if !req.AcceptLicenses {
+		serviceError(w, http.StatusBadRequest, "the licenses of Visual Studio and the Windows SDK need to be accepted with acceptLicenses, see winsysroot licenses")
+		return
+	}
+	var id [8]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		serviceError(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+	ctx, cancel := context.WithCancel(s.ctx)
+	b := &serviceBuild{
+		ID:      hex.EncodeToString(id[:]),
+		State:   buildQueued,
+		Request: req,
+		Output:  out,
+		Created: time.Now(),
+		changed: make(chan struct{}),
+		cancel:  cancel,
+	}
+	s.mu.Lock()
+	for _, other := range s.builds {
+		other.mu.Lock()
+		busy := other.Output == out && (other.State == buildQueued || other.State == buildRunning)
+		other.mu.Unlock()
+		if busy {
+			s.mu.Unlock()
+			cancel()
+			serviceError(w, http.StatusConflict, "build %v is already writing to %v", other.ID, req.Out)
+			return
+		}
+	}
+	s.builds[b.ID] = b
+	s.order = append(s.order, b.ID)
+	s.mu.Unlock()
+	b.event(serviceEvent{Type: "state", State: buildQueued})
+	log.Printf("Queued build %v of Windows SDK %v for %v to %v", b.ID, req.WinSDKVersion, strings.Join(req.Architectures, ","), out)
+	go s.run(ctx, b)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", serviceBuildsPath+"/"+b.ID)
+	w.WriteHeader(http.StatusAccepted)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	json.NewEncoder(w).Encode(b)
+}
+
+// outputSpec returns the target specification for the output of a request,
+// with the location resolved below outRoot.
+func (s *buildService) outputSpec(spec string) (string, error) {
+	parts := strings.SplitN(spec, ":", 2)
+	if len(parts) != 2 {
+		return "", fmt.Errorf("%q is not in the form scheme:location", spec)
+	}
+	known := false
+	for _, scheme := range target.Schemes() {
+		known = known || scheme == parts[0]
+	}
+	if !known {
+		return "", fmt.Errorf("unknown target scheme %q, available are %v", parts[0], strings.Join(target.Schemes(), ", "))
+	}
+	location, err := target.CleanPath(parts[1])
+	if err != nil {
+		return "", err
+	}
+	return parts[0] + ":" + filepath.Join(s.outRoot, filepath.FromSlash(location)), nil
+}
+
+// run waits for a free slot and builds b.
+func (s *buildService) run(ctx context.Context, b *serviceBuild) {
+	defer b.cancel()
+	var err error
+	select {
+	case s.slots <- struct{}{}:
+		b.setState(buildRunning, nil)
+		err = b.build(ctx)
+		<-s.slots
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	switch {
+	case err == nil:
+		log.Printf("Build %v succeeded", b.ID)
+		b.setState(buildSucceeded, nil)
+	case errors.Is(err, context.Canceled):
+		log.Printf("Build %v was cancelled", b.ID)
+		b.setState(buildCancelled, nil)
+	default:
+		log.Printf("Build %v failed: %v", b.ID, err)
+		b.setState(buildFailed, newErrorReport(err))
+	}
+}
+
+// build runs the sysroot build, like the main command does.
+func (b *serviceBuild) build(ctx context.Context) error {
+	req := b.Request
+	_, installer, err := fetchManifests(ctx, req.VSRelease)
+	if err != nil {
+		return err
+	}
+	sdkVersion, err := sysroot.ResolveSDKVersion(installer, req.WinSDKVersion, req.Nearest)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	b.ResolvedSDK = sdkVersion
+	b.mu.Unlock()
+	acRoots, err := authenticodeRoots()
+	if err != nil {
+		return stageErrorf(stageUsage, "", "", "%w", err)
+	}
+	hc, err := httpClient()
+	if err != nil {
+		return stageErrorf(stageUsage, "", "", "%w", err)
+	}
+	outInner, err := target.Open(b.Output)
+	if err != nil {
+		return stageErrorf(stageOutput, "", "", "failed to create output: %w", err)
+	}
+	vfsRoot := req.VFSRoot
+	if rooted, ok := outInner.(target.Rooted); ok {
+		vfsRoot = rooted.Root()
+	} else {
+		outInner = target.NewIntegrityLayer(outInner)
+	}
+	return sysroot.Build(ctx, sysroot.Options{
+		Manifest:                 installer,
+		WinSDKVersion:            sdkVersion,
+		Architectures:            req.Architectures,
+		Slim:                     req.Slim,
+		SDKFeatures:              req.SDKFeatures,
+		HTTPClient:               hc,
+		Header:                   httpHeader(),
+		RequestTimeout:           httpRequestTimeout,
+		Events:                   b,
+		CacheDir:                 *flagCacheDir,
+		AcceptLicenses:           req.AcceptLicenses,
+		Limits:                   &limits,
+		OnChecksumMismatch:       onChecksumMismatch,
+		RequireSigner:            requireSigner,
+		Authenticode:             verifyAuthenticode,
+		AuthenticodeRoots:        acRoots,
+		AuthenticodeIdentityOnly: authenticodeIdentity,
+		TempDir:                  *flagTempDir,
+		Downloads:                *flagDownloads,
+		ExtractWorkers:           *flagExtractWorkers,
+	}, vfs.NewTargetLayer(outInner, vfsRoot))
+}
+
+func (b *serviceBuild) setState(state string, report *errorReport) {
+	now := time.Now()
+	b.mu.Lock()
+	b.State = state
+	if state == buildRunning {
+		b.Started = &now
+	} else {
+		b.Finished = &now
+	}
+	b.Error = report
+	b.mu.Unlock()
+	b.event(serviceEvent{Type: "state", State: state, Error: report})
+}
+
+// finished reports whether the build has ended. b.mu must be held.
+func (b *serviceBuild) finished() bool {
+	return b.State != buildQueued && b.State != buildRunning
+}
+
+// event appends e to the progress stream and wakes up its readers.
+func (b *serviceBuild) event(e serviceEvent) {
+	e.Time = time.Now()
+	raw, err := json.Marshal(&e)
+	if err != nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.events = append(b.events, append(raw, '\n'))
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+// streamEvents writes all events of the build as JSON lines, following
+// new ones until the build has ended or the client goes away.
+func (b *serviceBuild) streamEvents(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	flusher, _ := w.(http.Flusher)
+	next := 0
+	for {
+		b.mu.Lock()
+		pending := b.events[next:]
+		done := b.finished()
+		changed := b.changed
+		b.mu.Unlock()
+		for _, raw := range pending {
+			if _, err := w.Write(raw); err != nil {
+				return
+			}
+		}
+		next += len(pending)
+		if flusher != nil {
+			flusher.Flush()
+		}
+		if done {
+			return
+		}
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func (b *serviceBuild) PackageResolved(pkg manifest.Package) {
+	b.event(serviceEvent{Type: "package", Package: pkg.ID, Version: pkg.Version})
+}
+
+func (b *serviceBuild) DownloadStarted(pkg manifest.Package, url string, size int64) {
+	b.event(serviceEvent{Type: "downloadStarted", Package: pkg.ID, URL: url, Total: size})
+}
+
+func (b *serviceBuild) DownloadFinished(pkg manifest.Package, url string, bytes int64) {
+	b.mu.Lock()
+	b.DownloadedBytes += bytes
+	b.mu.Unlock()
+	b.event(serviceEvent{Type: "downloadFinished", Package: pkg.ID, URL: url, Bytes: bytes})
+}
+
+func (b *serviceBuild) FileExtracted(path string, size int64) {
+	// Too frequent for the event stream, only counted in the status.
+	b.mu.Lock()
+	b.ExtractedFiles++
+	b.ExtractedBytes += size
+	b.mu.Unlock()
+}
+
+func (b *serviceBuild) ExtractProgress(pkg manifest.Package, url string, done, total int64) {
+	if total <= 0 {
+		return
+	}
+	step := done * 10 / total
+	b.mu.Lock()
+	if b.extractSteps == nil {
+		b.extractSteps = make(map[string]int64)
+	}
+	last, seen := b.extractSteps[url]
+	b.extractSteps[url] = step
+	b.mu.Unlock()
+	if seen && step <= last {
+		return
+	}
+	b.event(serviceEvent{Type: "extractProgress", Package: pkg.ID, URL: url, Done: done, Total: total})
+}
@@ -0,0 +1,513 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"git.dolansoft.org/lorenz/winsysroot/sysroot"
+	"git.dolansoft.org/lorenz/winsysroot/target"
+	"git.dolansoft.org/lorenz/winsysroot/vfs"
+)
+
+// The store keeps multiple sysroots under a single directory. File contents
+// are stored once in a content-addressed area (cas/) and hardlinked into the
+// individual sysroots (sysroots/<name>/). Each sysroot has an index mapping
+// its files to their content hashes, which is used for garbage-collecting
+// unreferenced content when sysroots are removed.
+//
+//	<store>/cas/<first two hex digits>/<sha256>
+//	<store>/sysroots/<name>/...
+//	<store>/sysroots/<name>/.winsysroot-index.json
+//	<store>/current
+//	<store>/lock
+//
+// Installs and garbage collection hold the lock, so that objects aren't
+// removed while another process links them into a sysroot.
+
+const (
+	storeIndexName = ".winsysroot-index.json"
+	storeLockName  = "lock"
+)
+
+func init() {
+	subcommands = append(subcommands,
+		&subcommand{name: "install", short: "Build a sysroot into the managed store", setup: setupStoreInstall},
+		&subcommand{name: "use", short: "Select a sysroot from the store and print its activation settings", setup: setupStoreUse},
+		&subcommand{name: "list", short: "List sysroots in the managed store", setup: setupStoreList},
+		&subcommand{name: "remove", short: "Remove a sysroot from the managed store", setup: setupStoreRemove},
+	)
+}
+
+func defaultStoreDir() string {
+	if dir := os.Getenv("WINSYSROOT_STORE"); dir != "" {
+		return dir
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ".winsysroot"
+	}
+	return filepath.Join(home, ".winsysroot")
+}
+
+func storeDirFlag(fs *flag.FlagSet) *string {
+	return fs.String("store", defaultStoreDir(), "Directory of the managed sysroot store (default from $WINSYSROOT_STORE or ~/.winsysroot)")
+}
+
+// storeIndex records the content hash of every file in a stored sysroot.
+type storeIndex struct {
+	VSRelease     string            `json:"vsRelease"`
+	WinSDKVersion string            `json:"winSdkVersion"`
+	Architectures []string          `json:"architectures"`
+	Slim          bool              `json:"slim"`
+	Created       time.Time         `json:"created"`
+	Files         map[string]string `json:"files"`
+}
+
+// casTarget writes files into the content-addressed part of the store and
+// hardlinks them into the sysroot directory.
+type casTarget struct {
+	casDir  string
+	rootDir string
+
+	mu    sync.Mutex
+	files map[string]string
+
+	curr *casFile
+}
+
+func newCASTarget(storeDir, rootDir string) (*casTarget, error) {
+	casDir := filepath.Join(storeDir, "cas")
+	if err := os.MkdirAll(filepath.Join(casDir, "tmp"), 0755); err != nil {
+		return nil, err
+	}
+	return &casTarget{casDir: casDir, rootDir: rootDir, files: make(map[string]string)}, nil
+}
+
+// casFile is a file being written into the store. It is moved into place and
+// linked into the sysroot when closed.
+type casFile struct {
+	c    *casTarget
+	path string
+	f    *os.File
+	h    hash.Hash
+}
+
+func (f *casFile) Write(b []byte) (int, error) {
+	f.h.Write(b)
+	return f.f.Write(b)
+}
+
+func (f *casFile) Close() error {
+	c := f.c
+	tmpName := f.f.Name()
+	if err := f.f.Close(); err != nil {
+		return err
+	}
+	sum := hex.EncodeToString(f.h.Sum(nil))
+	objPath := filepath.Join(c.casDir, sum[:2], sum)
+	if _, err := os.Stat(objPath); err == nil {
+		os.Remove(tmpName)
+	} else {
+		if err := os.MkdirAll(filepath.Dir(objPath), 0755); err != nil {
+			return err
+		}
+		if err := os.Rename(tmpName, objPath); err != nil {
+			return err
+		}
+	}
+	targetPath := filepath.Join(c.rootDir, filepath.FromSlash(f.path))
+	if err := os.MkdirAll(filepath.Dir(targetPath), 0755); err != nil {
+		return err
+	}
+	os.Remove(targetPath)
+	if err := os.Link(objPath, targetPath); err != nil {
+		return fmt.Errorf("failed to link %q into sysroot: %w", f.path, err)
+	}
+	c.mu.Lock()
+	c.files[f.path] = sum
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *casTarget) finishFile() error {
+	if c.curr == nil {
+		return nil
+	}
+	f := c.curr
+	c.curr = nil
+	return f.Close()
+}
+
+// CreateFile implements target.FileCreator, files can be written in
+// parallel.
+func (c *casTarget) CreateFile(path string, size int64, modTime time.Time) (io.WriteCloser, error) {
+	path, err := target.CleanPath(path)
+	if err != nil {
+		return nil, err
+	}
+	f, err := ioutil.TempFile(filepath.Join(c.casDir, "tmp"), "obj")
+	if err != nil {
+		return nil, err
+	}
+	return &casFile{c: c, path: path, f: f, h: sha256.New()}, nil
+}
+
+func (c *casTarget) Create(path string, size int64, modTime time.Time) error {
+	if err := c.finishFile(); err != nil {
+		return err
+	}
+	f, err := c.CreateFile(path, size, modTime)
+	if err != nil {
+		return err
+	}
+	c.curr = f.(*casFile)
+	return nil
+}
+
+func (c *casTarget) Write(b []byte) (int, error) {
+	return c.curr.Write(b)
+}
+
+func (c *casTarget) Close() error {
+	return c.finishFile()
+}
+
+func sysrootName(vsRelease, sdkVersion string, architectures []string) string {
+	return fmt.Sprintf("vs%s-sdk%s-%s", vsRelease, sdkVersion, strings.Join(architectures, "+"))
+}
+
+// checkStoreName rejects names of sysroots which aren't a single path
+// component below sysroots/.
+func checkStoreName(name string) error {
+	cleaned, err := target.CleanPath(name)
+	if err != nil {
+		return err
+	}
+	if cleaned != name || strings.Contains(cleaned, "/") {
+		return fmt.Errorf("%w %q: sysroot names must not contain path separators", target.ErrUnsafePath, name)
+	}
+	return nil
+}
+
+func setupStoreInstall(fs *flag.FlagSet) func(ctx context.Context) error {
+	storeDir := storeDirFlag(fs)
+	vsRelease := fs.String("vs-release", *flagVSRelease, flag.Lookup("vs-release").Usage)
+	winSDKVersion := fs.String("win-sdk-version", *flagWinSDKVersion, flag.Lookup("win-sdk-version").Usage)
+	archs := fs.String("architectures", *flagArchitectures, flag.Lookup("architectures").Usage)
+	fs.StringVar(flagHostArch, "host-arch", *flagHostArch, flag.Lookup("host-arch").Usage)
+	fs.StringVar(flagMSVCToolsets, "msvc-toolsets", *flagMSVCToolsets, flag.Lookup("msvc-toolsets").Usage)
+	slim := fs.Bool("slim", *flagSlim, flag.Lookup("slim").Usage)
+	nearest := fs.Bool("nearest", false, flag.Lookup("nearest").Usage)
+	strict := fs.Bool("strict", false, flag.Lookup("strict").Usage)
+	fs.BoolVar(flagProgress, "progress", false, flag.Lookup("progress").Usage)
+	fs.StringVar(flagCacheDir, "cache-dir", "", flag.Lookup("cache-dir").Usage)
+	fs.BoolVar(flagAcceptLicenses, "accept-licenses", false, flag.Lookup("accept-licenses").Usage)
+	name := fs.String("name", "", "Name of the sysroot in the store (default derived from versions and architectures)")
+	registerHTTPFlags(fs)
+	registerTrustFlags(fs)
+	registerLimitFlags(fs)
+	return func(ctx context.Context) error {
+		return runStoreInstall(ctx, *storeDir, *vsRelease, *winSDKVersion, strings.Split(*archs, ","), *slim, *nearest, *strict, *name)
+	}
+}
+
+func runStoreInstall(ctx context.Context, storeDir, vsRelease, winSDKVersion string, architectures []string, slim, nearest, strict bool, name string) error {
+	_, manifest, err := fetchManifests(ctx, vsRelease)
+	if err != nil {
+		return err
+	}
+	sdkVersion, err := sysroot.ResolveSDKVersion(manifest, winSDKVersion, nearest)
+	if err != nil {
+		return err
+	}
+	if sdkVersion != winSDKVersion {
+		log.Printf("Using Windows SDK %v for requested version %v", sdkVersion, winSDKVersion)
+	}
+	acRoots, err := authenticodeRoots()
+	if err != nil {
+		return stageErrorf(stageUsage, "", "", "%w", err)
+	}
+	hc, err := httpClient()
+	if err != nil {
+		return stageErrorf(stageUsage, "", "", "%w", err)
+	}
+	if name == "" {
+		name = sysrootName(vsRelease, sdkVersion, architectures)
+	}
+	if err := checkStoreName(name); err != nil {
+		return stageErrorf(stageUsage, "", "", "%w", err)
+	}
+	index := &storeIndex{
+		VSRelease:     vsRelease,
+		WinSDKVersion: sdkVersion,
+		Architectures: architectures,
+		Slim:          slim,
+	}
+	err = installIntoStore(storeDir, name, index, func(t target.Target, finalDir string) error {
+		return sysroot.Build(ctx, sysroot.Options{
+			Manifest:                 manifest,
+			WinSDKVersion:            sdkVersion,
+			Architectures:            architectures,
+			HostArch:                 *flagHostArch,
+			Toolsets:                 strings.Split(*flagMSVCToolsets, ","),
+			Slim:                     slim,
+			Strict:                   strict,
+			HTTPClient:               hc,
+			Header:                   httpHeader(),
+			RequestTimeout:           httpRequestTimeout,
+			Events:                   buildEvents(),
+			CacheDir:                 *flagCacheDir,
+			AcceptLicenses:           *flagAcceptLicenses,
+			Limits:                   &limits,
+			OnChecksumMismatch:       onChecksumMismatch,
+			RequireSigner:            requireSigner,
+			Authenticode:             verifyAuthenticode,
+			AuthenticodeRoots:        acRoots,
+			AuthenticodeIdentityOnly: authenticodeIdentity,
+		}, vfs.NewTargetLayer(t, finalDir))
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("Installed sysroot %q, activate it with: winsysroot use %s", name, name)
+	return nil
+}
+
+// installIntoStore builds a sysroot with build, which writes to t, and
+// moves it into place as name with the given index. It holds the store lock
+// while doing so. finalDir is the directory the sysroot ends up in.
+func installIntoStore(storeDir, name string, index *storeIndex, build func(t target.Target, finalDir string) error) error {
+	sysrootsDir := filepath.Join(storeDir, "sysroots")
+	finalDir, err := filepath.Abs(filepath.Join(sysrootsDir, name))
+	if err != nil {
+		return stageErrorf(stageOutput, "", "", "%w", err)
+	}
+	unlock, err := lockStore(storeDir)
+	if err != nil {
+		return stageErrorf(stageOutput, "", "", "failed to lock store: %w", err)
+	}
+	defer unlock()
+	if _, err := os.Stat(finalDir); err == nil {
+		return stageErrorf(stageUsage, "", "", "sysroot %q is already installed, remove it first", name)
+	}
+	tmpDir := finalDir + ".partial"
+	os.RemoveAll(tmpDir)
+	cas, err := newCASTarget(storeDir, tmpDir)
+	if err != nil {
+		return stageErrorf(stageOutput, "", "", "failed to initialize store: %w", err)
+	}
+	installed := false
+	defer func() {
+		if !installed {
+			os.RemoveAll(tmpDir)
+		}
+	}()
+	if err := build(cas, finalDir); err != nil {
+		return err
+	}
+	index.Created = time.Now()
+	index.Files = cas.files
+	indexRaw, err := json.MarshalIndent(index, "", "\t")
+	if err != nil {
+		return stageErrorf(stageOutput, "", "", "failed to encode store index: %w", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmpDir, storeIndexName), indexRaw, 0644); err != nil {
+		return stageErrorf(stageOutput, "", "", "failed to write store index: %w", err)
+	}
+	if err := os.Rename(tmpDir, finalDir); err != nil {
+		return stageErrorf(stageOutput, "", "", "failed to move sysroot into place: %w", err)
+	}
+	installed = true
+	return nil
+}
+
+func readStoreIndex(sysrootDir string) (*storeIndex, error) {
+	indexRaw, err := ioutil.ReadFile(filepath.Join(sysrootDir, storeIndexName))
+	if err != nil {
+		return nil, err
+	}
+	var idx storeIndex
+	if err := json.Unmarshal(indexRaw, &idx); err != nil {
+		return nil, fmt.Errorf("failed to parse store index: %w", err)
+	}
+	return &idx, nil
+}
+
+func currentSysroot(storeDir string) string {
+	current, err := ioutil.ReadFile(filepath.Join(storeDir, "current"))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(current))
+}
+
+func setupStoreUse(fs *flag.FlagSet) func(ctx context.Context) error {
+	storeDir := storeDirFlag(fs)
+	printFlags := fs.Bool("flags", false, "Print clang-cl flags for the sysroot instead of shell exports")
+	return func(ctx context.Context) error {
+		var name string
+		switch fs.NArg() {
+		case 0:
+			name = currentSysroot(*storeDir)
+			if name == "" {
+				return stageErrorf(stageUsage, "", "", "no sysroot selected, pass a name")
+			}
+		case 1:
+			name = fs.Arg(0)
+		default:
+			return stageErrorf(stageUsage, "", "", "usage: winsysroot use [--flags] [name]")
+		}
+		return runStoreUse(*storeDir, name, *printFlags)
+	}
+}
+
+func runStoreUse(storeDir, name string, printFlags bool) error {
+	if err := checkStoreName(name); err != nil {
+		return stageErrorf(stageUsage, "", "", "%w", err)
+	}
+	sysrootDir, err := filepath.Abs(filepath.Join(storeDir, "sysroots", name))
+	if err != nil {
+		return stageErrorf(stageUsage, "", "", "%w", err)
+	}
+	if _, err := readStoreIndex(sysrootDir); err != nil {
+		return stageErrorf(stageUsage, "", "", "sysroot %q is not installed: %w", name, err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(storeDir, "current"), []byte(name+"\n"), 0644); err != nil {
+		return stageErrorf(stageOutput, "", "", "failed to select sysroot: %w", err)
+	}
+	overlay := filepath.Join(sysrootDir, "vfsoverlay.yaml")
+	if printFlags {
+		fmt.Printf("-Xclang -ivfsoverlay -Xclang %s /winsysroot %s /link /vfsoverlay:%s\n", overlay, sysrootDir, overlay)
+	} else {
+		fmt.Printf("export WINSYSROOT=%s\n", sysrootDir)
+	}
+	return nil
+}
+
+func setupStoreList(fs *flag.FlagSet) func(ctx context.Context) error {
+	storeDir := storeDirFlag(fs)
+	return func(ctx context.Context) error {
+		return runStoreList(*storeDir)
+	}
+}
+
+func runStoreList(storeDir string) error {
+	entries, err := ioutil.ReadDir(filepath.Join(storeDir, "sysroots"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return stageErrorf(stageOutput, "", "", "failed to list store: %w", err)
+	}
+	current := currentSysroot(storeDir)
+	for _, e := range entries {
+		idx, err := readStoreIndex(filepath.Join(storeDir, "sysroots", e.Name()))
+		if err != nil {
+			continue
+		}
+		marker := " "
+		if e.Name() == current {
+			marker = "*"
+		}
+		fmt.Printf("%s %s\t(VS %s, SDK %s, %s, %d files)\n", marker, e.Name(), idx.VSRelease, idx.WinSDKVersion, strings.Join(idx.Architectures, ","), len(idx.Files))
+	}
+	return nil
+}
+
+func setupStoreRemove(fs *flag.FlagSet) func(ctx context.Context) error {
+	storeDir := storeDirFlag(fs)
+	return func(ctx context.Context) error {
+		if fs.NArg() != 1 {
+			return stageErrorf(stageUsage, "", "", "usage: winsysroot remove <name>")
+		}
+		return runStoreRemove(*storeDir, fs.Arg(0))
+	}
+}
+
+func runStoreRemove(storeDir, name string) error {
+	if err := checkStoreName(name); err != nil {
+		return stageErrorf(stageUsage, "", "", "%w", err)
+	}
+	unlock, err := lockStore(storeDir)
+	if err != nil {
+		return stageErrorf(stageOutput, "", "", "failed to lock store: %w", err)
+	}
+	defer unlock()
+	sysrootsDir := filepath.Join(storeDir, "sysroots")
+	if _, err := readStoreIndex(filepath.Join(sysrootsDir, name)); err != nil {
+		return stageErrorf(stageUsage, "", "", "sysroot %q is not installed: %w", name, err)
+	}
+	if err := os.RemoveAll(filepath.Join(sysrootsDir, name)); err != nil {
+		return stageErrorf(stageOutput, "", "", "failed to remove sysroot: %w", err)
+	}
+	if currentSysroot(storeDir) == name {
+		os.Remove(filepath.Join(storeDir, "current"))
+	}
+	removed, err := gcStore(storeDir)
+	if err != nil {
+		return stageErrorf(stageOutput, "", "", "failed to garbage-collect store: %w", err)
+	}
+	log.Printf("Removed sysroot %q, freed %d unreferenced objects", name, removed)
+	return nil
+}
+
+// gcStore removes all content objects not referenced by any sysroot index.
+// The store must be locked.
+func gcStore(storeDir string) (int, error) {
+	referenced := make(map[string]bool)
+	entries, err := ioutil.ReadDir(filepath.Join(storeDir, "sysroots"))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return 0, err
+	}
+	for _, e := range entries {
+		idx, err := readStoreIndex(filepath.Join(storeDir, "sysroots", e.Name()))
+		if err != nil {
+			continue
+		}
+		for _, sum := range idx.Files {
+			referenced[sum] = true
+		}
+	}
+	casDir := filepath.Join(storeDir, "cas")
+	prefixes, err := ioutil.ReadDir(casDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	var removed int
+	for _, prefix := range prefixes {
+		if !prefix.IsDir() {
+			continue
+		}
+		objs, err := ioutil.ReadDir(filepath.Join(casDir, prefix.Name()))
+		if err != nil {
+			return removed, err
+		}
+		for _, obj := range objs {
+			// As the store is locked, files in tmp/ are left over from
+			// failed installs.
+			if referenced[obj.Name()] && prefix.Name() != "tmp" {
+				continue
+			}
+			if err := os.Remove(filepath.Join(casDir, prefix.Name(), obj.Name())); err != nil {
+				return removed, err
+			}
+			removed++
+		}
+	}
+	return removed, nil
+}
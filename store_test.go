@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"git.dolansoft.org/lorenz/winsysroot/target"
+)
+
+func TestCheckStoreName(t *testing.T) {
+	for name, ok := range map[string]bool{
+		"vs17-sdk10.0.22621.0-x64": true,
+		"":                         false,
+		".":                        false,
+		"..":                       false,
+		"../outside":               false,
+		"a/b":                      false,
+		`a\b`:                      false,
+		"/abs":                     false,
+		"a/":                       false,
+	} {
+		if err := checkStoreName(name); (err == nil) != ok {
+			t.Errorf("checkStoreName(%q) = %v", name, err)
+		}
+	}
+}
+
+func TestInstallIntoStore(t *testing.T) {
+	storeDir := t.TempDir()
+	errBuild := errors.New("build failed")
+	err := installIntoStore(storeDir, "broken", &storeIndex{}, func(tgt target.Target, finalDir string) error {
+		if err := tgt.Create("a.h", 1, time.Now()); err != nil {
+			return err
+		}
+		return errBuild
+	})
+	if !errors.Is(err, errBuild) {
+		t.Fatalf("got error %v, want %v", err, errBuild)
+	}
+	if _, err := os.Stat(filepath.Join(storeDir, "sysroots", "broken.partial")); !os.IsNotExist(err) {
+		t.Errorf("partial sysroot left behind: %v", err)
+	}
+
+	for _, name := range []string{"one", "two"} {
+		err := installIntoStore(storeDir, name, &storeIndex{}, func(tgt target.Target, finalDir string) error {
+			if err := tgt.Create("include/"+name+".h", 3, time.Now()); err != nil {
+				return err
+			}
+			if _, err := tgt.Write([]byte(name)); err != nil {
+				return err
+			}
+			return tgt.Close()
+		})
+		if err != nil {
+			t.Fatalf("installing %v: %v", name, err)
+		}
+	}
+	content, err := ioutil.ReadFile(filepath.Join(storeDir, "sysroots", "one", "include", "one.h"))
+	if err != nil || string(content) != "one" {
+		t.Errorf("one.h contains %q, %v", content, err)
+	}
+	if err := os.RemoveAll(filepath.Join(storeDir, "sysroots", "two")); err != nil {
+		t.Fatal(err)
+	}
+	unlock, err := lockStore(storeDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	removed, err := gcStore(storeDir)
+	unlock()
+	if err != nil {
+		t.Fatalf("gcStore: %v", err)
+	}
+	// The object of two.h and the temporary file of the failed install
+	if removed != 2 {
+		t.Errorf("removed %d objects, want 2", removed)
+	}
+	if _, err := ioutil.ReadFile(filepath.Join(storeDir, "sysroots", "one", "include", "one.h")); err != nil {
+		t.Errorf("one.h is gone: %v", err)
+	}
+}
+
+func TestLockStore(t *testing.T) {
+	storeDir := t.TempDir()
+	unlock, err := lockStore(storeDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	locked := make(chan func())
+	go func() {
+		unlock2, err := lockStore(storeDir)
+		if err != nil {
+			t.Error(err)
+		}
+		locked <- unlock2
+	}()
+	select {
+	case <-locked:
+		t.Fatal("store was locked twice")
+	case <-time.After(100 * time.Millisecond):
+	}
+	unlock()
+	select {
+	case unlock2 := <-locked:
+		unlock2()
+	case <-time.After(5 * time.Second):
+		t.Fatal("lock was not released")
+	}
+}
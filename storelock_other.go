@@ -0,0 +1,38 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd,!dragonfly
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// lockStore takes the lock of the store, waiting for other processes
+// holding it. Without flock the lock is a file which exists while it is
+// held, so it remains if the process crashes.
+func lockStore(storeDir string) (func(), error) {
+	if err := os.MkdirAll(storeDir, 0755); err != nil {
+		return nil, err
+	}
+	name := filepath.Join(storeDir, storeLockName)
+	for waited := false; ; waited = true {
+		f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			fmt.Fprintf(f, "%d\n", os.Getpid())
+			f.Close()
+			return func() { os.Remove(name) }, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, err
+		}
+		if !waited {
+			log.Printf("Waiting for another winsysroot process using the store, remove %v if none is running", name)
+		}
+		time.Sleep(time.Second)
+	}
+}
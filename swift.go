@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"git.dolansoft.org/lorenz/winsysroot/vfs"
+)
+
+func init() {
+	subcommands = append(subcommands, &subcommand{
+		name:  "swift-sdk",
+		short: "Generate a Swift SDK bundle for cross-compiling to Windows with a sysroot directory",
+		setup: setupSwiftSDK,
+	})
+}
+
+// swiftArchs maps architectures of the sysroot to the names Swift uses.
+var swiftArchs = map[string]string{
+	"x86":   "i686",
+	"x64":   "x86_64",
+	"arm64": "aarch64",
+}
+
+// swiftModuleMapsDir is the directory in the sysroot the module maps and
+// their overlay are written to.
+const swiftModuleMapsDir = "swift"
+
+// swiftModuleMaps are the files from usr/share of the Swift Windows SDK
+// which make the C libraries importable, placed into the directories of
+// the headers they describe like the Swift installer does on Windows.
+var swiftModuleMaps = []struct {
+	name     string
+	required bool
+	dest     func(s *sysrootInfo) string
+}{
+	{"ucrt.modulemap", true, func(s *sysrootInfo) string { return s.sdkIncludeDir("ucrt") + "/module.modulemap" }},
+	{"winsdk.modulemap", true, func(s *sysrootInfo) string { return s.sdkIncludeDir("um") + "/module.modulemap" }},
+	{"vcruntime.modulemap", false, func(s *sysrootInfo) string { return s.msvcIncludeDir() + "/module.modulemap" }},
+	{"vcruntime.apinotes", false, func(s *sysrootInfo) string { return s.msvcIncludeDir() + "/vcruntime.apinotes" }},
+}
+
+func setupSwiftSDK(fs *flag.FlagSet) func(ctx context.Context) error {
+	outDir := fs.String("out", "winsysroot.artifactbundle", "Directory to write the Swift SDK bundle to")
+	id := fs.String("id", "", "ID of the Swift SDK in the bundle (default: winsysroot-<Windows SDK version>)")
+	archs := fs.String("architectures", "", "Comma-separated list of architectures to include (default: all in the sysroot supported by Swift)")
+	swiftSDK := fs.String("swift-windows-sdk", "", "Windows.sdk directory of a Swift toolchain for Windows, containing the Swift runtime and module maps")
+	return func(ctx context.Context) error {
+		if fs.NArg() != 1 || *swiftSDK == "" {
+			return stageErrorf(stageUsage, "", "", "usage: winsysroot swift-sdk --swift-windows-sdk <Windows.sdk> [flags] <sysroot-dir>")
+		}
+		return runSwiftSDK(fs.Arg(0), *outDir, *id, *archs, *swiftSDK)
+	}
+}
+
+func runSwiftSDK(sysrootDir, outDir, id, archs, swiftSDK string) error {
+	info, err := inspectSysroot(sysrootDir)
+	if err != nil {
+		return stageErrorf(stageUsage, "", "", "%w", err)
+	}
+	if info.Overlay == "" {
+		return stageErrorf(stageUsage, "", "", "sysroot in %v has no VFS overlay, Swift needs it to find headers regardless of their case", sysrootDir)
+	}
+	swiftSDK, err = filepath.Abs(swiftSDK)
+	if err != nil {
+		return stageErrorf(stageUsage, "", "", "%w", err)
+	}
+	var architectures []string
+	if archs != "" {
+		for _, arch := range strings.Split(archs, ",") {
+			if _, ok := swiftArchs[arch]; !ok {
+				return stageErrorf(stageUsage, "", "", "Swift does not support %v", arch)
+			}
+			if !info.hasArch(arch) {
+				return stageErrorf(stageUsage, "", "", "sysroot does not contain %v, available are %v", arch, strings.Join(info.Architectures, ", "))
+			}
+			architectures = append(architectures, arch)
+		}
+	} else {
+		for _, arch := range info.Architectures {
+			if _, ok := swiftArchs[arch]; ok {
+				architectures = append(architectures, arch)
+			}
+		}
+		if len(architectures) == 0 {
+			return stageErrorf(stageUsage, "", "", "sysroot contains no architecture supported by Swift, available are %v", strings.Join(info.Architectures, ", "))
+		}
+	}
+	if id == "" {
+		id = "winsysroot-" + info.SDKVersion
+	}
+
+	// The bundle may be installed elsewhere, so everything it refers to by
+	// absolute path is kept in the sysroot.
+	overlay, err := info.writeSwiftModuleMaps(swiftSDK)
+	if err != nil {
+		return stageErrorf(stageOutput, "", "", "failed to install module maps: %w", err)
+	}
+	sdkDir := filepath.Join(outDir, id)
+	if err := os.MkdirAll(sdkDir, 0755); err != nil {
+		return stageErrorf(stageOutput, "", "", "%w", err)
+	}
+	files := map[string]interface{}{
+		filepath.Join(outDir, "info.json"):      swiftBundleInfo(id, info.SDKVersion),
+		filepath.Join(sdkDir, "swift-sdk.json"): info.swiftSDKMetadata(architectures, swiftSDK),
+		filepath.Join(sdkDir, "toolset.json"):   info.swiftToolset(overlay),
+	}
+	for name, v := range files {
+		raw, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return stageErrorf(stageOutput, "", "", "%w", err)
+		}
+		if err := ioutil.WriteFile(name, append(raw, '\n'), 0644); err != nil {
+			return stageErrorf(stageOutput, "", "", "%w", err)
+		}
+	}
+	log.Printf("Wrote Swift SDK %v for %v to %v, install it with: swift sdk install %v", id, strings.Join(architectures, ", "), outDir, outDir)
+	return nil
+}
+
+// sdkIncludeDir returns the Windows SDK include directory of component.
+func (s *sysrootInfo) sdkIncludeDir(component string) string {
+	return filepath.ToSlash(filepath.Join(s.Root, "Windows Kits", "10", "Include", s.SDKVersion, component))
+}
+
+// msvcIncludeDir returns the include directory of MSVC.
+func (s *sysrootInfo) msvcIncludeDir() string {
+	return filepath.ToSlash(filepath.Join(s.Root, "VC", "Tools", "MSVC", s.MSVCVersion, "include"))
+}
+
+// writeSwiftModuleMaps copies the module maps of the Swift Windows SDK into
+// the sysroot and writes a VFS overlay placing them next to the headers.
+// It returns the path of the overlay.
+func (s *sysrootInfo) writeSwiftModuleMaps(swiftSDK string) (string, error) {
+	dir := filepath.Join(s.Root, swiftModuleMapsDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	False := false
+	overlay := vfs.VFS{CaseSensitive: &False, RedirectingWith: vfs.RedirectingWithFallthrough}
+	for _, m := range swiftModuleMaps {
+		raw, err := ioutil.ReadFile(filepath.Join(swiftSDK, "usr", "share", m.name))
+		if os.IsNotExist(err) && !m.required {
+			continue
+		} else if err != nil {
+			return "", fmt.Errorf("%v is not a Swift Windows SDK: %w", swiftSDK, err)
+		}
+		src := filepath.Join(dir, m.name)
+		if err := ioutil.WriteFile(src, raw, 0644); err != nil {
+			return "", err
+		}
+		dest := m.dest(s)
+		overlay.Roots = append(overlay.Roots, &vfs.Inode{
+			Type:             "file",
+			Name:             dest,
+			ExternalContents: filepath.ToSlash(src),
+		})
+	}
+	raw, err := json.MarshalIndent(&overlay, "", "\t")
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, "modulemaps.yaml")
+	return path, ioutil.WriteFile(path, raw, 0644)
+}
+
+// swiftBundleInfo returns the info.json of an artifact bundle containing
+// the Swift SDK id.
+func swiftBundleInfo(id, version string) interface{} {
+	return map[string]interface{}{
+		"schemaVersion": "1.0",
+		"artifacts": map[string]interface{}{
+			id: map[string]interface{}{
+				"type":     "swiftSDK",
+				"version":  version,
+				"variants": []interface{}{map[string]string{"path": id}},
+			},
+		},
+	}
+}
+
+// swiftSDKMetadata returns the swift-sdk.json for the given architectures.
+// The Swift runtime comes from swiftSDK, the C libraries from the sysroot.
+func (s *sysrootInfo) swiftSDKMetadata(archs []string, swiftSDK string) interface{} {
+	triples := make(map[string]interface{})
+	for _, arch := range archs {
+		libs := append(s.libDirs(arch), filepath.Join(swiftSDK, "usr", "lib", "swift", "windows", swiftArchs[arch]))
+		triples[swiftArchs[arch]+"-unknown-windows-msvc"] = map[string]interface{}{
+			"sdkRootPath":              swiftSDK,
+			"swiftResourcesPath":       filepath.Join(swiftSDK, "usr", "lib", "swift"),
+			"swiftStaticResourcesPath": filepath.Join(swiftSDK, "usr", "lib", "swift_static"),
+			"includeSearchPaths":       s.includeDirs(),
+			"librarySearchPaths":       libs,
+			"toolsetPaths":             []string{"toolset.json"},
+		}
+	}
+	return map[string]interface{}{
+		"schemaVersion": "4.0",
+		"targetTriples": triples,
+	}
+}
+
+// swiftToolset returns the toolset.json pointing the Swift driver, clang and
+// lld-link to the sysroot.
+func (s *sysrootInfo) swiftToolset(moduleMapOverlay string) interface{} {
+	swiftFlags := []string{
+		"-windows-sdk-root", filepath.Join(s.Root, "Windows Kits", "10"),
+		"-windows-sdk-version", s.SDKVersion,
+		"-visualc-tools-root", filepath.Join(s.Root, "VC", "Tools", "MSVC", s.MSVCVersion),
+		"-vfsoverlay", s.Overlay,
+		"-vfsoverlay", moduleMapOverlay,
+		"-use-ld=lld",
+	}
+	cFlags := []string{"-ivfsoverlay", s.Overlay, "-ivfsoverlay", moduleMapOverlay}
+	return map[string]interface{}{
+		"schemaVersion": "1.0",
+		"swiftCompiler": map[string]interface{}{"extraCLIOptions": swiftFlags},
+		"cCompiler":     map[string]interface{}{"extraCLIOptions": cFlags},
+		"cxxCompiler":   map[string]interface{}{"extraCLIOptions": cFlags},
+		"linker":        map[string]interface{}{"extraCLIOptions": []string{"/vfsoverlay:" + s.Overlay}},
+	}
+}
@@ -0,0 +1,310 @@
+package sysroot
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"git.dolansoft.org/lorenz/winsysroot/authenticode"
+	"git.dolansoft.org/lorenz/winsysroot/manifest"
+)
+
+// ChecksumError is returned if a payload doesn't match the SHA256 hash given
+// in the manifest.
+type ChecksumError struct {
+	URL  string
+	Want string
+	Got  string
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("SHA256 mismatch for %v: expected %v, got %v", e.URL, e.Want, e.Got)
+}
+
+// ChecksumPolicy determines what happens if a downloaded payload doesn't
+// match its hash from the manifest.
+type ChecksumPolicy int
+
+const (
+	// ChecksumFail fails the build.
+	ChecksumFail ChecksumPolicy = iota
+	// ChecksumRedownload downloads the payload again a few times before
+	// failing the build.
+	ChecksumRedownload
+	// ChecksumWarn logs a warning and uses the payload anyway.
+	ChecksumWarn
+)
+
+// checksumRetries is the number of additional downloads attempted with
+// ChecksumRedownload.
+const checksumRetries = 2
+
+var checksumPolicyNames = map[string]ChecksumPolicy{
+	"fail":       ChecksumFail,
+	"redownload": ChecksumRedownload,
+	"warn":       ChecksumWarn,
+}
+
+// ParseChecksumPolicy parses the name of a policy (fail, redownload or
+// warn).
+func ParseChecksumPolicy(name string) (ChecksumPolicy, error) {
+	p, ok := checksumPolicyNames[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown checksum mismatch policy %q, expected fail, redownload or warn", name)
+	}
+	return p, nil
+}
+
+func (p ChecksumPolicy) String() string {
+	for name, v := range checksumPolicyNames {
+		if v == p {
+			return name
+		}
+	}
+	return fmt.Sprintf("ChecksumPolicy(%d)", int(p))
+}
+
+// verifyPayload checks the hex-encoded SHA256 hash sum of a downloaded
+// payload against the hash from the manifest. Payloads without a hash in
+// the manifest are accepted.
+func verifyPayload(payload manifest.Payload, sum string) error {
+	if payload.Sha256 == "" {
+		return nil
+	}
+	if !strings.EqualFold(sum, payload.Sha256) {
+		return &ChecksumError{URL: payload.URL, Want: strings.ToLower(payload.Sha256), Got: sum}
+	}
+	return nil
+}
+
+// payloadSet records which payloads have been seen so that each unique one
+// is only downloaded and extracted once, even if it is referenced by
+// several packages. Payloads are identified by their hash or, without one,
+// by their URL.
+type payloadSet map[string]bool
+
+// add reports whether payload hasn't been added before.
+func (s payloadSet) add(payload manifest.Payload) bool {
+	key := "url:" + payload.URL
+	if payload.Sha256 != "" {
+		key = "sha256:" + strings.ToLower(payload.Sha256)
+	}
+	if s[key] {
+		return false
+	}
+	s[key] = true
+	return true
+}
+
+// checkSigner fails if opts.RequireSigner is set and payload doesn't
+// reference a signer listed in the manifest.
+func checkSigner(opts *Options, payload manifest.Payload) error {
+	if !opts.RequireSigner {
+		return nil
+	}
+	if payload.Signer.Ref == "" {
+		return fmt.Errorf("payload %v has no signer", payload.FileName)
+	}
+	if _, ok := opts.Manifest.SignerSubject(payload.Signer.Ref); !ok {
+		return fmt.Errorf("payload %v references unknown signer %q", payload.FileName, payload.Signer.Ref)
+	}
+	return nil
+}
+
+// verifyAuthenticode checks the Authenticode signature of payload if
+// enabled in opts. Payloads without a signer in the manifest or of a type
+// which can't carry a signature fail verification.
+func verifyAuthenticode(opts *Options, payload manifest.Payload, data *payloadFile) error {
+	if !opts.Authenticode {
+		return nil
+	}
+	if payload.Signer.Ref == "" {
+		return fmt.Errorf("payload %v has no signer to verify its Authenticode signature against", payload.FileName)
+	}
+	subject, ok := opts.Manifest.SignerSubject(payload.Signer.Ref)
+	if !ok {
+		return fmt.Errorf("payload references unknown signer %q", payload.Signer.Ref)
+	}
+	var sig *authenticode.Signature
+	var err error
+	switch strings.ToLower(filepath.Ext(payload.FileName)) {
+	case ".cab":
+		sig, err = authenticode.VerifyCABReader(data.f, data.size)
+	case ".msi":
+		sig, err = authenticode.VerifyMSI(data.open())
+	case ".vsix":
+		sig, err = authenticode.VerifyVSIX(data.f, data.size)
+	default:
+		return fmt.Errorf("Authenticode verification of %v is not supported for this file type", payload.FileName)
+	}
+	if err != nil {
+		return fmt.Errorf("Authenticode verification of %v failed: %w", payload.FileName, err)
+	}
+	if !sig.MatchesSubject(subject) {
+		return fmt.Errorf("%v is signed by %q instead of %q", payload.FileName, sig.Signer.Subject, subject)
+	}
+	if opts.AuthenticodeIdentityOnly {
+		return nil
+	}
+	if err := sig.VerifyChain(opts.AuthenticodeRoots); err != nil {
+		return fmt.Errorf("untrusted Authenticode signature on %v: %w", payload.FileName, err)
+	}
+	return nil
+}
+
+// payloadFile is a downloaded payload. To keep memory usage low, payloads
+// are stored in a file, which is either an entry of the cache or a
+// temporary file removed by Close.
+type payloadFile struct {
+	f    *os.File
+	size int64
+	temp bool
+}
+
+// open returns a new reader for the whole payload. The readers of a
+// payloadFile can be used concurrently.
+func (p *payloadFile) open() *io.SectionReader {
+	return io.NewSectionReader(p.f, 0, p.size)
+}
+
+// Close closes the file and removes it if it is temporary.
+func (p *payloadFile) Close() error {
+	err := p.f.Close()
+	if p.temp {
+		os.Remove(p.f.Name())
+	}
+	return err
+}
+
+// download fetches the given payload of pkg and verifies it against its
+// hash from the manifest. If opts.CacheDir is set, verified payloads are
+// taken from and stored in the cache. The returned payloadFile must be
+// closed by the caller.
+func download(ctx context.Context, opts *Options, pkg manifest.Package, payload manifest.Payload) (*payloadFile, error) {
+	if err := checkSigner(opts, payload); err != nil {
+		return nil, err
+	}
+	opts.Events.DownloadStarted(pkg, payload.URL, int64(payload.Size))
+	if data, ok := readCache(opts, payload); ok {
+		opts.Events.DownloadFinished(pkg, payload.URL, data.size)
+		if err := verifyAuthenticode(opts, payload, data); err != nil {
+			data.Close()
+			return nil, err
+		}
+		return data, nil
+	}
+	var data *payloadFile
+	for attempt := 0; ; attempt++ {
+		var sum string
+		var err error
+		data, sum, err = get(ctx, opts, payload.URL)
+		if err != nil {
+			return nil, err
+		}
+		opts.Events.DownloadFinished(pkg, payload.URL, data.size)
+		err = verifyPayload(payload, sum)
+		if err == nil {
+			break
+		}
+		switch opts.OnChecksumMismatch {
+		case ChecksumWarn:
+			opts.Logger.Warn("Using payload despite checksum mismatch", "package", pkg.ID, "error", err)
+			if err := verifyAuthenticode(opts, payload, data); err != nil {
+				data.Close()
+				return nil, err
+			}
+			// Never cache unverified data.
+			return data, nil
+		case ChecksumRedownload:
+			if attempt < checksumRetries {
+				data.Close()
+				opts.Logger.Warn("Downloading payload again after checksum mismatch", "package", pkg.ID, "error", err)
+				opts.Events.DownloadStarted(pkg, payload.URL, int64(payload.Size))
+				continue
+			}
+		}
+		data.Close()
+		return nil, err
+	}
+	if err := verifyAuthenticode(opts, payload, data); err != nil {
+		data.Close()
+		return nil, err
+	}
+	writeCache(opts, payload, data)
+	return data, nil
+}
+
+// spoolDir returns the directory downloads are written to. If the cache is
+// enabled, it is used so that verified downloads can be moved into it.
+func spoolDir(opts *Options) string {
+	if opts.CacheDir != "" {
+		if err := os.MkdirAll(opts.CacheDir, 0755); err == nil {
+			return opts.CacheDir
+		}
+	}
+	return opts.TempDir
+}
+
+// cachePath returns the path of payload in the cache or an empty string if
+// it cannot be cached.
+func cachePath(opts *Options, payload manifest.Payload) string {
+	if opts.CacheDir == "" || payload.Sha256 == "" {
+		return ""
+	}
+	return filepath.Join(opts.CacheDir, strings.ToLower(payload.Sha256))
+}
+
+// cached reports whether payload is available in the cache directory.
+func cached(opts *Options, payload manifest.Payload) bool {
+	path := cachePath(opts, payload)
+	if path == "" {
+		return false
+	}
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// readCache returns the cached payload if present. Cached files not
+// matching their hash are removed so that they get downloaded again.
+func readCache(opts *Options, payload manifest.Payload) (*payloadFile, bool) {
+	path := cachePath(opts, payload)
+	if path == "" {
+		return nil, false
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, false
+	}
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err == nil {
+		err = verifyPayload(payload, hex.EncodeToString(h.Sum(nil)))
+	}
+	if err != nil {
+		f.Close()
+		opts.Logger.Warn("Removing corrupted cache entry", "path", path, "error", err)
+		os.Remove(path)
+		return nil, false
+	}
+	opts.Logger.Debug("Using cached payload", "url", payload.URL, "path", path)
+	return &payloadFile{f: f, size: size}, true
+}
+
+// writeCache moves a verified download into the cache. Failures are logged
+// but otherwise ignored as the cache is only an optimization.
+func writeCache(opts *Options, payload manifest.Payload, data *payloadFile) {
+	path := cachePath(opts, payload)
+	if path == "" || !data.temp {
+		return
+	}
+	if err := os.Rename(data.f.Name(), path); err != nil {
+		opts.Logger.Warn("Failed to write cache entry", "error", err)
+		return
+	}
+	data.temp = false
+}
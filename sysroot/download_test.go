@@ -0,0 +1,47 @@
+package sysroot
+
+import (
+	"encoding/json"
+	"testing"
+
+	"git.dolansoft.org/lorenz/winsysroot/manifest"
+)
+
+func TestPayloadSet(t *testing.T) {
+	s := make(payloadSet)
+	cases := []struct {
+		payload manifest.Payload
+		want    bool
+	}{
+		{manifest.Payload{URL: "https://a/1", Sha256: "ABCD"}, true},
+		{manifest.Payload{URL: "https://a/2", Sha256: "abcd"}, false},
+		{manifest.Payload{URL: "https://a/3"}, true},
+		{manifest.Payload{URL: "https://a/3"}, false},
+		{manifest.Payload{URL: "https://a/1"}, true},
+	}
+	for i, c := range cases {
+		if got := s.add(c.payload); got != c.want {
+			t.Errorf("case %d: add(%+v) = %v, want %v", i, c.payload, got, c.want)
+		}
+	}
+}
+
+func TestVerifyAuthenticodeUnverifiable(t *testing.T) {
+	var m manifest.Installer
+	if err := json.Unmarshal([]byte(`{"signers": [{"$id": "s1", "subjectName": "CN=Microsoft Corporation"}]}`), &m); err != nil {
+		t.Fatal(err)
+	}
+	opts := &Options{Manifest: &m, Authenticode: true}
+	for _, raw := range []string{
+		`{"fileName": "a.msi"}`,
+		`{"fileName": "a.exe", "signer": {"$ref": "s1"}}`,
+	} {
+		var payload manifest.Payload
+		if err := json.Unmarshal([]byte(raw), &payload); err != nil {
+			t.Fatal(err)
+		}
+		if err := verifyAuthenticode(opts, payload, nil); err == nil {
+			t.Errorf("%v passed Authenticode verification", raw)
+		}
+	}
+}
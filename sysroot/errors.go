@@ -0,0 +1,51 @@
+package sysroot
+
+import "fmt"
+
+// Stage is a step of the sysroot build an error can happen in.
+type Stage string
+
+const (
+	// StageUsage indicates invalid options.
+	StageUsage Stage = "usage"
+	// StageManifest indicates a failure fetching or parsing a manifest.
+	StageManifest Stage = "manifest"
+	// StageResolve indicates that the requested packages could not be found.
+	StageResolve Stage = "resolve"
+	// StageDownload indicates a failure downloading a payload.
+	StageDownload Stage = "download"
+	// StageExtract indicates a failure parsing or extracting a payload.
+	StageExtract Stage = "extract"
+	// StageOutput indicates a failure writing to the target.
+	StageOutput Stage = "output"
+)
+
+// Error annotates an error with the stage it happened in as well as the
+// package and payload being processed, if any.
+type Error struct {
+	Stage   Stage
+	Package string
+	URL     string
+	Err     error
+}
+
+func (e *Error) Error() string {
+	msg := string(e.Stage) + " failed"
+	if e.Package != "" {
+		msg += fmt.Sprintf(" for package %q", e.Package)
+	}
+	if e.URL != "" {
+		msg += fmt.Sprintf(" (%s)", e.URL)
+	}
+	return msg + ": " + e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Errorf returns an Error for the given stage, package and payload URL with a
+// formatted underlying error.
+func Errorf(stage Stage, pkg, url string, format string, a ...interface{}) error {
+	return &Error{Stage: stage, Package: pkg, URL: url, Err: fmt.Errorf(format, a...)}
+}
@@ -0,0 +1,35 @@
+package sysroot
+
+import "git.dolansoft.org/lorenz/winsysroot/manifest"
+
+// Events receives notifications about the progress of a build. Methods are
+// called synchronously from the build, so implementations should return
+// quickly. Calls are serialized, but notifications about concurrent
+// downloads and extractions are interleaved. Embed NopEvents to only
+// implement some of them.
+type Events interface {
+	// PackageResolved is called for every package selected for inclusion
+	// in the sysroot.
+	PackageResolved(pkg manifest.Package)
+	// DownloadStarted is called before a payload is downloaded. size is the
+	// size from the manifest, which might be zero if it is unknown.
+	DownloadStarted(pkg manifest.Package, url string, size int64)
+	// DownloadFinished is called after a payload has been downloaded
+	// successfully with the number of bytes received.
+	DownloadFinished(pkg manifest.Package, url string, bytes int64)
+	// FileExtracted is called after a file has been written to the target.
+	FileExtracted(path string, size int64)
+	// ExtractProgress is called repeatedly while the archive at url is
+	// extracted with the number of bytes decompressed so far and an
+	// estimate of the total.
+	ExtractProgress(pkg manifest.Package, url string, done, total int64)
+}
+
+// NopEvents implements Events by ignoring all notifications.
+type NopEvents struct{}
+
+func (NopEvents) PackageResolved(pkg manifest.Package)                                {}
+func (NopEvents) DownloadStarted(pkg manifest.Package, url string, size int64)        {}
+func (NopEvents) DownloadFinished(pkg manifest.Package, url string, bytes int64)      {}
+func (NopEvents) FileExtracted(path string, size int64)                               {}
+func (NopEvents) ExtractProgress(pkg manifest.Package, url string, done, total int64) {}
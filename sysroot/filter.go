@@ -0,0 +1,51 @@
+package sysroot
+
+import (
+	"time"
+
+	"git.dolansoft.org/lorenz/winsysroot/msi"
+)
+
+// Decision is the result of a Filter.
+type Decision int
+
+const (
+	// Default applies the built-in filtering rules to the file.
+	Default Decision = iota
+	// Include includes the file regardless of the built-in rules.
+	Include
+	// Exclude excludes the file regardless of the built-in rules.
+	Exclude
+)
+
+// FileInfo describes a file considered for inclusion in the sysroot.
+type FileInfo struct {
+	// Size of the file in bytes.
+	Size int64
+	// ModTime is the modification time of the file.
+	ModTime time.Time
+	// Package is the ID of the package the file is from.
+	Package string
+	// Component is the MSI component installing the file, which tells
+	// apart 64-bit and 32-bit copies of the same file by its attributes
+	// and condition. It is only set for files from the Windows SDK.
+	Component *msi.Component
+}
+
+// A Filter is called for every file considered for extraction with its path
+// in the sysroot and decides if it is included.
+type Filter func(targetPath string, info FileInfo) Decision
+
+// applyFilter combines the decision of the user-provided filter with the
+// built-in one.
+func (o *Options) applyFilter(targetPath string, info FileInfo, builtin func() bool) bool {
+	if o.Filter != nil {
+		switch o.Filter(targetPath, info) {
+		case Include:
+			return true
+		case Exclude:
+			return false
+		}
+	}
+	return builtin()
+}
@@ -0,0 +1,411 @@
+package sysroot
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"git.dolansoft.org/lorenz/winsysroot/msi"
+	"git.dolansoft.org/lorenz/winsysroot/target"
+	"git.dolansoft.org/lorenz/winsysroot/vsix"
+)
+
+// Lazy is a sysroot whose files are known up front, but only downloaded and
+// extracted once they are opened. All files of a payload are extracted
+// together into a local directory, which is reused if the same directory is
+// passed to NewLazy again.
+type Lazy struct {
+	opts  Options
+	dir   string
+	out   *output
+	files map[string]*LazyFile
+	list  []*LazyFile
+}
+
+// LazyFile is a file of a Lazy sysroot.
+type LazyFile struct {
+	// Path is the slash-separated path of the file relative to the root of
+	// the sysroot.
+	Path string
+	Size int64
+	// ModTime of Windows SDK files is the time their MSI was created, as
+	// the cabinets with the actual times are only read when extracting.
+	ModTime time.Time
+	src     *lazySource
+}
+
+// lazySource extracts a payload. It is run once the first of its files is
+// opened.
+type lazySource struct {
+	extract func(ctx context.Context, out *output) error
+	// mu is held while extracting so that concurrent opens wait for it.
+	mu   sync.Mutex
+	done int32
+}
+
+// NewLazy resolves the packages selected by opts and lists their files,
+// which requires downloading the MSIs of the Windows SDK and the central
+// directories of the VSIX packages. Files are extracted into dir when
+// opened. Cancelling ctx only affects listing the files.
+func NewLazy(ctx context.Context, opts Options, dir string) (*Lazy, error) {
+	licenses, err := opts.prepare()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, Errorf(StageOutput, "", "", "%w", err)
+	}
+	l := &Lazy{opts: opts, dir: dir, out: &output{files: atomicDir(dir)}, files: make(map[string]*LazyFile)}
+	hasArch := make(map[string]bool)
+	for _, arch := range opts.Architectures {
+		hasArch[arch] = true
+	}
+	var mu sync.Mutex
+	add := func(f *LazyFile) {
+		mu.Lock()
+		defer mu.Unlock()
+		if _, ok := l.files[f.Path]; ok {
+			opts.Logger.Debug("Ignoring duplicate file", "path", f.Path)
+			return
+		}
+		l.files[f.Path] = f
+	}
+	p := newPipeline(ctx, &l.opts)
+	if err := l.listWinSDK(p, hasArch, add); err != nil {
+		p.wait()
+		return nil, err
+	}
+	if err := l.listVCTools(p, hasArch, add); err != nil {
+		p.wait()
+		return nil, err
+	}
+	if err := p.wait(); err != nil {
+		return nil, err
+	}
+	licenseDir := target.NewDirectory(dir)
+	err = writeLicenses(&l.opts, licenses, licenseDir)
+	if cerr := licenseDir.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, Errorf(StageOutput, "", "", "failed to write licenses: %w", err)
+	}
+	for _, name := range []string{"LICENSES.txt", "accepted.json"} {
+		path := LicensesDir + "/" + name
+		fi, err := os.Stat(filepath.Join(dir, filepath.FromSlash(path)))
+		if err != nil {
+			return nil, Errorf(StageOutput, "", "", "%w", err)
+		}
+		add(&LazyFile{Path: path, Size: fi.Size(), ModTime: fi.ModTime()})
+	}
+	for _, f := range l.files {
+		l.list = append(l.list, f)
+	}
+	sort.Slice(l.list, func(i, j int) bool { return l.list[i].Path < l.list[j].Path })
+	return l, nil
+}
+
+// Files returns all files of the sysroot sorted by path.
+func (l *Lazy) Files() []*LazyFile {
+	return l.list
+}
+
+// File returns the file with the given path.
+func (l *Lazy) File(path string) (*LazyFile, bool) {
+	f, ok := l.files[path]
+	return f, ok
+}
+
+// Open returns the contents of f, downloading and extracting the payload
+// containing it first if necessary. Cancelling ctx aborts waiting for that,
+// but doesn't abort an extraction which other callers are waiting for as
+// well.
+func (l *Lazy) Open(ctx context.Context, f *LazyFile) (*os.File, error) {
+	path := filepath.Join(l.dir, filepath.FromSlash(f.Path))
+	if fi, err := os.Stat(path); err == nil && fi.Size() == f.Size {
+		return os.Open(path)
+	}
+	if f.src != nil {
+		if err := l.fetch(ctx, f.src); err != nil {
+			return nil, err
+		}
+	}
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, Errorf(StageExtract, "", "", "%v was not found in its payload", f.Path)
+	}
+	return file, err
+}
+
+// fetch runs the extraction of src unless it has already succeeded.
+func (l *Lazy) fetch(ctx context.Context, src *lazySource) error {
+	if atomic.LoadInt32(&src.done) != 0 {
+		return nil
+	}
+	result := make(chan error, 1)
+	go func() {
+		src.mu.Lock()
+		defer src.mu.Unlock()
+		if atomic.LoadInt32(&src.done) != 0 {
+			result <- nil
+			return
+		}
+		// Extraction continues if ctx is cancelled, as others might be
+		// waiting for it as well.
+		err := src.extract(context.Background(), l.out)
+		if err == nil {
+			atomic.StoreInt32(&src.done, 1)
+		}
+		result <- err
+	}()
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// listWinSDK queues listing the files of the Windows SDK.
+func (l *Lazy) listWinSDK(p *pipeline, hasArch map[string]bool, add func(*LazyFile)) error {
+	opts := &l.opts
+	sdkPkg, ok := opts.Manifest.SDKPackage(opts.WinSDKVersion)
+	if !ok {
+		return Errorf(StageResolve, "", "", "failed to find Windows SDK with version %v", opts.WinSDKVersion)
+	}
+	if err := checkDeprecated(opts, []string{sdkPkg.ID}); err != nil {
+		return err
+	}
+	opts.Events.PackageResolved(sdkPkg)
+	cabPayloads := sdkCABPayloads(sdkPkg)
+	var mu sync.Mutex
+	cabSources := make(map[string]*lazySource)
+	// cabSource returns the source extracting the cabinet called name.
+	// Sets of cabinets are extracted as a whole, so the sources of all
+	// parts are done afterwards.
+	cabSource := func(name string, msiInfo *msi.MSI) *lazySource {
+		name = strings.ToLower(name)
+		mu.Lock()
+		defer mu.Unlock()
+		if src, ok := cabSources[name]; ok {
+			return src
+		}
+		payload, ok := cabPayloads[name]
+		if !ok {
+			return nil
+		}
+		claim := func(siblings []string) bool {
+			mu.Lock()
+			defer mu.Unlock()
+			for _, sibling := range siblings {
+				if src, ok := cabSources[strings.ToLower(sibling)]; ok {
+					atomic.StoreInt32(&src.done, 1)
+				}
+			}
+			return true
+		}
+		src := &lazySource{extract: func(ctx context.Context, out *output) error {
+			job, err := sdkCABJob(ctx, opts, out, sdkPkg, payload, cabPayloads, msiInfo, hasArch, claim)
+			if err != nil {
+				return err
+			}
+			return job()
+		}}
+		cabSources[name] = src
+		return src
+	}
+	seen := make(payloadSet)
+	for _, payload := range sdkPkg.Payloads {
+		if !strings.HasSuffix(payload.FileName, ".msi") || !seen.add(payload) {
+			continue
+		}
+		payload := payload
+		p.add(func(ctx context.Context) (func() error, error) {
+			msiRaw, err := download(ctx, opts, sdkPkg, payload)
+			if err != nil {
+				return nil, Errorf(StageDownload, sdkPkg.ID, payload.URL, "failed to download MSI %v: %w", payload.FileName, err)
+			}
+			return func() error {
+				defer msiRaw.Close()
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+				msiData, err := msi.Parse(msiRaw.open())
+				if err != nil {
+					return Errorf(StageExtract, sdkPkg.ID, payload.URL, "failed to parse MSI %v: %w", payload.FileName, err)
+				}
+				// Embedded cabinets are read from the MSI, which has to be
+				// downloaded and parsed again.
+				embedded := &lazySource{extract: func(ctx context.Context, out *output) error {
+					msiRaw, err := download(ctx, opts, sdkPkg, payload)
+					if err != nil {
+						return Errorf(StageDownload, sdkPkg.ID, payload.URL, "failed to download MSI %v: %w", payload.FileName, err)
+					}
+					defer msiRaw.Close()
+					msiData, err := msi.Parse(msiRaw.open())
+					if err != nil {
+						return Errorf(StageExtract, sdkPkg.ID, payload.URL, "failed to parse MSI %v: %w", payload.FileName, err)
+					}
+					return extractEmbeddedCABs(ctx, opts, out, sdkPkg, payload, msiData, relevantCABs(opts, msiData, hasArch), hasArch)
+				}}
+				isEmbedded := make(map[string]bool)
+				for _, name := range msiData.EmbeddedCABFiles {
+					isEmbedded[name] = true
+				}
+				var featureFiles map[string]bool
+				if len(opts.SDKFeatures) > 0 {
+					featureFiles = msiData.FeatureFiles(opts.SDKFeatures...)
+				}
+				for key, outPath := range msiData.FileMap {
+					if !wantedSDKFile(opts, msiData, featureFiles, hasArch, key) {
+						continue
+					}
+					size, _ := msiData.FileSize(key)
+					info := FileInfo{Size: size, Package: sdkPkg.ID}
+					info.Component, _ = msiData.FileComponent(key)
+					outPath := outPath
+					if !opts.applyFilter(outPath, info, func() bool { return includeSDKFile(outPath, hasArch, opts.Slim) }) {
+						continue
+					}
+					cabName, ok := msiData.FileCAB[key]
+					var src *lazySource
+					if isEmbedded[cabName] {
+						src = embedded
+					} else if ok {
+						src = cabSource(cabName, msiData)
+					}
+					if src == nil {
+						opts.Logger.Warn("Ignoring file without known cabinet", "file", outPath, "msi", payload.FileName)
+						continue
+					}
+					add(&LazyFile{Path: outPath, Size: size, ModTime: msiData.Summary.CreateTime, src: src})
+				}
+				return nil
+			}, nil
+		})
+	}
+	return nil
+}
+
+// listVCTools queues listing the files of the VC tools packages. Only the
+// central directories of the packages are fetched if the server supports
+// range requests.
+func (l *Lazy) listVCTools(p *pipeline, hasArch map[string]bool, add func(*LazyFile)) error {
+	opts := &l.opts
+	pkgs, err := vcToolsPackages(opts)
+	if err != nil {
+		return err
+	}
+	var ids []string
+	for _, pkg := range pkgs {
+		ids = append(ids, pkg.ID)
+	}
+	if err := checkDeprecated(opts, ids); err != nil {
+		return err
+	}
+	seen := make(payloadSet)
+	for _, pkg := range pkgs {
+		opts.Events.PackageResolved(pkg)
+		if !strings.EqualFold(pkg.Type, "vsix") || !seen.add(pkg.Payloads[0]) {
+			continue
+		}
+		pkg := pkg
+		src := &lazySource{extract: func(ctx context.Context, out *output) error {
+			job, err := vsixJob(ctx, opts, out, pkg, hasArch)
+			if err != nil {
+				return err
+			}
+			return job()
+		}}
+		p.add(func(ctx context.Context) (func() error, error) {
+			payload := pkg.Payloads[0]
+			var r io.ReaderAt
+			var size int64
+			var closer io.Closer = ioutil.NopCloser(nil)
+			if !opts.Authenticode && !cached(opts, payload) {
+				rr, err := openRange(ctx, opts, payload.URL)
+				if err != nil && !errors.Is(err, errNoRanges) {
+					return nil, Errorf(StageDownload, pkg.ID, payload.URL, "failed to list package: %w", err)
+				}
+				if err == nil {
+					r, size = rr, rr.size
+				}
+			}
+			if r == nil {
+				data, err := download(ctx, opts, pkg, payload)
+				if err != nil {
+					return nil, Errorf(StageDownload, pkg.ID, payload.URL, "failed to download package: %w", err)
+				}
+				r, size, closer = data.f, data.size, data
+			}
+			return func() error {
+				defer closer.Close()
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+				archive, err := vsix.New(r, size)
+				if err != nil {
+					return Errorf(StageExtract, pkg.ID, payload.URL, "failed to open package: %w", err)
+				}
+				for _, file := range archive.Files {
+					targetPath := file.InstallPath
+					info := FileInfo{Size: file.Size, ModTime: file.ModTime, Package: pkg.ID}
+					if opts.applyFilter(targetPath, info, func() bool { return includeVCFile(targetPath, hasArch) }) {
+						add(&LazyFile{Path: targetPath, Size: file.Size, ModTime: file.ModTime, src: src})
+					}
+				}
+				return nil
+			}, nil
+		})
+	}
+	return nil
+}
+
+// atomicDir writes files into a directory by renaming them into place once
+// they are complete, so that files which are being read are never
+// truncated.
+type atomicDir string
+
+func (d atomicDir) CreateFile(path string, size int64, modTime time.Time) (io.WriteCloser, error) {
+	path, err := target.CleanPath(path)
+	if err != nil {
+		return nil, err
+	}
+	targetPath := filepath.Join(string(d), filepath.FromSlash(path))
+	if err := os.MkdirAll(filepath.Dir(targetPath), 0755); err != nil {
+		return nil, err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(targetPath), ".tmp-")
+	if err != nil {
+		return nil, err
+	}
+	return &atomicFile{f: f, path: targetPath}, nil
+}
+
+type atomicFile struct {
+	f    *os.File
+	path string
+}
+
+func (f *atomicFile) Write(b []byte) (int, error) {
+	return f.f.Write(b)
+}
+
+func (f *atomicFile) Close() error {
+	err := f.f.Close()
+	if err == nil {
+		err = os.Rename(f.f.Name(), f.path)
+	}
+	if err != nil {
+		os.Remove(f.f.Name())
+	}
+	return err
+}
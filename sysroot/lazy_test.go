@@ -0,0 +1,61 @@
+package sysroot
+
+import (
+	"context"
+	"io/ioutil"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLazyOpen(t *testing.T) {
+	dir := t.TempDir()
+	var runs int32
+	src := &lazySource{extract: func(ctx context.Context, out *output) error {
+		atomic.AddInt32(&runs, 1)
+		for _, name := range []string{"Include/a.h", "Include/b.h"} {
+			w, err := out.files.CreateFile(name, 3, time.Time{})
+			if err != nil {
+				return err
+			}
+			if _, err := w.Write([]byte(name[8:])); err != nil {
+				return err
+			}
+			if err := w.Close(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}}
+	l := &Lazy{dir: dir, out: &output{files: atomicDir(dir)}}
+	files := []*LazyFile{
+		{Path: "Include/a.h", Size: 3, src: src},
+		{Path: "Include/b.h", Size: 3, src: src},
+		{Path: "Include/missing.h", Size: 3, src: src},
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(f *LazyFile) {
+			defer wg.Done()
+			file, err := l.Open(context.Background(), f)
+			if err != nil {
+				t.Errorf("failed to open %v: %v", f.Path, err)
+				return
+			}
+			defer file.Close()
+			data, err := ioutil.ReadAll(file)
+			if err != nil || string(data) != f.Path[8:] {
+				t.Errorf("%v contains %q, %v", f.Path, data, err)
+			}
+		}(files[i%2])
+	}
+	wg.Wait()
+	if _, err := l.Open(context.Background(), files[2]); err == nil {
+		t.Error("expected opening a file missing from its payload to fail")
+	}
+	if runs != 1 {
+		t.Errorf("expected payload to be extracted once, got %d", runs)
+	}
+}
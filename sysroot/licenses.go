@@ -0,0 +1,137 @@
+package sysroot
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"git.dolansoft.org/lorenz/winsysroot/manifest"
+	"git.dolansoft.org/lorenz/winsysroot/target"
+)
+
+// buildToolsProductID is the product the VC tools are distributed with. Its
+// license applies to tools packages which don't reference one themselves.
+const buildToolsProductID = "Microsoft.VisualStudio.Product.BuildTools"
+
+// LicensesDir is the directory in the sysroot the license record is
+// written to.
+const LicensesDir = "licenses"
+
+// License is a license some of the packages in a sysroot are distributed
+// under.
+type License struct {
+	// Title is the title of the package referencing the license.
+	Title string `json:"title,omitempty"`
+	// URL points to the license text. It is empty for packages which don't
+	// reference any license in the manifest.
+	URL string `json:"url"`
+	// Packages are the IDs of the packages distributed under the license.
+	Packages []string `json:"packages"`
+}
+
+// Licenses returns the licenses of all packages a build with opts would
+// include, sorted by URL.
+func Licenses(opts Options) ([]License, error) {
+	if opts.Manifest == nil {
+		return nil, Errorf(StageUsage, "", "", "no installer manifest given")
+	}
+	sdkPkg, ok := opts.Manifest.SDKPackage(opts.WinSDKVersion)
+	if !ok {
+		return nil, Errorf(StageResolve, "", "", "failed to find Windows SDK with version %v", opts.WinSDKVersion)
+	}
+	vcPkgs, err := vcToolsPackages(&opts)
+	if err != nil {
+		return nil, err
+	}
+	var fallback manifest.LocalizedResource
+	if product, ok := opts.Manifest.Package(buildToolsProductID); ok {
+		fallback, _ = product.Resource("en-us")
+	}
+	byURL := make(map[string]*License)
+	add := func(pkg manifest.Package, res manifest.LocalizedResource) {
+		l, ok := byURL[res.License]
+		if !ok {
+			l = &License{Title: res.Title, URL: res.License}
+			byURL[res.License] = l
+		}
+		l.Packages = append(l.Packages, pkg.ID)
+	}
+	res, _ := sdkPkg.Resource("en-us")
+	add(sdkPkg, res)
+	for _, pkg := range vcPkgs {
+		res, ok := pkg.Resource("en-us")
+		if !ok || res.License == "" {
+			res = fallback
+		}
+		add(pkg, res)
+	}
+	var licenses []License
+	for _, l := range byURL {
+		licenses = append(licenses, *l)
+	}
+	sort.Slice(licenses, func(i, j int) bool { return licenses[i].URL < licenses[j].URL })
+	return licenses, nil
+}
+
+// formatLicenses returns a human-readable list of licenses.
+func formatLicenses(licenses []License) string {
+	var b strings.Builder
+	for _, l := range licenses {
+		url := l.URL
+		if url == "" {
+			url = "(no license referenced in the manifest)"
+		}
+		if l.Title != "" {
+			fmt.Fprintf(&b, "%v: %v\n", l.Title, url)
+		} else {
+			fmt.Fprintf(&b, "%v\n", url)
+		}
+		fmt.Fprintf(&b, "  covering %v\n", strings.Join(l.Packages, ", "))
+	}
+	return b.String()
+}
+
+// licenseRecord is written to the sysroot as a record of the accepted
+// licenses.
+type licenseRecord struct {
+	Accepted      time.Time `json:"accepted"`
+	WinSDKVersion string    `json:"winSdkVersion"`
+	Architectures []string  `json:"architectures"`
+	Licenses      []License `json:"licenses"`
+}
+
+// writeLicenses writes the license list and acceptance record into the
+// licenses directory of the sysroot.
+func writeLicenses(opts *Options, licenses []License, t target.Target) error {
+	now := time.Now()
+	record, err := json.MarshalIndent(&licenseRecord{
+		Accepted:      now.UTC(),
+		WinSDKVersion: opts.WinSDKVersion,
+		Architectures: opts.Architectures,
+		Licenses:      licenses,
+	}, "", "\t")
+	if err != nil {
+		return err
+	}
+	text := "The components of this sysroot are distributed under the following licenses,\n" +
+		"which were accepted on " + now.UTC().Format(time.RFC3339) + ":\n\n" + formatLicenses(licenses)
+	files := []struct {
+		name    string
+		content []byte
+	}{
+		{LicensesDir + "/LICENSES.txt", []byte(text)},
+		{LicensesDir + "/accepted.json", append(record, '\n')},
+	}
+	for _, f := range files {
+		if err := t.Create(f.name, int64(len(f.content)), now); err != nil {
+			return err
+		}
+		if _, err := bytes.NewReader(f.content).WriteTo(t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
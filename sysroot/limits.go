@@ -0,0 +1,63 @@
+package sysroot
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"git.dolansoft.org/lorenz/winsysroot/cab"
+)
+
+// ErrLimitExceeded is returned if a payload exceeds one of the configured
+// Limits.
+var ErrLimitExceeded = cab.ErrLimitExceeded
+
+// Limits guard against malformed or hostile payloads exhausting memory or
+// disk space. Zero fields disable the respective limit.
+type Limits struct {
+	// MaxFileSize limits the size of a single extracted file.
+	MaxFileSize int64
+	// MaxTotalSize limits the total size of all extracted files.
+	MaxTotalSize int64
+	// MaxFolderSize limits the uncompressed size of a CAB folder, which is
+	// held in memory while extracting it.
+	MaxFolderSize int64
+	// MaxRatio limits the ratio between uncompressed and compressed size of
+	// CAB folders and zip entries larger than 1MiB.
+	MaxRatio float64
+}
+
+// DefaultLimits are used if Options.Limits is nil. They are well above
+// what any known package needs.
+var DefaultLimits = Limits{
+	MaxFileSize:   2 << 30,
+	MaxTotalSize:  32 << 30,
+	MaxFolderSize: 2 << 30,
+	MaxRatio:      200,
+}
+
+// ratioGrace is the size below which the decompression ratio isn't checked.
+const ratioGrace = 1 << 20
+
+// cabOptions returns the options for reading CAB files. Block checksums are
+// always verified.
+func (l *Limits) cabOptions() cab.Options {
+	return cab.Options{MaxFolderSize: l.MaxFolderSize, MaxRatio: l.MaxRatio, VerifyChecksums: true}
+}
+
+// checkFile accounts for a file of the given size about to be written,
+// failing if it exceeds the limits. compressedSize is the size of the file
+// in its archive or -1 if it isn't known.
+func (o *Options) checkFile(path string, size, compressedSize int64) error {
+	l := o.Limits
+	if l.MaxFileSize > 0 && size > l.MaxFileSize {
+		return fmt.Errorf("%w: %v is %d bytes, more than the maximum of %d", ErrLimitExceeded, path, size, l.MaxFileSize)
+	}
+	if l.MaxRatio > 0 && compressedSize >= 0 && size > ratioGrace && float64(size) > l.MaxRatio*float64(compressedSize) {
+		return fmt.Errorf("%w: %v decompresses to more than %v times its size", ErrLimitExceeded, path, l.MaxRatio)
+	}
+	written := atomic.AddInt64(o.written, size)
+	if l.MaxTotalSize > 0 && written > l.MaxTotalSize {
+		return fmt.Errorf("%w: sysroot is larger than %d bytes", ErrLimitExceeded, l.MaxTotalSize)
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package sysroot
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCheckFile(t *testing.T) {
+	limits := Limits{MaxFileSize: 4 << 20, MaxTotalSize: 6 << 20, MaxRatio: 10}
+	for _, tc := range []struct {
+		name string
+		// sizes and compressed sizes of the files extracted in order
+		sizes, compressed []int64
+		fail              bool
+	}{
+		{"within limits", []int64{3 << 20, 3 << 20}, []int64{-1, 1 << 20}, false},
+		{"file size", []int64{5 << 20}, []int64{-1}, true},
+		{"total size", []int64{3 << 20, 3 << 20, 1}, []int64{-1, -1, -1}, true},
+		{"zip entry ratio", []int64{3 << 20}, []int64{100 << 10}, true},
+		{"small zip entry", []int64{100 << 10}, []int64{1}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := &Options{Limits: &limits, written: new(int64)}
+			var err error
+			for i, size := range tc.sizes {
+				if err = opts.checkFile("file", size, tc.compressed[i]); err != nil {
+					break
+				}
+			}
+			if tc.fail && !errors.Is(err, ErrLimitExceeded) {
+				t.Errorf("got error %v, want ErrLimitExceeded", err)
+			}
+			if !tc.fail && err != nil {
+				t.Errorf("checkFile: %v", err)
+			}
+		})
+	}
+}
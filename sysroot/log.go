@@ -0,0 +1,52 @@
+package sysroot
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Logger receives structured log messages consisting of a message and
+// alternating keys and values. It is satisfied by *slog.Logger.
+type Logger interface {
+	Debug(msg string, args ...interface{})
+	Info(msg string, args ...interface{})
+	Warn(msg string, args ...interface{})
+}
+
+// StdLogger is a Logger writing to the standard library's default logger.
+// Debug messages are dropped unless Verbose is set.
+type StdLogger struct {
+	Verbose bool
+}
+
+func formatLog(level, msg string, args []interface{}) string {
+	var b strings.Builder
+	if level != "" {
+		b.WriteString(level)
+		b.WriteString(": ")
+	}
+	b.WriteString(msg)
+	for i := 0; i < len(args); i += 2 {
+		if i+1 < len(args) {
+			fmt.Fprintf(&b, " %v=%q", args[i], fmt.Sprint(args[i+1]))
+		} else {
+			fmt.Fprintf(&b, " %v", args[i])
+		}
+	}
+	return b.String()
+}
+
+func (l StdLogger) Debug(msg string, args ...interface{}) {
+	if l.Verbose {
+		log.Print(formatLog("", msg, args))
+	}
+}
+
+func (l StdLogger) Info(msg string, args ...interface{}) {
+	log.Print(formatLog("", msg, args))
+}
+
+func (l StdLogger) Warn(msg string, args ...interface{}) {
+	log.Print(formatLog("Warning", msg, args))
+}
@@ -0,0 +1,262 @@
+package sysroot
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"runtime"
+	"sync"
+	"time"
+
+	"git.dolansoft.org/lorenz/winsysroot/manifest"
+	"git.dolansoft.org/lorenz/winsysroot/target"
+)
+
+// DefaultDownloads is the number of concurrent downloads used if
+// Options.Downloads is zero.
+const DefaultDownloads = 4
+
+// pipeline downloads payloads concurrently and hands them to a pool of
+// extraction workers. Downloads are started in the order they were added. A
+// download only releases its slot once its extraction job has been queued,
+// so downloads stall instead of piling up in memory when extraction falls
+// behind. Jobs may add more work, for example downloads they found to be
+// needed. The first error cancels all remaining work.
+type pipeline struct {
+	parent      context.Context
+	ctx         context.Context
+	cancel      context.CancelFunc
+	jobs        chan func() error
+	pending     sync.WaitGroup
+	downloaders sync.WaitGroup
+	workers     sync.WaitGroup
+
+	mu     sync.Mutex
+	queued *sync.Cond
+	queue  []func(ctx context.Context) (func() error, error)
+	closed bool
+	err    error
+}
+
+func newPipeline(ctx context.Context, opts *Options) *pipeline {
+	p := &pipeline{parent: ctx}
+	p.ctx, p.cancel = context.WithCancel(ctx)
+	p.queued = sync.NewCond(&p.mu)
+	p.jobs = make(chan func() error, opts.ExtractWorkers)
+	for i := 0; i < opts.Downloads; i++ {
+		p.downloaders.Add(1)
+		go p.download()
+	}
+	for i := 0; i < opts.ExtractWorkers; i++ {
+		p.workers.Add(1)
+		go func() {
+			defer p.workers.Done()
+			for job := range p.jobs {
+				p.fail(job())
+			}
+		}()
+	}
+	return p
+}
+
+// add queues fetch to run concurrently with other downloads and queues the
+// extraction job it returns, if any. Both should stop once the context
+// passed to fetch is cancelled. Jobs are run even after a failure so that
+// they can release their resources, but they should then return early.
+func (p *pipeline) add(fetch func(ctx context.Context) (func() error, error)) {
+	// pending covers both the download and its job, so that wait doesn't
+	// return while a running job can still add work.
+	p.pending.Add(1)
+	p.mu.Lock()
+	p.queue = append(p.queue, fetch)
+	p.mu.Unlock()
+	p.queued.Signal()
+}
+
+// download runs queued downloads in order until the pipeline is closed.
+func (p *pipeline) download() {
+	defer p.downloaders.Done()
+	for {
+		p.mu.Lock()
+		for len(p.queue) == 0 && !p.closed {
+			p.queued.Wait()
+		}
+		if len(p.queue) == 0 {
+			p.mu.Unlock()
+			return
+		}
+		fetch := p.queue[0]
+		p.queue = p.queue[1:]
+		p.mu.Unlock()
+		p.run(fetch)
+	}
+}
+
+func (p *pipeline) run(fetch func(ctx context.Context) (func() error, error)) {
+	if p.ctx.Err() != nil {
+		p.pending.Done()
+		return
+	}
+	job, err := fetch(p.ctx)
+	if err != nil || job == nil {
+		p.fail(err)
+		p.pending.Done()
+		return
+	}
+	p.jobs <- func() error {
+		defer p.pending.Done()
+		return job()
+	}
+}
+
+// fail records err if it is the first error and cancels all other work.
+func (p *pipeline) fail(err error) {
+	if err == nil {
+		return
+	}
+	p.mu.Lock()
+	if p.err == nil {
+		p.err = err
+	}
+	p.mu.Unlock()
+	p.cancel()
+}
+
+// wait waits until all downloads and extraction jobs are done and returns
+// the first error. No more work can be added afterwards.
+func (p *pipeline) wait() error {
+	p.pending.Wait()
+	p.mu.Lock()
+	p.closed = true
+	p.mu.Unlock()
+	p.queued.Broadcast()
+	p.downloaders.Wait()
+	close(p.jobs)
+	p.workers.Wait()
+	p.cancel()
+	if p.err == nil && p.parent.Err() != nil {
+		return Errorf(StageDownload, "", "", "%w", p.parent.Err())
+	}
+	return p.err
+}
+
+// output writes extracted files to the target from concurrent extraction
+// workers. Targets which can't write several files at once are serialized by
+// target.Files.
+type output struct {
+	files target.FileCreator
+}
+
+func newOutput(t target.Target) *output {
+	return &output{files: target.Files(t)}
+}
+
+// bufferedFileSize is the size up to which files are decompressed into
+// memory before writing them, so that workers writing to serialized targets
+// only wait for each other's writes and not for their decompression.
+const bufferedFileSize = 16 << 20
+
+// readErrorReader remembers errors of the underlying reader to tell them
+// apart from errors writing to the target.
+type readErrorReader struct {
+	r   io.Reader
+	err error
+}
+
+func (r *readErrorReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, err
+}
+
+// writeFile writes a file with the contents of r to the target. Errors are
+// attributed to pkg and url.
+func (o *output) writeFile(pkg, url, path string, size int64, modTime time.Time, r io.Reader) error {
+	if size <= bufferedFileSize {
+		buf := make([]byte, size)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return Errorf(StageExtract, pkg, url, "failed to extract %q: %w", path, err)
+		}
+		r = bytes.NewReader(buf)
+	}
+	src := &readErrorReader{r: r}
+	w, err := o.files.CreateFile(path, size, modTime)
+	if err != nil {
+		return Errorf(StageOutput, pkg, url, "failed to create output file: %w", err)
+	}
+	_, err = io.Copy(w, src)
+	if cerr := w.Close(); err == nil && cerr != nil {
+		return Errorf(StageOutput, pkg, url, "failed to finish file %q: %w", path, cerr)
+	}
+	if err != nil {
+		if src.err != nil {
+			return Errorf(StageExtract, pkg, url, "failed to extract %q: %w", path, err)
+		}
+		return Errorf(StageOutput, pkg, url, "failed to copy file %q to target: %w", path, err)
+	}
+	return nil
+}
+
+// syncEvents serializes calls to Events from concurrent downloads and
+// extraction workers.
+type syncEvents struct {
+	mu sync.Mutex
+	e  Events
+}
+
+func (s *syncEvents) PackageResolved(pkg manifest.Package) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.e.PackageResolved(pkg)
+}
+
+func (s *syncEvents) DownloadStarted(pkg manifest.Package, url string, size int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.e.DownloadStarted(pkg, url, size)
+}
+
+func (s *syncEvents) DownloadFinished(pkg manifest.Package, url string, bytes int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.e.DownloadFinished(pkg, url, bytes)
+}
+
+func (s *syncEvents) FileExtracted(path string, size int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.e.FileExtracted(path, size)
+}
+
+func (s *syncEvents) ExtractProgress(pkg manifest.Package, url string, done, total int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.e.ExtractProgress(pkg, url, done, total)
+}
+
+// syncFilter returns a Filter serializing calls to f.
+func syncFilter(f Filter) Filter {
+	var mu sync.Mutex
+	return func(targetPath string, info FileInfo) Decision {
+		mu.Lock()
+		defer mu.Unlock()
+		return f(targetPath, info)
+	}
+}
+
+// checkWorkers validates the concurrency settings and applies defaults.
+func (o *Options) checkWorkers() error {
+	if o.Downloads < 0 || o.ExtractWorkers < 0 {
+		return errors.New("number of downloads and extraction workers must not be negative")
+	}
+	if o.Downloads == 0 {
+		o.Downloads = DefaultDownloads
+	}
+	if o.ExtractWorkers == 0 {
+		o.ExtractWorkers = runtime.NumCPU()
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package sysroot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestPipeline(t *testing.T) {
+	opts := &Options{Downloads: 2, ExtractWorkers: 3}
+	p := newPipeline(context.Background(), opts)
+	var mu sync.Mutex
+	done := make(map[int]bool)
+	for i := 0; i < 20; i++ {
+		i := i
+		p.add(func(ctx context.Context) (func() error, error) {
+			if i%5 == 0 {
+				return nil, nil
+			}
+			return func() error {
+				mu.Lock()
+				done[i] = true
+				mu.Unlock()
+				return nil
+			}, nil
+		})
+	}
+	if err := p.wait(); err != nil {
+		t.Fatalf("wait: %v", err)
+	}
+	if len(done) != 16 {
+		t.Errorf("ran %d jobs, want 16", len(done))
+	}
+
+	// Downloads start in order
+	p = newPipeline(context.Background(), &Options{Downloads: 1, ExtractWorkers: 2})
+	var order []int
+	for i := 0; i < 10; i++ {
+		i := i
+		p.add(func(ctx context.Context) (func() error, error) {
+			order = append(order, i)
+			return nil, nil
+		})
+	}
+	if err := p.wait(); err != nil {
+		t.Fatalf("wait: %v", err)
+	}
+	if fmt.Sprint(order) != "[0 1 2 3 4 5 6 7 8 9]" {
+		t.Errorf("downloads ran in order %v", order)
+	}
+
+	// Jobs adding more work
+	p = newPipeline(context.Background(), opts)
+	var count int
+	var add func(depth int)
+	add = func(depth int) {
+		p.add(func(ctx context.Context) (func() error, error) {
+			return func() error {
+				mu.Lock()
+				count++
+				mu.Unlock()
+				if depth < 3 {
+					add(depth + 1)
+					add(depth + 1)
+				}
+				return nil
+			}, nil
+		})
+	}
+	add(0)
+	if err := p.wait(); err != nil {
+		t.Fatalf("wait: %v", err)
+	}
+	if count != 15 {
+		t.Errorf("ran %d nested jobs, want 15", count)
+	}
+
+	wantErr := errors.New("broken")
+	p = newPipeline(context.Background(), opts)
+	for i := 0; i < 20; i++ {
+		i := i
+		p.add(func(ctx context.Context) (func() error, error) {
+			if i == 3 {
+				return nil, wantErr
+			}
+			return func() error { return ctx.Err() }, nil
+		})
+	}
+	if err := p.wait(); err != wantErr {
+		t.Errorf("wait returned %v, want %v", err, wantErr)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	p = newPipeline(ctx, opts)
+	p.add(func(ctx context.Context) (func() error, error) { return func() error { return nil }, nil })
+	if err := p.wait(); !errors.Is(err, context.Canceled) {
+		t.Errorf("wait returned %v after cancellation", err)
+	}
+}
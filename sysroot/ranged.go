@@ -0,0 +1,161 @@
+package sysroot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"git.dolansoft.org/lorenz/winsysroot/manifest"
+)
+
+// rangeReadAhead is the minimum size of a range request. archive/zip reads
+// entries in small chunks, which are served from the last fetched range.
+const rangeReadAhead = 4 << 20
+
+// errNoRanges is returned if the server doesn't support range requests.
+var errNoRanges = errors.New("server does not support range requests")
+
+// rangeReader reads a remote file using HTTP range requests, implementing
+// io.ReaderAt.
+type rangeReader struct {
+	ctx  context.Context
+	opts *Options
+	url  string
+	size int64
+
+	mu sync.Mutex
+	// Last fetched range
+	buf    []byte
+	bufOff int64
+	// fetched is the number of bytes transferred so far.
+	fetched int64
+}
+
+// useRanges reports whether only the needed parts of payload are fetched
+// instead of the whole file. This is not possible if the whole file needs
+// to be verified and not worth it if it is already cached.
+func useRanges(opts *Options, payload manifest.Payload) bool {
+	return opts.RangedVSIX && !opts.Authenticode && !cached(opts, payload)
+}
+
+// openRange prepares reading url with range requests. It fetches the end of
+// the file, which contains the central directory of zip files.
+func openRange(ctx context.Context, opts *Options, url string) (*rangeReader, error) {
+	r := &rangeReader{ctx: ctx, opts: opts, url: url}
+	buf, start, size, err := r.fetch(-1, rangeReadAhead)
+	if err != nil {
+		return nil, err
+	}
+	r.buf, r.bufOff, r.size = buf, start, size
+	return r, nil
+}
+
+// fetch requests length bytes at off, or the last length bytes of the file
+// if off is negative. It returns the contents along with their offset and
+// the total size of the file.
+func (r *rangeReader) fetch(off, length int64) (data []byte, start, size int64, err error) {
+	ctx := r.ctx
+	if r.opts.RequestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.opts.RequestTimeout)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.url, nil)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	for k, vals := range r.opts.Header {
+		req.Header[k] = vals
+	}
+	if off < 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=-%d", length))
+	} else {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+length-1))
+	}
+	res, err := r.opts.HTTPClient.Do(req)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusPartialContent {
+		if res.StatusCode == http.StatusOK {
+			return nil, 0, 0, errNoRanges
+		}
+		errorMsg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+		return nil, 0, 0, fmt.Errorf("HTTP %d: %s", res.StatusCode, string(errorMsg))
+	}
+	start, end, size, err := parseContentRange(res.Header.Get("Content-Range"))
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	// The size is checked before allocating, so a server can't make us
+	// allocate more than requested.
+	if off < 0 && (end != size-1 || end-start+1 > length) || off >= 0 && (start != off || end-start+1 != length) {
+		return nil, 0, 0, fmt.Errorf("server returned range %d-%d instead of the requested one", start, end)
+	}
+	data = make([]byte, end-start+1)
+	if _, err := io.ReadFull(res.Body, data); err != nil {
+		return nil, 0, 0, err
+	}
+	r.fetched += int64(len(data))
+	return data, start, size, nil
+}
+
+// parseContentRange parses a Content-Range header of the form
+// bytes start-end/size.
+func parseContentRange(s string) (start, end, size int64, err error) {
+	spec := strings.TrimPrefix(s, "bytes ")
+	slash := strings.IndexByte(spec, '/')
+	dash := strings.IndexByte(spec, '-')
+	if spec == s || slash < 0 || dash < 0 || dash > slash {
+		return 0, 0, 0, fmt.Errorf("invalid Content-Range %q", s)
+	}
+	start, err1 := strconv.ParseInt(spec[:dash], 10, 64)
+	end, err2 := strconv.ParseInt(spec[dash+1:slash], 10, 64)
+	size, err3 := strconv.ParseInt(spec[slash+1:], 10, 64)
+	if err1 != nil || err2 != nil || err3 != nil || start < 0 || end < start || end >= size {
+		return 0, 0, 0, fmt.Errorf("invalid Content-Range %q", s)
+	}
+	return start, end, size, nil
+}
+
+// ReadAt implements io.ReaderAt, fetching at least rangeReadAhead bytes
+// with every request.
+func (r *rangeReader) ReadAt(p []byte, off int64) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	n := 0
+	for n < len(p) && off < r.size {
+		if off >= r.bufOff && off < r.bufOff+int64(len(r.buf)) {
+			c := copy(p[n:], r.buf[off-r.bufOff:])
+			n += c
+			off += int64(c)
+			continue
+		}
+		length := int64(len(p) - n)
+		if length < rangeReadAhead {
+			length = rangeReadAhead
+		}
+		if off+length > r.size {
+			length = r.size - off
+		}
+		buf, start, _, err := r.fetch(off, length)
+		if err != nil {
+			return n, err
+		}
+		r.buf, r.bufOff = buf, start
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
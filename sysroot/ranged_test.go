@@ -0,0 +1,100 @@
+package sysroot
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"git.dolansoft.org/lorenz/winsysroot/vsix"
+)
+
+func TestRangeReader(t *testing.T) {
+	// A package with a large entry which is never read
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	large := make([]byte, 3*rangeReadAhead)
+	rand.New(rand.NewSource(1)).Read(large)
+	files := []struct {
+		name string
+		data []byte
+	}{
+		{"Contents/a.h", []byte("int a;")},
+		{"Contents/large.bin", large},
+		{"Contents/b.h", []byte("int b;")},
+	}
+	for _, f := range files {
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: f.name, Method: zip.Store})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(f.data)
+	}
+	zw.Close()
+	data := buf.Bytes()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/noranges" {
+			w.Write(data)
+			return
+		}
+		http.ServeContent(w, req, "pkg.vsix", time.Time{}, bytes.NewReader(data))
+	}))
+	defer srv.Close()
+	opts := &Options{HTTPClient: srv.Client()}
+
+	r, err := openRange(context.Background(), opts, srv.URL+"/pkg.vsix")
+	if err != nil {
+		t.Fatalf("openRange: %v", err)
+	}
+	pkg, err := vsix.New(r, r.size)
+	if err != nil {
+		t.Fatalf("vsix.New: %v", err)
+	}
+	for _, f := range pkg.Files {
+		if f.InstallPath == "large.bin" {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatalf("Open(%v): %v", f.InstallPath, err)
+		}
+		got, err := ioutil.ReadAll(rc)
+		if err != nil {
+			t.Fatalf("reading %v: %v", f.InstallPath, err)
+		}
+		if want := "int " + f.InstallPath[:1] + ";"; string(got) != want {
+			t.Errorf("%v contains %q, want %q", f.InstallPath, got, want)
+		}
+	}
+	if r.fetched >= int64(len(data)) {
+		t.Errorf("fetched %d bytes of a %d byte package", r.fetched, len(data))
+	}
+
+	if _, err := openRange(context.Background(), opts, srv.URL+"/noranges"); !errors.Is(err, errNoRanges) {
+		t.Errorf("openRange without range support returned %v", err)
+	}
+}
+
+func TestRangeReaderOversizedRange(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// Claim a range far larger than requested without sending it.
+		w.Header().Set("Content-Range", "bytes 0-1099511627775/1099511627776")
+		w.WriteHeader(http.StatusPartialContent)
+	}))
+	defer srv.Close()
+	opts := &Options{HTTPClient: srv.Client()}
+	if _, err := openRange(context.Background(), opts, srv.URL+"/pkg.vsix"); err == nil {
+		t.Error("openRange accepted a range larger than requested")
+	}
+	r := &rangeReader{ctx: context.Background(), opts: opts, url: srv.URL + "/pkg.vsix", size: 1 << 40}
+	if _, err := r.ReadAt(make([]byte, 10), 0); err == nil {
+		t.Error("ReadAt accepted a range larger than requested")
+	}
+}
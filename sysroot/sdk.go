@@ -0,0 +1,355 @@
+package sysroot
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+
+	"git.dolansoft.org/lorenz/winsysroot/cab"
+	"git.dolansoft.org/lorenz/winsysroot/manifest"
+	"git.dolansoft.org/lorenz/winsysroot/msi"
+)
+
+var includeRegexp = regexp.MustCompile(`^Windows Kits/[^/]+/Include/[0-9\.]+/.*\.h(pp)?$`)
+var libRegexp = regexp.MustCompile(`^Windows Kits/[^/]+/Lib/[0-9\.]+/.*\.[Ll][Ii][Bb]`)
+
+// includeSDKFile implements the built-in filtering rules for Windows SDK
+// files.
+func includeSDKFile(outPath string, hasArch map[string]bool, slim bool) bool {
+	parts := strings.Split(outPath, "/")
+	if len(parts) < 3 {
+		return false
+	}
+	typeDir := strings.ToLower(parts[2])
+	if typeDir == "include" {
+		if slim {
+			ext := strings.ToLower(path.Ext(outPath))
+			if ext != "" && ext != ".h" && ext != ".hpp" && ext != ".c" && ext != ".cpp" {
+				return false
+			}
+		}
+		return true
+	} else if typeDir == "lib" {
+		if len(parts) < 6 || !hasArch[strings.ToLower(parts[5])] {
+			return false
+		}
+		if slim {
+			ext := strings.ToLower(path.Ext(outPath))
+			if ext != ".lib" && ext != ".obj" {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func buildWinSDK(ctx context.Context, opts *Options, out *output) error {
+	hasArch := make(map[string]bool)
+	for _, arch := range opts.Architectures {
+		hasArch[arch] = true
+	}
+	sdkPkg, ok := opts.Manifest.SDKPackage(opts.WinSDKVersion)
+	if !ok {
+		return Errorf(StageResolve, "", "", "failed to find Windows SDK with version %v", opts.WinSDKVersion)
+	}
+	if err := checkDeprecated(opts, []string{sdkPkg.ID}); err != nil {
+		return err
+	}
+	opts.Events.PackageResolved(sdkPkg)
+	cabPayloads := sdkCABPayloads(sdkPkg)
+
+	var mu sync.Mutex
+	seen := make(payloadSet)
+	// Cabinets already extracted as part of a multi-part set
+	extracted := make(map[string]bool)
+	p := newPipeline(ctx, opts)
+	// addCAB queues downloading and extracting the cabinet called name,
+	// whose files are described by msiInfo.
+	addCAB := func(name string, msiInfo *msi.MSI) {
+		payload, ok := cabPayloads[name]
+		if !ok {
+			return
+		}
+		mu.Lock()
+		first := seen.add(payload)
+		mu.Unlock()
+		if !first {
+			return
+		}
+		p.add(func(ctx context.Context) (func() error, error) {
+			mu.Lock()
+			done := extracted[name]
+			mu.Unlock()
+			if done {
+				return nil, nil
+			}
+			// Another worker might have started on a different part of the
+			// same set in the meantime.
+			claim := func(siblings []string) bool {
+				mu.Lock()
+				defer mu.Unlock()
+				for _, sibling := range siblings {
+					if extracted[strings.ToLower(sibling)] {
+						return false
+					}
+				}
+				for _, sibling := range siblings {
+					extracted[strings.ToLower(sibling)] = true
+				}
+				return true
+			}
+			return sdkCABJob(ctx, opts, out, sdkPkg, payload, cabPayloads, msiInfo, hasArch, claim)
+		})
+	}
+	// The MSIs describe which cabinets are needed. They are parsed by the
+	// extraction workers and their cabinets queued right away, so that
+	// cabinets are downloaded while the remaining MSIs are still being
+	// processed.
+	for _, payload := range sdkPkg.Payloads {
+		if !strings.HasSuffix(payload.FileName, ".msi") {
+			continue
+		}
+		mu.Lock()
+		first := seen.add(payload)
+		mu.Unlock()
+		if !first {
+			continue
+		}
+		payload := payload
+		p.add(func(ctx context.Context) (func() error, error) {
+			msiRaw, err := download(ctx, opts, sdkPkg, payload)
+			if err != nil {
+				return nil, Errorf(StageDownload, sdkPkg.ID, payload.URL, "failed to download MSI %v: %w", payload.FileName, err)
+			}
+			return func() error {
+				defer msiRaw.Close()
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+				msiData, err := msi.Parse(msiRaw.open())
+				if err != nil {
+					return Errorf(StageExtract, sdkPkg.ID, payload.URL, "failed to parse MSI %v: %w", payload.FileName, err)
+				}
+				opts.Logger.Debug("Parsed MSI", "file", payload.FileName, "product", msiData.ProductName, "version", msiData.ProductVersion, "platform", msiData.Summary.Platform())
+				relevant := relevantCABs(opts, msiData, hasArch)
+				// Cabinets are queued in sequence order, so multi-part
+				// sets are started with their first part and the others
+				// are already marked as extracted when their turn comes.
+				skipped := 0
+				for _, cab := range msiData.CABFiles {
+					if relevant[cab] {
+						addCAB(strings.ToLower(cab), msiData)
+					} else {
+						skipped++
+					}
+				}
+				if skipped > 0 {
+					opts.Logger.Debug("Skipping cabinets without wanted files", "msi", payload.FileName, "count", skipped)
+				}
+				// Cabinets embedded in the MSI are extracted right away as
+				// msiRaw isn't kept around.
+				return extractEmbeddedCABs(ctx, opts, out, sdkPkg, payload, msiData, relevant, hasArch)
+			}, nil
+		})
+	}
+	return p.wait()
+}
+
+// sdkCABJob downloads the cabinet payload and returns a job extracting the
+// files described by msiInfo from it. Other parts of a multi-part set are
+// downloaded as needed using cabPayloads, which maps lowercase cabinet names
+// to their payloads. claim is called with the names of all parts of the set
+// and returns false if the set has been extracted already.
+func sdkCABJob(ctx context.Context, opts *Options, out *output, sdkPkg manifest.Package, payload manifest.Payload, cabPayloads map[string]manifest.Payload, msiInfo *msi.MSI, hasArch map[string]bool, claim func(siblings []string) bool) (func() error, error) {
+	cabRaw, err := download(ctx, opts, sdkPkg, payload)
+	if err != nil {
+		return nil, Errorf(StageDownload, sdkPkg.ID, payload.URL, "failed to download CAB %v: %w", payload.FileName, err)
+	}
+	return func() error {
+		files := []*payloadFile{cabRaw}
+		defer func() {
+			for _, f := range files {
+				f.Close()
+			}
+		}()
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		cabOpts := sdkCabOptions(opts, sdkPkg, payload, msiInfo, hasArch)
+		cabOpts.OpenCabinet = func(name string) (io.ReadSeeker, error) {
+			sibling, ok := cabPayloads[strings.ToLower(name)]
+			if !ok {
+				return nil, fmt.Errorf("no payload for cabinet %v", name)
+			}
+			data, err := download(ctx, opts, sdkPkg, sibling)
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, data)
+			return data.open(), nil
+		}
+		cabF, err := cab.NewWithOptions(cabRaw.open(), cabOpts)
+		if err != nil {
+			return Errorf(StageExtract, sdkPkg.ID, payload.URL, "failed to read CAB file: %w", err)
+		}
+		if !claim(cabF.Siblings()) {
+			return nil
+		}
+		return extractSDKCab(ctx, opts, out, sdkPkg, payload, payload.FileName, msiInfo, cabF, hasArch)
+	}, nil
+}
+
+// sdkCABPayloads maps the lowercase file names of the payloads of sdkPkg to
+// the payloads, which is how cabinets are referenced by MSIs.
+func sdkCABPayloads(sdkPkg manifest.Package) map[string]manifest.Payload {
+	payloads := make(map[string]manifest.Payload)
+	for _, payload := range sdkPkg.Payloads {
+		parts := strings.Split(payload.FileName, "\\")
+		if len(parts) == 2 {
+			payloads[strings.ToLower(parts[1])] = payload
+		}
+	}
+	return payloads
+}
+
+// relevantCABs returns the cabinets of msiData containing files which will
+// be extracted. Without a user-provided filter the built-in rules and the
+// selected features decide that, otherwise all cabinets with headers or
+// libraries are needed. If any such file has no known cabinet, all of them
+// are returned.
+func relevantCABs(opts *Options, msiData *msi.MSI, hasArch map[string]bool) map[string]bool {
+	var featureFiles map[string]bool
+	if len(opts.SDKFeatures) > 0 {
+		featureFiles = msiData.FeatureFiles(opts.SDKFeatures...)
+	}
+	relevant := make(map[string]bool)
+	unmapped := false
+	for key := range msiData.FileMap {
+		if wantedSDKFile(opts, msiData, featureFiles, hasArch, key) {
+			cab, ok := msiData.FileCAB[key]
+			relevant[cab] = true
+			unmapped = unmapped || !ok
+		}
+	}
+	if unmapped {
+		for _, cab := range msiData.CABFiles {
+			relevant[cab] = true
+		}
+		for _, cab := range msiData.EmbeddedCABFiles {
+			relevant[cab] = true
+		}
+	}
+	return relevant
+}
+
+// wantedSDKFile reports whether the file of msiData with the given key is
+// possibly extracted, without asking a user-provided filter.
+func wantedSDKFile(opts *Options, msiData *msi.MSI, featureFiles, hasArch map[string]bool, key string) bool {
+	targetFile, ok := msiData.FileMap[key]
+	if !ok || featureFiles != nil && !featureFiles[key] {
+		return false
+	}
+	if opts.Filter == nil {
+		return includeSDKFile(targetFile, hasArch, opts.Slim)
+	}
+	return includeRegexp.MatchString(targetFile) || libRegexp.MatchString(targetFile)
+}
+
+// extractEmbeddedCABs extracts the relevant cabinets embedded in the MSI
+// read from payload.
+func extractEmbeddedCABs(ctx context.Context, opts *Options, out *output, sdkPkg manifest.Package, payload manifest.Payload, msiData *msi.MSI, relevant, hasArch map[string]bool) error {
+	done := make(map[string]bool)
+	for _, name := range msiData.EmbeddedCABFiles {
+		if done[name] || !relevant[name] {
+			continue
+		}
+		r, err := msiData.OpenEmbeddedCAB(name)
+		if err != nil {
+			return Errorf(StageExtract, sdkPkg.ID, payload.URL, "%w", err)
+		}
+		cabOpts := sdkCabOptions(opts, sdkPkg, payload, msiData, hasArch)
+		cabOpts.OpenCabinet = msiData.OpenEmbeddedCAB
+		cabF, err := cab.NewWithOptions(r, cabOpts)
+		if err != nil {
+			return Errorf(StageExtract, sdkPkg.ID, payload.URL, "failed to read embedded CAB file %v: %w", name, err)
+		}
+		for _, sibling := range cabF.Siblings() {
+			done[sibling] = true
+		}
+		if err := extractSDKCab(ctx, opts, out, sdkPkg, payload, payload.FileName+":"+name, msiData, cabF, hasArch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sdkCabOptions returns the options for reading a cabinet of the Windows SDK
+// read from payload whose files are described by msiInfo. Folders without
+// wanted files are skipped without decompressing them.
+func sdkCabOptions(opts *Options, sdkPkg manifest.Package, payload manifest.Payload, msiInfo *msi.MSI, hasArch map[string]bool) cab.Options {
+	cabOpts := opts.Limits.cabOptions()
+	// Payloads are verified against the manifest, so harmless format
+	// deviations in older cabinets are only logged.
+	cabOpts.Lenient = true
+	cabOpts.Warn = func(msg string) {
+		opts.Logger.Warn("Tolerating malformed CAB header", "package", sdkPkg.ID, "url", payload.URL, "problem", msg)
+	}
+	cabOpts.Progress = func(p cab.Progress) {
+		opts.Events.ExtractProgress(sdkPkg, payload.URL, p.Bytes, p.TotalBytes)
+	}
+	var featureFiles map[string]bool
+	if len(opts.SDKFeatures) > 0 {
+		featureFiles = msiInfo.FeatureFiles(opts.SDKFeatures...)
+	}
+	cabOpts.WantFile = func(name string) bool {
+		return wantedSDKFile(opts, msiInfo, featureFiles, hasArch, name)
+	}
+	return cabOpts
+}
+
+// extractSDKCab writes the files of cabF which are described by msiInfo and
+// pass the filters to out. cabF was read from payload, cabName is its name
+// for log messages.
+func extractSDKCab(ctx context.Context, opts *Options, out *output, sdkPkg manifest.Package, payload manifest.Payload, cabName string, msiInfo *msi.MSI, cabF *cab.Cabinet, hasArch map[string]bool) error {
+	var featureFiles map[string]bool
+	if len(opts.SDKFeatures) > 0 {
+		featureFiles = msiInfo.FeatureFiles(opts.SDKFeatures...)
+	}
+	for {
+		if err := ctx.Err(); err != nil {
+			return Errorf(StageExtract, sdkPkg.ID, payload.URL, "%w", err)
+		}
+		hdr, err := cabF.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return Errorf(StageExtract, sdkPkg.ID, payload.URL, "failed to read CAB file %q: %w", cabName, err)
+		}
+		outPath := msiInfo.FileMap[hdr.Name]
+		if outPath == "" {
+			opts.Logger.Info("unknown file in CAB, ignoring", "file", hdr.Name, "cab", cabName)
+			continue
+		}
+		if featureFiles != nil && !featureFiles[hdr.Name] {
+			continue
+		}
+		info := FileInfo{Size: int64(hdr.Size), ModTime: hdr.CreateTime, Package: sdkPkg.ID}
+		info.Component, _ = msiInfo.FileComponent(hdr.Name)
+		if !opts.applyFilter(outPath, info, func() bool { return includeSDKFile(outPath, hasArch, opts.Slim) }) {
+			continue
+		}
+		if err := opts.checkFile(outPath, int64(hdr.Size), -1); err != nil {
+			return Errorf(StageExtract, sdkPkg.ID, payload.URL, "%w", err)
+		}
+		if err := out.writeFile(sdkPkg.ID, payload.URL, outPath, int64(hdr.Size), hdr.CreateTime, cabF); err != nil {
+			return err
+		}
+		opts.Events.FileExtracted(outPath, int64(hdr.Size))
+	}
+}
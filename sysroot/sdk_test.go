@@ -0,0 +1,32 @@
+package sysroot
+
+import (
+	"reflect"
+	"testing"
+
+	"git.dolansoft.org/lorenz/winsysroot/msi"
+)
+
+func TestRelevantCABs(t *testing.T) {
+	m := &msi.MSI{
+		FileMap: map[string]string{
+			"inc":   "Windows Kits/10/Include/10.0.22621.0/um/windows.h",
+			"x64":   "Windows Kits/10/Lib/10.0.22621.0/um/x64/kernel32.lib",
+			"arm64": "Windows Kits/10/Lib/10.0.22621.0/um/arm64/kernel32.lib",
+			"bin":   "Windows Kits/10/bin/x64/rc.exe",
+		},
+		FileCAB:  map[string]string{"inc": "a.cab", "x64": "b.cab", "arm64": "c.cab", "bin": "d.cab"},
+		CABFiles: []string{"a.cab", "b.cab", "c.cab", "d.cab"},
+	}
+	hasArch := map[string]bool{"x64": true}
+	got := relevantCABs(&Options{Slim: true}, m, hasArch)
+	if want := map[string]bool{"a.cab": true, "b.cab": true}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	// A custom filter might want libraries of any architecture.
+	opts := &Options{Filter: func(string, FileInfo) Decision { return Default }}
+	got = relevantCABs(opts, m, hasArch)
+	if want := map[string]bool{"a.cab": true, "b.cab": true, "c.cab": true}; !reflect.DeepEqual(got, want) {
+		t.Errorf("with filter got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,304 @@
+// Package sysroot assembles Windows sysroots containing the Windows SDK and
+// the MSVC headers and libraries from Microsoft's installer packages.
+package sysroot
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"git.dolansoft.org/lorenz/winsysroot/manifest"
+	"git.dolansoft.org/lorenz/winsysroot/target"
+	"git.dolansoft.org/lorenz/winsysroot/versions"
+)
+
+// Options configure a sysroot build.
+type Options struct {
+	// Manifest is the installer manifest packages are taken from.
+	Manifest *manifest.Installer
+	// WinSDKVersion is the version of the Windows SDK to include, without
+	// the patch version (e.g. 10.0.22621). See ResolveSDKVersion.
+	WinSDKVersion string
+	// Architectures to include libraries for. Supported are x86, x64, arm,
+	// arm64 and arm64ec.
+	Architectures []string
+	// HostArch is the architecture of the machine Visual Studio would be
+	// installed on, x64 or arm64. Some dependencies are only installed on
+	// one of them. If empty, x64 is used.
+	HostArch string
+	// Toolsets are the MSVC toolsets installed side by side below
+	// VC/Tools/MSVC, each either "latest" for the newest one of the release,
+	// a platform toolset like v141, v142 or v143 or a version like 14.29,
+	// which select the newest toolset matching them. If empty, only the
+	// newest one is installed.
+	Toolsets []string
+	// Slim strips most excess files, shipping only headers, libraries and
+	// object files.
+	Slim bool
+	// SDKFeatures, if set, restricts the Windows SDK to the files installed
+	// by the given MSI features (like OptionId.DesktopCPPx64) and their
+	// sub-features. The other filtering rules still apply.
+	SDKFeatures []string
+	// Strict fails the build if a selected package is marked as deprecated
+	// instead of just logging a warning.
+	Strict bool
+	// HTTPClient is used for all downloads. If nil, http.DefaultClient is
+	// used.
+	HTTPClient *http.Client
+	// Header contains additional HTTP headers sent with every request.
+	Header http.Header
+	// RequestTimeout limits the time a single HTTP request may take
+	// including downloading the response. Zero means no timeout.
+	RequestTimeout time.Duration
+	// Logger receives log messages. If nil, StdLogger is used. It must be
+	// safe for concurrent use.
+	Logger Logger
+	// Events, if set, receives progress notifications. Calls are
+	// serialized.
+	Events Events
+	// Filter, if set, is consulted for every file before the built-in
+	// filtering rules are applied. Calls are serialized.
+	Filter Filter
+	// CacheDir, if set, is a directory where downloaded payloads are kept
+	// by their SHA256 hash and reused by later builds.
+	CacheDir string
+	// OnChecksumMismatch determines what happens if a downloaded payload
+	// doesn't match its hash from the manifest. Corrupted cache entries are
+	// always downloaded again.
+	OnChecksumMismatch ChecksumPolicy
+	// RequireSigner fails the build if a payload doesn't reference a signer
+	// or references one which is not listed in the manifest.
+	RequireSigner bool
+	// Authenticode additionally verifies the Authenticode signatures of all
+	// MSI, CAB and VSIX payloads and checks that they were made by the
+	// signer given in the manifest.
+	Authenticode bool
+	// AcceptLicenses confirms that the licenses of all included packages
+	// (see Licenses) have been accepted. Build fails if it is not set. A
+	// record of the accepted licenses is written to the licenses directory
+	// of the sysroot.
+	AcceptLicenses bool
+	// Limits restrict the resources extraction may use. If nil,
+	// DefaultLimits are used.
+	Limits *Limits
+	// AuthenticodeRoots, if set, are the roots the Authenticode signing
+	// certificates must chain up to. Otherwise the Microsoft code signing
+	// roots are trusted, see authenticode.Signature.VerifyChain.
+	AuthenticodeRoots *x509.CertPool
+	// AuthenticodeIdentityOnly skips the certificate chain check of
+	// Authenticode signatures, so only the signer's identity is checked.
+	// Anyone can create a certificate with any identity, so this only
+	// detects accidental corruption.
+	AuthenticodeIdentityOnly bool
+	// Downloads is the number of payloads downloaded concurrently. If zero,
+	// DefaultDownloads is used.
+	Downloads int
+	// RangedVSIX fetches only the parts of VSIX packages which are
+	// extracted using HTTP range requests instead of downloading them
+	// completely. Their hashes can't be verified then, only the CRC-32 of
+	// the extracted files. It has no effect if Authenticode is set or the
+	// package is already cached.
+	RangedVSIX bool
+	// TempDir is the directory downloads are stored in while they are
+	// processed, unless they are kept in CacheDir. If empty, the default
+	// directory for temporary files is used.
+	TempDir string
+	// ExtractWorkers is the number of payloads extracted concurrently. If
+	// zero, one per CPU is used. With more than one, the order of files in
+	// the target depends on timing.
+	ExtractWorkers int
+
+	// written is the number of bytes extracted so far, updated atomically.
+	written *int64
+}
+
+// Build downloads the packages selected by opts and writes the sysroot into
+// t. t is closed after all files have been written successfully. Cancelling
+// ctx aborts the build as soon as possible. To make the
+// sysroot usable on case-sensitive filesystems, wrap t in a
+// vfs.TargetLayer.
+func Build(ctx context.Context, opts Options, t target.Target) error {
+	licenses, err := opts.prepare()
+	if err != nil {
+		return err
+	}
+	out := newOutput(t)
+	if err := buildWinSDK(ctx, &opts, out); err != nil {
+		return err
+	}
+	if err := buildVCTools(ctx, &opts, out); err != nil {
+		return err
+	}
+	if err := writeLicenses(&opts, licenses, t); err != nil {
+		return Errorf(StageOutput, "", "", "failed to write licenses: %w", err)
+	}
+	if err := t.Close(); err != nil {
+		return Errorf(StageOutput, "", "", "failed to finish writing output: %w", err)
+	}
+	return nil
+}
+
+// Packages returns the packages a build with opts is made of, without
+// downloading anything. Only the Windows SDK version, architectures and
+// manifest of opts are used.
+func Packages(opts Options) ([]manifest.Package, error) {
+	sdkPkg, ok := opts.Manifest.SDKPackage(opts.WinSDKVersion)
+	if !ok {
+		return nil, Errorf(StageResolve, "", "", "failed to find Windows SDK with version %v", opts.WinSDKVersion)
+	}
+	vcPkgs, err := vcToolsPackages(&opts)
+	if err != nil {
+		return nil, err
+	}
+	pkgs := []manifest.Package{sdkPkg}
+	for _, pkg := range vcPkgs {
+		if strings.EqualFold(pkg.Type, "vsix") {
+			pkgs = append(pkgs, pkg)
+		}
+	}
+	return pkgs, nil
+}
+
+// prepare validates opts, applies defaults and makes the callbacks safe for
+// concurrent use. It returns the licenses of the selected packages, which
+// must have been accepted.
+func (opts *Options) prepare() ([]License, error) {
+	if opts.Manifest == nil {
+		return nil, Errorf(StageUsage, "", "", "no installer manifest given")
+	}
+	if opts.Events == nil {
+		opts.Events = NopEvents{}
+	}
+	opts.Events = &syncEvents{e: opts.Events}
+	if opts.Filter != nil {
+		opts.Filter = syncFilter(opts.Filter)
+	}
+	if err := opts.checkWorkers(); err != nil {
+		return nil, Errorf(StageUsage, "", "", "%w", err)
+	}
+	opts.written = new(int64)
+	if opts.Logger == nil {
+		opts.Logger = StdLogger{}
+	}
+	if opts.HTTPClient == nil {
+		opts.HTTPClient = http.DefaultClient
+	}
+	if opts.Limits == nil {
+		opts.Limits = &DefaultLimits
+	}
+	licenses, err := Licenses(*opts)
+	if err != nil {
+		return nil, err
+	}
+	if !opts.AcceptLicenses {
+		return nil, Errorf(StageUsage, "", "", "the sysroot contains packages under the following licenses, which need to be accepted first (--accept-licenses):\n%v", formatLicenses(licenses))
+	}
+	return licenses, nil
+}
+
+// get fetches url into a temporary file and returns it along with the
+// hex-encoded SHA256 hash of its contents.
+func get(ctx context.Context, opts *Options, url string) (*payloadFile, string, error) {
+	if opts.RequestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.RequestTimeout)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	for k, vals := range opts.Header {
+		req.Header[k] = vals
+	}
+	res, err := opts.HTTPClient.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		errorMsg, err := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+		if err != nil {
+			return nil, "", fmt.Errorf("HTTP %d: %w", res.StatusCode, err)
+		}
+		return nil, "", fmt.Errorf("HTTP %d: %s", res.StatusCode, string(errorMsg))
+	}
+	f, err := ioutil.TempFile(spoolDir(opts), ".tmp-")
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	data := &payloadFile{f: f, temp: true}
+	h := sha256.New()
+	data.size, err = io.Copy(io.MultiWriter(f, h), res.Body)
+	if err != nil {
+		data.Close()
+		return nil, "", err
+	}
+	return data, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// CompareSDKVersions compares two dotted version numbers numerically,
+// returning -1, 0 or 1 if a is smaller, equal or greater than b.
+func CompareSDKVersions(a, b string) int {
+	return versions.Compare(a, b)
+}
+
+// ClosestSDKVersion returns the version out of available which is closest to
+// want. Versions sharing a longer prefix of components are preferred, ties
+// are broken by the numerical distance of the first differing component.
+func ClosestSDKVersion(want string, available []string) string {
+	return versions.Closest(want, available)
+}
+
+// ResolveSDKVersion resolves the requested SDK version against the manifest.
+// Besides full versions, "latest" and version ranges like "10.0" or
+// "[10.0.19041,10.0.22621]" are accepted (see versions.ParseRange). If no
+// version matches, the closest available version is either suggested in the
+// returned error or, if nearest is set, returned instead. Callers should
+// inform the user if the returned version differs from the requested one.
+func ResolveSDKVersion(m *manifest.Installer, version string, nearest bool) (string, error) {
+	available := m.SDKVersions()
+	if len(available) == 0 {
+		return "", Errorf(StageResolve, "", "", "no Windows SDKs found in the installer manifest")
+	}
+	resolved, err := versions.ResolveSDK(m, version)
+	if err == nil {
+		return resolved, nil
+	}
+	if _, perr := versions.Parse(version); perr != nil {
+		// Not a plain version, there is nothing to be close to.
+		return "", Errorf(StageResolve, "", "", "%w", err)
+	}
+	closest := versions.Closest(version, available)
+	if nearest {
+		return closest, nil
+	}
+	return "", Errorf(StageResolve, "", "", "failed to find Windows SDK with version %v, available versions are %v; did you mean %v? (pass --nearest to use it)", version, strings.Join(available, ", "), closest)
+}
+
+// checkDeprecated warns about all packages in ids which the manifest marks as
+// deprecated. If opts.Strict is set, it returns an error instead.
+func checkDeprecated(opts *Options, ids []string) error {
+	for _, id := range ids {
+		replacement, ok := opts.Manifest.Deprecate[id]
+		if !ok {
+			continue
+		}
+		if opts.Strict {
+			msg := fmt.Sprintf("package %q is marked as deprecated in the installer manifest", id)
+			if replacement != "" {
+				msg += fmt.Sprintf(" (replaced by %q)", replacement)
+			}
+			return Errorf(StageResolve, id, "", "%s", msg)
+		}
+		opts.Logger.Warn("package is marked as deprecated in the installer manifest and may disappear in a future release", "package", id, "replacement", replacement)
+	}
+	return nil
+}
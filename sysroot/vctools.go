@@ -0,0 +1,274 @@
+package sysroot
+
+import (
+	"context"
+	"errors"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"git.dolansoft.org/lorenz/winsysroot/manifest"
+	"git.dolansoft.org/lorenz/winsysroot/versions"
+	"git.dolansoft.org/lorenz/winsysroot/vsix"
+)
+
+var archTools = map[string]string{
+	"arm":     "Microsoft.VisualStudio.Component.VC.Tools.ARM",
+	"arm64":   "Microsoft.VisualStudio.Component.VC.Tools.ARM64",
+	"arm64ec": "Microsoft.VisualStudio.Component.VC.Tools.ARM64EC",
+	"x64":     "Microsoft.VisualStudio.Component.VC.Tools.x86.x64",
+	"x86":     "Microsoft.VisualStudio.Component.VC.Tools.x86.x64",
+}
+
+// toolsetSuffixes are the suffixes of the versioned VC tools components for
+// each architecture.
+var toolsetSuffixes = map[string]string{
+	"arm":     "ARM",
+	"arm64":   "ARM64",
+	"arm64ec": "ARM64EC",
+	"x64":     "x86.x64",
+	"x86":     "x86.x64",
+}
+
+// toolsetMinors are the ranges of MSVC minor versions of the toolsets
+// named like the platform toolsets in MSBuild.
+var toolsetMinors = map[string][2]int{
+	"v141": {10, 19},
+	"v142": {20, 29},
+	"v143": {30, 49},
+}
+
+var (
+	toolsetSpecRegexp      = regexp.MustCompile(`^14\.([0-9]+)$`)
+	toolsetComponentRegexp = regexp.MustCompile(`^Microsoft\.VisualStudio\.Component\.VC\.(14\.([0-9]+)\.[0-9]+\.[0-9]+)\.(.+)$`)
+)
+
+// toolsetComponent returns the component installing the VC tools of
+// toolset for arch. toolset is "latest", the name of a platform toolset
+// like v142 or an MSVC version like 14.29, which select the newest
+// toolset matching them.
+func toolsetComponent(m *manifest.Installer, toolset, arch string) (string, error) {
+	if toolset == "" || toolset == "latest" {
+		return archTools[arch], nil
+	}
+	var lo, hi int
+	if r, ok := toolsetMinors[toolset]; ok {
+		lo, hi = r[0], r[1]
+	} else if sm := toolsetSpecRegexp.FindStringSubmatch(toolset); sm != nil {
+		lo, _ = strconv.Atoi(sm[1])
+		hi = lo
+	} else {
+		return "", Errorf(StageUsage, "", "", "invalid MSVC toolset %q, expected latest, v141, v142, v143 or a version like 14.29", toolset)
+	}
+	suffix := toolsetSuffixes[arch]
+	// The v141 toolset of Visual Studio 2017 has no versioned components.
+	if lo <= 16 && 16 <= hi {
+		if id := "Microsoft.VisualStudio.Component.VC.v141." + suffix; hasPackage(m, id) {
+			return id, nil
+		}
+	}
+	var best, bestVersion string
+	for _, pkg := range m.Packages {
+		sm := toolsetComponentRegexp.FindStringSubmatch(pkg.ID)
+		if sm == nil || sm[3] != suffix {
+			continue
+		}
+		if minor, _ := strconv.Atoi(sm[2]); minor < lo || minor > hi {
+			continue
+		}
+		if best == "" || versions.Compare(sm[1], bestVersion) > 0 {
+			best, bestVersion = pkg.ID, sm[1]
+		}
+	}
+	if best != "" {
+		return best, nil
+	}
+	// The newest toolset is only installed by the unversioned components.
+	if available := versions.ToolsetVersions(m); len(available) > 0 {
+		v, err := versions.Parse(available[len(available)-1])
+		if err == nil && len(v) > 1 && v[1] >= lo && v[1] <= hi {
+			return archTools[arch], nil
+		}
+	}
+	return "", Errorf(StageResolve, "", "", "MSVC toolset %v for %v is not available, available toolsets are %v", toolset, arch, strings.Join(versions.ToolsetVersions(m), ", "))
+}
+
+func hasPackage(m *manifest.Installer, id string) bool {
+	_, ok := m.Package(id)
+	return ok
+}
+
+// buildToolsProduct is the product whose dependencies are followed, as
+// winsysroot installs the same packages as the Build Tools.
+const buildToolsProduct = "Microsoft.VisualStudio.Product.BuildTools"
+
+// includeVCFile implements the built-in filtering rules for VC tools files.
+func includeVCFile(targetPath string, hasArch map[string]bool) bool {
+	if !strings.HasPrefix(targetPath, "VC/Tools/MSVC/") {
+		return false
+	}
+	parts := strings.Split(targetPath, "/")
+	if len(parts) < 5 {
+		return false
+	}
+	typeDir := strings.ToLower(parts[4])
+	if typeDir != "include" && typeDir != "lib" {
+		return false
+	}
+	if typeDir == "lib" && (len(parts) < 6 || !hasArch[strings.ToLower(parts[5])]) {
+		return false
+	}
+	return true
+}
+
+// vcToolsPackages returns all packages needed for the VC tools of the
+// selected architectures.
+func vcToolsPackages(opts *Options) ([]manifest.Package, error) {
+	toolsets := opts.Toolsets
+	if len(toolsets) == 0 {
+		toolsets = []string{"latest"}
+	}
+	var roots []string
+	for _, arch := range opts.Architectures {
+		if archTools[arch] == "" {
+			return nil, Errorf(StageUsage, "", "", "unknown architecture %q, don't know the correct tools package", arch)
+		}
+		for _, toolset := range toolsets {
+			component, err := toolsetComponent(opts.Manifest, toolset, arch)
+			if err != nil {
+				return nil, err
+			}
+			roots = append(roots, component)
+		}
+	}
+	hostArch := opts.HostArch
+	if hostArch == "" {
+		hostArch = "x64"
+	}
+	if hostArch != "x64" && hostArch != "arm64" {
+		return nil, Errorf(StageUsage, "", "", "unsupported host architecture %q, supported are x64 and arm64", hostArch)
+	}
+	return opts.Manifest.DependencyClosureFor(manifest.Conditions{MachineArch: hostArch, Product: buildToolsProduct}, roots...), nil
+}
+
+func buildVCTools(ctx context.Context, opts *Options, out *output) error {
+	hasArch := make(map[string]bool)
+	for _, arch := range opts.Architectures {
+		hasArch[arch] = true
+	}
+	pkgs, err := vcToolsPackages(opts)
+	if err != nil {
+		return err
+	}
+	var ids []string
+	for _, pkg := range pkgs {
+		ids = append(ids, pkg.ID)
+	}
+	if err := checkDeprecated(opts, ids); err != nil {
+		return err
+	}
+	for _, pkg := range pkgs {
+		opts.Events.PackageResolved(pkg)
+	}
+	opts.Logger.Info("downloading VC tools packages", "count", len(pkgs))
+	p := newPipeline(ctx, opts)
+	seen := make(payloadSet)
+	for _, pkg := range pkgs {
+		if !strings.EqualFold(pkg.Type, "vsix") {
+			continue
+		}
+		if !seen.add(pkg.Payloads[0]) {
+			opts.Logger.Debug("Skipping package with the same payload as another one", "package", pkg.ID)
+			continue
+		}
+		pkg := pkg
+		p.add(func(ctx context.Context) (func() error, error) {
+			return vsixJob(ctx, opts, out, pkg, hasArch)
+		})
+	}
+	return p.wait()
+}
+
+// vsixJob downloads the VSIX package pkg, or prepares fetching the needed
+// parts of it, and returns a job extracting it.
+func vsixJob(ctx context.Context, opts *Options, out *output, pkg manifest.Package, hasArch map[string]bool) (func() error, error) {
+	opts.Logger.Info("downloading package", "package", pkg.ID, "version", pkg.Version)
+	if useRanges(opts, pkg.Payloads[0]) {
+		job, err := rangedVSIXJob(ctx, opts, out, pkg, hasArch)
+		if err == nil {
+			return job, nil
+		}
+		if !errors.Is(err, errNoRanges) {
+			return nil, err
+		}
+		opts.Logger.Warn("Downloading whole package", "package", pkg.ID, "error", err)
+	}
+	payload, err := download(ctx, opts, pkg, pkg.Payloads[0])
+	if err != nil {
+		return nil, Errorf(StageDownload, pkg.ID, pkg.Payloads[0].URL, "failed to download package: %w", err)
+	}
+	return func() error {
+		defer payload.Close()
+		return extractVSIX(ctx, opts, out, pkg, payload.f, payload.size, hasArch)
+	}, nil
+}
+
+// rangedVSIXJob returns a job extracting pkg while only fetching the parts
+// of it which are needed. The hash of the package can't be verified then,
+// but archive/zip checks the CRC-32 of every extracted file.
+func rangedVSIXJob(ctx context.Context, opts *Options, out *output, pkg manifest.Package, hasArch map[string]bool) (func() error, error) {
+	payload := pkg.Payloads[0]
+	if err := checkSigner(opts, payload); err != nil {
+		return nil, Errorf(StageDownload, pkg.ID, payload.URL, "%w", err)
+	}
+	opts.Events.DownloadStarted(pkg, payload.URL, int64(payload.Size))
+	r, err := openRange(ctx, opts, payload.URL)
+	if errors.Is(err, errNoRanges) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, Errorf(StageDownload, pkg.ID, payload.URL, "failed to download package: %w", err)
+	}
+	return func() error {
+		err := extractVSIX(ctx, opts, out, pkg, r, r.size, hasArch)
+		opts.Events.DownloadFinished(pkg, payload.URL, r.fetched)
+		return err
+	}, nil
+}
+
+// extractVSIX writes the files of the VSIX package pkg of the given size
+// read from r which pass the filters to out.
+func extractVSIX(ctx context.Context, opts *Options, out *output, pkg manifest.Package, r io.ReaderAt, size int64, hasArch map[string]bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	archive, err := vsix.New(r, size)
+	if err != nil {
+		return Errorf(StageExtract, pkg.ID, pkg.Payloads[0].URL, "failed to open package: %w", err)
+	}
+	for _, file := range archive.Files {
+		if err := ctx.Err(); err != nil {
+			return Errorf(StageExtract, pkg.ID, pkg.Payloads[0].URL, "%w", err)
+		}
+		targetPath := file.InstallPath
+		info := FileInfo{Size: file.Size, ModTime: file.ModTime, Package: pkg.ID}
+		if !opts.applyFilter(targetPath, info, func() bool { return includeVCFile(targetPath, hasArch) }) {
+			continue
+		}
+		if err := opts.checkFile(targetPath, file.Size, file.CompressedSize); err != nil {
+			return Errorf(StageExtract, pkg.ID, pkg.Payloads[0].URL, "%w", err)
+		}
+		f, err := file.Open()
+		if err != nil {
+			return Errorf(StageExtract, pkg.ID, pkg.Payloads[0].URL, "failed to open file %q: %w", targetPath, err)
+		}
+		err = out.writeFile(pkg.ID, pkg.Payloads[0].URL, targetPath, file.Size, file.ModTime, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		opts.Events.FileExtracted(targetPath, file.Size)
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package sysroot
+
+import (
+	"reflect"
+	"testing"
+
+	"git.dolansoft.org/lorenz/winsysroot/manifest"
+)
+
+func TestToolsetComponent(t *testing.T) {
+	m := &manifest.Installer{Packages: []manifest.Package{
+		{ID: "Microsoft.VisualStudio.Component.VC.Tools.x86.x64", Dependencies: map[string]interface{}{"Microsoft.VC.14.38.17.8.Tools.HostX64.TargetX64": "17.8"}},
+		{ID: "Microsoft.VC.14.38.17.8.Tools.HostX64.TargetX64", Version: "14.38.33130"},
+		{ID: "Microsoft.VisualStudio.Component.VC.14.38.17.8.x86.x64"},
+		{ID: "Microsoft.VisualStudio.Component.VC.14.29.16.11.x86.x64", Dependencies: map[string]interface{}{"Microsoft.VC.14.29.16.11.Tools.HostX64.TargetX64": "16.11"}},
+		{ID: "Microsoft.VC.14.29.16.11.Tools.HostX64.TargetX64", Version: "14.29.30133"},
+		{ID: "Microsoft.VisualStudio.Component.VC.14.28.16.9.x86.x64"},
+		{ID: "Microsoft.VisualStudio.Component.VC.14.29.16.11.ARM64"},
+		{ID: "Microsoft.VisualStudio.Component.VC.v141.x86.x64", Dependencies: map[string]interface{}{"Microsoft.VC.14.16.Tools.HostX64.TargetX64": "15.9"}},
+		{ID: "Microsoft.VC.14.16.Tools.HostX64.TargetX64", Version: "14.16.27023"},
+	}}
+	for _, tc := range []struct {
+		toolset, arch, want string
+	}{
+		{"latest", "x64", "Microsoft.VisualStudio.Component.VC.Tools.x86.x64"},
+		{"v143", "x64", "Microsoft.VisualStudio.Component.VC.14.38.17.8.x86.x64"},
+		{"v142", "x64", "Microsoft.VisualStudio.Component.VC.14.29.16.11.x86.x64"},
+		{"14.28", "x86", "Microsoft.VisualStudio.Component.VC.14.28.16.9.x86.x64"},
+		{"v142", "arm64", "Microsoft.VisualStudio.Component.VC.14.29.16.11.ARM64"},
+		{"v141", "x64", "Microsoft.VisualStudio.Component.VC.v141.x86.x64"},
+		{"14.16", "x64", "Microsoft.VisualStudio.Component.VC.v141.x86.x64"},
+		{"v141", "arm64", ""},
+		{"14.30", "x64", ""},
+		{"v140", "x64", ""},
+	} {
+		got, err := toolsetComponent(m, tc.toolset, tc.arch)
+		if got != tc.want || (err != nil) != (tc.want == "") {
+			t.Errorf("toolsetComponent(%v, %v) = %q, %v, want %q", tc.toolset, tc.arch, got, err, tc.want)
+		}
+	}
+
+	// The newest toolset is installed by the unversioned component only.
+	m.Packages = m.Packages[:2]
+	if got, err := toolsetComponent(m, "v143", "x64"); err != nil || got != "Microsoft.VisualStudio.Component.VC.Tools.x86.x64" {
+		t.Errorf("toolsetComponent(v143) without versioned components = %q, %v", got, err)
+	}
+}
+
+func TestVCToolsPackagesSideBySide(t *testing.T) {
+	m := &manifest.Installer{Packages: []manifest.Package{
+		{ID: "Microsoft.VisualStudio.Component.VC.Tools.x86.x64", Dependencies: map[string]interface{}{"Microsoft.VC.14.38.CRT.Headers": "17.8"}},
+		{ID: "Microsoft.VC.14.38.CRT.Headers"},
+		{ID: "Microsoft.VisualStudio.Component.VC.v141.x86.x64", Dependencies: map[string]interface{}{"Microsoft.VC.14.16.CRT.Headers": "15.9"}},
+		{ID: "Microsoft.VC.14.16.CRT.Headers"},
+	}}
+	pkgs, err := vcToolsPackages(&Options{Manifest: m, Architectures: []string{"x64"}, Toolsets: []string{"latest", "v141"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, pkg := range pkgs {
+		ids = append(ids, pkg.ID)
+	}
+	want := []string{
+		"Microsoft.VC.14.16.CRT.Headers",
+		"Microsoft.VC.14.38.CRT.Headers",
+		"Microsoft.VisualStudio.Component.VC.Tools.x86.x64",
+		"Microsoft.VisualStudio.Component.VC.v141.x86.x64",
+	}
+	if !reflect.DeepEqual(ids, want) {
+		t.Errorf("vcToolsPackages() = %v, want %v", ids, want)
+	}
+}
@@ -0,0 +1,163 @@
+package target
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// dirBufferSize is the size of the buffer collecting writes to a file, so
+// that files streamed in small chunks are written with few syscalls.
+const dirBufferSize = 1 << 20
+
+var dirBuffers = sync.Pool{
+	New: func() interface{} { return bufio.NewWriterSize(nil, dirBufferSize) },
+}
+
+// Directory writes files into a directory on the local filesystem.
+type Directory struct {
+	rootDir  string
+	currFile *dirFile
+
+	// dirs contains the directories which are known to exist so that
+	// MkdirAll is called only once per directory.
+	mu   sync.Mutex
+	dirs map[string]bool
+}
+
+// NewDirectory returns a target writing into rootDir. The directory is
+// created as needed.
+func NewDirectory(rootDir string) *Directory {
+	return &Directory{rootDir: rootDir, dirs: make(map[string]bool)}
+}
+
+// Root returns the directory the target writes into.
+func (d *Directory) Root() string {
+	return d.rootDir
+}
+
+func (d *Directory) Create(path string, size int64, modTime time.Time) error {
+	if d.currFile != nil {
+		// Closing flushes the buffered writes of the previous file.
+		err := d.currFile.Close()
+		d.currFile = nil
+		if err != nil {
+			return err
+		}
+	}
+	f, err := d.createFile(path, size)
+	if err != nil {
+		return err
+	}
+	d.currFile = f
+	return nil
+}
+
+// CreateExecutable implements Executables.
+func (d *Directory) CreateExecutable(path string, size int64, modTime time.Time) error {
+	if err := d.Create(path, size, modTime); err != nil {
+		return err
+	}
+	return d.currFile.f.Chmod(0755)
+}
+
+// CreateFile implements FileCreator, files can be written in parallel.
+func (d *Directory) CreateFile(path string, size int64, modTime time.Time) (io.WriteCloser, error) {
+	f, err := d.createFile(path, size)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (d *Directory) createFile(path string, size int64) (*dirFile, error) {
+	path, err := CleanPath(path)
+	if err != nil {
+		return nil, err
+	}
+	targetPath := filepath.Join(d.rootDir, filepath.FromSlash(path))
+	if err := d.mkdirAll(filepath.Dir(targetPath)); err != nil {
+		return nil, err
+	}
+	f, err := os.Create(targetPath)
+	if errors.Is(err, os.ErrNotExist) {
+		// The directory was removed after it had been created.
+		d.mu.Lock()
+		d.dirs = make(map[string]bool)
+		d.mu.Unlock()
+		if err := d.mkdirAll(filepath.Dir(targetPath)); err != nil {
+			return nil, err
+		}
+		f, err = os.Create(targetPath)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if size > 0 {
+		// Only a hint to the filesystem, so errors are ignored.
+		preallocate(f, size)
+	}
+	w := dirBuffers.Get().(*bufio.Writer)
+	w.Reset(f)
+	return &dirFile{f: f, w: w}, nil
+}
+
+// mkdirAll creates dir unless it has been created before.
+func (d *Directory) mkdirAll(dir string) error {
+	d.mu.Lock()
+	known := d.dirs[dir]
+	d.mu.Unlock()
+	if known {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	d.mu.Lock()
+	d.dirs[dir] = true
+	d.mu.Unlock()
+	return nil
+}
+
+func (d *Directory) Write(b []byte) (int, error) {
+	return d.currFile.Write(b)
+}
+
+func (d *Directory) Close() error {
+	if d.currFile != nil {
+		return d.currFile.Close()
+	}
+	return nil
+}
+
+// dirFile is a file being written by a Directory target. Writes are buffered
+// until the file is closed.
+type dirFile struct {
+	f *os.File
+	w *bufio.Writer
+}
+
+func (f *dirFile) Write(b []byte) (int, error) {
+	if f.w == nil {
+		return 0, os.ErrClosed
+	}
+	return f.w.Write(b)
+}
+
+func (f *dirFile) Close() error {
+	if f.w == nil {
+		return os.ErrClosed
+	}
+	err := f.w.Flush()
+	f.w.Reset(nil)
+	dirBuffers.Put(f.w)
+	f.w = nil
+	if cerr := f.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
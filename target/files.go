@@ -0,0 +1,64 @@
+package target
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// FileCreator is implemented by targets which can write several files at the
+// same time. CreateFile starts a new file like Create, but returns a writer
+// for its contents which finishes the file when closed. It may be called
+// from multiple goroutines and the returned writers may be used
+// concurrently, but not while Create and Write of the same target are in
+// use. All writers must be closed before closing the target.
+type FileCreator interface {
+	CreateFile(path string, size int64, modTime time.Time) (io.WriteCloser, error)
+}
+
+// Files returns a FileCreator for t. If t doesn't implement it itself, like
+// the archive targets, files are written one after another: CreateFile
+// blocks until the writer of the previous file has been closed.
+func Files(t Target) FileCreator {
+	if fc, ok := t.(FileCreator); ok {
+		return fc
+	}
+	return &serialFiles{t: t}
+}
+
+// serialFiles writes files sequentially using Create and Write.
+type serialFiles struct {
+	mu sync.Mutex
+	t  Target
+}
+
+func (s *serialFiles) CreateFile(path string, size int64, modTime time.Time) (io.WriteCloser, error) {
+	s.mu.Lock()
+	if err := s.t.Create(path, size, modTime); err != nil {
+		s.mu.Unlock()
+		return nil, err
+	}
+	return &serialWriter{s: s}, nil
+}
+
+// serialWriter holds the lock of its serialFiles until it is closed.
+type serialWriter struct {
+	s      *serialFiles
+	closed bool
+}
+
+func (w *serialWriter) Write(b []byte) (int, error) {
+	if w.closed {
+		return 0, errors.New("write after close")
+	}
+	return w.s.t.Write(b)
+}
+
+func (w *serialWriter) Close() error {
+	if !w.closed {
+		w.closed = true
+		w.s.mu.Unlock()
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+package target
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// IntegrityManifestName is the name of the file listing the SHA256 hashes of
+// all other files, in the format used by sha256sum.
+const IntegrityManifestName = "SHA256SUMS"
+
+// IntegrityLayer hashes all files written through it and writes their hashes
+// into IntegrityManifestName in the underlying target when closed, which
+// allows checking archives without extracting them.
+type IntegrityLayer struct {
+	t     Target
+	files FileCreator
+	path  string
+	h     hash.Hash
+
+	mu     sync.Mutex
+	hashes map[string]string
+}
+
+// NewIntegrityLayer wraps t.
+func NewIntegrityLayer(t Target) *IntegrityLayer {
+	return &IntegrityLayer{t: t, files: Files(t), hashes: make(map[string]string)}
+}
+
+func (l *IntegrityLayer) finishFile() {
+	if l.h != nil {
+		l.addHash(l.path, l.h)
+		l.h = nil
+	}
+}
+
+func (l *IntegrityLayer) addHash(path string, h hash.Hash) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.hashes[path] = hex.EncodeToString(h.Sum(nil))
+}
+
+func (l *IntegrityLayer) Create(path string, size int64, modTime time.Time) error {
+	return l.create(path, size, modTime, l.t.Create)
+}
+
+// CreateExecutable implements Executables if the underlying target does.
+func (l *IntegrityLayer) CreateExecutable(path string, size int64, modTime time.Time) error {
+	return l.create(path, size, modTime, func(path string, size int64, modTime time.Time) error {
+		return CreateExecutable(l.t, path, size, modTime)
+	})
+}
+
+func (l *IntegrityLayer) create(path string, size int64, modTime time.Time, create func(string, int64, time.Time) error) error {
+	l.finishFile()
+	path, err := CleanPath(path)
+	if err != nil {
+		return err
+	}
+	if err := create(path, size, modTime); err != nil {
+		return err
+	}
+	l.path = path
+	l.h = sha256.New()
+	return nil
+}
+
+func (l *IntegrityLayer) Write(b []byte) (int, error) {
+	n, err := l.t.Write(b)
+	l.h.Write(b[:n])
+	return n, err
+}
+
+// CreateFile implements FileCreator. Files are written in parallel if the
+// underlying target supports it.
+func (l *IntegrityLayer) CreateFile(path string, size int64, modTime time.Time) (io.WriteCloser, error) {
+	path, err := CleanPath(path)
+	if err != nil {
+		return nil, err
+	}
+	w, err := l.files.CreateFile(path, size, modTime)
+	if err != nil {
+		return nil, err
+	}
+	return &hashingWriter{w: w, h: sha256.New(), done: func(h hash.Hash) { l.addHash(path, h) }}, nil
+}
+
+// hashingWriter hashes everything written to w and passes the hash to done
+// when closed.
+type hashingWriter struct {
+	w    io.WriteCloser
+	h    hash.Hash
+	done func(h hash.Hash)
+}
+
+func (w *hashingWriter) Write(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+	w.h.Write(b[:n])
+	return n, err
+}
+
+func (w *hashingWriter) Close() error {
+	if err := w.w.Close(); err != nil {
+		return err
+	}
+	w.done(w.h)
+	return nil
+}
+
+func (l *IntegrityLayer) Close() error {
+	l.finishFile()
+	manifest := FormatIntegrityManifest(l.hashes)
+	if err := l.t.Create(IntegrityManifestName, int64(len(manifest)), time.Now()); err != nil {
+		return fmt.Errorf("failed to create integrity manifest: %w", err)
+	}
+	if _, err := l.t.Write(manifest); err != nil {
+		return fmt.Errorf("failed to write integrity manifest: %w", err)
+	}
+	return l.t.Close()
+}
+
+// FormatIntegrityManifest formats a map of paths to hex-encoded SHA256
+// hashes in sha256sum format, sorted by path.
+func FormatIntegrityManifest(hashes map[string]string) []byte {
+	var paths []string
+	for p := range hashes {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	var b bytes.Buffer
+	for _, p := range paths {
+		fmt.Fprintf(&b, "%v  %v\n", hashes[p], p)
+	}
+	return b.Bytes()
+}
+
+// ParseIntegrityManifest parses a manifest in sha256sum format into a map of
+// paths to hex-encoded SHA256 hashes.
+func ParseIntegrityManifest(manifest []byte) (map[string]string, error) {
+	hashes := make(map[string]string)
+	s := bufio.NewScanner(bytes.NewReader(manifest))
+	for line := 1; s.Scan(); line++ {
+		if s.Text() == "" {
+			continue
+		}
+		parts := strings.SplitN(s.Text(), "  ", 2)
+		if len(parts) != 2 || len(parts[0]) != 2*sha256.Size {
+			return nil, fmt.Errorf("invalid integrity manifest line %d", line)
+		}
+		hashes[parts[1]] = strings.ToLower(parts[0])
+	}
+	return hashes, s.Err()
+}
+
+// CheckIntegrity compares the hashes of the files found in an archive with
+// the hashes from its integrity manifest and returns a description of every
+// difference. The manifest itself must not be part of found.
+func CheckIntegrity(manifest, found map[string]string) []string {
+	var problems []string
+	for p, want := range manifest {
+		got, ok := found[p]
+		switch {
+		case !ok:
+			problems = append(problems, fmt.Sprintf("%v: missing", p))
+		case got != want:
+			problems = append(problems, fmt.Sprintf("%v: hash mismatch, expected %v, got %v", p, want, got))
+		}
+	}
+	for p := range found {
+		if _, ok := manifest[p]; !ok {
+			problems = append(problems, fmt.Sprintf("%v: not listed in the integrity manifest", p))
+		}
+	}
+	sort.Strings(problems)
+	return problems
+}
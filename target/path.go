@@ -0,0 +1,40 @@
+package target
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// ErrUnsafePath is returned by Create for paths which could escape the root
+// of the target.
+var ErrUnsafePath = errors.New("unsafe path")
+
+// CleanPath canonicalizes a slash-separated path relative to the root of a
+// target. Backslashes are treated as separators. Empty and absolute paths,
+// paths with drive letters and paths containing ".." components are
+// rejected with ErrUnsafePath, as they could be used to write outside of the
+// target. All backends call it in Create, custom backends should do the same.
+func CleanPath(p string) (string, error) {
+	slashed := strings.ReplaceAll(p, "\\", "/")
+	if slashed == "" || strings.HasPrefix(slashed, "/") {
+		return "", fmt.Errorf("%w %q: must be relative", ErrUnsafePath, p)
+	}
+	if len(slashed) >= 2 && slashed[1] == ':' {
+		return "", fmt.Errorf("%w %q: must not contain a drive letter", ErrUnsafePath, p)
+	}
+	for _, part := range strings.Split(slashed, "/") {
+		if part == ".." {
+			return "", fmt.Errorf("%w %q: must not contain ..", ErrUnsafePath, p)
+		}
+		if strings.ContainsRune(part, 0) {
+			return "", fmt.Errorf("%w %q: must not contain NUL bytes", ErrUnsafePath, p)
+		}
+	}
+	cleaned := path.Clean(slashed)
+	if cleaned == "." {
+		return "", fmt.Errorf("%w %q: refers to the root", ErrUnsafePath, p)
+	}
+	return cleaned, nil
+}
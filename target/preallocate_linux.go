@@ -0,0 +1,17 @@
+package target
+
+import (
+	"os"
+	"syscall"
+)
+
+// fallocKeepSize is FALLOC_FL_KEEP_SIZE, which allocates space without
+// changing the size of the file, so that a shorter file doesn't end up with
+// trailing zeros.
+const fallocKeepSize = 0x1
+
+// preallocate reserves size bytes for f, reducing fragmentation and
+// metadata updates while it is written.
+func preallocate(f *os.File, size int64) error {
+	return syscall.Fallocate(int(f.Fd()), fallocKeepSize, 0, size)
+}
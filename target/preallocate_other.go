@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package target
+
+import "os"
+
+// preallocate is a no-op on platforms without fallocate.
+func preallocate(f *os.File, size int64) error {
+	return nil
+}
@@ -0,0 +1,81 @@
+package target
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Tar writes files into a zstd-compressed tar archive.
+type Tar struct {
+	outFile io.WriteCloser
+	outComp *zstd.Encoder
+	out     *tar.Writer
+}
+
+// NewTar creates a zstd-compressed tar archive at name.
+func NewTar(name string) (*Tar, error) {
+	outFile, err := os.Create(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create output archive: %w", err)
+	}
+	return NewTarWriter(outFile)
+}
+
+// NewTarWriter writes a zstd-compressed tar archive to w, which is closed
+// together with the archive.
+func NewTarWriter(w io.WriteCloser) (*Tar, error) {
+	outComp, err := zstd.NewWriter(w)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize zstd compressor: %w", err)
+	}
+	out := tar.NewWriter(outComp)
+	return &Tar{
+		outFile: w,
+		outComp: outComp,
+		out:     out,
+	}, nil
+}
+
+func (a *Tar) Close() error {
+	if err := a.out.Close(); err != nil {
+		return err
+	}
+	if err := a.outComp.Close(); err != nil {
+		return err
+	}
+	if err := a.outFile.Close(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (a *Tar) Create(path string, size int64, modTime time.Time) error {
+	return a.create(path, size, modTime, 0644)
+}
+
+// CreateExecutable implements Executables.
+func (a *Tar) CreateExecutable(path string, size int64, modTime time.Time) error {
+	return a.create(path, size, modTime, 0755)
+}
+
+func (a *Tar) create(path string, size int64, modTime time.Time, mode int64) error {
+	path, err := CleanPath(path)
+	if err != nil {
+		return err
+	}
+	return a.out.WriteHeader(&tar.Header{
+		Name:    path,
+		ModTime: modTime,
+		Size:    size,
+		Mode:    mode,
+	})
+}
+
+func (a *Tar) Write(b []byte) (int, error) {
+	return a.out.Write(b)
+}
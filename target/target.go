@@ -0,0 +1,108 @@
+// Package target contains the backends sysroots can be written to.
+//
+// Built-in backends are a local directory (Directory), a zstd-compressed tar
+// archive (Tar) and a zip archive (Zip). Additional backends can be
+// registered using Register and opened by their scheme using Open, which is
+// also how the winsysroot command line selects its output.
+package target
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Target receives the files of a sysroot. Files are written sequentially:
+// Create starts a new file with the given slash-separated path relative to
+// the sysroot root, expected size and modification time. Its content is then
+// written using Write until the next call to Create. Close finishes the last
+// file as well as the target itself. Targets which can write several files
+// at once additionally implement FileCreator.
+type Target interface {
+	Create(path string, size int64, modTime time.Time) error
+	io.WriteCloser
+}
+
+// Executables is implemented by targets which can mark files as executable.
+// CreateExecutable starts a new executable file like Create.
+type Executables interface {
+	CreateExecutable(path string, size int64, modTime time.Time) error
+}
+
+// CreateExecutable starts a new executable file in t. Targets not
+// implementing Executables get a regular file.
+func CreateExecutable(t Target, path string, size int64, modTime time.Time) error {
+	if e, ok := t.(Executables); ok {
+		return e.CreateExecutable(path, size, modTime)
+	}
+	return t.Create(path, size, modTime)
+}
+
+// Rooted is implemented by targets writing to a directory on the local
+// filesystem. Root returns that directory.
+type Rooted interface {
+	Root() string
+}
+
+// Factory creates a target from a backend-specific location, usually a path
+// or URL.
+type Factory func(location string) (Target, error)
+
+var (
+	registryMu sync.RWMutex
+	registry   = make(map[string]Factory)
+)
+
+// Register makes a target backend available under the given scheme. It
+// panics if the scheme is already registered.
+func Register(scheme string, factory Factory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if _, ok := registry[scheme]; ok {
+		panic("target: scheme " + scheme + " registered twice")
+	}
+	registry[scheme] = factory
+}
+
+// Schemes returns the sorted list of registered schemes.
+func Schemes() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	var schemes []string
+	for scheme := range registry {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+	return schemes
+}
+
+// Open creates a target from a specification in the form scheme:location,
+// for example tar:/tmp/sysroot.tar.zst.
+func Open(spec string) (Target, error) {
+	parts := strings.SplitN(spec, ":", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("target %q is not in the form scheme:location", spec)
+	}
+	registryMu.RLock()
+	factory, ok := registry[parts[0]]
+	registryMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown target scheme %q, available are %v", parts[0], strings.Join(Schemes(), ", "))
+	}
+	return factory(parts[1])
+}
+
+func init() {
+	Register("dir", func(location string) (Target, error) {
+		return NewDirectory(location), nil
+	})
+	Register("tar", func(location string) (Target, error) {
+		return NewTar(location)
+	})
+	Register("zip", func(location string) (Target, error) {
+		return NewZip(location)
+	})
+}
@@ -0,0 +1,275 @@
+package target
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestOpenZip(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "out.zip")
+	out, err := Open("zip:" + name)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	files := map[string]string{
+		"VC/Tools/MSVC/include/vcruntime.h": "#pragma once\n",
+		"Windows Kits/10/Lib/um/x64/a.lib":  "!<arch>\n",
+	}
+	for _, p := range []string{"VC/Tools/MSVC/include/vcruntime.h", "Windows Kits/10/Lib/um/x64/a.lib"} {
+		if err := out.Create(p, int64(len(files[p])), time.Now()); err != nil {
+			t.Fatalf("Create(%q): %v", p, err)
+		}
+		if _, err := out.Write([]byte(files[p])); err != nil {
+			t.Fatalf("Write(%q): %v", p, err)
+		}
+	}
+	if err := out.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	r, err := zip.OpenReader(name)
+	if err != nil {
+		t.Fatalf("failed to open written zip: %v", err)
+	}
+	defer r.Close()
+	if len(r.File) != len(files) {
+		t.Fatalf("got %d files, want %d", len(r.File), len(files))
+	}
+	for _, f := range r.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != files[f.Name] {
+			t.Errorf("%q: got content %q, want %q", f.Name, content, files[f.Name])
+		}
+	}
+}
+
+func TestCreateExecutable(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "out.zip")
+	z, err := NewZip(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := NewIntegrityLayer(z)
+	for _, f := range []struct {
+		path string
+		exec bool
+	}{{"llvm/bin/clang-cl", true}, {"llvm/lib/clang/18/include/intrin.h", false}} {
+		create := out.Create
+		if f.exec {
+			create = out.CreateExecutable
+		}
+		if err := create(f.path, 1, time.Now()); err != nil {
+			t.Fatalf("creating %v: %v", f.path, err)
+		}
+		if _, err := out.Write([]byte("x")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := out.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r, err := zip.OpenReader(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	modes := make(map[string]os.FileMode)
+	for _, f := range r.File {
+		modes[f.Name] = f.Mode()
+	}
+	if modes["llvm/bin/clang-cl"]&0111 == 0 {
+		t.Errorf("executable has mode %v", modes["llvm/bin/clang-cl"])
+	}
+	if modes["llvm/lib/clang/18/include/intrin.h"]&0111 != 0 {
+		t.Errorf("regular file has mode %v", modes["llvm/lib/clang/18/include/intrin.h"])
+	}
+}
+
+func TestOpenUnknownScheme(t *testing.T) {
+	if _, err := Open("nonexistent:/tmp/x"); err == nil {
+		t.Error("expected error for unknown scheme")
+	}
+	if _, err := Open("/tmp/x"); err == nil {
+		t.Error("expected error for missing scheme")
+	}
+}
+
+func TestCleanPath(t *testing.T) {
+	valid := map[string]string{
+		"VC/Tools/MSVC/include/vcruntime.h": "VC/Tools/MSVC/include/vcruntime.h",
+		"Windows Kits\\10\\Include\\um.h":   "Windows Kits/10/Include/um.h",
+		"a/./b//c":                          "a/b/c",
+		"a..b/c..":                          "a..b/c..",
+	}
+	for in, want := range valid {
+		if got, err := CleanPath(in); err != nil || got != want {
+			t.Errorf("CleanPath(%q) = %q, %v, want %q", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"", ".", "/etc/passwd", "\\\\server\\share\\x", "C:\\Windows\\x.dll", "c:x", "../x", "a/../../x", "a\\..\\..\\x", "a\x00b"} {
+		if _, err := CleanPath(in); !errors.Is(err, ErrUnsafePath) {
+			t.Errorf("CleanPath(%q) = %v, want ErrUnsafePath", in, err)
+		}
+	}
+
+	dir := t.TempDir()
+	d := NewDirectory(filepath.Join(dir, "root"))
+	if err := d.Create("../escaped", 0, time.Now()); !errors.Is(err, ErrUnsafePath) {
+		t.Errorf("Directory.Create with traversal: got %v, want ErrUnsafePath", err)
+	}
+	d.Close()
+	if _, err := os.Stat(filepath.Join(dir, "escaped")); err == nil {
+		t.Error("file was written outside of the target root")
+	}
+}
+
+func TestIntegrityLayer(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "out.zip")
+	z, err := NewZip(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := NewIntegrityLayer(z)
+	for _, p := range []string{"a.h", "lib/x64/b.lib"} {
+		if err := out.Create(p, int64(len(p)), time.Now()); err != nil {
+			t.Fatal(err)
+		}
+		out.Write([]byte(p))
+	}
+	if err := out.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := zip.OpenReader(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	var manifestRaw []byte
+	for _, f := range r.File {
+		if f.Name == IntegrityManifestName {
+			rc, _ := f.Open()
+			manifestRaw, _ = ioutil.ReadAll(rc)
+			rc.Close()
+		}
+	}
+	manifest, err := ParseIntegrityManifest(manifestRaw)
+	if err != nil {
+		t.Fatalf("ParseIntegrityManifest: %v", err)
+	}
+	found := map[string]string{
+		"a.h":           "e1fd4a2ad7d5cc4e8bd8b4b0a1b5bd7ed84a7df0b8f59d4a0d3e0a25a4ed8d7b",
+		"lib/x64/b.lib": manifest["lib/x64/b.lib"],
+		"extra.h":       manifest["a.h"],
+	}
+	problems := CheckIntegrity(manifest, found)
+	if len(problems) != 2 {
+		t.Errorf("expected a mismatch and an unlisted file, got %v", problems)
+	}
+	delete(found, "extra.h")
+	found["a.h"] = manifest["a.h"]
+	if problems := CheckIntegrity(manifest, found); len(problems) != 0 {
+		t.Errorf("unexpected problems %v", problems)
+	}
+}
+
+func TestFilesConcurrent(t *testing.T) {
+	dir := t.TempDir()
+	z, err := NewZip(filepath.Join(dir, "out.zip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, out := range []Target{NewDirectory(filepath.Join(dir, "root")), NewIntegrityLayer(z)} {
+		files := Files(out)
+		var wg sync.WaitGroup
+		errs := make(chan error, 16)
+		for i := 0; i < 16; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				content := strings.Repeat(strconv.Itoa(i), 1000)
+				w, err := files.CreateFile(fmt.Sprintf("dir%d/file%d.h", i%3, i), int64(len(content)), time.Now())
+				if err != nil {
+					errs <- err
+					return
+				}
+				for j := 0; j < len(content); j += 100 {
+					if _, err := w.Write([]byte(content[j : j+100])); err != nil {
+						errs <- err
+					}
+				}
+				errs <- w.Close()
+			}(i)
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			if err != nil {
+				t.Errorf("%T: %v", out, err)
+			}
+		}
+		if err := out.Close(); err != nil {
+			t.Fatalf("%T: Close: %v", out, err)
+		}
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(dir, "root", "dir1", "file7.h"))
+	if err != nil || string(content) != strings.Repeat("7", 1000) {
+		t.Errorf("directory target: got %q, %v", content, err)
+	}
+	r, err := zip.OpenReader(filepath.Join(dir, "out.zip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	// All files plus the integrity manifest
+	if len(r.File) != 17 {
+		t.Fatalf("got %d files in zip, want 17", len(r.File))
+	}
+	for _, f := range r.File {
+		rc, _ := f.Open()
+		content, _ := ioutil.ReadAll(rc)
+		rc.Close()
+		if f.Name != IntegrityManifestName && len(content) != 1000 && len(content) != 2000 {
+			t.Errorf("%q: got %d bytes, files were interleaved", f.Name, len(content))
+		}
+	}
+}
+
+func TestDirectoryFlushError(t *testing.T) {
+	full, err := os.OpenFile("/dev/full", os.O_WRONLY, 0)
+	if err != nil {
+		t.Skipf("/dev/full is not available: %v", err)
+	}
+	d := NewDirectory(t.TempDir())
+	if err := d.Create("a.h", 5, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	// Let the buffered writes of a.h fail like on a full disk.
+	d.currFile.f.Close()
+	d.currFile.f = full
+	d.currFile.w.Reset(full)
+	if _, err := d.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Create("b.h", 5, time.Now()); err == nil {
+		t.Error("expected the failed flush of a.h to be reported")
+	}
+}
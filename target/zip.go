@@ -0,0 +1,80 @@
+package target
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// Zip writes files into a zip archive.
+type Zip struct {
+	outFile io.WriteCloser
+	out     *zip.Writer
+	curr    io.Writer
+}
+
+// NewZip creates a zip archive at name.
+func NewZip(name string) (*Zip, error) {
+	outFile, err := os.Create(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create output archive: %w", err)
+	}
+	return NewZipWriter(outFile), nil
+}
+
+// NewZipWriter writes a zip archive to w, which is closed together with the
+// archive.
+func NewZipWriter(w io.WriteCloser) *Zip {
+	return &Zip{
+		outFile: w,
+		out:     zip.NewWriter(w),
+	}
+}
+
+func (z *Zip) Create(path string, size int64, modTime time.Time) error {
+	return z.create(path, modTime, 0)
+}
+
+// CreateExecutable implements Executables.
+func (z *Zip) CreateExecutable(path string, size int64, modTime time.Time) error {
+	return z.create(path, modTime, 0755)
+}
+
+// create starts a new file, mode is only stored if it is set.
+func (z *Zip) create(path string, modTime time.Time, mode os.FileMode) error {
+	path, err := CleanPath(path)
+	if err != nil {
+		return err
+	}
+	hdr := &zip.FileHeader{
+		Name:     path,
+		Method:   zip.Deflate,
+		Modified: modTime,
+	}
+	if mode != 0 {
+		hdr.SetMode(mode)
+	}
+	w, err := z.out.CreateHeader(hdr)
+	if err != nil {
+		return err
+	}
+	z.curr = w
+	return nil
+}
+
+func (z *Zip) Write(b []byte) (int, error) {
+	if z.curr == nil {
+		return 0, errors.New("write before create")
+	}
+	return z.curr.Write(b)
+}
+
+func (z *Zip) Close() error {
+	if err := z.out.Close(); err != nil {
+		return err
+	}
+	return z.outFile.Close()
+}
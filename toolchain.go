@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"git.dolansoft.org/lorenz/winsysroot/versions"
+	"git.dolansoft.org/lorenz/winsysroot/vfs"
+)
+
+// toolchainArch describes how an architecture is called by the tools
+// consuming a sysroot.
+type toolchainArch struct {
+	// Triple is the LLVM target triple.
+	Triple string
+	// Machine is the value of link.exe's /machine flag.
+	Machine string
+	// Processor is CMAKE_SYSTEM_PROCESSOR as set on Windows hosts.
+	Processor string
+	// ArchitectureID is CMAKE_<LANG>_COMPILER_ARCHITECTURE_ID of MSVC and
+	// clang-cl.
+	ArchitectureID string
+}
+
+var toolchainArchs = map[string]toolchainArch{
+	"x86":     {"i686-pc-windows-msvc", "x86", "X86", "X86"},
+	"x64":     {"x86_64-pc-windows-msvc", "x64", "AMD64", "x64"},
+	"arm":     {"thumbv7-pc-windows-msvc", "arm", "ARM", "ARMV7"},
+	"arm64":   {"aarch64-pc-windows-msvc", "arm64", "ARM64", "ARM64"},
+	"arm64ec": {"arm64ec-pc-windows-msvc", "arm64ec", "ARM64", "ARM64EC"},
+}
+
+// sysrootInfo describes a sysroot generated into a directory.
+type sysrootInfo struct {
+	// Root is the absolute path of the sysroot.
+	Root          string
+	MSVCVersion   string
+	SDKVersion    string
+	Architectures []string
+	// Overlay is the path of the VFS overlay, empty if the sysroot doesn't
+	// have one.
+	Overlay string
+	// LLVMDir is the directory containing the LLVM tools, empty if they are
+	// looked up in PATH.
+	LLVMDir string
+}
+
+// inspectSysroot finds the versions and architectures of the sysroot in
+// dir. If it contains several versions, the newest ones are used.
+func inspectSysroot(dir string) (*sysrootInfo, error) {
+	root, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	info := &sysrootInfo{Root: root}
+	if info.MSVCVersion, err = newestSubdir(filepath.Join(root, "VC", "Tools", "MSVC")); err != nil {
+		return nil, fmt.Errorf("%v does not contain MSVC: %w", dir, err)
+	}
+	if info.SDKVersion, err = newestSubdir(filepath.Join(root, "Windows Kits", "10", "Lib")); err != nil {
+		return nil, fmt.Errorf("%v does not contain a Windows SDK: %w", dir, err)
+	}
+	libs, err := ioutil.ReadDir(filepath.Join(root, "VC", "Tools", "MSVC", info.MSVCVersion, "lib"))
+	if err != nil {
+		return nil, fmt.Errorf("%v does not contain MSVC libraries: %w", dir, err)
+	}
+	for _, fi := range libs {
+		if _, ok := toolchainArchs[strings.ToLower(fi.Name())]; ok && fi.IsDir() {
+			info.Architectures = append(info.Architectures, strings.ToLower(fi.Name()))
+		}
+	}
+	if len(info.Architectures) == 0 {
+		return nil, fmt.Errorf("%v does not contain libraries for any known architecture", dir)
+	}
+	sort.Strings(info.Architectures)
+	if _, err := os.Stat(filepath.Join(root, vfs.OverlayName)); err == nil {
+		info.Overlay = filepath.Join(root, vfs.OverlayName)
+	}
+	return info, nil
+}
+
+// newestSubdir returns the name of the subdirectory of dir with the highest
+// version.
+func newestSubdir(dir string) (string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+	var names []string
+	for _, fi := range entries {
+		if fi.IsDir() {
+			names = append(names, fi.Name())
+		}
+	}
+	if len(names) == 0 {
+		return "", fmt.Errorf("no versions in %v", dir)
+	}
+	versions.Sort(names)
+	return names[len(names)-1], nil
+}
+
+// useBundledLLVM sets LLVMDir if the sysroot contains LLVM tools added by
+// --bundle-llvm.
+func (s *sysrootInfo) useBundledLLVM() {
+	if dir := filepath.Join(s.Root, "llvm", "bin"); isFile(filepath.Join(dir, "clang-cl")) {
+		s.LLVMDir = dir
+	}
+}
+
+// tool returns the command running the LLVM tool name.
+func (s *sysrootInfo) tool(name string) string {
+	if s.LLVMDir == "" {
+		return name
+	}
+	return filepath.Join(s.LLVMDir, name)
+}
+
+// hasArch reports whether the sysroot contains libraries for arch.
+func (s *sysrootInfo) hasArch(arch string) bool {
+	for _, a := range s.Architectures {
+		if a == arch {
+			return true
+		}
+	}
+	return false
+}
+
+// includeDirs returns the include directories of MSVC and the Windows SDK.
+func (s *sysrootInfo) includeDirs() []string {
+	dirs := []string{filepath.Join(s.Root, "VC", "Tools", "MSVC", s.MSVCVersion, "include")}
+	for _, d := range []string{"ucrt", "um", "shared", "winrt", "cppwinrt"} {
+		dirs = append(dirs, filepath.Join(s.Root, "Windows Kits", "10", "Include", s.SDKVersion, d))
+	}
+	return dirs
+}
+
+// libDirs returns the library directories of MSVC and the Windows SDK for
+// arch.
+func (s *sysrootInfo) libDirs(arch string) []string {
+	return []string{
+		filepath.Join(s.Root, "VC", "Tools", "MSVC", s.MSVCVersion, "lib", arch),
+		filepath.Join(s.Root, "Windows Kits", "10", "Lib", s.SDKVersion, "ucrt", arch),
+		filepath.Join(s.Root, "Windows Kits", "10", "Lib", s.SDKVersion, "um", arch),
+	}
+}
+
+// compileFlags returns the clang-cl flags for compiling against the
+// sysroot.
+func (s *sysrootInfo) compileFlags(arch string) []string {
+	flags := []string{
+		"--target=" + toolchainArchs[arch].Triple,
+		"/winsysroot", s.Root,
+		"/vctoolsversion", s.MSVCVersion,
+		"/winsdkversion", s.SDKVersion,
+	}
+	if s.Overlay != "" {
+		flags = append(flags, "-Xclang", "-ivfsoverlay", "-Xclang", s.Overlay)
+	}
+	return flags
+}
+
+// linkFlags returns the lld-link flags for linking against the sysroot.
+func (s *sysrootInfo) linkFlags(arch string) []string {
+	flags := []string{
+		"/machine:" + toolchainArchs[arch].Machine,
+		"/winsysroot:" + s.Root,
+		"/vctoolsversion:" + s.MSVCVersion,
+		"/winsdkversion:" + s.SDKVersion,
+	}
+	if s.Overlay != "" {
+		flags = append(flags, "/vfsoverlay:"+s.Overlay)
+	}
+	return flags
+}
+
+// cmakeToolchain returns a CMake toolchain file cross-compiling for arch with
+// clang-cl and lld-link against the sysroot.
+func (s *sysrootInfo) cmakeToolchain(arch string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# CMake toolchain for %v generated by winsysroot\n", arch)
+	fmt.Fprintf(&b, "set(CMAKE_SYSTEM_NAME Windows)\n")
+	fmt.Fprintf(&b, "set(CMAKE_SYSTEM_PROCESSOR %v)\n", toolchainArchs[arch].Processor)
+	fmt.Fprintf(&b, "set(WINSYSROOT %v)\n\n", cmakeQuote(s.Root))
+	for _, tool := range [][2]string{
+		{"CMAKE_C_COMPILER", "clang-cl"},
+		{"CMAKE_CXX_COMPILER", "clang-cl"},
+		{"CMAKE_LINKER", "lld-link"},
+		{"CMAKE_AR", "llvm-lib"},
+		{"CMAKE_RC_COMPILER", "llvm-rc"},
+		{"CMAKE_MT", "llvm-mt"},
+	} {
+		if s.LLVMDir != "" {
+			fmt.Fprintf(&b, "find_program(%v NAMES %v PATHS %v NO_DEFAULT_PATH REQUIRED)\n", tool[0], tool[1], cmakeQuote(s.LLVMDir))
+		} else {
+			fmt.Fprintf(&b, "find_program(%v NAMES %v REQUIRED)\n", tool[0], tool[1])
+		}
+	}
+	compile := strings.Join(cmakeQuoteAll(s.compileFlags(arch)), " ")
+	link := strings.Join(cmakeQuoteAll(s.linkFlags(arch)), " ")
+	fmt.Fprintf(&b, "\nset(CMAKE_C_FLAGS_INIT %v)\n", cmakeQuote(compile))
+	fmt.Fprintf(&b, "set(CMAKE_CXX_FLAGS_INIT %v)\n", cmakeQuote(compile))
+	for _, kind := range []string{"EXE", "SHARED", "MODULE"} {
+		fmt.Fprintf(&b, "set(CMAKE_%v_LINKER_FLAGS_INIT %v)\n", kind, cmakeQuote(link))
+	}
+	fmt.Fprintf(&b, "\nset(CMAKE_FIND_ROOT_PATH ${WINSYSROOT})\n")
+	fmt.Fprintf(&b, "set(CMAKE_FIND_ROOT_PATH_MODE_PROGRAM NEVER)\n")
+	return b.String()
+}
+
+// cmakeQuote quotes s as a CMake argument.
+func cmakeQuote(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, `$`, `\$`)
+	return `"` + r.Replace(s) + `"`
+}
+
+// cmakeQuoteAll quotes flags containing spaces so they survive being joined
+// into a command line string.
+func cmakeQuoteAll(flags []string) []string {
+	quoted := make([]string, len(flags))
+	for i, f := range flags {
+		if strings.ContainsAny(f, " \t") {
+			f = `"` + f + `"`
+		}
+		quoted[i] = f
+	}
+	return quoted
+}
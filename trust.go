@@ -0,0 +1,153 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"git.dolansoft.org/lorenz/winsysroot/certcheck"
+	"git.dolansoft.org/lorenz/winsysroot/manifest"
+	"git.dolansoft.org/lorenz/winsysroot/sysroot"
+)
+
+var (
+	requireSignedManifests bool
+	manifestTrustRoots     string
+	verifyAuthenticode     bool
+	authenticodeTrustRoots string
+	authenticodeIdentity   bool
+	onChecksumMismatch     = sysroot.ChecksumFail
+	requireSigner          bool
+	tlsPins                repeatedFlag
+	signingPins            repeatedFlag
+	checkRevocation        bool
+)
+
+// repeatedFlag collects the values of a flag which can be given multiple
+// times.
+type repeatedFlag []string
+
+func (r *repeatedFlag) String() string {
+	return strings.Join(*r, ", ")
+}
+
+func (r *repeatedFlag) Set(v string) error {
+	*r = append(*r, v)
+	return nil
+}
+
+// checksumPolicyFlag adapts sysroot.ChecksumPolicy to flag.Value.
+type checksumPolicyFlag struct {
+	p *sysroot.ChecksumPolicy
+}
+
+func (f checksumPolicyFlag) String() string {
+	if f.p == nil {
+		return sysroot.ChecksumFail.String()
+	}
+	return f.p.String()
+}
+
+func (f checksumPolicyFlag) Set(v string) error {
+	p, err := sysroot.ParseChecksumPolicy(v)
+	if err != nil {
+		return err
+	}
+	*f.p = p
+	return nil
+}
+
+// registerTrustFlags registers the flags controlling how downloaded content
+// is authenticated on fs. Like registerHTTPFlags, it is used for both the
+// main command and subcommands which download.
+func registerTrustFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&requireSignedManifests, "require-signed-manifests", false, "Fail unless the channel and installer manifests carry a valid signature chaining up to a trusted root")
+	fs.StringVar(&manifestTrustRoots, "manifest-trust-roots", "", "PEM file with the root certificates trusted for manifest signatures (default: the Microsoft roots, if included in the signature)")
+	fs.Var(checksumPolicyFlag{&onChecksumMismatch}, "on-checksum-mismatch", "What to do if a download doesn't match its hash from the manifest: fail, redownload (retry a few times, then fail) or warn (use it anyway)")
+	fs.BoolVar(&requireSigner, "require-signer", false, "Fail if a payload doesn't reference a signer listed in the manifest")
+	fs.Var(&tlsPins, "tls-pin", "Require a certificate with this public key (sha256//BASE64 of the SPKI) in the chain of every TLS connection, can be repeated")
+	fs.Var(&signingPins, "signing-pin", "Require a certificate with this public key (sha256//BASE64 of the SPKI) in the chain of the manifest signature, can be repeated; implies --require-signed-manifests")
+	fs.BoolVar(&checkRevocation, "check-revocation", false, "Check TLS and manifest signing certificates against the CRLs they reference")
+	fs.BoolVar(&verifyAuthenticode, "verify-authenticode", false, "Verify the Authenticode signatures of downloaded MSI, CAB and VSIX payloads against the signers in the manifest")
+	fs.StringVar(&authenticodeTrustRoots, "authenticode-trust-roots", "", "PEM file with root certificates Authenticode signers must chain up to (default: the Microsoft code signing roots, if included in the signature)")
+	fs.BoolVar(&authenticodeIdentity, "authenticode-identity-only", false, "Only check the identity of Authenticode signers, not that their certificates chain up to a trusted root")
+}
+
+func init() {
+	registerTrustFlags(flag.CommandLine)
+}
+
+// loadCertPool reads a PEM file of certificates.
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read trust roots: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %v", path)
+	}
+	return pool, nil
+}
+
+// manifestVerifyOptions returns the options for verifying manifest
+// signatures or nil if signatures are not required.
+func manifestVerifyOptions() (*manifest.VerifyOptions, error) {
+	if !requireSignedManifests && len(signingPins) == 0 {
+		return nil, nil
+	}
+	pins, err := certcheck.ParsePins(signingPins)
+	if err != nil {
+		return nil, err
+	}
+	opts := manifest.VerifyOptions{Check: chainCheck(pins)}
+	if manifestTrustRoots != "" {
+		pool, err := loadCertPool(manifestTrustRoots)
+		if err != nil {
+			return nil, err
+		}
+		opts.Roots = pool
+	}
+	return &opts, nil
+}
+
+// authenticodeRoots returns the configured Authenticode trust roots or nil if
+// there are none.
+func authenticodeRoots() (*x509.CertPool, error) {
+	if authenticodeIdentity && authenticodeTrustRoots != "" {
+		return nil, fmt.Errorf("--authenticode-identity-only and --authenticode-trust-roots are mutually exclusive")
+	}
+	if authenticodeTrustRoots == "" {
+		return nil, nil
+	}
+	return loadCertPool(authenticodeTrustRoots)
+}
+
+// crlChecker is shared by all checks so CRLs are only downloaded once.
+var crlChecker certcheck.CRLChecker
+
+// chainCheck returns the check to run on certificate chains with the given
+// pins, including revocation checks if enabled.
+func chainCheck(pins certcheck.Pins) certcheck.ChainCheck {
+	var revocation certcheck.ChainCheck
+	if checkRevocation {
+		revocation = crlChecker.Check
+	}
+	return certcheck.All(pins.Check, revocation)
+}
+
+// tlsConfig returns the TLS configuration for all connections or nil if the
+// default one is sufficient.
+func tlsConfig() (*tls.Config, error) {
+	if len(tlsPins) == 0 && !checkRevocation {
+		return nil, nil
+	}
+	pins, err := certcheck.ParsePins(tlsPins)
+	if err != nil {
+		return nil, err
+	}
+	return certcheck.TLSConfig(chainCheck(pins)), nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func init() {
+	subcommands = append(subcommands, &subcommand{
+		name:  "vcpkg",
+		short: "Generate vcpkg triplets and toolchains cross-compiling against a sysroot directory",
+		setup: setupVcpkg,
+	})
+}
+
+func setupVcpkg(fs *flag.FlagSet) func(ctx context.Context) error {
+	outDir := fs.String("out", "vcpkg-winsysroot", "Directory to write the triplets and toolchain files to")
+	archs := fs.String("architectures", "", "Comma-separated list of architectures to generate triplets for (default: all in the sysroot)")
+	linkage := fs.String("library-linkage", "dynamic", "VCPKG_LIBRARY_LINKAGE of the triplets, dynamic or static")
+	return func(ctx context.Context) error {
+		if fs.NArg() != 1 {
+			return stageErrorf(stageUsage, "", "", "usage: winsysroot vcpkg [flags] <sysroot-dir>")
+		}
+		if *linkage != "dynamic" && *linkage != "static" {
+			return stageErrorf(stageUsage, "", "", "--library-linkage must be dynamic or static")
+		}
+		return runVcpkg(fs.Arg(0), *outDir, *archs, *linkage)
+	}
+}
+
+// vcpkgTriplet returns the name of the triplet for arch.
+func vcpkgTriplet(arch string) string {
+	return arch + "-windows-winsysroot"
+}
+
+func runVcpkg(sysrootDir, outDir, archs, linkage string) error {
+	info, err := inspectSysroot(sysrootDir)
+	if err != nil {
+		return stageErrorf(stageUsage, "", "", "%w", err)
+	}
+	architectures := info.Architectures
+	if archs != "" {
+		architectures = strings.Split(archs, ",")
+		for _, arch := range architectures {
+			if !info.hasArch(arch) {
+				return stageErrorf(stageUsage, "", "", "sysroot does not contain %v, available are %v", arch, strings.Join(info.Architectures, ", "))
+			}
+		}
+	}
+	outDir, err = filepath.Abs(outDir)
+	if err != nil {
+		return stageErrorf(stageOutput, "", "", "%w", err)
+	}
+	for _, dir := range []string{"triplets", "toolchains"} {
+		if err := os.MkdirAll(filepath.Join(outDir, dir), 0755); err != nil {
+			return stageErrorf(stageOutput, "", "", "%w", err)
+		}
+	}
+	for _, arch := range architectures {
+		toolchain := filepath.Join(outDir, "toolchains", "winsysroot-"+arch+".cmake")
+		if err := ioutil.WriteFile(toolchain, []byte(info.cmakeToolchain(arch)), 0644); err != nil {
+			return stageErrorf(stageOutput, "", "", "%w", err)
+		}
+		var b strings.Builder
+		fmt.Fprintf(&b, "# vcpkg triplet cross-compiling for %v with clang-cl against %v\n", arch, info.Root)
+		fmt.Fprintf(&b, "set(VCPKG_TARGET_ARCHITECTURE %v)\n", arch)
+		fmt.Fprintf(&b, "set(VCPKG_CRT_LINKAGE dynamic)\n")
+		fmt.Fprintf(&b, "set(VCPKG_LIBRARY_LINKAGE %v)\n", linkage)
+		fmt.Fprintf(&b, "set(VCPKG_CMAKE_SYSTEM_NAME Windows)\n")
+		fmt.Fprintf(&b, "set(VCPKG_CHAINLOAD_TOOLCHAIN_FILE %v)\n", cmakeQuote(toolchain))
+		fmt.Fprintf(&b, "# There is no Visual Studio installation to take the environment from\n")
+		fmt.Fprintf(&b, "set(VCPKG_LOAD_VCVARS_ENV OFF)\n")
+		triplet := filepath.Join(outDir, "triplets", vcpkgTriplet(arch)+".cmake")
+		if err := ioutil.WriteFile(triplet, []byte(b.String()), 0644); err != nil {
+			return stageErrorf(stageOutput, "", "", "%w", err)
+		}
+	}
+	log.Printf("Wrote vcpkg triplets, use them with: vcpkg install --overlay-triplets=%v --triplet=%v", filepath.Join(outDir, "triplets"), vcpkgTriplet(architectures[0]))
+	return nil
+}
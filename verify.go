@@ -0,0 +1,146 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/klauspost/compress/zstd"
+
+	"git.dolansoft.org/lorenz/winsysroot/target"
+)
+
+func init() {
+	subcommands = append(subcommands, &subcommand{
+		name:  "verify-archive",
+		short: "Check the files in a sysroot archive against its embedded integrity manifest",
+		setup: setupVerifyArchive,
+	})
+}
+
+func setupVerifyArchive(fs *flag.FlagSet) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		if fs.NArg() != 1 {
+			return stageErrorf(stageUsage, "", "", "usage: winsysroot verify-archive <archive>")
+		}
+		return runVerifyArchive(ctx, fs.Arg(0))
+	}
+}
+
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// archiveHashes hashes all files in the archive at name, which is either a
+// zip file or an optionally zstd-compressed tarball. The contents of the
+// integrity manifest are returned separately.
+func archiveHashes(ctx context.Context, name string) (map[string]string, []byte, error) {
+	hashes := make(map[string]string)
+	var manifest []byte
+	add := func(path string, r io.Reader) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if path == target.IntegrityManifestName {
+			var err error
+			manifest, err = ioutil.ReadAll(r)
+			return err
+		}
+		h := sha256.New()
+		if _, err := io.Copy(h, r); err != nil {
+			return fmt.Errorf("failed to read %v: %w", path, err)
+		}
+		hashes[path] = hex.EncodeToString(h.Sum(nil))
+		return nil
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	magic, _ := br.Peek(4)
+	if bytes.HasPrefix(magic, []byte("PK")) {
+		info, err := f.Stat()
+		if err != nil {
+			return nil, nil, err
+		}
+		zr, err := zip.NewReader(f, info.Size())
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, zf := range zr.File {
+			if zf.FileInfo().IsDir() {
+				continue
+			}
+			rc, err := zf.Open()
+			if err != nil {
+				return nil, nil, err
+			}
+			err = add(zf.Name, rc)
+			rc.Close()
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		return hashes, manifest, nil
+	}
+
+	var r io.Reader = br
+	if bytes.Equal(magic, zstdMagic) {
+		dec, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer dec.Close()
+		r = dec
+	}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		if err := add(hdr.Name, tr); err != nil {
+			return nil, nil, err
+		}
+	}
+	return hashes, manifest, nil
+}
+
+func runVerifyArchive(ctx context.Context, name string) error {
+	found, manifestRaw, err := archiveHashes(ctx, name)
+	if err != nil {
+		return stageErrorf(stageOutput, "", "", "failed to read archive: %w", err)
+	}
+	if manifestRaw == nil {
+		return stageErrorf(stageOutput, "", "", "archive contains no integrity manifest (%v)", target.IntegrityManifestName)
+	}
+	manifest, err := target.ParseIntegrityManifest(manifestRaw)
+	if err != nil {
+		return stageErrorf(stageOutput, "", "", "%w", err)
+	}
+	problems := target.CheckIntegrity(manifest, found)
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+	if len(problems) > 0 {
+		return stageErrorf(stageOutput, "", "", "archive failed verification with %d problems", len(problems))
+	}
+	fmt.Printf("OK: %d files verified\n", len(found))
+	return nil
+}
@@ -0,0 +1,53 @@
+package versions
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"git.dolansoft.org/lorenz/winsysroot/manifest"
+)
+
+var toolsetPackageRegexp = regexp.MustCompile(`^Microsoft\.VC\.[0-9.]+\.Tools\.Host`)
+
+// ToolsetVersions returns the versions of all MSVC toolsets in the manifest
+// in ascending order.
+func ToolsetVersions(m *manifest.Installer) []string {
+	var versions []string
+	seen := make(map[string]bool)
+	for _, pkg := range m.Packages {
+		if !toolsetPackageRegexp.MatchString(pkg.ID) || seen[pkg.Version] {
+			continue
+		}
+		seen[pkg.Version] = true
+		versions = append(versions, pkg.Version)
+	}
+	Sort(versions)
+	return versions
+}
+
+// ResolveSDK resolves spec to a Windows SDK version available in the
+// manifest. A full version must be available exactly, "latest" selects the
+// newest SDK and any other range (see ParseRange) selects the newest SDK in
+// the range, so "10.0" selects the newest 10.0.x SDK.
+func ResolveSDK(m *manifest.Installer, spec string) (string, error) {
+	available := m.SDKVersions()
+	for _, v := range available {
+		if v == spec {
+			return v, nil
+		}
+	}
+	r, err := ParseRange(spec)
+	if err != nil {
+		return "", err
+	}
+	// A full version which didn't match exactly shouldn't be resolved to a
+	// newer one, only partial versions act as prefixes.
+	if r.Prefix != nil && len(r.Prefix) >= 3 {
+		return "", fmt.Errorf("Windows SDK %v not available, available versions are %v", spec, strings.Join(available, ", "))
+	}
+	if v, ok := Latest(available, r); ok {
+		return v, nil
+	}
+	return "", fmt.Errorf("no Windows SDK matching %v, available versions are %v", spec, strings.Join(available, ", "))
+}
@@ -0,0 +1,115 @@
+package versions
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Range is a set of versions. The zero value contains all versions.
+type Range struct {
+	// Min and Max are the lower and upper bounds, nil if unbounded.
+	Min, Max Version
+	// MinExclusive and MaxExclusive make the respective bound exclusive.
+	MinExclusive, MaxExclusive bool
+	// Prefix, if set, restricts the range to versions starting with it.
+	Prefix Version
+}
+
+// ParseRange parses a version range. Accepted forms are
+//
+//	latest, *              all versions
+//	10.0                   all versions starting with 10.0
+//	>=10.0.19041, <14.40   one-sided bounds (also >, <=)
+//	[14.30,14.40)          intervals as used by the installer manifests
+func ParseRange(s string) (Range, error) {
+	s = strings.TrimSpace(s)
+	switch {
+	case s == "latest" || s == "*":
+		return Range{}, nil
+	case strings.HasPrefix(s, "[") || strings.HasPrefix(s, "("):
+		return parseInterval(s)
+	case strings.HasPrefix(s, ">=") || strings.HasPrefix(s, "<="):
+		v, err := Parse(s[2:])
+		if err != nil {
+			return Range{}, err
+		}
+		if s[0] == '>' {
+			return Range{Min: v}, nil
+		}
+		return Range{Max: v}, nil
+	case strings.HasPrefix(s, ">") || strings.HasPrefix(s, "<"):
+		v, err := Parse(s[1:])
+		if err != nil {
+			return Range{}, err
+		}
+		if s[0] == '>' {
+			return Range{Min: v, MinExclusive: true}, nil
+		}
+		return Range{Max: v, MaxExclusive: true}, nil
+	}
+	v, err := Parse(s)
+	if err != nil {
+		return Range{}, err
+	}
+	return Range{Prefix: v}, nil
+}
+
+func parseInterval(s string) (Range, error) {
+	if len(s) < 2 || !strings.ContainsAny(s[len(s)-1:], "])") {
+		return Range{}, fmt.Errorf("invalid version range %q: missing closing bracket", s)
+	}
+	bounds := strings.Split(s[1:len(s)-1], ",")
+	if len(bounds) != 2 {
+		return Range{}, fmt.Errorf("invalid version range %q: expected two bounds", s)
+	}
+	r := Range{MinExclusive: s[0] == '(', MaxExclusive: s[len(s)-1] == ')'}
+	var err error
+	if b := strings.TrimSpace(bounds[0]); b != "" {
+		if r.Min, err = Parse(b); err != nil {
+			return Range{}, err
+		}
+	}
+	if b := strings.TrimSpace(bounds[1]); b != "" {
+		if r.Max, err = Parse(b); err != nil {
+			return Range{}, err
+		}
+	}
+	return r, nil
+}
+
+// Contains reports whether v is in the range.
+func (r Range) Contains(v Version) bool {
+	if r.Prefix != nil && !v.HasPrefix(r.Prefix) {
+		return false
+	}
+	if r.Min != nil {
+		c := v.Compare(r.Min)
+		if c < 0 || c == 0 && r.MinExclusive {
+			return false
+		}
+	}
+	if r.Max != nil {
+		c := v.Compare(r.Max)
+		if c > 0 || c == 0 && r.MaxExclusive {
+			return false
+		}
+	}
+	return true
+}
+
+// Latest returns the highest version out of available contained in r.
+// Entries which aren't valid versions are ignored.
+func Latest(available []string, r Range) (string, bool) {
+	var best string
+	var bestVersion Version
+	for _, s := range available {
+		v, err := Parse(s)
+		if err != nil || !r.Contains(v) {
+			continue
+		}
+		if bestVersion == nil || v.Compare(bestVersion) > 0 {
+			best, bestVersion = s, v
+		}
+	}
+	return best, bestVersion != nil
+}
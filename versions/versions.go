@@ -0,0 +1,133 @@
+// Package versions parses and compares the dotted version numbers used by
+// Windows SDKs (10.0.22621) and MSVC toolsets (14.38.33130) and resolves
+// version specifications against an installer manifest.
+package versions
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Version is a parsed dotted version number.
+type Version []int
+
+// Parse parses a dotted version number like 10.0.22621.
+func Parse(s string) (Version, error) {
+	if s == "" {
+		return nil, fmt.Errorf("empty version")
+	}
+	var v Version
+	for _, p := range strings.Split(s, ".") {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid version %q: component %q is not a number", s, p)
+		}
+		v = append(v, n)
+	}
+	return v, nil
+}
+
+// MustParse is like Parse but panics if s is not a valid version.
+func MustParse(s string) Version {
+	v, err := Parse(s)
+	if err != nil {
+		panic(err)
+	}
+	return v
+}
+
+// parseLenient parses s, mapping invalid components to -1 so that they sort
+// before all valid ones.
+func parseLenient(s string) Version {
+	var v Version
+	for _, p := range strings.Split(s, ".") {
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			n = -1
+		}
+		v = append(v, n)
+	}
+	return v
+}
+
+func (v Version) String() string {
+	parts := make([]string, len(v))
+	for i, n := range v {
+		parts[i] = strconv.Itoa(n)
+	}
+	return strings.Join(parts, ".")
+}
+
+// Compare compares v and w numerically component by component, returning
+// -1, 0 or 1 if v is smaller, equal or greater than w. If one version is a
+// prefix of the other, the shorter one is smaller.
+func (v Version) Compare(w Version) int {
+	for i := 0; i < len(v) && i < len(w); i++ {
+		if v[i] != w[i] {
+			if v[i] < w[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	switch {
+	case len(v) < len(w):
+		return -1
+	case len(v) > len(w):
+		return 1
+	}
+	return 0
+}
+
+// HasPrefix reports whether the leading components of v are equal to prefix.
+func (v Version) HasPrefix(prefix Version) bool {
+	if len(prefix) > len(v) {
+		return false
+	}
+	for i := range prefix {
+		if v[i] != prefix[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Compare compares two version strings like Version.Compare. Components
+// which aren't numbers sort before all numeric ones.
+func Compare(a, b string) int {
+	return parseLenient(a).Compare(parseLenient(b))
+}
+
+// Sort sorts version strings in ascending order.
+func Sort(vs []string) {
+	sort.SliceStable(vs, func(i, j int) bool { return Compare(vs[i], vs[j]) < 0 })
+}
+
+// Closest returns the version out of available which is closest to want.
+// Versions sharing a longer prefix of components are preferred, ties are
+// broken by the numerical distance of the first differing component.
+func Closest(want string, available []string) string {
+	wantParts := parseLenient(want)
+	var best string
+	bestPrefix, bestDist := -1, 0
+	for _, v := range available {
+		parts := parseLenient(v)
+		prefix := 0
+		for prefix < len(parts) && prefix < len(wantParts) && parts[prefix] == wantParts[prefix] {
+			prefix++
+		}
+		var dist int
+		if prefix < len(parts) && prefix < len(wantParts) {
+			dist = parts[prefix] - wantParts[prefix]
+			if dist < 0 {
+				dist = -dist
+			}
+		}
+		if prefix > bestPrefix || prefix == bestPrefix && dist < bestDist {
+			best, bestPrefix, bestDist = v, prefix, dist
+		}
+	}
+	return best
+}
@@ -0,0 +1,94 @@
+package versions
+
+import (
+	"reflect"
+	"testing"
+
+	"git.dolansoft.org/lorenz/winsysroot/manifest"
+)
+
+func TestCompare(t *testing.T) {
+	cases := []struct {
+		a, b string
+		want int
+	}{
+		{"10.0.22621", "10.0.22621", 0},
+		{"10.0.9600", "10.0.22621", -1},
+		{"14.40", "14.38.33130", 1},
+		{"10.0", "10.0.0", -1},
+		{"10.x", "10.0", -1},
+	}
+	for _, c := range cases {
+		if got := Compare(c.a, c.b); got != c.want {
+			t.Errorf("Compare(%q, %q) = %d, want %d", c.a, c.b, got, c.want)
+		}
+	}
+}
+
+func TestRange(t *testing.T) {
+	cases := []struct {
+		spec string
+		in   []string
+		out  []string
+	}{
+		{"latest", []string{"10.0.19041", "14.38.33130"}, nil},
+		{"10.0", []string{"10.0.19041", "10.0"}, []string{"10.1.1", "1.0"}},
+		{">=10.0.19041", []string{"10.0.19041", "10.0.22621"}, []string{"10.0.18362"}},
+		{"<14.40", []string{"14.39.1"}, []string{"14.40", "14.40.1"}},
+		{"[14.30,14.40)", []string{"14.30", "14.38.33130"}, []string{"14.29.30133", "14.40"}},
+		{"(10.0.19041,]", []string{"10.0.22621"}, []string{"10.0.19041"}},
+	}
+	for _, c := range cases {
+		r, err := ParseRange(c.spec)
+		if err != nil {
+			t.Errorf("ParseRange(%q): %v", c.spec, err)
+			continue
+		}
+		for _, v := range c.in {
+			if !r.Contains(MustParse(v)) {
+				t.Errorf("%q should contain %v", c.spec, v)
+			}
+		}
+		for _, v := range c.out {
+			if r.Contains(MustParse(v)) {
+				t.Errorf("%q should not contain %v", c.spec, v)
+			}
+		}
+	}
+	for _, spec := range []string{"", "abc", "[1.0]", "[1.0,2.0", ">=x"} {
+		if _, err := ParseRange(spec); err == nil {
+			t.Errorf("ParseRange(%q) succeeded, expected error", spec)
+		}
+	}
+}
+
+func TestResolveSDK(t *testing.T) {
+	m := &manifest.Installer{Packages: []manifest.Package{
+		{ID: "Win10SDK_10.0.19041"},
+		{ID: "Win11SDK_10.0.22621"},
+		{ID: "Win10SDK_10.0.18362"},
+		{ID: "Microsoft.VC.14.38.17.8.Tools.HostX64.TargetX64.base", Version: "14.38.33135"},
+		{ID: "Microsoft.VC.14.29.16.11.Tools.HostX64.TargetX64.base", Version: "14.29.30153"},
+	}}
+	cases := map[string]string{
+		"latest":                  "10.0.22621",
+		"10.0":                    "10.0.22621",
+		"10.0.19041":              "10.0.19041",
+		"[10.0.18362,10.0.22621)": "10.0.19041",
+		"10.0.99999":              "",
+		"11.0":                    "",
+	}
+	for spec, want := range cases {
+		got, err := ResolveSDK(m, spec)
+		if want == "" {
+			if err == nil {
+				t.Errorf("ResolveSDK(%q) = %v, expected error", spec, got)
+			}
+		} else if err != nil || got != want {
+			t.Errorf("ResolveSDK(%q) = %v, %v, want %v", spec, got, err, want)
+		}
+	}
+	if got, want := ToolsetVersions(m), []string{"14.29.30153", "14.38.33135"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ToolsetVersions() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,92 @@
+package vfs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"sync"
+	"time"
+
+	"git.dolansoft.org/lorenz/winsysroot/target"
+)
+
+// OverlayName is the name of the overlay file written into the target.
+const OverlayName = "vfsoverlay.yaml"
+
+// TargetLayer records all files written through it in a case-insensitive VFS
+// overlay and writes the overlay into the underlying target when closed.
+type TargetLayer struct {
+	t     target.Target
+	files target.FileCreator
+
+	mu sync.Mutex
+	i  *Inode
+	v  VFS
+}
+
+// NewTargetLayer wraps t. sysrootPath is the path the sysroot will be
+// accessible at when used.
+func NewTargetLayer(t target.Target, sysrootPath string) *TargetLayer {
+	var vfs VFS
+	vfs.Version = 0
+	vfs.RedirectingWith = RedirectingWithFallthrough
+	True := true
+	False := false
+	vfs.CaseSensitive = &False
+	vfs.OverlayRelative = &True
+
+	winsysRoot := Inode{
+		Type: "directory",
+		Name: sysrootPath,
+	}
+	vfs.Roots = append(vfs.Roots, &winsysRoot)
+	return &TargetLayer{
+		t:     t,
+		files: target.Files(t),
+		i:     &winsysRoot,
+		v:     vfs,
+	}
+}
+
+func (v *TargetLayer) place(p string) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.i.Place(path.Dir(p), true, &Inode{
+		Type:             "file",
+		Name:             path.Base(p),
+		ExternalContents: p,
+	})
+}
+
+func (v *TargetLayer) Create(p string, size int64, modTime time.Time) error {
+	if err := v.place(p); err != nil {
+		return err
+	}
+	return v.t.Create(p, size, modTime)
+}
+
+// CreateFile implements target.FileCreator. Files are written in parallel
+// if the underlying target supports it.
+func (v *TargetLayer) CreateFile(p string, size int64, modTime time.Time) (io.WriteCloser, error) {
+	if err := v.place(p); err != nil {
+		return nil, err
+	}
+	return v.files.CreateFile(p, size, modTime)
+}
+
+func (v *TargetLayer) Write(b []byte) (int, error) {
+	return v.t.Write(b)
+}
+
+func (v *TargetLayer) Close() error {
+	vfsRaw, err := json.MarshalIndent(v.v, "", "\t")
+	if err != nil {
+		return fmt.Errorf("failed to encode VFS overlay metadata: %w", err)
+	}
+	v.t.Create(OverlayName, int64(len(vfsRaw)), time.Now())
+	if _, err := v.t.Write(vfsRaw); err != nil {
+		return fmt.Errorf("failed to write VFS overlay: %w", err)
+	}
+	return v.t.Close()
+}
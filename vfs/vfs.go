@@ -1,4 +1,6 @@
-package main
+// Package vfs generates LLVM VFS overlays which make the sysroot usable on
+// case-sensitive filesystems.
+package vfs
 
 import (
 	"fmt"
@@ -29,6 +31,12 @@ type Inode struct {
 	UseExternalName  *bool    `json:"use-external-name,omitempty"`
 	ExternalContents string   `json:"external-contents,omitempty"`
 	Contents         []*Inode `json:"contents,omitempty"`
+
+	// children indexes the first indexed entries of Contents by their
+	// lowercased name so that Place doesn't need to scan all of them.
+	// Entries appended to Contents directly are indexed on the next call.
+	children map[string][]*Inode
+	indexed  int
 }
 
 func (r *Inode) Place(dir string, caseSensitive bool, i *Inode) error {
@@ -36,6 +44,24 @@ func (r *Inode) Place(dir string, caseSensitive bool, i *Inode) error {
 	return r.place(dirParts, caseSensitive, i)
 }
 
+// child returns the first entry called name.
+func (r *Inode) child(name string, caseSensitive bool) *Inode {
+	if r.children == nil {
+		r.children = make(map[string][]*Inode)
+	}
+	for _, sub := range r.Contents[r.indexed:] {
+		key := strings.ToLower(sub.Name)
+		r.children[key] = append(r.children[key], sub)
+	}
+	r.indexed = len(r.Contents)
+	for _, sub := range r.children[strings.ToLower(name)] {
+		if caseSensitive && strings.EqualFold(sub.Name, name) || !caseSensitive && sub.Name == name {
+			return sub
+		}
+	}
+	return nil
+}
+
 func (r *Inode) place(dir []string, caseSensitive bool, i *Inode) error {
 	if len(dir) == 0 {
 		r.Contents = append(r.Contents, i)
@@ -44,10 +70,8 @@ func (r *Inode) place(dir []string, caseSensitive bool, i *Inode) error {
 	if r.Type != "directory" {
 		return fmt.Errorf("failed placing inode, %q not a directory", r.Name)
 	}
-	for _, sub := range r.Contents {
-		if caseSensitive && strings.EqualFold(sub.Name, dir[0]) || !caseSensitive && sub.Name == dir[0] {
-			return sub.place(dir[1:], caseSensitive, i)
-		}
+	if sub := r.child(dir[0], caseSensitive); sub != nil {
+		return sub.place(dir[1:], caseSensitive, i)
 	}
 	newI := Inode{
 		Type: "directory",
@@ -0,0 +1,40 @@
+package vfs
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestPlace(t *testing.T) {
+	root := &Inode{Type: "directory", Name: "/sysroot"}
+	// Entries added without Place must be found as well.
+	root.Contents = append(root.Contents, &Inode{Type: "directory", Name: "VC"})
+	for _, p := range []string{"vc/include", "VC/INCLUDE", "Windows Kits/10/Include", "windows kits/10/Lib"} {
+		for n := 0; n < 3; n++ {
+			if err := root.Place(p, true, &Inode{Type: "file", Name: fmt.Sprintf("f%d.h", n)}); err != nil {
+				t.Fatalf("Place(%q): %v", p, err)
+			}
+		}
+	}
+	if len(root.Contents) != 2 {
+		t.Fatalf("got %d top-level entries, want 2", len(root.Contents))
+	}
+	vc := root.Contents[0]
+	if len(vc.Contents) != 1 || vc.Contents[0].Name != "include" || len(vc.Contents[0].Contents) != 6 {
+		t.Errorf("directories differing only in case were not merged: %+v", vc.Contents)
+	}
+	kits := root.Contents[1]
+	if kits.Name != "Windows Kits" || len(kits.Contents) != 1 || len(kits.Contents[0].Contents) != 2 {
+		t.Errorf("unexpected tree below %q: %+v", kits.Name, kits.Contents)
+	}
+
+	if err := root.Place("VC/include/f0.h/sub", true, &Inode{Type: "file", Name: "x"}); err == nil {
+		t.Error("placing an inode below a file succeeded")
+	}
+	if err := root.Place("vc", false, &Inode{Type: "file", Name: "x"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(root.Contents) != 3 {
+		t.Errorf("case-sensitive placement reused %q", root.Contents[0].Name)
+	}
+}
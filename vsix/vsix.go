@@ -0,0 +1,129 @@
+// Package vsix reads Visual Studio extension packages (VSIX) as distributed
+// through the Visual Studio installer manifests. A VSIX is an OPC (zip)
+// package containing an extension.vsixmanifest describing the package and
+// its payload files under Contents/, which are installed relative to the
+// Visual Studio installation directory.
+package vsix
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ManifestName is the name of the VSIX manifest inside the package.
+const ManifestName = "extension.vsixmanifest"
+
+// contentsPrefix is the prefix of all payload files in the package.
+const contentsPrefix = "Contents/"
+
+// Manifest contains the metadata from the extension.vsixmanifest.
+type Manifest struct {
+	ID          string
+	Version     string
+	Language    string
+	Publisher   string
+	DisplayName string
+	Description string
+}
+
+type xmlManifest struct {
+	Metadata struct {
+		Identity struct {
+			ID        string `xml:"Id,attr"`
+			Version   string `xml:"Version,attr"`
+			Language  string `xml:"Language,attr"`
+			Publisher string `xml:"Publisher,attr"`
+		} `xml:"Identity"`
+		DisplayName string `xml:"DisplayName"`
+		Description string `xml:"Description"`
+	} `xml:"Metadata"`
+}
+
+// File is a payload file of a VSIX.
+type File struct {
+	// InstallPath is the slash-separated path of the file relative to the
+	// Visual Studio installation directory.
+	InstallPath string
+	// Size is the uncompressed size in bytes.
+	Size int64
+	// CompressedSize is the size of the file in the package in bytes.
+	CompressedSize int64
+	// ModTime is the modification time of the file.
+	ModTime time.Time
+
+	zf *zip.File
+}
+
+// Open returns a reader for the contents of the file.
+func (f *File) Open() (io.ReadCloser, error) {
+	return f.zf.Open()
+}
+
+// Package is an opened VSIX package.
+type Package struct {
+	// Manifest is the parsed extension.vsixmanifest or nil if the package
+	// doesn't have one.
+	Manifest *Manifest
+	// Files are all payload files in the order they appear in the package.
+	Files []*File
+}
+
+// New opens the VSIX package contained in r, which is size bytes long.
+func New(r io.ReaderAt, size int64) (*Package, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open VSIX: %w", err)
+	}
+	var pkg Package
+	for _, zf := range zr.File {
+		if zf.Name == ManifestName {
+			m, err := parseManifest(zf)
+			if err != nil {
+				return nil, err
+			}
+			pkg.Manifest = m
+			continue
+		}
+		if !strings.HasPrefix(zf.Name, contentsPrefix) || strings.HasSuffix(zf.Name, "/") {
+			continue
+		}
+		// OPC part names are percent-encoded
+		name, err := url.PathUnescape(zf.Name)
+		if err != nil {
+			name = zf.Name
+		}
+		pkg.Files = append(pkg.Files, &File{
+			InstallPath:    strings.TrimPrefix(name, contentsPrefix),
+			Size:           int64(zf.UncompressedSize64),
+			CompressedSize: int64(zf.CompressedSize64),
+			ModTime:        zf.Modified,
+			zf:             zf,
+		})
+	}
+	return &pkg, nil
+}
+
+func parseManifest(zf *zip.File) (*Manifest, error) {
+	r, err := zf.Open()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %v: %w", ManifestName, err)
+	}
+	defer r.Close()
+	var raw xmlManifest
+	if err := xml.NewDecoder(r).Decode(&raw); err != nil {
+		return nil, fmt.Errorf("failed to parse %v: %w", ManifestName, err)
+	}
+	return &Manifest{
+		ID:          raw.Metadata.Identity.ID,
+		Version:     raw.Metadata.Identity.Version,
+		Language:    raw.Metadata.Identity.Language,
+		Publisher:   raw.Metadata.Identity.Publisher,
+		DisplayName: strings.TrimSpace(raw.Metadata.DisplayName),
+		Description: strings.TrimSpace(raw.Metadata.Description),
+	}, nil
+}
@@ -0,0 +1,59 @@
+package vsix
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+const testManifest = `<?xml version="1.0" encoding="utf-8"?>
+<PackageManifest Version="2.0.0" xmlns="http://schemas.microsoft.com/developer/vsx-schema/2011">
+  <Metadata>
+    <Identity Id="Microsoft.VC.Test" Version="14.38.33130" Language="en-US" Publisher="Microsoft Corporation" />
+    <DisplayName>Test package</DisplayName>
+  </Metadata>
+</PackageManifest>`
+
+func TestNew(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, content := range map[string]string{
+		ManifestName:          testManifest,
+		"[Content_Types].xml": "<Types/>",
+		"Contents/VC/Tools/MSVC/14.38.33130/include/with%20space.h": "spaced",
+	} {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(content))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	pkg, err := New(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if pkg.Manifest == nil || pkg.Manifest.ID != "Microsoft.VC.Test" || pkg.Manifest.Version != "14.38.33130" || pkg.Manifest.DisplayName != "Test package" {
+		t.Errorf("unexpected manifest %+v", pkg.Manifest)
+	}
+	if len(pkg.Files) != 1 {
+		t.Fatalf("got %d files, want 1", len(pkg.Files))
+	}
+	f := pkg.Files[0]
+	if want := "VC/Tools/MSVC/14.38.33130/include/with space.h"; f.InstallPath != want {
+		t.Errorf("InstallPath = %q, want %q", f.InstallPath, want)
+	}
+	r, err := f.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _ := ioutil.ReadAll(r)
+	r.Close()
+	if string(content) != "spaced" || f.Size != 6 {
+		t.Errorf("got content %q with size %d", content, f.Size)
+	}
+}
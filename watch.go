@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"git.dolansoft.org/lorenz/winsysroot/versions"
+)
+
+func init() {
+	subcommands = append(subcommands, &subcommand{
+		name:  "watch",
+		short: "Poll the channel manifests and run a hook when new Windows SDK or MSVC versions appear",
+		setup: setupWatch,
+	})
+}
+
+func setupWatch(fs *flag.FlagSet) func(ctx context.Context) error {
+	vsReleases := fs.String("vs-releases", *flagVSRelease, "Comma-separated list of Visual Studio major releases to watch")
+	interval := fs.Duration("interval", 6*time.Hour, "Time between polls")
+	statePath := fs.String("state", "", "File the versions seen are kept in, so changes while not running are noticed (default: only keep them in memory)")
+	hook := fs.String("exec", "", "Command to run for every change, it gets the change as JSON on stdin and in WINSYSROOT_* environment variables")
+	webhook := fs.String("webhook", "", "URL to POST every change to as JSON")
+	once := fs.Bool("once", false, "Poll once and exit instead of polling every --interval, for running from cron")
+	fs.StringVar(flagCacheDir, "cache-dir", "", flag.Lookup("cache-dir").Usage)
+	registerHTTPFlags(fs)
+	registerTrustFlags(fs)
+	return func(ctx context.Context) error {
+		if fs.NArg() != 0 || *interval <= 0 {
+			return stageErrorf(stageUsage, "", "", "usage: winsysroot watch [flags]")
+		}
+		if *hook == "" && *webhook == "" {
+			log.Printf("Neither --exec nor --webhook given, only logging changes")
+		}
+		w := &watcher{
+			releases:  strings.Split(*vsReleases, ","),
+			statePath: *statePath,
+			hook:      strings.Fields(*hook),
+			webhook:   *webhook,
+			state:     watchState{Releases: make(map[string]*watchRelease)},
+		}
+		if err := w.load(); err != nil {
+			return stageErrorf(stageUsage, "", "", "failed to read state: %w", err)
+		}
+		for {
+			err := w.poll(ctx)
+			if *once {
+				return err
+			}
+			if err != nil {
+				log.Print(err)
+			}
+			select {
+			case <-time.After(*interval):
+			case <-ctx.Done():
+				return nil
+			}
+		}
+	}
+}
+
+// watchState is the content of the --state file.
+type watchState struct {
+	Releases map[string]*watchRelease `json:"releases"`
+}
+
+// watchRelease records what was last seen of a Visual Studio release.
+type watchRelease struct {
+	ProductVersion  string    `json:"productVersion"`
+	SDKVersions     []string  `json:"sdkVersions"`
+	ToolsetVersions []string  `json:"toolsetVersions"`
+	Checked         time.Time `json:"checked"`
+}
+
+// watchChange describes new versions in a Visual Studio release. It is
+// passed to the hooks.
+type watchChange struct {
+	VSRelease              string   `json:"vsRelease"`
+	ProductVersion         string   `json:"productVersion"`
+	PreviousProductVersion string   `json:"previousProductVersion"`
+	NewSDKVersions         []string `json:"newSdkVersions"`
+	NewToolsetVersions     []string `json:"newToolsetVersions"`
+	// The newest versions in the release
+	LatestSDKVersion     string `json:"latestSdkVersion"`
+	LatestToolsetVersion string `json:"latestToolsetVersion"`
+}
+
+type watcher struct {
+	releases  []string
+	statePath string
+	hook      []string
+	webhook   string
+	state     watchState
+}
+
+func (w *watcher) load() error {
+	if w.statePath == "" {
+		return nil
+	}
+	raw, err := ioutil.ReadFile(w.statePath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(raw, &w.state); err != nil {
+		return err
+	}
+	if w.state.Releases == nil {
+		w.state.Releases = make(map[string]*watchRelease)
+	}
+	return nil
+}
+
+func (w *watcher) save() error {
+	if w.statePath == "" {
+		return nil
+	}
+	raw, err := json.MarshalIndent(&w.state, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp := w.statePath + ".tmp"
+	if err := ioutil.WriteFile(tmp, raw, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, w.statePath)
+}
+
+// poll checks all releases for new versions. The state of a release is only
+// updated once the hooks for its change succeeded, so failed hooks are run
+// again on the next poll.
+func (w *watcher) poll(ctx context.Context) error {
+	var failed []string
+	for _, release := range w.releases {
+		if err := w.pollRelease(ctx, release); err != nil {
+			log.Printf("Visual Studio %v: %v", release, err)
+			failed = append(failed, release)
+		}
+	}
+	if err := w.save(); err != nil {
+		return stageErrorf(stageOutput, "", "", "failed to write state: %w", err)
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("checking Visual Studio %v failed", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+func (w *watcher) pollRelease(ctx context.Context, release string) error {
+	channel, installer, err := fetchManifests(ctx, release)
+	if err != nil {
+		return err
+	}
+	sdkVersions := installer.SDKVersions()
+	versions.Sort(sdkVersions)
+	cur := &watchRelease{
+		ProductVersion:  channel.Info.ProductDisplayVersion,
+		SDKVersions:     sdkVersions,
+		ToolsetVersions: versions.ToolsetVersions(installer),
+		Checked:         time.Now(),
+	}
+	prev := w.state.Releases[release]
+	if prev == nil {
+		log.Printf("Visual Studio %v (%v) has Windows SDKs %v and MSVC toolsets %v", release, cur.ProductVersion, strings.Join(cur.SDKVersions, ", "), strings.Join(cur.ToolsetVersions, ", "))
+		w.state.Releases[release] = cur
+		return nil
+	}
+	change := watchChange{
+		VSRelease:              release,
+		ProductVersion:         cur.ProductVersion,
+		PreviousProductVersion: prev.ProductVersion,
+		NewSDKVersions:         newVersions(prev.SDKVersions, cur.SDKVersions),
+		NewToolsetVersions:     newVersions(prev.ToolsetVersions, cur.ToolsetVersions),
+	}
+	if len(change.NewSDKVersions) == 0 && len(change.NewToolsetVersions) == 0 {
+		w.state.Releases[release] = cur
+		return nil
+	}
+	if n := len(cur.SDKVersions); n > 0 {
+		change.LatestSDKVersion = cur.SDKVersions[n-1]
+	}
+	if n := len(cur.ToolsetVersions); n > 0 {
+		change.LatestToolsetVersion = cur.ToolsetVersions[n-1]
+	}
+	log.Printf("Visual Studio %v (%v) has new Windows SDKs [%v] and MSVC toolsets [%v]", release, cur.ProductVersion, strings.Join(change.NewSDKVersions, ", "), strings.Join(change.NewToolsetVersions, ", "))
+	if err := w.notify(ctx, &change); err != nil {
+		return err
+	}
+	w.state.Releases[release] = cur
+	return nil
+}
+
+// newVersions returns the versions in cur which are not in prev.
+func newVersions(prev, cur []string) []string {
+	seen := make(map[string]bool)
+	for _, v := range prev {
+		seen[v] = true
+	}
+	var added []string
+	for _, v := range cur {
+		if !seen[v] {
+			added = append(added, v)
+		}
+	}
+	return added
+}
+
+// notify runs the hook and calls the webhook for change.
+func (w *watcher) notify(ctx context.Context, change *watchChange) error {
+	raw, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+	if len(w.hook) > 0 {
+		cmd := exec.CommandContext(ctx, w.hook[0], w.hook[1:]...)
+		cmd.Stdin = bytes.NewReader(raw)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		cmd.Env = append(os.Environ(),
+			"WINSYSROOT_VS_RELEASE="+change.VSRelease,
+			"WINSYSROOT_PRODUCT_VERSION="+change.ProductVersion,
+			"WINSYSROOT_NEW_SDK_VERSIONS="+strings.Join(change.NewSDKVersions, ","),
+			"WINSYSROOT_NEW_TOOLSET_VERSIONS="+strings.Join(change.NewToolsetVersions, ","),
+			"WINSYSROOT_LATEST_SDK_VERSION="+change.LatestSDKVersion,
+			"WINSYSROOT_LATEST_TOOLSET_VERSION="+change.LatestToolsetVersion,
+		)
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("hook failed: %w", err)
+		}
+	}
+	if w.webhook != "" {
+		hc, err := httpClient()
+		if err != nil {
+			return err
+		}
+		if httpRequestTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, httpRequestTimeout)
+			defer cancel()
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.webhook, bytes.NewReader(raw))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		res, err := hc.Do(req)
+		if err != nil {
+			return fmt.Errorf("webhook failed: %w", err)
+		}
+		defer res.Body.Close()
+		if res.StatusCode < 200 || res.StatusCode > 299 {
+			msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+			return fmt.Errorf("webhook failed: HTTP %d: %s", res.StatusCode, msg)
+		}
+	}
+	return nil
+}
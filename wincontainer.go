@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"git.dolansoft.org/lorenz/winsysroot/target"
+	"git.dolansoft.org/lorenz/winsysroot/versions"
+)
+
+func init() {
+	// The scripts are added by wrapping the target with newWinContainer
+	// once the integrity layer is in place, so verify-archive covers them.
+	target.Register("wincontainer", func(location string) (target.Target, error) {
+		return target.NewZip(location)
+	})
+}
+
+// msvcLibPathRegexp matches the library directories of the architectures in
+// the sysroot.
+var msvcLibPathRegexp = regexp.MustCompile(`(?i)^VC/Tools/MSVC/[^/]+/lib/([^/]+)/`)
+
+// winContainer wraps the zip archive of the wincontainer scheme, which is
+// extracted inside a Windows container. It adds scripts setting up the
+// environment variables the MSVC tools and clang-cl read the include and
+// library directories from. On Windows neither the VFS overlay nor
+// /winsysroot are needed, so the sysroot can be used from any directory.
+type winContainer struct {
+	t     target.Target
+	files target.FileCreator
+	seen  sysrootPaths
+}
+
+func newWinContainer(t target.Target) *winContainer {
+	return &winContainer{t: t, files: target.Files(t)}
+}
+
+// sysrootPaths collects the versions and architectures of a sysroot from the
+// paths written to a target.
+type sysrootPaths struct {
+	mu          sync.Mutex
+	msvcVersion string
+	sdkVersion  string
+	archs       map[string]bool
+}
+
+func (s *sysrootPaths) observe(p string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Of several MSVC toolsets installed side by side, the newest is used.
+	if m := msvcPathRegexp.FindStringSubmatch(p); m != nil && (s.msvcVersion == "" || versions.Compare(m[1], s.msvcVersion) > 0) {
+		s.msvcVersion = m[1]
+	}
+	if m := sdkPathRegexp.FindStringSubmatch(p); m != nil && s.sdkVersion == "" {
+		s.sdkVersion = m[1]
+	}
+	if m := msvcLibPathRegexp.FindStringSubmatch(p); m != nil {
+		if arch := strings.ToLower(m[1]); toolchainArchs[arch].Triple != "" {
+			if s.archs == nil {
+				s.archs = make(map[string]bool)
+			}
+			s.archs[arch] = true
+		}
+	}
+}
+
+// architectures returns the sorted architectures seen.
+func (s *sysrootPaths) architectures() []string {
+	var archs []string
+	for arch := range s.archs {
+		archs = append(archs, arch)
+	}
+	sort.Strings(archs)
+	return archs
+}
+
+// check returns an error if no sysroot was written.
+func (s *sysrootPaths) check() error {
+	if s.msvcVersion == "" || s.sdkVersion == "" || len(s.archs) == 0 {
+		return fmt.Errorf("sysroot contains no MSVC libraries or no Windows SDK")
+	}
+	return nil
+}
+
+func (w *winContainer) Create(p string, size int64, modTime time.Time) error {
+	w.seen.observe(p)
+	return w.t.Create(p, size, modTime)
+}
+
+// CreateExecutable implements target.Executables.
+func (w *winContainer) CreateExecutable(p string, size int64, modTime time.Time) error {
+	w.seen.observe(p)
+	return target.CreateExecutable(w.t, p, size, modTime)
+}
+
+// CreateFile implements target.FileCreator.
+func (w *winContainer) CreateFile(p string, size int64, modTime time.Time) (io.WriteCloser, error) {
+	w.seen.observe(p)
+	return w.files.CreateFile(p, size, modTime)
+}
+
+func (w *winContainer) Write(p []byte) (int, error) {
+	return w.t.Write(p)
+}
+
+func (w *winContainer) Close() error {
+	if err := w.writeScripts(); err != nil {
+		return fmt.Errorf("failed to write provisioning scripts: %w", err)
+	}
+	return w.t.Close()
+}
+
+// writeScripts adds provision.ps1 and provision.cmd to the root of the
+// archive.
+func (w *winContainer) writeScripts() error {
+	if err := w.seen.check(); err != nil {
+		return err
+	}
+	archs := w.seen.architectures()
+	data := struct {
+		MSVCVersion, SDKVersion, DefaultArch string
+		Archs                                []string
+	}{w.seen.msvcVersion, w.seen.sdkVersion, archs[0], archs}
+	if w.seen.archs["x64"] {
+		data.DefaultArch = "x64"
+	}
+	for _, tmpl := range []*template.Template{winContainerPS1, winContainerCmd} {
+		name := tmpl.Name()
+		var b bytes.Buffer
+		if err := tmpl.Execute(&b, &data); err != nil {
+			return err
+		}
+		// Both are read by Windows tools, cmd.exe misparses labels and
+		// blocks in files with bare LF line endings.
+		script := bytes.ReplaceAll(b.Bytes(), []byte("\n"), []byte("\r\n"))
+		if err := w.t.Create(name, int64(len(script)), time.Now()); err != nil {
+			return err
+		}
+		if _, err := w.t.Write(script); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var winContainerPS1 = template.Must(template.New("provision.ps1").Parse(`# Sets up the sysroot with MSVC {{.MSVCVersion}} and Windows SDK {{.SDKVersion}} generated by
+# winsysroot, so clang-cl, lld-link and the MSVC tools find its headers and libraries.
+# In a Dockerfile, pass -Machine so the settings persist into later layers:
+#   RUN powershell -Command "Expand-Archive sysroot.zip C:\winsysroot; C:\winsysroot\provision.ps1 -Machine"
+param(
+    [ValidateSet({{range $i, $a := .Archs}}{{if $i}}, {{end}}'{{$a}}'{{end}})]
+    [string]$Arch = '{{.DefaultArch}}',
+    [switch]$Machine
+)
+$ErrorActionPreference = 'Stop'
+$root = $PSScriptRoot
+$vc = "$root\VC\Tools\MSVC\{{.MSVCVersion}}"
+$sdk = "$root\Windows Kits\10"
+$scope = if ($Machine) { 'Machine' } else { 'Process' }
+$vars = [ordered]@{
+    WINSYSROOT        = $root
+    VCToolsInstallDir = "$vc\"
+    VCToolsVersion    = '{{.MSVCVersion}}'
+    WindowsSdkDir     = "$sdk\"
+    WindowsSDKVersion = '{{.SDKVersion}}\'
+    INCLUDE           = @(
+        "$vc\include",
+        "$sdk\Include\{{.SDKVersion}}\ucrt",
+        "$sdk\Include\{{.SDKVersion}}\um",
+        "$sdk\Include\{{.SDKVersion}}\shared",
+        "$sdk\Include\{{.SDKVersion}}\winrt",
+        "$sdk\Include\{{.SDKVersion}}\cppwinrt"
+    ) -join ';'
+    LIB               = @(
+        "$vc\lib\$Arch",
+        "$sdk\Lib\{{.SDKVersion}}\ucrt\$Arch",
+        "$sdk\Lib\{{.SDKVersion}}\um\$Arch"
+    ) -join ';'
+}
+# Tools bundled with --bundle-llvm and the SDK tools if they were included
+$tools = @("$root\llvm\bin", "$sdk\bin\{{.SDKVersion}}\x64") | Where-Object { Test-Path $_ }
+if ($tools) {
+    $vars['PATH'] = (@($tools) + [Environment]::GetEnvironmentVariable('PATH', $scope)) -join ';'
+}
+foreach ($name in $vars.Keys) {
+    [Environment]::SetEnvironmentVariable($name, $vars[$name], $scope)
+    Set-Item -Path "env:$name" -Value $vars[$name]
+}
+Write-Host "Set up MSVC {{.MSVCVersion}} and Windows SDK {{.SDKVersion}} for $Arch from $root"
+`))
+
+var winContainerCmd = template.Must(template.New("provision.cmd").Parse(`@echo off
+rem Sets up the sysroot with MSVC {{.MSVCVersion}} and Windows SDK {{.SDKVersion}} generated by
+rem winsysroot in the current cmd.exe session, like vcvarsall.bat.
+rem Usage: provision.cmd [{{range $i, $a := .Archs}}{{if $i}}|{{end}}{{$a}}{{end}}] (default {{.DefaultArch}})
+set "WINSYSROOT=%~dp0"
+set "WINSYSROOT=%WINSYSROOT:~0,-1%"
+set "WINSYSROOT_ARCH=%~1"
+if "%WINSYSROOT_ARCH%"=="" set "WINSYSROOT_ARCH={{.DefaultArch}}"
+set "VCToolsInstallDir=%WINSYSROOT%\VC\Tools\MSVC\{{.MSVCVersion}}\"
+if not exist "%VCToolsInstallDir%lib\%WINSYSROOT_ARCH%" (
+    echo The sysroot does not contain %WINSYSROOT_ARCH%, available are {{range $i, $a := .Archs}}{{if $i}}, {{end}}{{$a}}{{end}} 1>&2
+    exit /b 1
+)
+set "VCToolsVersion={{.MSVCVersion}}"
+set "WindowsSdkDir=%WINSYSROOT%\Windows Kits\10\"
+set "WindowsSDKVersion={{.SDKVersion}}\"
+set "INCLUDE=%VCToolsInstallDir%include;%WindowsSdkDir%Include\{{.SDKVersion}}\ucrt;%WindowsSdkDir%Include\{{.SDKVersion}}\um;%WindowsSdkDir%Include\{{.SDKVersion}}\shared;%WindowsSdkDir%Include\{{.SDKVersion}}\winrt;%WindowsSdkDir%Include\{{.SDKVersion}}\cppwinrt"
+set "LIB=%VCToolsInstallDir%lib\%WINSYSROOT_ARCH%;%WindowsSdkDir%Lib\{{.SDKVersion}}\ucrt\%WINSYSROOT_ARCH%;%WindowsSdkDir%Lib\{{.SDKVersion}}\um\%WINSYSROOT_ARCH%"
+if exist "%WindowsSdkDir%bin\{{.SDKVersion}}\x64" set "PATH=%WindowsSdkDir%bin\{{.SDKVersion}}\x64;%PATH%"
+if exist "%WINSYSROOT%\llvm\bin" set "PATH=%WINSYSROOT%\llvm\bin;%PATH%"
+`))
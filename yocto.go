@@ -0,0 +1,88 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"text/template"
+)
+
+var (
+	flagYoctoRecipe = flag.String("yocto-recipe", "", "After building an archive, write a Yocto/OpenEmbedded recipe installing it to this path (- for stdout)")
+	flagYoctoURL    = flag.String("yocto-url", "", "URL the archive is published at, used in SRC_URI of --yocto-recipe (default: file URL of the local archive)")
+)
+
+var yoctoTemplate = template.Must(template.New("recipe").Parse(`# Generated by winsysroot
+SUMMARY = "Windows SDK {{.SDKVersion}} and MSVC sysroot from Visual Studio {{.VSRelease}}"
+DESCRIPTION = "Headers and libraries for cross-compiling Windows programs with clang-cl and lld-link"
+# The licenses of Visual Studio and the Windows SDK were accepted when the
+# sysroot was built, they don't allow redistributing it.
+LICENSE = "CLOSED"
+PV = "{{.SDKVersion}}"
+
+SRC_URI = "{{.SrcURI}}"
+SRC_URI[sha256sum] = "{{.SHA256}}"
+
+S = "${WORKDIR}/sysroot"
+
+do_configure[noexec] = "1"
+do_compile[noexec] = "1"
+
+do_install() {
+    install -d ${D}${datadir}/winsysroot
+    cp -R --no-dereference --preserve=mode,links ${S}/. ${D}${datadir}/winsysroot/
+}
+
+FILES:${PN} = "${datadir}/winsysroot"
+# Windows libraries and objects are not ELF files
+INSANE_SKIP:${PN} += "already-stripped arch file-rdeps"
+BBCLASSEXTEND = "native nativesdk"
+`))
+
+// checkYoctoFlags validates the --yocto-* flags before anything is built.
+func checkYoctoFlags(outSpec string) error {
+	if *flagYoctoRecipe == "" {
+		return nil
+	}
+	return checkArchiveOutput("--yocto-recipe", "--yocto-url", outSpec, *flagYoctoURL)
+}
+
+// emitYoctoRecipe writes the recipe for the archive written by the build.
+func emitYoctoRecipe(outSpec string, uploaded []byte, vsRelease, sdkVersion string) error {
+	url, typ, sum, err := builtArchive(outSpec, uploaded, *flagYoctoURL)
+	if err != nil {
+		return err
+	}
+	// The fetcher picks the unpacker by file name, which URLs of object
+	// storage or artifact servers don't necessarily end in.
+	srcURI := url + ";subdir=sysroot"
+	if !strings.HasPrefix(url, "file://") {
+		name := path.Base(strings.SplitN(url, "?", 2)[0])
+		if !strings.HasSuffix(name, "."+typ) {
+			name = "winsysroot-" + sdkVersion + "." + typ
+		}
+		srcURI += ";downloadfilename=" + name
+	}
+	data := struct {
+		VSRelease, SDKVersion, SrcURI, SHA256 string
+	}{
+		VSRelease:  vsRelease,
+		SDKVersion: sdkVersion,
+		SrcURI:     srcURI,
+		SHA256:     fmt.Sprintf("%x", sum),
+	}
+	if *flagYoctoRecipe == "-" {
+		return yoctoTemplate.Execute(os.Stdout, &data)
+	}
+	f, err := os.Create(*flagYoctoRecipe)
+	if err != nil {
+		return err
+	}
+	if err := yoctoTemplate.Execute(f, &data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}